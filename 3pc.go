@@ -1,5 +1,7 @@
 package commit
 
+import "fmt"
+
 // ------------------------------------------
 //                  COMMON
 // ------------------------------------------
@@ -15,6 +17,24 @@ const (
 	stateCommitted
 )
 
+func (s TransactionState) String() string {
+	switch s {
+	case stateOperations:
+		return "Operations"
+	case stateVotedNo:
+		return "VotedNo"
+	case stateVotedYes:
+		return "VotedYes"
+	case statePreCommitted:
+		return "PreCommitted"
+	case stateAborted:
+		return "Aborted"
+	case stateCommitted:
+		return "Committed"
+	}
+	return fmt.Sprintf("TransactionState(%d)", int(s))
+}
+
 const (
 	PhasePrepare   = "Prepare"
 	PhasePreCommit = "PreCommit"
@@ -22,6 +42,14 @@ const (
 	PhaseAborted   = "Aborted"
 )
 
+// phases that only appear in logs
+const (
+	phaseOperations = "Operations" // Get and Set
+	phaseQuery      = "Query"
+	phaseRecovery   = "Recovery"
+	phaseMigration  = "Migration" // see migrate.go
+)
+
 // Common args struct because RPCs generally have the transaction ID as their only argument
 type RPCArgs struct {
 	Tid int
@@ -31,8 +59,16 @@ type RPCArgs struct {
 // used in the prepare phase to determine if the server is relavent to the transaction
 type PrepareReply struct {
 	// Your fields here
-	Relevant bool // True if the server is relavant to the transaction
-	Vote     bool // True if the server is willing to vote yes
+	Relevant bool   // True if the server is relavant to the transaction
+	Vote     bool   // True if the server is willing to vote yes; only a relevant server votes
+	TooLarge bool   // True if the server voted no because its Commit reply wouldn't fit in a message
+	NoKey    string // The key the server doesn't store, if that's why it voted no
+}
+
+// PreCommitReply struct to hold the response of the precommit phase
+// used to confirm the server voted yes, so a vote damaged in flight is caught before commit
+type PreCommitReply struct {
+	Ack bool // True if the server voted yes and is ready to commit
 }
 
 // response to the rpc query with current state of the transaction
@@ -46,6 +82,13 @@ type QueryReply struct {
 type CommitReply struct {
 	// Your fields here
 	ReadValues map[string]interface{} // name of data : value of data
+	Reads      int                    // len(ReadValues), so the coordinator can tell if values were lost in flight
+}
+
+// ResolveReply struct to hold the coordinator's answer to a restarted server
+// used to finish a transaction the server found in doubt; see resolve.go
+type ResolveReply struct {
+	Outcome string // Committed or Aborted once the coordinator has decided, "" until then
 }
 
 // represents the operation to be performed in the transaction
@@ -0,0 +1,131 @@
+package commit
+
+//
+// shipping each committed transaction's writes somewhere else, for
+// change-data-capture or offline analysis, without scraping logs:
+//
+//   archive, err := OpenArchiveLog("/var/lib/3pc/server0.changes.jsonl")
+//   sv.SetArchiveSink(archive, "server0")
+//
+//   sv.SetArchiveSink(ArchiveFunc(func(rec ArchiveRecord) {
+//       index.Update(rec.Writes)
+//   }), "server0")
+//
+// a Server's record of a transaction has the values it set, each
+// key's version after the commit, which orders the writes to a key
+// across transactions, and the values it read. it's made once the
+// commit is applied and logged, from the Decision the Server
+// publishes (events.go), so sinks get records one at a time, in the
+// order the Server committed them, without the Server's lock held,
+// but from the goroutine that committed, so a slow sink slows the
+// protocol down. aborted transactions have no record.
+//
+// records aren't persisted: a record made just before a crash is
+// delivered, or not, and a restarted Server doesn't deliver again
+// the transactions it replays. a sink that must not miss a commit
+// can check for a gap in a key's versions. values are as the
+// transaction set them, not redacted (redact.go).
+//
+// an ArchiveLog appends JSON lines to a file or other writer, an
+// ArchiveChannel sends each record on a channel, whose reader must
+// keep up, and an ArchiveFunc calls a function.
+//
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+type ArchiveRecord struct {
+	Source    string                 `json:"source"` // the server's name
+	Tid       int                    `json:"tid"`
+	Writes    map[string]interface{} `json:"writes"`          // the value set for each key
+	Versions  map[string]int         `json:"versions"`        // each key's version after the commit
+	Reads     map[string]interface{} `json:"reads,omitempty"` // the value read for each key
+	Committed time.Time              `json:"committed"`
+}
+
+type ArchiveSink interface {
+	Archive(rec ArchiveRecord)
+}
+
+// ship the transactions the Server commits to sink, with name as
+// their source, in place of any earlier sink; nil ships nothing.
+func (sv *Server) SetArchiveSink(sink ArchiveSink, name string) {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	if sv.archive != nil {
+		sv.archive()
+		sv.archive = nil
+	}
+	if sink != nil {
+		sv.archive = sv.Subscribe(func(e Event) {
+			if d, ok := e.(Decision); ok && d.Outcome == PhaseCommitted {
+				sink.Archive(ArchiveRecord{Source: name, Tid: d.Tid, Writes: d.Values, Versions: d.Versions, Reads: d.ReadValues, Committed: d.Time})
+			}
+		})
+	}
+}
+
+// calls the function with each record.
+type ArchiveFunc func(rec ArchiveRecord)
+
+func (f ArchiveFunc) Archive(rec ArchiveRecord) {
+	f(rec)
+}
+
+// sends each record on the channel, waiting for it to be received.
+type ArchiveChannel chan<- ArchiveRecord
+
+func (ch ArchiveChannel) Archive(rec ArchiveRecord) {
+	ch <- rec
+}
+
+// writes each record as a line of JSON.
+type ArchiveLog struct {
+	mu  sync.Mutex
+	w   io.Writer
+	enc *json.Encoder
+	err error // the first write that failed
+}
+
+func MakeArchiveLog(w io.Writer) *ArchiveLog {
+	return &ArchiveLog{w: w, enc: json.NewEncoder(w)}
+}
+
+// an ArchiveLog that appends to the file at path, creating it if
+// need be.
+func OpenArchiveLog(path string) (*ArchiveLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return MakeArchiveLog(f), nil
+}
+
+func (al *ArchiveLog) Archive(rec ArchiveRecord) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	if err := al.enc.Encode(rec); err != nil && al.err == nil {
+		al.err = err
+	}
+}
+
+// close the writer if it's an io.Closer, and return the first
+// error in writing a record, if any.
+func (al *ArchiveLog) Close() error {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	if c, ok := al.w.(io.Closer); ok {
+		if err := c.Close(); err != nil && al.err == nil {
+			al.err = err
+		}
+	}
+	return al.err
+}
@@ -0,0 +1,83 @@
+package commit
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// Commits two transactions through a server shipping to a callback, aborts a third and resends
+// one Commit, then switches the server to a JSON log and commits a fourth
+// The callback should get one record per commit with its writes, versions and reads, and the
+// fourth should only reach the log
+func TestArchiveSink(t *testing.T) {
+	t.Parallel()
+
+	sv := MakeServer([]string{"x", "y", "z"}, MakePersister())
+	defer sv.Kill()
+	var mu sync.Mutex
+	var records []ArchiveRecord
+	sv.SetArchiveSink(ArchiveFunc(func(rec ArchiveRecord) {
+		mu.Lock()
+		defer mu.Unlock()
+		records = append(records, rec)
+	}), "server0")
+	commit := func(tid int) {
+		sv.Prepare(Metadata{}, &RPCArgs{Tid: tid}, &PrepareReply{})
+		sv.PreCommit(Metadata{}, &RPCArgs{Tid: tid}, &PreCommitReply{})
+		sv.Commit(Metadata{}, &RPCArgs{Tid: tid}, &CommitReply{})
+	}
+
+	sv.Set(1, "x", 1)
+	sv.Get(1, "y")
+	commit(1)
+	sv.Set(2, "x", 2)
+	sv.Set(2, "z", "hello")
+	commit(2)
+	sv.Set(3, "y", 3)
+	sv.Prepare(Metadata{}, &RPCArgs{Tid: 3}, &PrepareReply{})
+	sv.Abort(Metadata{}, &RPCArgs{Tid: 3}, &struct{}{})
+	sv.Commit(Metadata{}, &RPCArgs{Tid: 2}, &CommitReply{})
+
+	mu.Lock()
+	got := append([]ArchiveRecord(nil), records...)
+	mu.Unlock()
+	if len(got) != 2 {
+		t.Fatalf("expected a record for each of the 2 commits, got %+v", got)
+	}
+	for i, want := range []ArchiveRecord{
+		{Source: "server0", Tid: 1, Writes: map[string]interface{}{"x": 1}, Versions: map[string]int{"x": 1}, Reads: map[string]interface{}{"y": nil}},
+		{Source: "server0", Tid: 2, Writes: map[string]interface{}{"x": 2, "z": "hello"}, Versions: map[string]int{"x": 2, "z": 1}, Reads: map[string]interface{}{}},
+	} {
+		if got[i].Committed.IsZero() {
+			t.Fatalf("expected record %d to have a commit time", i)
+		}
+		want.Committed = got[i].Committed
+		if !reflect.DeepEqual(got[i], want) {
+			t.Fatalf("expected record %d to be %+v, got %+v", i, want, got[i])
+		}
+	}
+
+	var buf bytes.Buffer
+	archiveLog := MakeArchiveLog(&buf)
+	sv.SetArchiveSink(archiveLog, "server0")
+	sv.Set(4, "y", 4)
+	commit(4)
+	if err := archiveLog.Close(); err != nil {
+		t.Fatalf("ArchiveLog: %v", err)
+	}
+	var line ArchiveRecord
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("expected a JSON line, got %q: %v", buf.String(), err)
+	}
+	if line.Tid != 4 || line.Writes["y"] != 4.0 || line.Versions["y"] != 1 {
+		t.Fatalf("expected transaction 4's write of y in the log, got %+v", line)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(records) != 2 {
+		t.Fatalf("expected the replaced sink to get no more records, got %d", len(records))
+	}
+}
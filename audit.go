@@ -0,0 +1,170 @@
+package commit
+
+//
+// an audit trail with a record of every finished transaction:
+//
+//   log, err := OpenAuditLog("/var/log/3pc/audit.jsonl")
+//   co.SetAuditSink(log)
+//   sv.SetAuditSink(log, "server0")
+//
+// the coordinator's record of a transaction names its participants,
+// its decision, when it started and was reported, and how long it
+// spent in each phase. a server's record has the keys it read and
+// set, and is written as it commits or aborts. a transaction
+// reported again after recovery gets a second coordinator record;
+// a server's record isn't repeated.
+//
+// the records are made from the Decision events the Coordinator and
+// Server publish (events.go), so sinks get them one at a time,
+// without the Coordinator's or Server's lock held, but from the
+// goroutine that decided, so a slow sink slows the protocol down. an AuditLog appends JSON lines
+// to a file or other writer, an AuditChannel sends each record on
+// a channel, whose reader must keep up, and an AuditCollector keeps
+// them in memory, e.g. for a test to check.
+//
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+type AuditRecord struct {
+	Source       string                   `json:"source"` // "coordinator", or the server's name
+	Tid          int                      `json:"tid"`
+	Trace        string                   `json:"trace,omitempty"`        // coordinator only
+	Decision     string                   `json:"decision"`               // PhaseCommitted or PhaseAborted
+	Participants []int                    `json:"participants,omitempty"` // coordinator only: the servers with operations
+	Reads        []string                 `json:"reads,omitempty"`        // server only: the keys read
+	Writes       []string                 `json:"writes,omitempty"`       // server only: the keys set
+	Started      time.Time                `json:"started"`                // coordinator only: when it started or recovered the transaction
+	Finished     time.Time                `json:"finished"`
+	Phases       map[string]time.Duration `json:"phases,omitempty"` // coordinator only: time spent in each phase
+}
+
+type AuditSink interface {
+	Audit(rec AuditRecord)
+}
+
+// record the transactions the Coordinator reports in sink, in place
+// of any earlier sink; nil records nothing.
+func (co *Coordinator) SetAuditSink(sink AuditSink) {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+
+	if co.audit != nil {
+		co.audit()
+		co.audit = nil
+	}
+	if sink != nil {
+		co.audit = co.Subscribe(func(e Event) {
+			if d, ok := e.(Decision); ok {
+				sink.Audit(AuditRecord{
+					Source:       "coordinator",
+					Tid:          d.Tid,
+					Trace:        d.Trace,
+					Decision:     d.Outcome,
+					Participants: d.Participants,
+					Started:      d.Started,
+					Finished:     d.Time,
+					Phases:       d.Phases,
+				})
+			}
+		})
+	}
+}
+
+// record the transactions the Server commits or aborts in sink,
+// with name as their source, in place of any earlier sink; nil
+// records nothing.
+func (sv *Server) SetAuditSink(sink AuditSink, name string) {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	if sv.audit != nil {
+		sv.audit()
+		sv.audit = nil
+	}
+	if sink != nil {
+		sv.audit = sv.Subscribe(func(e Event) {
+			if d, ok := e.(Decision); ok {
+				sink.Audit(AuditRecord{Source: name, Tid: d.Tid, Decision: d.Outcome, Reads: d.Reads, Writes: d.Writes, Finished: d.Time})
+			}
+		})
+	}
+}
+
+// writes each record as a line of JSON.
+type AuditLog struct {
+	mu  sync.Mutex
+	w   io.Writer
+	enc *json.Encoder
+	err error // the first write that failed
+}
+
+func MakeAuditLog(w io.Writer) *AuditLog {
+	return &AuditLog{w: w, enc: json.NewEncoder(w)}
+}
+
+// an AuditLog that appends to the file at path, creating it if
+// need be.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return MakeAuditLog(f), nil
+}
+
+func (al *AuditLog) Audit(rec AuditRecord) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	if err := al.enc.Encode(rec); err != nil && al.err == nil {
+		al.err = err
+	}
+}
+
+// close the writer if it's an io.Closer, and return the first
+// error in writing a record, if any.
+func (al *AuditLog) Close() error {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	if c, ok := al.w.(io.Closer); ok {
+		if err := c.Close(); err != nil && al.err == nil {
+			al.err = err
+		}
+	}
+	return al.err
+}
+
+// sends each record on the channel, waiting for it to be received.
+type AuditChannel chan<- AuditRecord
+
+func (ch AuditChannel) Audit(rec AuditRecord) {
+	ch <- rec
+}
+
+// keeps every record in memory.
+type AuditCollector struct {
+	mu      sync.Mutex
+	records []AuditRecord
+}
+
+func (ac *AuditCollector) Audit(rec AuditRecord) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	ac.records = append(ac.records, rec)
+}
+
+// the records so far, oldest first.
+func (ac *AuditCollector) Records() []AuditRecord {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	return append([]AuditRecord(nil), ac.records...)
+}
@@ -0,0 +1,145 @@
+package commit
+
+import (
+	"3PhaseCommit/labrpc"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Commits one transaction and aborts another, with the coordinator's records
+// appended to a file and the servers' kept by collectors
+// Each should have one coordinator record with its participants, decision and
+// phases, and one record from each server that decided it, with its keys
+func TestAuditLog(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	auditLog, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatalf("OpenAuditLog failed: %v", err)
+	}
+
+	net := labrpc.MakeNetwork()
+	defer net.Cleanup()
+	tr := makeLabrpcTransport(net)
+	var servers []*Server
+	var collectors []*AuditCollector
+	var peers []PeerClient
+	for i, keys := range [][]string{{"x", "y"}, {"z"}} {
+		sv := MakeServer(keys, MakePersister())
+		defer sv.Kill()
+		collectors = append(collectors, &AuditCollector{})
+		name := []string{"server0", "server1"}[i]
+		sv.SetAuditSink(collectors[i], name)
+		tr.Serve(name, sv)
+		end, _ := tr.Dial(name)
+		servers = append(servers, sv)
+		peers = append(peers, end)
+	}
+	respChan := make(chan ResponseMsg)
+	co := MakeCoordinator(peers, respChan)
+	defer co.Kill()
+	co.SetAuditSink(auditLog)
+
+	servers[0].Set(0, "y", 1)
+	servers[0].Get(0, "x")
+	servers[1].Set(0, "z", 2)
+	servers[0].Set(1, "w", 3) // w isn't a key, so transaction 1 aborts
+	for tid, committed := range []bool{true, false} {
+		co.FinishTransaction(tid)
+		select {
+		case msg := <-respChan:
+			if msg.committed != committed {
+				t.Fatalf("expected transaction %d to commit: %v, got %+v", tid, committed, msg)
+			}
+		case <-time.After(waitTimeout):
+			t.Fatalf("Transaction %d got no response within %v", tid, waitTimeout)
+		}
+	}
+
+	// the records are written just after the outcomes are reported
+	var records []AuditRecord
+	for start := time.Now(); time.Since(start) < waitTimeout; time.Sleep(10 * time.Millisecond) {
+		records = nil
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("couldn't read the audit log: %v", err)
+		}
+		for scanner := bufio.NewScanner(f); scanner.Scan(); {
+			var rec AuditRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				t.Fatalf("bad audit record %q: %v", scanner.Text(), err)
+			}
+			records = append(records, rec)
+		}
+		f.Close()
+		if len(records) == 2 {
+			break
+		}
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 coordinator records, got %+v", records)
+	}
+	expected := []struct {
+		decision     string
+		participants []int
+		phases       []string
+	}{
+		{PhaseCommitted, []int{0, 1}, []string{PhasePrepare, PhasePreCommit, PhaseCommitted}},
+		{PhaseAborted, []int{0}, []string{PhasePrepare, PhaseAborted}},
+	}
+	for tid, rec := range records {
+		want := expected[tid]
+		if rec.Source != "coordinator" || rec.Tid != tid || rec.Decision != want.decision || rec.Trace == "" ||
+			!reflect.DeepEqual(rec.Participants, want.participants) {
+			t.Fatalf("expected transaction %d %s with participants %v, got %+v", tid, want.decision, want.participants, rec)
+		}
+		if len(rec.Phases) != len(want.phases) || rec.Finished.Before(rec.Started) {
+			t.Fatalf("expected transaction %d to spend time in %v, got %+v", tid, want.phases, rec)
+		}
+		for _, phase := range want.phases {
+			if _, ok := rec.Phases[phase]; !ok {
+				t.Fatalf("transaction %d's record has no time for %s: %+v", tid, phase, rec)
+			}
+		}
+	}
+
+	for start := time.Now(); time.Since(start) < waitTimeout; time.Sleep(10 * time.Millisecond) {
+		if len(collectors[0].Records()) == 2 && len(collectors[1].Records()) == 1 {
+			break
+		}
+	}
+	got := append(collectors[0].Records(), collectors[1].Records()...)
+	want := []AuditRecord{
+		{Source: "server0", Tid: 0, Decision: PhaseCommitted, Reads: []string{"x"}, Writes: []string{"y"}},
+		{Source: "server0", Tid: 1, Decision: PhaseAborted, Writes: []string{"w"}},
+		{Source: "server1", Tid: 0, Decision: PhaseCommitted, Writes: []string{"z"}},
+	}
+	for i := range got {
+		got[i].Finished = time.Time{}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the servers' records %+v, got %+v", want, got)
+	}
+
+	// reopening the log appends to it
+	if err := auditLog.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	auditLog, err = OpenAuditLog(path)
+	if err != nil {
+		t.Fatalf("OpenAuditLog failed: %v", err)
+	}
+	auditLog.Audit(AuditRecord{Source: "test", Tid: 2})
+	auditLog.Close()
+	data, _ := os.ReadFile(path)
+	if lines := bytes.Count(data, []byte("\n")); lines != 3 {
+		t.Fatalf("expected 3 records after reopening the log, got %d:\n%s", lines, data)
+	}
+}
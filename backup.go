@@ -0,0 +1,77 @@
+package commit
+
+//
+// copying a Server's state out and into a new Server, for backups
+// and for tests that clone a server:
+//
+//   var buf bytes.Buffer
+//   err := sv.Backup(&buf)
+//   ...
+//   clone, err := RestoreServer(&buf)
+//
+// a backup holds the Server's keys, its log limit, and what a
+// snapshot would: the committed store with each key's version, and
+// the transaction table, so the clone still knows which transactions
+// committed and aborted, what they read, and which ones are in doubt.
+// the clone re-acquires the in-doubt transactions' locks, as a
+// restarted Server does, and can then be asked to resolve them (see
+// resolve.go). it keeps its state in a new in-memory Persister.
+//
+// Backup() takes a consistent copy while holding the Server's lock,
+// so it can run while transactions do; it doesn't copy the reply
+// cache, hooks or subscriptions.
+//
+
+import (
+	"3PhaseCommit/labgob"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// bumped when what a backup holds changes
+const backupFormat = 1
+
+// what Backup() writes.
+type serverBackup struct {
+	Format   int
+	Keys     []string
+	MaxState int
+	State    []byte // as encodeState() makes it
+}
+
+// write a copy of the Server's state to w.
+func (sv *Server) Backup(w io.Writer) error {
+	sv.mu.Lock()
+	b := serverBackup{Format: backupFormat, MaxState: sv.maxstate, State: sv.encodeState()}
+	for key := range sv.store {
+		b.Keys = append(b.Keys, key)
+	}
+	sv.mu.Unlock()
+
+	sort.Strings(b.Keys)
+	return labgob.NewEncoder(w).Encode(b)
+}
+
+// a new Server with the state Backup() wrote to r.
+func RestoreServer(r io.Reader) (*Server, error) {
+	var b serverBackup
+	if err := labgob.NewDecoder(r).Decode(&b); err != nil {
+		return nil, fmt.Errorf("reading backup: %w", err)
+	}
+	if b.Format != backupFormat {
+		return nil, fmt.Errorf("backup format %d, expected %d", b.Format, backupFormat)
+	}
+	// a Server can't start from state it can't read
+	if _, err := decodeState(b.State); err != nil {
+		return nil, fmt.Errorf("reading backup: %w", err)
+	}
+
+	ps := MakePersister()
+	if b.MaxState < 0 {
+		ps.Save(b.State)
+	} else {
+		ps.SaveStateAndSnapshot(nil, b.State)
+	}
+	return MakeServerWithSnapshots(b.Keys, ps, b.MaxState), nil
+}
@@ -0,0 +1,58 @@
+package commit
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Backs up a server with one committed transaction and one that voted Yes, and restores it
+// The clone should have the committed value, hold the in-doubt lock and commit it on its own,
+// leaving the original alone, and a backup that isn't one should be refused
+func TestBackupRestore(t *testing.T) {
+	t.Parallel()
+
+	sv := MakeServerWithSnapshots([]string{"x", "y"}, MakePersister(), 1<<20)
+	defer sv.Kill()
+	sv.Set(0, "x", 1)
+	args := &RPCArgs{Tid: 0}
+	sv.Prepare(Metadata{}, args, &PrepareReply{})
+	sv.PreCommit(Metadata{}, args, &PreCommitReply{})
+	sv.Commit(Metadata{}, args, &CommitReply{})
+	sv.Set(1, "y", 2)
+	sv.Prepare(Metadata{}, &RPCArgs{Tid: 1}, &PrepareReply{})
+
+	var buf bytes.Buffer
+	if err := sv.Backup(&buf); err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	clone, err := RestoreServer(&buf)
+	if err != nil {
+		t.Fatalf("RestoreServer: %v", err)
+	}
+	defer clone.Kill()
+
+	if v := clone.storeValues()["x"]; v != 1 {
+		t.Fatalf("expected the clone to have x = 1, got %v", v)
+	}
+	if locks := clone.heldLocks(); !reflect.DeepEqual(locks, []string{"y"}) {
+		t.Fatalf("expected the clone to hold the in-doubt transaction's lock on y, got %v", locks)
+	}
+	args = &RPCArgs{Tid: 1}
+	clone.PreCommit(Metadata{}, args, &PreCommitReply{})
+	clone.Commit(Metadata{}, args, &CommitReply{})
+	if v := clone.storeValues()["y"]; v != 2 {
+		t.Fatalf("expected the clone to commit y = 2, got %v", v)
+	}
+	if v := sv.storeValues()["y"]; v != nil {
+		t.Fatalf("expected the original to be left alone, got y = %v", v)
+	}
+	if undecided := sv.undecided(); !reflect.DeepEqual(undecided, []int{1}) {
+		t.Fatalf("expected the original to still have transaction 1 in doubt, got %v", undecided)
+	}
+
+	if _, err := RestoreServer(strings.NewReader("not a backup")); err == nil {
+		t.Fatalf("expected RestoreServer to refuse a backup that isn't one")
+	}
+}
@@ -0,0 +1,246 @@
+package commit
+
+//
+// benchmarks for the coordinator and servers, built on the tester,
+// and for the codecs on their own.
+//
+// go test -run '^$' -bench . -benchtime 200x
+//
+// besides ns/op, where one op is one committed transaction, each
+// benchmark reports RPCs and bytes sent per transaction, and the
+// mean latency from finishTransaction() to the response arriving,
+// which doesn't include the tester noticing the response, and
+// mutex-wait-ns/txn, the time goroutines spent waiting for a lock,
+// sv.mu and co.mu included, per transaction.
+//
+// to see which locks those are, write each benchmark's mutex
+// profile, and to cut a CPU profile by phase, use the profile
+// labels (profile.go) the servers and coordinator are given:
+//
+// BENCH_MUTEXPROFILE=/tmp/prof go test -run '^$' -bench HotKey -cpuprofile cpu.out
+// go tool pprof /tmp/prof/BenchmarkHotKey.pprof
+// go tool pprof -tagfocus 3pc.phase=Prepare cpu.out
+//
+
+import (
+	"3PhaseCommit/codec"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// run b.N transactions with fn, nclients at a time, and report the
+// network cost per transaction. fn(tid, client) sends one
+// transaction's operations.
+func benchTransactions(b *testing.B, cfg *config, nclients int, fn func(tid int, client int)) {
+	cfg.mu.Lock()
+	cfg.coordinator.SetProfileLabels(true)
+	for _, sv := range cfg.servers {
+		sv.SetProfileLabels(true)
+	}
+	cfg.mu.Unlock()
+	profile := profileContention(b)
+	rpcs0 := cfg.rpcTotal()
+	bytes0 := cfg.bytesTotal()
+	b.ResetTimer()
+
+	var wg sync.WaitGroup
+	for client := range nclients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				tid := int(cfg.nextTid.Add(1))
+				if tid > b.N {
+					return
+				}
+				fn(tid, client)
+				cfg.finishTransaction(tid)
+				if !cfg.waitTransaction(tid).committed {
+					b.Errorf("transaction %d aborted", tid)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	b.StopTimer()
+	profile()
+	b.ReportMetric(float64(cfg.rpcTotal()-rpcs0)/float64(b.N), "rpcs/txn")
+	b.ReportMetric(float64(cfg.bytesTotal()-bytes0)/float64(b.N), "bytes/txn")
+
+	cfg.mu.Lock()
+	latencies := cfg.commitLatenciesLocked()
+	cfg.mu.Unlock()
+	var sum time.Duration
+	for _, d := range latencies {
+		sum += d
+	}
+	b.ReportMetric(float64(sum)/float64(len(latencies)), "latency-ns/txn")
+}
+
+// measure lock contention until the returned function is called,
+// and report it per transaction. if BENCH_MUTEXPROFILE names a
+// directory, write the mutex profile there, named after b.
+func profileContention(b *testing.B) func() {
+	dir := os.Getenv("BENCH_MUTEXPROFILE")
+	fraction := 0
+	if dir != "" {
+		fraction = 1
+	}
+	p := StartContentionProfile(fraction)
+
+	return func() {
+		var f *os.File
+		if dir != "" {
+			var err error
+			f, err = os.Create(filepath.Join(dir, strings.ReplaceAll(b.Name(), "/", "_")+".pprof"))
+			if err != nil {
+				b.Fatalf("mutex profile: %v", err)
+			}
+			defer f.Close()
+		}
+		waited, err := p.Stop(f)
+		if err != nil {
+			b.Fatalf("mutex profile: %v", err)
+		}
+		b.ReportMetric(float64(waited)/float64(b.N), "mutex-wait-ns/txn")
+	}
+}
+
+// one client writing one key: the latency of a whole 3PC round.
+func BenchmarkSingleKeyCommit(b *testing.B) {
+	cfg := make_config(b, [][]string{{"x"}, {"y"}, {"z"}}, false, false)
+	defer cfg.cleanup()
+
+	benchTransactions(b, cfg, 1, func(tid int, client int) {
+		cfg.sendSet(tid, "x", tid)
+	})
+}
+
+// clients writing their own keys on every server, so nothing waits
+// for a lock.
+func BenchmarkDisjointKeys(b *testing.B) {
+	const nclients = 4
+	keys := make([][]string, 3)
+	for i := range keys {
+		for c := range nclients {
+			keys[i] = append(keys[i], string(rune('a'+i))+string(rune('0'+c)))
+		}
+	}
+	cfg := make_config(b, keys, false, false)
+	defer cfg.cleanup()
+
+	benchTransactions(b, cfg, nclients, func(tid int, client int) {
+		for i := range keys {
+			cfg.sendSet(tid, keys[i][client], tid)
+		}
+	})
+}
+
+// clients all reading and writing the same key, so every Prepare
+// waits for the transaction before it.
+func BenchmarkHotKey(b *testing.B) {
+	cfg := make_config(b, [][]string{{"hot"}, {"y"}, {"z"}}, false, false)
+	defer cfg.cleanup()
+
+	benchTransactions(b, cfg, 4, func(tid int, client int) {
+		cfg.sendGet(tid, "hot")
+		cfg.sendSet(tid, "hot", tid)
+	})
+}
+
+// one client writing a 64KB value to every server.
+func BenchmarkLargeValue(b *testing.B) {
+	cfg := make_config(b, [][]string{{"x"}, {"y"}, {"z"}}, false, false)
+	defer cfg.cleanup()
+
+	value := strings.Repeat("v", 64*1024)
+	benchTransactions(b, cfg, 1, func(tid int, client int) {
+		cfg.sendSet(tid, "x", value)
+		cfg.sendSet(tid, "y", value)
+		cfg.sendSet(tid, "z", value)
+	})
+}
+
+// encoding and decoding a CommitReply for a transaction that read
+// a mix of 16 ints, strings, floats and bools, with each codec.
+// reports each encoding's size too.
+func BenchmarkCodecs(b *testing.B) {
+	reply := &CommitReply{ReadValues: make(map[string]interface{})}
+	for i := range 16 {
+		key := fmt.Sprintf("key%d", i)
+		switch i % 4 {
+		case 0:
+			reply.ReadValues[key] = i * 1000
+		case 1:
+			reply.ReadValues[key] = strings.Repeat("v", 32)
+		case 2:
+			reply.ReadValues[key] = float64(i) / 3
+		case 3:
+			reply.ReadValues[key] = i%2 == 0
+		}
+	}
+	reply.Reads = len(reply.ReadValues)
+
+	for _, c := range []codec.Codec{codec.Gob, codec.JSON, codec.Msgpack, ProtoCodec} {
+		b.Run(c.Name(), func(b *testing.B) {
+			var size int
+			for range b.N {
+				data, err := c.Marshal(reply)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := c.Unmarshal(data, &CommitReply{}); err != nil {
+					b.Fatal(err)
+				}
+				size = len(data)
+			}
+			b.ReportMetric(float64(size), "bytes/msg")
+		})
+	}
+}
+
+// transactions on their own keys committing at once through a server
+// kept on disk that fsyncs each vote, with and without a group commit
+// window. reports the fsyncs each transaction paid for.
+func BenchmarkGroupCommit(b *testing.B) {
+	for _, window := range []time.Duration{0, time.Millisecond, 10 * time.Millisecond} {
+		b.Run(fmt.Sprintf("window=%v", window), func(b *testing.B) {
+			ps, err := OpenPersister(b.TempDir(), DiskOptions{Fsync: true, GroupCommitWindow: window})
+			if err != nil {
+				b.Fatalf("OpenPersister: %v", err)
+			}
+			defer ps.Close()
+			keys := make([]string, 1024)
+			for i := range keys {
+				keys[i] = fmt.Sprintf("k%d", i)
+			}
+			sv := MakeServerWithSnapshots(keys, ps, 1<<20)
+			defer sv.Kill()
+
+			var next atomic.Int64
+			b.SetParallelism(8)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					tid := int(next.Add(1))
+					args := &RPCArgs{Tid: tid}
+					sv.Set(tid, keys[tid%len(keys)], tid)
+					sv.Prepare(Metadata{}, args, &PrepareReply{})
+					sv.PreCommit(Metadata{}, args, &PreCommitReply{})
+					sv.Commit(Metadata{}, args, &CommitReply{})
+				}
+			})
+			b.StopTimer()
+			ps.mu.Lock()
+			b.ReportMetric(float64(ps.disk.fsyncs)/float64(b.N), "fsyncs/txn")
+			ps.mu.Unlock()
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package commit
+
+//
+// a report of the transactions that aren't getting anywhere, for
+// debugging a test that deadlocks or livelocks:
+//
+//   fmt.Print(co.DumpBlocked(time.Second, servers))
+//
+//   transaction 4: in Prepare for 2.3s, waiting for servers [1]
+//     server 1: Prepare waiting for the write lock on "x", held by 2 (PreCommitted), 3 (Preparing)
+//   transaction 5: in Committed for 1.1s, waiting for servers [0]
+//     server 0: no answer to Commit yet
+//
+// it lists every undecided transaction that has been in one phase
+// for threshold or longer, the servers it still waits on, and, for
+// each of those that has a Prepare blocked on a lock, the key and
+// the transactions holding it: those that voted Yes and those whose
+// own Prepare took it and is now waiting for a later key. the
+// coordinator's transactions and each server's locks are read one
+// after another, so a transaction may have moved on in between.
+// servers[i] is server i, or nil if it isn't running.
+//
+
+import (
+	"fmt"
+	"maps"
+	"sort"
+	"strings"
+	"time"
+)
+
+// a Prepare blocked on a lock, and who holds it.
+type blockedPrepare struct {
+	op      Operation
+	holders []lockHolder // by tid
+}
+
+type lockHolder struct {
+	tid   int
+	state string
+	write bool
+}
+
+// note that tid's Prepare is about to wait for op's lock.
+func (sv *Server) setBlocked(tid int, op Operation) {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	sv.blocked[tid] = op
+}
+
+// the Server's blocked Prepares, by tid; none once killed, since
+// Kill() releases the locks.
+func (sv *Server) blockedPrepares() map[int]blockedPrepare {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	if sv.killed() || len(sv.blocked) == 0 {
+		return nil
+	}
+
+	// a transaction holds a lock on each key it voted Yes for, and a
+	// blocked Prepare holds those before the one it waits for
+	held := make(map[string][]lockHolder) // key : its holders
+	hold := func(tid int, op Operation, state string) {
+		held[op.Key] = append(held[op.Key], lockHolder{tid, state, !op.IsGet})
+	}
+	for tid, state := range sv.states {
+		if state == stateVotedYes || state == statePreCommitted {
+			for _, op := range lockOrder(sv.operations[tid]) {
+				hold(tid, op, state.String())
+			}
+		}
+	}
+	for tid, waitingFor := range sv.blocked {
+		for _, op := range lockOrder(sv.operations[tid]) {
+			if op.Key == waitingFor.Key {
+				break
+			}
+			hold(tid, op, "Preparing")
+		}
+	}
+
+	blocked := make(map[int]blockedPrepare, len(sv.blocked))
+	for tid, op := range sv.blocked {
+		bp := blockedPrepare{op: op}
+		for _, h := range held[op.Key] {
+			// readers share a key's lock
+			if h.write || !op.IsGet {
+				bp.holders = append(bp.holders, h)
+			}
+		}
+		sort.Slice(bp.holders, func(i, j int) bool { return bp.holders[i].tid < bp.holders[j].tid })
+		blocked[tid] = bp
+	}
+	return blocked
+}
+
+// a human-readable list of the transactions that have been in one
+// phase for threshold or longer, and what each is waiting for,
+// using servers' locks to say who blocks a Prepare.
+func (co *Coordinator) DumpBlocked(threshold time.Duration, servers []*Server) string {
+	type stuck struct {
+		tid     int
+		phase   string
+		in      time.Duration
+		waiting map[int]string // server : method
+	}
+	var transactions []stuck
+	co.mu.Lock()
+	now := co.clock.Now()
+	for tid, tran := range co.tran {
+		if in := now.Sub(tran.phaseStart); !tran.done && in >= threshold {
+			transactions = append(transactions, stuck{tid, tran.Phase, in, maps.Clone(tran.waiting)})
+		}
+	}
+	co.mu.Unlock()
+	if len(transactions) == 0 {
+		return fmt.Sprintf("no transaction has been in one phase for %v\n", threshold)
+	}
+	sort.Slice(transactions, func(i, j int) bool { return transactions[i].tid < transactions[j].tid })
+
+	blocked := make([]map[int]blockedPrepare, len(servers))
+	for i, sv := range servers {
+		if sv != nil {
+			blocked[i] = sv.blockedPrepares()
+		}
+	}
+
+	var b strings.Builder
+	for _, s := range transactions {
+		waiting := make([]int, 0, len(s.waiting))
+		for server := range s.waiting {
+			waiting = append(waiting, server)
+		}
+		sort.Ints(waiting)
+		fmt.Fprintf(&b, "transaction %d: in %s for %v, waiting for servers %v\n", s.tid, s.phase, s.in.Round(time.Millisecond), waiting)
+		for _, server := range waiting {
+			if server >= len(servers) || servers[server] == nil {
+				fmt.Fprintf(&b, "  server %d: not running\n", server)
+				continue
+			}
+			if bp, ok := blocked[server][s.tid]; ok {
+				lock := "write"
+				if bp.op.IsGet {
+					lock = "read"
+				}
+				holders := make([]string, len(bp.holders))
+				for i, h := range bp.holders {
+					holders[i] = fmt.Sprintf("%d (%s)", h.tid, h.state)
+				}
+				if len(holders) == 0 {
+					holders = []string{"no known transaction"}
+				}
+				fmt.Fprintf(&b, "  server %d: Prepare waiting for the %s lock on %q, held by %s\n", server, lock, bp.op.Key, strings.Join(holders, ", "))
+			} else {
+				fmt.Fprintf(&b, "  server %d: no answer to %s yet\n", server, s.waiting[server])
+			}
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,83 @@
+package commit
+
+import (
+	"3PhaseCommit/labrpc"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Holds transaction 0 at PreCommit with y locked, so that 1's Prepare takes x and waits for y,
+// and 2's Prepare waits to read x
+// The report should name each transaction's phase, the lock each Prepare waits for, and its
+// holders, whether they voted Yes or are still preparing
+func TestDumpBlocked(t *testing.T) {
+	t.Parallel()
+
+	net := labrpc.MakeNetwork()
+	defer net.Cleanup()
+	tr := makeLabrpcTransport(net)
+	sv := MakeServer([]string{"x", "y"}, MakePersister())
+	defer sv.Kill()
+	held := make(chan struct{})
+	sv.setHook(func(point hookPoint, method string, tid int, meta Metadata) {
+		if point == hookBefore && method == "Server.PreCommit" && tid == 0 {
+			<-held
+		}
+	})
+	tr.Serve("server0", sv)
+	end, _ := tr.Dial("server0")
+	respChan := make(chan ResponseMsg)
+	// Prepares mustn't time out while the test looks at them
+	co := makeCoordinator([]PeerClient{end}, respChan, realClock{}, waitTimeout, stdLogger("coordinator"))
+	defer co.Kill()
+
+	sv.Set(0, "y", 0)
+	sv.Set(1, "x", 1)
+	sv.Set(1, "y", 1)
+	sv.Get(2, "x")
+	for tid := range 3 {
+		co.FinishTransaction(tid)
+		for start := time.Now(); ; time.Sleep(time.Millisecond) {
+			co.mu.Lock()
+			preCommitting := co.tran[tid].waiting[0] == "PreCommit"
+			co.mu.Unlock()
+			_, blocked := sv.blockedPrepares()[tid]
+			if tid == 0 && preCommitting || blocked {
+				break
+			}
+			if time.Since(start) > waitTimeout {
+				t.Fatalf("transaction %d's Prepare never got as far as expected", tid)
+			}
+		}
+	}
+
+	dump := co.DumpBlocked(0, []*Server{sv})
+	for _, want := range []string{
+		"transaction 0: in PreCommit for ",
+		"  server 0: no answer to PreCommit yet\n",
+		"transaction 1: in Prepare for ",
+		"  server 0: Prepare waiting for the write lock on \"y\", held by 0 (VotedYes)\n",
+		"transaction 2: in Prepare for ",
+		"  server 0: Prepare waiting for the read lock on \"x\", held by 1 (Preparing)\n",
+	} {
+		if !strings.Contains(dump, want) {
+			t.Fatalf("expected the report to contain %q, got:\n%s", want, dump)
+		}
+	}
+	if dump := co.DumpBlocked(time.Hour, []*Server{sv}); !strings.HasPrefix(dump, "no transaction") {
+		t.Fatalf("expected no transaction to have been stuck for an hour, got:\n%s", dump)
+	}
+
+	close(held)
+	for range 3 {
+		select {
+		case m := <-respChan:
+			if !m.committed {
+				t.Fatalf("expected every transaction to commit, got %+v", m)
+			}
+		case <-time.After(waitTimeout):
+			t.Fatalf("no response within %v", waitTimeout)
+		}
+	}
+}
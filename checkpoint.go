@@ -0,0 +1,92 @@
+package commit
+
+//
+// checkpoints for long-lived servers, so the log a restarted Server
+// replays, and the disk it takes up, stays short however quiet the
+// server is:
+//
+//   sv := MakeServerWithSnapshots(keys, ps, 1<<20)
+//   sv.CheckpointEvery(time.Minute)
+//
+// a checkpoint writes a snapshot of the committed store and the
+// transaction table, which holds the in-doubt transactions and
+// their operations, and truncates the log, whose records the
+// snapshot now covers. a Server checkpoints anyway once its log
+// grows past maxstate; CheckpointEvery() also bounds how old the
+// log gets. the checkpoint is synced like a Yes vote (disk.go), so
+// Checkpoint() returns once it's durable.
+//
+// a Server made with MakeServer() saves its whole state each time
+// and has no log, so it has nothing to checkpoint.
+//
+
+import (
+	"context"
+	"hash/crc32"
+	"time"
+)
+
+// fold the log into a snapshot now.
+func (sv *Server) Checkpoint() error {
+	sv.mu.Lock()
+	records := len(sv.log)
+	if sv.maxstate < 0 || sv.killed() || records == 0 {
+		sv.mu.Unlock()
+		return nil
+	}
+	sv.checkpointLocked()
+	sv.mu.Unlock()
+
+	if err := sv.persister.Sync(); err != nil {
+		return err
+	}
+	sv.logFor(withTxn(context.Background(), noTid, "")).Debugf("checkpointed %d log records; snapshot %d bytes, deltas %d bytes", records, sv.persister.SnapshotSize(), sv.persister.DeltasSize())
+	return nil
+}
+
+// write a snapshot of the whole state, or a delta (delta.go), and
+// empty the log; sv.mu must be held.
+func (sv *Server) checkpointLocked() {
+	if sv.retain > 0 {
+		sv.persister.retain(sv.encodeLog(), sv.retain)
+	}
+	if sv.deltaCount < sv.deltaEvery {
+		sv.checkpointDeltaLocked()
+		return
+	}
+	sv.log = nil
+	snapshot := sv.encodeState()
+	sv.persister.SaveStateAndSnapshot(sv.encodeLog(), snapshot)
+	sv.deltas, sv.deltaCount, sv.snapshotSum = nil, 0, crc32.Checksum(snapshot, crcTable)
+}
+
+// checkpoint every interval; 0 stops the checkpoints.
+func (sv *Server) CheckpointEvery(interval time.Duration) {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	sv.checkpointEvery = interval
+	if interval > 0 && !sv.checkpointing {
+		sv.checkpointing = true
+		sv.spawn(sv.checkpointer)
+	}
+}
+
+func (sv *Server) checkpointer() {
+	for !sv.killed() {
+		sv.mu.Lock()
+		interval := sv.checkpointEvery
+		sv.mu.Unlock()
+		if interval <= 0 {
+			sv.sleep(slowCheckInterval)
+			continue
+		}
+		if !sv.sleep(interval) {
+			return
+		}
+
+		if err := sv.Checkpoint(); err != nil {
+			sv.logFor(withTxn(context.Background(), noTid, "")).Warnf("checkpoint failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package commit
+
+import (
+	"3PhaseCommit/labrpc"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Commits transactions through a server kept on disk that checkpoints every 20ms, with a log
+// limit it never reaches, then holds one transaction in doubt and checkpoints by hand
+// Each checkpoint should empty the log into the snapshot, and a server reopened from the
+// snapshot alone should have the committed values and still hold the in-doubt lock
+func TestCheckpoint(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	ps, err := OpenPersister(dir, DiskOptions{Fsync: true})
+	if err != nil {
+		t.Fatalf("OpenPersister: %v", err)
+	}
+	net := labrpc.MakeNetwork()
+	defer net.Cleanup()
+	tr := makeLabrpcTransport(net)
+	sv := MakeServerWithSnapshots([]string{"x", "y"}, ps, 1<<20)
+	prepared := make(chan struct{})
+	held := make(chan struct{})
+	defer close(held)
+	sv.setHook(func(point hookPoint, method string, tid int, meta Metadata) {
+		if point == hookBefore && method == "Server.PreCommit" && tid == 3 {
+			close(prepared)
+			<-held
+		}
+	})
+	tr.Serve("server0", sv)
+	end, _ := tr.Dial("server0")
+	respChan := make(chan ResponseMsg)
+	co := MakeCoordinator([]PeerClient{end}, respChan)
+	defer co.Kill()
+
+	for tid := 0; tid < 3; tid++ {
+		sv.Set(tid, "x", tid)
+		co.FinishTransaction(tid)
+		select {
+		case m := <-respChan:
+			if !m.committed {
+				t.Fatalf("expected transaction %d to commit, got %+v", tid, m)
+			}
+		case <-time.After(waitTimeout):
+			t.Fatalf("Transaction %d got no response within %v", tid, waitTimeout)
+		}
+	}
+	if ps.ServerStateSize() == 0 {
+		t.Fatalf("expected the transactions to be logged")
+	}
+	sv.CheckpointEvery(20 * time.Millisecond)
+	for start := time.Now(); ps.ServerStateSize() > 0 || ps.SnapshotSize() == 0; time.Sleep(5 * time.Millisecond) {
+		if time.Since(start) > waitTimeout {
+			t.Fatalf("expected a checkpoint to empty the log within %v", waitTimeout)
+		}
+	}
+	sv.CheckpointEvery(0)
+
+	sv.Set(3, "y", 3)
+	co.FinishTransaction(3)
+	select {
+	case <-prepared:
+	case <-time.After(waitTimeout):
+		t.Fatalf("Transaction 3 never reached PreCommit")
+	}
+	if err := sv.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint: %v", err)
+	}
+	if n := ps.ServerStateSize(); n != 0 {
+		t.Fatalf("expected an empty log after checkpointing, got %d bytes", n)
+	}
+	sv.Kill()
+	for start := time.Now(); sv.goroutines() > 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > waitTimeout {
+			t.Fatalf("expected the checkpointer to return once the server was killed")
+		}
+	}
+	ps.Close()
+
+	ps, err = OpenPersister(dir, DiskOptions{Fsync: true})
+	if err != nil {
+		t.Fatalf("OpenPersister again: %v", err)
+	}
+	defer ps.Close()
+	sv = MakeServerWithSnapshots([]string{"x", "y"}, ps, 1<<20)
+	defer sv.Kill()
+	if v := sv.storeValues()["x"]; v != 2 {
+		t.Fatalf("expected x to be 2 after reopening, got %v", v)
+	}
+	if locks := sv.heldLocks(); !reflect.DeepEqual(locks, []string{"y"}) {
+		t.Fatalf("expected the in-doubt transaction to hold y after reopening, got %v", locks)
+	}
+}
@@ -0,0 +1,71 @@
+package commit
+
+//
+// time as seen by the Coordinator's timeouts.
+//
+// the Coordinator reads the time only through a Clock, so
+// the tester can hand it a SimClock and decide exactly when
+// a timeout fires, instead of waiting for it in real time.
+//
+// clock := MakeSimClock()
+// clock.Advance(phaseTimeout) -- every pending timeout expires
+//
+
+import (
+	"sync"
+	"time"
+)
+
+type Clock interface {
+	Now() time.Time
+}
+
+// the wall clock, used outside of tests.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// a Clock that only moves when Advance() is called.
+type SimClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func MakeSimClock() *SimClock {
+	return &SimClock{now: time.Unix(0, 0)}
+}
+
+func (c *SimClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// move the clock forward by d.
+// a negative d is ignored: simulated time never runs backwards.
+func (c *SimClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if d > 0 {
+		c.now = c.now.Add(d)
+	}
+}
+
+// how often sleep() looks at the Coordinator's clock.
+const sleepCheckInterval = time.Millisecond
+
+// wait until d has passed on the Coordinator's clock, so that a
+// SimClock's Advance() ends the wait; false if the Coordinator was
+// killed first.
+func (co *Coordinator) sleep(d time.Duration) bool {
+	until := co.clock.Now().Add(d)
+	for co.clock.Now().Before(until) {
+		if co.killed() {
+			return false
+		}
+		time.Sleep(sleepCheckInterval)
+	}
+	return !co.killed()
+}
@@ -0,0 +1,247 @@
+package commit
+
+//
+// the protocol's messages under other codecs than gob:
+//
+//   cfg.net.SetCodec(ProtoCodec) // on a labrpc.Network
+//   tr := MakeTCPTransport()
+//   tr.SetCodec(codec.Msgpack)   // on every node
+//
+// ProtoCodec encodes the messages in 3pc.go in their commitpb form,
+// as the gRPC transport sends them, so it carries the same values;
+// see grpc.go. a TCPTransport with a codec frames each net/rpc
+// message itself, in place of net/rpc's gob stream; servers and
+// coordinators must use the same codec.
+//
+
+import (
+	"3PhaseCommit/codec"
+	"3PhaseCommit/commitpb"
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/rpc"
+	"reflect"
+
+	"google.golang.org/protobuf/proto"
+)
+
+var ProtoCodec codec.Codec = protoCodec{}
+
+type protoCodec struct{}
+
+func (protoCodec) Name() string { return "commitpb" }
+
+func (protoCodec) Marshal(v interface{}) ([]byte, error) {
+	m, err := messageToPB(v)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(m)
+}
+
+// the commitpb form of one of the protocol's messages.
+func messageToPB(v interface{}) (proto.Message, error) {
+	switch v := v.(type) {
+	case struct{}, *struct{}:
+		return &commitpb.Empty{}, nil
+	case *RPCArgs:
+		if v == nil {
+			return &commitpb.RPCArgs{}, nil
+		}
+		return argsToPB(v), nil
+	case *TCPArgs:
+		pb := &commitpb.TCPArgs{Meta: v.Meta}
+		if v.Args != nil {
+			pb.Args = argsToPB(v.Args)
+		}
+		return pb, nil
+	case *PrepareReply:
+		return &commitpb.PrepareReply{Relevant: v.Relevant, Vote: v.Vote, TooLarge: v.TooLarge, NoKey: v.NoKey}, nil
+	case *PreCommitReply:
+		return &commitpb.PreCommitReply{Ack: v.Ack}, nil
+	case *CommitReply:
+		return commitReplyToPB(*v)
+	case *QueryReply:
+		return queryReplyToPB(*v)
+	}
+	return nil, fmt.Errorf("%T isn't one of the protocol's messages", v)
+}
+
+func (protoCodec) Unmarshal(data []byte, v interface{}) error {
+	// labrpc decodes pointer args into a pointer to a nil pointer
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Pointer && rv.Elem().Kind() == reflect.Pointer {
+		if rv.Elem().IsNil() {
+			rv.Elem().Set(reflect.New(rv.Elem().Type().Elem()))
+		}
+		rv = rv.Elem()
+	}
+
+	switch v := rv.Interface().(type) {
+	case *struct{}:
+		return proto.Unmarshal(data, &commitpb.Empty{})
+	case *RPCArgs:
+		pb := &commitpb.RPCArgs{}
+		if err := proto.Unmarshal(data, pb); err != nil {
+			return err
+		}
+		*v = RPCArgs{Tid: int(pb.Tid)}
+	case *TCPArgs:
+		pb := &commitpb.TCPArgs{}
+		if err := proto.Unmarshal(data, pb); err != nil {
+			return err
+		}
+		*v = TCPArgs{Meta: pb.Meta}
+		if pb.Args != nil {
+			v.Args = &RPCArgs{Tid: int(pb.Args.Tid)}
+		}
+	case *PrepareReply:
+		pb := &commitpb.PrepareReply{}
+		if err := proto.Unmarshal(data, pb); err != nil {
+			return err
+		}
+		*v = PrepareReply{Relevant: pb.Relevant, Vote: pb.Vote, TooLarge: pb.TooLarge, NoKey: pb.NoKey}
+	case *PreCommitReply:
+		pb := &commitpb.PreCommitReply{}
+		if err := proto.Unmarshal(data, pb); err != nil {
+			return err
+		}
+		*v = PreCommitReply{Ack: pb.Ack}
+	case *CommitReply:
+		pb := &commitpb.CommitReply{}
+		if err := proto.Unmarshal(data, pb); err != nil {
+			return err
+		}
+		*v = commitReplyFromPB(pb)
+	case *QueryReply:
+		pb := &commitpb.QueryReply{}
+		if err := proto.Unmarshal(data, pb); err != nil {
+			return err
+		}
+		*v = queryReplyFromPB(pb)
+	default:
+		return fmt.Errorf("%T isn't one of the protocol's messages", v)
+	}
+	return nil
+}
+
+// the most bytes rpcCodec accepts in one field of a message, so a
+// corrupt length can't make it allocate without bound.
+const rpcMaxField = 64 << 20
+
+// net/rpc's messages with their bodies encoded by a codec.Codec.
+// each message is its sequence number, method and error, then its
+// body, each but the first preceded by its length.
+type rpcCodec struct {
+	c    codec.Codec
+	max  int // the most bytes in a body; 0 for no limit
+	conn io.ReadWriteCloser
+	r    *bufio.Reader
+	w    *bufio.Writer
+	body []byte // the body of the message whose header was just read
+}
+
+func newRPCCodec(c codec.Codec, max int, conn io.ReadWriteCloser) *rpcCodec {
+	return &rpcCodec{c: c, max: max, conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+}
+
+// a request over the limit isn't sent, and the call fails with
+// ErrMessageTooLarge.
+func (rc *rpcCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	b, err := rc.c.Marshal(body)
+	if err != nil {
+		return err
+	}
+	if rc.max > 0 && len(b) > rc.max {
+		return ErrMessageTooLarge
+	}
+	return rc.write(r.Seq, r.ServiceMethod, "", b)
+}
+
+func (rc *rpcCodec) ReadResponseHeader(r *rpc.Response) error {
+	var err error
+	r.Seq, r.ServiceMethod, r.Error, err = rc.read()
+	return err
+}
+
+func (rc *rpcCodec) ReadResponseBody(body interface{}) error {
+	return rc.readBody(body)
+}
+
+func (rc *rpcCodec) ReadRequestHeader(r *rpc.Request) error {
+	var err error
+	r.Seq, r.ServiceMethod, _, err = rc.read()
+	return err
+}
+
+func (rc *rpcCodec) ReadRequestBody(body interface{}) error {
+	return rc.readBody(body)
+}
+
+// a reply over the limit is replaced by an ErrMessageTooLarge error.
+func (rc *rpcCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	b, err := rc.c.Marshal(body)
+	if err != nil {
+		return err
+	}
+	errStr := r.Error
+	if rc.max > 0 && len(b) > rc.max {
+		if b, err = rc.c.Marshal(struct{}{}); err != nil {
+			return err
+		}
+		errStr = ErrMessageTooLarge.Error()
+	}
+	return rc.write(r.Seq, r.ServiceMethod, errStr, b)
+}
+
+func (rc *rpcCodec) Close() error {
+	return rc.conn.Close()
+}
+
+func (rc *rpcCodec) write(seq uint64, method string, errStr string, b []byte) error {
+	rc.w.Write(binary.AppendUvarint(nil, seq))
+	for _, field := range [][]byte{[]byte(method), []byte(errStr), b} {
+		rc.w.Write(binary.AppendUvarint(nil, uint64(len(field))))
+		rc.w.Write(field)
+	}
+	return rc.w.Flush()
+}
+
+func (rc *rpcCodec) read() (seq uint64, method string, errStr string, err error) {
+	if seq, err = binary.ReadUvarint(rc.r); err != nil {
+		return
+	}
+	var fields [3][]byte
+	for i := range fields {
+		if fields[i], err = rc.readField(); err != nil {
+			return
+		}
+	}
+	rc.body = fields[2]
+	return seq, string(fields[0]), string(fields[1]), nil
+}
+
+func (rc *rpcCodec) readField() ([]byte, error) {
+	n, err := binary.ReadUvarint(rc.r)
+	if err != nil {
+		return nil, err
+	}
+	if n > rpcMaxField {
+		return nil, fmt.Errorf("rpcCodec: %d-byte field", n)
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(rc.r, b)
+	return b, err
+}
+
+// nil body means net/rpc wants it skipped.
+func (rc *rpcCodec) readBody(body interface{}) error {
+	b := rc.body
+	rc.body = nil
+	if body == nil {
+		return nil
+	}
+	return rc.c.Unmarshal(b, body)
+}
@@ -0,0 +1,179 @@
+package codec
+
+//
+// how RPC args and replies become bytes and back, for labrpc and
+// the TCP transport, so that users can trade compatibility with
+// other languages against speed:
+//
+//   net.SetCodec(codec.JSON)  // a labrpc.Network
+//   tr.SetCodec(codec.Msgpack) // a TCPTransport
+//
+// Gob uses labgob, with its warnings about lower-case fields, and
+// is labrpc's default. JSON and Msgpack turn the numbers they find
+// in interface{} values, e.g. a value read from the store, back
+// into ints or float64s; JSON also turns []byte values there into
+// base64 strings. Proto only takes proto.Message values; the
+// commit package's ProtoCodec converts its own messages first.
+//
+
+import (
+	"3PhaseCommit/labgob"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+type Codec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+
+	// decode data into v, which must be a pointer.
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	Gob     Codec = gobCodec{}
+	JSON    Codec = jsonCodec{}
+	Msgpack Codec = msgpackCodec{}
+	Proto   Codec = protoCodec{}
+)
+
+// every codec here, e.g. for benchmarks.
+var All = []Codec{Gob, JSON, Msgpack, Proto}
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string { return "gob" }
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	b := new(bytes.Buffer)
+	if err := labgob.NewEncoder(b).Encode(v); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return labgob.NewDecoder(bytes.NewBuffer(data)).Decode(v)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	normalize(reflect.ValueOf(v))
+	return nil
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string { return "msgpack" }
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	if err := msgpack.Unmarshal(data, v); err != nil {
+		return err
+	}
+	normalize(reflect.ValueOf(v))
+	return nil
+}
+
+type protoCodec struct{}
+
+func (protoCodec) Name() string { return "proto" }
+
+func (protoCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("codec: proto can't encode a %T", v)
+	}
+	return proto.Marshal(m)
+}
+
+func (protoCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("codec: proto can't decode into a %T", v)
+	}
+	return proto.Unmarshal(data, m)
+}
+
+// replace the numbers held in interface values anywhere in v with
+// ints, or float64s if they aren't whole, as gob would have left
+// them; other codecs decode them as json.Numbers or sized ints.
+func normalize(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if !v.IsNil() {
+			normalize(v.Elem())
+		}
+	case reflect.Interface:
+		if !v.IsNil() && v.CanSet() {
+			v.Set(normalized(v.Elem()))
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				normalize(v.Field(i))
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			normalize(v.Index(i))
+		}
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			// map elements can't be set in place
+			e := reflect.New(v.Type().Elem()).Elem()
+			e.Set(v.MapIndex(key))
+			normalize(e)
+			v.SetMapIndex(key, e)
+		}
+	}
+}
+
+// what an interface holding x should hold instead.
+func normalized(x reflect.Value) reflect.Value {
+	if n, ok := x.Interface().(json.Number); ok {
+		if i, err := n.Int64(); err == nil {
+			return reflect.ValueOf(int(i))
+		}
+		f, _ := n.Float64()
+		return reflect.ValueOf(f)
+	}
+
+	// leave named types, e.g. enums, alone, as gob does
+	if x.Type().PkgPath() == "" {
+		switch x.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return reflect.ValueOf(int(x.Int()))
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return reflect.ValueOf(int(x.Uint()))
+		case reflect.Float32:
+			return reflect.ValueOf(x.Float())
+		}
+	}
+
+	// a copy, in which nested interfaces can be set
+	c := reflect.New(x.Type()).Elem()
+	c.Set(x)
+	normalize(c)
+	return c
+}
@@ -0,0 +1,49 @@
+package codec
+
+import (
+	"reflect"
+	"testing"
+)
+
+type Named int
+
+type Message struct {
+	Values map[string]interface{}
+	List   []interface{}
+	Named  interface{}
+}
+
+// JSON and msgpack should bring back interface values' numbers as
+// ints and float64s, as gob does.
+func TestRoundTrip(t *testing.T) {
+	in := Message{
+		Values: map[string]interface{}{"int": 1, "big": 1 << 40, "float": 2.5, "string": "s", "bool": true, "nil": nil},
+		List:   []interface{}{-3, map[string]interface{}{"nested": 4}},
+	}
+
+	for _, c := range []Codec{JSON, Msgpack} {
+		data, err := c.Marshal(&in)
+		if err != nil {
+			t.Fatalf("%s: Marshal: %v", c.Name(), err)
+		}
+		var out Message
+		if err := c.Unmarshal(data, &out); err != nil {
+			t.Fatalf("%s: Unmarshal: %v", c.Name(), err)
+		}
+		if !reflect.DeepEqual(out, in) {
+			t.Fatalf("%s: got %#v; expected %#v", c.Name(), out, in)
+		}
+	}
+
+	if _, err := Proto.Marshal(&in); err == nil {
+		t.Fatalf("proto encoded a %T", in)
+	}
+}
+
+func TestNormalizeKeepsNamedTypes(t *testing.T) {
+	m := Message{Named: Named(3)}
+	normalize(reflect.ValueOf(&m))
+	if _, ok := m.Named.(Named); !ok {
+		t.Fatalf("normalize turned a Named into a %T", m.Named)
+	}
+}
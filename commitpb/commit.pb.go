@@ -0,0 +1,832 @@
+// The RPCs a 3PC coordinator sends to servers, for participants and
+// clients written in other languages. They mirror the Go types in
+// 3pc.go; see grpc.go for the conversion.
+//
+// Regenerate commit.pb.go and commit_grpc.pb.go from the repository root with
+//
+//   buf generate
+//
+// or with protoc, protoc-gen-go and protoc-gen-go-grpc:
+//
+//   protoc --go_out=. --go_opt=paths=source_relative \
+//     --go-grpc_out=. --go-grpc_opt=paths=source_relative commitpb/commit.proto
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.12
+// 	protoc        (unknown)
+// source: commitpb/commit.proto
+
+package commitpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type TransactionState int32
+
+const (
+	TransactionState_OPERATIONS    TransactionState = 0
+	TransactionState_VOTED_NO      TransactionState = 1
+	TransactionState_VOTED_YES     TransactionState = 2
+	TransactionState_PRE_COMMITTED TransactionState = 3
+	TransactionState_ABORTED       TransactionState = 4
+	TransactionState_COMMITTED     TransactionState = 5
+)
+
+// Enum value maps for TransactionState.
+var (
+	TransactionState_name = map[int32]string{
+		0: "OPERATIONS",
+		1: "VOTED_NO",
+		2: "VOTED_YES",
+		3: "PRE_COMMITTED",
+		4: "ABORTED",
+		5: "COMMITTED",
+	}
+	TransactionState_value = map[string]int32{
+		"OPERATIONS":    0,
+		"VOTED_NO":      1,
+		"VOTED_YES":     2,
+		"PRE_COMMITTED": 3,
+		"ABORTED":       4,
+		"COMMITTED":     5,
+	}
+)
+
+func (x TransactionState) Enum() *TransactionState {
+	p := new(TransactionState)
+	*p = x
+	return p
+}
+
+func (x TransactionState) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (TransactionState) Descriptor() protoreflect.EnumDescriptor {
+	return file_commitpb_commit_proto_enumTypes[0].Descriptor()
+}
+
+func (TransactionState) Type() protoreflect.EnumType {
+	return &file_commitpb_commit_proto_enumTypes[0]
+}
+
+func (x TransactionState) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use TransactionState.Descriptor instead.
+func (TransactionState) EnumDescriptor() ([]byte, []int) {
+	return file_commitpb_commit_proto_rawDescGZIP(), []int{0}
+}
+
+type Empty struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Empty) Reset() {
+	*x = Empty{}
+	mi := &file_commitpb_commit_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Empty) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Empty) ProtoMessage() {}
+
+func (x *Empty) ProtoReflect() protoreflect.Message {
+	mi := &file_commitpb_commit_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Empty.ProtoReflect.Descriptor instead.
+func (*Empty) Descriptor() ([]byte, []int) {
+	return file_commitpb_commit_proto_rawDescGZIP(), []int{0}
+}
+
+type RPCArgs struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Tid           int64                  `protobuf:"varint,1,opt,name=tid,proto3" json:"tid,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RPCArgs) Reset() {
+	*x = RPCArgs{}
+	mi := &file_commitpb_commit_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RPCArgs) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RPCArgs) ProtoMessage() {}
+
+func (x *RPCArgs) ProtoReflect() protoreflect.Message {
+	mi := &file_commitpb_commit_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RPCArgs.ProtoReflect.Descriptor instead.
+func (*RPCArgs) Descriptor() ([]byte, []int) {
+	return file_commitpb_commit_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *RPCArgs) GetTid() int64 {
+	if x != nil {
+		return x.Tid
+	}
+	return 0
+}
+
+// what the TCP transport sends with ProtoCodec: a call's metadata
+// and its args, which are unset for Query
+type TCPArgs struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Meta          map[string]string      `protobuf:"bytes,1,rep,name=meta,proto3" json:"meta,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Args          *RPCArgs               `protobuf:"bytes,2,opt,name=args,proto3" json:"args,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *TCPArgs) Reset() {
+	*x = TCPArgs{}
+	mi := &file_commitpb_commit_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TCPArgs) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TCPArgs) ProtoMessage() {}
+
+func (x *TCPArgs) ProtoReflect() protoreflect.Message {
+	mi := &file_commitpb_commit_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TCPArgs.ProtoReflect.Descriptor instead.
+func (*TCPArgs) Descriptor() ([]byte, []int) {
+	return file_commitpb_commit_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *TCPArgs) GetMeta() map[string]string {
+	if x != nil {
+		return x.Meta
+	}
+	return nil
+}
+
+func (x *TCPArgs) GetArgs() *RPCArgs {
+	if x != nil {
+		return x.Args
+	}
+	return nil
+}
+
+type PrepareReply struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Relevant      bool                   `protobuf:"varint,1,opt,name=relevant,proto3" json:"relevant,omitempty"`                 // the server has operations for the transaction
+	Vote          bool                   `protobuf:"varint,2,opt,name=vote,proto3" json:"vote,omitempty"`                         // the server votes Yes; only a relevant server votes
+	TooLarge      bool                   `protobuf:"varint,3,opt,name=too_large,json=tooLarge,proto3" json:"too_large,omitempty"` // the server votes No because its Commit reply wouldn't fit in a message
+	NoKey         string                 `protobuf:"bytes,4,opt,name=no_key,json=noKey,proto3" json:"no_key,omitempty"`           // the key the server doesn't store, if that's why it votes No
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PrepareReply) Reset() {
+	*x = PrepareReply{}
+	mi := &file_commitpb_commit_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PrepareReply) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PrepareReply) ProtoMessage() {}
+
+func (x *PrepareReply) ProtoReflect() protoreflect.Message {
+	mi := &file_commitpb_commit_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PrepareReply.ProtoReflect.Descriptor instead.
+func (*PrepareReply) Descriptor() ([]byte, []int) {
+	return file_commitpb_commit_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *PrepareReply) GetRelevant() bool {
+	if x != nil {
+		return x.Relevant
+	}
+	return false
+}
+
+func (x *PrepareReply) GetVote() bool {
+	if x != nil {
+		return x.Vote
+	}
+	return false
+}
+
+func (x *PrepareReply) GetTooLarge() bool {
+	if x != nil {
+		return x.TooLarge
+	}
+	return false
+}
+
+func (x *PrepareReply) GetNoKey() string {
+	if x != nil {
+		return x.NoKey
+	}
+	return ""
+}
+
+type PreCommitReply struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Ack           bool                   `protobuf:"varint,1,opt,name=ack,proto3" json:"ack,omitempty"` // the server voted Yes and is ready to commit
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PreCommitReply) Reset() {
+	*x = PreCommitReply{}
+	mi := &file_commitpb_commit_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PreCommitReply) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PreCommitReply) ProtoMessage() {}
+
+func (x *PreCommitReply) ProtoReflect() protoreflect.Message {
+	mi := &file_commitpb_commit_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PreCommitReply.ProtoReflect.Descriptor instead.
+func (*PreCommitReply) Descriptor() ([]byte, []int) {
+	return file_commitpb_commit_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *PreCommitReply) GetAck() bool {
+	if x != nil {
+		return x.Ack
+	}
+	return false
+}
+
+type CommitReply struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	ReadValues    map[string]*Value      `protobuf:"bytes,1,rep,name=read_values,json=readValues,proto3" json:"read_values,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"` // key : value read
+	Reads         int64                  `protobuf:"varint,2,opt,name=reads,proto3" json:"reads,omitempty"`                                                                                                      // len(read_values), to catch values lost in flight
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CommitReply) Reset() {
+	*x = CommitReply{}
+	mi := &file_commitpb_commit_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CommitReply) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CommitReply) ProtoMessage() {}
+
+func (x *CommitReply) ProtoReflect() protoreflect.Message {
+	mi := &file_commitpb_commit_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CommitReply.ProtoReflect.Descriptor instead.
+func (*CommitReply) Descriptor() ([]byte, []int) {
+	return file_commitpb_commit_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *CommitReply) GetReadValues() map[string]*Value {
+	if x != nil {
+		return x.ReadValues
+	}
+	return nil
+}
+
+func (x *CommitReply) GetReads() int64 {
+	if x != nil {
+		return x.Reads
+	}
+	return 0
+}
+
+type QueryReply struct {
+	state         protoimpl.MessageState       `protogen:"open.v1"`
+	Transactions  map[int64]*ServerTransaction `protobuf:"bytes,1,rep,name=transactions,proto3" json:"transactions,omitempty" protobuf_key:"varint,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"` // tid : the server's record of it
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *QueryReply) Reset() {
+	*x = QueryReply{}
+	mi := &file_commitpb_commit_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *QueryReply) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*QueryReply) ProtoMessage() {}
+
+func (x *QueryReply) ProtoReflect() protoreflect.Message {
+	mi := &file_commitpb_commit_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use QueryReply.ProtoReflect.Descriptor instead.
+func (*QueryReply) Descriptor() ([]byte, []int) {
+	return file_commitpb_commit_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *QueryReply) GetTransactions() map[int64]*ServerTransaction {
+	if x != nil {
+		return x.Transactions
+	}
+	return nil
+}
+
+type ServerTransaction struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	State         TransactionState       `protobuf:"varint,1,opt,name=state,proto3,enum=commit.TransactionState" json:"state,omitempty"`
+	Operations    []*Operation           `protobuf:"bytes,2,rep,name=operations,proto3" json:"operations,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ServerTransaction) Reset() {
+	*x = ServerTransaction{}
+	mi := &file_commitpb_commit_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ServerTransaction) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ServerTransaction) ProtoMessage() {}
+
+func (x *ServerTransaction) ProtoReflect() protoreflect.Message {
+	mi := &file_commitpb_commit_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ServerTransaction.ProtoReflect.Descriptor instead.
+func (*ServerTransaction) Descriptor() ([]byte, []int) {
+	return file_commitpb_commit_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *ServerTransaction) GetState() TransactionState {
+	if x != nil {
+		return x.State
+	}
+	return TransactionState_OPERATIONS
+}
+
+func (x *ServerTransaction) GetOperations() []*Operation {
+	if x != nil {
+		return x.Operations
+	}
+	return nil
+}
+
+type Operation struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	IsGet         bool                   `protobuf:"varint,1,opt,name=is_get,json=isGet,proto3" json:"is_get,omitempty"`
+	Key           string                 `protobuf:"bytes,2,opt,name=key,proto3" json:"key,omitempty"`
+	Value         *Value                 `protobuf:"bytes,3,opt,name=value,proto3" json:"value,omitempty"` // unset for a Get
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Operation) Reset() {
+	*x = Operation{}
+	mi := &file_commitpb_commit_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Operation) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Operation) ProtoMessage() {}
+
+func (x *Operation) ProtoReflect() protoreflect.Message {
+	mi := &file_commitpb_commit_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Operation.ProtoReflect.Descriptor instead.
+func (*Operation) Descriptor() ([]byte, []int) {
+	return file_commitpb_commit_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *Operation) GetIsGet() bool {
+	if x != nil {
+		return x.IsGet
+	}
+	return false
+}
+
+func (x *Operation) GetKey() string {
+	if x != nil {
+		return x.Key
+	}
+	return ""
+}
+
+func (x *Operation) GetValue() *Value {
+	if x != nil {
+		return x.Value
+	}
+	return nil
+}
+
+// a stored value; none of kind is set for a key that was never written
+type Value struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Kind:
+	//
+	//	*Value_Int
+	//	*Value_String_
+	//	*Value_Bool
+	//	*Value_Float
+	//	*Value_Bytes
+	Kind          isValue_Kind `protobuf_oneof:"kind"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Value) Reset() {
+	*x = Value{}
+	mi := &file_commitpb_commit_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Value) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Value) ProtoMessage() {}
+
+func (x *Value) ProtoReflect() protoreflect.Message {
+	mi := &file_commitpb_commit_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Value.ProtoReflect.Descriptor instead.
+func (*Value) Descriptor() ([]byte, []int) {
+	return file_commitpb_commit_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *Value) GetKind() isValue_Kind {
+	if x != nil {
+		return x.Kind
+	}
+	return nil
+}
+
+func (x *Value) GetInt() int64 {
+	if x != nil {
+		if x, ok := x.Kind.(*Value_Int); ok {
+			return x.Int
+		}
+	}
+	return 0
+}
+
+func (x *Value) GetString_() string {
+	if x != nil {
+		if x, ok := x.Kind.(*Value_String_); ok {
+			return x.String_
+		}
+	}
+	return ""
+}
+
+func (x *Value) GetBool() bool {
+	if x != nil {
+		if x, ok := x.Kind.(*Value_Bool); ok {
+			return x.Bool
+		}
+	}
+	return false
+}
+
+func (x *Value) GetFloat() float64 {
+	if x != nil {
+		if x, ok := x.Kind.(*Value_Float); ok {
+			return x.Float
+		}
+	}
+	return 0
+}
+
+func (x *Value) GetBytes() []byte {
+	if x != nil {
+		if x, ok := x.Kind.(*Value_Bytes); ok {
+			return x.Bytes
+		}
+	}
+	return nil
+}
+
+type isValue_Kind interface {
+	isValue_Kind()
+}
+
+type Value_Int struct {
+	Int int64 `protobuf:"varint,1,opt,name=int,proto3,oneof"`
+}
+
+type Value_String_ struct {
+	String_ string `protobuf:"bytes,2,opt,name=string,proto3,oneof"`
+}
+
+type Value_Bool struct {
+	Bool bool `protobuf:"varint,3,opt,name=bool,proto3,oneof"`
+}
+
+type Value_Float struct {
+	Float float64 `protobuf:"fixed64,4,opt,name=float,proto3,oneof"`
+}
+
+type Value_Bytes struct {
+	Bytes []byte `protobuf:"bytes,5,opt,name=bytes,proto3,oneof"`
+}
+
+func (*Value_Int) isValue_Kind() {}
+
+func (*Value_String_) isValue_Kind() {}
+
+func (*Value_Bool) isValue_Kind() {}
+
+func (*Value_Float) isValue_Kind() {}
+
+func (*Value_Bytes) isValue_Kind() {}
+
+var File_commitpb_commit_proto protoreflect.FileDescriptor
+
+const file_commitpb_commit_proto_rawDesc = "" +
+	"\n" +
+	"\x15commitpb/commit.proto\x12\x06commit\"\a\n" +
+	"\x05Empty\"\x1b\n" +
+	"\aRPCArgs\x12\x10\n" +
+	"\x03tid\x18\x01 \x01(\x03R\x03tid\"\x96\x01\n" +
+	"\aTCPArgs\x12-\n" +
+	"\x04meta\x18\x01 \x03(\v2\x19.commit.TCPArgs.MetaEntryR\x04meta\x12#\n" +
+	"\x04args\x18\x02 \x01(\v2\x0f.commit.RPCArgsR\x04args\x1a7\n" +
+	"\tMetaEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"r\n" +
+	"\fPrepareReply\x12\x1a\n" +
+	"\brelevant\x18\x01 \x01(\bR\brelevant\x12\x12\n" +
+	"\x04vote\x18\x02 \x01(\bR\x04vote\x12\x1b\n" +
+	"\ttoo_large\x18\x03 \x01(\bR\btooLarge\x12\x15\n" +
+	"\x06no_key\x18\x04 \x01(\tR\x05noKey\"\"\n" +
+	"\x0ePreCommitReply\x12\x10\n" +
+	"\x03ack\x18\x01 \x01(\bR\x03ack\"\xb7\x01\n" +
+	"\vCommitReply\x12D\n" +
+	"\vread_values\x18\x01 \x03(\v2#.commit.CommitReply.ReadValuesEntryR\n" +
+	"readValues\x12\x14\n" +
+	"\x05reads\x18\x02 \x01(\x03R\x05reads\x1aL\n" +
+	"\x0fReadValuesEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12#\n" +
+	"\x05value\x18\x02 \x01(\v2\r.commit.ValueR\x05value:\x028\x01\"\xb2\x01\n" +
+	"\n" +
+	"QueryReply\x12H\n" +
+	"\ftransactions\x18\x01 \x03(\v2$.commit.QueryReply.TransactionsEntryR\ftransactions\x1aZ\n" +
+	"\x11TransactionsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\x03R\x03key\x12/\n" +
+	"\x05value\x18\x02 \x01(\v2\x19.commit.ServerTransactionR\x05value:\x028\x01\"v\n" +
+	"\x11ServerTransaction\x12.\n" +
+	"\x05state\x18\x01 \x01(\x0e2\x18.commit.TransactionStateR\x05state\x121\n" +
+	"\n" +
+	"operations\x18\x02 \x03(\v2\x11.commit.OperationR\n" +
+	"operations\"Y\n" +
+	"\tOperation\x12\x15\n" +
+	"\x06is_get\x18\x01 \x01(\bR\x05isGet\x12\x10\n" +
+	"\x03key\x18\x02 \x01(\tR\x03key\x12#\n" +
+	"\x05value\x18\x03 \x01(\v2\r.commit.ValueR\x05value\"\x83\x01\n" +
+	"\x05Value\x12\x12\n" +
+	"\x03int\x18\x01 \x01(\x03H\x00R\x03int\x12\x18\n" +
+	"\x06string\x18\x02 \x01(\tH\x00R\x06string\x12\x14\n" +
+	"\x04bool\x18\x03 \x01(\bH\x00R\x04bool\x12\x16\n" +
+	"\x05float\x18\x04 \x01(\x01H\x00R\x05float\x12\x16\n" +
+	"\x05bytes\x18\x05 \x01(\fH\x00R\x05bytesB\x06\n" +
+	"\x04kind*n\n" +
+	"\x10TransactionState\x12\x0e\n" +
+	"\n" +
+	"OPERATIONS\x10\x00\x12\f\n" +
+	"\bVOTED_NO\x10\x01\x12\r\n" +
+	"\tVOTED_YES\x10\x02\x12\x11\n" +
+	"\rPRE_COMMITTED\x10\x03\x12\v\n" +
+	"\aABORTED\x10\x04\x12\r\n" +
+	"\tCOMMITTED\x10\x052\xf5\x01\n" +
+	"\x06Server\x120\n" +
+	"\aPrepare\x12\x0f.commit.RPCArgs\x1a\x14.commit.PrepareReply\x12'\n" +
+	"\x05Abort\x12\x0f.commit.RPCArgs\x1a\r.commit.Empty\x12*\n" +
+	"\x05Query\x12\r.commit.Empty\x1a\x12.commit.QueryReply\x124\n" +
+	"\tPreCommit\x12\x0f.commit.RPCArgs\x1a\x16.commit.PreCommitReply\x12.\n" +
+	"\x06Commit\x12\x0f.commit.RPCArgs\x1a\x13.commit.CommitReplyB\x17Z\x153PhaseCommit/commitpbb\x06proto3"
+
+var (
+	file_commitpb_commit_proto_rawDescOnce sync.Once
+	file_commitpb_commit_proto_rawDescData []byte
+)
+
+func file_commitpb_commit_proto_rawDescGZIP() []byte {
+	file_commitpb_commit_proto_rawDescOnce.Do(func() {
+		file_commitpb_commit_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_commitpb_commit_proto_rawDesc), len(file_commitpb_commit_proto_rawDesc)))
+	})
+	return file_commitpb_commit_proto_rawDescData
+}
+
+var file_commitpb_commit_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_commitpb_commit_proto_msgTypes = make([]protoimpl.MessageInfo, 13)
+var file_commitpb_commit_proto_goTypes = []any{
+	(TransactionState)(0),     // 0: commit.TransactionState
+	(*Empty)(nil),             // 1: commit.Empty
+	(*RPCArgs)(nil),           // 2: commit.RPCArgs
+	(*TCPArgs)(nil),           // 3: commit.TCPArgs
+	(*PrepareReply)(nil),      // 4: commit.PrepareReply
+	(*PreCommitReply)(nil),    // 5: commit.PreCommitReply
+	(*CommitReply)(nil),       // 6: commit.CommitReply
+	(*QueryReply)(nil),        // 7: commit.QueryReply
+	(*ServerTransaction)(nil), // 8: commit.ServerTransaction
+	(*Operation)(nil),         // 9: commit.Operation
+	(*Value)(nil),             // 10: commit.Value
+	nil,                       // 11: commit.TCPArgs.MetaEntry
+	nil,                       // 12: commit.CommitReply.ReadValuesEntry
+	nil,                       // 13: commit.QueryReply.TransactionsEntry
+}
+var file_commitpb_commit_proto_depIdxs = []int32{
+	11, // 0: commit.TCPArgs.meta:type_name -> commit.TCPArgs.MetaEntry
+	2,  // 1: commit.TCPArgs.args:type_name -> commit.RPCArgs
+	12, // 2: commit.CommitReply.read_values:type_name -> commit.CommitReply.ReadValuesEntry
+	13, // 3: commit.QueryReply.transactions:type_name -> commit.QueryReply.TransactionsEntry
+	0,  // 4: commit.ServerTransaction.state:type_name -> commit.TransactionState
+	9,  // 5: commit.ServerTransaction.operations:type_name -> commit.Operation
+	10, // 6: commit.Operation.value:type_name -> commit.Value
+	10, // 7: commit.CommitReply.ReadValuesEntry.value:type_name -> commit.Value
+	8,  // 8: commit.QueryReply.TransactionsEntry.value:type_name -> commit.ServerTransaction
+	2,  // 9: commit.Server.Prepare:input_type -> commit.RPCArgs
+	2,  // 10: commit.Server.Abort:input_type -> commit.RPCArgs
+	1,  // 11: commit.Server.Query:input_type -> commit.Empty
+	2,  // 12: commit.Server.PreCommit:input_type -> commit.RPCArgs
+	2,  // 13: commit.Server.Commit:input_type -> commit.RPCArgs
+	4,  // 14: commit.Server.Prepare:output_type -> commit.PrepareReply
+	1,  // 15: commit.Server.Abort:output_type -> commit.Empty
+	7,  // 16: commit.Server.Query:output_type -> commit.QueryReply
+	5,  // 17: commit.Server.PreCommit:output_type -> commit.PreCommitReply
+	6,  // 18: commit.Server.Commit:output_type -> commit.CommitReply
+	14, // [14:19] is the sub-list for method output_type
+	9,  // [9:14] is the sub-list for method input_type
+	9,  // [9:9] is the sub-list for extension type_name
+	9,  // [9:9] is the sub-list for extension extendee
+	0,  // [0:9] is the sub-list for field type_name
+}
+
+func init() { file_commitpb_commit_proto_init() }
+func file_commitpb_commit_proto_init() {
+	if File_commitpb_commit_proto != nil {
+		return
+	}
+	file_commitpb_commit_proto_msgTypes[9].OneofWrappers = []any{
+		(*Value_Int)(nil),
+		(*Value_String_)(nil),
+		(*Value_Bool)(nil),
+		(*Value_Float)(nil),
+		(*Value_Bytes)(nil),
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_commitpb_commit_proto_rawDesc), len(file_commitpb_commit_proto_rawDesc)),
+			NumEnums:      1,
+			NumMessages:   13,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_commitpb_commit_proto_goTypes,
+		DependencyIndexes: file_commitpb_commit_proto_depIdxs,
+		EnumInfos:         file_commitpb_commit_proto_enumTypes,
+		MessageInfos:      file_commitpb_commit_proto_msgTypes,
+	}.Build()
+	File_commitpb_commit_proto = out.File
+	file_commitpb_commit_proto_goTypes = nil
+	file_commitpb_commit_proto_depIdxs = nil
+}
@@ -0,0 +1,286 @@
+// The RPCs a 3PC coordinator sends to servers, for participants and
+// clients written in other languages. They mirror the Go types in
+// 3pc.go; see grpc.go for the conversion.
+//
+// Regenerate commit.pb.go and commit_grpc.pb.go from the repository root with
+//
+//   buf generate
+//
+// or with protoc, protoc-gen-go and protoc-gen-go-grpc:
+//
+//   protoc --go_out=. --go_opt=paths=source_relative \
+//     --go-grpc_out=. --go-grpc_opt=paths=source_relative commitpb/commit.proto
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: commitpb/commit.proto
+
+package commitpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Server_Prepare_FullMethodName   = "/commit.Server/Prepare"
+	Server_Abort_FullMethodName     = "/commit.Server/Abort"
+	Server_Query_FullMethodName     = "/commit.Server/Query"
+	Server_PreCommit_FullMethodName = "/commit.Server/PreCommit"
+	Server_Commit_FullMethodName    = "/commit.Server/Commit"
+)
+
+// ServerClient is the client API for Server service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ServerClient interface {
+	Prepare(ctx context.Context, in *RPCArgs, opts ...grpc.CallOption) (*PrepareReply, error)
+	Abort(ctx context.Context, in *RPCArgs, opts ...grpc.CallOption) (*Empty, error)
+	Query(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*QueryReply, error)
+	PreCommit(ctx context.Context, in *RPCArgs, opts ...grpc.CallOption) (*PreCommitReply, error)
+	Commit(ctx context.Context, in *RPCArgs, opts ...grpc.CallOption) (*CommitReply, error)
+}
+
+type serverClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewServerClient(cc grpc.ClientConnInterface) ServerClient {
+	return &serverClient{cc}
+}
+
+func (c *serverClient) Prepare(ctx context.Context, in *RPCArgs, opts ...grpc.CallOption) (*PrepareReply, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(PrepareReply)
+	err := c.cc.Invoke(ctx, Server_Prepare_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *serverClient) Abort(ctx context.Context, in *RPCArgs, opts ...grpc.CallOption) (*Empty, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, Server_Abort_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *serverClient) Query(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*QueryReply, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(QueryReply)
+	err := c.cc.Invoke(ctx, Server_Query_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *serverClient) PreCommit(ctx context.Context, in *RPCArgs, opts ...grpc.CallOption) (*PreCommitReply, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(PreCommitReply)
+	err := c.cc.Invoke(ctx, Server_PreCommit_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *serverClient) Commit(ctx context.Context, in *RPCArgs, opts ...grpc.CallOption) (*CommitReply, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CommitReply)
+	err := c.cc.Invoke(ctx, Server_Commit_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ServerServer is the server API for Server service.
+// All implementations must embed UnimplementedServerServer
+// for forward compatibility.
+type ServerServer interface {
+	Prepare(context.Context, *RPCArgs) (*PrepareReply, error)
+	Abort(context.Context, *RPCArgs) (*Empty, error)
+	Query(context.Context, *Empty) (*QueryReply, error)
+	PreCommit(context.Context, *RPCArgs) (*PreCommitReply, error)
+	Commit(context.Context, *RPCArgs) (*CommitReply, error)
+	mustEmbedUnimplementedServerServer()
+}
+
+// UnimplementedServerServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedServerServer struct{}
+
+func (UnimplementedServerServer) Prepare(context.Context, *RPCArgs) (*PrepareReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Prepare not implemented")
+}
+func (UnimplementedServerServer) Abort(context.Context, *RPCArgs) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Abort not implemented")
+}
+func (UnimplementedServerServer) Query(context.Context, *Empty) (*QueryReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Query not implemented")
+}
+func (UnimplementedServerServer) PreCommit(context.Context, *RPCArgs) (*PreCommitReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PreCommit not implemented")
+}
+func (UnimplementedServerServer) Commit(context.Context, *RPCArgs) (*CommitReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Commit not implemented")
+}
+func (UnimplementedServerServer) mustEmbedUnimplementedServerServer() {}
+func (UnimplementedServerServer) testEmbeddedByValue()                {}
+
+// UnsafeServerServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ServerServer will
+// result in compilation errors.
+type UnsafeServerServer interface {
+	mustEmbedUnimplementedServerServer()
+}
+
+func RegisterServerServer(s grpc.ServiceRegistrar, srv ServerServer) {
+	// If the following call pancis, it indicates UnimplementedServerServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Server_ServiceDesc, srv)
+}
+
+func _Server_Prepare_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RPCArgs)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ServerServer).Prepare(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Server_Prepare_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ServerServer).Prepare(ctx, req.(*RPCArgs))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Server_Abort_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RPCArgs)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ServerServer).Abort(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Server_Abort_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ServerServer).Abort(ctx, req.(*RPCArgs))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Server_Query_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ServerServer).Query(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Server_Query_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ServerServer).Query(ctx, req.(*Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Server_PreCommit_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RPCArgs)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ServerServer).PreCommit(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Server_PreCommit_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ServerServer).PreCommit(ctx, req.(*RPCArgs))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Server_Commit_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RPCArgs)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ServerServer).Commit(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Server_Commit_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ServerServer).Commit(ctx, req.(*RPCArgs))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Server_ServiceDesc is the grpc.ServiceDesc for Server service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Server_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "commit.Server",
+	HandlerType: (*ServerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Prepare",
+			Handler:    _Server_Prepare_Handler,
+		},
+		{
+			MethodName: "Abort",
+			Handler:    _Server_Abort_Handler,
+		},
+		{
+			MethodName: "Query",
+			Handler:    _Server_Query_Handler,
+		},
+		{
+			MethodName: "PreCommit",
+			Handler:    _Server_PreCommit_Handler,
+		},
+		{
+			MethodName: "Commit",
+			Handler:    _Server_Commit_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "commitpb/commit.proto",
+}
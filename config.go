@@ -9,19 +9,30 @@ package commit
 //
 
 import (
+	"3PhaseCommit/codec"
+	"3PhaseCommit/labgob"
 	"3PhaseCommit/labrpc"
+	"3PhaseCommit/models"
+	"3PhaseCommit/porcupine"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"testing"
 
+	"bytes"
 	crand "crypto/rand"
 	"encoding/base64"
 	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
-
-
 func randstring(n int) string {
 	b := make([]byte, 2*n)
 	crand.Read(b)
@@ -30,53 +41,164 @@ func randstring(n int) string {
 }
 
 type config struct {
-	mu            sync.Mutex
-	t             *testing.T
-	net           *labrpc.Network
-	n             int
-	keyMap        map[string]int // which keys are assigned to which servers
-	coordinator   *Coordinator   // protected by `mu`
-	servers       []*Server      // protected by `mu`
-	transactions  []ResponseMsg  // protected by `mu`
-	connected     []bool         // whether each server is on the net; protected by `mu`
-	endnames      []string       // the port file names the coordinator sends to
-	doOnPreCommit func() bool    // function to run on next PreCommit
-	doOnCommit    func() bool    // function to run on next Commit
-	start         time.Time      // time at which make_config() was called
+	mu           sync.Mutex
+	t            testing.TB
+	net          *labrpc.Network
+	n            int
+	keys         [][]string             // keys stored by each server
+	keyMap       map[string]int         // which keys are assigned to which servers
+	coordinator  *Coordinator           // protected by `mu`
+	decisions    *Persister             // the coordinator's decision log, if persistCoordinator(); protected by `mu`
+	servers      []*Server              // protected by `mu`
+	saved        []*Persister           // persisted state of each server; protected by `mu`
+	disks        []*faultDisk           // each server's simulated disk, if useFaultDisks(); protected by `mu`
+	transactions []ResponseMsg          // protected by `mu`
+	changed      chan struct{}          // closed and replaced to wake waitTransaction(); protected by `mu`
+	ops          map[int][]models.TxnOp // operations sent by each transaction; protected by `mu`
+	calls        map[int]int64          // when each transaction was finished; protected by `mu`
+	returns      map[int]int64          // when each response arrived; protected by `mu`
+	connected    []bool                 // whether each server is on the net; protected by `mu`
+	rpcServers   []*labrpc.Server       // each running Server's RPC endpoint; protected by `mu`
+	paused       []bool                 // whether each server's requests are held; protected by `mu`
+	groups       [][]int                // current partition, nil if none; protected by `mu`
+	endnames     []string               // the port file names the coordinator sends to
+	latency      []time.Duration        // extra delay on the coordinator's link to each server
+	onPreCommit  func() bool            // function to run on next PreCommit
+	onCommit     func() bool            // function to run on next Commit
+	onQuery      func() bool            // function to run on next Query
+	queries      int                    // Query RPCs delivered to a server; protected by `mu`
+	faults       []injectedFault        // faults for upcoming RPCs; protected by `mu`
+	inHandlers   []handlerAction        // code for upcoming handlers to run; protected by `mu`
+	start        time.Time              // time at which make_config() was called
+	seed         int64                  // seed for all randomness in this test
+	rand         *rand.Rand             // seeded source for tests; protected by `mu`
+	duplicates   bool                   // tolerate repeated responses that agree; protected by `mu`
+	clock        Clock                  // the coordinator's clock; protected by `mu`
+	timeout      time.Duration          // the coordinators' phase timeout; protected by `mu`
+	nextTid      atomic.Int64           // last tid handed to a generated transaction
+	timeline     *timeline              // RPCs, transactions and faults, for debugging
+	log          *testLog               // every component's log lines, printed if the test fails
+	tester       Logger                 // the tester's own lines, see logf()
+	maxstate     int                    // servers' snapshot threshold, -1 for no snapshots
+	done         chan struct{}          // closed by cleanup() to stop background checkers
+	started      []startedCoordinator   // every Coordinator, crashed ones included
+	extras       []extraCoordinator     // coordinators running alongside cfg.coordinator; protected by `mu`
+	instances    [][]*Server            // every Server started at each index; protected by `mu`
+	background   atomic.Int32           // the tester's own goroutines still running
 	// begin()/end() statistics
 	t0        time.Time // time at which test_test.go called cfg.begin()
 	rpcs0     int       // rpcTotal() at start of test
 	bytes0    int64
 	maxIndex  int // protected by `mu`
 	maxIndex0 int
+	stats0    map[interface{}]map[string]labrpc.Stats // per-server, per-method RPCs at start of test
 	stopCh    chan struct{}
 }
 
 var ncpu_once sync.Once
 
-func make_config(t *testing.T, keys [][]string, unreliable bool, snapshot bool) *config {
+// the seed comes from the TEST_SEED environment variable if set,
+// so that a failing run can be repeated, and from the clock otherwise.
+func makeSeed(t testing.TB) int64 {
+	if env := os.Getenv("TEST_SEED"); env != "" {
+		seed, err := strconv.ParseInt(env, 10, 64)
+		if err != nil {
+			t.Fatalf("bad TEST_SEED %q: %v", env, err)
+		}
+		return seed
+	}
+	return time.Now().UnixNano()
+}
+
+// a random int from the test's seeded source.
+func (cfg *config) randInt() int {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+
+	return cfg.randIntLocked()
+}
+
+func (cfg *config) randIntLocked() int {
+	return cfg.rand.Int()
+}
+
+// keys[i] lists the keys stored by server i, so len(keys) is the
+// number of servers. a server may store no keys at all.
+func make_config(t testing.TB, keys [][]string, unreliable bool, snapshot bool) *config {
+	return makeSeededConfig(t, keys, unreliable, snapshot, makeSeed(t))
+}
+
+// a config with nservers servers, and nkeys keys named k0, k1, ...
+// each assigned to a random server. the assignment comes from the
+// test's seed, so TEST_SEED reproduces it.
+func make_random_config(t testing.TB, nservers int, nkeys int, unreliable bool) *config {
+	seed := makeSeed(t)
+	r := rand.New(rand.NewSource(seed))
+
+	keys := make([][]string, nservers)
+	for k := range nkeys {
+		i := r.Intn(nservers)
+		keys[i] = append(keys[i], fmt.Sprintf("k%d", k))
+	}
+	return makeSeededConfig(t, keys, unreliable, false, seed)
+}
+
+// how many of each end's last messages the network keeps, to be
+// dumped if the test fails.
+const journalSize = 64
+
+// with snapshots, servers fold their log into a snapshot every
+// few transactions, so tests that crash servers restore from both.
+const snapshotMaxState = 1000
+
+func makeSeededConfig(t testing.TB, keys [][]string, unreliable bool, snapshot bool, seed int64) *config {
 	ncpu_once.Do(func() {
 		if runtime.NumCPU() < 2 {
 			fmt.Printf("warning: only one CPU, which may conceal locking bugs\n")
 		}
 	})
 
-	runtime.GOMAXPROCS(4)
+	// everything a test touches hangs off its config, so tests
+	// can run in parallel; GOMAXPROCS is left to the -cpu flag.
 	cfg := &config{}
 	cfg.t = t
 	cfg.net = labrpc.MakeNetwork()
 	cfg.n = len(keys)
+	cfg.keys = keys
 	cfg.keyMap = make(map[string]int)
 	cfg.servers = make([]*Server, cfg.n)
+	cfg.saved = make([]*Persister, cfg.n)
+	cfg.instances = make([][]*Server, cfg.n)
+	cfg.ops = make(map[int][]models.TxnOp)
+	cfg.calls = make(map[int]int64)
+	cfg.returns = make(map[int]int64)
 	cfg.connected = make([]bool, cfg.n)
+	cfg.rpcServers = make([]*labrpc.Server, cfg.n)
+	cfg.paused = make([]bool, cfg.n)
 	cfg.endnames = make([]string, cfg.n)
+	cfg.latency = make([]time.Duration, cfg.n)
+	cfg.clock = realClock{}
+	cfg.timeout = phaseTimeout
+	cfg.maxstate = -1
+	if snapshot {
+		cfg.maxstate = snapshotMaxState
+	}
 	cfg.start = time.Now()
+	cfg.timeline = makeTimeline(cfg.start)
+	cfg.log = makeTestLog(t.Name(), cfg.start)
+	cfg.tester = cfg.log.logger("tester")
+	cfg.seed = seed
+	cfg.rand = rand.New(rand.NewSource(cfg.seed))
+	cfg.net.Seed(cfg.seed)
+	cfg.net.SetJournal(journalSize)
 
 	cfg.setunreliable(unreliable)
 
 	cfg.net.LongDelays(false)
 
 	cfg.net.RegisterCallback(cfg.netCallback)
+	cfg.net.RegisterInterceptor(cfg.netIntercept)
+	cfg.net.RegisterObserver(cfg.timeline.rpc)
 
 	for i, keyList := range keys {
 		for _, key := range keyList {
@@ -85,7 +207,7 @@ func make_config(t *testing.T, keys [][]string, unreliable bool, snapshot bool)
 	}
 
 	for i := 0; i < cfg.n; i++ {
-		cfg.startServer(i, keys[i])
+		cfg.startServer(i)
 	}
 	cfg.startCoordinator()
 	// connect everyone
@@ -93,6 +215,10 @@ func make_config(t *testing.T, keys [][]string, unreliable bool, snapshot bool)
 		cfg.connect(i)
 	}
 
+	cfg.done = make(chan struct{})
+	cfg.changed = make(chan struct{})
+	cfg.goBackground(func() { cfg.lockChecker(cfg.done) })
+
 	return cfg
 }
 
@@ -100,37 +226,221 @@ func (cfg *config) netCallback(method string, endname interface{}) {
 	cfg.mu.Lock()
 	defer cfg.mu.Unlock()
 
-	if method == "Server.PreCommit" && cfg.doOnPreCommit != nil {
-		if cfg.doOnPreCommit() {
-			cfg.doOnPreCommit = nil
+	if method == "Server.PreCommit" && cfg.onPreCommit != nil {
+		if cfg.onPreCommit() {
+			cfg.onPreCommit = nil
 		}
 	}
 
-	if method == "Server.Commit" && cfg.doOnCommit != nil {
-		if cfg.doOnCommit() {
-			cfg.doOnCommit = nil
+	if method == "Server.Commit" && cfg.onCommit != nil {
+		if cfg.onCommit() {
+			cfg.onCommit = nil
+		}
+	}
+
+	if method == "Server.Query" {
+		cfg.queries++
+		if cfg.onQuery != nil && cfg.onQuery() {
+			cfg.onQuery = nil
 		}
 	}
 }
 
+// run f, with cfg.mu held, as each PreCommit is sent, until it
+// returns true.
 func (cfg *config) doNextPreCommit(f func() bool) {
 	cfg.mu.Lock()
 	defer cfg.mu.Unlock()
 
-	cfg.doOnPreCommit = f
+	cfg.onPreCommit = f
 }
 
 func (cfg *config) doNextCommit(f func() bool) {
 	cfg.mu.Lock()
 	defer cfg.mu.Unlock()
 
-	cfg.doOnCommit = f
+	cfg.onCommit = f
+}
+
+// run f, with cfg.mu held, as the nth upcoming PreCommit is sent,
+// counting from 1. e.g. restart the coordinator once the first
+// server has heard PreCommit:
+// cfg.doOnPreCommit(2, cfg.restartCoordinatorLocked)
+func (cfg *config) doOnPreCommit(n int, f func()) {
+	cfg.doNextPreCommit(nth(n, f))
+}
+
+// run f, with cfg.mu held, as the nth upcoming Commit is sent.
+func (cfg *config) doOnCommit(n int, f func()) {
+	cfg.doNextCommit(nth(n, f))
+}
+
+// a hook that runs f the nth time it's called, and is then done.
+func nth(n int, f func()) func() bool {
+	return func() bool {
+		n--
+		if n > 0 {
+			return false
+		}
+		f()
+		return true
+	}
+}
+
+// run f as the next Query is sent, i.e. while a coordinator
+// is recovering.
+func (cfg *config) doNextQuery(f func() bool) {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+
+	cfg.onQuery = f
+}
+
+// how many Query RPCs coordinators have sent to running servers,
+// e.g. to check that a restarted coordinator really recovered.
+func (cfg *config) queryCount() int {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+
+	return cfg.queries
+}
+
+// wait until coordinators have sent n Query RPCs in all.
+func (cfg *config) awaitQueries(n int) {
+	cfg.awaitHook(func() bool { return cfg.queries >= n })
+}
+
+// matches any server in dropNext() and friends.
+const anyServer = -1
+
+// a fault waiting for a matching RPC.
+type injectedFault struct {
+	method string
+	server int
+	skip   int // matching RPCs to let through first
+	fault  labrpc.Fault
+}
+
+// apply the first pending fault that is due for an RPC, so
+// each fault hits exactly one message. every other fault that
+// matches counts the RPC towards its skip.
+func (cfg *config) netIntercept(method string, endname interface{}) *labrpc.Fault {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+
+	server := -1
+	for i, name := range cfg.endnames {
+		if name == endname {
+			server = i
+		}
+	}
+
+	var hit *labrpc.Fault
+	pending := cfg.faults[:0]
+	for _, f := range cfg.faults {
+		if f.method == method && (f.server == anyServer || f.server == server) {
+			if f.skip > 0 {
+				f.skip--
+			} else if hit == nil {
+				hit = &f.fault
+				continue
+			}
+		}
+		pending = append(pending, f)
+	}
+	cfg.faults = pending
+	return hit
+}
+
+// do action to the nth upcoming `method` request to server (or
+// anyServer), counting from 1, and to no other. action may drop,
+// delay, duplicate or rewrite the request, or drop or rewrite its reply.
+// e.g. the third PreCommit to server 2 is lost once:
+// cfg.interceptNth("Server.PreCommit", 2, 3, labrpc.Fault{DropRequest: true})
+func (cfg *config) interceptNth(method string, server int, n int, action labrpc.Fault) {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+
+	cfg.faults = append(cfg.faults, injectedFault{method, server, n - 1, action})
+}
+
+// do action to the next `method` request to server.
+func (cfg *config) interceptNext(method string, server int, action labrpc.Fault) {
+	cfg.interceptNth(method, server, 1, action)
+}
+
+// lose the next `method` request to server (or anyServer);
+// the handler never runs.
+// e.g. cfg.dropNext("Server.Commit", 0)
+func (cfg *config) dropNext(method string, server int) {
+	cfg.interceptNext(method, server, labrpc.Fault{DropRequest: true})
+}
+
+// run the next `method` request to server, but lose its reply.
+func (cfg *config) dropReplyNext(method string, server int) {
+	cfg.interceptNext(method, server, labrpc.Fault{DropReply: true})
+}
+
+// deliver the next `method` request to server twice.
+func (cfg *config) duplicateNext(method string, server int) {
+	cfg.interceptNext(method, server, labrpc.Fault{Duplicate: true})
+}
+
+// hold back the next `method` request to server by d,
+// so that later messages can overtake it.
+func (cfg *config) delayNext(method string, server int, d time.Duration) {
+	cfg.interceptNext(method, server, labrpc.Fault{Delay: d})
+}
+
+// let f change the arguments of the next `method` request to
+// server, which must take RPCArgs (everything but Query).
+// e.g. a message from another transaction:
+// cfg.modifyNext("Server.Abort", 1, func(args *RPCArgs) { args.Tid = 7 })
+func (cfg *config) modifyNext(method string, server int, f func(args *RPCArgs)) {
+	cfg.interceptNext(method, server, labrpc.Fault{Rewrite: func(data []byte) []byte {
+		var args RPCArgs
+		return cfg.recode("modifyNext", method, data, &args, func() { f(&args) })
+	}})
+}
+
+// let f change the reply to the next Prepare to server, as if it
+// were damaged in flight. e.g. a flipped vote:
+// cfg.modifyPrepareReplyNext(1, func(reply *PrepareReply) { reply.Vote = !reply.Vote })
+func (cfg *config) modifyPrepareReplyNext(server int, f func(reply *PrepareReply)) {
+	cfg.interceptNext("Server.Prepare", server, labrpc.Fault{RewriteReply: func(data []byte) []byte {
+		var reply PrepareReply
+		return cfg.recode("modifyPrepareReplyNext", "Server.Prepare", data, &reply, func() { f(&reply) })
+	}})
+}
+
+// let f change the reply to the next Commit to server.
+func (cfg *config) modifyCommitReplyNext(server int, f func(reply *CommitReply)) {
+	cfg.interceptNext("Server.Commit", server, labrpc.Fault{RewriteReply: func(data []byte) []byte {
+		var reply CommitReply
+		return cfg.recode("modifyCommitReplyNext", "Server.Commit", data, &reply, func() { f(&reply) })
+	}})
+}
+
+// decode a labgob-encoded message into v, run f, and encode v again.
+func (cfg *config) recode(caller string, method string, data []byte, v interface{}, f func()) []byte {
+	if labgob.NewDecoder(bytes.NewBuffer(data)).Decode(v) != nil {
+		cfg.backgroundErrorf("%s: can't decode a %T from %s", caller, v, method)
+		return data
+	}
+	f()
+	w := new(bytes.Buffer)
+	labgob.NewEncoder(w).Encode(v)
+	return w.Bytes()
 }
 
 func (cfg *config) restartCoordinatorLocked() {
 	cfg.crashCoordinatorLocked()
 	cfg.coordinator = cfg.newCoordinator()
-	cfg.connectAll()
+	if cfg.groups != nil {
+		cfg.partitionLocked(cfg.groups)
+	} else {
+		cfg.connectAll()
+	}
 }
 
 func (cfg *config) apply(m ResponseMsg) {
@@ -139,11 +449,21 @@ func (cfg *config) apply(m ResponseMsg) {
 
 	for _, trans := range cfg.transactions {
 		if trans.tid == m.tid {
+			if cfg.duplicates && trans.committed == m.committed && reflect.DeepEqual(trans.readValues, m.readValues) {
+				return
+			}
 			cfg.t.Fatalf("Got repeated client message for transaction %d", m.tid)
 		}
 	}
 
+	if m.committed {
+		cfg.timeline.mark(coordinatorId, "commit %d", m.tid)
+	} else {
+		cfg.timeline.mark(coordinatorId, "abort %d", m.tid)
+	}
 	cfg.transactions = append(cfg.transactions, m)
+	cfg.returns[m.tid] = time.Since(cfg.start).Nanoseconds()
+	cfg.wakeWaitersLocked()
 }
 
 // applier reads message from response channel
@@ -168,18 +488,292 @@ func (cfg *config) applier(respChan chan ResponseMsg, stopCh <-chan struct{}) {
 	}
 }
 
-// start a new Server
-func (cfg *config) startServer(i int, keys []string) {
-	sv := MakeServer(keys)
-
+// start or re-start a Server.
+// if one already exists, "kill" it first.
+// the new Server is handed the state persisted by the old one.
+func (cfg *config) startServer(i int) {
 	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+
+	cfg.startServerLocked(i)
+}
+
+func (cfg *config) startServerLocked(i int) {
+	cfg.crashServerLocked(i)
+
+	if cfg.saved[i] == nil {
+		cfg.saved[i] = MakePersister()
+	}
+
+	sv := makeServer(cfg.keys[i], cfg.saved[i], cfg.maxstate, cfg.log.logger(fmt.Sprintf("server %d", i)))
 	cfg.servers[i] = sv
+	cfg.instances[i] = append(cfg.instances[i], sv)
+	sv.setHook(func(point hookPoint, method string, tid int, meta Metadata) {
+		cfg.runInHandler(i, point, method)
+	})
+
+	cfg.rpcServers[i] = serveLabrpc(cfg.net, i, sv)
+	cfg.timeline.mark(i, "start")
+}
+
+// shut down Server i but save its persistent state.
+// the Server stays unreachable until restartServer(i).
+func (cfg *config) crashServer(i int) {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+
+	cfg.crashServerLocked(i)
+}
+
+func (cfg *config) crashServerLocked(i int) {
+	if cfg.servers[i] == nil {
+		return
+	}
+
+	// stop RPCs from reaching the old instance, and let any it
+	// was holding run, so they fail rather than wait forever.
+	cfg.net.DeleteServer(i)
+	cfg.resumeLocked(i)
+	cfg.rpcServers[i] = nil
+
+	// a fresh persister, so that the old instance can't overwrite
+	// the saved state if it is still running a handler.
+	// but copy the old persister's content so that the new
+	// instance starts from the last persisted state.
+	// on a simulated disk, that's what the disk holds: all the old
+	// instance wrote, unless a write cut the power.
+	if cfg.disks != nil && cfg.disks[i] != nil {
+		cfg.saved[i].Close()
+		if cfg.disks[i].powerOff() {
+			cfg.disks[i] = cfg.disks[i].powerLoss()
+		}
+		cfg.saved[i] = cfg.openFaultDiskLocked(i)
+	} else {
+		cfg.saved[i] = cfg.saved[i].Copy()
+	}
+
+	cfg.servers[i].Kill()
+	cfg.servers[i] = nil
+	cfg.timeline.mark(i, "crash")
+}
+
+// crash Server i (if it is still running), then start a fresh
+// Server from its persisted state.
+func (cfg *config) restartServer(i int) {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+
+	cfg.restartServerLocked(i)
+}
+
+func (cfg *config) restartServerLocked(i int) {
+	cfg.startServerLocked(i)
+}
+
+// start a new server, storing keys, while the test runs, and tell
+// every running coordinator about it; coordinators started later
+// know it from the start. transactions that were already
+// finishing don't involve it. returns the new server's index.
+func (cfg *config) addServer(keys []string) int {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+
+	if cfg.groups != nil {
+		cfg.t.Fatalf("addServer: heal the partition first")
+	}
+	i := cfg.n
+	for _, key := range keys {
+		if j, exists := cfg.keyMap[key]; exists {
+			cfg.t.Fatalf("addServer: server %d already stores %s", j, key)
+		}
+		cfg.keyMap[key] = i
+	}
+
+	cfg.n++
+	cfg.keys = append(cfg.keys, keys)
+	cfg.servers = append(cfg.servers, nil)
+	cfg.saved = append(cfg.saved, nil)
+	if cfg.disks != nil {
+		cfg.disks = append(cfg.disks, nil)
+	}
+	cfg.instances = append(cfg.instances, nil)
+	cfg.connected = append(cfg.connected, false)
+	cfg.rpcServers = append(cfg.rpcServers, nil)
+	cfg.paused = append(cfg.paused, false)
+	cfg.latency = append(cfg.latency, 0)
+	cfg.startServerLocked(i)
+
+	endname, end := cfg.makeEnd(i)
+	cfg.endnames = append(cfg.endnames, endname)
+	if cfg.coordinator != nil {
+		cfg.coordinator.addServer(end)
+	}
+	for c := range cfg.extras {
+		endname, end := cfg.makeEnd(i)
+		cfg.extras[c].endnames = append(cfg.extras[c].endnames, endname)
+		cfg.extras[c].co.addServer(end)
+		cfg.net.Enable(endname, true)
+	}
+	cfg.connect(i)
+	cfg.timeline.mark(i, "added")
+	return i
+}
+
+// make server i's next write to its Persister go wrong as f says.
+// when a write fails or tears, the server stops at once, as it
+// would if its disk errored or its power went out: the request
+// that wrote it gets no reply, and the server stays down until
+// restartServer(i). a dropped sync only shows once the server
+// crashes. torn writes need servers with snapshots, since
+// otherwise every write rewrites the whole state.
+func (cfg *config) diskFaultNext(i int, f diskFault) {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+
+	sv := cfg.servers[i]
+	if sv == nil {
+		cfg.t.Fatalf("diskFaultNext: server %d isn't running", i)
+	}
+	if f == diskTearWrite && cfg.maxstate < 0 {
+		cfg.t.Fatalf("diskFaultNext: torn writes need servers with snapshots")
+	}
+	cfg.saved[i].injectFault(f, func() {
+		// sv.mu is held, so sv can't have been replaced yet
+		if sv.killed() {
+			return
+		}
+		cfg.timeline.mark(i, "disk: %v", f)
+		cfg.net.DeleteServer(i)
+		cfg.goBackground(func() {
+			cfg.mu.Lock()
+			defer cfg.mu.Unlock()
+
+			if cfg.servers[i] == sv {
+				cfg.crashServerLocked(i)
+			}
+		})
+	})
+}
+
+// keep each server's state on a simulated disk (faultdisk.go)
+// rather than in memory, fsyncing before each Yes vote. the servers
+// restart on empty disks, so call it before the first transaction.
+// a crashed server's disk keeps everything written to it, as when
+// its process dies; powerLossLocked() loses what wasn't synced too.
+// servers added later keep their state in memory.
+func (cfg *config) useFaultDisks() {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+
+	if cfg.maxstate < 0 {
+		cfg.t.Fatalf("useFaultDisks: servers need snapshots, since otherwise every write rewrites the whole state")
+	}
+	cfg.disks = make([]*faultDisk, cfg.n)
+	for i := range cfg.n {
+		running := cfg.servers[i] != nil
+		cfg.crashServerLocked(i)
+		cfg.disks[i] = makeFaultDisk(cfg.seed + int64(i))
+		cfg.saved[i] = cfg.openFaultDiskLocked(i)
+		if running {
+			cfg.startServerLocked(i)
+		}
+	}
+}
+
+// a Persister on server i's simulated disk.
+func (cfg *config) openFaultDiskLocked(i int) *Persister {
+	ps, err := openPersister(cfg.disks[i], "server", DiskOptions{Fsync: true})
+	if err != nil {
+		cfg.t.Fatalf("server %d's simulated disk: %v", i, err)
+	}
+	return ps
+}
+
+// make the next write to server i's simulated disk go wrong as f
+// says. a short write fails, so the server votes No and stops
+// itself; a torn or reordered write cuts the power. either way the
+// server leaves the net at once, as in diskFaultNext(), so that an
+// instance that's stopped can't answer for it, and stays down
+// until restartServer(i), which finds the disk as the fault left
+// it.
+func (cfg *config) writeFaultNext(i int, f writeFault) {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+
+	sv := cfg.servers[i]
+	if sv == nil {
+		cfg.t.Fatalf("writeFaultNext: server %d isn't running", i)
+	}
+	if cfg.disks == nil || cfg.disks[i] == nil {
+		cfg.t.Fatalf("writeFaultNext: server %d has no simulated disk; call useFaultDisks()", i)
+	}
+	cfg.disks[i].failNext(f, func() {
+		// sv.mu is held, so sv can't have been replaced yet
+		if sv.killed() {
+			return
+		}
+		cfg.timeline.mark(i, "disk: %v", f)
+		cfg.net.DeleteServer(i)
+		cfg.goBackground(func() {
+			cfg.mu.Lock()
+			defer cfg.mu.Unlock()
+
+			if cfg.servers[i] == sv {
+				cfg.crashServerLocked(i)
+			}
+		})
+	})
+}
+
+// cut server i's power: it crashes, if it's running, and its disk
+// keeps only what was synced. it stays down until restartServer(i).
+func (cfg *config) powerLossLocked(i int) {
+	cfg.crashServerLocked(i)
+	cfg.saved[i].Close()
+	cfg.disks[i] = cfg.disks[i].powerLoss()
+	cfg.saved[i] = cfg.openFaultDiskLocked(i)
+	cfg.timeline.mark(i, "power loss")
+}
+
+// code waiting for a matching handler to run it.
+type handlerAction struct {
+	server int
+	method string
+	point  hookPoint
+	f      func()
+}
+
+// run f inside server i's next handler for method (e.g.
+// "Server.Commit"), as it starts or just before it replies. f
+// runs with no lock held, and may sleep to slow the handler
+// down, or crash the server, e.g. after it persisted a decision
+// but before it replied. a real server would die just the same
+// if its handler panicked, but a panic would take the tester
+// down with it.
+func (cfg *config) doInHandler(i int, method string, point hookPoint, f func()) {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+
+	cfg.inHandlers = append(cfg.inHandlers, handlerAction{i, method, point, f})
+}
+
+// run, and forget, the first action waiting for this handler.
+func (cfg *config) runInHandler(i int, point hookPoint, method string) {
+	cfg.mu.Lock()
+	var f func()
+	for j, a := range cfg.inHandlers {
+		if a.server == i && a.method == method && a.point == point {
+			f = a.f
+			cfg.inHandlers = append(cfg.inHandlers[:j], cfg.inHandlers[j+1:]...)
+			cfg.timeline.mark(i, "%s %s", point, method)
+			break
+		}
+	}
 	cfg.mu.Unlock()
 
-	svc := labrpc.MakeService(sv)
-	srv := labrpc.MakeServer()
-	srv.AddService(svc)
-	cfg.net.AddServer(i, srv)
+	if f != nil {
+		f()
+	}
 }
 
 func (cfg *config) crashCoordinator() {
@@ -203,29 +797,251 @@ func (cfg *config) crashCoordinatorLocked() {
 	close(cfg.stopCh)
 	cfg.coordinator.Kill()
 
+	// as for a server, the next coordinator starts from a copy of
+	// the log, which the old instance can't write to
+	if cfg.decisions != nil {
+		cfg.decisions = cfg.decisions.Copy()
+	}
+
 	cfg.coordinator = nil
+	cfg.timeline.mark(coordinatorId, "crash")
 }
 
 func (cfg *config) newCoordinator() *Coordinator {
-	// a fresh set of outgoing ClientEnd names.
-	// so that old crashed instance's ClientEnds can't send.
-	cfg.endnames = make([]string, cfg.n)
-	for i := range cfg.n {
-		cfg.endnames[i] = randstring(20)
+	co, endnames, stopCh := cfg.launchCoordinator("coordinator", cfg.decisions)
+	cfg.endnames = endnames
+	cfg.stopCh = stopCh
+	return co
+}
+
+// restart the coordinator logging its decisions to a Persister.
+// every later restart hands the new coordinator a copy of the log,
+// and nothing else the old one knew, so it recovers from the log
+// and the servers' Query replies alone.
+func (cfg *config) persistCoordinator() {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+
+	cfg.decisions = MakePersister()
+	cfg.restartCoordinatorLocked()
+}
+
+// the outcome the coordinator's log holds for tid, "" if none.
+func (cfg *config) loggedDecision(tid int) string {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+
+	return cfg.loggedDecisionLocked(tid)
+}
+
+func (cfg *config) loggedDecisionLocked(tid int) string {
+	if cfg.decisions == nil {
+		cfg.t.Fatalf("loggedDecision: the coordinator doesn't log its decisions")
+	}
+	framed, _, err := readFrames(cfg.decisions.ReadServerState())
+	if err != nil {
+		cfg.t.Fatalf("loggedDecision: %v", err)
 	}
+	outcome := ""
+	d := labgob.NewDecoder(bytes.NewBuffer(framed))
+	for {
+		var record decisionRecord
+		if d.Decode(&record) != nil {
+			return outcome
+		}
+		if record.Tid == tid {
+			outcome = record.Outcome
+		}
+	}
+}
 
-	// a fresh set of ClientEnds.
-	ends := make([]*labrpc.ClientEnd, cfg.n)
+// start a Coordinator on a fresh set of ends to every server,
+// with its own applier, logging as name, and its decisions to
+// decisions if that isn't nil.
+func (cfg *config) launchCoordinator(name string, decisions *Persister) (*Coordinator, []string, chan struct{}) {
+	// a fresh set of outgoing ClientEnds, so that old
+	// crashed instance's ClientEnds can't send.
+	endnames := make([]string, cfg.n)
+	ends := make([]PeerClient, cfg.n)
 	for i := range cfg.n {
-		ends[i] = cfg.net.MakeEnd(cfg.endnames[i])
-		cfg.net.Connect(cfg.endnames[i], i)
+		endnames[i], ends[i] = cfg.makeEnd(i)
 	}
 
 	respChan := make(chan ResponseMsg)
-	cfg.stopCh = make(chan struct{})
-	go cfg.applier(respChan, cfg.stopCh)
+	stopCh := make(chan struct{})
+	cfg.goBackground(func() { cfg.applier(respChan, stopCh) })
+
+	cfg.timeline.mark(coordinatorId, "start")
+	co := makeLoggingCoordinator(ends, respChan, cfg.clock, cfg.timeout, cfg.log.logger(name), decisions, nil)
+	co.OnSlow(func(s SlowTransaction) {
+		cfg.timeline.mark(coordinatorId, "slow %d: %s, waiting for %v", s.Tid, s.Phase, s.Waiting)
+	})
+	co.WarnSlow(slowPhase)
+	cfg.started = append(cfg.started, startedCoordinator{co, respChan})
+	return co, endnames, stopCh
+}
+
+// a ClientEnd to server i, under a fresh random name.
+func (cfg *config) makeEnd(i int) (string, *labrpc.ClientEnd) {
+	endname := randstring(20)
+	end := cfg.net.MakeEnd(endname)
+	cfg.net.Connect(endname, i)
+	cfg.timeline.addEnd(endname, i)
+	cfg.net.SetLatency(endname, cfg.latency[i])
+	return endname, end
+}
+
+// give the coordinator a simulated clock, restarting it so that
+// it takes effect. its timeouts then only fire when the test
+// advances the clock.
+// a Coordinator started by startExtraCoordinator().
+type extraCoordinator struct {
+	co       *Coordinator
+	endnames []string
+	stopCh   chan struct{}
+}
+
+// start another Coordinator next to the current one, e.g. a
+// replacement started while the old one wasn't really dead. it
+// recovers like a restarted Coordinator, and reports to the same
+// history. returns its number for finishTransactionOn(); the
+// usual coordinator is 0. faults from interceptNth() and friends
+// only apply to coordinator 0.
+func (cfg *config) startExtraCoordinator() int {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+
+	return cfg.startExtraCoordinatorLocked()
+}
+
+func (cfg *config) startExtraCoordinatorLocked() int {
+	co, endnames, stopCh := cfg.launchCoordinator(fmt.Sprintf("coordinator %d", len(cfg.extras)+1), nil)
+	for _, endname := range endnames {
+		cfg.net.Enable(endname, true)
+	}
+	cfg.extras = append(cfg.extras, extraCoordinator{co, endnames, stopCh})
+	return len(cfg.extras)
+}
+
+func (cfg *config) coordinatorLocked(c int) *Coordinator {
+	if c == 0 {
+		return cfg.coordinator
+	}
+	if c < 0 || c > len(cfg.extras) {
+		cfg.t.Fatalf("no coordinator %d", c)
+	}
+	return cfg.extras[c-1].co
+}
+
+// cut coordinator c off from every server, or reconnect it.
+func (cfg *config) isolateCoordinator(c int, isolated bool) {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+
+	cfg.isolateCoordinatorLocked(c, isolated)
+}
+
+func (cfg *config) isolateCoordinatorLocked(c int, isolated bool) {
+	if c == 0 {
+		for i := range cfg.n {
+			if isolated {
+				cfg.disconnect(i)
+			} else {
+				cfg.connect(i)
+			}
+		}
+		return
+	}
+
+	cfg.coordinatorLocked(c)
+	if isolated {
+		cfg.timeline.mark(coordinatorId, "isolate coordinator %d", c)
+	} else {
+		cfg.timeline.mark(coordinatorId, "reconnect coordinator %d", c)
+	}
+	for _, endname := range cfg.extras[c-1].endnames {
+		cfg.net.Enable(endname, !isolated)
+	}
+}
+
+func (cfg *config) crashExtraCoordinatorsLocked() {
+	for _, extra := range cfg.extras {
+		for _, endname := range extra.endnames {
+			cfg.net.Enable(endname, false)
+		}
+		close(extra.stopCh)
+		extra.co.Kill()
+	}
+	cfg.extras = nil
+}
+
+// retry Prepare and PreCommit for d, rather than phaseTimeout,
+// before aborting, so a test can time out a server quickly. it
+// applies to the running coordinators' next phases, and to
+// coordinators started later.
+func (cfg *config) setPhaseTimeout(d time.Duration) {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+
+	cfg.timeout = d
+	if cfg.coordinator != nil {
+		cfg.coordinator.setTimeout(d)
+	}
+	for _, extra := range cfg.extras {
+		extra.co.setTimeout(d)
+	}
+}
+
+func (cfg *config) useSimClock() *SimClock {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+
+	clock := MakeSimClock()
+	cfg.clock = clock
+	cfg.restartCoordinatorLocked()
+	return clock
+}
+
+// run the network's delays and timeouts and the coordinator's on
+// one virtual clock, restarting the coordinator so that it takes
+// effect, and step the clock in the background whenever something
+// waits on it, so that time jumps straight to the next event. with
+// the test's seed, a test that keeps one RPC in flight at a time
+// sees the same delays and losses, at the same virtual times, on
+// every run; returns once the restarted coordinator has recovered,
+// so that its Queries don't race the test's RPCs. once the test is over the clock is stepped until
+// nothing waits on it, so RPCs in flight return.
+func (cfg *config) useVirtualTime() *labrpc.VirtualClock {
+	cfg.mu.Lock()
+	clock := labrpc.MakeVirtualClock()
+	cfg.net.SetClock(clock)
+	cfg.clock = clock
+	cfg.restartCoordinatorLocked()
+	co := cfg.coordinator
+	cfg.mu.Unlock()
+
+	cfg.goBackground(func() {
+		for {
+			if clock.Step() {
+				continue
+			}
+			select {
+			case <-cfg.done:
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	})
 
-	return MakeCoordinator(ends, respChan)
+	// the test's RPCs mustn't race the recovery's
+	deadline := time.Now().Add(waitTimeout)
+	for co.working() > 0 {
+		if time.Now().After(deadline) {
+			cfg.t.Fatalf("coordinator didn't recover within %v", waitTimeout)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return clock
 }
 
 // start or re-start the Coordinator.
@@ -250,6 +1066,61 @@ func (cfg *config) checkTimeout() {
 	}
 }
 
+// a Coordinator and the channel it reports on.
+type startedCoordinator struct {
+	co       *Coordinator
+	respChan chan ResponseMsg
+}
+
+// run f in a goroutine that checkGoroutines() waits for.
+func (cfg *config) goBackground(f func()) {
+	cfg.background.Add(1)
+	go func() {
+		defer cfg.background.Add(-1)
+		f()
+	}()
+}
+
+// once everything is killed, every goroutine the coordinators and
+// servers started must return, and then the appliers and the lock
+// checker. wait up to d for stragglers, e.g. RPCs in flight.
+func (cfg *config) checkGoroutines(d time.Duration) {
+	deadline := time.Now().Add(d)
+	settle := func(running func() int) int {
+		for running() > 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return running()
+	}
+
+	for i, started := range cfg.started {
+		if n := settle(started.co.goroutines); n > 0 {
+			cfg.t.Errorf("coordinator %d still has %d goroutines running after Kill()", i, n)
+			continue
+		}
+		// nothing can report on it any more, which stops its applier
+		close(started.respChan)
+	}
+
+	cfg.mu.Lock()
+	instances := cfg.instances
+	cfg.mu.Unlock()
+	for i := range instances {
+		for j, sv := range instances[i] {
+			if n := settle(sv.runningPrepares); n > 0 {
+				cfg.t.Errorf("server %d (instance %d) still has %d Prepares running after Kill()", i, j, n)
+			}
+			if n := settle(sv.goroutines); n > 0 {
+				cfg.t.Errorf("server %d (instance %d) still has %d goroutines running after Kill()", i, j, n)
+			}
+		}
+	}
+
+	if n := settle(func() int { return int(cfg.background.Load()) }); n > 0 {
+		cfg.t.Errorf("%d of the tester's appliers and checkers still running after cleanup()", n)
+	}
+}
+
 func (cfg *config) cleanup() {
 	/*
 		for i := 0; i < len(cfg.rafts); i++ {
@@ -258,15 +1129,54 @@ func (cfg *config) cleanup() {
 			}
 		}
 	*/
-	cfg.coordinator.Kill()
+	close(cfg.done)
+	cfg.mu.Lock()
+	// the coordinator first, so that nothing it reports after
+	// the servers are killed reaches the applier
+	cfg.crashCoordinatorLocked()
+	cfg.crashExtraCoordinatorsLocked()
+	for i := range cfg.servers {
+		if cfg.servers[i] != nil {
+			cfg.resumeLocked(i)
+			cfg.servers[i].Kill()
+		}
+	}
+	cfg.mu.Unlock()
 	cfg.net.Cleanup()
 	cfg.checkTimeout()
+	cfg.checkGoroutines(5 * time.Second)
+	if cfg.t.Failed() {
+		fmt.Printf("  ... seed %d; rerun with TEST_SEED=%d\n", cfg.seed, cfg.seed)
+	}
+	if cfg.t.Failed() || os.Getenv("TIMELINE") != "" {
+		if name, err := cfg.timeline.save(cfg.t.Name(), cfg.n); err != nil {
+			fmt.Printf("  ... can't write timeline: %v\n", err)
+		} else {
+			fmt.Printf("  ... timeline in %s\n", name)
+		}
+	}
+	if cfg.t.Failed() || os.Getenv("JOURNAL") != "" {
+		fmt.Printf("  ... the last %d messages on each end:\n", journalSize)
+		cfg.net.DumpJournals(os.Stdout)
+	}
+	if cfg.t.Failed() || os.Getenv("LOG") != "" {
+		cfg.log.dump(os.Stdout, logLevelFromEnv())
+	}
+}
+
+// log a line from the test itself, e.g. what fault it's about to
+// inject, alongside the coordinator's and servers' lines.
+func (cfg *config) logf(format string, a ...interface{}) {
+	cfg.tester.Infof(noTid, "", format, a...)
 }
 
 // attach server i to the net.
 func (cfg *config) connect(i int) {
 	// fmt.Printf("connect(%d)\n", i)
 
+	if !cfg.connected[i] {
+		cfg.timeline.mark(i, "connect")
+	}
 	cfg.connected[i] = true
 
 	cfg.net.Enable(cfg.endnames[i], true)
@@ -282,11 +1192,177 @@ func (cfg *config) connectAll() {
 func (cfg *config) disconnect(i int) {
 	// fmt.Printf("disconnect(%d)\n", i)
 
+	if cfg.connected[i] {
+		cfg.timeline.mark(i, "disconnect")
+	}
 	cfg.connected[i] = false
 
 	cfg.net.Enable(cfg.endnames[i], false)
 }
 
+// cut one direction between the coordinator and server i: with
+// requests but not replies, server i runs the coordinator's RPCs
+// but the coordinator never hears back; with replies but not
+// requests, only RPCs server i already has get answers.
+// connect(i) restores both directions.
+func (cfg *config) connectOneWay(i int, requests bool, replies bool) {
+	switch {
+	case requests && replies:
+		cfg.connect(i)
+		return
+	case requests:
+		cfg.timeline.mark(i, "lose replies")
+	case replies:
+		cfg.timeline.mark(i, "lose requests")
+	default:
+		cfg.disconnect(i)
+		return
+	}
+	cfg.connected[i] = false
+
+	cfg.net.EnableDirections(cfg.endnames[i], requests, replies)
+}
+
+// stall server i without disconnecting it, e.g. as in a long GC
+// pause: requests still reach it, but wait unhandled until
+// resume(i), so senders see a slow RPC rather than a lost one.
+// handlers that are already running carry on.
+func (cfg *config) pause(i int) {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+
+	cfg.pauseLocked(i)
+}
+
+func (cfg *config) pauseLocked(i int) {
+	if cfg.rpcServers[i] == nil || cfg.paused[i] {
+		return
+	}
+	cfg.timeline.mark(i, "pause")
+	cfg.paused[i] = true
+	cfg.rpcServers[i].Pause()
+}
+
+// handle the requests server i held since pause(i), and new ones.
+func (cfg *config) resume(i int) {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+
+	cfg.resumeLocked(i)
+}
+
+func (cfg *config) resumeLocked(i int) {
+	if cfg.rpcServers[i] == nil || !cfg.paused[i] {
+		return
+	}
+	cfg.timeline.mark(i, "resume")
+	cfg.paused[i] = false
+	cfg.rpcServers[i].Resume()
+}
+
+// the coordinator's id in partition groups.
+const coordinatorId = -1
+
+// split the coordinator (coordinatorId) and the servers into
+// isolated groups. the coordinator can only reach the servers in
+// its own group. every server and the coordinator must appear in
+// exactly one group.
+// e.g. cfg.partition([][]int{{coordinatorId, 0}, {1, 2}})
+func (cfg *config) partition(groups [][]int) {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+
+	cfg.partitionLocked(groups)
+}
+
+func (cfg *config) partitionLocked(groups [][]int) {
+	seen := make(map[int]bool)
+	reachable := make([]bool, cfg.n)
+	for _, group := range groups {
+		withCoordinator := false
+		for _, i := range group {
+			if i == coordinatorId {
+				withCoordinator = true
+			}
+		}
+		for _, i := range group {
+			if i != coordinatorId && (i < 0 || i >= cfg.n) {
+				cfg.t.Fatalf("partition: unknown server %d", i)
+			}
+			if seen[i] {
+				cfg.t.Fatalf("partition: %d appears in more than one group", i)
+			}
+			seen[i] = true
+			if i != coordinatorId {
+				reachable[i] = withCoordinator
+			}
+		}
+	}
+	if len(seen) != cfg.n+1 {
+		cfg.t.Fatalf("partition: groups must cover the coordinator and all %d servers", cfg.n)
+	}
+
+	cfg.groups = groups
+	cfg.timeline.mark(coordinatorId, "partition %v", groups)
+	for i := 0; i < cfg.n; i++ {
+		if reachable[i] {
+			cfg.connect(i)
+		} else {
+			cfg.disconnect(i)
+		}
+	}
+}
+
+// remove the current partition and reconnect everyone.
+func (cfg *config) heal() {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+
+	cfg.healLocked()
+}
+
+func (cfg *config) healLocked() {
+	cfg.groups = nil
+	cfg.timeline.mark(coordinatorId, "heal")
+	cfg.connectAll()
+}
+
+// delay every RPC from the coordinator to server i by d.
+// the delay survives coordinator restarts; zero removes it.
+func (cfg *config) setLatency(i int, d time.Duration) {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+
+	cfg.latency[i] = d
+	cfg.net.SetLatency(cfg.endnames[i], d)
+}
+
+// show f every RPC between the coordinator and the servers as it
+// is sent, delivered and replied to, with copies of its args and
+// reply that f may change. f runs on the network's goroutines, and
+// for the rest of the test.
+func (cfg *config) onMessage(f labrpc.MessageFunc) {
+	cfg.net.RegisterMessageCallback(f)
+}
+
+// carry at most bytesPerSec of the RPCs to and from server i,
+// from any coordinator; zero removes the limit.
+func (cfg *config) setBandwidth(i int, bytesPerSec int) {
+	cfg.net.SetServerBandwidth(i, bytesPerSec)
+}
+
+// put method's RPCs, e.g. "Server.Abort", in lane p: on a link
+// limited by setBandwidth, or a paused server, High RPCs go ahead
+// of the Bulk ones waiting there.
+func (cfg *config) setPriority(method string, p labrpc.Priority) {
+	cfg.net.SetPriority(method, p)
+}
+
+// encode every later RPC's args and reply with c.
+func (cfg *config) setCodec(c codec.Codec) {
+	cfg.net.SetCodec(c)
+}
+
 func (cfg *config) rpcCount(server int) int {
 	return cfg.net.GetCount(server)
 }
@@ -312,6 +1388,7 @@ func (cfg *config) sendGet(tid int, key string) {
 	defer cfg.mu.Unlock()
 
 	cfg.servers[cfg.keyMap[key]].Get(tid, key)
+	cfg.ops[tid] = append(cfg.ops[tid], models.TxnOp{IsGet: true, Key: key})
 }
 
 func (cfg *config) sendSet(tid int, key string, value interface{}) {
@@ -319,26 +1396,152 @@ func (cfg *config) sendSet(tid int, key string, value interface{}) {
 	defer cfg.mu.Unlock()
 
 	cfg.servers[cfg.keyMap[key]].Set(tid, key, value)
+	cfg.ops[tid] = append(cfg.ops[tid], models.TxnOp{IsGet: false, Key: key, Value: value})
 }
 
 func (cfg *config) finishTransaction(tid int) {
+	cfg.finishTransactionOn(0, tid)
+}
+
+// finish the transaction on coordinator c: 0 for the usual one,
+// or a number returned by startExtraCoordinator().
+func (cfg *config) finishTransactionOn(c int, tid int) {
 	cfg.mu.Lock()
 	defer cfg.mu.Unlock()
 
-	go cfg.coordinator.FinishTransaction(tid)
+	// a retry doesn't move the transaction's start
+	if _, ok := cfg.calls[tid]; !ok {
+		cfg.calls[tid] = time.Since(cfg.start).Nanoseconds()
+	}
+	co := cfg.coordinatorLocked(c)
+	if c == 0 {
+		cfg.timeline.mark(coordinatorId, "finish %d", tid)
+	} else {
+		cfg.timeline.mark(coordinatorId, "finish %d on coordinator %d", tid, c)
+	}
+	go co.FinishTransaction(tid)
+}
+
+// like waitTransaction, but finish the transaction again every
+// retry, as a client would if its response might have been lost.
+// gives up and returns false at the deadline.
+func (cfg *config) waitTransactionRetrying(tid int, retry time.Duration, deadline time.Time) (ResponseMsg, bool) {
+	for time.Now().Before(deadline) {
+		if m, ok := cfg.waitTransactionFor(tid, min(retry, time.Until(deadline))); ok {
+			return m, true
+		}
+		if time.Now().Before(deadline) {
+			cfg.finishTransaction(tid)
+		}
+	}
+	return ResponseMsg{}, false
 }
 
+// how long waitTransaction() waits for a response before failing
+// the test, well before the tester's two-minute limit.
+const waitTimeout = 30 * time.Second
+
+// how long a transaction may stay in one phase before its
+// coordinator logs a warning naming the servers it waits on.
+const slowPhase = 5 * time.Second
+
+// wait for tid's response, failing the test with the coordinator's
+// and servers' view of the transaction if none arrives within
+// waitTimeout.
 func (cfg *config) waitTransaction(tid int) ResponseMsg {
+	m, ok := cfg.waitTransactionFor(tid, waitTimeout)
+	if !ok {
+		cfg.t.Fatalf("Transaction %d got no response within %v\n%s", tid, waitTimeout, cfg.describeTransaction(tid))
+	}
+	return m
+}
+
+// wait up to timeout for tid's response; false if none arrived.
+func (cfg *config) waitTransactionFor(tid int, timeout time.Duration) (ResponseMsg, bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
 	for {
 		cfg.mu.Lock()
 		for _, trans := range cfg.transactions {
 			if trans.tid == tid {
-				defer cfg.mu.Unlock()
-				return trans
+				cfg.mu.Unlock()
+				return trans, true
 			}
 		}
+		changed := cfg.changed
 		cfg.mu.Unlock()
-		time.Sleep(10 * time.Millisecond)
+
+		cfg.stopIfFailed()
+		select {
+		case <-changed:
+		case <-timer.C:
+			return ResponseMsg{}, false
+		}
+	}
+}
+
+// wake everything waiting in waitTransactionFor() to look again.
+func (cfg *config) wakeWaitersLocked() {
+	close(cfg.changed)
+	cfg.changed = make(chan struct{})
+}
+
+// fail the test from a goroutine other than the test's own; the
+// test stops when it next waits for a transaction.
+func (cfg *config) backgroundErrorf(format string, a ...interface{}) {
+	cfg.t.Helper()
+	cfg.t.Errorf(format, a...)
+	cfg.tester.Warnf(noTid, "", format, a...)
+
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	cfg.wakeWaitersLocked()
+}
+
+// the coordinators' and servers' view of tid, for a test that
+// gave up waiting for it, and what every stuck transaction waits
+// for.
+func (cfg *config) describeTransaction(tid int) string {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+
+	var b strings.Builder
+	coordinators := []*Coordinator{cfg.coordinator}
+	for _, extra := range cfg.extras {
+		coordinators = append(coordinators, extra.co)
+	}
+	for c, co := range coordinators {
+		if co == nil {
+			fmt.Fprintf(&b, "  coordinator %d: not running\n", c)
+		} else if phase, relevant, ok := co.transactionPhase(tid); ok {
+			fmt.Fprintf(&b, "  coordinator %d: phase %s, servers %v, %d goroutines\n", c, phase, relevant, co.goroutines())
+		} else {
+			fmt.Fprintf(&b, "  coordinator %d: doesn't know transaction %d\n", c, tid)
+		}
+	}
+	for i, sv := range cfg.servers {
+		if sv == nil {
+			fmt.Fprintf(&b, "  server %d: crashed\n", i)
+			continue
+		}
+		state := "no record"
+		if s, ok := sv.transactionState(tid); ok {
+			state = s.String()
+		}
+		fmt.Fprintf(&b, "  server %d: %s, connected %v, paused %v, %d Prepares running\n",
+			i, state, cfg.connected[i], cfg.paused[i], sv.runningPrepares())
+	}
+	if cfg.coordinator != nil {
+		b.WriteString(cfg.coordinator.DumpBlocked(0, cfg.servers))
+	}
+	return b.String()
+}
+
+// stop waiting once a background check has failed the test.
+func (cfg *config) stopIfFailed() {
+	if cfg.t.Failed() {
+		cfg.t.FailNow()
 	}
 }
 
@@ -380,6 +1583,86 @@ func (cfg *config) assertTransaction(tid int, committed bool, readValues map[str
 	return resp
 }
 
+// check server i's store directly, bypassing the read path: every
+// key it holds must have the value in want, and keys missing from
+// want must never have been written.
+func (cfg *config) assertStoreEquals(i int, want map[string]interface{}) {
+	cfg.mu.Lock()
+	sv := cfg.servers[i]
+	cfg.mu.Unlock()
+	if sv == nil {
+		cfg.t.Fatalf("assertStoreEquals: server %d is not running", i)
+	}
+
+	got := sv.storeValues()
+	for key, v := range want {
+		if _, ok := got[key]; !ok {
+			cfg.t.Fatalf("server %d doesn't store key %s", i, key)
+		}
+		if !reflect.DeepEqual(got[key], v) {
+			cfg.t.Fatalf("server %d stores %v for key %s, expected %v", i, got[key], key, v)
+		}
+	}
+	for key, v := range got {
+		if _, ok := want[key]; !ok && v != nil {
+			cfg.t.Fatalf("server %d stores %v for key %s, expected it to be unset", i, v, key)
+		}
+	}
+}
+
+// every server must have taken a snapshot, and kept its log
+// under maxstate since.
+func (cfg *config) checkSnapshots() {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	if cfg.maxstate < 0 {
+		cfg.t.Fatalf("checkSnapshots: servers don't take snapshots")
+	}
+	for i, ps := range cfg.saved {
+		if ps.SnapshotSize() == 0 {
+			cfg.t.Fatalf("server %d never took a snapshot", i)
+		}
+		if size := ps.ServerStateSize(); size > cfg.maxstate {
+			cfg.t.Fatalf("server %d's log is %d bytes, more than maxstate %d", i, size, cfg.maxstate)
+		}
+	}
+}
+
+const serializabilityCheckTimeout = 1 * time.Second
+
+// check that every transaction's outcome is explained by some
+// serial order of the committed transactions that respects
+// real time. transactions without a response may or may not
+// have committed.
+func (cfg *config) checkHistory() {
+	cfg.mu.Lock()
+	history := make([]porcupine.Operation, 0, len(cfg.calls))
+	for tid, call := range cfg.calls {
+		op := porcupine.Operation{
+			ClientId: tid,
+			Input:    models.TxnInput{Tid: tid, Ops: cfg.ops[tid]},
+			Call:     call,
+			Output:   models.TxnOutput{Unknown: true},
+			Return:   math.MaxInt64,
+		}
+		for _, trans := range cfg.transactions {
+			if trans.tid == tid {
+				op.Output = models.TxnOutput{Committed: trans.committed, ReadValues: trans.readValues}
+				op.Return = cfg.returns[tid]
+			}
+		}
+		history = append(history, op)
+	}
+	cfg.mu.Unlock()
+
+	res := porcupine.CheckOperationsTimeout(models.TxnKvModel, history, serializabilityCheckTimeout)
+	if res == porcupine.Illegal {
+		cfg.t.Fatalf("history is not serializable")
+	} else if res == porcupine.Unknown {
+		fmt.Println("info: serializability check timed out, assuming history is ok")
+	}
+}
+
 // start a Test.
 // print the Test message.
 // e.g. cfg.begin("Test (2B): RPC counts aren't too high")
@@ -388,6 +1671,7 @@ func (cfg *config) begin(description string) {
 	cfg.t0 = time.Now()
 	cfg.rpcs0 = cfg.rpcTotal()
 	cfg.bytes0 = cfg.bytesTotal()
+	cfg.stats0 = cfg.net.GetStats()
 	cfg.maxIndex0 = cfg.maxIndex
 }
 
@@ -397,6 +1681,12 @@ func (cfg *config) begin(description string) {
 // and some performance numbers.
 func (cfg *config) end() {
 	cfg.checkTimeout()
+	if cfg.t.Failed() == false {
+		cfg.checkReleased(releaseTimeout)
+	}
+	if cfg.t.Failed() == false {
+		cfg.checkHistory()
+	}
 	if cfg.t.Failed() == false {
 		cfg.mu.Lock()
 		t := time.Since(cfg.t0).Seconds()       // real time
@@ -404,9 +1694,108 @@ func (cfg *config) end() {
 		nrpc := cfg.rpcTotal() - cfg.rpcs0      // number of RPC sends
 		nbytes := cfg.bytesTotal() - cfg.bytes0 // number of bytes
 		ncmds := cfg.maxIndex - cfg.maxIndex0   // number of Raft agreements reported
+		latencies := cfg.commitLatenciesLocked()
 		cfg.mu.Unlock()
 
 		fmt.Printf("  ... Passed --")
-		fmt.Printf("  %4.1f  %d %4d %7d %4d\n", t, npeers, nrpc, nbytes, ncmds)
+		fmt.Printf("  %4.1f  %d %4d %7d %4d", t, npeers, nrpc, nbytes, ncmds)
+		if len(latencies) > 0 {
+			fmt.Printf("  commit p50 %v p95 %v p99 %v",
+				percentile(latencies, 50), percentile(latencies, 95), percentile(latencies, 99))
+		}
+		fmt.Printf("\n")
+		cfg.printRPCStats()
+	}
+}
+
+// how long end() gives the last Commits and Aborts to arrive.
+const releaseTimeout = 2 * time.Second
+
+// fail the test if, once every transaction has had wait to be
+// decided, a running server still holds a lock or still has a
+// transaction that voted Yes and wasn't decided, e.g. because
+// a commit or abort path forgot to release its locks. servers
+// that are disconnected, partitioned away or paused are skipped,
+// since they can't hear the decision.
+func (cfg *config) checkReleased(wait time.Duration) {
+	deadline := time.Now().Add(wait)
+	for {
+		var leaks []string
+		cfg.mu.Lock()
+		for i, sv := range cfg.servers {
+			if sv == nil || sv.killed() || !cfg.connected[i] || cfg.paused[i] {
+				continue
+			}
+			if keys := sv.heldLocks(); len(keys) > 0 {
+				leaks = append(leaks, fmt.Sprintf("server %d holds locks on %v", i, keys))
+			}
+			if tids := sv.undecided(); len(tids) > 0 {
+				leaks = append(leaks, fmt.Sprintf("server %d has undecided transactions %v", i, tids))
+			}
+		}
+		cfg.mu.Unlock()
+
+		if len(leaks) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			cfg.t.Fatalf("at the end of the test: %s", strings.Join(leaks, "; "))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+var serverMethods = []string{"Server.Prepare", "Server.PreCommit", "Server.Commit", "Server.Abort", "Server.Query"}
+
+// the RPCs sent to server for method, and their bytes, since
+// the test started.
+func (cfg *config) rpcStats(server int, method string) labrpc.Stats {
+	return cfg.net.GetStats()[server][method]
+}
+
+// the counts, bytes, failures and latency of every RPC for method,
+// to any server, since the network was made.
+func (cfg *config) methodStats(method string) labrpc.MethodStats {
+	return cfg.net.GetMethodStats()[method]
+}
+
+// print each server's RPCs and bytes per method since begin().
+func (cfg *config) printRPCStats() {
+	stats := cfg.net.GetStats()
+	for i := range cfg.n {
+		var parts []string
+		for _, method := range serverMethods {
+			count := stats[i][method].Count - cfg.stats0[i][method].Count
+			bytes := stats[i][method].Bytes - cfg.stats0[i][method].Bytes
+			if count > 0 {
+				parts = append(parts, fmt.Sprintf("%s %d (%d B)", strings.TrimPrefix(method, "Server."), count, bytes))
+			}
+		}
+		if len(parts) > 0 {
+			fmt.Printf("  ... server %d: %s\n", i, strings.Join(parts, ", "))
+		}
+	}
+}
+
+// time from finishTransaction() to the response, for every
+// committed transaction, in increasing order.
+func (cfg *config) commitLatenciesLocked() []time.Duration {
+	latencies := make([]time.Duration, 0)
+	for _, trans := range cfg.transactions {
+		if trans.committed {
+			d := time.Duration(cfg.returns[trans.tid] - cfg.calls[trans.tid])
+			latencies = append(latencies, d.Round(10*time.Microsecond))
+		}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return latencies
+}
+
+// the p-th percentile of sorted, by the nearest-rank method.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
 	}
+	return sorted[rank-1]
 }
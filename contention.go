@@ -0,0 +1,105 @@
+package commit
+
+//
+// a stress workload with a tunable amount of contention.
+//
+// every client writes a cold key of its own in each transaction,
+// and hotPct percent of transactions also read and write one hot
+// key that every client shares. transactions aren't retried, so
+// the result counts how many of each kind committed:
+//
+// c := contention{hot: "hot", cold: []string{"a", "b"}, hotPct: 50, txns: 10}
+// r := cfg.runContention(c)
+//
+// a Prepare waits for the locks it needs, so conflicting
+// transactions should mostly queue up behind each other rather
+// than abort; one only aborts if it waits longer than the phase
+// timeout.
+//
+
+import (
+	"fmt"
+	"sync"
+)
+
+type contention struct {
+	hot    string   // the key hot transactions share
+	cold   []string // one key per client, which only it writes
+	hotPct int      // percent of transactions that also touch hot
+	txns   int      // transactions per client
+}
+
+type contentionResult struct {
+	hotTxns     int
+	hotCommits  int
+	coldTxns    []int // per client, transactions that didn't touch hot
+	coldCommits []int
+}
+
+func (r contentionResult) txns() int {
+	n := r.hotTxns
+	for _, c := range r.coldTxns {
+		n += c
+	}
+	return n
+}
+
+func (r contentionResult) commits() int {
+	n := r.hotCommits
+	for _, c := range r.coldCommits {
+		n += c
+	}
+	return n
+}
+
+func (r contentionResult) String() string {
+	return fmt.Sprintf("%d/%d committed, hot %d/%d, cold %v/%v",
+		r.commits(), r.txns(), r.hotCommits, r.hotTxns, r.coldCommits, r.coldTxns)
+}
+
+// run c's clients, one per cold key, until each has finished its
+// transactions.
+func (cfg *config) runContention(c contention) contentionResult {
+	r := contentionResult{
+		coldTxns:    make([]int, len(c.cold)),
+		coldCommits: make([]int, len(c.cold)),
+	}
+	var mu sync.Mutex
+
+	var wg sync.WaitGroup
+	for client, cold := range c.cold {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range c.txns {
+				cfg.mu.Lock()
+				hot := cfg.randIntLocked()%100 < c.hotPct
+				cfg.mu.Unlock()
+
+				tid := int(cfg.nextTid.Add(1))
+				cfg.sendSet(tid, cold, tid)
+				if hot {
+					cfg.sendGet(tid, c.hot)
+					cfg.sendSet(tid, c.hot, tid)
+				}
+				cfg.finishTransaction(tid)
+				committed := cfg.waitTransaction(tid).committed
+
+				mu.Lock()
+				if hot {
+					r.hotTxns++
+				} else {
+					r.coldTxns[client]++
+				}
+				if committed && hot {
+					r.hotCommits++
+				} else if committed {
+					r.coldCommits[client]++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return r
+}
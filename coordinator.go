@@ -1,10 +1,18 @@
 package commit
 
 import (
-	"3PhaseCommit/labrpc"
-	"log"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
 	"sync"
 	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Responses to the client
@@ -13,370 +21,470 @@ type ResponseMsg struct {
 	tid        int
 	committed  bool
 	readValues map[string]interface{}
+	durations  map[string]time.Duration // time in each phase it went through, see durationsOf(); nil if reported again after recovery
+	err        *TxnError                // why it aborted; nil if it committed, see errors.go
 }
 
 type Coordinator struct {
-	servers  []*labrpc.ClientEnd
-	respChan chan ResponseMsg
-	dead     int32
+	servers   []PeerClient // protected by mu, since addServer() may grow it
+	respChan  chan ResponseMsg
+	dead      int32
+	running   int32 // goroutines started by the Coordinator that haven't returned
+	watchdog  int32 // the slow-transaction watchdog and the reporter, if running; counted in running too
+	profiling int32 // 1 to label goroutines with their transaction; see profile.go
+	redacting int32 // how logs show values, a Redaction; see redact.go
+	durable   int32 // how durable a decision is before it's acted on, a DurabilityLevel; see durability.go
 
 	tran     map[int]*Transaction // transaction ID : transaction
-	serversN int                  // number of servers
-	mu       sync.Mutex
+	serversN int                  // number of servers; protected by mu
+	clock    Clock                // measures timeouts
+	timeout  time.Duration        // how long Prepare and PreCommit are retried; protected by mu
+	logger   Logger
+	tracer   trace.Tracer       // starts transactions' spans; see tracing.go
+	events   eventBus           // see events.go
+	audit    func()             // ends SetAuditSink()'s subscription
+	metrics  func()             // ends SetMetrics()'s subscription
+	counts   *coordinatorCounts // see expvar.go
+
+	persister   *Persister     // holds the decision log, or nil; see durability.go
+	dlog        DecisionLog    // holds the decision log in place of persister, or nil; see raftlog.go
+	decisionLog *frameWriter   // encodes the records appended to persister; protected by mu
+	decided     map[int]string // tid : outcome, from the decision log; protected by mu
+
+	slowThreshold time.Duration // warn about a transaction this long in one phase; see slow.go
+	slowWatching  bool          // the watchdog has started
+	reportEvery   time.Duration // log a summary this often; see report.go
+	reporting     bool          // the reporter has started
+	migrating     map[int]bool  // servers whose keys are moving: true holds every message to them, false just Prepare; see migrate.go
+	inflight      map[int]int   // messages sent to each server and not yet answered
+	migrations    sync.Mutex    // held by the migration running, if any
+	migrated      *sync.Cond    // on mu; broadcast when migrating or inflight changes, and every migrateCheckInterval during a migration
+
+	mu sync.Mutex
 }
 
 type Transaction struct {
-	Phase      string                 // Current phase: Prepare, PreCommit, Committed, Aborted
-	Relevant   map[int]bool           // Servers with operations for this transaction
-	ReadValues map[string]interface{} // Values from Get operations
+	Phase      string                   // Current phase: Prepare, PreCommit, Committed, Aborted
+	Relevant   map[int]bool             // Servers with operations for this transaction
+	ReadValues map[string]interface{}   // Values from Get operations
+	Recovered  bool                     // Finished by a previous Coordinator; reported again if the client retries
+	Trace      string                   // Sent with the transaction's RPCs, so that servers' logs can be matched to the Coordinator's
+	span       trace.Span               // Its OpenTelemetry span, until its outcome is reported; protected by mu
+	phaseStart time.Time                // When it entered Phase, on the Coordinator's clock; protected by mu
+	started    time.Time                // When it entered its first phase; protected by mu
+	phaseTimes map[string]time.Duration // Time spent in each phase it has left; protected by mu
+	done       bool                     // Its outcome was reported, or recovery found it finished; protected by mu
+	waiting    map[int]string           // Servers yet to answer its phase's message, and that message; protected by mu
+	warnings   int                      // Slow warnings given in this phase; protected by mu
+	answered   map[int]map[string]bool  // Server : the messages it has answered; protected by mu, see rpcstats.go
+	abortErr   *TxnError                // Why it was aborted, once it is; protected by mu
 }
 
+// how long Prepare and PreCommit are retried before giving up on a server
+// and aborting the transaction, unless changed with setTimeout
+const phaseTimeout = 500 * time.Millisecond
+
 // Start the 3PC protocol for a particular transaction
 // TID is a unique transaction ID generated by the client
 // This may be called concurrently
 
 func (co *Coordinator) FinishTransaction(tid int) {
 	co.mu.Lock()
-	// Check if the transaction is already in progress
-
-	if _, exists := co.tran[tid]; !exists {
-		// Create a new transaction and add it to the map
-		co.tran[tid] = &Transaction{
-			Phase:      PhasePrepare,
-			Relevant:   make(map[int]bool),
-			ReadValues: make(map[string]interface{}),
-		}
-	}
-
-	tran := co.tran[tid]
-	co.mu.Unlock()
-
-	go func() {
-
-		// ======================
-		// PHASE 1: PREPARE
-		// ======================
-
-		relevant := make(map[int]bool)
-		votes := make(map[int]bool)
-		allVotedYes := true
-
-		// Send Prepare RPC to all servers
-
-		log.Printf("Coordinator: Sending Prepare RPC to all servers for transaction %d\n", tid)
-
-		for i := 0; i < co.serversN; i++ {
-			log.Printf("Coordinator: Sending Prepare RPC to server %d for transaction %d\n", i, tid)
-			if co.killed() {
-				return
-			}
-
-			args := &RPCArgs{Tid: tid}
-			reply := &PrepareReply{}
 
-			for !co.sendPrepare(i, args, reply) {
-				log.Printf("Coordinator: Failed to send Prepare RPC to server %d for transaction %d\n", i, tid)
-				co.abortTransaction(tid, relevant)
-				co.mu.Lock()
-				tran.Phase = PhaseAborted
-				co.mu.Unlock()
-				co.respChan <- ResponseMsg{tid: tid, committed: false, readValues: nil}
-				return
-
-			}
-
-			log.Printf("Coordinator: Received Prepare RPC reply from server %d for transaction %d\n", i, tid)
-
-			if reply.Relevant {
-				relevant[i] = true
-				votes[i] = reply.Vote
-				if !reply.Vote {
-					allVotedYes = false
-				}
-			}
-
-			log.Printf("Coordinator Reply: Server %d voted %v for transaction %d\n", i, reply.Vote, tid)
-
-		}
-
-		co.mu.Lock()
-		tran.Relevant = relevant
-		co.mu.Unlock()
-
-		log.Printf("Coordinator: Checking votes for transaction %d\n", tid)
-
-		if !allVotedYes {
-			log.Printf("Coordinator: At least one server voted No for transaction %d, aborting transaction\n", tid)
-			co.abortTransaction(tid, relevant)
-			co.mu.Lock()
-			tran.Phase = PhaseAborted
+	if tran, exists := co.tran[tid]; exists {
+		// a client retrying a transaction finished by the previous
+		// Coordinator, whose response may have been lost
+		if tran.Recovered {
+			tran.Recovered = false
 			co.mu.Unlock()
-			co.respChan <- ResponseMsg{tid: tid, committed: false, readValues: nil}
+			co.logFor(withTxn(context.Background(), tid, "")).Infof("reporting recovered transaction again")
+			co.report(tid, tran)
 			return
-
 		}
 
-		// ======================
+		// recovery may already be driving this transaction
+		co.mu.Unlock()
+		co.logFor(withTxn(context.Background(), tid, "")).Debugf("already in progress")
+		return
+	}
 
-		// PHASE 2: PRECOMMIT
+	tran := &Transaction{
+		Relevant:   make(map[int]bool),
+		ReadValues: make(map[string]interface{}),
+		Trace:      newTrace(),
+	}
+	co.tran[tid] = tran
+	co.setPhaseLocked(tid, tran, PhasePrepare)
+	co.mu.Unlock()
+	co.counts.started.Add(1)
 
-		// ======================
+	co.spawn(func() { co.run3PC(tid, tran) })
 
-		log.Printf("Coordinator: Sending PreCommit RPC to all servers for transaction %d\n", tid)
+}
 
-		for i := range relevant {
-			if co.killed() {
-				return
-			}
+// Report the outcome of a transaction that was already finished on every server
+// A committed transaction runs the Commit phase again, which servers answer
+// with the values they read the first time
 
-			args := &RPCArgs{Tid: tid}
-			retry := 0
-			for !co.sendPreCommit(i, args) {
-				log.Printf("Coordinator: Failed to send PreCommit RPC to server %d for transaction %d\n", i, tid)
+func (co *Coordinator) report(tid int, tran *Transaction) {
 
-				if co.killed() {
-					return
-				}
+	co.mu.Lock()
+	phase := tran.Phase
+	why := tran.abortErr
+	if phase != PhaseAborted {
+		tran.done = false // its Commit is sent again
+	}
+	co.mu.Unlock()
 
-				if retry > 3 {
-					log.Printf("Coordinator: Timeout waiting for PreCommit to server %d for transaction %d, aborting\n", i, tid)
-					co.Kill()
-					log.Printf("killing coordinator")
-					co.abortTransaction(tid, relevant)
-					co.mu.Lock()
-					tran.Phase = PhaseAborted
-					co.mu.Unlock()
-					co.respChan <- ResponseMsg{tid: tid, committed: false, readValues: nil}
-					return
+	if phase == PhaseAborted {
+		co.respChan <- ResponseMsg{tid: tid, committed: false, readValues: nil, err: why}
+		return
+	}
 
-				}
+	co.spawn(func() { co.run3PC(tid, tran) })
 
-				retry++
+}
 
-			}
+// Abort the transaction, because of why
+// Abort RPCs go to every relevant server in parallel, since an unreachable
+// server may keep its RPCs retrying for a long time. The decision is reported
+// to the client once one server has recorded it; from then on a recovering
+// Coordinator will see the abort instead of resuming the transaction
 
-		}
+func (co *Coordinator) decideAbort(tid int, tran *Transaction, relevant map[int]bool, why *TxnError) {
 
-		co.mu.Lock()
-		tran.Phase = PhasePreCommit
+	co.mu.Lock()
+	if co.decided[tid] == PhaseCommitted {
+		// a server may have committed already
 		co.mu.Unlock()
+		co.logFor(withTxn(context.Background(), tid, PhaseAborted)).Warnf("not aborting, as the commit was logged: %v", why)
+		return
+	}
+	co.setPhaseLocked(tid, tran, PhaseAborted)
+	tran.Relevant = relevant
+	tran.abortErr = why
+	co.mu.Unlock()
 
-		// ======================
-
-		// PHASE 3: COMMIT
-
-		// ======================
-
-		log.Printf("Coordinator: Sending Commit RPC to all servers for transaction %d\n", tid)
-		readValues := make(map[string]interface{})
-
-		for i := range relevant {
-
-			if co.killed() {
-				return
-			}
-
-			args := &RPCArgs{Tid: tid}
-			reply := &CommitReply{}
-			log.Printf("Coordinator: Sending Commit RPC to server %d for transaction %d\n", i, tid)
-			co.sendCommit(i, args, reply)
-
-			for !co.sendCommit(i, args, reply) {
-				log.Printf("Coordinator: Failed to send Commit RPC to server %d for transaction %d\n", i, tid)
-
-				if co.killed() {
-					return
-				}
-
-			}
+	ctx, span := co.startPhase(co.traceTransaction(tid, tran), tid, PhaseAborted)
+	defer co.profile(ctx)()
+	co.logFor(ctx).Infof("aborting")
+	defer span.End()
+	if !co.logDecision(ctx, tid, PhaseAborted) {
+		return
+	}
 
-			log.Printf("Coordinator: Received Commit RPC reply from server %d for transaction %d\n", i, tid)
+	if len(relevant) == 0 {
+		co.respChan <- ResponseMsg{tid: tid, committed: false, readValues: nil, durations: co.durationsOf(tran), err: why}
+		co.reported(tid, tran, PhaseAborted)
+		return
+	}
 
-			for k, v := range reply.ReadValues {
-				readValues[k] = v
-			}
+	acks := make(chan bool, len(relevant))
+	for i := range relevant {
+		co.spawn(func() { acks <- co.abortServer(ctx, tid, i) })
+	}
 
+	for range relevant {
+		if <-acks {
+			co.respChan <- ResponseMsg{tid: tid, committed: false, readValues: nil, durations: co.durationsOf(tran), err: why}
+			co.reported(tid, tran, PhaseAborted)
+			return
 		}
+	}
 
-		co.mu.Lock()
-		tran.Phase = PhaseCommitted
-		tran.ReadValues = readValues
-		co.mu.Unlock()
-		co.respChan <- ResponseMsg{tid: tid, committed: true, readValues: readValues}
-
-	}()
+	// killed before any server heard of the abort; the next Coordinator decides
 
 }
 
-// Abort the transaction
-
-func (co *Coordinator) abortTransaction(tid int, relevant map[int]bool) {
+// Send Abort to one server until it succeeds
+// Returns false if the Coordinator was killed first
 
-	log.Printf("Coordinator: Aborting transaction %d\n", tid)
+func (co *Coordinator) abortServer(ctx context.Context, tid int, server int) bool {
 
-	// Send Abort RPC to all servers
+	args := &RPCArgs{Tid: tid}
+	co.logFor(ctx).Debugf("sending Abort to server %d", server)
+	ctx, rpc := co.startRPC(ctx, "Server.Abort", server)
 
-	for i := range relevant {
-
-		log.Printf("Coordinator: Sending Abort RPC to server %d for transaction %d\n", i, tid)
+	for err := co.sendAbort(ctx, server, args); err != nil; err = co.sendAbort(ctx, server, args) {
+		co.logFor(ctx).Warnf("failed to send Abort to server %d: %v", server, err)
+		rpc.RecordError(err)
 		if co.killed() {
-			log.Printf("Coordinator: Aborting transaction %d due to kill signal\n", tid)
-			return
-		}
-
-		args := &RPCArgs{Tid: tid}
-
-		for !co.sendAbort(i, args) {
-			log.Printf("Coordinator: Failed to send Abort RPC to server %d for transaction %d\n", i, tid)
-			if co.killed() {
-				return
-			}
-
+			co.logFor(ctx).Debugf("killed, giving up on Abort")
+			endSpan(rpc, errKilled)
+			return false
 		}
 
 	}
 
-	log.Printf("Coordinator: Transaction %d aborted\n", tid)
+	co.logFor(ctx).Debugf("server %d aborted", server)
+	rpc.End()
+	return true
 
 }
 
+// Drive a transaction through the remaining phases of 3PC, starting at tran.Phase
+// Used both for new transactions and for transactions resumed during recovery
+
 func (co *Coordinator) run3PC(tid int, tran *Transaction) bool {
-	log.Printf("Coordinator: Running 3PC for transaction %d\n", tid)
-	if tran.Phase == PhasePrepare {
-		log.Printf("Coordinator, Run3RPC: Transaction %d in PhasePrepare\n", tid)
+	ctx := co.traceTransaction(tid, tran)
+	co.logFor(ctx).Debugf("running 3PC, trace %s", tran.Trace)
 
-		relevant := make(map[int]bool)
-		votes := make(map[int]bool)
-		allVotedYes := true
+	co.mu.Lock()
+	phase := tran.Phase
+	relevant := tran.Relevant
+	timeout := co.timeout
+	serversN := co.serversN
+	co.mu.Unlock()
 
-		// Send Prepare RPC to all servers
+	// ======================
+	// PHASE 1: PREPARE
+	// ======================
 
-		log.Printf("Coordinator: Sending Prepare RPC to all servers for transaction %d\n", tid)
+	if phase == PhasePrepare {
+		pctx, span := co.startPhase(ctx, tid, PhasePrepare)
+		defer co.profile(pctx)()
+		co.logFor(pctx).Debugf("sending Prepare to all servers")
 
-		for i := 0; i < co.serversN; i++ {
-			log.Printf("Coordinator: Sending Prepare RPC to server %d for transaction %d\n", i, tid)
+		relevant = make(map[int]bool)
+		var votedNo *TxnError // the first server's No
+
+		for i := 0; i < serversN; i++ {
+			co.logFor(pctx).Debugf("sending Prepare to server %d", i)
 			if co.killed() {
+				endSpan(span, errKilled)
 				return false
 			}
 
 			args := &RPCArgs{Tid: tid}
 			reply := &PrepareReply{}
 
-			for !co.sendPrepare(i, args, reply) {
-				log.Printf("Coordinator: Failed to send Prepare RPC to server %d for transaction %d\n", i, tid)
-				co.abortTransaction(tid, relevant)
-				co.mu.Lock()
-				tran.Phase = PhaseAborted
-				co.mu.Unlock()
-				co.respChan <- ResponseMsg{tid: tid, committed: false, readValues: nil}
-				return false
+			rctx, rpc := co.startRPC(pctx, "Server.Prepare", i)
+			deadline := co.clock.Now().Add(timeout)
+			for err := co.sendPrepare(rctx, i, args, reply); err != nil; err = co.sendPrepare(rctx, i, args, reply) {
+				co.logFor(pctx).Warnf("failed to send Prepare to server %d: %v", i, err)
+				rpc.RecordError(err)
+
+				if co.killed() {
+					endSpan(rpc, errKilled)
+					endSpan(span, errKilled)
+					return false
+				}
+
+				// resending a message that's too large can't help
+				tooLarge := errors.Is(err, ErrMessageTooLarge)
+				if tooLarge || !co.clock.Now().Before(deadline) {
+					if tooLarge {
+						co.logFor(pctx).Warnf("Prepare with server %d doesn't fit in a message, aborting", i)
+					} else {
+						co.logFor(pctx).Warnf("timed out waiting for Prepare from server %d, aborting", i)
+					}
+					// servers we haven't heard from may hold the transaction,
+					// or still be acquiring its locks, so all of them must
+					// hear the abort
+					for j := 0; j < serversN; j++ {
+						relevant[j] = true
+					}
+					endSpan(rpc, err)
+					endSpan(span, err)
+					co.decideAbort(tid, tran, relevant, phaseError(tid, PhasePrepare, i, err))
+					return false
+				}
+
+				reply = &PrepareReply{}
 
 			}
+			rpc.End()
 
-			log.Printf("Coordinator: Received Prepare RPC reply from server %d for transaction %d\n", i, tid)
+			co.logFor(pctx).Debugf("received Prepare reply from server %d", i)
+			co.publish(VoteReceived{EventHeader: co.eventHeader(pctx), Server: i, Relevant: reply.Relevant, Vote: reply.Vote})
 
 			if reply.Relevant {
 				relevant[i] = true
-				votes[i] = reply.Vote
 				if !reply.Vote {
-					allVotedYes = false
+					co.counts.rejectedVotes.Add(1)
+				}
+				if !reply.Vote && votedNo == nil {
+					votedNo = voteError(tid, i, reply)
+				}
+				if reply.TooLarge {
+					co.logFor(pctx).Warnf("server %d's Commit reply wouldn't fit in a message", i)
 				}
 			}
 
-			log.Printf("Coordinator Reply: Server %d voted %v for transaction %d\n", i, reply.Vote, tid)
+			co.logFor(pctx).Debugf("server %d voted %v", i, reply.Vote)
 
 		}
 
-		// co.mu.Lock()
-		tran.Relevant = relevant
-		// co.mu.Unlock()
-
-		log.Printf("Coordinator: Checking votes for transaction %d in 3PC\n", tid)
-
-		if !allVotedYes {
-			log.Printf("Coordinator: At least one server voted No for transaction %d, aborting transaction\n", tid)
-			co.abortTransaction(tid, relevant)
-			co.mu.Lock()
-			tran.Phase = PhaseAborted
-			co.mu.Unlock()
-			co.respChan <- ResponseMsg{tid: tid, committed: false, readValues: nil}
+		if votedNo != nil {
+			co.logFor(pctx).Infof("a server voted No, aborting: %v", votedNo)
+			span.End()
+			co.decideAbort(tid, tran, relevant, votedNo)
 			return false
 
 		}
 
-		log.Printf("Coordinator: All servers voted Yes for transaction %d, proceeding to PreCommit\n", tid)
-		tran.Phase = PhasePreCommit
+		span.End()
+		co.logFor(pctx).Infof("all servers voted Yes, proceeding to PreCommit")
+		co.mu.Lock()
+		tran.Relevant = relevant
+		co.setPhaseLocked(tid, tran, PhasePreCommit)
+		co.mu.Unlock()
+		phase = PhasePreCommit
 
 	}
 
-	if tran.Phase == PhasePreCommit {
-		log.Printf("Coordinator, Run3RPC: Sending PreCommit RPC to all servers for transaction %d\n", tid)
+	// ======================
+	// PHASE 2: PRECOMMIT
+	// ======================
+
+	if phase == PhasePreCommit {
+		pctx, span := co.startPhase(ctx, tid, PhasePreCommit)
+		defer co.profile(pctx)()
+		co.logFor(pctx).Debugf("sending PreCommit to all servers")
+
+		// a previous Coordinator logged the commit, and a server may
+		// have committed already, e.g. from ResolveTransaction; the
+		// PreCommits are resent, backing off, rather than aborting.
+		// a server that hasn't acknowledged by the phase timeout is
+		// left to ResolveTransaction, which answers from the log, and
+		// to the next recovery's Query
+		co.mu.Lock()
+		logged := co.decided[tid] == PhaseCommitted
+		co.mu.Unlock()
 
-		for i := range tran.Relevant {
+		for i := range relevant {
 			if co.killed() {
+				endSpan(span, errKilled)
 				return false
 			}
 
 			args := &RPCArgs{Tid: tid}
-			retry := 0
-			for !co.sendPreCommit(i, args) {
-				log.Printf("Coordinator: Failed to send PreCommit RPC to server %d for transaction %d\n", i, tid)
+			reply := &PreCommitReply{}
+			rctx, rpc := co.startRPC(pctx, "Server.PreCommit", i)
+			deadline := co.clock.Now().Add(timeout)
+			wait := resolveRetryInterval / 10
+			for err := co.sendPreCommit(rctx, i, args, reply); err != nil || (logged && !reply.Ack); err = co.sendPreCommit(rctx, i, args, reply) {
+				if err == nil {
+					co.logFor(pctx).Warnf("server %d didn't acknowledge PreCommit, though the commit was logged", i)
+					reply = &PreCommitReply{}
+					err = ErrNoAck
+				} else {
+					co.logFor(pctx).Warnf("failed to send PreCommit to server %d: %v", i, err)
+				}
+				rpc.RecordError(err)
 
 				if co.killed() {
+					endSpan(rpc, errKilled)
+					endSpan(span, errKilled)
+					return false
+				}
+
+				if logged && !co.clock.Now().Before(deadline) {
+					co.logFor(pctx).Warnf("gave up on PreCommit to server %d, leaving the logged commit to ResolveTransaction and recovery", i)
+					endSpan(rpc, err)
+					endSpan(span, err)
+					co.mu.Lock()
+					delete(co.tran, tid) // so ResolveTransaction answers from the log
+					co.mu.Unlock()
 					return false
+
+				}
+
+				if logged {
+					co.sleep(wait)
+					wait = min(2*wait, resolveRetryInterval)
+					continue
 				}
 
-				if retry > 3 {
-					log.Printf("Coordinator: Timeout waiting for PreCommit to server %d for transaction %d, aborting\n", i, tid)
-					co.Kill()
-					log.Printf("killing coordinator")
-					co.abortTransaction(tid, tran.Relevant)
+				if errors.Is(err, ErrMessageTooLarge) {
+					co.logFor(pctx).Warnf("PreCommit with server %d doesn't fit in a message, aborting", i)
+					endSpan(rpc, err)
+					endSpan(span, err)
+					co.decideAbort(tid, tran, relevant, phaseError(tid, PhasePreCommit, i, err))
+					return false
 
-					tran.Phase = PhaseAborted
+				}
 
-					co.respChan <- ResponseMsg{tid: tid, committed: false, readValues: nil}
+				if !co.clock.Now().Before(deadline) {
+					co.logFor(pctx).Warnf("timed out waiting for PreCommit to server %d, aborting", i)
+					endSpan(rpc, err)
+					endSpan(span, err)
+					co.decideAbort(tid, tran, relevant, phaseError(tid, PhasePreCommit, i, err))
 					return false
 
 				}
 
-				retry++
+			}
+			rpc.End()
+
+			// the server didn't vote Yes after all, e.g. its vote was
+			// damaged in flight, or another coordinator aborted
+
+			if !reply.Ack {
+				co.logFor(pctx).Warnf("server %d didn't acknowledge PreCommit, aborting", i)
+				endSpan(span, ErrNoAck)
+				co.decideAbort(tid, tran, relevant, &TxnError{Tid: tid, Phase: PhasePreCommit, Participant: i, Err: ErrNoAck})
+				return false
 
 			}
+			co.publish(PreCommitAcked{EventHeader: co.eventHeader(pctx), Server: i})
 
 		}
+		span.End()
 
-		tran.Phase = PhaseCommitted
+		co.mu.Lock()
+		co.setPhaseLocked(tid, tran, PhaseCommitted)
+		co.mu.Unlock()
+		phase = PhaseCommitted
+		if !co.logDecision(pctx, tid, PhaseCommitted) {
+			return false
+		}
 
-		log.Printf("Coordinator, Run3RPC: Transaction %d in PhasePreCommit finished, proceed to Commit Phase\n", tid)
+		co.logFor(pctx).Infof("finished PreCommit, proceeding to Commit")
 
 	}
 
-	if tran.Phase == PhaseCommitted {
+	// ======================
+	// PHASE 3: COMMIT
+	// ======================
+
+	if phase == PhaseCommitted {
 
-		log.Printf("Coordinator: Sending Commit RPC to all servers for transaction %d\n", tid)
+		pctx, span := co.startPhase(ctx, tid, PhaseCommitted)
+		defer co.profile(pctx)()
+		co.logFor(pctx).Debugf("sending Commit to all servers")
 		readValues := make(map[string]interface{})
 
-		for i := range tran.Relevant {
+		for i := range relevant {
 
 			if co.killed() {
+				endSpan(span, errKilled)
 				return false
 			}
 
 			args := &RPCArgs{Tid: tid}
 			reply := &CommitReply{}
-			log.Printf("Coordinator: Sending Commit RPC to server %d for transaction %d\n", i, tid)
-			co.sendCommit(i, args, reply)
+			co.logFor(pctx).Debugf("sending Commit to server %d", i)
+			rctx, rpc := co.startRPC(pctx, "Server.Commit", i)
 
-			for !co.sendCommit(i, args, reply) {
-				log.Printf("Coordinator: Failed to send Commit RPC to server %d for transaction %d\n", i, tid)
+			// too late to abort, but the servers checked at Prepare
+			// that their replies would fit
+			for err := co.sendCommit(rctx, i, args, reply); err != nil; err = co.sendCommit(rctx, i, args, reply) {
+				co.logFor(pctx).Warnf("failed to send Commit to server %d: %v", i, err)
+				rpc.RecordError(err)
 
 				if co.killed() {
+					endSpan(rpc, errKilled)
+					endSpan(span, errKilled)
 					return false
 				}
 
+				reply = &CommitReply{}
+
 			}
+			rpc.End()
 
-			log.Printf("Coordinator: Received Commit RPC reply from server %d for transaction %d\n", i, tid)
+			co.logFor(pctx).Debugf("received Commit reply from server %d", i)
 
 			for k, v := range reply.ReadValues {
 				readValues[k] = v
@@ -384,15 +492,18 @@ func (co *Coordinator) run3PC(tid int, tran *Transaction) bool {
 
 		}
 
-		tran.Phase = PhaseCommitted
+		co.mu.Lock()
 		tran.ReadValues = readValues
+		co.mu.Unlock()
+		span.End()
 
-		co.respChan <- ResponseMsg{tid: tid, committed: true, readValues: readValues}
+		co.logFor(pctx).Infof("committed, read values: %v", co.redaction().values(readValues))
+		co.respChan <- ResponseMsg{tid: tid, committed: true, readValues: readValues, durations: co.durationsOf(tran)}
+		co.reported(tid, tran, PhaseCommitted)
 
 	}
 
-	log.Printf("Coordinator: Transaction %d in PhaseCommitted, read values: %v\n", tid, tran.ReadValues)
-	return true
+	return phase == PhaseCommitted
 
 }
 
@@ -406,7 +517,35 @@ func (co *Coordinator) run3PC(tid int, tran *Transaction) bool {
 
 // respChan is how you'll send messages to the client to notify it of committed or aborted transactions
 
-func MakeCoordinator(servers []*labrpc.ClientEnd, respChan chan ResponseMsg) *Coordinator {
+// servers[i] reaches server i, e.g. a *labrpc.ClientEnd or one from a Transport's Dial()
+
+func MakeCoordinator(servers []PeerClient, respChan chan ResponseMsg) *Coordinator {
+	return makeCoordinator(servers, respChan, realClock{}, phaseTimeout, stdLogger("coordinator"))
+}
+
+// Like MakeCoordinator, but lines are logged to logger, e.g. one made by
+// NewLogger() or an adapter to another logging library; nil means
+// MakeCoordinator's logger, which only shows warnings
+
+func MakeCoordinatorWithLogger(servers []PeerClient, respChan chan ResponseMsg, logger Logger) *Coordinator {
+	if logger == nil {
+		logger = stdLogger("coordinator")
+	}
+	return makeCoordinator(servers, respChan, realClock{}, phaseTimeout, logger)
+}
+
+// Like MakeCoordinator, but timeouts are measured on clock, Prepare and
+// PreCommit are retried for timeout, and lines are logged to logger
+
+func makeCoordinator(servers []PeerClient, respChan chan ResponseMsg, clock Clock, timeout time.Duration, logger Logger) *Coordinator {
+	return makeLoggingCoordinator(servers, respChan, clock, timeout, logger, nil, nil)
+
+}
+
+// Like makeCoordinator, but decisions are logged to persister, or to dlog,
+// if either isn't nil
+
+func makeLoggingCoordinator(servers []PeerClient, respChan chan ResponseMsg, clock Clock, timeout time.Duration, logger Logger, persister *Persister, dlog DecisionLog) *Coordinator {
 
 	co := &Coordinator{
 		servers:  servers,
@@ -415,23 +554,54 @@ func MakeCoordinator(servers []*labrpc.ClientEnd, respChan chan ResponseMsg) *Co
 		// Initialize other fields here
 		tran:     make(map[int]*Transaction),
 		serversN: len(servers),
+		clock:    clock,
+		timeout:  timeout,
+		logger:   logger,
+		tracer:   defaultTracer(),
+		counts:   &coordinatorCounts{},
+
+		persister: persister,
+		dlog:      dlog,
+		decided:   make(map[int]string),
+		migrating: make(map[int]bool),
+		inflight:  make(map[int]int),
+	}
+	co.migrated = sync.NewCond(&co.mu)
+	co.SetRedaction(redactionFromEnv())
+	co.SetDurability(DurabilitySync)
+	if persister != nil {
+		co.readDecisions(persister.ReadServerState())
 	}
 
-	go co.recover()
+	co.spawn(co.recover)
 	return co
 
 }
 
 // recover is called when the Coordinator restarts
+// It queries every server and resumes any transaction left unfinished by the
+// previous Coordinator. Transactions that every relevant server has already
+// committed or aborted were reported by the previous Coordinator and are skipped
 
 func (co *Coordinator) recover() {
 
+	tranStates := make(map[int]map[int]ServerTransaction)
+
+	// a standby waits here until its replica of the decision log leads
+	if co.dlog != nil && !co.readDecisionLog() {
+		return
+
+	}
+
 	co.mu.Lock()
-	defer co.mu.Unlock()
+	serversN := co.serversN
+	co.mu.Unlock()
 
-	tranStates := make(map[int]map[int]ServerTransaction)
+	trace := newTrace()
+	co.counts.recoveries.Add(1)
+	co.logFor(withTxn(context.Background(), noTid, phaseRecovery)).Infof("recovering, trace %s", trace)
 
-	for i := 0; i < co.serversN; i++ {
+	for i := 0; i < serversN; i++ {
 
 		if co.killed() {
 			return
@@ -440,7 +610,7 @@ func (co *Coordinator) recover() {
 
 		reply := &QueryReply{}
 
-		for !co.sendQuery(i, reply) {
+		for co.sendQuery(i, trace, reply) != nil {
 			if co.killed() {
 				return
 
@@ -461,27 +631,13 @@ func (co *Coordinator) recover() {
 
 	for tid, serverStates := range tranStates {
 
-		// co.mu.Lock()
-
-		if _, exists := co.tran[tid]; !exists {
-
-			co.tran[tid] = &Transaction{
-				Phase:      PhasePrepare,
-				Relevant:   make(map[int]bool),
-				ReadValues: make(map[string]interface{}),
-			}
-
-		}
-
-		tran := co.tran[tid]
-
-		// co.mu.Unlock()
-
 		anyAborted := false
+		allAborted := true
 		anyCommitted := false
 		allCommitted := true
 		anyPreCommitted := false
 		anyVotedYes := false
+		abortedBy := -1 // the first server that aborted or voted No
 		relevant := make(map[int]bool)
 
 		for server, state := range serverStates {
@@ -493,6 +649,14 @@ func (co *Coordinator) recover() {
 
 			if state.State == stateAborted || state.State == stateVotedNo {
 				anyAborted = true
+				if abortedBy < 0 || server < abortedBy {
+					abortedBy = server
+				}
+
+			}
+
+			if state.State != stateAborted {
+				allAborted = false
 
 			}
 
@@ -516,43 +680,90 @@ func (co *Coordinator) recover() {
 
 		}
 
-		// co.mu.Lock()
+		ctx := withTxn(context.Background(), tid, phaseRecovery)
 
-		log.Printf("Coordinator: Information for transactions %d, relevant: %v, anyAborted: %v, anyCommitted: %v, allCommitted: %v, anyPreCommitted: %v, anyVotedYes: %v\n", tid, relevant, anyAborted, anyCommitted, allCommitted, anyPreCommitted, anyVotedYes)
-		tran.Relevant = relevant
+		// the previous Coordinator's logged decision, which the
+		// servers may not have heard yet. a logged commit resumes at
+		// PreCommit, since a server only commits once it's
+		// pre-committed, but can't be aborted from there
+		co.mu.Lock()
+		logged := co.decided[tid]
+		co.mu.Unlock()
+		if logged == PhaseCommitted && !anyCommitted && !anyAborted {
+			co.logFor(ctx).Infof("commit was logged")
+			anyPreCommitted = true
+		} else if logged == PhaseAborted && !anyCommitted && !anyAborted {
+			co.logFor(ctx).Infof("abort was logged")
+			anyAborted = true
+		}
 
-		// co.mu.Unlock()
+		co.logFor(ctx).Debugf("relevant: %v, anyAborted: %v, allAborted: %v, anyCommitted: %v, allCommitted: %v, anyPreCommitted: %v, anyVotedYes: %v", relevant, anyAborted, allAborted, anyCommitted, allCommitted, anyPreCommitted, anyVotedYes)
 
-		if anyAborted {
-			log.Printf("Coordinator: Transaction %d entering anyAbort Stage\n", tid)
-			// co.mu.Lock()
-			tran.Phase = PhaseAborted
-			// co.mu.Unlock()
-			co.abortTransaction(tid, relevant)
-			co.respChan <- ResponseMsg{tid: tid, committed: false, readValues: nil}
+		co.mu.Lock()
 
-		} else if anyCommitted && !allCommitted {
-			log.Printf("Coordinator: Transaction %d entering anyCommit Stage\n", tid)
-			// co.mu.Lock()
-			tran.Phase = PhaseCommitted
-			// co.mu.Unlock()
-			co.run3PC(tid, tran)
+		// FinishTransaction may have started this transaction after we restarted
+		if _, exists := co.tran[tid]; exists {
+			co.mu.Unlock()
+			continue
 
-		} else if anyPreCommitted {
-			log.Printf("Coordinator: Transaction %d entering anyPreCommit Stage\n", tid)
+		}
 
-			// co.mu.Lock()
-			tran.Phase = PhasePreCommit
-			// co.mu.Unlock()
+		tran := &Transaction{
+			Relevant:   relevant,
+			ReadValues: make(map[string]interface{}),
+			Trace:      newTrace(),
+		}
+		co.tran[tid] = tran
+		for server, state := range serverStates {
+			for _, method := range answeredIn(state.State) {
+				co.answeredLocked(tran, server, method)
+			}
+		}
 
-			co.run3PC(tid, tran)
+		if allAborted {
+			co.setPhaseLocked(tid, tran, PhaseAborted)
+			tran.Recovered = true
+			tran.done = true
+			tran.abortErr = &TxnError{Tid: tid, Phase: phaseRecovery, Participant: -1, Err: ErrAbortedBeforeRestart}
+			co.mu.Unlock()
+
+		} else if anyAborted {
+			co.logFor(ctx).Infof("a server aborted, aborting")
+			co.mu.Unlock()
+			why := &TxnError{Tid: tid, Phase: phaseRecovery, Participant: abortedBy, Err: ErrServerAborted}
+			if abortedBy < 0 {
+				why.Err = ErrAbortedBeforeRestart // only the log says so
+			}
+			co.spawn(func() { co.decideAbort(tid, tran, relevant, why) })
+
+		} else if allCommitted {
+			co.setPhaseLocked(tid, tran, PhaseCommitted)
+			tran.Recovered = true
+			tran.done = true
+			co.mu.Unlock()
+
+		} else if anyCommitted {
+			co.logFor(ctx).Infof("a server committed, resuming at Commit")
+			co.setPhaseLocked(tid, tran, PhaseCommitted)
+			co.mu.Unlock()
+			co.spawn(func() { co.run3PC(tid, tran) })
+
+		} else if anyPreCommitted {
+			co.logFor(ctx).Infof("a server pre-committed, resuming at PreCommit")
+			co.setPhaseLocked(tid, tran, PhasePreCommit)
+			co.mu.Unlock()
+			co.spawn(func() { co.run3PC(tid, tran) })
 
 		} else if anyVotedYes {
-			log.Printf("Coordinator: Transaction %d entering anyVotedYes Stage\n", tid)
-			// co.mu.Lock()
-			tran.Phase = PhasePrepare
-			// co.mu.Unlock()
-			co.run3PC(tid, tran)
+			co.logFor(ctx).Infof("servers voted Yes, resuming at Prepare")
+			co.setPhaseLocked(tid, tran, PhasePrepare)
+			co.mu.Unlock()
+			co.spawn(func() { co.run3PC(tid, tran) })
+
+		} else {
+			// no server has voted yet; leave it to FinishTransaction
+			delete(co.tran, tid)
+			co.mu.Unlock()
 
 		}
 
@@ -560,34 +771,127 @@ func (co *Coordinator) recover() {
 
 }
 
-// Like in Raft, each send method returns true if the request succeeded and false if it timed out
+// Change how long Prepare and PreCommit are retried, for the phases
+// that start from now on
+
+func (co *Coordinator) setTimeout(timeout time.Duration) {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+
+	co.timeout = timeout
+
+}
+
+// Start sending to one more server, e.g. one the tester added mid-test
+// Returns its index; transactions that already started don't involve it
+
+func (co *Coordinator) addServer(end PeerClient) int {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+
+	co.servers = append(co.servers, end)
+	co.serversN = len(co.servers)
+	return co.serversN - 1
+
+}
+
+func (co *Coordinator) server(i int) PeerClient {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+
+	return co.servers[i]
+
+}
+
+// The metadata sent with a transaction's RPCs: its ID and trace, and the
+// span in ctx
+
+func (co *Coordinator) metadata(ctx context.Context, tid int) Metadata {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+
+	meta := Metadata{MetaTid: strconv.Itoa(tid)}
+	if tran, exists := co.tran[tid]; exists {
+		meta[MetaTrace] = tran.Trace
+	}
+	injectSpan(ctx, meta)
+	return meta
+
+}
+
+// A fresh trace ID, for a transaction or a recovery
+
+func newTrace() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+
+}
+
+// Like in Raft, each send method reports whether the request succeeded: it returns nil,
+// or why it failed, e.g. ErrMessageTooLarge, which resending can't fix
 
 // They are guaranteed to return *unless* the handler function on the server side does not return
 
-func (co *Coordinator) sendPrepare(server int, args *RPCArgs, reply *PrepareReply) bool {
-	return co.servers[server].Call("Server.Prepare", args, reply)
+// a reply that arrived but was damaged in flight, which is treated as lost
+
+var errDamagedReply = errors.New("reply damaged in flight")
+
+// why a phase gave up, for its span
+
+var (
+	errKilled = errors.New("coordinator killed")
+)
+
+func (co *Coordinator) sendPrepare(ctx context.Context, server int, args *RPCArgs, reply *PrepareReply) error {
+	if err := co.call(server, "Prepare", co.metadata(ctx, args.Tid), args.Tid, args, reply); err != nil {
+		return err
+
+	}
+
+	// a server never votes for a transaction it doesn't hold, so
+	// such a reply was damaged in flight and is treated as lost
+
+	if !reply.Relevant && reply.Vote {
+		return errDamagedReply
+	}
+	return nil
 
 }
 
-func (co *Coordinator) sendAbort(server int, args *RPCArgs) bool {
+func (co *Coordinator) sendAbort(ctx context.Context, server int, args *RPCArgs) error {
 	reply := struct{}{}
-	return co.servers[server].Call("Server.Abort", args, &reply)
+	return co.call(server, "Abort", co.metadata(ctx, args.Tid), args.Tid, args, &reply)
 
 }
 
-func (co *Coordinator) sendQuery(server int, reply *QueryReply) bool {
-	return co.servers[server].Call("Server.Query", struct{}{}, reply)
+func (co *Coordinator) sendQuery(server int, trace string, reply *QueryReply) error {
+	co.counts.rpcs.Add(1)
+	err := co.server(server).CallErr("Server.Query", Metadata{MetaTrace: trace}, struct{}{}, reply)
+	if err != nil {
+		co.counts.failed(err)
+	}
+	return err
 
 }
 
-func (co *Coordinator) sendPreCommit(server int, args *RPCArgs) bool {
-	reply := struct{}{}
-	return co.servers[server].Call("Server.PreCommit", args, &reply)
+func (co *Coordinator) sendPreCommit(ctx context.Context, server int, args *RPCArgs, reply *PreCommitReply) error {
+	return co.call(server, "PreCommit", co.metadata(ctx, args.Tid), args.Tid, args, reply)
 
 }
 
-func (co *Coordinator) sendCommit(server int, args *RPCArgs, reply *CommitReply) bool {
-	return co.servers[server].Call("Server.Commit", args, reply)
+func (co *Coordinator) sendCommit(ctx context.Context, server int, args *RPCArgs, reply *CommitReply) error {
+	if err := co.call(server, "Commit", co.metadata(ctx, args.Tid), args.Tid, args, reply); err != nil {
+		return err
+
+	}
+
+	// read values lost in flight; a resent Commit gets them again
+
+	if len(reply.ReadValues) != reply.Reads {
+		return errDamagedReply
+	}
+	return nil
 
 }
 
@@ -609,9 +913,20 @@ func (co *Coordinator) sendCommit(server int, args *RPCArgs, reply *CommitReply)
 
 // should call killed() to check whether it should stop.
 
+// Peers that hold connections, like a TCPTransport's, are closed too
+
 func (co *Coordinator) Kill() {
 	atomic.StoreInt32(&co.dead, 1)
 
+	co.mu.Lock()
+	defer co.mu.Unlock()
+
+	for _, server := range co.servers {
+		if c, ok := server.(io.Closer); ok {
+			c.Close()
+		}
+	}
+
 }
 
 func (co *Coordinator) killed() bool {
@@ -619,3 +934,149 @@ func (co *Coordinator) killed() bool {
 	return z == 1
 
 }
+
+// Run f in a goroutine, counted until it returns so the tester can check
+
+// that none outlive Kill()
+
+func (co *Coordinator) spawn(f func()) {
+	atomic.AddInt32(&co.running, 1)
+	go func() {
+		defer atomic.AddInt32(&co.running, -1)
+		f()
+	}()
+
+}
+
+func (co *Coordinator) goroutines() int {
+	return int(atomic.LoadInt32(&co.running))
+
+}
+
+// Move a transaction to phase, and publish the change
+// co.mu must be held
+
+func (co *Coordinator) setPhaseLocked(tid int, tran *Transaction, phase string) {
+	now := co.clock.Now()
+	changed := PhaseChanged{EventHeader: EventHeader{Tid: tid, Phase: phase, Time: now}}
+	if tran.phaseStart.IsZero() {
+		tran.started = now
+	} else {
+		changed.From = tran.Phase
+		changed.After = co.leavePhaseLocked(tran, now)
+	}
+	tran.Phase = phase
+	tran.phaseStart = now
+	tran.waiting = nil
+	tran.warnings = 0
+	co.publish(changed)
+
+}
+
+// Note that tran's outcome was sent to the client: end its span, time its
+// last phase, and publish the decision
+
+func (co *Coordinator) reported(tid int, tran *Transaction, outcome string) {
+	co.endTrace(tran, outcome)
+	co.counts.decided(outcome)
+
+	co.mu.Lock()
+	now := co.clock.Now()
+	tran.done = true
+	decision := Decision{
+		EventHeader: EventHeader{Tid: tid, Phase: tran.Phase, Time: now},
+		Outcome:     outcome,
+		Trace:       tran.Trace,
+		Started:     tran.started,
+		InPhase:     co.leavePhaseLocked(tran, now),
+		Err:         tran.abortErr,
+		Phases:      make(map[string]time.Duration, len(tran.phaseTimes)),
+	}
+	for server := range tran.Relevant {
+		decision.Participants = append(decision.Participants, server)
+	}
+	sort.Ints(decision.Participants)
+	for phase, d := range tran.phaseTimes {
+		decision.Phases[phase] = d
+	}
+	co.mu.Unlock()
+
+	co.publish(decision)
+
+}
+
+// How long tran has spent in each phase, keyed prepare, precommit, commit
+// and abort, and in all, keyed total, up to now
+// A transaction resumed by recovery is timed from when it was resumed
+
+func (co *Coordinator) durationsOf(tran *Transaction) map[string]time.Duration {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+
+	now := co.clock.Now()
+	durations := map[string]time.Duration{"total": now.Sub(tran.started)}
+	for phase, d := range tran.phaseTimes {
+		durations[durationKeys[phase]] += d
+	}
+	durations[durationKeys[tran.Phase]] += now.Sub(tran.phaseStart)
+	return durations
+
+}
+
+// the key of each phase in durationsOf()
+
+var durationKeys = map[string]string{
+	PhasePrepare:   "prepare",
+	PhasePreCommit: "precommit",
+	PhaseCommitted: "commit",
+	PhaseAborted:   "abort",
+}
+
+// Add the time tran spent in its phase, up to now, and return it
+// co.mu must be held
+
+func (co *Coordinator) leavePhaseLocked(tran *Transaction, now time.Time) time.Duration {
+	d := now.Sub(tran.phaseStart)
+	if tran.phaseTimes == nil {
+		tran.phaseTimes = make(map[string]time.Duration)
+	}
+	tran.phaseTimes[tran.Phase] += d
+	tran.phaseStart = now
+	return d
+
+}
+
+// Whether the Coordinator has run or recovered tid, or logged a decision
+// for it, so that a client handing out tids can skip it
+
+func (co *Coordinator) hasTid(tid int) bool {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+
+	_, running := co.tran[tid]
+	_, logged := co.decided[tid]
+	return running || logged
+
+}
+
+// The phase of a transaction and the servers it involves, for the tester to
+// report when the transaction never finishes
+
+func (co *Coordinator) transactionPhase(tid int) (string, []int, bool) {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+
+	tran, exists := co.tran[tid]
+	if !exists {
+		return "", nil, false
+
+	}
+
+	relevant := make([]int, 0, len(tran.Relevant))
+	for i := range tran.Relevant {
+		relevant = append(relevant, i)
+	}
+	sort.Ints(relevant)
+	return tran.Phase, relevant, true
+
+}
@@ -0,0 +1,157 @@
+package commit
+
+//
+// a snapshot of the live protocol state as JSON, for looking
+// inside a wedged run without attaching a debugger:
+//
+//   http.Handle("/debug/3pc", DebugHandler(co, servers))
+//   curl localhost:8080/debug/3pc
+//
+// it shows the coordinator's transaction table, with each
+// transaction's phase, participants and how long it has been in
+// that phase, and each server's transactions, their operations,
+// and every key's lock: whether it's held, and by which undecided
+// transactions. the Gateway serves the same at GET /debug/3pc.
+//
+// the coordinator and each server are read under their own lock,
+// one after another, so the snapshot isn't atomic across them,
+// and a handler blocked while holding a lock blocks it too.
+//
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+type debugState struct {
+	Coordinator *debugCoordinator `json:"coordinator,omitempty"`
+	Servers     []debugServer     `json:"servers"`
+}
+
+type debugCoordinator struct {
+	Killed       bool                        `json:"killed"`
+	Servers      int                         `json:"servers"`
+	Timeout      string                      `json:"timeout"`
+	Goroutines   int                         `json:"goroutines"`
+	Transactions map[string]debugTransaction `json:"transactions"` // by tid
+}
+
+type debugTransaction struct {
+	Phase        string `json:"phase"`
+	InPhaseFor   string `json:"inPhaseFor"`
+	Participants []int  `json:"participants"`
+	Trace        string `json:"trace"`
+	Recovered    bool   `json:"recovered,omitempty"`
+}
+
+type debugServer struct {
+	Killed          bool                              `json:"killed"`
+	RunningPrepares int                               `json:"runningPrepares"`
+	Transactions    map[string]debugServerTransaction `json:"transactions"` // by tid
+	Locks           map[string]debugLock              `json:"locks"`        // by key
+}
+
+type debugServerTransaction struct {
+	State      string           `json:"state"`
+	Operations []debugOperation `json:"operations"`
+	Preparing  bool             `json:"preparing,omitempty"` // a Prepare is acquiring its locks
+}
+
+type debugOperation struct {
+	Op    string      `json:"op"` // get or set
+	Key   string      `json:"key"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+type debugLock struct {
+	Locked    bool  `json:"locked"`
+	Readers   []int `json:"readers,omitempty"`
+	Writers   []int `json:"writers,omitempty"`
+	Preparing bool  `json:"preparing,omitempty"`
+}
+
+// serves the state of co, which may be nil, and servers as JSON.
+func DebugHandler(co *Coordinator, servers []*Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state := debugState{Servers: make([]debugServer, len(servers))}
+		if co != nil {
+			state.Coordinator = co.debugState()
+		}
+		for i, sv := range servers {
+			state.Servers[i] = sv.debugState()
+		}
+		writeJSON(w, http.StatusOK, state)
+	})
+}
+
+func (co *Coordinator) debugState() *debugCoordinator {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+
+	state := &debugCoordinator{
+		Killed:       co.killed(),
+		Servers:      co.serversN,
+		Timeout:      co.timeout.String(),
+		Goroutines:   co.goroutines(),
+		Transactions: make(map[string]debugTransaction, len(co.tran)),
+	}
+	now := co.clock.Now()
+	for tid, tran := range co.tran {
+		dt := debugTransaction{
+			Phase:        tran.Phase,
+			InPhaseFor:   now.Sub(tran.phaseStart).Round(time.Microsecond).String(),
+			Participants: make([]int, 0, len(tran.Relevant)),
+			Trace:        tran.Trace,
+			Recovered:    tran.Recovered,
+		}
+		for i := range tran.Relevant {
+			dt.Participants = append(dt.Participants, i)
+		}
+		sort.Ints(dt.Participants)
+		state.Transactions[strconv.Itoa(tid)] = dt
+	}
+	return state
+
+}
+
+func (sv *Server) debugState() debugServer {
+	// lockTable() takes sv.mu itself
+	table := sv.lockTable()
+
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	state := debugServer{
+		Killed:          sv.killed(),
+		RunningPrepares: int(atomic.LoadInt32(&sv.prepares)),
+		Transactions:    make(map[string]debugServerTransaction, len(sv.states)),
+		Locks:           make(map[string]debugLock, len(table)),
+	}
+	tids := make(map[int]bool)
+	for tid := range sv.states {
+		tids[tid] = true
+	}
+	for tid := range sv.operations {
+		tids[tid] = true
+	}
+	for tid := range tids {
+		st := debugServerTransaction{State: sv.states[tid].String()}
+		for _, op := range sv.operations[tid] {
+			if op.IsGet {
+				st.Operations = append(st.Operations, debugOperation{Op: "get", Key: op.Key})
+			} else {
+				st.Operations = append(st.Operations, debugOperation{Op: "set", Key: op.Key, Value: sv.redaction().value(op.Value)})
+			}
+		}
+		_, st.Preparing = sv.preparing[tid]
+		state.Transactions[strconv.Itoa(tid)] = st
+	}
+	for key, l := range table {
+		state.Locks[key] = debugLock{Locked: l.locked, Readers: l.readers, Writers: l.writers, Preparing: l.preparing}
+	}
+	return state
+
+}
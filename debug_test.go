@@ -0,0 +1,95 @@
+package commit
+
+import (
+	"3PhaseCommit/labrpc"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Holds a transaction at PreCommit with another still taking operations,
+// and reads the debug handler
+// It should show the held transaction's phase and participants at the coordinator,
+// and each server's states, operations and the locks the transaction holds
+func TestDebugHandler(t *testing.T) {
+	t.Parallel()
+
+	net := labrpc.MakeNetwork()
+	defer net.Cleanup()
+	tr := makeLabrpcTransport(net)
+	var servers []*Server
+	var peers []PeerClient
+	held := make(chan struct{})
+	defer close(held)
+	for i, keys := range [][]string{{"x", "y"}, {"z"}} {
+		sv := MakeServer(keys, MakePersister())
+		defer sv.Kill()
+		sv.setHook(func(point hookPoint, method string, tid int, meta Metadata) {
+			if point == hookBefore && method == "Server.PreCommit" {
+				<-held
+			}
+		})
+		name := []string{"server0", "server1"}[i]
+		tr.Serve(name, sv)
+		end, _ := tr.Dial(name)
+		servers = append(servers, sv)
+		peers = append(peers, end)
+	}
+	co := MakeCoordinator(peers, make(chan ResponseMsg))
+	defer co.Kill()
+	web := httptest.NewServer(DebugHandler(co, servers))
+	defer web.Close()
+
+	servers[0].Set(0, "x", 1)
+	servers[0].Get(0, "y")
+	servers[1].Set(1, "z", "later")
+	co.FinishTransaction(0)
+
+	var state debugState
+	for start := time.Now(); time.Since(start) < waitTimeout; time.Sleep(10 * time.Millisecond) {
+		resp, err := web.Client().Get(web.URL)
+		if err != nil {
+			t.Fatalf("GET failed: %v", err)
+		}
+		state = debugState{}
+		err = json.NewDecoder(resp.Body).Decode(&state)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("bad debug state: %v", err)
+		}
+		if state.Coordinator.Transactions["0"].Phase == PhasePreCommit {
+			break
+		}
+	}
+
+	tran := state.Coordinator.Transactions["0"]
+	if tran.Phase != PhasePreCommit || !reflect.DeepEqual(tran.Participants, []int{0}) || tran.Trace == "" {
+		t.Fatalf("expected transaction 0 at PreCommit with participant 0, got %+v", state.Coordinator)
+	}
+	if state.Coordinator.Servers != 2 || state.Coordinator.Killed {
+		t.Fatalf("expected a live coordinator with 2 servers, got %+v", state.Coordinator)
+	}
+
+	expected := []debugServer{
+		{
+			Transactions: map[string]debugServerTransaction{
+				"0": {State: "VotedYes", Operations: []debugOperation{{"set", "x", 1.0}, {"get", "y", nil}}},
+			},
+			Locks: map[string]debugLock{
+				"x": {Locked: true, Writers: []int{0}},
+				"y": {Locked: true, Readers: []int{0}},
+			},
+		},
+		{
+			Transactions: map[string]debugServerTransaction{
+				"1": {State: "Operations", Operations: []debugOperation{{"set", "z", "later"}}},
+			},
+			Locks: map[string]debugLock{"z": {}},
+		},
+	}
+	if !reflect.DeepEqual(state.Servers, expected) {
+		t.Fatalf("expected servers %+v, got %+v", expected, state.Servers)
+	}
+}
@@ -0,0 +1,167 @@
+package commit
+
+//
+// incremental checkpoints, for servers whose store is too big to
+// rewrite on every checkpoint:
+//
+//   sv := MakeServerWithSnapshots(keys, ps, 1<<20)
+//   sv.DeltaCheckpoints(8)
+//   sv.CheckpointEvery(time.Minute)
+//
+// with DeltaCheckpoints(n), up to n checkpoints in a row write a
+// delta rather than a full snapshot: the keys and transactions the
+// log changed since the last checkpoint, with their current values,
+// versions and states, in the snapshot's format. each delta is
+// appended to the Persister's deltas, then the log is emptied. after
+// n deltas the next checkpoint writes a full snapshot again and drops
+// them, which bounds how many a restarted Server applies: it reads
+// the full snapshot, then each delta in order, then the log.
+//
+// each delta is a frame (wal.go), so a torn last delta is dropped,
+// and the log it would have emptied is still there. it also names
+// the checksum of the full snapshot it follows; a crash while a full
+// snapshot replaces them can leave the deltas next to a snapshot
+// that already holds them, and a Server skips deltas that name
+// another snapshot.
+//
+
+import (
+	"3PhaseCommit/labgob"
+	"bytes"
+	"context"
+	"fmt"
+	"hash/crc32"
+	"log"
+)
+
+// the changes one checkpoint made, after the snapshot whose
+// checksum is Base.
+type deltaRecord struct {
+	Base  uint32
+	State []byte // as encodeState(), but only what changed
+}
+
+// write up to n deltas between full snapshots; 0, the default, makes
+// each checkpoint a full snapshot.
+func (sv *Server) DeltaCheckpoints(n int) {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	sv.deltaEvery = n
+}
+
+// append a delta of what the log changed and empty the log; sv.mu
+// must be held.
+func (sv *Server) checkpointDeltaLocked() {
+	fw := newFrameWriter()
+	fw.encode(deltaRecord{Base: sv.snapshotSum, State: sv.encodeDelta()})
+	sv.deltas = append(clone(sv.deltas), fw.bytes()...)
+	sv.deltaCount++
+	sv.log = nil
+	sv.persister.SaveStateAndDeltas(sv.encodeLog(), sv.deltas)
+}
+
+// the keys and transactions the log's records changed, as they are now.
+func (sv *Server) encodeDelta() []byte {
+	saved := &savedState{
+		values:     make(map[string]interface{}),
+		operations: make(map[int][]Operation),
+		states:     make(map[int]TransactionState),
+		readValues: make(map[int]map[string]interface{}),
+		versions:   make(map[string]int),
+	}
+	for _, record := range sv.log {
+		if ops, exists := sv.operations[record.Tid]; exists {
+			saved.operations[record.Tid] = ops
+		}
+		if state, exists := sv.states[record.Tid]; exists {
+			saved.states[record.Tid] = state
+		}
+		if values, exists := sv.readValues[record.Tid]; exists {
+			saved.readValues[record.Tid] = values
+		}
+		for key := range record.Values {
+			if item, exists := sv.store[key]; exists {
+				saved.values[key] = item.value
+				saved.versions[key] = item.version
+			}
+		}
+	}
+	return saved.encode()
+}
+
+// apply the deltas written after snapshot, in order.
+func (sv *Server) readDeltas(snapshot []byte, data []byte) {
+	sv.snapshotSum = crc32.Checksum(snapshot, crcTable)
+	if len(data) < 1 {
+		return
+	}
+
+	ctx := withTxn(context.Background(), noTid, phaseRecovery)
+	frames, torn, err := splitFrames(data)
+	if err != nil {
+		log.Fatalf("Server: deltas: %v", err)
+	}
+	if torn > 0 {
+		sv.logFor(ctx).Warnf("dropping a torn delta, %d bytes", torn)
+	}
+
+	for _, frame := range frames {
+		var delta deltaRecord
+		if err := labgob.NewDecoder(bytes.NewBuffer(frame)).Decode(&delta); err != nil {
+			log.Fatalf("Server: a delta passed its checksum but can't be decoded: %v", err)
+		}
+		if delta.Base != sv.snapshotSum {
+			sv.logFor(ctx).Infof("skipping deltas the snapshot already holds")
+			break
+		}
+		sv.readState(delta.State)
+		sv.deltaCount++
+	}
+	// keep just the whole deltas, which the next one is appended to
+	sv.deltas = clone(data[:deltasLen(frames[:sv.deltaCount])])
+}
+
+// how many bytes frames take framed.
+func deltasLen(frames [][]byte) int {
+	n := 0
+	for _, frame := range frames {
+		n += frameHeader + len(frame)
+	}
+	return n
+}
+
+// save the server state and the deltas, which only ever grow until
+// SaveStateAndSnapshot() drops them. the deltas are written, and
+// synced if the Persister fsyncs, before the state, which usually
+// empties the log they replace.
+func (ps *Persister) SaveStateAndDeltas(serverstate []byte, deltas []byte) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.takeFault() != diskOK || !ps.mirrorLocked(serverstate, ps.snapshot, deltas) {
+		return
+	}
+	if df := ps.disk; df != nil {
+		df.write(df.deltas, ps.deltas, deltas)
+		if df.opts.Fsync && df.err == nil {
+			if err := df.deltas.Sync(); err != nil {
+				df.err = fmt.Errorf("fsync %s: %w", df.deltas.Name(), err)
+			}
+		}
+		df.state = df.replace(df.state, serverstate)
+	}
+	ps.serverstate = clone(serverstate)
+	ps.deltas = clone(deltas)
+}
+
+func (ps *Persister) ReadDeltas() []byte {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return clone(ps.deltas)
+}
+
+func (ps *Persister) DeltasSize() int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return len(ps.deltas)
+}
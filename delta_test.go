@@ -0,0 +1,101 @@
+package commit
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// Writes a full snapshot of a hundred keys on a server kept on disk, then two deltas, one with
+// a transaction in doubt, and reopens it with more commits in the log, then checkpoints again
+// Each delta should hold just what changed, the reopened server should have every value and the
+// in-doubt lock, and the third checkpoint should be full and drop the deltas
+func TestDeltaCheckpoints(t *testing.T) {
+	t.Parallel()
+
+	keys := make([]string, 100)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("k%d", i)
+	}
+	dir := t.TempDir()
+	ps, err := OpenPersister(dir, DiskOptions{Fsync: true})
+	if err != nil {
+		t.Fatalf("OpenPersister: %v", err)
+	}
+	sv := MakeServerWithSnapshots(keys, ps, 1<<20)
+	want := make(map[string]interface{})
+	commit := func(tid int, keys ...string) {
+		for _, key := range keys {
+			sv.Set(tid, key, tid)
+			want[key] = tid
+		}
+		sv.Prepare(Metadata{}, &RPCArgs{Tid: tid}, &PrepareReply{})
+		sv.PreCommit(Metadata{}, &RPCArgs{Tid: tid}, &PreCommitReply{})
+		sv.Commit(Metadata{}, &RPCArgs{Tid: tid}, &CommitReply{})
+	}
+	checkpoint := func() {
+		if err := sv.Checkpoint(); err != nil {
+			t.Fatalf("Checkpoint: %v", err)
+		}
+		if n := ps.ServerStateSize(); n != 0 {
+			t.Fatalf("expected an empty log after checkpointing, got %d bytes", n)
+		}
+	}
+
+	commit(0, keys...)
+	checkpoint()
+	full := ps.SnapshotSize()
+	sv.DeltaCheckpoints(2)
+	commit(1, "k1")
+	checkpoint()
+	one := ps.DeltasSize()
+	if ps.SnapshotSize() != full || one == 0 || one > full/4 {
+		t.Fatalf("expected a delta much smaller than the %d-byte snapshot, got a %d-byte delta and a %d-byte snapshot", full, one, ps.SnapshotSize())
+	}
+	sv.Set(2, "k2", 2)
+	sv.Prepare(Metadata{}, &RPCArgs{Tid: 2}, &PrepareReply{})
+	commit(3, "k3")
+	checkpoint()
+	beforeFull := ps.Copy()
+	if ps.SnapshotSize() != full || ps.DeltasSize() <= one {
+		t.Fatalf("expected a second delta appended, got %d bytes of deltas", ps.DeltasSize())
+	}
+	commit(4, "k4")
+	sv.Kill()
+	ps.Close()
+
+	ps, err = OpenPersister(dir, DiskOptions{Fsync: true})
+	if err != nil {
+		t.Fatalf("OpenPersister: %v", err)
+	}
+	defer ps.Close()
+	sv = MakeServerWithSnapshots(keys, ps, 1<<20)
+	defer sv.Kill()
+	if values := sv.storeValues(); !reflect.DeepEqual(values, want) {
+		t.Fatalf("expected %v after reopening, got %v", want, values)
+	}
+	if held := sv.heldLocks(); !reflect.DeepEqual(held, []string{"k2"}) {
+		t.Fatalf("expected the in-doubt transaction to hold k2's lock after reopening, got %v", held)
+	}
+
+	sv.DeltaCheckpoints(2)
+	sv.PreCommit(Metadata{}, &RPCArgs{Tid: 2}, &PreCommitReply{})
+	sv.Commit(Metadata{}, &RPCArgs{Tid: 2}, &CommitReply{})
+	want["k2"] = 2
+	checkpoint()
+	if ps.DeltasSize() != 0 || ps.SnapshotSize() == full {
+		t.Fatalf("expected a full snapshot after two deltas, got %d bytes of deltas", ps.DeltasSize())
+	}
+
+	// a crash as the full snapshot replaced the deltas left them
+	crashed := ps.Copy()
+	crashed.deltas = beforeFull.ReadDeltas()
+	restarted := MakeServerWithSnapshots(keys, crashed, 1<<20)
+	defer restarted.Kill()
+	if values := restarted.storeValues(); !reflect.DeepEqual(values, want) {
+		t.Fatalf("expected %v with stale deltas left over, got %v", want, values)
+	}
+	if held := restarted.heldLocks(); len(held) > 0 {
+		t.Fatalf("expected stale deltas not to bring back the in-doubt transaction, got locks %v", held)
+	}
+}
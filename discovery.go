@@ -0,0 +1,248 @@
+package commit
+
+//
+// finding the servers, and the keys each owns, without hard-coding
+// their addresses, for Coordinators on a network Transport:
+//
+//   d := FileDiscovery{Path: "participants.json"}
+//   // or DNSDiscovery{Service: "3pc", Proto: "tcp", Name: "example.com"}
+//   cl, err := DiscoverCoordinator(MakeTCPTransport(), d, respChan)
+//   co := cl.Coordinator()
+//   added, err := cl.Refresh() // later, to pick up new servers
+//
+// a participants file is JSON:
+//
+//   {"participants": [{"addr": "10.0.0.1:7000", "keys": ["x", "y"]},
+//                     {"addr": "10.0.0.2:7000", "keys": ["z"]}]}
+//
+// with DNS, each SRV record for _service._proto.name is a server,
+// and a TXT record "keys=x,y" on its target lists the keys it owns.
+//
+// a Coordinator numbers servers in the order it learns of them,
+// and a transaction may involve any of them, so Refresh() only
+// adds servers: one that disappears from the discovery stays, in
+// case it holds transactions, and a key that moves to a new
+// server is looked up there from then on.
+//
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a server's address, and the keys it owns.
+type Participant struct {
+	Addr string   `json:"addr"`
+	Keys []string `json:"keys"`
+}
+
+// where the participants are.
+type Discovery interface {
+	Participants() ([]Participant, error)
+}
+
+// participants listed in a JSON file, read again on every call.
+type FileDiscovery struct {
+	Path string
+}
+
+func (fd FileDiscovery) Participants() ([]Participant, error) {
+	data, err := os.ReadFile(fd.Path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Participants []Participant `json:"participants"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", fd.Path, err)
+	}
+	if err := checkParticipants(file.Participants); err != nil {
+		return nil, fmt.Errorf("%s: %v", fd.Path, err)
+	}
+	return file.Participants, nil
+}
+
+// how long DNSDiscovery waits for its lookups.
+const dnsTimeout = 5 * time.Second
+
+// the lookups DNSDiscovery makes; *net.Resolver has them.
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// participants found through DNS SRV records, looked up again on
+// every call, sorted by address.
+type DNSDiscovery struct {
+	Service  string   // e.g. "3pc" for _3pc._tcp.example.com
+	Proto    string   // e.g. "tcp"
+	Name     string   // e.g. "example.com"
+	Resolver Resolver // nil for net.DefaultResolver
+}
+
+func (dd DNSDiscovery) Participants() ([]Participant, error) {
+	var r Resolver = net.DefaultResolver
+	if dd.Resolver != nil {
+		r = dd.Resolver
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+
+	_, srvs, err := r.LookupSRV(ctx, dd.Service, dd.Proto, dd.Name)
+	if err != nil {
+		return nil, err
+	}
+	var ps []Participant
+	for _, srv := range srvs {
+		host := strings.TrimSuffix(srv.Target, ".")
+		txts, err := r.LookupTXT(ctx, srv.Target)
+		if err != nil {
+			return nil, fmt.Errorf("keys of %s: %v", host, err)
+		}
+		p := Participant{Addr: net.JoinHostPort(host, strconv.Itoa(int(srv.Port)))}
+		for _, txt := range txts {
+			if list, ok := strings.CutPrefix(txt, "keys="); ok && list != "" {
+				p.Keys = append(p.Keys, strings.Split(list, ",")...)
+			}
+		}
+		ps = append(ps, p)
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i].Addr < ps[j].Addr })
+
+	if err := checkParticipants(ps); err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
+
+// every participant needs an address, and no key may have two
+// owners.
+func checkParticipants(ps []Participant) error {
+	owners := make(map[string]string)
+	addrs := make(map[string]bool)
+	for _, p := range ps {
+		if p.Addr == "" {
+			return fmt.Errorf("a participant has no address")
+		}
+		if addrs[p.Addr] {
+			return fmt.Errorf("%s is listed twice", p.Addr)
+		}
+		addrs[p.Addr] = true
+		for _, key := range p.Keys {
+			if owner, ok := owners[key]; ok {
+				return fmt.Errorf("key %s is owned by both %s and %s", key, owner, p.Addr)
+			}
+			owners[key] = p.Addr
+		}
+	}
+	return nil
+}
+
+// a Coordinator dialled through a Discovery, and which server owns
+// each key.
+type Cluster struct {
+	t  Transport
+	d  Discovery
+	co *Coordinator
+
+	mu     sync.Mutex
+	addrs  []string       // server i's address
+	owners map[string]int // key : the server that owns it
+}
+
+// find the participants through d, and start a Coordinator that
+// reaches them through t.
+func DiscoverCoordinator(t Transport, d Discovery, respChan chan ResponseMsg) (*Cluster, error) {
+	ps, err := d.Participants()
+	if err != nil {
+		return nil, err
+	}
+
+	cl := &Cluster{t: t, d: d, owners: make(map[string]int)}
+	peers := make([]PeerClient, len(ps))
+	for i, p := range ps {
+		if peers[i], err = t.Dial(p.Addr); err != nil {
+			return nil, err
+		}
+		cl.addrs = append(cl.addrs, p.Addr)
+		for _, key := range p.Keys {
+			cl.owners[key] = i
+		}
+	}
+	cl.co = MakeCoordinator(peers, respChan)
+	return cl, nil
+}
+
+func (cl *Cluster) Coordinator() *Coordinator {
+	return cl.co
+}
+
+// ask the Discovery again, dial any servers it didn't list before
+// and add them to the Coordinator, and note which server owns each
+// key now. returns how many servers were added.
+func (cl *Cluster) Refresh() (int, error) {
+	ps, err := cl.d.Participants()
+	if err != nil {
+		return 0, err
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	added := 0
+	for _, p := range ps {
+		i := cl.indexLocked(p.Addr)
+		if i < 0 {
+			peer, err := cl.t.Dial(p.Addr)
+			if err != nil {
+				return added, err
+			}
+			i = cl.co.addServer(peer)
+			cl.addrs = append(cl.addrs, p.Addr)
+			added++
+		}
+		for _, key := range p.Keys {
+			cl.owners[key] = i
+		}
+	}
+	return added, nil
+}
+
+func (cl *Cluster) indexLocked(addr string) int {
+	for i, a := range cl.addrs {
+		if a == addr {
+			return i
+		}
+	}
+	return -1
+}
+
+// the server that owns key, as the Coordinator numbers them, and
+// its address; false if no participant listed it.
+func (cl *Cluster) Owner(key string) (int, string, bool) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	i, ok := cl.owners[key]
+	if !ok {
+		return -1, "", false
+	}
+	return i, cl.addrs[i], true
+}
+
+// server i's address, for each server the Coordinator knows.
+func (cl *Cluster) Addrs() []string {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	return append([]string(nil), cl.addrs...)
+}
@@ -0,0 +1,180 @@
+package commit
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Serves servers on local TCP ports, lists them in a participants file, and
+// dials a coordinator from it; after a third server is added to the file,
+// Refresh should dial it, and transactions should reach its key
+func TestFileDiscovery(t *testing.T) {
+	t.Parallel()
+
+	tr := MakeTCPTransport()
+	keys := [][]string{{"x"}, {"y"}, {"z"}}
+	servers := make([]*Server, len(keys))
+	ps := make([]Participant, len(keys))
+	for i := range keys {
+		servers[i] = MakeServer(keys[i], MakePersister())
+		defer servers[i].Kill()
+		l, err := tr.Listen("127.0.0.1:0", servers[i])
+		if err != nil {
+			t.Fatalf("Listen: %v", err)
+		}
+		defer l.Close()
+		ps[i] = Participant{Addr: l.Addr(), Keys: keys[i]}
+	}
+
+	path := filepath.Join(t.TempDir(), "participants.json")
+	write := func(ps []Participant) {
+		var lines []string
+		for _, p := range ps {
+			lines = append(lines, fmt.Sprintf(`{"addr": %q, "keys": [%q]}`, p.Addr, p.Keys[0]))
+		}
+		data := `{"participants": [` + strings.Join(lines, ", ") + `]}`
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(ps[:2])
+
+	respChan := make(chan ResponseMsg)
+	cl, err := DiscoverCoordinator(tr, FileDiscovery{Path: path}, respChan)
+	if err != nil {
+		t.Fatalf("DiscoverCoordinator: %v", err)
+	}
+	co := cl.Coordinator()
+	defer co.Kill()
+
+	await := func(tid int) ResponseMsg {
+		select {
+		case m := <-respChan:
+			if m.tid != tid || !m.committed {
+				t.Fatalf("expected transaction %d to commit, got %+v", tid, m)
+			}
+			return m
+		case <-time.After(waitTimeout):
+			t.Fatalf("Transaction %d got no response within %v", tid, waitTimeout)
+		}
+		return ResponseMsg{}
+	}
+
+	// a client finds each key's server through the Cluster
+	set := func(tid int, key string, value interface{}) {
+		i, addr, ok := cl.Owner(key)
+		if !ok || addr != ps[i].Addr {
+			t.Fatalf("Owner(%s) = %d, %s, %v", key, i, addr, ok)
+		}
+		servers[i].Set(tid, key, value)
+	}
+
+	set(0, "x", 1)
+	set(0, "y", 2)
+	co.FinishTransaction(0)
+	await(0)
+
+	if _, _, ok := cl.Owner("z"); ok {
+		t.Fatalf("z has an owner before its server was listed")
+	}
+	if added, err := cl.Refresh(); err != nil || added != 0 {
+		t.Fatalf("Refresh() with no new servers = %d, %v", added, err)
+	}
+
+	write(ps)
+	if added, err := cl.Refresh(); err != nil || added != 1 {
+		t.Fatalf("Refresh() with a new server = %d, %v; expected 1", added, err)
+	}
+	if !reflect.DeepEqual(cl.Addrs(), []string{ps[0].Addr, ps[1].Addr, ps[2].Addr}) {
+		t.Fatalf("Addrs() = %v", cl.Addrs())
+	}
+
+	set(1, "x", 3)
+	set(1, "z", 3)
+	co.FinishTransaction(1)
+	await(1)
+	servers[2].Get(2, "z")
+	co.FinishTransaction(2)
+	if m := await(2); m.readValues["z"] != 3 {
+		t.Fatalf("expected z=3, read %v", m.readValues)
+	}
+
+	// a bad file leaves the Cluster as it was
+	os.WriteFile(path, []byte(`{"participants": [{"addr": "a:1", "keys": ["x"]}, {"addr": "b:1", "keys": ["x"]}]}`), 0600)
+	if _, err := cl.Refresh(); err == nil {
+		t.Fatalf("Refresh() accepted a key with two owners")
+	}
+	if i, _, _ := cl.Owner("x"); i != 0 {
+		t.Fatalf("x moved to server %d after a failed Refresh()", i)
+	}
+}
+
+// answers DNSDiscovery's lookups from maps.
+type fakeResolver struct {
+	srvs map[string][]*net.SRV // _service._proto.name : records
+	txts map[string][]string   // target : records
+}
+
+func (r fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	cname := "_" + service + "._" + proto + "." + name
+	srvs, ok := r.srvs[cname]
+	if !ok {
+		return "", nil, &net.DNSError{Err: "no such host", Name: cname, IsNotFound: true}
+	}
+	return cname, srvs, nil
+}
+
+func (r fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return r.txts[name], nil
+}
+
+// Looks participants up in SRV records, with their keys in TXT records
+// They should come back sorted by address, and a key with two owners
+// or a missing service should be an error
+func TestDNSDiscovery(t *testing.T) {
+	t.Parallel()
+
+	r := fakeResolver{
+		srvs: map[string][]*net.SRV{
+			"_3pc._tcp.example.com": {
+				{Target: "b.example.com.", Port: 7001},
+				{Target: "a.example.com.", Port: 7000},
+			},
+			"_3pc._tcp.bad.example.com": {
+				{Target: "a.example.com.", Port: 7000},
+				{Target: "c.example.com.", Port: 7002},
+			},
+		},
+		txts: map[string][]string{
+			"a.example.com.": {"keys=x,y", "v=spf1 -all"},
+			"b.example.com.": {"keys=z"},
+			"c.example.com.": {"keys=y"},
+		},
+	}
+
+	ps, err := DNSDiscovery{Service: "3pc", Proto: "tcp", Name: "example.com", Resolver: r}.Participants()
+	if err != nil {
+		t.Fatalf("Participants: %v", err)
+	}
+	want := []Participant{
+		{Addr: "a.example.com:7000", Keys: []string{"x", "y"}},
+		{Addr: "b.example.com:7001", Keys: []string{"z"}},
+	}
+	if !reflect.DeepEqual(ps, want) {
+		t.Fatalf("Participants() = %v; expected %v", ps, want)
+	}
+
+	if _, err := (DNSDiscovery{Service: "3pc", Proto: "tcp", Name: "bad.example.com", Resolver: r}).Participants(); err == nil {
+		t.Fatalf("accepted a key with two owners")
+	}
+	if _, err := (DNSDiscovery{Service: "3pc", Proto: "tcp", Name: "missing.example.com", Resolver: r}).Participants(); err == nil {
+		t.Fatalf("found participants for a missing service")
+	}
+}
@@ -0,0 +1,395 @@
+package commit
+
+//
+// a Persister kept in files, so a Server's state survives the
+// process and not just the tester's restarts:
+//
+//   ps, err := OpenPersister("/var/lib/3pc/server0", DiskOptions{Fsync: true})
+//   sv := MakeServerWithSnapshots(keys, ps, 64*1024)
+//   ...
+//   sv.Kill()
+//   ps.Close()
+//
+// the directory holds three files: "state", what Save() last wrote,
+// "snapshot", and "deltas", which SaveStateAndDeltas() appends to
+// (delta.go). a Server made with MakeServerWithSnapshots()
+// saves a log that only ever grows between snapshots, so its
+// "state" file is a write-ahead log: each Save() appends the new
+// records rather than rewriting the file. a Server made with
+// MakeServer() rewrites the whole file on each change.
+//
+// every Save() reaches the operating system before it returns, but
+// not necessarily the disk. before a Server votes Yes it calls
+// Sync(), which, with Fsync set, fsyncs the files, so the
+// transaction's operations and vote survive a machine crash and a
+// restarted Server still holds the locks it promised. without
+// Fsync, Sync() only reports write errors, which is enough to
+// survive a crashed process and much faster. if a write or fsync
+// fails, the Server votes No and stops, since it can no longer keep
+// its promises.
+//
+// when many transactions vote at once, their fsyncs are shared: a
+// Sync() that finds another's fsync under way waits for it, and the
+// next one then covers every write made meanwhile. with
+// GroupCommitWindow set, a Sync() that has to fsync first waits that
+// long for other votes' writes to join it, trading that much latency
+// for fewer fsyncs, which on most disks means more transactions a
+// second.
+//
+// SaveStateAndSnapshot() replaces each file whole: it writes the new
+// contents to "snapshot.tmp" or "state.tmp", fsyncs it if Fsync is
+// set, and renames it over the old file, so a crash while
+// checkpointing leaves each file either as it was or as it should
+// be, never half-written. OpenPersister() removes a temporary file
+// a crash left behind. the snapshot is replaced first, so a crash
+// between the two renames leaves the new snapshot with the old log,
+// whose records the snapshot already holds; a Server replaying them
+// skips the values it has a later version of (see readLog()).
+//
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// added to a file's name while its replacement is written.
+const tmpSuffix = ".tmp"
+
+type DiskOptions struct {
+	Fsync             bool          // fsync before a Server votes Yes
+	GroupCommitWindow time.Duration // how long an fsync waits for others to share it; 0 not at all
+}
+
+// what a Persister kept on disk needs of the filesystem: the
+// operating system's, or a simulated disk that fails as a test asks
+// (faultdisk.go).
+type diskFS interface {
+	MkdirAll(dir string) error
+	OpenFile(path string, flag int) (diskFile, error)
+	ReadFile(path string) ([]byte, error)
+	ReadDir(dir string) ([]string, error)
+	Rename(from string, to string) error
+	Remove(path string) error
+	SyncDir(dir string) error
+}
+
+// an open file; *os.File is one.
+type diskFile interface {
+	Name() string
+	Write(b []byte) (int, error)
+	WriteAt(b []byte, off int64) (int, error)
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+// the operating system's filesystem.
+type osFS struct{}
+
+// a Persister's files.
+type diskFiles struct {
+	fs       diskFS
+	dir      string
+	opts     DiskOptions
+	state    diskFile
+	snapshot diskFile
+	deltas   diskFile
+	written  uint64     // writes made so far
+	synced   uint64     // writes made durable so far
+	syncing  bool       // a Sync() is gathering writes or fsyncing them
+	syncDone *sync.Cond // signalled when syncing ends; on the Persister's mu
+	fsyncs   int        // fsyncs run, for tests
+	err      error      // the first write that failed, reported by Sync()
+}
+
+// a Persister that keeps its state in dir, creating it if need be,
+// and starts with whatever a previous one left there.
+func OpenPersister(dir string, opts DiskOptions) (*Persister, error) {
+	return openPersister(osFS{}, dir, opts)
+}
+
+// like OpenPersister, on fs.
+func openPersister(fs diskFS, dir string, opts DiskOptions) (*Persister, error) {
+	if err := fs.MkdirAll(dir); err != nil {
+		return nil, err
+	}
+	df := &diskFiles{fs: fs, dir: dir, opts: opts}
+	ps := MakePersister()
+	df.syncDone = sync.NewCond(&ps.mu)
+	var err error
+	// a file a crash stopped us from renaming into place
+	for _, name := range []string{"state", "snapshot", "deltas"} {
+		if err := fs.Remove(filepath.Join(dir, name+tmpSuffix)); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	if df.state, ps.serverstate, err = openDiskFile(fs, filepath.Join(dir, "state")); err != nil {
+		return nil, err
+	}
+	if df.snapshot, ps.snapshot, err = openDiskFile(fs, filepath.Join(dir, "snapshot")); err != nil {
+		df.state.Close()
+		return nil, err
+	}
+	if df.deltas, ps.deltas, err = openDiskFile(fs, filepath.Join(dir, "deltas")); err != nil {
+		df.state.Close()
+		df.snapshot.Close()
+		return nil, err
+	}
+	// the files may be new, and a crash mustn't lose them with the
+	// votes they'll hold
+	if opts.Fsync {
+		err = fs.SyncDir(dir)
+	}
+	if err == nil {
+		ps.retained, err = readRetained(fs, dir)
+	}
+	if err != nil {
+		df.state.Close()
+		df.snapshot.Close()
+		df.deltas.Close()
+		return nil, err
+	}
+	ps.disk = df
+	return ps, nil
+}
+
+// open path for reading and writing, and read what it holds.
+func openDiskFile(fs diskFS, path string) (diskFile, []byte, error) {
+	f, err := fs.OpenFile(path, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := fs.ReadFile(path)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, data, nil
+}
+
+// make what Save() and SaveStateAndSnapshot() wrote durable, if
+// the Persister fsyncs, and return the first write or fsync that
+// failed, or write a replica group didn't take. a Persister kept in
+// memory has nothing to do.
+func (ps *Persister) Sync() error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	df := ps.disk
+	if ps.mirrorErr != nil {
+		return ps.mirrorErr
+	}
+	if df == nil || !df.opts.Fsync {
+		return ps.diskErr()
+	}
+	mine := df.written
+	for ps.disk == df && df.synced < mine && df.err == nil {
+		if df.syncing {
+			df.syncDone.Wait()
+			continue
+		}
+
+		// gather the writes of the votes arriving meanwhile
+		df.syncing = true
+		if df.opts.GroupCommitWindow > 0 {
+			ps.mu.Unlock()
+			time.Sleep(df.opts.GroupCommitWindow)
+			ps.mu.Lock()
+		}
+		// Saves carry on while we fsync; replacing or closing
+		// the files waits for us
+		upTo := df.written
+		if ps.disk == df {
+			ps.mu.Unlock()
+			err := df.fsync()
+			ps.mu.Lock()
+			df.fsyncs++
+			if err != nil && df.err == nil {
+				df.err = err
+			}
+			df.synced = upTo
+		}
+		df.syncing = false
+		df.syncDone.Broadcast()
+	}
+	return df.err
+}
+
+// the first write or fsync that failed, if kept on disk.
+// must be called with ps.mu held.
+func (ps *Persister) diskErr() error {
+	if ps.disk == nil {
+		return nil
+	}
+	return ps.disk.err
+}
+
+// fsync all the files.
+func (df *diskFiles) fsync() error {
+	for _, f := range []diskFile{df.state, df.snapshot, df.deltas} {
+		if err := f.Sync(); err != nil {
+			return fmt.Errorf("fsync %s: %w", f.Name(), err)
+		}
+	}
+	return nil
+}
+
+// wait for a Sync() that's using the files to finish.
+// must be called with the Persister's mu held.
+func (df *diskFiles) waitSync() {
+	for df.syncing {
+		df.syncDone.Wait()
+	}
+}
+
+// close the files of a Persister kept on disk. it keeps what it
+// holds in memory, but writes no more.
+func (ps *Persister) Close() error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	df := ps.disk
+	if df == nil {
+		return nil
+	}
+	df.waitSync()
+	if ps.disk != df {
+		return nil // closed while we waited
+	}
+	ps.disk = nil
+	err := df.state.Close()
+	if err2 := df.snapshot.Close(); err == nil {
+		err = err2
+	}
+	if err2 := df.deltas.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// write new over old in f, appending if new only adds to old.
+func (df *diskFiles) write(f diskFile, old []byte, new []byte) {
+	if df.err != nil {
+		return
+	}
+	if len(new) >= len(old) && bytes.Equal(new[:len(old)], old) {
+		df.append(f, len(old), new[len(old):])
+		return
+	}
+	df.written++
+	if err := f.Truncate(0); err != nil {
+		df.err = fmt.Errorf("truncate %s: %w", f.Name(), err)
+	} else if _, err := f.WriteAt(new, 0); err != nil {
+		df.err = fmt.Errorf("write %s: %w", f.Name(), err)
+	}
+}
+
+// append data to f, which holds size bytes.
+func (df *diskFiles) append(f diskFile, size int, data []byte) {
+	if df.err != nil {
+		return
+	}
+	df.written++
+	if _, err := f.WriteAt(data, int64(size)); err != nil {
+		df.err = fmt.Errorf("append to %s: %w", f.Name(), err)
+	}
+}
+
+// replace f's contents with data, through a temporary file renamed
+// over it, and return the file now at f's name.
+func (df *diskFiles) replace(f diskFile, data []byte) diskFile {
+	if df.err != nil {
+		return f
+	}
+	df.waitSync()
+	path := f.Name()
+	if err := df.writeTemp(path+tmpSuffix, data); err != nil {
+		df.err = err
+		df.fs.Remove(path + tmpSuffix)
+		return f
+	}
+	if err := df.fs.Rename(path+tmpSuffix, path); err != nil {
+		df.err = fmt.Errorf("rename %s: %w", path+tmpSuffix, err)
+		return f
+	}
+	if df.opts.Fsync {
+		if err := df.fs.SyncDir(df.dir); err != nil {
+			df.err = err
+		}
+	}
+	f.Close()
+	nf, err := df.fs.OpenFile(path, os.O_RDWR)
+	if err != nil && df.err == nil {
+		df.err = fmt.Errorf("reopen %s: %w", path, err)
+	}
+	return nf
+}
+
+// write data to a new file at path, fsyncing it if the Persister
+// fsyncs.
+func (df *diskFiles) writeTemp(path string, data []byte) error {
+	f, err := df.fs.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+	if df.opts.Fsync {
+		if err := f.Sync(); err != nil {
+			return fmt.Errorf("fsync %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+func (osFS) MkdirAll(dir string) error {
+	return os.MkdirAll(dir, 0755)
+}
+
+func (osFS) OpenFile(path string, flag int) (diskFile, error) {
+	f, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return nil, err // not a non-nil diskFile holding a nil *os.File
+	}
+	return f, nil
+}
+
+func (osFS) ReadFile(path string) ([]byte, error) {
+	return os.ReadFile(path)
+}
+
+func (osFS) ReadDir(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name()
+	}
+	return names, err
+}
+
+func (osFS) Rename(from string, to string) error {
+	return os.Rename(from, to)
+}
+
+func (osFS) Remove(path string) error {
+	return os.Remove(path)
+}
+
+// make a rename in dir durable.
+func (osFS) SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("fsync %s: %w", dir, err)
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package commit
+
+import (
+	"3PhaseCommit/labrpc"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Commits a transaction through a server kept on disk, and holds a second at PreCommit after it
+// voted Yes, then reopens the directory in a new server
+// The state file should match what the server saved, and the new server should have the first
+// transaction's value and still hold the second's lock
+func TestDiskPersister(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	ps, err := OpenPersister(dir, DiskOptions{Fsync: true})
+	if err != nil {
+		t.Fatalf("OpenPersister: %v", err)
+	}
+	net := labrpc.MakeNetwork()
+	defer net.Cleanup()
+	tr := makeLabrpcTransport(net)
+	sv := MakeServerWithSnapshots([]string{"x", "y"}, ps, 1<<20)
+	prepared := make(chan struct{})
+	held := make(chan struct{})
+	defer close(held)
+	sv.setHook(func(point hookPoint, method string, tid int, meta Metadata) {
+		if point == hookBefore && method == "Server.PreCommit" && tid == 1 {
+			close(prepared)
+			<-held
+		}
+	})
+	tr.Serve("server0", sv)
+	end, _ := tr.Dial("server0")
+	respChan := make(chan ResponseMsg)
+	co := MakeCoordinator([]PeerClient{end}, respChan)
+	defer co.Kill()
+
+	sv.Set(0, "x", 1)
+	co.FinishTransaction(0)
+	select {
+	case m := <-respChan:
+		if !m.committed {
+			t.Fatalf("expected transaction 0 to commit, got %+v", m)
+		}
+	case <-time.After(waitTimeout):
+		t.Fatalf("Transaction 0 got no response within %v", waitTimeout)
+	}
+	sv.Set(1, "y", 2)
+	co.FinishTransaction(1)
+	select {
+	case <-prepared:
+	case <-time.After(waitTimeout):
+		t.Fatalf("Transaction 1 never reached PreCommit")
+	}
+
+	onDisk, err := os.ReadFile(filepath.Join(dir, "state"))
+	if err != nil || !bytes.Equal(onDisk, ps.ReadServerState()) {
+		t.Fatalf("expected the state file to hold what the server saved (err %v)", err)
+	}
+	sv.Kill()
+	if err := ps.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	ps, err = OpenPersister(dir, DiskOptions{Fsync: true})
+	if err != nil {
+		t.Fatalf("OpenPersister again: %v", err)
+	}
+	defer ps.Close()
+	sv = MakeServerWithSnapshots([]string{"x", "y"}, ps, 1<<20)
+	defer sv.Kill()
+	if v := sv.storeValues()["x"]; v != 1 {
+		t.Fatalf("expected x to be 1 after reopening, got %v", v)
+	}
+	if locks := sv.heldLocks(); !reflect.DeepEqual(locks, []string{"y"}) {
+		t.Fatalf("expected the in-doubt transaction to hold y after reopening, got %v", locks)
+	}
+}
+
+// Breaks the state file of a server kept on disk before a transaction's Prepare
+// The server should vote No rather than promise what it can't make durable, and stop
+func TestDiskWriteFailure(t *testing.T) {
+	t.Parallel()
+
+	ps, err := OpenPersister(t.TempDir(), DiskOptions{})
+	if err != nil {
+		t.Fatalf("OpenPersister: %v", err)
+	}
+	defer ps.Close()
+	net := labrpc.MakeNetwork()
+	defer net.Cleanup()
+	tr := makeLabrpcTransport(net)
+	sv := MakeServerWithSnapshots([]string{"x"}, ps, 1<<20)
+	defer sv.Kill()
+	tr.Serve("server0", sv)
+	end, _ := tr.Dial("server0")
+	respChan := make(chan ResponseMsg)
+	co := MakeCoordinator([]PeerClient{end}, respChan)
+	defer co.Kill()
+
+	ps.disk.state.Close()
+	sv.Set(0, "x", 1)
+	co.FinishTransaction(0)
+	select {
+	case m := <-respChan:
+		if m.committed || !errors.Is(m.Err(), ErrVotedNo) {
+			t.Fatalf("expected transaction 0 to abort on a No vote, got %+v", m)
+		}
+	case <-time.After(waitTimeout):
+		t.Fatalf("Transaction 0 got no response within %v", waitTimeout)
+	}
+	if !sv.killed() {
+		t.Fatalf("expected the server to stop after a failed write")
+	}
+	if err := ps.Sync(); err == nil {
+		t.Fatalf("expected Sync to report the failed write")
+	}
+}
+
+// Checkpoints a server kept on disk, commits again so the log is appended to the replaced
+// file, then leaves a half-written snapshot.tmp behind, as a crash while checkpointing would
+// Both files should match what the server saved, and reopening should ignore the torn file
+func TestDiskAtomicSnapshot(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	ps, err := OpenPersister(dir, DiskOptions{Fsync: true})
+	if err != nil {
+		t.Fatalf("OpenPersister: %v", err)
+	}
+	sv := MakeServerWithSnapshots([]string{"x"}, ps, 1<<20)
+	commit := func(tid int, value int) {
+		args := &RPCArgs{Tid: tid}
+		sv.Set(tid, "x", value)
+		sv.Prepare(Metadata{}, args, &PrepareReply{})
+		sv.PreCommit(Metadata{}, args, &PreCommitReply{})
+		sv.Commit(Metadata{}, args, &CommitReply{})
+	}
+	commit(0, 1)
+	if err := sv.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint: %v", err)
+	}
+	commit(1, 2)
+
+	for name, saved := range map[string][]byte{"state": ps.ReadServerState(), "snapshot": ps.ReadSnapshot()} {
+		onDisk, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil || !bytes.Equal(onDisk, saved) {
+			t.Fatalf("expected the %s file to hold what the server saved (err %v)", name, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, name+tmpSuffix)); !os.IsNotExist(err) {
+			t.Fatalf("expected no %s%s after a checkpoint, got %v", name, tmpSuffix, err)
+		}
+	}
+	snapshot := ps.ReadSnapshot()
+	sv.Kill()
+	ps.Close()
+
+	torn := filepath.Join(dir, "snapshot"+tmpSuffix)
+	if err := os.WriteFile(torn, snapshot[:len(snapshot)/2], 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	ps, err = OpenPersister(dir, DiskOptions{Fsync: true})
+	if err != nil {
+		t.Fatalf("OpenPersister again: %v", err)
+	}
+	defer ps.Close()
+	sv = MakeServerWithSnapshots([]string{"x"}, ps, 1<<20)
+	defer sv.Kill()
+	if v := sv.storeValues()["x"]; v != 2 {
+		t.Fatalf("expected x to be 2 after reopening, got %v", v)
+	}
+	if _, err := os.Stat(torn); !os.IsNotExist(err) {
+		t.Fatalf("expected reopening to remove the torn snapshot, got %v", err)
+	}
+}
+
+// Prepares 16 transactions on their own keys at once, through a server kept on disk whose
+// fsyncs wait 20ms for others to join them
+// Every transaction should vote Yes, with far fewer fsyncs than votes
+func TestGroupCommit(t *testing.T) {
+	t.Parallel()
+
+	const ntxns = 16
+	ps, err := OpenPersister(t.TempDir(), DiskOptions{Fsync: true, GroupCommitWindow: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("OpenPersister: %v", err)
+	}
+	defer ps.Close()
+	keys := make([]string, ntxns)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("k%d", i)
+	}
+	sv := MakeServerWithSnapshots(keys, ps, 1<<20)
+	defer sv.Kill()
+
+	var wg sync.WaitGroup
+	votes := make([]bool, ntxns)
+	for tid := range ntxns {
+		sv.Set(tid, keys[tid], tid)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reply := &PrepareReply{}
+			sv.Prepare(Metadata{}, &RPCArgs{Tid: tid}, reply)
+			votes[tid] = reply.Vote
+		}()
+	}
+	wg.Wait()
+
+	for tid, vote := range votes {
+		if !vote {
+			t.Fatalf("expected transaction %d to vote Yes", tid)
+		}
+	}
+	ps.mu.Lock()
+	fsyncs, synced, written := ps.disk.fsyncs, ps.disk.synced, ps.disk.written
+	ps.mu.Unlock()
+	if fsyncs > ntxns/4 {
+		t.Fatalf("expected %d votes to share at most %d fsyncs, got %d", ntxns, ntxns/4, fsyncs)
+	}
+	if synced != written {
+		t.Fatalf("expected every write to be synced once the votes are in, got %d of %d", synced, written)
+	}
+}
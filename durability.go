@@ -0,0 +1,286 @@
+package commit
+
+//
+// how much waits for the disk, traded against how much a crash can
+// lose:
+//
+//   co := MakeCoordinatorWithPersister(servers, respChan, persister)
+//   co.SetDurability(DurabilityAsync)
+//   sv.SetDurability(DurabilityAsync)
+//
+// a Server's level applies to its Yes votes. with DurabilitySync,
+// the default, the vote and the transaction's operations are synced
+// (see Persister.Sync()) before the vote is sent, so a Server that
+// crashes and restarts still holds the locks it promised. with
+// DurabilityAsync the vote is sent at once and synced in the
+// background; a machine crash in between can lose a Yes vote the
+// Coordinator already counted. with DurabilityNone nothing is synced:
+// votes reach the disk when the operating system writes them, and a
+// failing disk goes unnoticed. a Persister kept in memory has nothing
+// to sync, so the level only matters for one from OpenPersister().
+//
+// a Coordinator's level applies to its decisions, which it logs only
+// if it was made with MakeCoordinatorWithPersister(), or with
+// MakeCoordinatorWithDecisionLog() (raftlog.go). with
+// DurabilitySync, the default, a decision to commit or abort is
+// logged and synced before any server hears it; with DurabilityAsync
+// it's logged and synced in the background; with DurabilityNone it
+// isn't logged. a Coordinator made with the same Persister after a
+// crash finishes each transaction the way the log says, even if no
+// server heard the decision, and answers ResolveTransaction from it;
+// without the log, recovery works out the outcome from the servers
+// alone, and may commit a transaction the previous Coordinator had
+// decided to abort but told no server about. a Server or Coordinator
+// that can't sync stops, since it can no longer keep its promises.
+//
+
+import (
+	"3PhaseCommit/labgob"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync/atomic"
+)
+
+type DurabilityLevel int32
+
+const (
+	DurabilityNone  DurabilityLevel = iota // nothing waits for the disk
+	DurabilityAsync                        // written at once, synced in the background
+	DurabilitySync                         // synced before anyone hears of it
+)
+
+func (l DurabilityLevel) String() string {
+	switch l {
+	case DurabilityNone:
+		return "none"
+	case DurabilityAsync:
+		return "async"
+	case DurabilitySync:
+		return "sync"
+	}
+	return fmt.Sprintf("DurabilityLevel(%d)", int(l))
+}
+
+// one entry in a Coordinator's decision log.
+type decisionRecord struct {
+	Tid     int
+	Outcome string // Committed or Aborted
+}
+
+// a decision log kept somewhere other than a Persister, e.g. by a
+// RaftLog's replicas (raftlog.go).
+type DecisionLog interface {
+	// log tid's outcome durably; an error if it may not be, or if
+	// the log already holds the other outcome for tid.
+	Append(tid int, outcome string) error
+
+	// every outcome logged so far; an error if the log can't tell
+	// yet, e.g. while another replica leads.
+	Decisions() (map[int]string, error)
+}
+
+// like MakeCoordinator, but decisions are logged to persister, and a
+// Coordinator made with the same persister after a crash finishes
+// the transactions the way the log says.
+func MakeCoordinatorWithPersister(servers []PeerClient, respChan chan ResponseMsg, persister *Persister) *Coordinator {
+	return makeLoggingCoordinator(servers, respChan, realClock{}, phaseTimeout, stdLogger("coordinator"), persister, nil)
+}
+
+// how durable the Coordinator makes its decisions from now on.
+func (co *Coordinator) SetDurability(l DurabilityLevel) {
+	atomic.StoreInt32(&co.durable, int32(l))
+}
+
+// how durable the Server makes its Yes votes from now on.
+func (sv *Server) SetDurability(l DurabilityLevel) {
+	atomic.StoreInt32(&sv.durable, int32(l))
+}
+
+func (co *Coordinator) durability() DurabilityLevel {
+	return DurabilityLevel(atomic.LoadInt32(&co.durable))
+}
+
+func (sv *Server) durability() DurabilityLevel {
+	return DurabilityLevel(atomic.LoadInt32(&sv.durable))
+}
+
+// log the decision on tid, if the Coordinator logs, as durably as
+// its level asks; false if it can't, and the Coordinator has stopped.
+func (co *Coordinator) logDecision(ctx context.Context, tid int, outcome string) bool {
+	level := co.durability()
+	if (co.persister == nil && co.dlog == nil) || level == DurabilityNone {
+		return true
+	}
+	if co.dlog != nil {
+		return co.appendDecision(ctx, tid, outcome, level)
+	}
+
+	co.mu.Lock()
+	if logged, err := co.checkDecidedLocked(tid, outcome); logged || err != nil {
+		co.mu.Unlock()
+		if err != nil {
+			co.logFor(ctx).Warnf("can't log the decision, stopping: %v", err)
+			co.Kill()
+		}
+		return err == nil
+	}
+	co.decided[tid] = outcome
+	co.decisionLog.encode(decisionRecord{Tid: tid, Outcome: outcome})
+	co.persister.Append(co.decisionLog.take())
+	co.mu.Unlock()
+
+	if level == DurabilityAsync {
+		co.spawn(func() {
+			if err := co.persister.Sync(); err != nil {
+				co.logFor(ctx).Warnf("a decision already sent isn't durable, stopping: %v", err)
+				co.Kill()
+			}
+		})
+		return true
+	}
+	if err := co.persister.Sync(); err != nil {
+		co.logFor(ctx).Warnf("can't make the decision durable, stopping: %v", err)
+		co.Kill()
+		return false
+	}
+	return true
+}
+
+// log the decision on tid to co.dlog, as logDecision() does to
+// co.persister.
+func (co *Coordinator) appendDecision(ctx context.Context, tid int, outcome string, level DurabilityLevel) bool {
+	co.mu.Lock()
+	if logged, err := co.checkDecidedLocked(tid, outcome); logged || err != nil {
+		co.mu.Unlock()
+		if err != nil {
+			co.logFor(ctx).Warnf("can't log the decision, stopping: %v", err)
+			co.Kill()
+		}
+		return err == nil
+	}
+	co.decided[tid] = outcome
+	co.mu.Unlock()
+
+	if level == DurabilityAsync {
+		co.spawn(func() {
+			if err := co.dlog.Append(tid, outcome); err != nil {
+				co.logFor(ctx).Warnf("a decision already sent isn't logged, stopping: %v", err)
+				co.Kill()
+			}
+		})
+		return true
+	}
+	if err := co.dlog.Append(tid, outcome); err != nil {
+		co.logFor(ctx).Warnf("can't log the decision, stopping: %v", err)
+		co.Kill()
+		return false
+	}
+	return true
+}
+
+// whether tid's outcome is already logged, and an error if it's
+// logged as the other one. must be called with co.mu held
+func (co *Coordinator) checkDecidedLocked(tid int, outcome string) (bool, error) {
+	decided, exists := co.decided[tid]
+	if exists && decided != outcome {
+		return false, fmt.Errorf("transaction %d was already logged as %s", tid, decided)
+	}
+	return exists, nil
+}
+
+// wait until co.dlog can tell every decision logged so far, and
+// take them as a previous Coordinator's; false if we're killed
+// first.
+func (co *Coordinator) readDecisionLog() bool {
+	ctx := withTxn(context.Background(), noTid, phaseRecovery)
+	for !co.killed() {
+		decided, err := co.dlog.Decisions()
+		if err == nil {
+			co.mu.Lock()
+			for tid, outcome := range decided {
+				co.decided[tid] = outcome
+			}
+			co.mu.Unlock()
+			co.logFor(ctx).Infof("read %d decisions from the decision log", len(decided))
+			return true
+		}
+		co.logFor(ctx).Debugf("waiting for the decision log: %v", err)
+		co.sleep(resolveRetryInterval)
+	}
+	return false
+}
+
+// read the decision log a previous Coordinator left; a record cut
+// short by a torn write is dropped, as no server heard of it, but a
+// log missing decisions before its last one stops us (see wal.go).
+// the log is then rewritten with one record per transaction, by the
+// encoder that appends the next ones.
+func (co *Coordinator) readDecisions(data []byte) {
+	co.decisionLog = newFrameWriter()
+	if len(data) == 0 {
+		return
+	}
+
+	ctx := withTxn(context.Background(), noTid, phaseRecovery)
+	framed, torn, err := readFrames(data)
+	if err != nil {
+		log.Fatalf("Coordinator: decision log: %v", err)
+	}
+	if torn > 0 {
+		co.logFor(ctx).Warnf("dropping a torn decision record, %d bytes", torn)
+	}
+
+	r := bytes.NewBuffer(framed)
+	d := labgob.NewDecoder(r)
+	for r.Len() > 0 {
+		var record decisionRecord
+		if err := d.Decode(&record); err != nil {
+			log.Fatalf("Coordinator: a decision record passed its checksum but can't be decoded: %v", err)
+		}
+		if _, err := co.checkDecidedLocked(record.Tid, record.Outcome); err != nil {
+			co.logFor(ctx).Warnf("keeping the first outcome: %v, then as %s", err, record.Outcome)
+			continue
+		}
+		co.decided[record.Tid] = record.Outcome
+	}
+
+	tids := make([]int, 0, len(co.decided))
+	for tid := range co.decided {
+		tids = append(tids, tid)
+	}
+	sort.Ints(tids)
+	for _, tid := range tids {
+		co.decisionLog.encode(decisionRecord{Tid: tid, Outcome: co.decided[tid]})
+	}
+	// replaced atomically, so a crash leaves the old log or this one
+	co.persister.SaveStateAndSnapshot(co.decisionLog.take(), nil)
+}
+
+// make a Yes vote as durable as the Server's level asks; false if it
+// can't be, and the Server has stopped.
+func (sv *Server) syncVote(ctx context.Context) bool {
+	switch sv.durability() {
+	case DurabilityNone:
+		return true
+	case DurabilityAsync:
+		sv.spawn(func() {
+			if sv.killed() {
+				return
+			}
+			if err := sv.persister.Sync(); err != nil {
+				sv.logFor(ctx).Warnf("a vote already sent isn't durable, stopping: %v", err)
+				sv.Kill()
+			}
+		})
+		return true
+	}
+	if err := sv.persister.Sync(); err != nil {
+		sv.logFor(ctx).Warnf("can't make the vote durable, voting No and stopping: %v", err)
+		sv.Kill()
+		return false
+	}
+	return true
+}
@@ -0,0 +1,255 @@
+package commit
+
+import (
+	"3PhaseCommit/labrpc"
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Prepares a transaction through a server kept on disk at each durability level
+// A Sync vote should be fsynced by the time it's sent, an Async one soon after, and a
+// None one never
+func TestDurabilityVotes(t *testing.T) {
+	t.Parallel()
+
+	for _, level := range []DurabilityLevel{DurabilityNone, DurabilityAsync, DurabilitySync} {
+		ps, err := OpenPersister(t.TempDir(), DiskOptions{Fsync: true})
+		if err != nil {
+			t.Fatalf("OpenPersister: %v", err)
+		}
+		defer ps.Close()
+		sv := MakeServerWithSnapshots([]string{"x"}, ps, 1<<20)
+		defer sv.Kill()
+		sv.SetDurability(level)
+		fsyncs := func() int {
+			ps.mu.Lock()
+			defer ps.mu.Unlock()
+			return ps.disk.fsyncs
+		}
+
+		sv.Set(0, "x", 1)
+		reply := &PrepareReply{}
+		sv.Prepare(Metadata{}, &RPCArgs{Tid: 0}, reply)
+		if !reply.Vote {
+			t.Fatalf("%v: expected a Yes vote", level)
+		}
+		switch level {
+		case DurabilitySync:
+			if n := fsyncs(); n != 1 {
+				t.Fatalf("%v: expected the vote to be fsynced before it was sent, got %d fsyncs", level, n)
+			}
+		case DurabilityAsync:
+			for start := time.Now(); fsyncs() == 0 || sv.goroutines() > 0; time.Sleep(5 * time.Millisecond) {
+				if time.Since(start) > waitTimeout {
+					t.Fatalf("%v: expected the vote to be fsynced, by a goroutine that then returns, within %v", level, waitTimeout)
+				}
+			}
+		case DurabilityNone:
+			time.Sleep(50 * time.Millisecond)
+			if n := fsyncs(); n != 0 {
+				t.Fatalf("%v: expected no fsyncs, got %d", level, n)
+			}
+		}
+	}
+}
+
+// Has a coordinator that logs its decisions give up on an unreachable server and decide
+// to abort, then crashes before any server hears the abort; the other server voted Yes
+// A coordinator restarted from the log should abort the transaction, where one without
+// it would find only Yes votes and commit
+func TestDurabilityDecisions(t *testing.T) {
+	t.Parallel()
+
+	net := labrpc.MakeNetwork()
+	defer net.Cleanup()
+	servers := []*Server{MakeServer([]string{"x"}, MakePersister()), MakeServer([]string{"y"}, MakePersister())}
+	for i, sv := range servers {
+		defer sv.Kill()
+		serveLabrpc(net, fmt.Sprintf("server%d", i), sv)
+	}
+	ends := func(prefix string, enabled ...bool) []PeerClient {
+		peers := make([]PeerClient, len(enabled))
+		for i, on := range enabled {
+			name := fmt.Sprintf("%s-%d", prefix, i)
+			end := net.MakeEnd(name)
+			net.Connect(name, fmt.Sprintf("server%d", i))
+			net.Enable(name, on)
+			peers[i] = end
+		}
+		return peers
+	}
+
+	var co *Coordinator
+	crashed := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	first := true
+	servers[0].setHook(func(point hookPoint, method string, tid int, meta Metadata) {
+		if point == hookBefore && method == "Server.Abort" && first {
+			first = false
+			co.Kill()
+			close(crashed)
+			<-release
+		}
+	})
+
+	ps := MakePersister()
+	co = MakeCoordinatorWithPersister(ends("first", true, false), make(chan ResponseMsg), ps)
+	servers[0].Set(0, "x", 1)
+	servers[1].Set(0, "y", 1)
+	co.FinishTransaction(0)
+	select {
+	case <-crashed:
+	case <-time.After(waitTimeout + phaseTimeout):
+		t.Fatalf("the coordinator never decided to abort")
+	}
+	if state, _ := servers[0].transactionState(0); state != stateVotedYes {
+		t.Fatalf("expected server 0 to still be in doubt, got %v", state)
+	}
+
+	respChan := make(chan ResponseMsg)
+	co2 := MakeCoordinatorWithPersister(ends("second", true, true), respChan, ps.Copy())
+	defer co2.Kill()
+	select {
+	case m := <-respChan:
+		if m.tid != 0 || m.committed {
+			t.Fatalf("expected the restarted coordinator to abort transaction 0, got %+v", m)
+		}
+	case <-time.After(waitTimeout):
+		t.Fatalf("the restarted coordinator reported nothing within %v", waitTimeout)
+	}
+	if v := servers[0].storeValues()["x"]; v != nil {
+		t.Fatalf("expected the aborted Set not to be applied, got x = %v", v)
+	}
+}
+
+// Restarts a coordinator from a log holding a commit both servers voted Yes on, on a simulated
+// clock, and cuts server 1 off as its first PreCommit arrives
+// The coordinator should keep resending PreCommit, rather than abort a logged commit, until the
+// clock passes the phase timeout, then give up and answer ResolveTransaction from the log
+func TestDurabilityLoggedCommit(t *testing.T) {
+	t.Parallel()
+
+	net := labrpc.MakeNetwork()
+	defer net.Cleanup()
+	servers := []*Server{MakeServer([]string{"x"}, MakePersister()), MakeServer([]string{"y"}, MakePersister())}
+	peers := make([]PeerClient, len(servers))
+	for i, sv := range servers {
+		defer sv.Kill()
+		serveLabrpc(net, fmt.Sprintf("server%d", i), sv)
+		name := fmt.Sprintf("end-%d", i)
+		peers[i] = net.MakeEnd(name)
+		net.Connect(name, fmt.Sprintf("server%d", i))
+		net.Enable(name, true)
+	}
+	for i, sv := range servers {
+		sv.Set(0, []string{"x", "y"}[i], 1)
+		reply := &PrepareReply{}
+		sv.Prepare(Metadata{}, &RPCArgs{Tid: 0}, reply)
+		if !reply.Vote {
+			t.Fatalf("expected server %d to vote Yes", i)
+		}
+	}
+
+	cut := make(chan struct{})
+	var once sync.Once
+	servers[1].setHook(func(point hookPoint, method string, tid int, meta Metadata) {
+		if point == hookBefore && method == "Server.PreCommit" {
+			once.Do(func() {
+				net.Enable("end-1", false)
+				close(cut)
+			})
+		}
+	})
+
+	fw := newFrameWriter()
+	fw.encode(decisionRecord{Tid: 0, Outcome: PhaseCommitted})
+	ps := MakePersister()
+	ps.Save(fw.bytes())
+	clock := MakeSimClock()
+	respChan := make(chan ResponseMsg, 1)
+	co := makeLoggingCoordinator(peers, respChan, clock, phaseTimeout, stdLogger("coordinator"), ps, nil)
+	defer co.Kill()
+	select {
+	case <-cut:
+	case <-time.After(waitTimeout):
+		t.Fatalf("the restarted coordinator never sent server 1 PreCommit")
+	}
+	resolved := func() string {
+		reply := &ResolveReply{}
+		co.ResolveTransaction(Metadata{}, &RPCArgs{Tid: 0}, reply)
+		return reply.Outcome
+	}
+
+	// the clock hasn't moved, so the coordinator keeps resending
+	time.Sleep(200 * time.Millisecond)
+	if outcome := resolved(); outcome != "" {
+		t.Fatalf("expected the coordinator to still be resending PreCommit, but it answers %q", outcome)
+	}
+
+	clock.Advance(phaseTimeout)
+	for start := time.Now(); resolved() != PhaseCommitted; time.Sleep(5 * time.Millisecond) {
+		if time.Since(start) > waitTimeout {
+			t.Fatalf("expected the coordinator to give up on server 1 and answer from the log within %v", waitTimeout)
+		}
+	}
+	select {
+	case m := <-respChan:
+		t.Fatalf("expected nothing reported for a transaction left to resolution, got %+v", m)
+	default:
+	}
+	for i, sv := range servers {
+		if state, _ := sv.transactionState(0); state == stateAborted {
+			t.Fatalf("expected server %d not to abort a logged commit", i)
+		}
+	}
+}
+
+// Logs decisions to a Persister, again and then the other way, and restarts the coordinator
+// from a log holding duplicates and a conflict
+// A repeated decision should add nothing, a conflicting one should stop the coordinator,
+// and a restart should keep each transaction's first outcome, compacted, and append after it
+func TestDurabilityDecisionLog(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ps := MakePersister()
+	co := makeLoggingCoordinator(nil, make(chan ResponseMsg), realClock{}, phaseTimeout, stdLogger("coordinator"), ps, nil)
+	if !co.logDecision(ctx, 0, PhaseCommitted) {
+		t.Fatalf("expected the commit to be logged")
+	}
+	size := ps.ServerStateSize()
+	if !co.logDecision(ctx, 0, PhaseCommitted) || ps.ServerStateSize() != size {
+		t.Fatalf("expected a repeated commit to log nothing, the log grew from %d to %d bytes", size, ps.ServerStateSize())
+	}
+	if co.logDecision(ctx, 0, PhaseAborted) || !co.killed() {
+		t.Fatalf("expected aborting a logged commit to stop the coordinator")
+	}
+
+	fw := newFrameWriter()
+	for _, record := range []decisionRecord{{1, PhaseCommitted}, {2, PhaseAborted}, {1, PhaseCommitted}, {1, PhaseAborted}} {
+		fw.encode(record)
+	}
+	ps = MakePersister()
+	ps.Save(fw.bytes())
+	size = ps.ServerStateSize()
+	co = makeLoggingCoordinator(nil, make(chan ResponseMsg), realClock{}, phaseTimeout, stdLogger("coordinator"), ps, nil)
+	defer co.Kill()
+	if ps.ServerStateSize() >= size {
+		t.Fatalf("expected the restart to compact the log, still %d bytes", ps.ServerStateSize())
+	}
+	co.logDecision(ctx, 3, PhaseCommitted)
+
+	co2 := makeLoggingCoordinator(nil, make(chan ResponseMsg), realClock{}, phaseTimeout, stdLogger("coordinator"), ps.Copy(), nil)
+	defer co2.Kill()
+	want := map[int]string{1: PhaseCommitted, 2: PhaseAborted, 3: PhaseCommitted}
+	co2.mu.Lock()
+	defer co2.mu.Unlock()
+	if !reflect.DeepEqual(co2.decided, want) {
+		t.Fatalf("expected the log to hold %v, got %v", want, co2.decided)
+	}
+}
@@ -0,0 +1,116 @@
+package commit
+
+//
+// why a transaction aborted, or why an operation was refused, with
+// where it happened, so a client doesn't have to find out from the
+// interleaved logs:
+//
+//   m := <-respChan
+//   var te *TxnError
+//   if errors.As(m.Err(), &te) && errors.Is(te, ErrNoSuchKey) {
+//       fmt.Printf("server %d has no key %q\n", te.Participant, te.Key)
+//   }
+//
+// an aborted transaction's ResponseMsg carries the first reason the
+// Coordinator found to abort, and Decision events and the Gateway's
+// status replies carry the same. Server.Get() and Server.Set()
+// return one when they refuse an operation.
+//
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type TxnError struct {
+	Tid         int
+	Phase       string // the phase it happened in, e.g. Prepare or Recovery
+	Participant int    // the server it happened at, or -1
+	Key         string // the key it's about, or ""
+	Err         error  // what happened: one of the errors below, or a transport's
+}
+
+var (
+	ErrVotedNo              = errors.New("voted No")
+	ErrNoSuchKey            = errors.New("no such key")
+	ErrPhaseTimeout         = errors.New("no reply before the phase timed out")
+	ErrNoAck                = errors.New("PreCommit not acknowledged")
+	ErrServerAborted        = errors.New("already aborted")
+	ErrAbortedBeforeRestart = errors.New("aborted before the coordinator restarted")
+	ErrTooLate              = errors.New("the transaction is past its operations")
+	ErrClientAbort          = errors.New("aborted by the client")
+	ErrKeyMoved             = errors.New("the key moved to another server")
+)
+
+func (e *TxnError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "transaction %d", e.Tid)
+	if e.Phase != "" {
+		fmt.Fprintf(&b, " in %s", e.Phase)
+	}
+	if e.Participant >= 0 {
+		fmt.Fprintf(&b, ", server %d", e.Participant)
+	}
+	if e.Key != "" {
+		fmt.Fprintf(&b, ", key %q", e.Key)
+	}
+	fmt.Fprintf(&b, ": %v", e.Err)
+	return b.String()
+}
+
+func (e *TxnError) Unwrap() error {
+	return e.Err
+}
+
+// as JSON, with Err as its message.
+func (e *TxnError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Tid         int    `json:"tid"`
+		Phase       string `json:"phase,omitempty"`
+		Participant int    `json:"participant"`
+		Key         string `json:"key,omitempty"`
+		Error       string `json:"error"`
+	}{e.Tid, e.Phase, e.Participant, e.Key, e.Err.Error()})
+}
+
+// why server's Prepare reply for tid was No.
+func voteError(tid int, server int, reply *PrepareReply) *TxnError {
+	e := &TxnError{Tid: tid, Phase: PhasePrepare, Participant: server, Key: reply.NoKey, Err: ErrVotedNo}
+	if reply.TooLarge {
+		e.Err = fmt.Errorf("%w: the Commit reply", ErrMessageTooLarge)
+	} else if reply.NoKey != "" {
+		e.Err = ErrNoSuchKey
+	}
+	return e
+}
+
+// why a phase gave up on server, whose last call failed with err.
+func phaseError(tid int, phase string, server int, err error) *TxnError {
+	if !errors.Is(err, ErrMessageTooLarge) {
+		err = fmt.Errorf("%w, last try: %v", ErrPhaseTimeout, err)
+	}
+	return &TxnError{Tid: tid, Phase: phase, Participant: server, Err: err}
+}
+
+// the outcome and read values of a transaction, and why it aborted.
+func (m ResponseMsg) Tid() int {
+	return m.tid
+}
+
+func (m ResponseMsg) Committed() bool {
+	return m.committed
+}
+
+func (m ResponseMsg) ReadValues() map[string]interface{} {
+	return m.readValues
+}
+
+// a *TxnError if the transaction aborted, nil if it committed.
+func (m ResponseMsg) Err() error {
+	if m.err == nil {
+		return nil // not a nil *TxnError
+	}
+	return m.err
+}
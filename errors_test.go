@@ -0,0 +1,72 @@
+package commit
+
+import (
+	"3PhaseCommit/labrpc"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Runs one transaction that commits and one that reads a key server 1 doesn't have, then tries
+// to add an operation to the aborted one
+// The abort should say which phase, server and key caused it, the commit should carry no error,
+// and the late Set should be refused with ErrTooLate
+func TestTxnErrors(t *testing.T) {
+	t.Parallel()
+
+	net := labrpc.MakeNetwork()
+	defer net.Cleanup()
+	tr := makeLabrpcTransport(net)
+	servers := []*Server{
+		MakeServer([]string{"x"}, MakePersister()),
+		MakeServer([]string{"y"}, MakePersister()),
+	}
+	ends := make([]PeerClient, len(servers))
+	for i, sv := range servers {
+		defer sv.Kill()
+		name := fmt.Sprintf("server%d", i)
+		tr.Serve(name, sv)
+		ends[i], _ = tr.Dial(name)
+	}
+	respChan := make(chan ResponseMsg)
+	co := MakeCoordinator(ends, respChan)
+	defer co.Kill()
+	wait := func(tid int) ResponseMsg {
+		select {
+		case m := <-respChan:
+			return m
+		case <-time.After(waitTimeout):
+			t.Fatalf("Transaction %d got no response within %v", tid, waitTimeout)
+		}
+		return ResponseMsg{}
+	}
+
+	if err := servers[0].Set(0, "x", 1); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	co.FinishTransaction(0)
+	if m := wait(0); !m.Committed() || m.Err() != nil {
+		t.Fatalf("expected transaction 0 to commit without an error, got %+v", m)
+	}
+
+	servers[0].Get(1, "x")
+	servers[1].Get(1, "z")
+	co.FinishTransaction(1)
+	m := wait(1)
+	if m.Committed() {
+		t.Fatalf("expected transaction 1 to abort")
+	}
+	var te *TxnError
+	if !errors.As(m.Err(), &te) || !errors.Is(m.Err(), ErrNoSuchKey) {
+		t.Fatalf("expected a TxnError for a missing key, got %v", m.Err())
+	}
+	if te.Tid != 1 || te.Phase != PhasePrepare || te.Participant != 1 || te.Key != "z" {
+		t.Fatalf("expected transaction 1 in Prepare, server 1, key z, got %+v", te)
+	}
+
+	err := servers[1].Set(1, "y", 2)
+	if !errors.Is(err, ErrTooLate) || !errors.As(err, &te) || te.Key != "y" {
+		t.Fatalf("expected ErrTooLate for key y, got %v", err)
+	}
+}
@@ -0,0 +1,216 @@
+package commit
+
+//
+// typed events for each step of the protocol, from the Coordinator
+// and from each Server, for observers that want to follow along:
+//
+//   stop := co.Subscribe(func(e Event) {
+//       switch e := e.(type) {
+//       case VoteReceived:
+//           fmt.Printf("transaction %d: server %d voted %v\n", e.Tid, e.Server, e.Vote)
+//       case Decision:
+//           fmt.Printf("transaction %d: %s\n", e.Tid, e.Outcome)
+//       }
+//   })
+//   defer stop()
+//
+// the Coordinator publishes PhaseChanged, VoteReceived,
+// PreCommitAcked, SlowTransaction and Decision; a Server publishes
+// LockAcquired, TxnPrepared, LockReleased and Decision. the audit
+// log, the metrics' counters and histogram, the gateway's WebSocket
+// and History are all subscribers.
+//
+// events are delivered to each subscriber in the order they're
+// published, synchronously, on the goroutine that published them,
+// so a slow subscriber slows the protocol down. PhaseChanged and
+// LockReleased may come with the Coordinator's or Server's lock
+// held, so a subscriber mustn't block on them or call back into
+// it; the others come without it.
+//
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+type Event interface {
+	header() EventHeader
+}
+
+// what every event has.
+type EventHeader struct {
+	Tid   int
+	Phase string    // the transaction's phase, as the publisher saw it
+	Time  time.Time // on the Coordinator's clock, for its events
+}
+
+func (h EventHeader) header() EventHeader {
+	return h
+}
+
+// the Coordinator moved a transaction to Phase, after After in From;
+// From is "" for its first phase.
+type PhaseChanged struct {
+	EventHeader
+	From  string
+	After time.Duration
+}
+
+// the Coordinator got Server's answer to Prepare.
+type VoteReceived struct {
+	EventHeader
+	Server   int
+	Relevant bool // the server has operations for the transaction
+	Vote     bool
+}
+
+// the Coordinator got Server's acknowledgement of PreCommit.
+type PreCommitAcked struct {
+	EventHeader
+	Server int
+}
+
+// a Server voted Yes, holding the locks on Keys.
+type TxnPrepared struct {
+	EventHeader
+	Keys []string
+}
+
+// the Coordinator reported a transaction's outcome to the client, or
+// a Server committed or aborted it.
+type Decision struct {
+	EventHeader
+	Outcome      string                   // PhaseCommitted or PhaseAborted
+	Trace        string                   // Coordinator only
+	Participants []int                    // Coordinator only: the servers with operations
+	Started      time.Time                // Coordinator only: when it started or recovered the transaction
+	Phases       map[string]time.Duration // Coordinator only: time spent in each phase, up to now
+	InPhase      time.Duration            // Coordinator only: time spent in Outcome's phase this time
+	Err          *TxnError                // Coordinator only: why it aborted
+	Reads        []string                 // Server only: the keys read
+	Writes       []string                 // Server only: the keys set
+	Values       map[string]interface{}   // Server only: what a commit set each key to
+	Versions     map[string]int           // Server only: each key's version after a commit
+	ReadValues   map[string]interface{}   // Server only: what a commit read
+}
+
+// a Server's Prepare took the lock on Key, after waiting Waited for
+// it if it was held.
+type LockAcquired struct {
+	EventHeader
+	Key    string
+	Write  bool
+	Waited time.Duration
+}
+
+// a Server released a transaction's lock on Key.
+type LockReleased struct {
+	EventHeader
+	Key   string
+	Write bool
+}
+
+// a Coordinator's or Server's subscribers.
+type eventBus struct {
+	mu   sync.Mutex
+	next int
+	subs map[int]func(Event)
+	ids  []int // subscription order
+}
+
+func (b *eventBus) subscribe(f func(Event)) func() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.subs == nil {
+		b.subs = make(map[int]func(Event))
+	}
+	id := b.next
+	b.next++
+	b.subs[id] = f
+	b.ids = append(b.ids, id)
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		delete(b.subs, id)
+	}
+}
+
+func (b *eventBus) publish(e Event) {
+	b.mu.Lock()
+	subs := make([]func(Event), 0, len(b.subs))
+	ids := b.ids[:0]
+	for _, id := range b.ids {
+		if f, ok := b.subs[id]; ok {
+			subs = append(subs, f)
+			ids = append(ids, id) // forget unsubscribed ones
+		}
+	}
+	b.ids = ids
+	b.mu.Unlock()
+
+	for _, f := range subs {
+		f(e)
+	}
+}
+
+// call f with each of the Coordinator's events until the returned
+// function is called.
+func (co *Coordinator) Subscribe(f func(Event)) (unsubscribe func()) {
+	return co.events.subscribe(f)
+}
+
+// call f with each of the Server's events until the returned
+// function is called.
+func (sv *Server) Subscribe(f func(Event)) (unsubscribe func()) {
+	return sv.events.subscribe(f)
+}
+
+func (co *Coordinator) publish(e Event) {
+	co.events.publish(e)
+}
+
+func (sv *Server) publish(e Event) {
+	sv.events.publish(e)
+}
+
+// the header of an event about ctx's transaction and phase.
+func (co *Coordinator) eventHeader(ctx context.Context) EventHeader {
+	tid, phase := txnOf(ctx)
+	return EventHeader{Tid: tid, Phase: phase, Time: co.clock.Now()}
+}
+
+func serverEventHeader(ctx context.Context) EventHeader {
+	tid, phase := txnOf(ctx)
+	return EventHeader{Tid: tid, Phase: phase, Time: time.Now()}
+}
+
+// the Server's Decision about ctx's transaction; sv.mu must be held.
+func (sv *Server) decisionLocked(ctx context.Context, outcome string) *Decision {
+	tid, _ := txnOf(ctx)
+	reads := make(map[string]bool)
+	writes := make(map[string]bool)
+	for _, op := range sv.operations[tid] {
+		if op.IsGet {
+			reads[op.Key] = true
+		} else {
+			writes[op.Key] = true
+		}
+	}
+	return &Decision{EventHeader: serverEventHeader(ctx), Outcome: outcome, Reads: sortedKeys(reads), Writes: sortedKeys(writes)}
+}
+
+func sortedKeys(set map[string]bool) []string {
+	if len(set) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,150 @@
+package commit
+
+import (
+	"3PhaseCommit/labrpc"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Subscribes to a coordinator's and two servers' events while one transaction commits and
+// another, which sets a key server 0 doesn't have, aborts
+// Each should see its events in protocol order, and none once it has unsubscribed
+func TestEvents(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	seen := make(map[string][]string) // subscriber : events, summed up
+	record := func(who string) func(Event) {
+		return func(e Event) {
+			var s string
+			switch e := e.(type) {
+			case PhaseChanged:
+				s = fmt.Sprintf("%d phase %s from %q", e.Tid, e.Phase, e.From)
+			case VoteReceived:
+				s = fmt.Sprintf("%d vote %d %v %v", e.Tid, e.Server, e.Relevant, e.Vote)
+			case PreCommitAcked:
+				s = fmt.Sprintf("%d ack %d", e.Tid, e.Server)
+			case TxnPrepared:
+				s = fmt.Sprintf("%d prepared %v", e.Tid, e.Keys)
+			case Decision:
+				s = fmt.Sprintf("%d %s %v %v %v", e.Tid, e.Outcome, e.Participants, e.Reads, e.Writes)
+			case LockAcquired:
+				s = fmt.Sprintf("%d lock %s %v", e.Tid, e.Key, e.Write)
+			case LockReleased:
+				s = fmt.Sprintf("%d unlock %s %v", e.Tid, e.Key, e.Write)
+			default:
+				s = fmt.Sprintf("%T", e)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			seen[who] = append(seen[who], s)
+		}
+	}
+
+	net := labrpc.MakeNetwork()
+	defer net.Cleanup()
+	tr := makeLabrpcTransport(net)
+	var peers []PeerClient
+	var servers []*Server
+	for i, keys := range [][]string{{"x", "y"}, {"z"}} {
+		sv := MakeServer(keys, MakePersister())
+		defer sv.Kill()
+		name := []string{"server0", "server1"}[i]
+		sv.Subscribe(record(name))
+		tr.Serve(name, sv)
+		end, _ := tr.Dial(name)
+		peers = append(peers, end)
+		servers = append(servers, sv)
+	}
+	servers[0].Get(0, "x")
+	servers[0].Set(0, "y", 1)
+	servers[1].Set(0, "z", 2)
+	servers[0].Set(1, "w", 3) // not a key, so server 0 votes No
+	respChan := make(chan ResponseMsg)
+	co := MakeCoordinator(peers, respChan)
+	defer co.Kill()
+	co.Subscribe(record("coordinator"))
+
+	for tid, committed := range []bool{true, false} {
+		co.FinishTransaction(tid)
+		select {
+		case m := <-respChan:
+			if m.committed != committed {
+				t.Fatalf("expected transaction %d to commit: %v, got %+v", tid, committed, m)
+			}
+		case <-time.After(waitTimeout):
+			t.Fatalf("Transaction %d got no response within %v", tid, waitTimeout)
+		}
+	}
+
+	// the coordinator publishes its decision after reporting it, and a
+	// server's Abort may still be running
+	expected := map[string][]string{
+		"coordinator": {
+			`0 phase Prepare from ""`,
+			"0 vote 0 true true",
+			"0 vote 1 true true",
+			`0 phase PreCommit from "Prepare"`,
+			"0 ack 0", "0 ack 1", // in either order
+			`0 phase Committed from "PreCommit"`,
+			"0 Committed [0 1] [] []",
+			`1 phase Prepare from ""`,
+			"1 vote 0 true false",
+			"1 vote 1 false false",
+			`1 phase Aborted from "Prepare"`,
+			"1 Aborted [0] [] []",
+		},
+		"server0": {
+			"0 lock x false",
+			"0 lock y true",
+			"0 prepared [x y]",
+			"0 unlock x false",
+			"0 unlock y true",
+			"0 Committed [] [x] [y]",
+			"1 Aborted [] [] [w]",
+		},
+		"server1": {
+			"0 lock z true",
+			"0 prepared [z]",
+			"0 unlock z true",
+			"0 Committed [] [] [z]",
+		},
+	}
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		mu.Lock()
+		done := len(seen["coordinator"]) >= len(expected["coordinator"]) && len(seen["server0"]) >= len(expected["server0"])
+		mu.Unlock()
+		if done {
+			break
+		}
+		if time.Since(start) > waitTimeout {
+			t.Fatalf("events still missing after %v", waitTimeout)
+		}
+	}
+
+	mu.Lock()
+	got := seen["coordinator"]
+	if len(got) == len(expected["coordinator"]) && got[5] < got[4] {
+		got[4], got[5] = got[5], got[4]
+	}
+	for who, want := range expected {
+		if !reflect.DeepEqual(seen[who], want) {
+			t.Fatalf("%s's events:\n%q\nexpected:\n%q", who, seen[who], want)
+		}
+	}
+	mu.Unlock()
+
+	// an unsubscribed observer hears nothing more
+	n := 0
+	stop := co.Subscribe(func(Event) { n++ })
+	stop()
+	servers[1].Set(2, "z", 3)
+	co.FinishTransaction(2)
+	<-respChan
+	if n != 0 {
+		t.Fatalf("an unsubscribed observer got %d events", n)
+	}
+}
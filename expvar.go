@@ -0,0 +1,112 @@
+package commit
+
+//
+// counters for programs that embed a Coordinator and already serve
+// expvar's /debug/vars, with nothing more to import:
+//
+//   co.PublishExpvar("3pc")
+//
+// publishes one variable, named by the prefix, whose value is
+//
+//   {"recovery_runs": 1, "rpcs_sent": 42, "transactions_aborted": 2,
+//    "transactions_committed": 12, "transactions_started": 14}
+//
+// started counts the transactions FinishTransaction() began, not
+// those recovery took over; committed and aborted count outcomes
+// reported to the client, and rpcs_sent every RPC, resends and
+// recovery's Queries included. a Coordinator counts from the moment
+// it's made, so its first recovery is counted too. a restarted
+// Coordinator published under the same prefix adds to its
+// predecessors' counts rather than starting again from zero.
+//
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// what a Coordinator has done since it was made.
+type coordinatorCounts struct {
+	started    atomic.Int64
+	committed  atomic.Int64
+	aborted    atomic.Int64
+	rpcs       atomic.Int64
+	recoveries atomic.Int64
+
+	// not published; see rpcstats.go
+	timeouts         atomic.Int64
+	disconnected     atomic.Int64
+	tooLarge         atomic.Int64
+	rejectedVotes    atomic.Int64
+	duplicateReplies atomic.Int64
+}
+
+func (c *coordinatorCounts) decided(outcome string) {
+	if outcome == PhaseCommitted {
+		c.committed.Add(1)
+	} else {
+		c.aborted.Add(1)
+	}
+}
+
+// the counts of every Coordinator published under one prefix.
+type expvarCounts struct {
+	mu     sync.Mutex
+	counts []*coordinatorCounts
+}
+
+var (
+	expvarMu     sync.Mutex
+	expvarByName = make(map[string]*expvarCounts) // prefix : its Coordinators
+)
+
+// publish the Coordinator's counters as the expvar named prefix. it
+// fails if something else already published that name.
+func (co *Coordinator) PublishExpvar(prefix string) error {
+	expvarMu.Lock()
+	defer expvarMu.Unlock()
+
+	ec, exists := expvarByName[prefix]
+	if !exists {
+		if expvar.Get(prefix) != nil {
+			return fmt.Errorf("expvar %q is already published", prefix)
+		}
+		ec = &expvarCounts{}
+		expvar.Publish(prefix, expvar.Func(ec.value))
+		expvarByName[prefix] = ec
+	}
+
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	for _, c := range ec.counts {
+		if c == co.counts {
+			return nil
+		}
+	}
+	ec.counts = append(ec.counts, co.counts)
+	return nil
+}
+
+func (ec *expvarCounts) value() interface{} {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	var started, committed, aborted, rpcs, recoveries int64
+	for _, c := range ec.counts {
+		started += c.started.Load()
+		committed += c.committed.Load()
+		aborted += c.aborted.Load()
+		rpcs += c.rpcs.Load()
+		recoveries += c.recoveries.Load()
+	}
+	return map[string]int64{
+		"transactions_started":   started,
+		"transactions_committed": committed,
+		"transactions_aborted":   aborted,
+		"rpcs_sent":              rpcs,
+		"recovery_runs":          recoveries,
+	}
+}
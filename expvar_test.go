@@ -0,0 +1,77 @@
+package commit
+
+import (
+	"3PhaseCommit/labrpc"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Commits one transaction and aborts another through a coordinator published under an expvar
+// prefix, then restarts the coordinator and publishes the new one under the same prefix
+// The counters should add up across both coordinators, and a name taken by another variable
+// should be refused
+func TestExpvar(t *testing.T) {
+	t.Parallel()
+
+	prefix := fmt.Sprintf("test_expvar_%d", time.Now().UnixNano()) // expvars outlive a test run with -count
+	net := labrpc.MakeNetwork()
+	defer net.Cleanup()
+	tr := makeLabrpcTransport(net)
+	sv := MakeServer([]string{"x"}, MakePersister())
+	defer sv.Kill()
+	tr.Serve("server0", sv)
+	end, _ := tr.Dial("server0")
+	respChan := make(chan ResponseMsg)
+	co := MakeCoordinator([]PeerClient{end}, respChan)
+	if err := co.PublishExpvar(prefix); err != nil {
+		t.Fatalf("PublishExpvar: %v", err)
+	}
+
+	sv.Set(0, "x", 1)
+	sv.Set(1, "w", 2) // not a key, so the server votes No
+	for tid, committed := range []bool{true, false} {
+		co.FinishTransaction(tid)
+		select {
+		case m := <-respChan:
+			if m.committed != committed {
+				t.Fatalf("expected transaction %d to commit: %v, got %+v", tid, committed, m)
+			}
+		case <-time.After(waitTimeout):
+			t.Fatalf("Transaction %d got no response within %v", tid, waitTimeout)
+		}
+	}
+	co.Kill()
+	co = MakeCoordinator([]PeerClient{end}, respChan)
+	defer co.Kill()
+	if err := co.PublishExpvar(prefix); err != nil {
+		t.Fatalf("PublishExpvar after a restart: %v", err)
+	}
+
+	var counts map[string]int64
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if err := json.Unmarshal([]byte(expvar.Get(prefix).String()), &counts); err != nil {
+			t.Fatalf("expvar %s isn't a JSON object: %v", prefix, err)
+		}
+		if counts["recovery_runs"] == 2 {
+			break
+		}
+		if time.Since(start) > waitTimeout {
+			t.Fatalf("expected both coordinators' recoveries to be counted, got %v", counts)
+		}
+	}
+	if counts["transactions_started"] != 2 || counts["transactions_committed"] != 1 || counts["transactions_aborted"] != 1 {
+		t.Fatalf("expected 2 transactions started, 1 committed and 1 aborted, got %v", counts)
+	}
+	// a Prepare, PreCommit and Commit, a Prepare and an Abort, and a Query at each start
+	if counts["rpcs_sent"] < 7 {
+		t.Fatalf("expected at least 7 RPCs sent, got %v", counts)
+	}
+
+	expvar.NewInt(prefix + "_taken")
+	if err := co.PublishExpvar(prefix + "_taken"); err == nil {
+		t.Fatalf("expected publishing over another variable to fail")
+	}
+}
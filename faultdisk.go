@@ -0,0 +1,376 @@
+package commit
+
+//
+// a simulated disk for the tester, to check a Persister kept on
+// disk (disk.go) against the ways real storage fails:
+//
+//   fd := makeFaultDisk(seed)
+//   ps, _ := openPersister(fd, "server0", DiskOptions{Fsync: true})
+//   fd.failNext(writeTorn, nil)
+//   ... a write stops partway, and the disk loses power
+//   ps, _ = openPersister(fd.powerLoss(), "server0", DiskOptions{Fsync: true})
+//
+// the disk keeps two versions of everything: what reads see, and
+// what's durable, which is all that's left after the power goes. a
+// file's writes are durable once it's fsynced, and a new, renamed or
+// removed name once its directory is. powerLoss() returns the disk
+// as it comes back, with only what was durable; the old disk fails
+// every call from then on, as if its machine were off.
+//
+// failNext() makes the next write go wrong:
+//
+//   - writeShort writes the first half and returns io.ErrShortWrite,
+//     as a full disk does; the disk carries on.
+//   - writeTorn writes a random prefix and cuts the power, as if it
+//     went out mid-write.
+//   - writeReordered writes a random subset of the write's 512-byte
+//     sectors, never all of them, and cuts the power, as when a disk
+//     flushes its cache in its own order and the power goes out
+//     partway.
+//
+// a write cut short by the power failing finds the cache otherwise
+// flushed: the writes and renames before it are durable, as is what
+// it wrote, and the power is off until powerLoss(). that, and a
+// powerLoss() that keeps only what was synced, are the two extremes
+// of what a crash can leave behind.
+//
+// directories are only names: MkdirAll() needs no syncing, and
+// files are kept by their full path.
+//
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const sectorSize = 512
+
+type writeFault int
+
+const (
+	writeOK        writeFault = iota
+	writeShort                // the write stops halfway and fails
+	writeTorn                 // the power goes out partway through the write
+	writeReordered            // the power goes out with some of the write's sectors written
+)
+
+func (f writeFault) String() string {
+	switch f {
+	case writeOK:
+		return "ok"
+	case writeShort:
+		return "short write"
+	case writeTorn:
+		return "torn write"
+	case writeReordered:
+		return "reordered sectors"
+	}
+	return "unknown"
+}
+
+// returned by every call to a disk whose power is off.
+var errPowerOff = errors.New("the disk has lost power")
+
+type faultDisk struct {
+	mu      sync.Mutex
+	rand    *rand.Rand
+	files   map[string]*faultInode // by path, as reads see them
+	durable map[string]*faultInode // by path, as power loss leaves them
+	dirs    map[string]bool
+	next    writeFault
+	hit     func() // called when the next write goes wrong, with the writer's locks held
+	off     bool
+}
+
+// a file's contents, under whatever names it has.
+type faultInode struct {
+	data    []byte // what reads see
+	durable []byte // what's left after power loss
+}
+
+// an open file.
+type faultFile struct {
+	disk  *faultDisk
+	name  string
+	inode *faultInode
+	pos   int64 // where Write() writes
+}
+
+func makeFaultDisk(seed int64) *faultDisk {
+	return &faultDisk{
+		rand:    rand.New(rand.NewSource(seed)),
+		files:   make(map[string]*faultInode),
+		durable: make(map[string]*faultInode),
+		dirs:    make(map[string]bool),
+	}
+}
+
+// make the next write go wrong as f says. hit is called, with the
+// writer's locks held, when it does.
+func (fd *faultDisk) failNext(f writeFault, hit func()) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	fd.next = f
+	fd.hit = hit
+}
+
+// whether a write has cut the power.
+func (fd *faultDisk) powerOff() bool {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	return fd.off
+}
+
+// the disk as it comes back after the power goes out now, with only
+// what was durable; this one stays off.
+func (fd *faultDisk) powerLoss() *faultDisk {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+
+	fd.off = true
+	nd := makeFaultDisk(0)
+	nd.rand = fd.rand
+	for path, inode := range fd.durable {
+		nd.files[path] = &faultInode{data: clone(inode.durable), durable: clone(inode.durable)}
+		nd.durable[path] = nd.files[path]
+	}
+	for dir := range fd.dirs {
+		nd.dirs[dir] = true
+	}
+	return nd
+}
+
+// everything written so far reaches the disk, and the power goes
+// out; fd.mu must be held.
+func (fd *faultDisk) cutPowerLocked() {
+	for _, inode := range fd.files {
+		inode.durable = clone(inode.data)
+	}
+	fd.durable = make(map[string]*faultInode)
+	for path, inode := range fd.files {
+		fd.durable[path] = inode
+	}
+	fd.off = true
+}
+
+func (fd *faultDisk) MkdirAll(dir string) error {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+
+	if fd.off {
+		return errPowerOff
+	}
+	for ; dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+		fd.dirs[dir] = true
+	}
+	return nil
+}
+
+func (fd *faultDisk) OpenFile(path string, flag int) (diskFile, error) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+
+	if fd.off {
+		return nil, errPowerOff
+	}
+	inode, exists := fd.files[path]
+	if !exists {
+		if flag&os.O_CREATE == 0 || !fd.dirs[filepath.Dir(path)] {
+			return nil, &os.PathError{Op: "open", Path: path, Err: fs.ErrNotExist}
+		}
+		inode = &faultInode{}
+		fd.files[path] = inode
+	}
+	if flag&os.O_TRUNC != 0 {
+		inode.data = nil
+	}
+	return &faultFile{disk: fd, name: path, inode: inode}, nil
+}
+
+func (fd *faultDisk) ReadFile(path string) ([]byte, error) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+
+	if fd.off {
+		return nil, errPowerOff
+	}
+	inode, exists := fd.files[path]
+	if !exists {
+		return nil, &os.PathError{Op: "open", Path: path, Err: fs.ErrNotExist}
+	}
+	return clone(inode.data), nil
+}
+
+func (fd *faultDisk) ReadDir(dir string) ([]string, error) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+
+	if fd.off {
+		return nil, errPowerOff
+	}
+	if !fd.dirs[dir] {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: fs.ErrNotExist}
+	}
+	var names []string
+	for path := range fd.files {
+		if filepath.Dir(path) == dir {
+			names = append(names, filepath.Base(path))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (fd *faultDisk) Rename(from string, to string) error {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+
+	if fd.off {
+		return errPowerOff
+	}
+	inode, exists := fd.files[from]
+	if !exists {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: fs.ErrNotExist}
+	}
+	delete(fd.files, from)
+	fd.files[to] = inode
+	return nil
+}
+
+func (fd *faultDisk) Remove(path string) error {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+
+	if fd.off {
+		return errPowerOff
+	}
+	if _, exists := fd.files[path]; !exists {
+		return &os.PathError{Op: "remove", Path: path, Err: fs.ErrNotExist}
+	}
+	delete(fd.files, path)
+	return nil
+}
+
+// make the names in dir durable as they are now.
+func (fd *faultDisk) SyncDir(dir string) error {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+
+	if fd.off {
+		return errPowerOff
+	}
+	for path := range fd.durable {
+		if filepath.Dir(path) == dir {
+			delete(fd.durable, path)
+		}
+	}
+	for path, inode := range fd.files {
+		if filepath.Dir(path) == dir {
+			fd.durable[path] = inode
+		}
+	}
+	return nil
+}
+
+func (f *faultFile) Name() string {
+	return f.name
+}
+
+func (f *faultFile) Write(b []byte) (int, error) {
+	n, err := f.WriteAt(b, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *faultFile) WriteAt(b []byte, off int64) (int, error) {
+	fd := f.disk
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+
+	if fd.off {
+		return 0, errPowerOff
+	}
+	fault := fd.next
+	fd.next = writeOK
+	if fault != writeOK && fd.hit != nil {
+		defer fd.hit()
+	}
+	switch fault {
+	case writeShort:
+		n := len(b) / 2
+		f.inode.writeAt(b[:n], off)
+		return n, io.ErrShortWrite
+	case writeTorn:
+		n := 0
+		if len(b) > 0 {
+			n = fd.rand.Intn(len(b))
+		}
+		f.inode.writeAt(b[:n], off)
+		fd.cutPowerLocked()
+		return n, errPowerOff
+	case writeReordered:
+		// the sectors the write touches, by their offset in the file
+		var sectors []int64
+		for s := off / sectorSize * sectorSize; s < off+int64(len(b)); s += sectorSize {
+			sectors = append(sectors, s)
+		}
+		skip := fd.rand.Intn(len(sectors)) // one that's never written
+		for i, s := range sectors {
+			if i == skip || fd.rand.Intn(2) == 0 {
+				continue
+			}
+			from, to := max(s, off), min(s+sectorSize, off+int64(len(b)))
+			f.inode.writeAt(b[from-off:to-off], from)
+		}
+		fd.cutPowerLocked()
+		return 0, errPowerOff
+	}
+	f.inode.writeAt(b, off)
+	return len(b), nil
+}
+
+// write b at off, zero-filling any gap past the end.
+func (inode *faultInode) writeAt(b []byte, off int64) {
+	if end := int(off) + len(b); end > len(inode.data) {
+		inode.data = append(inode.data, make([]byte, end-len(inode.data))...)
+	}
+	copy(inode.data[off:], b)
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	fd := f.disk
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+
+	if fd.off {
+		return errPowerOff
+	}
+	if int(size) <= len(f.inode.data) {
+		f.inode.data = f.inode.data[:size]
+	} else {
+		f.inode.writeAt(nil, size)
+	}
+	return nil
+}
+
+func (f *faultFile) Sync() error {
+	fd := f.disk
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+
+	if fd.off {
+		return errPowerOff
+	}
+	f.inode.durable = clone(f.inode.data)
+	return nil
+}
+
+func (f *faultFile) Close() error {
+	return nil
+}
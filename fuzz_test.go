@@ -0,0 +1,217 @@
+package commit
+
+//
+// fuzz tests for the server handlers and the coordinator.
+//
+// go test -run FuzzServerHandlers        -- just the seed inputs
+// go test -fuzz FuzzServerHandlers       -- search for new ones
+//
+// an input is a list of two-byte commands: the first byte picks
+// the call, the second its transaction, key and value.
+//
+
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+var fuzzKeys = []string{"a", "b", "unknown"}
+
+var fuzzValues = []interface{}{nil, 1, "one"}
+
+type fuzzCommand struct {
+	op    int
+	tid   int
+	key   string
+	value interface{}
+}
+
+func decodeFuzzCommands(data []byte, nops int) []fuzzCommand {
+	cmds := make([]fuzzCommand, 0)
+	for i := 0; i+1 < len(data) && len(cmds) < 32; i += 2 {
+		arg := int(data[i+1])
+		cmds = append(cmds, fuzzCommand{
+			op:    int(data[i]) % nops,
+			tid:   arg % 4,
+			key:   fuzzKeys[(arg/4)%len(fuzzKeys)],
+			value: fuzzValues[(arg/12)%len(fuzzValues)],
+		})
+	}
+	return cmds
+}
+
+// every handler logs, which slows fuzzing to a crawl; seed
+// inputs run by a plain go test still log as usual
+func quietWhileFuzzing(f *testing.F) {
+	if fuzz := flag.Lookup("test.fuzz"); fuzz != nil && fuzz.Value.String() != "" {
+		log.SetOutput(io.Discard)
+		f.Cleanup(func() { log.SetOutput(os.Stderr) })
+	}
+}
+
+// Calls a server's handlers in any order: phases before operations,
+// repeated or skipped phases, unknown transactions and keys, nil
+// values, and restarts from the persisted state
+// No handler may panic or unlock a lock it doesn't hold, and once every
+// transaction is aborted all handlers must return and all locks be free
+func FuzzServerHandlers(f *testing.F) {
+	const (
+		opGet = iota
+		opSet
+		opPrepare
+		opPreCommit
+		opCommit
+		opAbort
+		opQuery
+		opRestart
+		nops
+	)
+
+	f.Add([]byte{opSet, 0, opGet, 4, opPrepare, 0, opPreCommit, 0, opCommit, 0})
+	f.Add([]byte{opSet, 1, opPrepare, 1, opSet, 5, opPreCommit, 1, opCommit, 1})
+	f.Add([]byte{opCommit, 2, opPreCommit, 2, opSet, 2, opPrepare, 2, opAbort, 2, opAbort, 2})
+	f.Add([]byte{opSet, 0, opSet, 1, opPrepare, 0, opPrepare, 1, opAbort, 0, opQuery, 0})
+	f.Add([]byte{opGet, 0, opSet, 0, opPrepare, 0, opRestart, 0, opPreCommit, 0, opRestart, 0, opCommit, 0})
+	f.Add([]byte{opSet, 8, opPrepare, 8, opAbort, 8, opSet, 24, opPrepare, 0})
+
+	quietWhileFuzzing(f)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		keys := fuzzKeys[:2]
+		persister := MakePersister()
+		sv := MakeServer(keys, persister)
+		instances := []*Server{sv}
+		var prepares sync.WaitGroup
+
+		for _, cmd := range decodeFuzzCommands(data, nops) {
+			args := &RPCArgs{Tid: cmd.tid}
+			switch cmd.op {
+			case opGet:
+				sv.Get(cmd.tid, cmd.key)
+			case opSet:
+				sv.Set(cmd.tid, cmd.key, cmd.value)
+			case opPrepare:
+				// may wait for another transaction's locks
+				done := make(chan struct{})
+				prepares.Add(1)
+				go func(sv *Server) {
+					defer prepares.Done()
+					sv.Prepare(Metadata{}, args, &PrepareReply{})
+					close(done)
+				}(sv)
+				select {
+				case <-done:
+				case <-time.After(5 * time.Millisecond):
+				}
+			case opPreCommit:
+				sv.PreCommit(Metadata{}, args, &PreCommitReply{})
+			case opCommit:
+				sv.Commit(Metadata{}, args, &CommitReply{})
+			case opAbort:
+				sv.Abort(Metadata{}, args, &struct{}{})
+			case opQuery:
+				sv.Query(Metadata{}, struct{}{}, &QueryReply{})
+			case opRestart:
+				sv.Kill()
+				persister = persister.Copy()
+				sv = MakeServer(keys, persister)
+				instances = append(instances, sv)
+			}
+		}
+
+		// abort everything still undecided; killed incarnations
+		// released their locks in Kill()
+		for _, sv := range instances {
+			for tid := range 4 {
+				sv.Abort(Metadata{}, &RPCArgs{Tid: tid}, &struct{}{})
+			}
+		}
+
+		done := make(chan struct{})
+		go func() {
+			prepares.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Prepare never returned after every transaction was aborted")
+		}
+
+		for i, sv := range instances {
+			for key, item := range sv.store {
+				if !item.lock.TryLock() {
+					t.Fatalf("server incarnation %d still holds the lock on %s", i, key)
+				}
+				item.lock.Unlock()
+			}
+		}
+	})
+}
+
+// Drives the coordinator with operations, finishes and coordinator
+// restarts in any order, including finishing a transaction twice
+// or with no operations
+// Every finished transaction must get a response, and the history
+// must be serializable
+func FuzzCoordinator(f *testing.F) {
+	const (
+		opGet = iota
+		opSet
+		opFinish
+		opRestart
+		nops
+	)
+
+	f.Add([]byte{opSet, 0, opSet, 4, opFinish, 0, opGet, 1, opFinish, 1})
+	f.Add([]byte{opFinish, 2, opFinish, 2, opSet, 3, opGet, 7, opFinish, 3})
+	f.Add([]byte{opSet, 0, opSet, 1, opFinish, 0, opRestart, 0, opFinish, 1, opRestart, 0})
+	f.Add([]byte{opGet, 0, opSet, 0, opGet, 5, opSet, 1, opFinish, 1, opFinish, 0})
+
+	quietWhileFuzzing(f)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		cfg := make_config(t, [][]string{{"a"}, {"b"}}, false, false)
+		defer cfg.cleanup()
+
+		cfg.mu.Lock()
+		cfg.duplicates = true // a restarted coordinator may report a transaction again
+		cfg.mu.Unlock()
+
+		finished := make(map[int]bool)
+		for _, cmd := range decodeFuzzCommands(data, nops) {
+			// a client only sends operations before finishing;
+			// the tester has no server for the unknown key
+			if (cmd.op == opGet || cmd.op == opSet) && (finished[cmd.tid] || cmd.key == "unknown") {
+				continue
+			}
+			switch cmd.op {
+			case opGet:
+				cfg.sendGet(cmd.tid, cmd.key)
+			case opSet:
+				cfg.sendSet(cmd.tid, cmd.key, cmd.value)
+			case opFinish:
+				cfg.finishTransaction(cmd.tid)
+				finished[cmd.tid] = true
+			case opRestart:
+				cfg.mu.Lock()
+				cfg.restartCoordinatorLocked()
+				cfg.mu.Unlock()
+			}
+		}
+
+		deadline := time.Now().Add(10 * time.Second)
+		for tid := range finished {
+			if _, ok := cfg.waitTransactionRetrying(tid, 500*time.Millisecond, deadline); !ok {
+				t.Fatalf("no response for transaction %d", tid)
+			}
+		}
+
+		cfg.checkHistory()
+	})
+}
@@ -0,0 +1,455 @@
+package commit
+
+//
+// an HTTP/JSON gateway for running transactions from curl or
+// tools not written in Go, e.g. for demos and integration tests:
+//
+//   gw := MakeGateway(co, servers, respChan)
+//   http.ListenAndServe(":8080", gw)
+//
+// the gateway takes over respChan, and queues each operation on
+// the server that stores its key, as a Go client would:
+//
+//   POST /transactions               begin a transaction; replies {"tid": 0}
+//   POST /transactions/{tid}/get     queue a Get: {"key": "x"}
+//   POST /transactions/{tid}/set     queue a Set: {"key": "x", "value": 1}
+//   POST /transactions/{tid}/finish  run 3PC
+//   POST /transactions/{tid}/abort   abort a transaction that isn't finished
+//   GET  /transactions/{tid}         its status; ?wait=5s waits for the outcome
+//   GET  /servers                    each server's keys and transactions
+//   GET  /ws                         the same over a WebSocket; see websocket.go
+//   GET  /debug/3pc                  the protocol's live state; see debug.go
+//
+// values are JSON numbers, strings, booleans or null; whole numbers
+// become ints. errors come back as {"error": "..."} with a 4xx status,
+// and with "txn": the TxnError (errors.go) if the error is about a
+// transaction's key. an aborted transaction's status has the
+// TxnError that says why as "reason".
+//
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// what a gateway transaction's status says it is doing.
+const (
+	gatewayOpen      = "open"      // taking operations
+	gatewayFinishing = "finishing" // running 3PC
+	gatewayAborting  = "aborting"  // telling the servers it aborted
+	gatewayCommitted = "committed"
+	gatewayAborted   = "aborted"
+)
+
+type Gateway struct {
+	co      *Coordinator
+	servers []*Server
+	mux     *http.ServeMux
+	hub     wsHub         // WebSocket clients, told of every phase change and outcome
+	done    chan struct{} // closed by Close()
+
+	mu      sync.Mutex
+	nextTid int // no lower tid is free; see beginTransaction()
+	trans   map[int]*gatewayTransaction
+}
+
+// a transaction begun through the gateway.
+type gatewayTransaction struct {
+	status     string
+	readValues map[string]interface{}
+	reason     *TxnError     // why it aborted
+	decided    chan struct{} // closed once committed or aborted
+}
+
+// the body of a status reply.
+type gatewayStatus struct {
+	Tid        int                    `json:"tid"`
+	Status     string                 `json:"status"`
+	Phase      string                 `json:"phase,omitempty"` // the Coordinator's, while finishing
+	ReadValues map[string]interface{} `json:"readValues,omitempty"`
+	Reason     *TxnError              `json:"reason,omitempty"` // why it aborted
+}
+
+// the body of a get or set request.
+type gatewayOperation struct {
+	Key   string      `json:"key"`
+	Value interface{} `json:"value"` // ignored for a get
+}
+
+// serve transactions for co, whose servers are servers, reading
+// their outcomes from respChan, which co was made with.
+func MakeGateway(co *Coordinator, servers []*Server, respChan chan ResponseMsg) *Gateway {
+	gw := &Gateway{
+		co:      co,
+		servers: servers,
+		mux:     http.NewServeMux(),
+		done:    make(chan struct{}),
+		trans:   make(map[int]*gatewayTransaction),
+	}
+	gw.mux.HandleFunc("POST /transactions", gw.begin)
+	gw.mux.HandleFunc("POST /transactions/{tid}/get", gw.operation(true))
+	gw.mux.HandleFunc("POST /transactions/{tid}/set", gw.operation(false))
+	gw.mux.HandleFunc("POST /transactions/{tid}/finish", gw.finish)
+	gw.mux.HandleFunc("POST /transactions/{tid}/abort", gw.abort)
+	gw.mux.HandleFunc("GET /transactions/{tid}", gw.status)
+	gw.mux.HandleFunc("GET /servers", gw.serverStates)
+	gw.mux.Handle("GET /ws", websocket.Handler(gw.serveWebSocket))
+	gw.mux.Handle("GET /debug/3pc", DebugHandler(co, servers))
+
+	co.Subscribe(func(e Event) {
+		if p, ok := e.(PhaseChanged); ok {
+			gw.hub.broadcast(wsMessage{Type: "phase", Tid: p.Tid, Phase: p.Phase})
+		}
+	})
+	go gw.applier(respChan)
+	return gw
+}
+
+func (gw *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	gw.mux.ServeHTTP(w, r)
+}
+
+// stop reading respChan, and close the WebSocket connections.
+func (gw *Gateway) Close() error {
+	close(gw.done)
+	gw.hub.closeAll()
+	return nil
+}
+
+// record each outcome the Coordinator reports.
+func (gw *Gateway) applier(respChan chan ResponseMsg) {
+	for {
+		select {
+		case m := <-respChan:
+			if m.committed {
+				gw.decide(m.tid, gatewayCommitted, m.readValues, nil)
+			} else {
+				gw.decide(m.tid, gatewayAborted, nil, m.err)
+			}
+		case <-gw.done:
+			return
+		}
+	}
+}
+
+// mark tid decided, unless it's already decided, and tell the
+// WebSocket clients, even if the gateway didn't begin tid.
+func (gw *Gateway) decide(tid int, status string, readValues map[string]interface{}, reason *TxnError) {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+
+	tran, ok := gw.trans[tid]
+	if ok && (tran.status == gatewayCommitted || tran.status == gatewayAborted) {
+		return
+	}
+	gw.hub.broadcast(wsMessage{Type: "decided", Tid: tid, Status: status, ReadValues: readValues, Reason: reason})
+	if !ok {
+		return
+	}
+	tran.status = status
+	tran.readValues = readValues
+	tran.reason = reason
+	close(tran.decided)
+}
+
+func (gw *Gateway) begin(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusCreated, gatewayStatus{Tid: gw.beginTransaction(), Status: gatewayOpen})
+}
+
+func (gw *Gateway) operation(isGet bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tid, ok := gw.lookup(w, r, gatewayOpen)
+		if !ok {
+			return
+		}
+
+		dec := json.NewDecoder(r.Body)
+		dec.UseNumber()
+		var op gatewayOperation
+		if err := dec.Decode(&op); err != nil {
+			writeError(w, http.StatusBadRequest, "bad body: %v", err)
+			return
+		}
+		if err := gw.queue(tid, isGet, op); err != nil {
+			writeGatewayError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (gw *Gateway) finish(w http.ResponseWriter, r *http.Request) {
+	tid, ok := gw.lookup(w, r, "")
+	if !ok {
+		return
+	}
+	if err := gw.finishTransaction(tid); err != nil {
+		writeGatewayError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, gatewayStatus{Tid: tid, Status: gatewayFinishing})
+}
+
+func (gw *Gateway) abort(w http.ResponseWriter, r *http.Request) {
+	tid, ok := gw.lookup(w, r, "")
+	if !ok {
+		return
+	}
+	if err := gw.abortTransaction(tid); err != nil {
+		writeGatewayError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, gatewayStatus{Tid: tid, Status: gatewayAborted})
+}
+
+func (gw *Gateway) status(w http.ResponseWriter, r *http.Request) {
+	tid, ok := gw.lookup(w, r, "")
+	if !ok {
+		return
+	}
+
+	if s := r.URL.Query().Get("wait"); s != "" {
+		wait, err := time.ParseDuration(s)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "bad wait: %v", err)
+			return
+		}
+		gw.mu.Lock()
+		decided := gw.trans[tid].decided
+		gw.mu.Unlock()
+		select {
+		case <-decided:
+		case <-time.After(wait):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, gw.statusOf(tid))
+}
+
+// why a gateway operation failed, and the HTTP status that says so.
+type gatewayError struct {
+	code int
+	msg  string
+	txn  *TxnError // if it's about a transaction's key
+}
+
+func (e *gatewayError) Error() string {
+	return e.msg
+}
+
+func gatewayErrorf(code int, format string, a ...interface{}) error {
+	return &gatewayError{code, fmt.Sprintf(format, a...), nil}
+}
+
+// the operations, whether they came over HTTP or a WebSocket.
+
+// begin a transaction with a tid that neither the Coordinator nor
+// any server knows, e.g. from before a restart.
+func (gw *Gateway) beginTransaction() int {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+
+	tid := gw.nextTid
+	for gw.tidTaken(tid) {
+		tid++
+	}
+	gw.nextTid = tid + 1
+	gw.trans[tid] = &gatewayTransaction{status: gatewayOpen, decided: make(chan struct{})}
+	return tid
+}
+
+func (gw *Gateway) tidTaken(tid int) bool {
+	if gw.co.hasTid(tid) {
+		return true
+	}
+	for _, sv := range gw.servers {
+		if sv.hasTid(tid) {
+			return true
+		}
+	}
+	return false
+}
+
+// queue op on the server that stores its key.
+func (gw *Gateway) queue(tid int, isGet bool, op gatewayOperation) error {
+	if err := gw.check(tid, gatewayOpen); err != nil {
+		return err
+	}
+	value, err := fromJSON(op.Value)
+	if err != nil {
+		return gatewayErrorf(http.StatusBadRequest, "%v", err)
+	}
+	sv := gw.serverFor(op.Key)
+	if sv == nil {
+		te := &TxnError{Tid: tid, Phase: phaseOperations, Participant: -1, Key: op.Key, Err: ErrNoSuchKey}
+		return &gatewayError{http.StatusBadRequest, fmt.Sprintf("no server stores key %q", op.Key), te}
+	}
+
+	if isGet {
+		err = sv.Get(tid, op.Key)
+	} else {
+		err = sv.Set(tid, op.Key, value)
+	}
+	if te, ok := err.(*TxnError); ok {
+		return &gatewayError{http.StatusConflict, te.Error(), te}
+	}
+	return err
+}
+
+func (gw *Gateway) finishTransaction(tid int) error {
+	gw.mu.Lock()
+	if err := gw.checkLocked(tid, gatewayOpen); err != nil {
+		gw.mu.Unlock()
+		return err
+	}
+	gw.trans[tid].status = gatewayFinishing
+	gw.mu.Unlock()
+
+	gw.co.FinishTransaction(tid)
+	return nil
+}
+
+// abort on every server, so that a recovering Coordinator sees the
+// abort too. the Coordinator never hears of the transaction. it's
+// marked aborting first, so it can't be finished meanwhile.
+func (gw *Gateway) abortTransaction(tid int) error {
+	gw.mu.Lock()
+	if err := gw.checkLocked(tid, gatewayOpen); err != nil {
+		gw.mu.Unlock()
+		return err
+	}
+	gw.trans[tid].status = gatewayAborting
+	gw.mu.Unlock()
+
+	for _, sv := range gw.servers {
+		sv.Abort(Metadata{}, &RPCArgs{Tid: tid}, &struct{}{})
+	}
+	gw.decide(tid, gatewayAborted, nil, &TxnError{Tid: tid, Phase: phaseOperations, Participant: -1, Err: ErrClientAbort})
+	return nil
+}
+
+func (gw *Gateway) statusOf(tid int) gatewayStatus {
+	gw.mu.Lock()
+	tran := gw.trans[tid]
+	st := gatewayStatus{Tid: tid, Status: tran.status, ReadValues: tran.readValues, Reason: tran.reason}
+	gw.mu.Unlock()
+	if st.Status == gatewayFinishing {
+		st.Phase, _, _ = gw.co.transactionPhase(tid)
+	}
+	return st
+}
+
+// an error unless tid is a transaction in status, or in any status
+// if status is empty.
+func (gw *Gateway) check(tid int, status string) error {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+
+	return gw.checkLocked(tid, status)
+}
+
+func (gw *Gateway) checkLocked(tid int, status string) error {
+	tran, ok := gw.trans[tid]
+	if !ok {
+		return gatewayErrorf(http.StatusNotFound, "no transaction %d", tid)
+	}
+	if status != "" && tran.status != status {
+		return gatewayErrorf(http.StatusConflict, "transaction %d is %s", tid, tran.status)
+	}
+	return nil
+}
+
+// one server, as GET /servers shows it.
+type gatewayServer struct {
+	Keys         []string          `json:"keys"`
+	Transactions map[string]string `json:"transactions"` // tid : state
+}
+
+func (gw *Gateway) serverStates(w http.ResponseWriter, r *http.Request) {
+	states := make([]gatewayServer, len(gw.servers))
+	for i, sv := range gw.servers {
+		reply := &QueryReply{}
+		sv.Query(Metadata{}, struct{}{}, reply)
+		states[i] = gatewayServer{Keys: sv.keys(), Transactions: make(map[string]string)}
+		for tid, tran := range reply.Transactions {
+			states[i].Transactions[strconv.Itoa(tid)] = tran.State.String()
+		}
+	}
+	writeJSON(w, http.StatusOK, states)
+}
+
+// the request's transaction, which must be in status unless that's
+// empty. writes the error reply if there's no such transaction, or
+// it's in another status.
+func (gw *Gateway) lookup(w http.ResponseWriter, r *http.Request, status string) (int, bool) {
+	tid, err := strconv.Atoi(r.PathValue("tid"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad transaction ID %q", r.PathValue("tid"))
+		return 0, false
+	}
+	if err := gw.check(tid, status); err != nil {
+		writeGatewayError(w, err)
+		return 0, false
+	}
+	return tid, true
+}
+
+// the server that stores key, or nil.
+func (gw *Gateway) serverFor(key string) *Server {
+	for _, sv := range gw.servers {
+		for _, k := range sv.keys() {
+			if k == key {
+				return sv
+			}
+		}
+	}
+	return nil
+}
+
+// a JSON value as a store value; whole numbers become ints, and
+// the other numbers float64s.
+func fromJSON(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case nil, string, bool:
+		return v, nil
+	case json.Number:
+		if n, err := strconv.Atoi(string(v)); err == nil {
+			return n, nil
+		}
+		return v.Float64()
+	}
+	return nil, fmt.Errorf("can't store a value of type %T", v)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, format string, a ...interface{}) {
+	writeJSON(w, code, map[string]string{"error": fmt.Sprintf(format, a...)})
+}
+
+func writeGatewayError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	if ge, ok := err.(*gatewayError); ok {
+		code = ge.code
+		if ge.txn != nil {
+			writeJSON(w, code, struct {
+				Error string    `json:"error"`
+				Txn   *TxnError `json:"txn"`
+			}{ge.msg, ge.txn})
+			return
+		}
+	}
+	writeError(w, code, "%v", err)
+}
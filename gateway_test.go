@@ -0,0 +1,313 @@
+package commit
+
+import (
+	"3PhaseCommit/labrpc"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// Drives transactions through the HTTP gateway, as curl would
+// A transaction should commit and read back what an earlier one wrote, an aborted one should leave
+// the store alone and refuse more operations, and bad requests should get errors
+func TestGateway(t *testing.T) {
+	t.Parallel()
+
+	net := labrpc.MakeNetwork()
+	defer net.Cleanup()
+	tr := makeLabrpcTransport(net)
+
+	keys := [][]string{{"x"}, {"y"}}
+	servers := make([]*Server, len(keys))
+	addrs := make([]string, len(keys))
+	for i := range keys {
+		servers[i] = MakeServer(keys[i], MakePersister())
+		defer servers[i].Kill()
+		addrs[i] = fmt.Sprintf("server%d", i)
+		tr.Serve(addrs[i], servers[i])
+	}
+	respChan := make(chan ResponseMsg)
+	co, err := DialCoordinator(tr, addrs, respChan)
+	if err != nil {
+		t.Fatalf("DialCoordinator: %v", err)
+	}
+	defer co.Kill()
+
+	gw := MakeGateway(co, servers, respChan)
+	defer gw.Close()
+	ts := httptest.NewServer(gw)
+	defer ts.Close()
+
+	do := func(method string, path string, body string, wantCode int) map[string]interface{} {
+		req, err := http.NewRequest(method, ts.URL+path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != wantCode {
+			t.Fatalf("%s %s %s: status %d; expected %d", method, path, body, resp.StatusCode, wantCode)
+		}
+		var reply map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&reply)
+		return reply
+	}
+	begin := func() string {
+		return fmt.Sprint(do("POST", "/transactions", "", http.StatusCreated)["tid"])
+	}
+
+	tid := begin()
+	do("POST", "/transactions/"+tid+"/set", `{"key": "x", "value": 1}`, http.StatusNoContent)
+	do("POST", "/transactions/"+tid+"/set", `{"key": "y", "value": "two"}`, http.StatusNoContent)
+	do("POST", "/transactions/"+tid+"/finish", "", http.StatusAccepted)
+	if st := do("GET", "/transactions/"+tid+"?wait=5s", "", http.StatusOK); st["status"] != gatewayCommitted {
+		t.Fatalf("transaction %s is %v; expected it to commit", tid, st)
+	}
+	do("POST", "/transactions/"+tid+"/set", `{"key": "x", "value": 3}`, http.StatusConflict)
+
+	aborted := begin()
+	do("POST", "/transactions/"+aborted+"/set", `{"key": "x", "value": 2}`, http.StatusNoContent)
+	do("POST", "/transactions/"+aborted+"/abort", "", http.StatusOK)
+	if st := do("GET", "/transactions/"+aborted, "", http.StatusOK); st["reason"] == nil || st["reason"].(map[string]interface{})["error"] != ErrClientAbort.Error() {
+		t.Fatalf("transaction %s is %v; expected the client's abort as its reason", aborted, st)
+	}
+	do("POST", "/transactions/"+aborted+"/set", `{"key": "y", "value": 2}`, http.StatusConflict)
+	do("POST", "/transactions/"+aborted+"/finish", "", http.StatusConflict)
+
+	tid = begin()
+	do("POST", "/transactions/"+tid+"/get", `{"key": "x"}`, http.StatusNoContent)
+	do("POST", "/transactions/"+tid+"/get", `{"key": "y"}`, http.StatusNoContent)
+	do("POST", "/transactions/"+tid+"/finish", "", http.StatusAccepted)
+	st := do("GET", "/transactions/"+tid+"?wait=5s", "", http.StatusOK)
+	want := map[string]interface{}{"x": 1.0, "y": "two"}
+	if st["status"] != gatewayCommitted || !reflect.DeepEqual(st["readValues"], want) {
+		t.Fatalf("transaction %s is %v; expected it to commit and read %v", tid, st, want)
+	}
+	if v := servers[0].storeValues()["x"]; v != 1 {
+		t.Fatalf("x is %v (%T); expected the int 1", v, v)
+	}
+
+	tid = begin()
+	do("POST", "/transactions/"+tid+"/set", `{"key": "nokey", "value": 1}`, http.StatusBadRequest)
+	do("POST", "/transactions/"+tid+"/set", `{"key": "x", "value": [1]}`, http.StatusBadRequest)
+	do("POST", "/transactions/"+tid+"/set", `not json`, http.StatusBadRequest)
+	do("GET", "/transactions/99", "", http.StatusNotFound)
+	do("GET", "/transactions/abc", "", http.StatusBadRequest)
+
+	resp, err := http.Get(ts.URL + "/servers")
+	if err != nil {
+		t.Fatalf("GET /servers: %v", err)
+	}
+	defer resp.Body.Close()
+	var states []gatewayServer
+	if err := json.NewDecoder(resp.Body).Decode(&states); err != nil {
+		t.Fatalf("GET /servers: %v", err)
+	}
+	if len(states) != 2 || !reflect.DeepEqual(states[1].Keys, []string{"y"}) || states[0].Transactions[aborted] != "Aborted" {
+		t.Fatalf("GET /servers gave %+v", states)
+	}
+}
+
+// Runs transactions over the gateway's WebSocket while a second connection watches
+// The first should get a reply or an error for each request, and the watcher should see
+// the transaction move through Prepare, PreCommit and Committed, then its outcome
+func TestGatewayWebSocket(t *testing.T) {
+	t.Parallel()
+
+	net := labrpc.MakeNetwork()
+	defer net.Cleanup()
+	tr := makeLabrpcTransport(net)
+
+	keys := [][]string{{"x"}, {"y"}}
+	servers := make([]*Server, len(keys))
+	addrs := make([]string, len(keys))
+	for i := range keys {
+		servers[i] = MakeServer(keys[i], MakePersister())
+		defer servers[i].Kill()
+		addrs[i] = fmt.Sprintf("server%d", i)
+		tr.Serve(addrs[i], servers[i])
+	}
+	respChan := make(chan ResponseMsg)
+	co, err := DialCoordinator(tr, addrs, respChan)
+	if err != nil {
+		t.Fatalf("DialCoordinator: %v", err)
+	}
+	defer co.Kill()
+
+	gw := MakeGateway(co, servers, respChan)
+	defer gw.Close()
+	ts := httptest.NewServer(gw)
+	defer ts.Close()
+
+	dial := func() *websocket.Conn {
+		ws, err := websocket.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", "", ts.URL)
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		return ws
+	}
+	client, watcher := dial(), dial()
+	defer client.Close()
+	defer watcher.Close()
+
+	receive := func(ws *websocket.Conn) wsMessage {
+		ws.SetReadDeadline(time.Now().Add(waitTimeout))
+		var m wsMessage
+		if err := websocket.JSON.Receive(ws, &m); err != nil {
+			t.Fatalf("Receive: %v", err)
+		}
+		return m
+	}
+	// send a request, and return its reply or error, skipping events
+	id := 0
+	request := func(req string) wsMessage {
+		id++
+		if _, err := client.Write([]byte(fmt.Sprintf(`{"id": %d, %s}`, id, req))); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		for {
+			if m := receive(client); m.ID == id {
+				return m
+			}
+		}
+	}
+
+	m := request(`"op": "begin"`)
+	if m.Type != "reply" || m.Status != gatewayOpen {
+		t.Fatalf("begin: %+v", m)
+	}
+	tid := m.Tid
+	request(fmt.Sprintf(`"op": "set", "tid": %d, "key": "x", "value": 1`, tid))
+	request(fmt.Sprintf(`"op": "get", "tid": %d, "key": "y"`, tid))
+	if m := request(fmt.Sprintf(`"op": "set", "tid": %d, "key": "nokey", "value": 1`, tid)); m.Type != "error" {
+		t.Fatalf("set of an unknown key: %+v", m)
+	}
+	if m := request(`"op": "finish", "tid": 99`); m.Type != "error" || m.Tid != 99 {
+		t.Fatalf("finish of an unknown transaction: %+v", m)
+	}
+	if m := request(fmt.Sprintf(`"op": "finish", "tid": %d`, tid)); m.Type != "reply" || m.Status != gatewayFinishing {
+		t.Fatalf("finish: %+v", m)
+	}
+
+	var phases []string
+	for {
+		m := receive(watcher)
+		if m.Tid != tid {
+			t.Fatalf("watcher heard of transaction %d: %+v", m.Tid, m)
+		}
+		if m.Type == "phase" {
+			phases = append(phases, m.Phase)
+			continue
+		}
+		if m.Type != "decided" || m.Status != gatewayCommitted || !reflect.DeepEqual(m.ReadValues, map[string]interface{}{"y": nil}) {
+			t.Fatalf("expected transaction %d to commit, got %+v", tid, m)
+		}
+		break
+	}
+	if want := []string{PhasePrepare, PhasePreCommit, PhaseCommitted}; !reflect.DeepEqual(phases, want) {
+		t.Fatalf("watcher saw phases %v; expected %v", phases, want)
+	}
+	if m := request(fmt.Sprintf(`"op": "status", "tid": %d`, tid)); m.Status != gatewayCommitted {
+		t.Fatalf("status: %+v", m)
+	}
+
+	tid = request(`"op": "begin"`).Tid
+	if m := request(fmt.Sprintf(`"op": "abort", "tid": %d`, tid)); m.Type != "reply" || m.Status != gatewayAborted {
+		t.Fatalf("abort: %+v", m)
+	}
+	if m := receive(watcher); m.Type != "decided" || m.Tid != tid || m.Status != gatewayAborted {
+		t.Fatalf("expected the watcher to hear of the abort, got %+v", m)
+	}
+	if m := request(`"op": "launch"`); m.Type != "error" {
+		t.Fatalf("an unknown op: %+v", m)
+	}
+}
+
+// Starts a gateway whose servers hold tids 0 and 1 and whose coordinator logged a commit for
+// tid 2, then aborts a new transaction and tries to finish it while the Aborts are being sent
+// The gateway should hand out tids from 3 on, and refuse the finish since the abort got there first
+func TestGatewayTids(t *testing.T) {
+	t.Parallel()
+
+	net := labrpc.MakeNetwork()
+	defer net.Cleanup()
+	tr := makeLabrpcTransport(net)
+
+	old := MakeServer([]string{"x"}, MakePersister())
+	defer old.Kill()
+	tr.Serve("old", old)
+	oldEnd, _ := tr.Dial("old")
+	ps := MakePersister()
+	oldResp := make(chan ResponseMsg)
+	oldCo := MakeCoordinatorWithPersister([]PeerClient{oldEnd}, oldResp, ps)
+	old.Set(2, "x", 1)
+	oldCo.FinishTransaction(2)
+	select {
+	case <-oldResp:
+	case <-time.After(waitTimeout):
+		t.Fatalf("Transaction 2 got no response within %v", waitTimeout)
+	}
+	oldCo.Kill()
+
+	keys := [][]string{{"x"}, {"y"}}
+	servers := make([]*Server, len(keys))
+	ends := make([]PeerClient, len(keys))
+	for i := range keys {
+		servers[i] = MakeServer(keys[i], MakePersister())
+		defer servers[i].Kill()
+		name := fmt.Sprintf("server%d", i)
+		tr.Serve(name, servers[i])
+		ends[i], _ = tr.Dial(name)
+	}
+	servers[0].Set(0, "x", 1)
+	servers[1].Set(1, "y", 1)
+	servers[1].Prepare(Metadata{}, &RPCArgs{Tid: 1}, &PrepareReply{})
+	respChan := make(chan ResponseMsg)
+	co := MakeCoordinatorWithPersister(ends, respChan, ps.Copy())
+	defer co.Kill()
+	gw := MakeGateway(co, servers, respChan)
+	defer gw.Close()
+
+	for want := 3; want <= 4; want++ {
+		if tid := gw.beginTransaction(); tid != want {
+			t.Fatalf("expected the gateway to begin transaction %d, got %d", want, tid)
+		}
+	}
+
+	aborting := make(chan struct{})
+	release := make(chan struct{})
+	servers[0].setHook(func(point hookPoint, method string, tid int, meta Metadata) {
+		if point == hookBefore && method == "Server.Abort" && tid == 4 {
+			close(aborting)
+			<-release
+		}
+	})
+	aborted := make(chan error)
+	go func() { aborted <- gw.abortTransaction(4) }()
+	select {
+	case <-aborting:
+	case <-time.After(waitTimeout):
+		t.Fatalf("the gateway never sent transaction 4's Abort")
+	}
+	if err := gw.finishTransaction(4); err == nil {
+		t.Fatalf("expected finishing transaction 4 to be refused while it's aborting")
+	}
+	close(release)
+	if err := <-aborted; err != nil {
+		t.Fatalf("abort: %v", err)
+	}
+	if st := gw.statusOf(4); st.Status != gatewayAborted {
+		t.Fatalf("expected transaction 4 to be aborted, got %+v", st)
+	}
+}
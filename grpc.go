@@ -0,0 +1,382 @@
+package commit
+
+//
+// a Transport over gRPC, with the messages in commitpb/commit.proto,
+// so that servers and clients in other languages can take part:
+//
+//   t := MakeGRPCTransport()
+//   l, err := t.Listen(":7000", sv)                // on each server
+//   co, err := DialCoordinator(t, addrs, respChan) // on the coordinator
+//
+// values cross the wire as a commitpb.Value, which holds an int,
+// string, bool, float64 or []byte; a handler fails on any other
+// type. each PeerClient keeps a pool of PoolConfig.Size gRPC
+// connections, which it takes in turn; gRPC redials each by itself
+// after it breaks, e.g. because the server restarted, with the
+// pool's backoff, and pings idle ones every HealthInterval (at
+// least every 10s, gRPC's limit). a call gives up and returns false after
+// grpcCallTimeout, like a request lost by labrpc, and the
+// Coordinator retries it as usual. a call's Metadata travels as
+// gRPC metadata, each key prefixed with grpcMetaPrefix; gRPC
+// lower-cases keys, and only allows printable ASCII in values.
+// MakeGRPCTransportTLS() encrypts the connections; see tls.go.
+// SetMaxMessageSize() sets gRPC's limits on both sides, and a call
+// over them fails with ErrMessageTooLarge.
+//
+
+import (
+	"3PhaseCommit/commitpb"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	grpcDialTimeout = time.Second
+	grpcCallTimeout = 5 * time.Second
+	grpcMetaPrefix  = "commit-"       // keeps a call's Metadata apart from gRPC's own headers
+	grpcMinPing     = 5 * time.Second // the most often a server lets clients ping; below gRPC's client limit
+)
+
+type GRPCTransport struct {
+	tls        TransportTLS
+	pool       PoolConfig
+	maxMessage int // the most bytes in a request or reply; 0 for gRPC's defaults
+}
+
+func MakeGRPCTransport() *GRPCTransport {
+	return &GRPCTransport{pool: DefaultPoolConfig()}
+}
+
+// like MakeGRPCTransport, but with TLS on every connection.
+func MakeGRPCTransportTLS(tlsCfg TransportTLS) *GRPCTransport {
+	return &GRPCTransport{tls: tlsCfg, pool: DefaultPoolConfig()}
+}
+
+func (gt *GRPCTransport) SetPool(pc PoolConfig) {
+	gt.pool = pc
+}
+
+// refuse the requests and replies of later Listens and Dials that
+// take more than n bytes once encoded; 0 restores gRPC's defaults.
+func (gt *GRPCTransport) SetMaxMessageSize(n int) {
+	gt.maxMessage = n
+}
+
+// a Server's handlers, listening for gRPC on a TCP address.
+type GRPCListener struct {
+	ln net.Listener
+	gs *grpc.Server
+}
+
+// listen on addr, e.g. ":7000", or "127.0.0.1:0" for any free port,
+// and serve sv's handlers.
+func (gt *GRPCTransport) Listen(addr string, sv *Server) (*GRPCListener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// let clients' health checks through, even between calls
+	opts := []grpc.ServerOption{
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{MinTime: grpcMinPing, PermitWithoutStream: true}),
+	}
+	if gt.tls.Server != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(gt.tls.Server)))
+	}
+	if max := gt.maxMessage; max > 0 {
+		opts = append(opts, grpc.MaxRecvMsgSize(max), grpc.MaxSendMsgSize(max))
+		sv.setMessageFits(func(msg interface{}) bool {
+			m, err := messageToPB(msg)
+			return err == nil && proto.Size(m) <= max
+		})
+	}
+	gs := grpc.NewServer(opts...)
+	commitpb.RegisterServerServer(gs, &grpcHandlers{sv: sv})
+	go gs.Serve(ln)
+	return &GRPCListener{ln: ln, gs: gs}, nil
+}
+
+func (gt *GRPCTransport) Serve(addr string, sv *Server) (io.Closer, error) {
+	return gt.Listen(addr, sv)
+}
+
+func (gt *GRPCTransport) Dial(addr string) (PeerClient, error) {
+	creds := insecure.NewCredentials()
+	if gt.tls.Client != nil {
+		creds = credentials.NewTLS(gt.tls.Client)
+	}
+	opts := []grpc.DialOption{
+		grpc.WithTransportCredentials(creds),
+		grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff: backoff.Config{
+				BaseDelay:  gt.pool.MinBackoff,
+				Multiplier: 2,
+				Jitter:     0.2,
+				MaxDelay:   gt.pool.MaxBackoff,
+			},
+			MinConnectTimeout: grpcDialTimeout,
+		}),
+	}
+	if gt.pool.HealthInterval > 0 {
+		opts = append(opts, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                gt.pool.HealthInterval,
+			Timeout:             grpcDialTimeout,
+			PermitWithoutStream: true,
+		}))
+	}
+
+	if gt.maxMessage > 0 {
+		opts = append(opts, grpc.WithDefaultCallOptions(grpc.MaxCallSendMsgSize(gt.maxMessage), grpc.MaxCallRecvMsgSize(gt.maxMessage)))
+	}
+
+	p := &grpcPeer{}
+	for range max(gt.pool.Size, 1) {
+		conn, err := grpc.NewClient(addr, opts...)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.conns = append(p.conns, conn)
+		p.clients = append(p.clients, commitpb.NewServerClient(conn))
+	}
+	return p, nil
+}
+
+// the address l listens on, with the port filled in.
+func (l *GRPCListener) Addr() string {
+	return l.ln.Addr().String()
+}
+
+// stop listening and drop every connection, failing calls in
+// progress.
+func (l *GRPCListener) Close() error {
+	l.gs.Stop()
+	return nil
+}
+
+// a Server's handlers in the form gRPC expects.
+type grpcHandlers struct {
+	commitpb.UnimplementedServerServer
+	sv *Server
+}
+
+func (h *grpcHandlers) Prepare(ctx context.Context, args *commitpb.RPCArgs) (*commitpb.PrepareReply, error) {
+	reply := &PrepareReply{}
+	h.sv.Prepare(metaFromContext(ctx), &RPCArgs{Tid: int(args.Tid)}, reply)
+	return &commitpb.PrepareReply{Relevant: reply.Relevant, Vote: reply.Vote, TooLarge: reply.TooLarge, NoKey: reply.NoKey}, nil
+}
+
+func (h *grpcHandlers) Abort(ctx context.Context, args *commitpb.RPCArgs) (*commitpb.Empty, error) {
+	h.sv.Abort(metaFromContext(ctx), &RPCArgs{Tid: int(args.Tid)}, &struct{}{})
+	return &commitpb.Empty{}, nil
+}
+
+func (h *grpcHandlers) Query(ctx context.Context, args *commitpb.Empty) (*commitpb.QueryReply, error) {
+	reply := &QueryReply{}
+	h.sv.Query(metaFromContext(ctx), struct{}{}, reply)
+	return queryReplyToPB(*reply)
+}
+
+func (h *grpcHandlers) PreCommit(ctx context.Context, args *commitpb.RPCArgs) (*commitpb.PreCommitReply, error) {
+	reply := &PreCommitReply{}
+	h.sv.PreCommit(metaFromContext(ctx), &RPCArgs{Tid: int(args.Tid)}, reply)
+	return &commitpb.PreCommitReply{Ack: reply.Ack}, nil
+}
+
+func (h *grpcHandlers) Commit(ctx context.Context, args *commitpb.RPCArgs) (*commitpb.CommitReply, error) {
+	reply := &CommitReply{}
+	h.sv.Commit(metaFromContext(ctx), &RPCArgs{Tid: int(args.Tid)}, reply)
+	return commitReplyToPB(*reply)
+}
+
+// a PeerClient for one server, sending the Coordinator's calls as
+// gRPCs.
+type grpcPeer struct {
+	conns   []*grpc.ClientConn
+	clients []commitpb.ServerClient
+	next    atomic.Uint32 // the connection the next call takes
+}
+
+func (p *grpcPeer) Call(svcMeth string, args interface{}, reply interface{}) bool {
+	return p.CallMeta(svcMeth, nil, args, reply)
+}
+
+func (p *grpcPeer) CallMeta(svcMeth string, meta Metadata, args interface{}, reply interface{}) bool {
+	return p.CallErr(svcMeth, meta, args, reply) == nil
+}
+
+func (p *grpcPeer) CallErr(svcMeth string, meta Metadata, args interface{}, reply interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), grpcCallTimeout)
+	defer cancel()
+
+	md := metadata.MD{}
+	for key, value := range meta {
+		md.Set(grpcMetaPrefix+key, value)
+	}
+	ctx = metadata.NewOutgoingContext(ctx, md)
+
+	client := p.clients[int(p.next.Add(1))%len(p.clients)]
+	var err error
+	switch svcMeth {
+	case "Server.Prepare":
+		var r *commitpb.PrepareReply
+		r, err = client.Prepare(ctx, argsToPB(args))
+		if err == nil {
+			*reply.(*PrepareReply) = PrepareReply{Relevant: r.Relevant, Vote: r.Vote, TooLarge: r.TooLarge, NoKey: r.NoKey}
+		}
+	case "Server.Abort":
+		_, err = client.Abort(ctx, argsToPB(args))
+	case "Server.Query":
+		var r *commitpb.QueryReply
+		r, err = client.Query(ctx, &commitpb.Empty{})
+		if err == nil {
+			*reply.(*QueryReply) = queryReplyFromPB(r)
+		}
+	case "Server.PreCommit":
+		var r *commitpb.PreCommitReply
+		r, err = client.PreCommit(ctx, argsToPB(args))
+		if err == nil {
+			*reply.(*PreCommitReply) = PreCommitReply{Ack: r.Ack}
+		}
+	case "Server.Commit":
+		var r *commitpb.CommitReply
+		r, err = client.Commit(ctx, argsToPB(args))
+		if err == nil {
+			*reply.(*CommitReply) = commitReplyFromPB(r)
+		}
+	default:
+		return ErrUnsupportedMethod
+	}
+	if status.Code(err) == codes.ResourceExhausted {
+		// over the client's or the server's limit
+		return ErrMessageTooLarge
+	}
+	return err
+}
+
+// gRPC has no one-way calls, so make the call without waiting
+// for it.
+func (p *grpcPeer) Send(svcMeth string, args interface{}) {
+	go p.CallMeta(svcMeth, nil, args, replyFor(svcMeth))
+}
+
+// close every connection; later calls fail.
+func (p *grpcPeer) Close() error {
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+	return nil
+}
+
+// the Metadata a grpcPeer sent with the call a handler is running.
+func metaFromContext(ctx context.Context) Metadata {
+	meta := Metadata{}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for key, values := range md {
+		if name, ok := strings.CutPrefix(key, grpcMetaPrefix); ok && len(values) > 0 {
+			meta[name] = values[0]
+		}
+	}
+	return meta
+}
+
+func argsToPB(args interface{}) *commitpb.RPCArgs {
+	return &commitpb.RPCArgs{Tid: int64(args.(*RPCArgs).Tid)}
+}
+
+func queryReplyToPB(reply QueryReply) (*commitpb.QueryReply, error) {
+	pb := &commitpb.QueryReply{Transactions: make(map[int64]*commitpb.ServerTransaction)}
+	for tid, tran := range reply.Transactions {
+		ptran := &commitpb.ServerTransaction{State: commitpb.TransactionState(tran.State)}
+		for _, op := range tran.Operations {
+			value, err := valueToPB(op.Value)
+			if err != nil {
+				return nil, fmt.Errorf("transaction %d: %v", tid, err)
+			}
+			ptran.Operations = append(ptran.Operations, &commitpb.Operation{IsGet: op.IsGet, Key: op.Key, Value: value})
+		}
+		pb.Transactions[int64(tid)] = ptran
+	}
+	return pb, nil
+}
+
+func queryReplyFromPB(pb *commitpb.QueryReply) QueryReply {
+	reply := QueryReply{Transactions: make(map[int]ServerTransaction)}
+	for tid, ptran := range pb.Transactions {
+		tran := ServerTransaction{State: TransactionState(ptran.State)}
+		for _, op := range ptran.Operations {
+			tran.Operations = append(tran.Operations, Operation{IsGet: op.IsGet, Key: op.Key, Value: valueFromPB(op.Value)})
+		}
+		reply.Transactions[int(tid)] = tran
+	}
+	return reply
+}
+
+func commitReplyToPB(reply CommitReply) (*commitpb.CommitReply, error) {
+	pb := &commitpb.CommitReply{ReadValues: make(map[string]*commitpb.Value), Reads: int64(reply.Reads)}
+	for key, v := range reply.ReadValues {
+		value, err := valueToPB(v)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %v", key, err)
+		}
+		pb.ReadValues[key] = value
+	}
+	return pb, nil
+}
+
+func commitReplyFromPB(pb *commitpb.CommitReply) CommitReply {
+	reply := CommitReply{ReadValues: make(map[string]interface{}), Reads: int(pb.Reads)}
+	for key, value := range pb.ReadValues {
+		reply.ReadValues[key] = valueFromPB(value)
+	}
+	return reply
+}
+
+func valueToPB(v interface{}) (*commitpb.Value, error) {
+	switch v := v.(type) {
+	case nil:
+		return &commitpb.Value{}, nil
+	case int:
+		return &commitpb.Value{Kind: &commitpb.Value_Int{Int: int64(v)}}, nil
+	case string:
+		return &commitpb.Value{Kind: &commitpb.Value_String_{String_: v}}, nil
+	case bool:
+		return &commitpb.Value{Kind: &commitpb.Value_Bool{Bool: v}}, nil
+	case float64:
+		return &commitpb.Value{Kind: &commitpb.Value_Float{Float: v}}, nil
+	case []byte:
+		return &commitpb.Value{Kind: &commitpb.Value_Bytes{Bytes: v}}, nil
+	}
+	return nil, fmt.Errorf("can't send a value of type %T over gRPC", v)
+}
+
+func valueFromPB(pb *commitpb.Value) interface{} {
+	switch kind := pb.GetKind().(type) {
+	case *commitpb.Value_Int:
+		return int(kind.Int)
+	case *commitpb.Value_String_:
+		return kind.String_
+	case *commitpb.Value_Bool:
+		return kind.Bool
+	case *commitpb.Value_Float:
+		return kind.Float
+	case *commitpb.Value_Bytes:
+		return kind.Bytes
+	}
+	return nil
+}
@@ -0,0 +1,291 @@
+package commit
+
+//
+// a record of what happened to each transaction, and a Graphviz
+// diagram of it, for teaching and for showing exactly what went
+// on in a failing recovery:
+//
+//   h := MakeHistory()
+//   for i := range ends {
+//       peers[i] = h.RecordCalls(ends[i], i)
+//   }
+//   co := MakeCoordinator(peers, respChan)
+//   h.WatchCoordinator(co)
+//   ...
+//   h.WriteDOT(f, tid)     -- then: dot -Tsvg f > tid.svg
+//
+// the history holds the coordinator's phase changes, each call it
+// makes to a server, and each call's reply, or why it was lost.
+// a server's states are read off its replies: a Yes vote means it
+// voted Yes, an acknowledged PreCommit that it pre-committed, and
+// so on. a restarted coordinator must be watched again.
+//
+// in the diagram the coordinator and each server have a column of
+// the states they went through, joined by bold edges. each
+// message is an edge from its sender's state when it was sent to
+// the state it led to, numbered in the order it happened; a reply
+// is dashed, and a lost message is red and dotted.
+//
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type HistoryKind int
+
+const (
+	HistoryPhase   HistoryKind = iota // the coordinator moved the transaction to Phase
+	HistoryRequest                    // the coordinator called Method on Server
+	HistoryReply                      // the call Call got a reply, summed up in Detail
+	HistoryLost                       // the call Call failed, with the error in Detail
+)
+
+type HistoryEvent struct {
+	Time   time.Time
+	Tid    int
+	Kind   HistoryKind
+	Phase  string // HistoryPhase
+	Server int    // the others
+	Method string // the others
+	Call   int    // which call a request, reply or loss is about
+	Detail string // HistoryReply and HistoryLost
+}
+
+type History struct {
+	mu     sync.Mutex
+	events []HistoryEvent
+	calls  int // calls recorded so far
+}
+
+func MakeHistory() *History {
+	return &History{}
+}
+
+func (h *History) add(e HistoryEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	e.Time = time.Now()
+	h.events = append(h.events, e)
+}
+
+// record each phase change of co's transactions.
+func (h *History) WatchCoordinator(co *Coordinator) {
+	co.Subscribe(func(e Event) {
+		if p, ok := e.(PhaseChanged); ok {
+			h.add(HistoryEvent{Tid: p.Tid, Kind: HistoryPhase, Phase: p.Phase})
+		}
+	})
+}
+
+// a PeerClient that calls peer, which reaches server, recording
+// each call about a transaction and what came of it.
+func (h *History) RecordCalls(peer PeerClient, server int) PeerClient {
+	return &historyPeer{PeerClient: peer, h: h, server: server}
+}
+
+type historyPeer struct {
+	PeerClient
+	h      *History
+	server int
+}
+
+func (p *historyPeer) Call(svcMeth string, args interface{}, reply interface{}) bool {
+	return p.CallErr(svcMeth, nil, args, reply) == nil
+}
+
+func (p *historyPeer) CallMeta(svcMeth string, meta Metadata, args interface{}, reply interface{}) bool {
+	return p.CallErr(svcMeth, meta, args, reply) == nil
+}
+
+func (p *historyPeer) CallErr(svcMeth string, meta Metadata, args interface{}, reply interface{}) error {
+	tid, err := strconv.Atoi(meta[MetaTid])
+	if err != nil {
+		// not about one transaction, e.g. a Query
+		return p.PeerClient.CallErr(svcMeth, meta, args, reply)
+	}
+
+	p.h.mu.Lock()
+	p.h.calls++
+	call := p.h.calls
+	p.h.mu.Unlock()
+
+	method := strings.TrimPrefix(svcMeth, "Server.")
+	p.h.add(HistoryEvent{Tid: tid, Kind: HistoryRequest, Server: p.server, Method: method, Call: call})
+	err = p.PeerClient.CallErr(svcMeth, meta, args, reply)
+	if err != nil {
+		p.h.add(HistoryEvent{Tid: tid, Kind: HistoryLost, Server: p.server, Method: method, Call: call, Detail: err.Error()})
+	} else {
+		p.h.add(HistoryEvent{Tid: tid, Kind: HistoryReply, Server: p.server, Method: method, Call: call, Detail: replySummary(reply)})
+	}
+	return err
+}
+
+func (p *historyPeer) Close() error {
+	if c, ok := p.PeerClient.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// what a reply says, in a word or two.
+func replySummary(reply interface{}) string {
+	switch r := reply.(type) {
+	case *PrepareReply:
+		if !r.Relevant {
+			return "not relevant"
+		} else if r.Vote {
+			return "Yes"
+		}
+		return "No"
+	case *PreCommitReply:
+		if r.Ack {
+			return "ack"
+		}
+		return "no ack"
+	case *CommitReply:
+		return fmt.Sprintf("%d reads", r.Reads)
+	}
+	return "ok"
+}
+
+// the state a server's reply to method shows it's in; "" if it
+// doesn't show one.
+func serverStateAfter(method string, summary string) string {
+	switch {
+	case method == "Prepare" && summary == "Yes":
+		return stateVotedYes.String()
+	case method == "Prepare" && summary == "No":
+		return stateVotedNo.String()
+	case method == "PreCommit" && summary == "ack":
+		return statePreCommitted.String()
+	case method == "Commit":
+		return stateCommitted.String()
+	case method == "Abort":
+		return stateAborted.String()
+	}
+	return ""
+}
+
+// tid's events, oldest first.
+func (h *History) Events(tid int) []HistoryEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var events []HistoryEvent
+	for _, e := range h.events {
+		if e.Tid == tid {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+var errNoHistory = errors.New("no events for that transaction")
+
+// write tid's history to w as a Graphviz DOT digraph.
+func (h *History) WriteDOT(w io.Writer, tid int) error {
+	events := h.Events(tid)
+	if len(events) == 0 {
+		return errNoHistory
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "digraph \"transaction %d\" {\n", tid)
+	fmt.Fprintf(&b, "\tlabel=\"transaction %d\";\n\tlabelloc=t;\n\tnode [shape=box, style=rounded];\n", tid)
+
+	// each participant's states, as node names and labels
+	type column struct {
+		nodes  []string
+		labels []string
+	}
+	columns := map[int]*column{}
+	const coordinator = -1
+	state := func(who int, label string) string {
+		c, ok := columns[who]
+		if !ok {
+			c = &column{}
+			columns[who] = c
+		}
+		name := fmt.Sprintf("c%d", len(c.nodes))
+		if who != coordinator {
+			name = fmt.Sprintf("s%d_%d", who, len(c.nodes))
+		}
+		c.nodes = append(c.nodes, name)
+		c.labels = append(c.labels, label)
+		return name
+	}
+	current := func(who int) string {
+		c, ok := columns[who]
+		if !ok {
+			return state(who, "start")
+		}
+		return c.nodes[len(c.nodes)-1]
+	}
+	currentLabel := func(who int) string {
+		current(who)
+		c := columns[who]
+		return c.labels[len(c.labels)-1]
+	}
+
+	var edges []string
+	sent := map[int]string{} // call : the coordinator's state when it was sent
+	n := 0
+	for _, e := range events {
+		switch e.Kind {
+		case HistoryPhase:
+			state(coordinator, e.Phase)
+		case HistoryRequest:
+			sent[e.Call] = current(coordinator)
+			current(e.Server) // start the server's column
+		case HistoryReply:
+			to := current(e.Server)
+			if s := serverStateAfter(e.Method, e.Detail); s != "" && s != currentLabel(e.Server) {
+				to = state(e.Server, s)
+			}
+			n++
+			edges = append(edges, fmt.Sprintf("\t%s -> %s [label=\"%d. %s\"];", sent[e.Call], to, n, e.Method))
+			n++
+			edges = append(edges, fmt.Sprintf("\t%s -> %s [label=\"%d. %s\", style=dashed];", to, current(coordinator), n, e.Detail))
+		case HistoryLost:
+			n++
+			edges = append(edges, fmt.Sprintf("\t%s -> %s [label=\"%d. %s lost: %s\", color=red, fontcolor=red, style=dotted];",
+				sent[e.Call], current(e.Server), n, e.Method, strings.ReplaceAll(e.Detail, "\"", "'")))
+		}
+	}
+
+	who := make([]int, 0, len(columns))
+	for i := range columns {
+		who = append(who, i)
+	}
+	sort.Ints(who)
+	for _, i := range who {
+		c := columns[i]
+		if i == coordinator {
+			fmt.Fprintf(&b, "\tsubgraph cluster_coordinator {\n\t\tlabel=\"coordinator\";\n")
+		} else {
+			fmt.Fprintf(&b, "\tsubgraph cluster_server%d {\n\t\tlabel=\"server %d\";\n", i, i)
+		}
+		for j, node := range c.nodes {
+			fmt.Fprintf(&b, "\t\t%s [label=\"%s\"];\n", node, c.labels[j])
+			if j > 0 {
+				fmt.Fprintf(&b, "\t\t%s -> %s [style=bold, weight=10];\n", c.nodes[j-1], node)
+			}
+		}
+		fmt.Fprintf(&b, "\t}\n")
+	}
+	for _, edge := range edges {
+		fmt.Fprintln(&b, edge)
+	}
+	fmt.Fprintf(&b, "}\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,110 @@
+package commit
+
+import (
+	"3PhaseCommit/labrpc"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a PeerClient whose first call to method fails without being sent.
+type losingPeer struct {
+	PeerClient
+	method string
+	lost   bool
+}
+
+func (p *losingPeer) CallErr(svcMeth string, meta Metadata, args interface{}, reply interface{}) error {
+	if svcMeth == p.method && !p.lost {
+		p.lost = true
+		return errors.New("lost in a test")
+	}
+	return p.PeerClient.CallErr(svcMeth, meta, args, reply)
+}
+
+// Commits a transaction whose first PreCommit to server 1 is lost, with its history recorded
+// The events should follow the protocol, and its DOT diagram should show each party's states
+// and the numbered messages between them, including the lost one
+func TestHistoryDOT(t *testing.T) {
+	t.Parallel()
+
+	h := MakeHistory()
+	net := labrpc.MakeNetwork()
+	defer net.Cleanup()
+	tr := makeLabrpcTransport(net)
+	var peers []PeerClient
+	for i, keys := range [][]string{{"x"}, {"y"}} {
+		sv := MakeServer(keys, MakePersister())
+		defer sv.Kill()
+		name := []string{"server0", "server1"}[i]
+		tr.Serve(name, sv)
+		end, _ := tr.Dial(name)
+		if i == 1 {
+			end = &losingPeer{PeerClient: end, method: "Server.PreCommit"}
+		}
+		peers = append(peers, h.RecordCalls(end, i))
+		sv.Set(0, keys[0], i)
+	}
+	respChan := make(chan ResponseMsg)
+	co := MakeCoordinator(peers, respChan)
+	defer co.Kill()
+	h.WatchCoordinator(co)
+
+	co.FinishTransaction(0)
+	select {
+	case m := <-respChan:
+		if !m.committed {
+			t.Fatalf("expected transaction 0 to commit, got %+v", m)
+		}
+	case <-time.After(waitTimeout):
+		t.Fatalf("Transaction 0 got no response within %v", waitTimeout)
+	}
+
+	lost := false
+	for _, e := range h.Events(0) {
+		if e.Kind == HistoryLost {
+			if e.Server != 1 || e.Method != "PreCommit" {
+				t.Fatalf("expected only server 1's PreCommit to be lost, got %+v", e)
+			}
+			lost = true
+		}
+	}
+	if !lost {
+		t.Fatalf("the lost PreCommit isn't in the history")
+	}
+
+	var b strings.Builder
+	if err := h.WriteDOT(&b, 0); err != nil {
+		t.Fatalf("WriteDOT: %v", err)
+	}
+	dot := b.String()
+	for _, want := range []string{
+		`digraph "transaction 0" {`,
+		`c0 [label="Prepare"];`,
+		`c1 [label="PreCommit"];`,
+		`c2 [label="Committed"];`,
+		`s0_0 [label="start"];`,
+		`s0_1 [label="VotedYes"];`,
+		`s0_2 [label="PreCommitted"];`,
+		`s0_3 [label="Committed"];`,
+		`s1_1 [label="VotedYes"];`,
+		`c0 -> s1_1 [label="`,
+		`s1_1 -> c0 [label="`,
+		`c1 -> s1_1 [label="`,
+		`PreCommit lost: lost in a test", color=red`,
+		`s1_2 -> c1 [label="`,
+		`c2 -> s1_3 [label="`,
+	} {
+		if !strings.Contains(dot, want) {
+			t.Fatalf("expected the diagram to contain %q:\n%s", want, dot)
+		}
+	}
+	if !strings.HasSuffix(dot, "}\n") {
+		t.Fatalf("the diagram isn't closed:\n%s", dot)
+	}
+
+	if err := h.WriteDOT(&b, 1); err == nil {
+		t.Fatalf("expected WriteDOT to fail for a transaction with no history")
+	}
+}
@@ -0,0 +1,78 @@
+package commit
+
+//
+// which of a server's keys transactions wait for, to find the hot
+// keys that make a workload block or abort:
+//
+//   for _, k := range sv.HotKeys(5) {
+//       fmt.Printf("%s: %d waits, %v in all, %d aborts\n", k.Key, k.Waits, k.WaitTime, k.Aborts)
+//   }
+//
+// a Prepare that finds a key's lock held counts a wait on that key,
+// and how long it waited for it. a transaction aborted while its
+// Prepare was acquiring locks counts an abort on every key it
+// waited for. the counts are in memory only, and start over when
+// the server restarts.
+//
+
+import (
+	"sort"
+	"time"
+)
+
+type KeyContention struct {
+	Key      string
+	Waits    int           // Prepares that found the key's lock held
+	WaitTime time.Duration // how long they waited for it, in all
+	MaxWait  time.Duration // the longest one waited
+	Aborts   int           // transactions aborted after waiting for it
+}
+
+// note that a Prepare waited d for key's lock; sv.mu must be held.
+func (sv *Server) noteWaitLocked(key string, d time.Duration) {
+	kc, ok := sv.contention[key]
+	if !ok {
+		kc = &KeyContention{Key: key}
+		sv.contention[key] = kc
+	}
+	kc.Waits++
+	kc.WaitTime += d
+	if d > kc.MaxWait {
+		kc.MaxWait = d
+	}
+}
+
+// note that a transaction that waited for keys was aborted; sv.mu
+// must be held.
+func (sv *Server) noteAbortLocked(keys []string) {
+	for _, key := range keys {
+		if kc, ok := sv.contention[key]; ok {
+			kc.Aborts++
+		}
+	}
+}
+
+// the n keys transactions waited longest for, longest first; every
+// key that was waited for if n <= 0.
+func (sv *Server) HotKeys(n int) []KeyContention {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	keys := make([]KeyContention, 0, len(sv.contention))
+	for _, kc := range sv.contention {
+		keys = append(keys, *kc)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].WaitTime != keys[j].WaitTime {
+			return keys[i].WaitTime > keys[j].WaitTime
+		}
+		if keys[i].Waits != keys[j].Waits {
+			return keys[i].Waits > keys[j].Waits
+		}
+		return keys[i].Key < keys[j].Key
+	})
+	if n > 0 && n < len(keys) {
+		keys = keys[:n]
+	}
+	return keys
+}
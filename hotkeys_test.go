@@ -0,0 +1,80 @@
+package commit
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Makes one transaction wait for a key held by another and get aborted while
+// it waits, and a third wait briefly for a second key
+// HotKeys should rank the first key above the second, with its wait and abort,
+// and leave out the key nothing waited for
+func TestHotKeys(t *testing.T) {
+	t.Parallel()
+
+	sv := MakeServer([]string{"hot", "warm", "cold"}, MakePersister())
+	defer sv.Kill()
+	prepare := func(tid int) chan bool {
+		voted := make(chan bool, 1)
+		go func() {
+			reply := &PrepareReply{}
+			sv.Prepare(Metadata{}, &RPCArgs{Tid: tid}, reply)
+			voted <- reply.Vote
+		}()
+		// wait until it's acquiring its locks, so its waits are timed from here
+		for !sv.debugState().Transactions[strconv.Itoa(tid)].Preparing {
+			select {
+			case v := <-voted:
+				voted <- v
+				return voted
+			default:
+				time.Sleep(time.Millisecond)
+			}
+		}
+		return voted
+	}
+
+	// 0 holds hot, and 1 waits for it until aborted and 0 commits
+	sv.Set(0, "hot", 1)
+	if !<-prepare(0) {
+		t.Fatalf("transaction 0 voted No")
+	}
+	sv.Set(1, "cold", 1)
+	sv.Set(1, "hot", 2)
+	voted1 := prepare(1)
+	time.Sleep(50 * time.Millisecond)
+	sv.Abort(Metadata{}, &RPCArgs{Tid: 1}, &struct{}{})
+	sv.PreCommit(Metadata{}, &RPCArgs{Tid: 0}, &PreCommitReply{})
+	sv.Commit(Metadata{}, &RPCArgs{Tid: 0}, &CommitReply{})
+	if <-voted1 {
+		t.Fatalf("transaction 1 voted Yes after it was aborted")
+	}
+
+	// 2 holds warm, and 3 waits for it until 2 aborts
+	sv.Get(2, "warm")
+	if !<-prepare(2) {
+		t.Fatalf("transaction 2 voted No")
+	}
+	sv.Set(3, "warm", 3)
+	voted3 := prepare(3)
+	time.Sleep(10 * time.Millisecond)
+	sv.Abort(Metadata{}, &RPCArgs{Tid: 2}, &struct{}{})
+	if !<-voted3 {
+		t.Fatalf("transaction 3 voted No")
+	}
+
+	keys := sv.HotKeys(0)
+	if len(keys) != 2 || keys[0].Key != "hot" || keys[1].Key != "warm" {
+		t.Fatalf("expected hot then warm, got %+v", keys)
+	}
+	if hot := keys[0]; hot.Waits != 1 || hot.Aborts != 1 || hot.WaitTime < 50*time.Millisecond || hot.MaxWait != hot.WaitTime {
+		t.Fatalf("expected one wait of at least 50ms and one abort on hot, got %+v", hot)
+	}
+	if warm := keys[1]; warm.Waits != 1 || warm.Aborts != 0 || warm.WaitTime < 10*time.Millisecond {
+		t.Fatalf("expected one wait of at least 10ms and no abort on warm, got %+v", warm)
+	}
+	if top := sv.HotKeys(1); len(top) != 1 || top[0].Key != "hot" {
+		t.Fatalf("expected HotKeys(1) to be just hot, got %+v", top)
+	}
+}
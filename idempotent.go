@@ -0,0 +1,162 @@
+package commit
+
+//
+// calls that are safe to resend. WithRetries wraps a PeerClient so
+// that each call carries a request ID, and is resent with the same
+// ID until it succeeds or the RetryPolicy gives up:
+//
+//   peer, err := t.Dial("server0")
+//   peer = WithRetries(peer, DefaultRetryPolicy())
+//   err = peer.CallErr("Server.Prepare", meta, &args, &reply)
+//
+// a Server remembers the replies to recent request IDs, so a handler
+// runs at most once per ID however often the request is delivered:
+// a resend, or a duplicate made by the network, gets the first
+// delivery's reply, waiting for it if that handler hasn't returned
+// yet. a call made again through CallErr is a new request with a new
+// ID, and runs again.
+//
+// the replies are kept in memory only, for the last replyCacheSize
+// requests; after a crash, a resend runs the handler again, which
+// the protocol's handlers tolerate anyway.
+//
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the request ID key in a call's Metadata, set by WithRetries.
+const MetaRequest = "request"
+
+// how many requests' replies a Server remembers.
+const replyCacheSize = 1024
+
+// how often, and how patiently, WithRetries resends a call.
+type RetryPolicy struct {
+	Attempts   int           // sends per call, including the first; 0 for no limit
+	MinBackoff time.Duration // wait before the first resend, doubling each time
+	MaxBackoff time.Duration
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		Attempts:   5,
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 500 * time.Millisecond,
+	}
+}
+
+// a PeerClient that gives each call a request ID and resends it
+// on transient failures.
+type retryingPeer struct {
+	peer   PeerClient
+	policy RetryPolicy
+}
+
+// wrap peer so that its calls are resent, under the same request
+// ID, until they succeed, fail with an error resending can't fix
+// (ErrMessageTooLarge, ErrUnsupportedMethod), or have been sent
+// policy.Attempts times.
+// Send() is passed through unchanged.
+func WithRetries(peer PeerClient, policy RetryPolicy) PeerClient {
+	return &retryingPeer{peer: peer, policy: policy}
+}
+
+func (rp *retryingPeer) Call(svcMeth string, args interface{}, reply interface{}) bool {
+	return rp.CallErr(svcMeth, nil, args, reply) == nil
+}
+
+func (rp *retryingPeer) CallMeta(svcMeth string, meta Metadata, args interface{}, reply interface{}) bool {
+	return rp.CallErr(svcMeth, meta, args, reply) == nil
+}
+
+func (rp *retryingPeer) CallErr(svcMeth string, meta Metadata, args interface{}, reply interface{}) error {
+	m := make(Metadata, len(meta)+1)
+	for k, v := range meta {
+		m[k] = v
+	}
+	if m[MetaRequest] == "" {
+		m[MetaRequest] = newTrace()
+	}
+
+	var backoff time.Duration
+	for attempt := 1; ; attempt++ {
+		err := rp.peer.CallErr(svcMeth, m, args, reply)
+		if err == nil || errors.Is(err, ErrMessageTooLarge) || errors.Is(err, ErrUnsupportedMethod) {
+			return err
+		}
+		if rp.policy.Attempts > 0 && attempt >= rp.policy.Attempts {
+			return err
+		}
+		if backoff == 0 {
+			backoff = rp.policy.MinBackoff
+		} else {
+			backoff = min(2*backoff, rp.policy.MaxBackoff)
+		}
+		time.Sleep(backoff)
+	}
+}
+
+func (rp *retryingPeer) Send(svcMeth string, args interface{}) {
+	rp.peer.Send(svcMeth, args)
+}
+
+// a Server's replies to recent requests, by method and request ID.
+type replyCache struct {
+	mu      sync.Mutex
+	replies map[string]*cachedReply
+	order   []string     // keys, oldest first
+	calls   atomic.Int64 // handler calls, replayed or not
+	replays atomic.Int64 // calls that got an earlier delivery's reply
+}
+
+type cachedReply struct {
+	done  chan struct{} // closed once reply is set
+	reply reflect.Value // a copy of what the handler replied
+}
+
+func makeReplyCache() *replyCache {
+	return &replyCache{replies: make(map[string]*cachedReply)}
+}
+
+// called as a handler starts. if meta's request ID has been seen
+// before, waits for that request's handler to return, copies its
+// reply into reply, and returns true: the handler should return at
+// once. otherwise the handler must call finish() as it returns, once
+// reply is final. calls without a request ID are never replayed.
+func (rc *replyCache) start(method string, meta Metadata, reply interface{}) (finish func(), replayed bool) {
+	rc.calls.Add(1)
+	id := meta[MetaRequest]
+	if id == "" {
+		return func() {}, false
+	}
+	key := method + " " + id
+
+	rc.mu.Lock()
+	if cr, ok := rc.replies[key]; ok {
+		rc.mu.Unlock()
+		rc.replays.Add(1)
+		<-cr.done
+		reflect.ValueOf(reply).Elem().Set(cr.reply)
+		return nil, true
+	}
+	cr := &cachedReply{done: make(chan struct{})}
+	rc.replies[key] = cr
+	rc.order = append(rc.order, key)
+	if len(rc.order) > replyCacheSize {
+		delete(rc.replies, rc.order[0])
+		rc.order = rc.order[1:]
+	}
+	rc.mu.Unlock()
+
+	return func() {
+		v := reflect.ValueOf(reply).Elem()
+		cr.reply = reflect.New(v.Type()).Elem()
+		cr.reply.Set(v)
+		close(cr.done)
+	}, false
+}
@@ -0,0 +1,107 @@
+package commit
+
+import (
+	"3PhaseCommit/labrpc"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Loses the replies to the first two Prepares and delivers every request twice
+// The retrying client should get a Yes vote in the end, with the Prepare handler
+// having run once, while a second call with a new request ID runs again
+func TestIdempotentCalls(t *testing.T) {
+	t.Parallel()
+
+	net := labrpc.MakeNetwork()
+	defer net.Cleanup()
+
+	var mu sync.Mutex
+	delivered := make(map[string]int) // method : deliveries
+	ran := make(map[string]int)       // method : handler runs
+	net.RegisterInterceptor(func(svcMeth string, endname interface{}) *labrpc.Fault {
+		mu.Lock()
+		defer mu.Unlock()
+		delivered[svcMeth]++
+		return &labrpc.Fault{Duplicate: true, DropReply: svcMeth == "Server.Prepare" && delivered[svcMeth] <= 2}
+	})
+
+	sv := MakeServer([]string{"x"}, MakePersister())
+	defer sv.Kill()
+	sv.setHook(func(point hookPoint, method string, tid int, meta Metadata) {
+		if point == hookBefore {
+			mu.Lock()
+			ran[method]++
+			mu.Unlock()
+		}
+	})
+	tr := makeLabrpcTransport(net)
+	tr.Serve("server0", sv)
+	end, _ := tr.Dial("server0")
+	peer := WithRetries(end, RetryPolicy{Attempts: 10, MinBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond})
+
+	sv.Set(0, "x", 1)
+	var reply PrepareReply
+	if err := peer.CallErr("Server.Prepare", Metadata{MetaTid: "0"}, &RPCArgs{Tid: 0}, &reply); err != nil {
+		t.Fatalf("Prepare failed: %v", err)
+	}
+	if !reply.Relevant || !reply.Vote {
+		t.Fatalf("expected a Yes vote, got %+v", reply)
+	}
+	mu.Lock()
+	if delivered["Server.Prepare"] != 3 || ran["Server.Prepare"] != 1 {
+		t.Fatalf("Prepare was delivered %d times and ran %d times; expected 3 and 1",
+			delivered["Server.Prepare"], ran["Server.Prepare"])
+	}
+	mu.Unlock()
+
+	for i := 0; i < 2; i++ {
+		var reply PreCommitReply
+		if !peer.CallMeta("Server.PreCommit", Metadata{MetaTid: "0"}, &RPCArgs{Tid: 0}, &reply) {
+			t.Fatalf("PreCommit failed")
+		}
+	}
+	mu.Lock()
+	if ran["Server.PreCommit"] != 2 {
+		t.Fatalf("two PreCommit calls ran %d times; expected 2", ran["Server.PreCommit"])
+	}
+	mu.Unlock()
+
+	// a message that can't fit is never resent
+	net.SetMaxMessageSize(1)
+	mu.Lock()
+	before := delivered["Server.Commit"]
+	mu.Unlock()
+	if err := peer.CallErr("Server.Commit", nil, &RPCArgs{Tid: 0}, &CommitReply{}); err != ErrMessageTooLarge {
+		t.Fatalf("expected ErrMessageTooLarge, got %v", err)
+	}
+	mu.Lock()
+	if n := delivered["Server.Commit"] - before; n > 1 {
+		t.Fatalf("an oversized Commit was sent %d times", n)
+	}
+	mu.Unlock()
+
+	// nor is one the transport refuses, however the error is wrapped
+	for _, want := range []error{fmt.Errorf("%w: wrapped", ErrMessageTooLarge), ErrUnsupportedMethod} {
+		failing := &failingPeer{PeerClient: end, err: want}
+		err := WithRetries(failing, RetryPolicy{Attempts: 10, MinBackoff: time.Millisecond}).CallErr("Server.Commit", nil, &RPCArgs{Tid: 0}, &CommitReply{})
+		if !errors.Is(err, want) || failing.calls.Load() != 1 {
+			t.Fatalf("expected %v after 1 send, got %v after %d", want, err, failing.calls.Load())
+		}
+	}
+}
+
+// fails every call with err.
+type failingPeer struct {
+	PeerClient
+	err   error
+	calls atomic.Int32
+}
+
+func (p *failingPeer) CallErr(svcMeth string, meta Metadata, args interface{}, reply interface{}) error {
+	p.calls.Add(1)
+	return p.err
+}
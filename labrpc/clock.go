@@ -0,0 +1,178 @@
+package labrpc
+
+//
+// the network's time: how long it delays requests and replies,
+// and when a lost request times out. by default the network
+// sleeps and sets timers in real time; net.SetClock(clock) makes
+// it use a VirtualClock instead, which only moves when the test
+// steps it:
+//
+//   clock := MakeVirtualClock()
+//   net.SetClock(clock)
+//   clock.BlockUntil(1)        -- wait until a message is waiting on the clock
+//   clock.Advance(time.Second) -- run every timer due within the next second
+//   clock.Step()               -- jump to the next timer and run it
+//
+// a delay of any length then costs no real time, and with a
+// seeded network (net.Seed()) a test that only steps the clock
+// once the messages it expects are waiting on it sees the same
+// delays, losses and reorderings on every run. the network still
+// measures latency for its statistics and observers in real time,
+// and still checks in real time whether a server was deleted
+// while its handler ran.
+//
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	// run f once d has passed. f mustn't block, since a
+	// VirtualClock runs it in the goroutine that steps the clock.
+	AfterFunc(d time.Duration, f func())
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) {
+	time.AfterFunc(d, f)
+}
+
+// a Clock whose time only moves when Advance() or Step() is
+// called. timers run in order of their deadlines, and timers with
+// the same deadline in the order they were set, each once the one
+// before it has returned.
+type VirtualClock struct {
+	mu     sync.Mutex
+	cond   *sync.Cond // broadcast when a timer is set
+	now    time.Time
+	timers []*virtualTimer // sorted by when, then by when they were set
+}
+
+type virtualTimer struct {
+	when time.Time
+	f    func()
+}
+
+func MakeVirtualClock() *VirtualClock {
+	c := &VirtualClock{now: time.Unix(0, 0)}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *VirtualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+// block until the clock has moved on by d.
+func (c *VirtualClock) Sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	woken := make(chan struct{})
+	c.AfterFunc(d, func() { close(woken) })
+	<-woken
+}
+
+func (c *VirtualClock) AfterFunc(d time.Duration, f func()) {
+	if d <= 0 {
+		f()
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &virtualTimer{when: c.now.Add(d), f: f}
+	i := sort.Search(len(c.timers), func(i int) bool {
+		return c.timers[i].when.After(t.when)
+	})
+	c.timers = append(c.timers, nil)
+	copy(c.timers[i+1:], c.timers[i:])
+	c.timers[i] = t
+	c.cond.Broadcast()
+}
+
+// move the clock forward by d, running every timer due by then.
+// a negative d is ignored: virtual time never runs backwards.
+func (c *VirtualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	target := c.now
+	if d > 0 {
+		target = c.now.Add(d)
+	}
+	c.mu.Unlock()
+
+	for c.fireNext(target) {
+	}
+
+	c.mu.Lock()
+	c.now = target
+	c.mu.Unlock()
+}
+
+// move the clock to the earliest timer and run it. returns false,
+// without moving the clock, if no timer is set.
+func (c *VirtualClock) Step() bool {
+	c.mu.Lock()
+	if len(c.timers) == 0 {
+		c.mu.Unlock()
+		return false
+	}
+	when := c.timers[0].when
+	c.mu.Unlock()
+
+	return c.fireNext(when)
+}
+
+// run the earliest timer if it is due by target, moving the
+// clock to its deadline.
+func (c *VirtualClock) fireNext(target time.Time) bool {
+	c.mu.Lock()
+	if len(c.timers) == 0 || c.timers[0].when.After(target) {
+		c.mu.Unlock()
+		return false
+	}
+	t := c.timers[0]
+	c.timers = c.timers[1:]
+	c.now = t.when
+	c.mu.Unlock()
+
+	t.f()
+	return true
+}
+
+// the number of timers set and not yet run, including
+// the messages sleeping on the clock.
+func (c *VirtualClock) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.timers)
+}
+
+// block until at least n timers are set, e.g. until the messages
+// the test expects are all waiting on the clock.
+func (c *VirtualClock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.timers) < n {
+		c.cond.Wait()
+	}
+}
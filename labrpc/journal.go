@@ -0,0 +1,171 @@
+package labrpc
+
+//
+// a record of what happened to each end's recent messages, so that
+// a failing test can show which message was lost rather than leave
+// it to guesswork:
+//
+//   net.SetJournal(64)          -- keep each end's last 64 messages
+//   net.Journal(endname)        -- an end's entries, oldest first
+//   net.DumpJournals(os.Stdout) -- every end's entries, e.g. on failure
+//
+// each request, reply and stream chunk gets an entry as its fate is
+// decided: its method, direction, encoded size, and whether it was
+// delivered, dropped, timed out, refused as too large, or lost
+// because the server was deleted. entries are stamped with the
+// network's clock, so they follow a VirtualClock's time. the
+// journal is off, and costs nothing, until SetJournal() is called.
+//
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+type Direction int
+
+const (
+	Request Direction = iota
+	Reply
+	Chunk
+)
+
+func (d Direction) String() string {
+	switch d {
+	case Request:
+		return "request"
+	case Reply:
+		return "reply"
+	case Chunk:
+		return "chunk"
+	}
+	return fmt.Sprintf("Direction(%d)", int(d))
+}
+
+type Outcome int
+
+const (
+	Delivered  Outcome = iota
+	Dropped            // lost by an unreliable network or a Fault
+	TimedOut           // the end was disabled or unconnected, or its replies were
+	TooLarge           // refused by SetMaxMessageSize()
+	ServerDead         // the server was deleted before it could reply
+)
+
+func (o Outcome) String() string {
+	switch o {
+	case Delivered:
+		return "delivered"
+	case Dropped:
+		return "dropped"
+	case TimedOut:
+		return "timed out"
+	case TooLarge:
+		return "too large"
+	case ServerDead:
+		return "server dead"
+	}
+	return fmt.Sprintf("Outcome(%d)", int(o))
+}
+
+type JournalEntry struct {
+	Time       time.Time
+	SvcMeth    string
+	Servername interface{} // the server the end was connected to; nil if none
+	Dir        Direction
+	Bytes      int // the encoded args, reply or chunk; 0 if there was none
+	Outcome    Outcome
+}
+
+func (je JournalEntry) String() string {
+	return fmt.Sprintf("%s %s to %v: %s of %d bytes %s",
+		je.Time.Format("15:04:05.000000"), je.SvcMeth, je.Servername, je.Dir, je.Bytes, je.Outcome)
+}
+
+// an end's last entries, in a ring.
+type journal struct {
+	entries []JournalEntry
+	next    int // where the next entry goes
+	full    bool
+}
+
+func (j *journal) add(e JournalEntry) {
+	j.entries[j.next] = e
+	j.next = (j.next + 1) % len(j.entries)
+	if j.next == 0 {
+		j.full = true
+	}
+}
+
+func (j *journal) list() []JournalEntry {
+	if !j.full {
+		return append([]JournalEntry(nil), j.entries[:j.next]...)
+	}
+	return append(append([]JournalEntry(nil), j.entries[j.next:]...), j.entries[:j.next]...)
+}
+
+// keep the last n messages of each end, forgetting those already
+// kept; 0 turns the journal off.
+func (rn *Network) SetJournal(n int) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.journalSize = n
+	rn.journals = map[interface{}]*journal{}
+}
+
+// note what happened to one of req's messages, of n bytes.
+func (rn *Network) record(req reqMsg, dir Direction, n int, outcome Outcome) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	if rn.journalSize <= 0 {
+		return
+	}
+	j, ok := rn.journals[req.endname]
+	if !ok {
+		j = &journal{entries: make([]JournalEntry, rn.journalSize)}
+		rn.journals[req.endname] = j
+	}
+	j.add(JournalEntry{
+		Time:       rn.clock.Now(),
+		SvcMeth:    req.svcMeth,
+		Servername: rn.connections[req.endname],
+		Dir:        dir,
+		Bytes:      n,
+		Outcome:    outcome,
+	})
+}
+
+// endname's entries, oldest first.
+func (rn *Network) Journal(endname interface{}) []JournalEntry {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	if j, ok := rn.journals[endname]; ok {
+		return j.list()
+	}
+	return nil
+}
+
+// write every end's entries to w, end by end.
+func (rn *Network) DumpJournals(w io.Writer) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	var endnames []interface{}
+	for endname := range rn.journals {
+		endnames = append(endnames, endname)
+	}
+	sort.Slice(endnames, func(i, j int) bool {
+		return fmt.Sprint(endnames[i]) < fmt.Sprint(endnames[j])
+	})
+	for _, endname := range endnames {
+		fmt.Fprintf(w, "end %v:\n", endname)
+		for _, e := range rn.journals[endname].list() {
+			fmt.Fprintf(w, "  %v\n", e)
+		}
+	}
+}
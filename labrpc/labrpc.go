@@ -14,6 +14,7 @@ package labrpc
 //
 // sends labgob-encoded values to ensure that RPCs
 // don't include references to program objects.
+// net.SetCodec(c) encodes them with another codec.Codec instead.
 //
 // net := MakeNetwork() -- holds network, clients, servers.
 // end := net.MakeEnd(endname) -- create a client end-point, to talk to one server.
@@ -21,7 +22,30 @@ package labrpc
 // net.DeleteServer(servername) -- eliminate the named server.
 // net.Connect(endname, servername) -- connect a client to a server.
 // net.Enable(endname, enabled) -- enable/disable a client.
+// net.EnableDirections(endname, requests, replies) -- like Enable(), but for
+//   each direction alone, e.g. requests reach the server but replies are lost
 // net.Reliable(bool) -- false means drop/delay messages
+// net.SetCodec(c) -- encode args, replies and chunks with c; codec.Gob by default
+// net.SetMaxMessageSize(n) -- refuse args, replies and chunks of more than n
+//   encoded bytes; the call fails with ErrMessageTooLarge rather than ErrNoReply
+// net.SetLatency(endname, d) -- delay every request on a client by d
+// net.SetClock(clock) -- take delays and timeouts from clock, e.g. a
+//   VirtualClock the test steps, rather than sleeping; see clock.go
+// net.SetEndBandwidth(endname, n) / net.SetServerBandwidth(servername, n) --
+//   carry at most n bytes per second of requests, replies and chunks on a
+//   client's or server's link, so large messages queue behind each other
+// net.SetPriority(svcMeth, High) -- put svcMeth's requests, replies and chunks
+//   in the high-priority lane: on a bandwidth-limited link they wait only
+//   behind other high-priority messages, and a paused server runs the
+//   high-priority requests it held before the rest once it resumes
+// net.SetJournal(n) -- keep a record of each end's last n messages and what
+//   happened to them, for net.DumpJournals(w) to show; see journal.go
+// net.RegisterInterceptor(f) -- f may drop, duplicate, delay or rewrite a request or reply
+// net.RegisterObserver(f) -- f sees every request's outcome, e.g. for a timeline
+// net.RegisterMessageCallback(f) -- f sees copies of each request's args as it is
+//   sent and delivered, and of its reply, and may change what the other side gets
+// net.GetStats() -- RPCs and bytes sent to each server, per method
+// net.GetMethodStats() -- RPCs, bytes, failures and latency per method, over all servers
 //
 // end.Call("Raft.AppendEntries", &args, &reply) -- send an RPC, wait for reply.
 // the "Raft" is the name of the server struct to be called.
@@ -40,9 +64,43 @@ package labrpc
 // as pointers, so that their types exactly match the types of the arguments
 // to Call().
 //
+// end.CallMeta("Raft.AppendEntries", meta, &args, &reply) -- like Call(),
+// but also carries meta, an opaque map[string]string such as a trace ID.
+// a handler that wants it declares it before args:
+//   func (rf *Raft) AppendEntries(meta map[string]string, args *AppendEntriesArgs, reply *AppendEntriesReply)
+// other handlers never see it. Call() sends an empty map.
+//
+// end.CallTimeout("Raft.AppendEntries", &args, &reply, d) -- like Call(),
+// but give up after d with a *TimeoutError; CallContext() takes a
+// context instead. they return nil on success, and ErrNoReply where
+// Call() would return false, or ErrLost, which wraps it, where the
+// network dropped the request or reply. CallErr() is like CallMeta(),
+// but returns an error in the same way.
+//
+// end.Send("Raft.Heartbeat", &args) -- send a one-way message and return
+// at once; the network faults it like any request, but the caller never
+// learns whether it arrived. a handler just for such messages declares
+// no reply:
+//   func (rf *Raft) Heartbeat(args *HeartbeatArgs)
+// Send() to a handler with a reply throws the reply away.
+//
+// end.CallStream("Raft.InstallSnapshot", &args, chunks) -- send an RPC
+// whose handler streams back any number of chunks instead of a reply.
+// chunks is a chan of the chunks' type, which CallStream() sends each
+// chunk to as it arrives and closes before returning, so the caller
+// must read it from another goroutine. the handler declares a send
+// function in place of its reply:
+//   func (rf *Raft) InstallSnapshot(args *InstallSnapshotArgs, send func(chunk interface{}) bool)
+// send() returns false once the stream is broken, e.g. the server was
+// deleted or the network lost a chunk, so the handler can stop early.
+// each chunk is dropped and delayed like a reply, so chunks may arrive
+// out of order; CallStream() returns true only if the handler returned
+// and every chunk it sent arrived.
+//
 // srv := MakeServer()
 // srv.AddService(svc) -- a server can have multiple services, e.g. Raft and k/v
 //   pass srv to net.AddServer()
+// srv.Pause() / srv.Resume() -- hold incoming requests, as if the server stalled
 //
 // svc := MakeService(receiverObject) -- obj's methods will handle RPCs
 //   much like Go's rpcs.Register()
@@ -50,9 +108,12 @@ package labrpc
 //
 
 import (
-	"bytes"
-	"3PhaseCommit/labgob"
+	"3PhaseCommit/codec"
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"maps"
 	"math/rand"
 	"reflect"
 	"strings"
@@ -66,36 +127,124 @@ type reqMsg struct {
 	svcMeth  string      // e.g. "Raft.AppendEntries"
 	argsType reflect.Type
 	args     []byte
+	codec    codec.Codec // what args, the reply and any chunks are encoded with
+	meta     Meta        // the caller's metadata; nil if none
+	priority Priority    // set by the network as it takes the request
 	replyCh  chan replyMsg
+
+	// for CallStream(); nil otherwise
+	chunkCh    chan chunkMsg
+	streamDone chan struct{} // closed when CallStream() returns
+	stream     *stream       // set by the network as it delivers the request
+}
+
+// the server's side of a CallStream().
+type stream struct {
+	send func(chunk []byte) bool // hand a chunk to the network; false if the stream is broken
+	sent int32                   // chunks handed to the network, whether or not they arrive
+}
+
+// for a streaming handler called with Call(), or a duplicate
+// request, whose chunks nobody would see.
+func brokenStream() *stream {
+	return &stream{send: func(chunk []byte) bool { return false }}
+}
+
+// one chunk of a stream, or the news that the network lost one.
+type chunkMsg struct {
+	ok    bool
+	chunk []byte
 }
 
+// opaque per-call metadata, e.g. trace IDs, passed to handlers
+// that declare it.
+type Meta = map[string]string
+
+var metaType = reflect.TypeOf(Meta(nil))
+
+// what a streaming handler takes in place of a reply.
+type SendFunc = func(chunk interface{}) bool
+
+var sendType = reflect.TypeOf(SendFunc(nil))
+
 type replyMsg struct {
 	ok    bool
 	reply []byte
+	err   error // why ok is false; nil means ErrNoReply
 }
 
 type ClientEnd struct {
 	endname interface{}   // this end-point's name
-	ch      chan reqMsg   // copy of Network.endCh
-	done    chan struct{} // closed when Network is cleaned up
+	ch      chan reqMsg        // copy of Network.endCh
+	done    chan struct{}      // closed when Network is cleaned up
+	codec   func() codec.Codec // the Network's current codec
 }
 
 // send an RPC, wait for the reply.
 // the return value indicates success; false means that
 // no reply was received from the server.
 func (e *ClientEnd) Call(svcMeth string, args interface{}, reply interface{}) bool {
-	req := reqMsg{}
-	req.endname = e.endname
-	req.svcMeth = svcMeth
-	req.argsType = reflect.TypeOf(args)
-	req.replyCh = make(chan replyMsg)
+	return e.CallMeta(svcMeth, nil, args, reply)
+}
 
-	qb := new(bytes.Buffer)
-	qe := labgob.NewEncoder(qb)
-	if err := qe.Encode(args); err != nil {
-		panic(err)
-	}
-	req.args = qb.Bytes()
+// like Call(), but hand meta to the handler along with args.
+func (e *ClientEnd) CallMeta(svcMeth string, meta Meta, args interface{}, reply interface{}) bool {
+	return e.call(context.Background(), svcMeth, meta, args, reply) == nil
+}
+
+// like Call(), but give up once ctx is done, returning a
+// *TimeoutError, rather than waiting for however long the network
+// takes to fail. returns nil if the reply arrived, ErrLost if the
+// network dropped the request or reply, and ErrNoReply if the end is
+// disabled or the server is down.
+// the request may still reach the handler after a timeout.
+func (e *ClientEnd) CallContext(ctx context.Context, svcMeth string, args interface{}, reply interface{}) error {
+	return e.call(ctx, svcMeth, nil, args, reply)
+}
+
+// like CallMeta(), but return an error as CallContext() does.
+func (e *ClientEnd) CallErr(svcMeth string, meta Meta, args interface{}, reply interface{}) error {
+	return e.call(context.Background(), svcMeth, meta, args, reply)
+}
+
+// like CallContext(), with a context that times out after d.
+func (e *ClientEnd) CallTimeout(svcMeth string, args interface{}, reply interface{}, d time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	return e.CallContext(ctx, svcMeth, args, reply)
+}
+
+// returned by CallContext() when no reply arrived because the end
+// is disabled or the server is down; wrapped by ErrLost when the
+// network lost the request or reply.
+var ErrNoReply = errors.New("labrpc: no reply")
+
+// returned by CallContext() when the network dropped the request or
+// the reply, as an unreliable network or a Fault does, rather than
+// the end being disabled or the server down. it wraps ErrNoReply.
+var ErrLost = fmt.Errorf("%w: message lost", ErrNoReply)
+
+// returned by CallContext() when the args or the reply were bigger
+// than SetMaxMessageSize() allows, so the network refused them.
+var ErrMessageTooLarge = errors.New("labrpc: message too large")
+
+// returned by CallContext() when ctx was done before a reply
+// arrived.
+type TimeoutError struct {
+	SvcMeth string
+	Err     error // ctx.Err(), e.g. context.DeadlineExceeded
+}
+
+func (te *TimeoutError) Error() string {
+	return fmt.Sprintf("labrpc: %s: %v", te.SvcMeth, te.Err)
+}
+
+func (te *TimeoutError) Unwrap() error {
+	return te.Err
+}
+
+func (e *ClientEnd) call(ctx context.Context, svcMeth string, meta Meta, args interface{}, reply interface{}) error {
+	req := e.makeReq(svcMeth, meta, args)
 
 	//
 	// send the request.
@@ -105,52 +254,235 @@ func (e *ClientEnd) Call(svcMeth string, args interface{}, reply interface{}) bo
 		// the request has been sent.
 	case <-e.done:
 		// entire Network has been destroyed.
-		return false
+		return ErrNoReply
+	case <-ctx.Done():
+		return &TimeoutError{svcMeth, ctx.Err()}
 	}
 
 	//
 	// wait for the reply.
 	//
-	rep := <-req.replyCh
+	var rep replyMsg
+	select {
+	case rep = <-req.replyCh:
+	case <-ctx.Done():
+		// replyCh has room for the reply, if it ever comes
+		return &TimeoutError{svcMeth, ctx.Err()}
+	}
 	if rep.ok {
-		rb := bytes.NewBuffer(rep.reply)
-		rd := labgob.NewDecoder(rb)
-		if err := rd.Decode(reply); err != nil {
+		if err := req.codec.Unmarshal(rep.reply, reply); err != nil {
 			log.Fatalf("ClientEnd.Call(): decode reply: %v\n", err)
 		}
-		return true
+		return nil
+	} else if rep.err != nil {
+		return rep.err
 	} else {
+		return ErrNoReply
+	}
+}
+
+// send a one-way message, without waiting for it to arrive or for
+// the handler to run.
+func (e *ClientEnd) Send(svcMeth string, args interface{}) {
+	req := e.makeReq(svcMeth, nil, args)
+	// replyCh has room for the reply nobody reads
+	select {
+	case e.ch <- req:
+	case <-e.done:
+	}
+}
+
+// send an RPC to a streaming handler, and send each chunk it
+// streams back to chunks, a chan of the chunks' type, closing it
+// before returning. the return value is true if the handler
+// returned and every chunk arrived.
+func (e *ClientEnd) CallStream(svcMeth string, args interface{}, chunks interface{}) bool {
+	out := reflect.ValueOf(chunks)
+	if out.Kind() != reflect.Chan {
+		log.Fatalf("ClientEnd.CallStream(): chunks is a %v, not a chan\n", out.Type())
+	}
+	defer out.Close()
+
+	req := e.makeReq(svcMeth, nil, args)
+	req.chunkCh = make(chan chunkMsg)
+	req.streamDone = make(chan struct{})
+	defer close(req.streamDone)
+
+	select {
+	case e.ch <- req:
+	case <-e.done:
 		return false
 	}
+
+	// until the reply says how many chunks were sent, and all of
+	// them have arrived or been lost.
+	arrived := 0
+	lost := false
+	replied := false
+	sent := 0
+	for !replied || arrived < sent {
+		select {
+		case rep := <-req.replyCh:
+			if !rep.ok {
+				return false
+			}
+			if err := req.codec.Unmarshal(rep.reply, &sent); err != nil {
+				log.Fatalf("ClientEnd.CallStream(): decode reply: %v\n", err)
+			}
+			replied = true
+		case m := <-req.chunkCh:
+			arrived++
+			if !m.ok {
+				lost = true
+				continue
+			}
+			v := reflect.New(out.Type().Elem())
+			if err := req.codec.Unmarshal(m.chunk, v.Interface()); err != nil {
+				log.Fatalf("ClientEnd.CallStream(): decode chunk: %v\n", err)
+			}
+			out.Send(v.Elem())
+		}
+	}
+	return !lost
+}
+
+func (e *ClientEnd) makeReq(svcMeth string, meta Meta, args interface{}) reqMsg {
+	req := reqMsg{}
+	req.endname = e.endname
+	req.svcMeth = svcMeth
+	req.argsType = reflect.TypeOf(args)
+	req.meta = maps.Clone(meta)
+	req.replyCh = make(chan replyMsg, 1)
+	req.codec = e.codec()
+
+	qb, err := req.codec.Marshal(args)
+	if err != nil {
+		panic(err)
+	}
+	req.args = qb
+	return req
 }
 
 type CallbackFunc func(string, interface{})
 
+// where a message is when a MessageFunc sees it.
+type MessagePoint int
+
+const (
+	AtSend    MessagePoint = iota // as the network takes the request, when a CallbackFunc runs
+	AtDeliver                     // as the request reaches the server, after any faults
+	AtReply                       // as the handler's reply leaves the server
+)
+
+func (p MessagePoint) String() string {
+	switch p {
+	case AtSend:
+		return "send"
+	case AtDeliver:
+		return "deliver"
+	case AtReply:
+		return "reply"
+	}
+	return fmt.Sprintf("MessagePoint(%d)", int(p))
+}
+
+// a message shown to a MessageFunc. Args and Reply are decoded
+// copies, so the caller's and the server's own values are safe.
+type Message struct {
+	Point   MessagePoint
+	SvcMeth string
+	Endname interface{}
+
+	// the args, of the type the caller passed, e.g. *AppendEntriesArgs.
+	// assigning to it, or changing what it points to, changes what
+	// the handler gets.
+	Args interface{}
+
+	// at AtReply, a pointer to the reply, e.g. *AppendEntriesReply,
+	// which the caller gets as changed; nil otherwise, and for
+	// one-way handlers.
+	Reply interface{}
+}
+
+// called with every message at each MessagePoint, e.g. to check
+// what a protocol sends, or to make a server lie.
+type MessageFunc func(m *Message)
+
+// what should happen to a single request, as decided by an InterceptFunc.
+type Fault struct {
+	DropRequest bool          // lose the request; the handler never runs
+	DropReply   bool          // run the handler, but lose its reply
+	Duplicate   bool          // run the handler a second time after the first
+	Delay       time.Duration // hold the request back, letting later ones overtake it
+
+	// replace the request's encoded arguments
+	Rewrite func(args []byte) []byte
+
+	// replace the handler's encoded reply, if it gets one
+	RewriteReply func(reply []byte) []byte
+}
+
+// called with the method and end name of every request that
+// would be delivered. returning nil delivers it normally.
+type InterceptFunc func(svcMeth string, endname interface{}) *Fault
+
+// called as Call() is about to return, with when the network took
+// the request and whether the caller gets a reply.
+type ObserveFunc func(svcMeth string, endname interface{}, start time.Time, ok bool)
+
 type Network struct {
 	mu             sync.Mutex
 	reliable       bool
-	longDelays     bool                        // pause a long time on send on disabled connection
-	longReordering bool                        // sometimes delay replies a long time
-	ends           map[interface{}]*ClientEnd  // ends, by name
-	enabled        map[interface{}]bool        // by end name
-	servers        map[interface{}]*Server     // servers, by name
-	connections    map[interface{}]interface{} // endname -> servername
+	longDelays     bool                          // pause a long time on send on disabled connection
+	longReordering bool                          // sometimes delay replies a long time
+	ends           map[interface{}]*ClientEnd    // ends, by name
+	enabled        map[interface{}]bool          // whether requests get through, by end name
+	replies        map[interface{}]bool          // whether replies get through, by end name
+	servers        map[interface{}]*Server       // servers, by name
+	connections    map[interface{}]interface{}   // endname -> servername
+	latency        map[interface{}]time.Duration // extra per-request delay, by end name
+	endLinks       map[interface{}]*link         // bandwidth limits, by end name
+	serverLinks    map[interface{}]*link         // bandwidth limits, by server name
+	priorities     map[string]Priority           // lanes other than Bulk, by method
 	endCh          chan reqMsg
-	done           chan struct{} // closed when Network is cleaned up
-	count          int32         // total RPC count, for statistics
-	bytes          int64         // total bytes send, for statistics
+	done           chan struct{}       // closed when Network is cleaned up
+	count          int32               // total RPC count, for statistics
+	bytes          int64               // total bytes send, for statistics
+	stats          map[statsKey]*Stats // per server and method, for statistics
+	methodStats    map[string]*MethodStats
 	callbacks      []CallbackFunc
+	messageFuncs   []MessageFunc
+	interceptors   []InterceptFunc
+	observers      []ObserveFunc
+	codec          codec.Codec // protected by mu
+	maxMessage     int         // the most bytes in one message, 0 for no limit; protected by mu
+	clock          Clock       // delays and timeouts; protected by mu
+	randMu         sync.Mutex
+	rand           *rand.Rand // source of all network randomness; protected by randMu
+
+	journalSize int                      // entries kept per end, 0 for no journal; protected by mu
+	journals    map[interface{}]*journal // by end name; protected by mu
 }
 
 func MakeNetwork() *Network {
 	rn := &Network{}
 	rn.reliable = true
+	rn.codec = codec.Gob
+	rn.clock = realClock{}
 	rn.ends = map[interface{}]*ClientEnd{}
 	rn.enabled = map[interface{}]bool{}
+	rn.replies = map[interface{}]bool{}
 	rn.servers = map[interface{}]*Server{}
 	rn.connections = map[interface{}](interface{}){}
+	rn.latency = map[interface{}]time.Duration{}
+	rn.endLinks = map[interface{}]*link{}
+	rn.serverLinks = map[interface{}]*link{}
+	rn.priorities = map[string]Priority{}
+	rn.stats = map[statsKey]*Stats{}
+	rn.methodStats = map[string]*MethodStats{}
 	rn.endCh = make(chan reqMsg)
 	rn.done = make(chan struct{})
+	rn.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
 
 	// single goroutine to handle all ClientEnd.Call()s
 	go func() {
@@ -159,6 +491,7 @@ func MakeNetwork() *Network {
 			case xreq := <-rn.endCh:
 				atomic.AddInt32(&rn.count, 1)
 				atomic.AddInt64(&rn.bytes, int64(len(xreq.args)))
+				rn.addStats(xreq, 1, len(xreq.args))
 				go rn.processReq(xreq)
 			case <-rn.done:
 				return
@@ -176,10 +509,181 @@ func (rn *Network) RegisterCallback(f CallbackFunc) {
 	rn.callbacks = append(rn.callbacks, f)
 }
 
+func (rn *Network) RegisterMessageCallback(f MessageFunc) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.messageFuncs = append(rn.messageFuncs, f)
+}
+
+// show req, and at AtReply its encoded reply, to the
+// MessageFuncs, and return the reply as they left it. req.args
+// becomes the args as they left them. decoding is skipped if
+// there are no MessageFuncs.
+func (rn *Network) showMessage(point MessagePoint, req *reqMsg, server *Server, reply []byte) []byte {
+	rn.mu.Lock()
+	funcs := rn.messageFuncs
+	rn.mu.Unlock()
+	if len(funcs) == 0 {
+		return reply
+	}
+
+	m := &Message{Point: point, SvcMeth: req.svcMeth, Endname: req.endname}
+	args := reflect.New(req.argsType)
+	req.codec.Unmarshal(req.args, args.Interface())
+	m.Args = args.Elem().Interface()
+	if point == AtReply && reply != nil {
+		if replyType := server.replyType(req.svcMeth); replyType != nil {
+			replyv := reflect.New(replyType)
+			req.codec.Unmarshal(reply, replyv.Interface())
+			m.Reply = replyv.Interface()
+		}
+	}
+
+	for _, f := range funcs {
+		f(m)
+	}
+
+	qb, err := req.codec.Marshal(m.Args)
+	if err != nil {
+		panic(err)
+	}
+	req.args = qb
+	if m.Reply != nil {
+		rb, err := req.codec.Marshal(m.Reply)
+		if err != nil {
+			panic(err)
+		}
+		reply = rb
+	}
+	return reply
+}
+
+// seed the network's random delays and drops,
+// so that a failing run can be reproduced.
+func (rn *Network) Seed(seed int64) {
+	rn.randMu.Lock()
+	defer rn.randMu.Unlock()
+
+	rn.rand = rand.New(rand.NewSource(seed))
+}
+
+func (rn *Network) randInt() int {
+	rn.randMu.Lock()
+	defer rn.randMu.Unlock()
+
+	return rn.rand.Int()
+}
+
+func (rn *Network) randIntn(n int) int {
+	rn.randMu.Lock()
+	defer rn.randMu.Unlock()
+
+	return rn.rand.Intn(n)
+}
+
+func (rn *Network) RegisterInterceptor(f InterceptFunc) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.interceptors = append(rn.interceptors, f)
+}
+
+func (rn *Network) RegisterObserver(f ObserveFunc) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.observers = append(rn.observers, f)
+}
+
+// hand the reply to the caller, telling the observers first.
+func (rn *Network) deliver(req reqMsg, start time.Time, reply replyMsg) {
+	rn.mu.Lock()
+	observers := rn.observers
+	rn.finishStatsLocked(req, time.Since(start), reply.ok)
+	rn.mu.Unlock()
+
+	for _, f := range observers {
+		f(req.svcMeth, req.endname, start, reply.ok)
+	}
+	req.replyCh <- reply
+}
+
+// ask the interceptors what to do with a request.
+// the first one to return a Fault wins.
+func (rn *Network) intercept(req reqMsg) *Fault {
+	rn.mu.Lock()
+	interceptors := rn.interceptors
+	rn.mu.Unlock()
+
+	for _, f := range interceptors {
+		if fault := f(req.svcMeth, req.endname); fault != nil {
+			return fault
+		}
+	}
+	return nil
+}
+
 func (rn *Network) Cleanup() {
 	close(rn.done)
 }
 
+// encode the args, replies and chunks of later calls with c.
+func (rn *Network) SetCodec(c codec.Codec) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.codec = c
+}
+
+func (rn *Network) getCodec() codec.Codec {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	return rn.codec
+}
+
+// delay messages and time out lost requests on clock; requests
+// already in flight keep the clock they started with.
+func (rn *Network) SetClock(clock Clock) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.clock = clock
+}
+
+func (rn *Network) getClock() Clock {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	return rn.clock
+}
+
+// refuse args, replies and chunks of more than n bytes, as encoded;
+// 0 lifts the limit.
+func (rn *Network) SetMaxMessageSize(n int) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.maxMessage = n
+}
+
+// whether a message of n bytes is over the limit.
+func (rn *Network) tooLarge(n int) bool {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	return rn.maxMessage > 0 && n > rn.maxMessage
+}
+
+// whether v, encoded with the network's codec, is within the
+// message size limit, e.g. so a server can tell in advance that
+// a reply would be refused.
+func (rn *Network) FitsMessage(v interface{}) bool {
+	b, err := rn.getCodec().Marshal(v)
+	return err == nil && !rn.tooLarge(len(b))
+}
+
 func (rn *Network) Reliable(yes bool) {
 	rn.mu.Lock()
 	defer rn.mu.Unlock()
@@ -201,6 +705,113 @@ func (rn *Network) LongDelays(yes bool) {
 	rn.longDelays = yes
 }
 
+// add a fixed delay to every request sent on endname,
+// on top of any delay from an unreliable network.
+// zero removes the delay.
+func (rn *Network) SetLatency(endname interface{}, d time.Duration) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.latency[endname] = d
+}
+
+func (rn *Network) readLatency(endname interface{}) time.Duration {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	return rn.latency[endname]
+}
+
+// a link that carries bytesPerSec, one message after another.
+type link struct {
+	bytesPerSec   int
+	busyUntil     time.Time // when the messages already on it will have gone
+	highBusyUntil time.Time // when its High messages will have gone
+}
+
+// the lane a message travels in. a High message overtakes the
+// Bulk messages waiting on a link, and on a paused server.
+type Priority int
+
+const (
+	Bulk Priority = iota // the default
+	High
+)
+
+// put every message of svcMeth, e.g. "Server.Abort", in lane p.
+func (rn *Network) SetPriority(svcMeth string, p Priority) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.priorities[svcMeth] = p
+}
+
+func (rn *Network) readPriority(svcMeth string) Priority {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	return rn.priorities[svcMeth]
+}
+
+// carry at most bytesPerSec of the messages on endname;
+// zero removes the limit.
+func (rn *Network) SetEndBandwidth(endname interface{}, bytesPerSec int) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.endLinks[endname] = &link{bytesPerSec: bytesPerSec}
+}
+
+// carry at most bytesPerSec of the messages to and from
+// servername, over all of its ends; zero removes the limit.
+func (rn *Network) SetServerBandwidth(servername interface{}, bytesPerSec int) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.serverLinks[servername] = &link{bytesPerSec: bytesPerSec}
+}
+
+// wait for n bytes to cross the links between endname and
+// servername, behind the messages already on them. a High message
+// waits only behind High messages, and pushes back the Bulk
+// messages that come after it.
+func (rn *Network) throttle(endname interface{}, servername interface{}, n int, p Priority) {
+	rn.mu.Lock()
+	clock := rn.clock
+	now := clock.Now()
+	until := now
+	for _, l := range []*link{rn.endLinks[endname], rn.serverLinks[servername]} {
+		if l == nil || l.bytesPerSec <= 0 {
+			continue
+		}
+		d := time.Duration(n) * time.Second / time.Duration(l.bytesPerSec)
+		var end time.Time
+		if p == High {
+			end = laterOf(l.highBusyUntil, now).Add(d)
+			l.highBusyUntil = end
+			l.busyUntil = laterOf(l.busyUntil, now).Add(d)
+		} else {
+			end = laterOf(l.busyUntil, l.highBusyUntil, now).Add(d)
+			l.busyUntil = end
+		}
+		if end.After(until) {
+			until = end
+		}
+	}
+	rn.mu.Unlock()
+
+	clock.Sleep(until.Sub(now))
+}
+
+func laterOf(t time.Time, ts ...time.Time) time.Time {
+	for _, u := range ts {
+		if u.After(t) {
+			t = u
+		}
+	}
+	return t
+}
+
 func (rn *Network) readEndnameInfo(endname interface{}) (enabled bool,
 	servername interface{}, server *Server, reliable bool, longreordering bool,
 ) {
@@ -217,17 +828,35 @@ func (rn *Network) readEndnameInfo(endname interface{}) (enabled bool,
 	return
 }
 
+func (rn *Network) repliesDisabled(endname interface{}) bool {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	return rn.enabled[endname] && !rn.replies[endname]
+}
+
+// whether a reply from server can no longer reach endname: the
+// server was deleted or replaced, or the end's replies are disabled.
 func (rn *Network) isServerDead(endname interface{}, servername interface{}, server *Server) bool {
 	rn.mu.Lock()
 	defer rn.mu.Unlock()
 
-	if rn.enabled[endname] == false || rn.servers[servername] != server {
+	if rn.replies[endname] == false || rn.servers[servername] != server {
 		return true
 	}
 	return false
 }
 
 func (rn *Network) processReq(req reqMsg) {
+	start := time.Now()
+	clock := rn.getClock()
+	req.priority = rn.readPriority(req.svcMeth)
+	if rn.tooLarge(len(req.args)) {
+		// the sender refuses it at once
+		rn.record(req, Request, len(req.args), TooLarge)
+		rn.deliver(req, start, replyMsg{false, nil, ErrMessageTooLarge})
+		return
+	}
 	enabled, servername, server, reliable, longreordering := rn.readEndnameInfo(req.endname)
 
 	if enabled && servername != nil && server != nil {
@@ -235,20 +864,47 @@ func (rn *Network) processReq(req reqMsg) {
 		for _, cb := range rn.callbacks {
 			cb(req.svcMeth, req.endname)
 		}
+		rn.showMessage(AtSend, &req, server, nil)
 	}
 
 	enabled, servername, server, reliable, longreordering = rn.readEndnameInfo(req.endname)
 
 	if enabled && servername != nil && server != nil {
+		fault := rn.intercept(req)
+		if fault == nil {
+			fault = &Fault{}
+		}
+
+		if fault.Delay > 0 {
+			clock.Sleep(fault.Delay)
+		}
+
+		if fault.DropRequest {
+			rn.record(req, Request, len(req.args), Dropped)
+			rn.deliver(req, start, replyMsg{false, nil, ErrLost})
+			return
+		}
+
+		if fault.Rewrite != nil {
+			req.args = fault.Rewrite(req.args)
+		}
+
+		if d := rn.readLatency(req.endname); d > 0 {
+			// slow link
+			clock.Sleep(d)
+		}
+		rn.throttle(req.endname, servername, len(req.args), req.priority)
+
 		if reliable == false {
 			// short delay
-			ms := (rand.Int() % 27)
-			time.Sleep(time.Duration(ms) * time.Millisecond)
+			ms := (rn.randInt() % 27)
+			clock.Sleep(time.Duration(ms) * time.Millisecond)
 		}
 
-		if reliable == false && (rand.Int()%1000) < 100 {
+		if reliable == false && (rn.randInt()%1000) < 100 {
 			// drop the request, return as if timeout
-			req.replyCh <- replyMsg{false, nil}
+			rn.record(req, Request, len(req.args), Dropped)
+			rn.deliver(req, start, replyMsg{false, nil, ErrLost})
 			return
 		}
 
@@ -256,10 +912,24 @@ func (rn *Network) processReq(req reqMsg) {
 		// in a separate thread so that we can periodically check
 		// if the server has been killed and the RPC should get a
 		// failure reply.
+		rn.showMessage(AtDeliver, &req, server, nil)
+		rn.record(req, Request, len(req.args), Delivered)
+		if req.chunkCh != nil {
+			req.stream = rn.makeStream(req, servername, server, reliable, longreordering)
+		}
 		ech := make(chan replyMsg)
 		go func() {
 			r := server.dispatch(req)
 			ech <- r
+			if fault.Duplicate {
+				// the duplicate's reply is never seen by the caller,
+				// and nor are its chunks
+				dup := req
+				if dup.stream != nil {
+					dup.stream = brokenStream()
+				}
+				server.dispatch(dup)
+			}
 		}()
 
 		// wait for handler to return,
@@ -290,43 +960,134 @@ func (rn *Network) processReq(req reqMsg) {
 		// DeleteServer() before superseding the Persister.
 		serverDead = rn.isServerDead(req.endname, servername, server)
 
-		if replyOK == false || serverDead == true {
+		if replyOK && fault.RewriteReply != nil {
+			reply.reply = fault.RewriteReply(reply.reply)
+		}
+		if replyOK && !serverDead {
+			reply.reply = rn.showMessage(AtReply, &req, server, reply.reply)
+			rn.throttle(req.endname, servername, len(reply.reply), req.priority)
+		}
+
+		if replyOK && serverDead && rn.repliesDisabled(req.endname) {
+			// the server is fine, but its reply is lost on the way
+			// back, so the caller waits as for a lost request.
+			rn.record(req, Reply, len(reply.reply), TimedOut)
+			rn.timeOut(req, start)
+		} else if replyOK == false || serverDead == true {
 			// server was killed while we were waiting; return error.
-			req.replyCh <- replyMsg{false, nil}
-		} else if reliable == false && (rand.Int()%1000) < 100 {
+			rn.record(req, Reply, len(reply.reply), ServerDead)
+			rn.deliver(req, start, replyMsg{false, nil, nil})
+		} else if rn.tooLarge(len(reply.reply)) {
+			// the server refuses to send it
+			rn.record(req, Reply, len(reply.reply), TooLarge)
+			rn.deliver(req, start, replyMsg{false, nil, ErrMessageTooLarge})
+		} else if fault.DropReply {
+			rn.record(req, Reply, len(reply.reply), Dropped)
+			rn.deliver(req, start, replyMsg{false, nil, ErrLost})
+		} else if reliable == false && (rn.randInt()%1000) < 100 {
 			// drop the reply, return as if timeout
-			req.replyCh <- replyMsg{false, nil}
-		} else if longreordering == true && rand.Intn(900) < 600 {
+			rn.record(req, Reply, len(reply.reply), Dropped)
+			rn.deliver(req, start, replyMsg{false, nil, ErrLost})
+		} else if longreordering == true && rn.randIntn(900) < 600 {
 			// delay the response for a while
-			ms := 200 + rand.Intn(1+rand.Intn(2000))
+			ms := 200 + rn.randIntn(1+rn.randIntn(2000))
 			// Russ points out that this timer arrangement will decrease
 			// the number of goroutines, so that the race
 			// detector is less likely to get upset.
-			time.AfterFunc(time.Duration(ms)*time.Millisecond, func() {
+			clock.AfterFunc(time.Duration(ms)*time.Millisecond, func() {
 				atomic.AddInt64(&rn.bytes, int64(len(reply.reply)))
-				req.replyCh <- reply
+				rn.addStats(req, 0, len(reply.reply))
+				rn.record(req, Reply, len(reply.reply), Delivered)
+				rn.deliver(req, start, reply)
 			})
 		} else {
 			atomic.AddInt64(&rn.bytes, int64(len(reply.reply)))
-			req.replyCh <- reply
+			rn.addStats(req, 0, len(reply.reply))
+			rn.record(req, Reply, len(reply.reply), Delivered)
+			rn.deliver(req, start, reply)
 		}
 	} else {
-		// simulate no reply and eventual timeout.
+		rn.record(req, Request, len(req.args), TimedOut)
+		rn.timeOut(req, start)
+	}
+
+}
+
+// simulate no reply and eventual timeout.
+func (rn *Network) timeOut(req reqMsg, start time.Time) {
+	ms := 0
+	if rn.longDelays {
+		// let Raft tests check that leader doesn't send
+		// RPCs synchronously.
+		ms = (rn.randInt() % 7000)
+	} else {
+		// many kv tests require the client to try each
+		// server in fairly rapid succession.
+		ms = (rn.randInt() % 100)
+	}
+	rn.getClock().AfterFunc(time.Duration(ms)*time.Millisecond, func() {
+		rn.deliver(req, start, replyMsg{false, nil, nil})
+	})
+}
+
+// the sending side of req's stream. each chunk may be lost or
+// delayed like a reply; once one is lost, or the server is
+// deleted, the stream is broken and no more chunks are sent.
+func (rn *Network) makeStream(req reqMsg, servername interface{}, server *Server, reliable bool, longreordering bool) *stream {
+	clock := rn.getClock()
+	st := &stream{}
+	var broken int32
+	st.send = func(chunk []byte) bool {
+		if atomic.LoadInt32(&broken) == 1 || rn.isServerDead(req.endname, servername, server) {
+			atomic.StoreInt32(&broken, 1)
+			return false
+		}
+		if rn.tooLarge(len(chunk)) {
+			// refused, which breaks the stream like a lost chunk
+			rn.record(req, Chunk, len(chunk), TooLarge)
+			atomic.StoreInt32(&broken, 1)
+			rn.deliverChunk(req, chunkMsg{false, nil})
+			return false
+		}
+		rn.throttle(req.endname, servername, len(chunk), req.priority)
+		atomic.AddInt32(&st.sent, 1)
+		atomic.AddInt64(&rn.bytes, int64(len(chunk)))
+		rn.addStats(req, 0, len(chunk))
+
+		if reliable == false && (rn.randInt()%1000) < 100 {
+			// lose the chunk, and with it the stream
+			rn.record(req, Chunk, len(chunk), Dropped)
+			atomic.StoreInt32(&broken, 1)
+			rn.deliverChunk(req, chunkMsg{false, nil})
+			return false
+		}
+
 		ms := 0
-		if rn.longDelays {
-			// let Raft tests check that leader doesn't send
-			// RPCs synchronously.
-			ms = (rand.Int() % 7000)
+		if reliable == false {
+			ms = rn.randInt() % 27
+		}
+		if longreordering == true && rn.randIntn(900) < 600 {
+			ms += 200 + rn.randIntn(1+rn.randIntn(2000))
+		}
+		rn.record(req, Chunk, len(chunk), Delivered)
+		if ms == 0 {
+			rn.deliverChunk(req, chunkMsg{true, chunk})
 		} else {
-			// many kv tests require the client to try each
-			// server in fairly rapid succession.
-			ms = (rand.Int() % 100)
+			clock.AfterFunc(time.Duration(ms)*time.Millisecond, func() {
+				rn.deliverChunk(req, chunkMsg{true, chunk})
+			})
 		}
-		time.AfterFunc(time.Duration(ms)*time.Millisecond, func() {
-			req.replyCh <- replyMsg{false, nil}
-		})
+		return true
 	}
+	return st
+}
 
+// hand a chunk to CallStream(), unless it has already returned.
+func (rn *Network) deliverChunk(req reqMsg, m chunkMsg) {
+	select {
+	case req.chunkCh <- m:
+	case <-req.streamDone:
+	}
 }
 
 // create a client end-point.
@@ -343,8 +1104,10 @@ func (rn *Network) MakeEnd(endname interface{}) *ClientEnd {
 	e.endname = endname
 	e.ch = rn.endCh
 	e.done = rn.done
+	e.codec = rn.getCodec
 	rn.ends[endname] = e
 	rn.enabled[endname] = false
+	rn.replies[endname] = false
 	rn.connections[endname] = nil
 
 	return e
@@ -379,6 +1142,20 @@ func (rn *Network) Enable(endname interface{}, enabled bool) {
 	defer rn.mu.Unlock()
 
 	rn.enabled[endname] = enabled
+	rn.replies[endname] = enabled
+}
+
+// enable/disable each direction of a ClientEnd's connection.
+// with requests but not replies, the server executes requests
+// but the client never hears back; with replies but not requests,
+// new requests are lost, but ones the server already has still
+// get their replies.
+func (rn *Network) EnableDirections(endname interface{}, requests bool, replies bool) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.enabled[endname] = requests
+	rn.replies[endname] = replies
 }
 
 // get a server's count of incoming RPCs.
@@ -400,18 +1177,124 @@ func (rn *Network) GetTotalBytes() int64 {
 	return x
 }
 
+// RPCs sent to one server for one method, and the bytes of
+// their requests and of the replies that got back.
+type Stats struct {
+	Count int
+	Bytes int64
+}
+
+type statsKey struct {
+	servername interface{}
+	svcMeth    string
+}
+
+// count an RPC, or some bytes, for the server req's end is
+// connected to.
+func (rn *Network) addStats(req reqMsg, count int, bytes int) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	key := statsKey{rn.connections[req.endname], req.svcMeth}
+	st := rn.stats[key]
+	if st == nil {
+		st = &Stats{}
+		rn.stats[key] = st
+	}
+	st.Count += count
+	st.Bytes += int64(bytes)
+
+	ms := rn.methodStatsLocked(req.svcMeth)
+	ms.Count += count
+	ms.Bytes += int64(bytes)
+}
+
+// RPCs for one method, over all servers: how many were sent, the
+// bytes of their requests and of the replies that got back, how
+// many failed, and how long their callers waited.
+type MethodStats struct {
+	Count      int
+	Bytes      int64
+	Returned   int           // calls that have returned, unlike those still in flight
+	Failures   int           // calls that returned false
+	Latency    time.Duration // in all, from the network taking a request to Call() returning
+	MaxLatency time.Duration
+}
+
+// the mean Latency of the calls that have returned.
+func (ms MethodStats) MeanLatency() time.Duration {
+	if ms.Returned == 0 {
+		return 0
+	}
+	return ms.Latency / time.Duration(ms.Returned)
+}
+
+func (rn *Network) methodStatsLocked(svcMeth string) *MethodStats {
+	ms := rn.methodStats[svcMeth]
+	if ms == nil {
+		ms = &MethodStats{}
+		rn.methodStats[svcMeth] = ms
+	}
+	return ms
+}
+
+// count a call's outcome as it returns.
+func (rn *Network) finishStatsLocked(req reqMsg, latency time.Duration, ok bool) {
+	ms := rn.methodStatsLocked(req.svcMeth)
+	ms.Returned++
+	if !ok {
+		ms.Failures++
+	}
+	ms.Latency += latency
+	ms.MaxLatency = max(ms.MaxLatency, latency)
+}
+
+// the MethodStats for every method, e.g.
+// stats["Raft.AppendEntries"].
+func (rn *Network) GetMethodStats() map[string]MethodStats {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	stats := map[string]MethodStats{}
+	for svcMeth, ms := range rn.methodStats {
+		stats[svcMeth] = *ms
+	}
+	return stats
+}
+
+// the Stats for every server and method, by server name, then
+// by method, e.g. stats[0]["Raft.AppendEntries"].
+func (rn *Network) GetStats() map[interface{}]map[string]Stats {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	stats := map[interface{}]map[string]Stats{}
+	for key, st := range rn.stats {
+		if stats[key.servername] == nil {
+			stats[key.servername] = map[string]Stats{}
+		}
+		stats[key.servername][key.svcMeth] = *st
+	}
+	return stats
+}
+
 // a server is a collection of services, all sharing
 // the same rpc dispatcher. so that e.g. both a Raft
 // and a k/v server can listen to the same rpc endpoint.
 type Server struct {
 	mu       sync.Mutex
 	services map[string]*Service
-	count    int // incoming RPCs
+	count    int           // incoming RPCs
+	paused   chan struct{} // closed by Resume(); nil unless paused
+	heldHigh map[chan struct{}]int // High requests held by each Pause() that haven't started
+	started  *sync.Cond            // broadcast when heldHigh falls
 }
 
 func MakeServer() *Server {
 	rs := &Server{}
 	rs.services = map[string]*Service{}
+	rs.heldHigh = map[chan struct{}]int{}
+	rs.started = sync.NewCond(&rs.mu)
 	return rs
 }
 
@@ -421,8 +1304,61 @@ func (rs *Server) AddService(svc *Service) {
 	rs.services[svc.name] = svc
 }
 
+// hold every request that arrives from now on, without running
+// its handler, until Resume(), as if the server had stalled.
+// handlers that are already running carry on.
+func (rs *Server) Pause() {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if rs.paused == nil {
+		rs.paused = make(chan struct{})
+	}
+}
+
+// run the requests held since Pause(), the High ones first and
+// otherwise in no particular order, and handle new ones as they
+// arrive.
+func (rs *Server) Resume() {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if rs.paused != nil {
+		close(rs.paused)
+		rs.paused = nil
+	}
+}
+
 func (rs *Server) dispatch(req reqMsg) replyMsg {
 	rs.mu.Lock()
+	paused := rs.paused
+	if paused != nil && req.priority == High {
+		rs.heldHigh[paused]++
+	}
+	rs.mu.Unlock()
+	if paused != nil {
+		<-paused
+	}
+
+	// called as the handler is about to run
+	started := func() {}
+	if paused != nil && req.priority == High {
+		started = func() {
+			rs.mu.Lock()
+			defer rs.mu.Unlock()
+
+			if rs.heldHigh[paused]--; rs.heldHigh[paused] == 0 {
+				delete(rs.heldHigh, paused)
+			}
+			rs.started.Broadcast()
+		}
+	}
+
+	rs.mu.Lock()
+	for paused != nil && req.priority != High && rs.heldHigh[paused] > 0 {
+		// held Bulk requests start once the High ones have
+		rs.started.Wait()
+	}
 
 	rs.count += 1
 
@@ -436,7 +1372,7 @@ func (rs *Server) dispatch(req reqMsg) replyMsg {
 	rs.mu.Unlock()
 
 	if ok {
-		return service.dispatch(methodName, req)
+		return service.dispatch(methodName, req, started)
 	} else {
 		choices := []string{}
 		for k, _ := range rs.services {
@@ -444,10 +1380,32 @@ func (rs *Server) dispatch(req reqMsg) replyMsg {
 		}
 		log.Fatalf("labrpc.Server.dispatch(): unknown Service %v in %v.%v; expecting one of %v\n",
 			serviceName, serviceName, methodName, choices)
-		return replyMsg{false, nil}
+		return replyMsg{false, nil, nil}
 	}
 }
 
+// the type of svcMeth's reply, or nil if its handler has none.
+func (rs *Server) replyType(svcMeth string) reflect.Type {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	dot := strings.LastIndex(svcMeth, ".")
+	svc, ok := rs.services[svcMeth[:dot]]
+	if !ok {
+		return nil
+	}
+	method, ok := svc.methods[svcMeth[dot+1:]]
+	if !ok || method.Type.NumIn() == 2 {
+		return nil
+	}
+	last := method.Type.In(method.Type.NumIn() - 1)
+	if last == sendType {
+		// a stream's reply is how many chunks it sent
+		return reflect.TypeOf(0)
+	}
+	return last.Elem()
+}
+
 func (rs *Server) GetCount() int {
 	rs.mu.Lock()
 	defer rs.mu.Unlock()
@@ -478,10 +1436,17 @@ func MakeService(rcvr interface{}) *Service {
 		//fmt.Printf("%v pp %v ni %v 1k %v 2k %v no %v\n",
 		//	mname, method.PkgPath, mtype.NumIn(), mtype.In(1).Kind(), mtype.In(2).Kind(), mtype.NumOut())
 
+		// a handler may take the caller's metadata before its args,
+		// and a send function for a stream in place of its reply,
+		// or no reply at all for one-way messages
+		withMeta := mtype.NumIn() == 4 && mtype.In(1) == metaType
+		oneWay := mtype.NumIn() == 2
+		last := mtype.In(mtype.NumIn() - 1)
+
 		if method.PkgPath != "" || // capitalized?
-			mtype.NumIn() != 3 ||
+			(mtype.NumIn() != 3 && !withMeta && !oneWay) ||
 			//mtype.In(1).Kind() != reflect.Ptr ||
-			mtype.In(2).Kind() != reflect.Ptr ||
+			(!oneWay && last.Kind() != reflect.Ptr && last != sendType) ||
 			mtype.NumOut() != 0 {
 			// the method is not suitable for a handler
 			//fmt.Printf("bad method: %v\n", mname)
@@ -494,32 +1459,65 @@ func MakeService(rcvr interface{}) *Service {
 	return svc
 }
 
-func (svc *Service) dispatch(methname string, req reqMsg) replyMsg {
+// started is called just before the handler runs.
+func (svc *Service) dispatch(methname string, req reqMsg, started func()) replyMsg {
 	if method, ok := svc.methods[methname]; ok {
 		// prepare space into which to read the argument.
 		// the Value's type will be a pointer to req.argsType.
 		args := reflect.New(req.argsType)
 
 		// decode the argument.
-		ab := bytes.NewBuffer(req.args)
-		ad := labgob.NewDecoder(ab)
-		ad.Decode(args.Interface())
+		req.codec.Unmarshal(req.args, args.Interface())
+		started()
+
+		function := method.Func
+		in := []reflect.Value{svc.rcvr}
+		if method.Type.NumIn() == 4 {
+			// its own copy of the metadata; empty if the caller
+			// sent none.
+			meta := Meta{}
+			maps.Copy(meta, req.meta)
+			in = append(in, reflect.ValueOf(meta))
+		}
+		in = append(in, args.Elem())
+
+		if method.Type.NumIn() == 2 {
+			// a one-way handler, with nothing to reply
+			function.Call(in)
+			return replyMsg{true, nil, nil}
+		}
+
+		last := method.Type.In(method.Type.NumIn() - 1)
+		if last == sendType {
+			// a streaming handler, whose reply is the number of
+			// chunks it sent.
+			st := req.stream
+			if st == nil {
+				st = brokenStream()
+			}
+			send := func(chunk interface{}) bool {
+				cb, err := req.codec.Marshal(chunk)
+				if err != nil {
+					panic(err)
+				}
+				return st.send(cb)
+			}
+			function.Call(append(in, reflect.ValueOf(send)))
+
+			rb, _ := req.codec.Marshal(int(atomic.LoadInt32(&st.sent)))
+			return replyMsg{true, rb, nil}
+		}
 
 		// allocate space for the reply.
-		replyType := method.Type.In(2)
-		replyType = replyType.Elem()
-		replyv := reflect.New(replyType)
+		replyv := reflect.New(last.Elem())
 
 		// call the method.
-		function := method.Func
-		function.Call([]reflect.Value{svc.rcvr, args.Elem(), replyv})
+		function.Call(append(in, replyv))
 
 		// encode the reply.
-		rb := new(bytes.Buffer)
-		re := labgob.NewEncoder(rb)
-		re.EncodeValue(replyv)
+		rb, _ := req.codec.Marshal(replyv.Interface())
 
-		return replyMsg{true, rb.Bytes()}
+		return replyMsg{true, rb, nil}
 	} else {
 		choices := []string{}
 		for k, _ := range svc.methods {
@@ -527,6 +1525,6 @@ func (svc *Service) dispatch(methname string, req reqMsg) replyMsg {
 		}
 		log.Fatalf("labrpc.Service.dispatch(): unknown method %v in %v; expecting one of %v\n",
 			methname, req.svcMeth, choices)
-		return replyMsg{false, nil}
+		return replyMsg{false, nil, nil}
 	}
 }
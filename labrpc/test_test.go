@@ -6,6 +6,12 @@ import "sync"
 import "runtime"
 import "time"
 import "fmt"
+import "bytes"
+import "context"
+import "errors"
+import "strings"
+import "3PhaseCommit/labgob"
+import "3PhaseCommit/codec"
 
 type JunkArgs struct {
 	X int
@@ -66,6 +72,31 @@ func (js *JunkServer) Handler7(args int, reply *string) {
 	}
 }
 
+// takes the caller's metadata
+func (js *JunkServer) Handler8(meta map[string]string, args int, reply *string) {
+	*reply = meta["trace"] + "-" + strconv.Itoa(args)
+	meta["trace"] = "changed by the handler"
+}
+
+// streams args chunks, 0 up to args-1, stopping if the stream breaks
+func (js *JunkServer) Handler9(args int, send func(chunk interface{}) bool) {
+	for i := 0; i < args; i++ {
+		if !send(i) {
+			break
+		}
+	}
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	js.log2 = append(js.log2, args)
+}
+
+// one-way, with no reply
+func (js *JunkServer) Handler10(args string) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	js.log1 = append(js.log1, args)
+}
+
 func TestBasic(t *testing.T) {
 	runtime.GOMAXPROCS(4)
 
@@ -269,9 +300,100 @@ func TestBytes(t *testing.T) {
 	}
 }
 
+//
+// test net.GetStats()
+//
+func TestStats(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	ends := map[int]*ClientEnd{}
+	for _, server := range []int{98, 99} {
+		rs := MakeServer()
+		rs.AddService(MakeService(&JunkServer{}))
+		rn.AddServer(server, rs)
+
+		endname := "end1-" + strconv.Itoa(server)
+		ends[server] = rn.MakeEnd(endname)
+		rn.Connect(endname, server)
+		rn.Enable(endname, true)
+	}
+
+	for i := 0; i < 5; i++ {
+		reply := ""
+		ends[98].Call("JunkServer.Handler7", 100, &reply)
+	}
+	for i := 0; i < 3; i++ {
+		reply := ""
+		ends[99].Call("JunkServer.Handler2", i, &reply)
+	}
+	reply := 0
+	ends[99].Call("JunkServer.Handler1", "1", &reply)
+
+	stats := rn.GetStats()
+	if st := stats[98]["JunkServer.Handler7"]; st.Count != 5 || st.Bytes < 500 || st.Bytes > 700 {
+		t.Fatalf("wrong stats %+v for server 98, expected 5 RPCs and about 550 bytes", st)
+	}
+	if st := stats[99]["JunkServer.Handler2"]; st.Count != 3 {
+		t.Fatalf("wrong stats %+v for server 99, expected 3 RPCs", st)
+	}
+	if st := stats[99]["JunkServer.Handler1"]; st.Count != 1 {
+		t.Fatalf("wrong stats %+v for server 99, expected 1 RPC", st)
+	}
+	if len(stats[98]) != 1 || len(stats[99]) != 2 {
+		t.Fatalf("wrong stats %v, expected one method on 98 and two on 99", stats)
+	}
+}
+
 //
 // test RPCs from concurrent ClientEnds
 //
+func TestMethodStats(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	ends := map[int]*ClientEnd{}
+	for _, server := range []int{98, 99} {
+		rs := MakeServer()
+		rs.AddService(MakeService(&JunkServer{}))
+		rn.AddServer(server, rs)
+
+		endname := "end1-" + strconv.Itoa(server)
+		ends[server] = rn.MakeEnd(endname)
+		rn.Connect(endname, server)
+		rn.Enable(endname, true)
+	}
+	rn.SetLatency("end1-99", 50*time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		for _, server := range []int{98, 99} {
+			reply := ""
+			ends[server].Call("JunkServer.Handler2", i, &reply)
+		}
+	}
+	rn.Enable("end1-98", false)
+	reply := ""
+	if ends[98].Call("JunkServer.Handler2", 3, &reply) {
+		t.Fatalf("call to a disabled end succeeded")
+	}
+
+	stats := rn.GetMethodStats()
+	st := stats["JunkServer.Handler2"]
+	if st.Count != 7 || st.Returned != 7 || st.Failures != 1 || st.Bytes == 0 {
+		t.Fatalf("wrong stats %+v, expected 7 RPCs of which 1 failed", st)
+	}
+	if st.MaxLatency < 50*time.Millisecond || st.MeanLatency() >= st.MaxLatency {
+		t.Fatalf("wrong latencies %+v, expected 50ms on some calls", st)
+	}
+	if len(stats) != 1 {
+		t.Fatalf("wrong stats %v, expected one method", stats)
+	}
+}
+
 func TestConcurrentMany(t *testing.T) {
 	runtime.GOMAXPROCS(4)
 
@@ -565,6 +687,1092 @@ func TestKilled(t *testing.T) {
 	}
 }
 
+//
+// does net.SetLatency() slow down only the given end?
+//
+func TestLatency(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	e1 := rn.MakeEnd("end1")
+	e2 := rn.MakeEnd("end2")
+
+	js := &JunkServer{}
+	svc := MakeService(js)
+
+	rs := MakeServer()
+	rs.AddService(svc)
+	rn.AddServer("server99", rs)
+
+	rn.Connect("end1", "server99")
+	rn.Connect("end2", "server99")
+	rn.Enable("end1", true)
+	rn.Enable("end2", true)
+
+	rn.SetLatency("end1", 50*time.Millisecond)
+
+	t0 := time.Now()
+	reply := ""
+	e1.Call("JunkServer.Handler2", 111, &reply)
+	if reply != "handler2-111" {
+		t.Fatalf("wrong reply from Handler2")
+	}
+	if d := time.Since(t0); d < 50*time.Millisecond {
+		t.Fatalf("slow end replied too quickly (%v)", d)
+	}
+
+	t0 = time.Now()
+	reply = ""
+	e2.Call("JunkServer.Handler2", 111, &reply)
+	if reply != "handler2-111" {
+		t.Fatalf("wrong reply from Handler2")
+	}
+	if d := time.Since(t0); d > 40*time.Millisecond {
+		t.Fatalf("fast end was delayed (%v)", d)
+	}
+
+	rn.SetLatency("end1", 0)
+
+	t0 = time.Now()
+	e1.Call("JunkServer.Handler2", 111, &reply)
+	if d := time.Since(t0); d > 40*time.Millisecond {
+		t.Fatalf("end was still delayed after removing latency (%v)", d)
+	}
+}
+
+//
+// does a paused server hold requests until it's resumed?
+//
+func TestBandwidth(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	rs := MakeServer()
+	rs.AddService(MakeService(&JunkServer{}))
+	rn.AddServer("server99", rs)
+
+	ends := []*ClientEnd{}
+	for _, endname := range []string{"end1-99", "end2-99"} {
+		ends = append(ends, rn.MakeEnd(endname))
+		rn.Connect(endname, "server99")
+		rn.Enable(endname, true)
+	}
+
+	// five 2000-byte requests queue on a 20000 byte/s link
+	call := func(e *ClientEnd) {
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				reply := 0
+				if !e.Call("JunkServer.Handler6", string(make([]byte, 2000)), &reply) || reply != 2000 {
+					t.Errorf("wrong reply %v", reply)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+
+	rn.SetServerBandwidth("server99", 20000)
+	t0 := time.Now()
+	call(ends[0])
+	if d := time.Since(t0); d < 450*time.Millisecond || d > 2*time.Second {
+		t.Fatalf("10000 bytes took %v at 20000 bytes/s; expected about 0.5s", d)
+	}
+	rn.SetServerBandwidth("server99", 0)
+
+	// only the limited end is slow
+	rn.SetEndBandwidth("end1-99", 20000)
+	t0 = time.Now()
+	call(ends[1])
+	if d := time.Since(t0); d > 200*time.Millisecond {
+		t.Fatalf("an unlimited end took %v", d)
+	}
+	t0 = time.Now()
+	call(ends[0])
+	if d := time.Since(t0); d < 450*time.Millisecond {
+		t.Fatalf("10000 bytes took %v at 20000 bytes/s; expected about 0.5s", d)
+	}
+}
+
+func TestPause(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	e := rn.MakeEnd("end1-99")
+
+	js := &JunkServer{}
+	svc := MakeService(js)
+
+	rs := MakeServer()
+	rs.AddService(svc)
+	rn.AddServer("server99", rs)
+
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+
+	rs.Pause()
+
+	ch := make(chan string)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			reply := ""
+			e.Call("JunkServer.Handler2", i, &reply)
+			ch <- reply
+		}(i)
+	}
+
+	select {
+	case reply := <-ch:
+		t.Fatalf("paused server replied %q", reply)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if n := rs.GetCount(); n != 0 {
+		t.Fatalf("paused server handled %d requests", n)
+	}
+
+	rs.Resume()
+
+	replies := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		select {
+		case reply := <-ch:
+			replies[reply] = true
+		case <-time.After(2 * time.Second):
+			t.Fatalf("resumed server didn't reply")
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if !replies[fmt.Sprintf("handler2-%d", i)] {
+			t.Fatalf("wrong replies %v after resuming", replies)
+		}
+	}
+	if n := rs.GetCount(); n != 3 {
+		t.Fatalf("resumed server handled %d requests, expected 3", n)
+	}
+}
+
+// records the order its handlers start in
+type LaneServer struct {
+	mu    sync.Mutex
+	order []string
+}
+
+func (ls *LaneServer) Urgent(args string, reply *int) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.order = append(ls.order, "urgent")
+	*reply = len(args)
+}
+
+func (ls *LaneServer) Bulk(args string, reply *int) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.order = append(ls.order, "bulk")
+	*reply = len(args)
+}
+
+func TestPriority(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	ls := &LaneServer{}
+	rs := MakeServer()
+	rs.AddService(MakeService(ls))
+	rn.AddServer("server99", rs)
+
+	e := rn.MakeEnd("end1-99")
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+	rn.SetPriority("LaneServer.Urgent", High)
+
+	// five 2000-byte requests queue on a 20000 byte/s link, and
+	// an urgent one overtakes them
+	rn.SetServerBandwidth("server99", 20000)
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reply := 0
+			e.Call("LaneServer.Bulk", string(make([]byte, 2000)), &reply)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	t0 := time.Now()
+	reply := 0
+	if !e.Call("LaneServer.Urgent", string(make([]byte, 100)), &reply) || reply != 100 {
+		t.Fatalf("wrong reply %v", reply)
+	}
+	if d := time.Since(t0); d > 200*time.Millisecond {
+		t.Fatalf("an urgent request took %v behind 10000 bytes of bulk requests", d)
+	}
+	wg.Wait()
+	rn.SetServerBandwidth("server99", 0)
+
+	// a paused server runs the urgent requests it held first
+	ls.mu.Lock()
+	ls.order = nil
+	ls.mu.Unlock()
+	rs.Pause()
+	for _, method := range []string{"Bulk", "Bulk", "Urgent", "Bulk"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reply := 0
+			e.Call("LaneServer."+method, "x", &reply)
+		}()
+		time.Sleep(20 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	rs.Resume()
+	wg.Wait()
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if len(ls.order) != 4 || ls.order[0] != "urgent" {
+		t.Fatalf("handlers ran in order %v after resuming; expected the urgent one first", ls.order)
+	}
+}
+
+func TestJournal(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	rs := MakeServer()
+	rs.AddService(MakeService(&JunkServer{}))
+	rn.AddServer("server99", rs)
+
+	ends := []*ClientEnd{}
+	for _, endname := range []string{"end1-99", "end2-99"} {
+		ends = append(ends, rn.MakeEnd(endname))
+		rn.Connect(endname, "server99")
+		rn.Enable(endname, true)
+	}
+
+	// nothing is kept until the journal is on
+	reply := ""
+	ends[0].Call("JunkServer.Handler2", 1, &reply)
+	if j := rn.Journal("end1-99"); len(j) != 0 {
+		t.Fatalf("journal off, but kept %v", j)
+	}
+
+	rn.SetJournal(3)
+	var drop *Fault
+	rn.RegisterInterceptor(func(svcMeth string, endname interface{}) *Fault {
+		return drop
+	})
+
+	ends[0].Call("JunkServer.Handler2", 2, &reply)
+	drop = &Fault{DropReply: true}
+	ends[0].Call("JunkServer.Handler2", 3, &reply)
+	drop = &Fault{DropRequest: true}
+	ends[0].Call("JunkServer.Handler2", 4, &reply)
+	drop = nil
+	rn.Enable("end2-99", false)
+	ends[1].Call("JunkServer.Handler2", 5, &reply)
+
+	type want struct {
+		dir     Direction
+		outcome Outcome
+	}
+	check := func(endname string, wants []want) {
+		j := rn.Journal(endname)
+		if len(j) != len(wants) {
+			t.Fatalf("%s's journal is %v; expected %d entries", endname, j, len(wants))
+		}
+		for i, w := range wants {
+			if j[i].SvcMeth != "JunkServer.Handler2" || j[i].Servername != "server99" ||
+				j[i].Dir != w.dir || j[i].Outcome != w.outcome || j[i].Bytes == 0 {
+				t.Fatalf("%s's entry %d is %v; expected a %v %v", endname, i, j[i], w.dir, w.outcome)
+			}
+		}
+	}
+	// the ring holds the last three of the five entries on end1
+	check("end1-99", []want{{Request, Delivered}, {Reply, Dropped}, {Request, Dropped}})
+	ends[0].Call("JunkServer.Handler2", 6, &reply)
+	check("end1-99", []want{{Request, Dropped}, {Request, Delivered}, {Reply, Delivered}})
+	check("end2-99", []want{{Request, TimedOut}})
+
+	var out strings.Builder
+	rn.DumpJournals(&out)
+	if !strings.Contains(out.String(), "end end2-99:\n") ||
+		!strings.Contains(out.String(), "JunkServer.Handler2 to server99: request of") ||
+		!strings.Contains(out.String(), "timed out") {
+		t.Fatalf("DumpJournals() wrote:\n%s", out.String())
+	}
+}
+
+//
+// do interceptors drop, duplicate and rewrite requests as asked?
+//
+func TestIntercept(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	e := rn.MakeEnd("end1-99")
+
+	js := &JunkServer{}
+	svc := MakeService(js)
+
+	rs := MakeServer()
+	rs.AddService(svc)
+	rn.AddServer("server99", rs)
+
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+
+	var mu sync.Mutex
+	var next *Fault
+	rn.RegisterInterceptor(func(svcMeth string, endname interface{}) *Fault {
+		mu.Lock()
+		defer mu.Unlock()
+		f := next
+		next = nil
+		return f
+	})
+	setNext := func(f *Fault) {
+		mu.Lock()
+		defer mu.Unlock()
+		next = f
+	}
+	handled := func() int {
+		js.mu.Lock()
+		defer js.mu.Unlock()
+		return len(js.log2)
+	}
+
+	reply := ""
+	setNext(&Fault{DropRequest: true})
+	if e.Call("JunkServer.Handler2", 1, &reply) {
+		t.Fatalf("dropped request succeeded")
+	}
+	if handled() != 0 {
+		t.Fatalf("dropped request reached the handler")
+	}
+
+	setNext(&Fault{DropReply: true})
+	if e.Call("JunkServer.Handler2", 2, &reply) {
+		t.Fatalf("request with dropped reply succeeded")
+	}
+	if handled() != 1 {
+		t.Fatalf("request with dropped reply didn't reach the handler")
+	}
+
+	setNext(&Fault{DropRequest: true})
+	if err := e.CallErr("JunkServer.Handler2", nil, 7, &reply); !errors.Is(err, ErrLost) || !errors.Is(err, ErrNoReply) {
+		t.Fatalf("dropped request returned %v; expected ErrLost", err)
+	}
+
+	setNext(&Fault{Duplicate: true})
+	if !e.Call("JunkServer.Handler2", 3, &reply) || reply != "handler2-3" {
+		t.Fatalf("wrong reply from duplicated request")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if handled() != 3 {
+		t.Fatalf("duplicated request ran %v times; expected 2", handled()-1)
+	}
+
+	setNext(&Fault{Rewrite: func(args []byte) []byte {
+		w := new(bytes.Buffer)
+		labgob.NewEncoder(w).Encode(40)
+		return w.Bytes()
+	}})
+	if !e.Call("JunkServer.Handler2", 4, &reply) || reply != "handler2-40" {
+		t.Fatalf("wrong reply %v from rewritten request; expected handler2-40", reply)
+	}
+
+	setNext(&Fault{RewriteReply: func(data []byte) []byte {
+		w := new(bytes.Buffer)
+		labgob.NewEncoder(w).Encode("rewritten")
+		return w.Bytes()
+	}})
+	if !e.Call("JunkServer.Handler2", 6, &reply) || reply != "rewritten" {
+		t.Fatalf("wrong reply %v from rewritten reply; expected rewritten", reply)
+	}
+
+	if !e.Call("JunkServer.Handler2", 5, &reply) || reply != "handler2-5" {
+		t.Fatalf("wrong reply after faults")
+	}
+}
+
+func TestObserver(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	e := rn.MakeEnd("end1-99")
+
+	js := &JunkServer{}
+	svc := MakeService(js)
+
+	rs := MakeServer()
+	rs.AddService(svc)
+	rn.AddServer("server99", rs)
+
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+
+	var mu sync.Mutex
+	var seen []bool
+	rn.RegisterObserver(func(svcMeth string, endname interface{}, start time.Time, ok bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		if svcMeth != "JunkServer.Handler2" || endname != "end1-99" || time.Since(start) < 0 {
+			t.Errorf("wrong observation %v %v %v", svcMeth, endname, start)
+		}
+		seen = append(seen, ok)
+	})
+
+	reply := ""
+	if !e.Call("JunkServer.Handler2", 1, &reply) {
+		t.Fatalf("call failed")
+	}
+	rn.Enable("end1-99", false)
+	if e.Call("JunkServer.Handler2", 2, &reply) {
+		t.Fatalf("call to a disabled end succeeded")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(seen) != 2 || !seen[0] || seen[1] {
+		t.Fatalf("observed %v; expected [true false]", seen)
+	}
+}
+
+func TestMeta(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	e := rn.MakeEnd("end1-99")
+
+	js := &JunkServer{}
+	svc := MakeService(js)
+
+	rs := MakeServer()
+	rs.AddService(svc)
+	rn.AddServer("server99", rs)
+
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+
+	meta := map[string]string{"trace": "abc"}
+	{
+		reply := ""
+		e.CallMeta("JunkServer.Handler8", meta, 7, &reply)
+		if reply != "abc-7" {
+			t.Fatalf("wrong reply %q from Handler8", reply)
+		}
+		if meta["trace"] != "abc" {
+			t.Fatalf("handler changed the caller's metadata")
+		}
+	}
+
+	{
+		reply := ""
+		e.Call("JunkServer.Handler8", 7, &reply)
+		if reply != "-7" {
+			t.Fatalf("wrong reply %q from Handler8 without metadata", reply)
+		}
+	}
+
+	{
+		// handlers that don't take metadata ignore it
+		reply := ""
+		e.CallMeta("JunkServer.Handler2", meta, 111, &reply)
+		if reply != "handler2-111" {
+			t.Fatalf("wrong reply %q from Handler2", reply)
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	e := rn.MakeEnd("end1-99")
+
+	js := &JunkServer{}
+	svc := MakeService(js)
+
+	rs := MakeServer()
+	rs.AddService(svc)
+	rn.AddServer("server99", rs)
+
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+
+	// read a stream of n chunks, returning the chunks that arrived
+	stream := func(n int) ([]int, bool) {
+		chunks := make(chan int)
+		okCh := make(chan bool)
+		go func() {
+			okCh <- e.CallStream("JunkServer.Handler9", n, chunks)
+		}()
+		got := []int{}
+		for c := range chunks {
+			got = append(got, c)
+		}
+		return got, <-okCh
+	}
+
+	{
+		got, ok := stream(100)
+		if !ok || len(got) != 100 {
+			t.Fatalf("got %d chunks, ok %v; expected 100", len(got), ok)
+		}
+		for i, c := range got {
+			if c != i {
+				t.Fatalf("chunk %d is %d on a reliable network", i, c)
+			}
+		}
+	}
+
+	{
+		// nobody to send chunks to
+		reply := 0
+		if !e.Call("JunkServer.Handler9", 10, &reply) || reply != 0 {
+			t.Fatalf("Call() to a streaming handler sent %d chunks", reply)
+		}
+	}
+
+	// on an unreliable network, a stream succeeds only if every
+	// chunk arrived, though maybe out of order
+	rn.Reliable(false)
+	const n = 5
+	var mu sync.Mutex
+	succeeded, failed, reordered := 0, 0, 0
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, ok := stream(n)
+			mu.Lock()
+			defer mu.Unlock()
+			if !ok {
+				failed++
+				return
+			}
+			succeeded++
+			seen := map[int]bool{}
+			for i, c := range got {
+				seen[c] = true
+				if c != i {
+					reordered++
+				}
+			}
+			if len(got) != n || len(seen) != n {
+				t.Errorf("a successful stream got chunks %v", got)
+			}
+		}()
+	}
+	wg.Wait()
+	if succeeded == 0 || failed == 0 || reordered == 0 {
+		t.Fatalf("%d streams succeeded, %d failed and %d chunks were reordered; expected some of each", succeeded, failed, reordered)
+	}
+}
+
+// a stream breaks when its server is deleted, and send()
+// tells the handler to stop
+func TestStreamKilled(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	e := rn.MakeEnd("end1-99")
+
+	js := &JunkServer{}
+	svc := MakeService(js)
+
+	rs := MakeServer()
+	rs.AddService(svc)
+	rn.AddServer("server99", rs)
+
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+
+	chunks := make(chan int)
+	okCh := make(chan bool)
+	go func() {
+		okCh <- e.CallStream("JunkServer.Handler9", 1<<30, chunks)
+	}()
+	for c := range chunks {
+		if c == 10 {
+			rn.DeleteServer("server99")
+			break
+		}
+	}
+	go func() {
+		for range chunks {
+		}
+	}()
+	if <-okCh {
+		t.Fatalf("stream succeeded after its server was deleted")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if len(js.log2) != 1 {
+		t.Fatalf("handler didn't stop streaming after its server was deleted")
+	}
+}
+
+func TestCallTimeout(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	e := rn.MakeEnd("end1-99")
+
+	js := &JunkServer{}
+	svc := MakeService(js)
+
+	rs := MakeServer()
+	rs.AddService(svc)
+	rn.AddServer("server99", rs)
+
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+
+	{
+		reply := ""
+		if err := e.CallTimeout("JunkServer.Handler2", 111, &reply, time.Second); err != nil || reply != "handler2-111" {
+			t.Fatalf("CallTimeout() returned %v with reply %q", err, reply)
+		}
+	}
+
+	{
+		// a stalled server
+		rs.Pause()
+		reply := ""
+		t0 := time.Now()
+		err := e.CallTimeout("JunkServer.Handler2", 111, &reply, 100*time.Millisecond)
+		var te *TimeoutError
+		if !errors.As(err, &te) || te.SvcMeth != "JunkServer.Handler2" || !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("CallTimeout() to a stalled server returned %v", err)
+		}
+		if d := time.Since(t0); d > time.Second {
+			t.Fatalf("CallTimeout() took %v to time out after 100ms", d)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			cancel()
+		}()
+		if err := e.CallContext(ctx, "JunkServer.Handler2", 111, &reply); !errors.Is(err, context.Canceled) {
+			t.Fatalf("CallContext() returned %v after its context was cancelled", err)
+		}
+		rs.Resume()
+	}
+
+	{
+		rn.Enable("end1-99", false)
+		reply := ""
+		if err := e.CallTimeout("JunkServer.Handler2", 111, &reply, time.Second); err != ErrNoReply {
+			t.Fatalf("CallTimeout() on a disabled end returned %v", err)
+		}
+	}
+}
+
+func TestSend(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	e := rn.MakeEnd("end1-99")
+
+	js := &JunkServer{}
+	svc := MakeService(js)
+
+	rs := MakeServer()
+	rs.AddService(svc)
+	rn.AddServer("server99", rs)
+
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+
+	// Send() returns before the handler runs
+	rs.Pause()
+	e.Send("JunkServer.Handler10", "a")
+	e.Send("JunkServer.Handler10", "b")
+	e.Send("JunkServer.Handler1", "9") // its reply is thrown away
+	rs.Resume()
+
+	got := func() []string {
+		js.mu.Lock()
+		defer js.mu.Unlock()
+		return append([]string{}, js.log1...)
+	}
+	for start := time.Now(); len(got()) < 3 && time.Since(start) < time.Second; {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	rn.Enable("end1-99", false)
+	e.Send("JunkServer.Handler10", "lost")
+	time.Sleep(200 * time.Millisecond)
+
+	log1 := got()
+	if len(log1) != 3 {
+		t.Fatalf("handlers got %v; expected a, b and 9 in any order", log1)
+	}
+	for _, s := range log1 {
+		if s != "a" && s != "b" && s != "9" {
+			t.Fatalf("handlers got %v; expected a, b and 9 in any order", log1)
+		}
+	}
+}
+
+func TestDirections(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	e := rn.MakeEnd("end1-99")
+
+	js := &JunkServer{}
+	svc := MakeService(js)
+
+	rs := MakeServer()
+	rs.AddService(svc)
+	rn.AddServer("server99", rs)
+
+	delivered := make(chan string, 10)
+	rn.RegisterMessageCallback(func(m *Message) {
+		if m.Point == AtDeliver {
+			delivered <- m.Args.(string)
+		}
+	})
+
+	rn.Connect("end1-99", "server99")
+
+	// requests but not replies: the handler runs, the caller hears nothing
+	rn.EnableDirections("end1-99", true, false)
+	reply := 0
+	if e.Call("JunkServer.Handler1", "7", &reply) {
+		t.Fatalf("Call succeeded with replies disabled")
+	}
+	js.mu.Lock()
+	if len(js.log1) != 1 || js.log1[0] != "7" {
+		t.Fatalf("handler got %v; expected 7", js.log1)
+	}
+	js.mu.Unlock()
+	<-delivered
+
+	// replies but not requests: a request the server already
+	// has gets its reply, a new one is lost
+	rn.Enable("end1-99", true)
+	rs.Pause()
+	ch := make(chan bool)
+	go func() {
+		reply := 0
+		ok := e.Call("JunkServer.Handler1", "8", &reply)
+		ch <- ok && reply == 8
+	}()
+	<-delivered
+	rn.EnableDirections("end1-99", false, true)
+	rs.Resume()
+	if !<-ch {
+		t.Fatalf("lost the reply to a request delivered before requests were disabled")
+	}
+
+	reply = 0
+	if e.Call("JunkServer.Handler1", "9", &reply) {
+		t.Fatalf("Call succeeded with requests disabled")
+	}
+	js.mu.Lock()
+	if len(js.log1) != 2 {
+		t.Fatalf("handlers got %v; expected 7 and 8", js.log1)
+	}
+	js.mu.Unlock()
+}
+
+func TestCodec(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	e := rn.MakeEnd("end1-99")
+
+	js := &JunkServer{}
+	svc := MakeService(js)
+
+	rs := MakeServer()
+	rs.AddService(svc)
+	rn.AddServer("server99", rs)
+
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+
+	// what Handler2's args look like on the wire
+	var mu sync.Mutex
+	var wire []byte
+	rn.RegisterInterceptor(func(svcMeth string, endname interface{}) *Fault {
+		return &Fault{Rewrite: func(args []byte) []byte {
+			mu.Lock()
+			defer mu.Unlock()
+			if svcMeth == "JunkServer.Handler2" {
+				wire = args
+			}
+			return args
+		}}
+	})
+
+	for _, c := range []codec.Codec{codec.Gob, codec.JSON, codec.Msgpack} {
+		rn.SetCodec(c)
+
+		reply := ""
+		e.Call("JunkServer.Handler2", 111, &reply)
+		if reply != "handler2-111" {
+			t.Fatalf("%s: wrong reply %q from Handler2", c.Name(), reply)
+		}
+		mu.Lock()
+		want, _ := c.Marshal(111)
+		if !bytes.Equal(wire, want) {
+			t.Fatalf("%s: args sent as %q; expected %q", c.Name(), wire, want)
+		}
+		mu.Unlock()
+
+		jreply := JunkReply{}
+		e.Call("JunkServer.Handler4", &JunkArgs{4}, &jreply)
+		if jreply.X != "pointer" {
+			t.Fatalf("%s: wrong reply %q from Handler4", c.Name(), jreply.X)
+		}
+		jreply = JunkReply{}
+		e.Call("JunkServer.Handler5", JunkArgs{5}, &jreply)
+		if jreply.X != "no pointer" {
+			t.Fatalf("%s: wrong reply %q from Handler5", c.Name(), jreply.X)
+		}
+
+		chunks := make(chan int)
+		var got []int
+		done := make(chan struct{})
+		go func() {
+			for c := range chunks {
+				got = append(got, c)
+			}
+			close(done)
+		}()
+		ok := e.CallStream("JunkServer.Handler9", 3, chunks)
+		<-done
+		if !ok || len(got) != 3 {
+			t.Fatalf("%s: stream got %v, ok %v; expected 0, 1 and 2", c.Name(), got, ok)
+		}
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	e := rn.MakeEnd("end1-99")
+
+	js := &JunkServer{}
+	svc := MakeService(js)
+
+	rs := MakeServer()
+	rs.AddService(svc)
+	rn.AddServer("server99", rs)
+
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+
+	rn.SetMaxMessageSize(1000)
+
+	// args over the limit never reach the handler
+	reply := 0
+	err := e.CallErr("JunkServer.Handler6", nil, strings.Repeat("x", 2000), &reply)
+	if err != ErrMessageTooLarge {
+		t.Fatalf("sending 2000 bytes: %v; expected ErrMessageTooLarge", err)
+	}
+	if n := rs.GetCount(); n != 0 {
+		t.Fatalf("handler ran %d times for args over the limit", n)
+	}
+	if err := e.CallErr("JunkServer.Handler6", nil, strings.Repeat("x", 100), &reply); err != nil || reply != 100 {
+		t.Fatalf("sending 100 bytes: %v, reply %d", err, reply)
+	}
+
+	// the handler runs, but its reply is refused
+	sreply := ""
+	if err := e.CallErr("JunkServer.Handler7", nil, 2000, &sreply); err != ErrMessageTooLarge {
+		t.Fatalf("replying with 2000 bytes: %v; expected ErrMessageTooLarge", err)
+	}
+	if rn.FitsMessage(strings.Repeat("y", 2000)) || !rn.FitsMessage(strings.Repeat("y", 100)) {
+		t.Fatalf("FitsMessage() disagrees with the limit")
+	}
+
+	rn.SetMaxMessageSize(0)
+	if err := e.CallErr("JunkServer.Handler7", nil, 2000, &sreply); err != nil || len(sreply) != 2000 {
+		t.Fatalf("replying with 2000 bytes without a limit: %v, %d bytes", err, len(sreply))
+	}
+}
+
+func TestVirtualClock(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	// 20 calls on an unreliable network with a second of latency,
+	// stepping the clock whenever a message waits on it
+	run := func() ([]bool, time.Duration) {
+		rn := MakeNetwork()
+		defer rn.Cleanup()
+		rn.Seed(42)
+		rn.Reliable(false)
+		clock := MakeVirtualClock()
+		rn.SetClock(clock)
+
+		e := rn.MakeEnd("end1-99")
+		rs := MakeServer()
+		rs.AddService(MakeService(&JunkServer{}))
+		rn.AddServer("server99", rs)
+		rn.Connect("end1-99", "server99")
+		rn.Enable("end1-99", true)
+		rn.SetLatency("end1-99", time.Second)
+
+		done := make(chan struct{})
+		go func() {
+			for {
+				if !clock.Step() {
+					select {
+					case <-done:
+						return
+					case <-time.After(time.Millisecond):
+					}
+				}
+			}
+		}()
+		defer close(done)
+
+		var oks []bool
+		for i := 0; i < 20; i++ {
+			reply := 0
+			oks = append(oks, e.Call("JunkServer.Handler6", "x", &reply))
+		}
+		return oks, clock.Now().Sub(time.Unix(0, 0))
+	}
+
+	t0 := time.Now()
+	oks1, elapsed1 := run()
+	oks2, elapsed2 := run()
+	if d := time.Since(t0); d > 5*time.Second {
+		t.Fatalf("40 calls with a second of virtual latency took %v of real time", d)
+	}
+	if elapsed1 < 20*time.Second {
+		t.Fatalf("only %v of virtual time passed for 20 calls with a second of latency", elapsed1)
+	}
+	if fmt.Sprint(oks1) != fmt.Sprint(oks2) || elapsed1 != elapsed2 {
+		t.Fatalf("runs with the same seed differ: %v after %v, then %v after %v", oks1, elapsed1, oks2, elapsed2)
+	}
+
+	// timers run in order of deadline, then of when they were set
+	clock := MakeVirtualClock()
+	var order []int
+	clock.AfterFunc(2*time.Second, func() { order = append(order, 2) })
+	clock.AfterFunc(time.Second, func() { order = append(order, 1) })
+	clock.AfterFunc(time.Second, func() { order = append(order, 3) })
+	clock.Advance(500 * time.Millisecond) // nothing is due yet
+	if len(order) != 0 || clock.Pending() != 3 {
+		t.Fatalf("timers %v ran early; %d pending", order, clock.Pending())
+	}
+	clock.Advance(2 * time.Second)
+	if fmt.Sprint(order) != "[1 3 2]" || clock.Pending() != 0 {
+		t.Fatalf("timers ran in order %v; expected [1 3 2]", order)
+	}
+	if got := clock.Now().Sub(time.Unix(0, 0)); got != 2500*time.Millisecond {
+		t.Fatalf("clock at %v after advancing 2.5s", got)
+	}
+}
+
+func TestMessageCallback(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	e := rn.MakeEnd("end1-99")
+
+	js := &JunkServer{}
+	svc := MakeService(js)
+
+	rs := MakeServer()
+	rs.AddService(svc)
+	rn.AddServer("server99", rs)
+
+	rn.Connect("end1-99", "server99")
+	rn.Enable("end1-99", true)
+
+	var mu sync.Mutex
+	var seen []string
+	tamper := false
+	rn.RegisterMessageCallback(func(m *Message) {
+		mu.Lock()
+		defer mu.Unlock()
+		reply := "-"
+		if m.Reply != nil {
+			reply = *m.Reply.(*string)
+		}
+		seen = append(seen, fmt.Sprintf("%v %v %v %v %v", m.Point, m.SvcMeth, m.Endname, m.Args, reply))
+		if tamper && m.Point == AtDeliver {
+			m.Args = 222
+		}
+		if tamper && m.Point == AtReply {
+			*m.Reply.(*string) += "-tampered"
+		}
+	})
+
+	reply := ""
+	if !e.Call("JunkServer.Handler2", 111, &reply) || reply != "handler2-111" {
+		t.Fatalf("wrong reply %q", reply)
+	}
+	mu.Lock()
+	want := []string{
+		"send JunkServer.Handler2 end1-99 111 -",
+		"deliver JunkServer.Handler2 end1-99 111 -",
+		"reply JunkServer.Handler2 end1-99 111 handler2-111",
+	}
+	if fmt.Sprint(seen) != fmt.Sprint(want) {
+		t.Fatalf("callbacks saw %q; expected %q", seen, want)
+	}
+	tamper = true
+	mu.Unlock()
+
+	reply = ""
+	if !e.Call("JunkServer.Handler2", 111, &reply) || reply != "handler2-222-tampered" {
+		t.Fatalf("wrong reply %q to tampered args and reply", reply)
+	}
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if fmt.Sprint(js.log2) != "[111 222]" {
+		t.Fatalf("handler got %v; expected [111 222]", js.log2)
+	}
+}
+
 func TestBenchmark(t *testing.T) {
 	runtime.GOMAXPROCS(4)
 
@@ -0,0 +1,92 @@
+package commit
+
+//
+// a background checker for the servers' locks.
+//
+// every lockCheckPeriod, for every running server, the checker
+// compares each key's lock with the transactions that should
+// hold it: those that voted Yes and haven't been decided. it
+// fails the test as soon as
+//
+//   - two such transactions hold a key and one of them sets it,
+//   - a lock is held and no such transaction reads or sets the key
+//     (e.g. a committed or aborted transaction never released it),
+//   - such a transaction reads or sets a key that isn't locked.
+//
+// killed servers are skipped, since Kill() releases their locks.
+//
+// keys a running Prepare is locking are only checked for the
+// first, since the Prepare may hold them before it has voted.
+//
+// the checker runs in the background, so it fails the test with
+// backgroundErrorf(), which wakes the test if it's waiting for a
+// transaction.
+//
+
+import (
+	"sort"
+	"time"
+)
+
+const lockCheckPeriod = 5 * time.Millisecond
+
+// check the locks every lockCheckPeriod until done is closed.
+func (cfg *config) lockChecker(done <-chan struct{}) {
+	ticker := time.NewTicker(lockCheckPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if !cfg.checkLocks() {
+				return
+			}
+		}
+	}
+}
+
+// check every running server's locks once, and report whether
+// they were all as expected.
+func (cfg *config) checkLocks() bool {
+	cfg.mu.Lock()
+	servers := append([]*Server(nil), cfg.servers...)
+	cfg.mu.Unlock()
+
+	for i, sv := range servers {
+		if sv == nil {
+			continue
+		}
+		table := sv.lockTable()
+
+		keys := make([]string, 0, len(table))
+		for key := range table {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			l := table[key]
+			holders := len(l.readers) + len(l.writers)
+			switch {
+			case len(l.writers) > 1 || (len(l.writers) == 1 && len(l.readers) > 0):
+				return cfg.lockViolation(i, "server %d: transactions %v write %s while transactions %v also hold it",
+					i, l.writers, key, l.readers)
+			case l.preparing:
+			case holders == 0 && l.locked:
+				return cfg.lockViolation(i, "server %d: %s is locked, but no undecided transaction holds it", i, key)
+			case holders > 0 && !l.locked:
+				return cfg.lockViolation(i, "server %d: transactions %v hold %s, but it isn't locked",
+					i, append(l.readers, l.writers...), key)
+			}
+		}
+	}
+	return true
+}
+
+func (cfg *config) lockViolation(server int, format string, a ...interface{}) bool {
+	cfg.t.Helper()
+	cfg.timeline.mark(server, "lock invariant violated")
+	cfg.backgroundErrorf(format, a...)
+	return false
+}
@@ -0,0 +1,289 @@
+package commit
+
+//
+// logs for the coordinator, the servers and the tester.
+//
+// every line says how far into which test it was written, which
+// component wrote it, the transaction and phase it's about, and
+// how much it matters:
+//
+//   12.345ms TestBasicCommit coordinator  tid 3    Prepare    INFO  all servers voted Yes
+//
+// the tester gives each test its own log, which keeps the last
+// logMaxLines lines and which cleanup() prints only if the test
+// fails, so passing runs stay quiet. set LOG=1 to print it for
+// passing tests too, LOG_LEVEL=info or LOG_LEVEL=warn to leave
+// out the detail, and LOG_REDACT=hash or LOG_REDACT=omit to keep
+// values out of it (redact.go).
+//
+// outside the tester lines go to a log/slog Logger, with the
+// component, tid and phase as attributes. MakeServer() and
+// MakeCoordinator() log warnings to stderr, and nothing else unless
+// LOG_LEVEL=debug or LOG_LEVEL=info; to choose the handler, pass
+//
+//   NewLogger(slog.New(h), "server 0")
+//
+// to MakeServerWithLogger() or MakeCoordinatorWithLogger(). they
+// take any Logger, so lines can go to another logging library,
+// e.g. zap or zerolog, through a type with its three methods.
+//
+// the coordinator and servers don't tag each line by hand: the
+// transaction and phase a goroutine is working on ride in its
+// context (withTxn), set where a transaction, a phase or a handler
+// starts, and co.logFor(ctx) and sv.logFor(ctx) tag each line with
+// them, as eventHeader does each event.
+//
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota // each step
+	levelInfo                  // decisions: votes, commits, aborts, recovery
+	levelWarn                  // something went wrong: lost RPCs, timeouts
+)
+
+func (l logLevel) String() string {
+	switch l {
+	case levelDebug:
+		return "DEBUG"
+	case levelInfo:
+		return "INFO"
+	case levelWarn:
+		return "WARN"
+	}
+	return fmt.Sprintf("logLevel(%d)", int(l))
+}
+
+// for lines that aren't about one transaction.
+const noTid = -1
+
+// a test's log keeps this many of its latest lines.
+const logMaxLines = 20000
+
+type logLine struct {
+	level logLevel
+	text  string
+}
+
+// one test's log, shared by all of its components.
+type testLog struct {
+	mu      sync.Mutex
+	name    string // the test it belongs to
+	start   time.Time
+	lines   []logLine // the latest lines, oldest at next once full
+	next    int
+	dropped int // older lines that no longer fit
+}
+
+func makeTestLog(name string, start time.Time) *testLog {
+	return &testLog{name: name, start: start}
+}
+
+func (tl *testLog) add(level logLevel, text string) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	ms := float64(time.Since(tl.start)) / float64(time.Millisecond)
+	line := logLine{level, fmt.Sprintf("%10.3fms %s %s", ms, tl.name, text)}
+	if len(tl.lines) < logMaxLines {
+		tl.lines = append(tl.lines, line)
+		return
+	}
+	tl.lines[tl.next] = line
+	tl.next = (tl.next + 1) % logMaxLines
+	tl.dropped++
+}
+
+// write the lines at min or above, oldest first.
+func (tl *testLog) dump(w io.Writer, min logLevel) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	if tl.dropped > 0 {
+		fmt.Fprintf(w, "  ... %d earlier log lines dropped\n", tl.dropped)
+	}
+	for i := range tl.lines {
+		line := tl.lines[(tl.next+i)%len(tl.lines)]
+		if line.level >= min {
+			fmt.Fprintln(w, line.text)
+		}
+	}
+}
+
+// the level LOG_LEVEL asks for; everything by default.
+func logLevelFromEnv() logLevel {
+	switch strings.ToLower(os.Getenv("LOG_LEVEL")) {
+	case "info":
+		return levelInfo
+	case "warn":
+		return levelWarn
+	}
+	return levelDebug
+}
+
+func (l logLevel) slogLevel() slog.Level {
+	switch l {
+	case levelDebug:
+		return slog.LevelDebug
+	case levelInfo:
+		return slog.LevelInfo
+	}
+	return slog.LevelWarn
+}
+
+// the level LOG_LEVEL asks for outside the tester; warnings by default.
+func slogLevelFromEnv() slog.Level {
+	switch strings.ToLower(os.Getenv("LOG_LEVEL")) {
+	case "debug":
+		return slog.LevelDebug
+	case "info":
+		return slog.LevelInfo
+	}
+	return slog.LevelWarn
+}
+
+// what the coordinator and a server write their lines to. tid is
+// -1 for a line that isn't about one transaction, and phase is ""
+// for one that isn't about one phase. Debugf is for each step,
+// Infof for decisions, and Warnf for things that went wrong.
+type Logger interface {
+	Debugf(tid int, phase string, format string, a ...interface{})
+	Infof(tid int, phase string, format string, a ...interface{})
+	Warnf(tid int, phase string, format string, a ...interface{})
+}
+
+type txnKey struct{}
+
+// the transaction and phase in a context.
+type txnTag struct {
+	tid   int
+	phase string
+}
+
+// ctx, tagged as about tid (noTid for none) in phase ("" for none).
+func withTxn(ctx context.Context, tid int, phase string) context.Context {
+	return context.WithValue(ctx, txnKey{}, txnTag{tid, phase})
+}
+
+// ctx, still about its transaction, but in phase.
+func withPhase(ctx context.Context, phase string) context.Context {
+	tid, _ := txnOf(ctx)
+	return withTxn(ctx, tid, phase)
+}
+
+// the transaction and phase ctx is tagged with; noTid and "" if none.
+func txnOf(ctx context.Context) (int, string) {
+	if tag, ok := ctx.Value(txnKey{}).(txnTag); ok {
+		return tag.tid, tag.phase
+	}
+	return noTid, ""
+}
+
+// a Logger's lines, tagged with one context's transaction and phase.
+type txnLogger struct {
+	l     Logger
+	tid   int
+	phase string
+}
+
+func taggedLogger(ctx context.Context, l Logger) txnLogger {
+	tid, phase := txnOf(ctx)
+	return txnLogger{l, tid, phase}
+}
+
+func (tl txnLogger) Debugf(format string, a ...interface{}) {
+	tl.l.Debugf(tl.tid, tl.phase, format, a...)
+}
+
+func (tl txnLogger) Infof(format string, a ...interface{}) {
+	tl.l.Infof(tl.tid, tl.phase, format, a...)
+}
+
+func (tl txnLogger) Warnf(format string, a ...interface{}) {
+	tl.l.Warnf(tl.tid, tl.phase, format, a...)
+}
+
+// the Coordinator's and Server's loggers, tagged with ctx's
+// transaction and phase.
+func (co *Coordinator) logFor(ctx context.Context) txnLogger {
+	return taggedLogger(ctx, co.logger)
+}
+
+func (sv *Server) logFor(ctx context.Context) txnLogger {
+	return taggedLogger(ctx, sv.logger)
+}
+
+// writes one component's lines, to a test's log or, if it has
+// none, to a slog.Logger.
+type componentLogger struct {
+	tl        *testLog
+	sl        *slog.Logger
+	component string
+}
+
+func (tl *testLog) logger(component string) Logger {
+	return &componentLogger{tl: tl, component: component}
+}
+
+// a Logger for component that writes to sl.
+func NewLogger(sl *slog.Logger, component string) Logger {
+	return &componentLogger{sl: sl, component: component}
+}
+
+// the Logger MakeServer() and MakeCoordinator() use: text on stderr,
+// at the level LOG_LEVEL asks for.
+func stdLogger(component string) Logger {
+	h := slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slogLevelFromEnv()})
+	return NewLogger(slog.New(h), component)
+}
+
+func (l *componentLogger) Debugf(tid int, phase string, format string, a ...interface{}) {
+	l.logf(levelDebug, tid, phase, format, a...)
+}
+
+func (l *componentLogger) Infof(tid int, phase string, format string, a ...interface{}) {
+	l.logf(levelInfo, tid, phase, format, a...)
+}
+
+func (l *componentLogger) Warnf(tid int, phase string, format string, a ...interface{}) {
+	l.logf(levelWarn, tid, phase, format, a...)
+}
+
+func (l *componentLogger) logf(level logLevel, tid int, phase string, format string, a ...interface{}) {
+	if l.tl == nil {
+		l.slogf(level, tid, phase, format, a...)
+		return
+	}
+	about := ""
+	if tid != noTid {
+		about = fmt.Sprintf("tid %d", tid)
+	}
+	text := fmt.Sprintf("%-12s %-8s %-10s %-5v %s", l.component, about, phase, level, fmt.Sprintf(format, a...))
+	l.tl.add(level, text)
+}
+
+func (l *componentLogger) slogf(level logLevel, tid int, phase string, format string, a ...interface{}) {
+	ctx := context.Background()
+	if !l.sl.Enabled(ctx, level.slogLevel()) {
+		return // don't format lines no one will see
+	}
+	attrs := []slog.Attr{slog.String("component", l.component)}
+	if tid != noTid {
+		attrs = append(attrs, slog.Int("tid", tid))
+	}
+	if phase != "" {
+		attrs = append(attrs, slog.String("phase", phase))
+	}
+	l.sl.LogAttrs(ctx, level.slogLevel(), fmt.Sprintf(format, a...), attrs...)
+}
@@ -0,0 +1,220 @@
+package commit
+
+//
+// optional Prometheus metrics for a coordinator and its servers:
+//
+//   m := MakeMetrics()
+//   co.SetMetrics(m)
+//   sv.SetMetrics(m, "server0")
+//   http.Handle("/metrics", m.Handler())
+//
+// the coordinator counts the transactions it reports committed or
+// aborted and times each phase, from entering it to entering the
+// next or reporting the outcome. each server counts the
+// transactions it commits and aborts. the counts and times come
+// from their events (events.go); gauges are read from the
+// coordinators and servers as they're scraped:
+//
+//   threepc_coordinator_transactions_total{outcome}     committed or aborted
+//   threepc_coordinator_phase_duration_seconds{phase}
+//   threepc_coordinator_in_doubt_transactions           not yet decided
+//   threepc_server_transactions_total{server,outcome}
+//   threepc_server_locks_held{server}                   keys locked
+//   threepc_server_in_doubt_transactions{server}        voted Yes, not yet decided
+//
+// killed coordinators and servers are left out of the gauges. a
+// Metrics has its own registry; Registry() returns it, to gather
+// it along with an application's own metrics.
+//
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "threepc"
+
+type Metrics struct {
+	registry        *prometheus.Registry
+	decisions       *prometheus.CounterVec   // by outcome
+	phases          *prometheus.HistogramVec // by phase
+	serverDecisions *prometheus.CounterVec   // by server and outcome
+
+	mu           sync.Mutex
+	coordinators []*Coordinator
+	servers      map[string]*Server // name : server
+}
+
+var (
+	coordinatorInDoubtDesc = prometheus.NewDesc(metricsNamespace+"_coordinator_in_doubt_transactions",
+		"Transactions the coordinator has started and not yet decided.", nil, nil)
+	serverLocksDesc = prometheus.NewDesc(metricsNamespace+"_server_locks_held",
+		"Keys whose lock some transaction holds.", []string{"server"}, nil)
+	serverInDoubtDesc = prometheus.NewDesc(metricsNamespace+"_server_in_doubt_transactions",
+		"Transactions the server voted Yes for that haven't been decided.", []string{"server"}, nil)
+)
+
+func MakeMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		decisions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "coordinator_transactions_total",
+			Help:      "Transactions the coordinator reported, by outcome.",
+		}, []string{"outcome"}),
+		phases: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "coordinator_phase_duration_seconds",
+			Help:      "How long transactions spent in each phase.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10), // 100µs to 26s
+		}, []string{"phase"}),
+		serverDecisions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "server_transactions_total",
+			Help:      "Transactions the server committed or aborted, by outcome.",
+		}, []string{"server", "outcome"}),
+		servers: make(map[string]*Server),
+	}
+	m.registry.MustRegister(m.decisions, m.phases, m.serverDecisions, metricsCollector{m})
+	return m
+}
+
+// serves the metrics in the Prometheus text format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+func (m *Metrics) Registry() *prometheus.Registry {
+	return m.registry
+}
+
+// record the Coordinator's decisions and phases in m, and report its
+// in-doubt transactions.
+func (co *Coordinator) SetMetrics(m *Metrics) {
+	co.mu.Lock()
+	if co.metrics != nil {
+		co.metrics()
+	}
+	co.metrics = co.Subscribe(func(e Event) {
+		switch e := e.(type) {
+		case PhaseChanged:
+			if e.From != "" {
+				m.observePhase(e.From, e.After)
+			}
+		case Decision:
+			m.observePhase(e.Outcome, e.InPhase)
+			m.decided(e.Outcome)
+		}
+	})
+	co.mu.Unlock()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.coordinators = append(m.coordinators, co)
+}
+
+// record the Server's decisions in m, labelled with name, and
+// report its locks and in-doubt transactions.
+func (sv *Server) SetMetrics(m *Metrics, name string) {
+	sv.mu.Lock()
+	if sv.metrics != nil {
+		sv.metrics()
+	}
+	sv.metrics = sv.Subscribe(func(e Event) {
+		if d, ok := e.(Decision); ok {
+			m.serverDecided(name, d.Outcome)
+		}
+	})
+	sv.mu.Unlock()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.servers[name] = sv
+}
+
+// a transaction left phase after d.
+func (m *Metrics) observePhase(phase string, d time.Duration) {
+	if m != nil {
+		m.phases.WithLabelValues(phase).Observe(d.Seconds())
+	}
+}
+
+func (m *Metrics) decided(outcome string) {
+	if m != nil {
+		m.decisions.WithLabelValues(strings.ToLower(outcome)).Inc()
+	}
+}
+
+func (m *Metrics) serverDecided(server string, outcome string) {
+	if m != nil {
+		m.serverDecisions.WithLabelValues(server, strings.ToLower(outcome)).Inc()
+	}
+}
+
+// reads the gauges from the coordinators and servers when scraped.
+type metricsCollector struct {
+	m *Metrics
+}
+
+func (c metricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- coordinatorInDoubtDesc
+	ch <- serverLocksDesc
+	ch <- serverInDoubtDesc
+}
+
+func (c metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.m.mu.Lock()
+	coordinators := make([]*Coordinator, 0, len(c.m.coordinators))
+	for _, co := range c.m.coordinators {
+		if !co.killed() {
+			coordinators = append(coordinators, co)
+		}
+	}
+	c.m.coordinators = coordinators // forget the killed ones
+	servers := make(map[string]*Server, len(c.m.servers))
+	for name, sv := range c.m.servers {
+		servers[name] = sv
+	}
+	c.m.mu.Unlock()
+
+	inDoubt := 0
+	for _, co := range coordinators {
+		inDoubt += co.inDoubt()
+	}
+	ch <- prometheus.MustNewConstMetric(coordinatorInDoubtDesc, prometheus.GaugeValue, float64(inDoubt))
+
+	for name, sv := range servers {
+		if sv.killed() {
+			continue
+		}
+		held := 0
+		for _, l := range sv.lockTable() {
+			if l.locked {
+				held++
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(serverLocksDesc, prometheus.GaugeValue, float64(held), name)
+		ch <- prometheus.MustNewConstMetric(serverInDoubtDesc, prometheus.GaugeValue, float64(len(sv.undecided())), name)
+	}
+}
+
+// how many of the Coordinator's transactions are in Prepare or PreCommit.
+func (co *Coordinator) inDoubt() int {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+
+	n := 0
+	for _, tran := range co.tran {
+		if tran.Phase == PhasePrepare || tran.Phase == PhasePreCommit {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,112 @@
+package commit
+
+import (
+	"3PhaseCommit/labrpc"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Holds a transaction at PreCommit, then lets it commit and aborts another,
+// scraping the metrics handler as it goes
+// The gauges should show the held transaction in doubt with its locks, and the
+// counters and histograms should count each outcome and phase once it's reported
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+
+	m := MakeMetrics()
+	web := httptest.NewServer(m.Handler())
+	defer web.Close()
+	scrape := func() string {
+		resp, err := web.Client().Get(web.URL)
+		if err != nil {
+			t.Fatalf("scrape failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+	// wait until the scrape has every line in lines
+	expect := func(lines ...string) {
+		t.Helper()
+		var body string
+		for start := time.Now(); time.Since(start) < waitTimeout; time.Sleep(10 * time.Millisecond) {
+			body = scrape()
+			missing := false
+			for _, line := range lines {
+				if !strings.Contains(body, line+"\n") {
+					missing = true
+				}
+			}
+			if !missing {
+				return
+			}
+		}
+		t.Fatalf("expected the metrics to include %q, got:\n%s", lines, body)
+	}
+
+	net := labrpc.MakeNetwork()
+	defer net.Cleanup()
+	tr := makeLabrpcTransport(net)
+	sv := MakeServer([]string{"x", "y"}, MakePersister())
+	defer sv.Kill()
+	sv.SetMetrics(m, "server0")
+	held := make(chan struct{})
+	sv.setHook(func(point hookPoint, method string, tid int, meta Metadata) {
+		if point == hookBefore && method == "Server.PreCommit" && tid == 0 {
+			<-held
+		}
+	})
+	tr.Serve("server0", sv)
+	end, _ := tr.Dial("server0")
+	respChan := make(chan ResponseMsg)
+	co := MakeCoordinator([]PeerClient{end}, respChan)
+	defer co.Kill()
+	co.SetMetrics(m)
+
+	sv.Set(0, "x", 1)
+	sv.Get(0, "y")
+	co.FinishTransaction(0)
+	expect(
+		`threepc_coordinator_in_doubt_transactions 1`,
+		`threepc_server_locks_held{server="server0"} 2`,
+		`threepc_server_in_doubt_transactions{server="server0"} 1`,
+	)
+
+	close(held)
+	await := func(tid int, committed bool) {
+		select {
+		case msg := <-respChan:
+			if msg.tid != tid || msg.committed != committed {
+				t.Fatalf("expected transaction %d to commit: %v, got %+v", tid, committed, msg)
+			}
+		case <-time.After(waitTimeout):
+			t.Fatalf("Transaction %d got no response within %v", tid, waitTimeout)
+		}
+	}
+	await(0, true)
+	sv.Set(1, "w", 2) // w isn't a key, so transaction 1 aborts
+	co.FinishTransaction(1)
+	await(1, false)
+	expect(
+		`threepc_coordinator_in_doubt_transactions 0`,
+		`threepc_server_locks_held{server="server0"} 0`,
+		`threepc_server_in_doubt_transactions{server="server0"} 0`,
+		`threepc_coordinator_transactions_total{outcome="committed"} 1`,
+		`threepc_coordinator_transactions_total{outcome="aborted"} 1`,
+		`threepc_server_transactions_total{outcome="committed",server="server0"} 1`,
+		`threepc_server_transactions_total{outcome="aborted",server="server0"} 1`,
+		`threepc_coordinator_phase_duration_seconds_count{phase="Prepare"} 2`,
+		`threepc_coordinator_phase_duration_seconds_count{phase="PreCommit"} 1`,
+		`threepc_coordinator_phase_duration_seconds_count{phase="Committed"} 1`,
+		`threepc_coordinator_phase_duration_seconds_count{phase="Aborted"} 1`,
+	)
+
+	// a killed coordinator's transactions are no longer counted
+	co.Kill()
+	if body := scrape(); !strings.Contains(body, "threepc_coordinator_in_doubt_transactions 0\n") {
+		t.Fatalf("expected no in-doubt transactions after Kill, got:\n%s", body)
+	}
+}
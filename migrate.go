@@ -0,0 +1,505 @@
+package commit
+
+//
+// moving keys, and the transactions on them, from one Server to
+// another while the system keeps running, e.g. to replace a
+// server's machine:
+//
+//   sv := MakeServer(keys, MakePersister()) // the new machine
+//   tr.Serve("server0-new", sv)
+//   end, _ := tr.Dial("server0-new")
+//   if err := co.ReplaceServer(0, end); err != nil {
+//       // server 0 is unchanged
+//   }
+//
+// or, to move a range of keys between two servers:
+//
+//   co.MigrateKeys(0, 1, KeyRange{From: "m"}) // keys from "m" on
+//
+// the target must already store the keys, as MakeServer() made it
+// with them. while the keys move, the Coordinator holds its messages
+// to the source: first Prepare, so that no new transaction votes on
+// its keys, then, once the Prepares already sent have been answered,
+// everything else. transactions on its keys wait rather than abort.
+// if the messages already sent aren't answered within the phase
+// timeout, on the Coordinator's clock, the migration gives up with
+// ErrStillInFlight and lets the messages go.
+// the source's ExportKeys handler then returns the keys' values and
+// versions and the transactions on them, and refuses Gets and Sets on
+// them from then on with ErrKeyMoved. the target's ImportKeys takes
+// them, re-acquiring the locks of those in doubt as after a restart,
+// and persists them. the source's ReleaseKeys then drops the keys,
+// or, if the import failed, takes them back.
+//
+// ReplaceServer() moves every key and every transaction to the new
+// server, which then takes the old one's place: the Coordinator's
+// messages for transactions in doubt go to it. MigrateKeys() moves
+// only the keys, since the Coordinator would still send the
+// transactions' messages to the source: it waits, up to
+// migrateTimeout, until no transaction is in doubt on them. a
+// transaction whose operations on them hadn't been prepared stays on
+// the source, which votes No on it as on keys it doesn't have, and
+// the client retries it on the target. clients send the keys'
+// operations to the target once the call returns.
+//
+// the source's Persister no longer holds the keys, but the keys a
+// Server stores are the ones it's made with, so it must be restarted
+// without them. the RPCs are served over labrpc; the other transports
+// carry only the 3PC messages so far, and refuse them with
+// ErrUnsupportedMethod, which MigrateKeys() and ReplaceServer()
+// return before holding any messages.
+//
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// how long MigrateKeys() waits for the transactions in doubt on the
+// keys to finish.
+const migrateTimeout = 10 * time.Second
+
+// how often a migration's waits check the Coordinator's clock.
+const migrateCheckInterval = 10 * time.Millisecond
+
+var (
+	// returned by MigrateKeys() when transactions on the keys were
+	// still in doubt after migrateTimeout.
+	ErrStillInDoubt = errors.New("transactions on the keys are still in doubt")
+
+	// returned when messages to the source were still unanswered
+	// after the phase timeout.
+	ErrStillInFlight = errors.New("messages to the server are still in flight")
+)
+
+// the keys from From up to, not including, To; "" for To means no
+// end, so KeyRange{} is every key.
+type KeyRange struct {
+	From string
+	To   string
+}
+
+func (r KeyRange) contains(key string) bool {
+	return key >= r.From && (r.To == "" || key < r.To)
+}
+
+// a transaction as the source knew it, with its operations and read
+// values on the keys that moved.
+type MigratedTransaction struct {
+	State      TransactionState
+	HasState   bool
+	Operations []Operation
+	ReadValues map[string]interface{}
+}
+
+type ExportArgs struct {
+	Range KeyRange
+}
+
+type ExportReply struct {
+	Values       map[string]interface{}
+	Versions     map[string]int
+	Transactions map[int]MigratedTransaction
+}
+
+type ImportArgs struct {
+	Values       map[string]interface{}
+	Versions     map[string]int
+	Transactions map[int]MigratedTransaction
+}
+
+type ImportReply struct {
+	Err string // why the keys weren't imported, or ""
+}
+
+type ReleaseArgs struct {
+	Range KeyRange
+	Moved bool // drop the keys, rather than take them back
+}
+
+// the transactions that voted Yes and weren't decided, sorted.
+func (reply *ExportReply) inDoubt() []int {
+	tids := make([]int, 0)
+	for tid, t := range reply.Transactions {
+		if t.State == stateVotedYes || t.State == statePreCommitted {
+			tids = append(tids, tid)
+		}
+	}
+	sort.Ints(tids)
+	return tids
+}
+
+// ExportKeys handler
+// Replies with the values and transactions of the keys in args.Range,
+// and refuses operations on them from now on
+func (sv *Server) ExportKeys(meta Metadata, args *ExportArgs, reply *ExportReply) {
+	sv.runHook(hookBefore, "Server.ExportKeys", noTid, meta)
+	defer sv.runHook(hookAfter, "Server.ExportKeys", noTid, meta)
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	reply.Values = make(map[string]interface{})
+	reply.Versions = make(map[string]int)
+	for key, item := range sv.store {
+		if args.Range.contains(key) {
+			sv.moved[key] = true
+			reply.Values[key] = item.value
+			reply.Versions[key] = item.version
+		}
+	}
+
+	// every transaction moves with every key, even one that had
+	// none, so the new server can tell a recovering Coordinator
+	// about it
+	all := args.Range == KeyRange{}
+	reply.Transactions = make(map[int]MigratedTransaction)
+	for _, tid := range sv.transactionIDs() {
+		t := MigratedTransaction{ReadValues: make(map[string]interface{})}
+		t.State, t.HasState = sv.states[tid]
+		for _, op := range sv.operations[tid] {
+			if args.Range.contains(op.Key) {
+				t.Operations = append(t.Operations, op)
+			}
+		}
+		for key, value := range sv.readValues[tid] {
+			if args.Range.contains(key) {
+				t.ReadValues[key] = value
+			}
+		}
+		if all || len(t.Operations) > 0 {
+			reply.Transactions[tid] = t
+		}
+	}
+	sv.logFor(withTxn(context.Background(), noTid, phaseMigration)).Infof("exported %d keys and %d transactions", len(reply.Values), len(reply.Transactions))
+}
+
+// the transactions this server knows of, with operations or a state.
+// must be called with sv.mu held
+func (sv *Server) transactionIDs() []int {
+	seen := make(map[int]bool)
+	tids := make([]int, 0)
+	for tid := range sv.operations {
+		seen[tid] = true
+		tids = append(tids, tid)
+	}
+	for tid := range sv.states {
+		if !seen[tid] {
+			tids = append(tids, tid)
+		}
+	}
+	sort.Ints(tids)
+	return tids
+}
+
+// ImportKeys handler
+// Takes the keys and transactions another server exported, which must
+// be keys this server stores. a resent import changes nothing
+func (sv *Server) ImportKeys(meta Metadata, args *ImportArgs, reply *ImportReply) {
+	sv.runHook(hookBefore, "Server.ImportKeys", noTid, meta)
+	defer sv.runHook(hookAfter, "Server.ImportKeys", noTid, meta)
+	ctx := withTxn(context.Background(), noTid, phaseMigration)
+	sv.mu.Lock()
+
+	for key := range args.Values {
+		if _, exists := sv.store[key]; !exists {
+			reply.Err = fmt.Sprintf("no key %q here", key)
+			sv.mu.Unlock()
+			return
+		}
+	}
+
+	// a transaction already here must be the same one, imported
+	// before; the others in doubt take their locks as after a restart
+	imported := make([]int, 0)
+	for tid, t := range args.Transactions {
+		state, exists := sv.states[tid]
+		if _, ops := sv.operations[tid]; ops || exists {
+			if exists != t.HasState || state != t.State || !reflect.DeepEqual(sv.operations[tid], t.Operations) {
+				reply.Err = fmt.Sprintf("transaction %d is already here in another state", tid)
+				sv.mu.Unlock()
+				return
+			}
+			continue
+		}
+		imported = append(imported, tid)
+	}
+	sort.Ints(imported)
+
+	var locked []Operation
+	for _, tid := range imported {
+		t := args.Transactions[tid]
+		if t.State != stateVotedYes && t.State != statePreCommitted {
+			continue
+		}
+		for _, op := range lockOrder(t.Operations) {
+			item, exists := sv.store[op.Key]
+			if !exists {
+				continue
+			}
+			if (op.IsGet && !item.lock.TryRLock()) || (!op.IsGet && !item.lock.TryLock()) {
+				sv.unlockOps(ctx, locked)
+				reply.Err = fmt.Sprintf("key %s is locked here", op.Key)
+				sv.mu.Unlock()
+				return
+			}
+			locked = append(locked, op)
+		}
+	}
+
+	for key, value := range args.Values {
+		sv.store[key].value = value
+		sv.store[key].version = args.Versions[key]
+	}
+	for _, tid := range imported {
+		t := args.Transactions[tid]
+		if len(t.Operations) > 0 {
+			sv.operations[tid] = t.Operations
+		}
+		if t.HasState {
+			sv.states[tid] = t.State
+		}
+		if len(t.ReadValues) > 0 {
+			sv.readValues[tid] = t.ReadValues
+		}
+	}
+	sv.saveAllLocked()
+	sv.mu.Unlock()
+
+	if err := sv.persister.Sync(); err != nil {
+		reply.Err = fmt.Sprintf("sync: %v", err)
+		return
+	}
+	sv.logFor(ctx).Infof("imported %d keys and %d transactions", len(args.Values), len(imported))
+}
+
+// ReleaseKeys handler
+// Drops the exported keys in args.Range, or takes them back
+func (sv *Server) ReleaseKeys(meta Metadata, args *ReleaseArgs, reply *struct{}) {
+	sv.runHook(hookBefore, "Server.ReleaseKeys", noTid, meta)
+	defer sv.runHook(hookAfter, "Server.ReleaseKeys", noTid, meta)
+	ctx := withTxn(context.Background(), noTid, phaseMigration)
+	sv.mu.Lock()
+
+	released := 0
+	for key := range sv.store {
+		if !args.Range.contains(key) || !sv.moved[key] {
+			continue
+		}
+		if args.Moved {
+			delete(sv.store, key)
+		} else {
+			delete(sv.moved, key)
+		}
+		released++
+	}
+	if args.Moved {
+		sv.saveAllLocked()
+	}
+	sv.mu.Unlock()
+
+	if args.Moved {
+		if err := sv.persister.Sync(); err != nil {
+			sv.logFor(ctx).Warnf("sync: %v", err)
+		}
+	}
+	sv.logFor(ctx).Infof("released %d keys, moved %v", released, args.Moved)
+}
+
+// persist the whole state, which changed outside any transaction, so
+// the log can't hold it. must be called with sv.mu held
+func (sv *Server) saveAllLocked() {
+	if sv.maxstate < 0 {
+		sv.persister.Save(sv.encodeState())
+		return
+	}
+	// a delta only holds what the log changed
+	sv.deltaCount = sv.deltaEvery
+	sv.checkpointLocked()
+}
+
+// move the keys in r from server from to server to, whose
+// transactions stay with from. new transactions on from wait until
+// they've moved, or MigrateKeys() gives up.
+func (co *Coordinator) MigrateKeys(from int, to int, r KeyRange) error {
+	return co.migrate(from, co.server(to), r, false)
+}
+
+// move every key and transaction of server i to the server at to,
+// which then takes its place. the old server can be stopped once it
+// returns.
+func (co *Coordinator) ReplaceServer(i int, to PeerClient) error {
+	return co.migrate(i, to, KeyRange{}, true)
+}
+
+func (co *Coordinator) migrate(from int, to PeerClient, r KeyRange, replace bool) error {
+	co.migrations.Lock()
+	defer co.migrations.Unlock()
+	ctx := withTxn(context.Background(), noTid, phaseMigration)
+	done := make(chan struct{})
+	defer close(done)
+	co.spawn(func() { co.tickMigration(done) })
+
+	// exporting an empty range changes nothing, but fails at once on
+	// a transport that doesn't carry the migration's RPCs
+	for _, peer := range []PeerClient{co.server(from), to} {
+		if err := co.migrationCall(peer, "Server.ExportKeys", &ExportArgs{Range: KeyRange{From: "-", To: "-"}}, &ExportReply{}); err != nil {
+			return fmt.Errorf("reaching the servers: %w", err)
+		}
+	}
+
+	co.holdMessages(from, false)
+	defer co.releaseMessages(from)
+	deadline := co.clock.Now().Add(migrateTimeout)
+	var exported ExportReply
+	for {
+		if err := co.drain(from); err != nil {
+			return err
+		}
+		co.holdMessages(from, true)
+		if err := co.drain(from); err != nil {
+			return err
+		}
+
+		exported = ExportReply{}
+		if err := co.migrationCall(co.server(from), "Server.ExportKeys", &ExportArgs{Range: r}, &exported); err != nil {
+			co.migrationCall(co.server(from), "Server.ReleaseKeys", &ReleaseArgs{Range: r}, &struct{}{})
+			return fmt.Errorf("exporting server %d's keys: %w", from, err)
+		}
+		inDoubt := exported.inDoubt()
+		if replace || len(inDoubt) == 0 {
+			break
+		}
+
+		// let them finish
+		co.migrationCall(co.server(from), "Server.ReleaseKeys", &ReleaseArgs{Range: r}, &struct{}{})
+		if !co.clock.Now().Before(deadline) {
+			return fmt.Errorf("transactions %v on server %d: %w", inDoubt, from, ErrStillInDoubt)
+		}
+		co.logFor(ctx).Infof("waiting for transactions %v, in doubt on server %d's keys", inDoubt, from)
+		co.holdMessages(from, false)
+		co.mu.Lock()
+		retry := co.clock.Now().Add(resolveRetryInterval)
+		for co.clock.Now().Before(retry) {
+			if !co.migrationWaitLocked(deadline) {
+				break
+			}
+		}
+		co.mu.Unlock()
+	}
+
+	args := &ImportArgs{Values: exported.Values, Versions: exported.Versions}
+	if replace {
+		args.Transactions = exported.Transactions
+	}
+	reply := &ImportReply{}
+	err := co.migrationCall(to, "Server.ImportKeys", args, reply)
+	if err == nil && reply.Err != "" {
+		err = errors.New(reply.Err)
+	}
+	if err != nil {
+		co.migrationCall(co.server(from), "Server.ReleaseKeys", &ReleaseArgs{Range: r}, &struct{}{})
+		return fmt.Errorf("importing server %d's keys: %w", from, err)
+	}
+
+	// the keys are safe on to, and refused by from even if it didn't hear
+	if err := co.migrationCall(co.server(from), "Server.ReleaseKeys", &ReleaseArgs{Range: r, Moved: true}, &struct{}{}); err != nil {
+		co.logFor(ctx).Warnf("server %d didn't drop the keys it exported: %v", from, err)
+	}
+	if replace {
+		co.mu.Lock()
+		co.servers[from] = to
+		co.mu.Unlock()
+	}
+	co.logFor(ctx).Infof("moved %d keys and %d transactions from server %d", len(args.Values), len(args.Transactions), from)
+	return nil
+}
+
+// hold Prepares to server, or every message if all, until
+// releaseMessages().
+func (co *Coordinator) holdMessages(server int, all bool) {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	co.migrating[server] = all
+	co.migrated.Broadcast()
+}
+
+func (co *Coordinator) releaseMessages(server int) {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	delete(co.migrating, server)
+	co.migrated.Broadcast()
+}
+
+// wake the migration's waits every migrateCheckInterval, so that
+// they see the Coordinator's clock pass their deadlines, until done
+// is closed.
+func (co *Coordinator) tickMigration(done chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(migrateCheckInterval):
+		}
+		co.mu.Lock()
+		co.migrated.Broadcast()
+		co.mu.Unlock()
+	}
+}
+
+// wait for the next change or tick; false if deadline has passed on
+// the Coordinator's clock, or we've been killed.
+// must be called with co.mu held
+func (co *Coordinator) migrationWaitLocked(deadline time.Time) bool {
+	if co.killed() || !co.clock.Now().Before(deadline) {
+		return false
+	}
+	co.migrated.Wait()
+	return true
+}
+
+// wait until server has answered, or failed, every message sent to
+// it; ErrStillInFlight if it hasn't within the phase timeout.
+func (co *Coordinator) drain(server int) error {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	deadline := co.clock.Now().Add(co.timeout)
+	for co.inflight[server] > 0 {
+		if !co.migrationWaitLocked(deadline) {
+			return fmt.Errorf("%d messages to server %d: %w", co.inflight[server], server, ErrStillInFlight)
+		}
+	}
+	return nil
+}
+
+// wait while a migration holds method to server.
+// must be called with co.mu held
+func (co *Coordinator) waitMigrationLocked(server int, method string) {
+	for !co.killed() {
+		all, held := co.migrating[server]
+		if !held || (!all && method != "Prepare") {
+			return
+		}
+		co.migrated.Wait()
+	}
+}
+
+// call one of a migration's handlers, resending for as long as
+// Prepare would be.
+func (co *Coordinator) migrationCall(peer PeerClient, method string, args interface{}, reply interface{}) error {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	deadline := co.clock.Now().Add(co.timeout)
+
+	for {
+		co.mu.Unlock()
+		err := peer.CallErr(method, Metadata{}, args, reply)
+		co.mu.Lock()
+		if err == nil || errors.Is(err, ErrMessageTooLarge) || errors.Is(err, ErrUnsupportedMethod) || !co.migrationWaitLocked(deadline) {
+			return err
+		}
+	}
+}
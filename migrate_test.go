@@ -0,0 +1,255 @@
+package commit
+
+import (
+	"3PhaseCommit/labrpc"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// a PeerClient whose calls to method fail without being sent while
+// refusing is set.
+type refusingPeer struct {
+	PeerClient
+	method   string
+	refusing atomic.Bool
+}
+
+func (p *refusingPeer) CallErr(svcMeth string, meta Metadata, args interface{}, reply interface{}) error {
+	if svcMeth == p.method && p.refusing.Load() {
+		return errors.New("refused in a test")
+	}
+	return p.PeerClient.CallErr(svcMeth, meta, args, reply)
+}
+
+// Moves key b from server 0 to server 1, then replaces server 0 while a committed transaction is
+// pre-committed there, its Commits lost, and another has logged a Set there but not prepared. The moved keys should
+// keep their values and be refused by the old server, both transactions should commit on the new one,
+// and a transaction started during the replacement should wait for it rather than reach server 1
+func TestMigration(t *testing.T) {
+	t.Parallel()
+
+	net := labrpc.MakeNetwork()
+	defer net.Cleanup()
+	tr := makeLabrpcTransport(net)
+	sv0 := MakeServer([]string{"a", "b"}, MakePersister())
+	defer sv0.Kill()
+	sv1 := MakeServer([]string{"b", "x"}, MakePersister())
+	defer sv1.Kill()
+	tr.Serve("server0", sv0)
+	tr.Serve("server1", sv1)
+	end0, _ := tr.Dial("server0")
+	end1, _ := tr.Dial("server1")
+	peer0 := &refusingPeer{PeerClient: end0, method: "Server.Commit"}
+
+	respChan := make(chan ResponseMsg, 10)
+	co := MakeCoordinator([]PeerClient{peer0, end1}, respChan)
+	defer co.Kill()
+	finish := func(tids ...int) {
+		waiting := make(map[int]bool)
+		for _, tid := range tids {
+			waiting[tid] = true
+		}
+		for len(waiting) > 0 {
+			select {
+			case m := <-respChan:
+				if !waiting[m.tid] || !m.committed {
+					t.Fatalf("expected transactions %v to commit, got %+v", tids, m)
+				}
+				delete(waiting, m.tid)
+			case <-time.After(waitTimeout):
+				t.Fatalf("transactions %v didn't finish within %v", tids, waitTimeout)
+			}
+		}
+	}
+
+	sv0.Set(0, "a", 1)
+	sv0.Set(0, "b", 2)
+	sv1.Set(0, "x", 3)
+	co.FinishTransaction(0)
+	finish(0)
+
+	if err := co.MigrateKeys(0, 1, KeyRange{From: "b", To: "c"}); err != nil {
+		t.Fatalf("MigrateKeys: %v", err)
+	}
+	if v := sv1.storeValues()["b"]; v != 2 {
+		t.Fatalf("expected b = 2 on server 1, got %v", v)
+	}
+	if err := sv0.Set(1, "b", 4); !errors.Is(err, ErrKeyMoved) {
+		t.Fatalf("expected server 0 to refuse b as moved, got %v", err)
+	}
+	sv1.Set(1, "b", 4)
+	co.FinishTransaction(1)
+	finish(1)
+
+	// transaction 2 pre-commits on server 0, whose Commits are lost
+	peer0.refusing.Store(true)
+	sv0.Set(2, "a", 10)
+	sv1.Set(2, "x", 11)
+	co.FinishTransaction(2)
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		state, _ := sv0.transactionState(2)
+		if phase, _, _ := co.transactionPhase(2); state == statePreCommitted && phase == PhaseCommitted {
+			break
+		}
+		if time.Since(start) > waitTimeout {
+			t.Fatalf("transaction 2 didn't pre-commit on server 0 and get decided")
+		}
+	}
+	sv0.Set(3, "a", 20)
+
+	svNew := MakeServer([]string{"a"}, MakePersister())
+	defer svNew.Kill()
+	reachedServer1 := make(chan bool, 1)
+	svNew.setHook(func(point hookPoint, method string, tid int, meta Metadata) {
+		if point == hookBefore && method == "Server.ImportKeys" {
+			sv1.Set(4, "b", 30)
+			co.FinishTransaction(4)
+			time.Sleep(100 * time.Millisecond)
+			_, reached := sv1.transactionState(4)
+			reachedServer1 <- reached
+		}
+	})
+	tr.Serve("server0-new", svNew)
+	endNew, _ := tr.Dial("server0-new")
+	if err := co.ReplaceServer(0, endNew); err != nil {
+		t.Fatalf("ReplaceServer: %v", err)
+	}
+	if <-reachedServer1 {
+		t.Fatalf("expected transaction 4 to wait for the replacement before preparing")
+	}
+	finish(2, 4)
+	if err := sv0.Set(5, "a", 40); !errors.Is(err, ErrKeyMoved) {
+		t.Fatalf("expected the old server to refuse a as moved, got %v", err)
+	}
+
+	co.FinishTransaction(3)
+	finish(3)
+	if v := svNew.storeValues()["a"]; v != 20 {
+		t.Fatalf("expected a = 20 on the new server, got %v", v)
+	}
+	if v := sv1.storeValues()["b"]; v != 30 {
+		t.Fatalf("expected b = 30 on server 1, got %v", v)
+	}
+	if held := svNew.heldLocks(); len(held) != 0 {
+		t.Fatalf("expected the new server to hold no locks, got %v", held)
+	}
+}
+
+// Migrates a key between two servers served over each transport, then commits a transaction
+// Only labrpc carries the migration's RPCs; the others should refuse the migration with
+// ErrUnsupportedMethod, without holding the transaction's messages
+func TestMigrationTransports(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range transportCases() {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			tr := tc.make(t)
+			sv0 := MakeServer([]string{"a", "b"}, MakePersister())
+			defer sv0.Kill()
+			sv1 := MakeServer([]string{"b"}, MakePersister())
+			defer sv1.Kill()
+			peers := []PeerClient{serveAndDial(t, tr, tc.addrs[0], sv0), serveAndDial(t, tr, tc.addrs[1], sv1)}
+			respChan := make(chan ResponseMsg, 1)
+			co := MakeCoordinator(peers, respChan)
+			defer co.Kill()
+			finish := func(tid int) {
+				select {
+				case m := <-respChan:
+					if m.tid != tid || !m.committed {
+						t.Fatalf("expected transaction %d to commit, got %+v", tid, m)
+					}
+				case <-time.After(waitTimeout):
+					t.Fatalf("transaction %d didn't finish within %v", tid, waitTimeout)
+				}
+			}
+
+			sv0.Set(0, "b", 1)
+			co.FinishTransaction(0)
+			finish(0)
+
+			err := co.MigrateKeys(0, 1, KeyRange{From: "b", To: "c"})
+			if tc.name == "labrpc" && err != nil {
+				t.Fatalf("MigrateKeys: %v", err)
+			} else if tc.name != "labrpc" && !errors.Is(err, ErrUnsupportedMethod) {
+				t.Fatalf("expected ErrUnsupportedMethod, got %v", err)
+			}
+
+			sv0.Set(1, "a", 2)
+			co.FinishTransaction(1)
+			finish(1)
+		})
+	}
+}
+
+// Starts a migration while a Prepare to the source is stuck in flight, on a simulated clock
+// The migration should wait until the clock passes the phase timeout, then give up with
+// ErrStillInFlight, leaving the keys on the source and the transaction free to finish
+func TestMigrationStuckMessage(t *testing.T) {
+	t.Parallel()
+
+	net := labrpc.MakeNetwork()
+	defer net.Cleanup()
+	tr := makeLabrpcTransport(net)
+	sv0 := MakeServer([]string{"a", "b"}, MakePersister())
+	defer sv0.Kill()
+	sv1 := MakeServer([]string{"b"}, MakePersister())
+	defer sv1.Kill()
+	tr.Serve("server0", sv0)
+	tr.Serve("server1", sv1)
+	end0, _ := tr.Dial("server0")
+	end1, _ := tr.Dial("server1")
+	peer0 := &stallingPeer{PeerClient: end0, method: "Server.Prepare", release: make(chan struct{})}
+
+	clock := MakeSimClock()
+	respChan := make(chan ResponseMsg, 1)
+	co := makeLoggingCoordinator([]PeerClient{peer0, end1}, respChan, clock, phaseTimeout, stdLogger("coordinator"), nil, nil)
+	defer co.Kill()
+
+	sv0.Set(0, "a", 1)
+	co.FinishTransaction(0)
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		co.mu.Lock()
+		stuck := co.inflight[0] > 0
+		co.mu.Unlock()
+		if stuck {
+			break
+		}
+		if time.Since(start) > waitTimeout {
+			t.Fatalf("the Prepare to server 0 was never sent")
+		}
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- co.MigrateKeys(0, 1, KeyRange{From: "b", To: "c"}) }()
+	select {
+	case err := <-errc:
+		t.Fatalf("expected the migration to wait for the clock, got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	clock.Advance(phaseTimeout)
+	select {
+	case err := <-errc:
+		if !errors.Is(err, ErrStillInFlight) {
+			t.Fatalf("expected ErrStillInFlight, got %v", err)
+		}
+	case <-time.After(waitTimeout):
+		t.Fatalf("the migration didn't give up within %v of the clock passing its deadline", waitTimeout)
+	}
+
+	close(peer0.release)
+	select {
+	case m := <-respChan:
+		if m.tid != 0 || !m.committed {
+			t.Fatalf("expected transaction 0 to commit, got %+v", m)
+		}
+	case <-time.After(waitTimeout):
+		t.Fatalf("transaction 0 didn't finish within %v", waitTimeout)
+	}
+	if err := sv0.Set(1, "b", 2); err != nil {
+		t.Fatalf("expected b to stay on server 0, got %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+package models
+
+//
+// a porcupine model of the transactional key/value store
+// implemented by the 3PC servers: each operation is a whole
+// transaction, which either commits atomically or has no effect.
+//
+
+import (
+	"3PhaseCommit/porcupine"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// one Get or Set inside a transaction.
+type TxnOp struct {
+	IsGet bool
+	Key   string
+	Value interface{} // nil for Get
+}
+
+type TxnInput struct {
+	Tid int
+	Ops []TxnOp
+}
+
+type TxnOutput struct {
+	Unknown    bool // no response was seen; it may or may not have committed
+	Committed  bool
+	ReadValues map[string]interface{}
+}
+
+// apply a transaction's operations in order, returning the new
+// state and the value each key was last read as.
+func apply(state map[string]interface{}, ops []TxnOp) (map[string]interface{}, map[string]interface{}) {
+	next := make(map[string]interface{}, len(state))
+	for k, v := range state {
+		next[k] = v
+	}
+	reads := make(map[string]interface{})
+	for _, op := range ops {
+		if op.IsGet {
+			reads[op.Key] = next[op.Key]
+		} else {
+			next[op.Key] = op.Value
+		}
+	}
+	return next, reads
+}
+
+var TxnKvModel = (&porcupine.NondeterministicModel{
+	Init: func() []interface{} {
+		return []interface{}{map[string]interface{}{}}
+	},
+	Step: func(state, input, output interface{}) []interface{} {
+		st := state.(map[string]interface{})
+		inp := input.(TxnInput)
+		out := output.(TxnOutput)
+
+		next, reads := apply(st, inp.Ops)
+		if out.Unknown {
+			return []interface{}{st, next}
+		}
+		if !out.Committed {
+			return []interface{}{st}
+		}
+		for k, v := range reads {
+			if !reflect.DeepEqual(out.ReadValues[k], v) {
+				return nil
+			}
+		}
+		return []interface{}{next}
+	},
+	Equal: func(state1, state2 interface{}) bool {
+		return reflect.DeepEqual(state1, state2)
+	},
+	DescribeOperation: func(input, output interface{}) string {
+		inp := input.(TxnInput)
+		out := output.(TxnOutput)
+		desc := fmt.Sprintf("txn %d [", inp.Tid)
+		for i, op := range inp.Ops {
+			if i > 0 {
+				desc += " "
+			}
+			if op.IsGet {
+				desc += fmt.Sprintf("get(%s)", op.Key)
+			} else {
+				desc += fmt.Sprintf("set(%s, %v)", op.Key, op.Value)
+			}
+		}
+		switch {
+		case out.Unknown:
+			return desc + "] -> ?"
+		case !out.Committed:
+			return desc + "] -> aborted"
+		default:
+			return desc + fmt.Sprintf("] -> committed %v", out.ReadValues)
+		}
+	},
+	DescribeState: func(state interface{}) string {
+		st := state.(map[string]interface{})
+		keys := make([]string, 0, len(st))
+		for k := range st {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		desc := "{"
+		for i, k := range keys {
+			if i > 0 {
+				desc += ", "
+			}
+			desc += fmt.Sprintf("%s: %v", k, st[k])
+		}
+		return desc + "}"
+	},
+}).ToModel()
@@ -0,0 +1,198 @@
+package commit
+
+//
+// support for Servers to save persistent state
+// (the store, logged operations and transaction states)
+// so that it survives a crash and restart.
+//
+// the tester hands each Server a Persister in MakeServer(),
+// and passes the same (copied) Persister to the Server that
+// replaces it after a crash.
+//
+// a Server made with MakeServerWithSnapshots() keeps a snapshot of
+// its whole state next to a log of the changes since, so each
+// change only rewrites the (short) log.
+//
+// the tester can make the next write fail, vanish or tear, to
+// check that servers survive a bad disk; see cfg.diskFaultNext().
+//
+// MakePersister() keeps the state in memory; OpenPersister() also
+// keeps it in files (disk.go).
+//
+
+import "sync"
+
+type Persister struct {
+	mu          sync.Mutex
+	serverstate []byte
+	snapshot    []byte
+	deltas      []byte               // changes since the snapshot, framed; see delta.go
+	fault       diskFault            // what goes wrong with the next write
+	crash       func()               // stops the server when a write fails or tears
+	disk        *diskFiles           // where writes go too; nil if kept in memory only
+	retained    []retainedCheckpoint // older snapshots and their logs, oldest first; see pitr.go
+	mirror      mirrorFunc           // sends each write to a replica group first; see replica.go
+	mirrorErr   error                // the first write the group didn't take
+}
+
+type diskFault int
+
+const (
+	diskOK        diskFault = iota
+	diskFailWrite           // the write fails, and the server stops
+	diskDropSync            // the write seems to work, but never reaches the disk
+	diskTearWrite           // the server stops partway through the write
+)
+
+func (f diskFault) String() string {
+	switch f {
+	case diskOK:
+		return "ok"
+	case diskFailWrite:
+		return "fail write"
+	case diskDropSync:
+		return "drop sync"
+	case diskTearWrite:
+		return "tear write"
+	}
+	return "unknown"
+}
+
+func MakePersister() *Persister {
+	return &Persister{}
+}
+
+func clone(orig []byte) []byte {
+	x := make([]byte, len(orig))
+	copy(x, orig)
+	return x
+}
+
+// a copy kept in memory, even of a Persister kept on disk.
+func (ps *Persister) Copy() *Persister {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	np := MakePersister()
+	np.serverstate = ps.serverstate[:len(ps.serverstate):len(ps.serverstate)] // Append() doesn't share it
+	np.snapshot = ps.snapshot
+	np.deltas = ps.deltas
+	np.retained = append([]retainedCheckpoint(nil), ps.retained...)
+	return np
+}
+
+func (ps *Persister) ReadServerState() []byte {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return clone(ps.serverstate)
+}
+
+func (ps *Persister) ServerStateSize() int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return len(ps.serverstate)
+}
+
+func (ps *Persister) Save(serverstate []byte) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	switch ps.takeFault() {
+	case diskFailWrite, diskDropSync:
+		return
+	case diskTearWrite:
+		serverstate = tear(ps.serverstate, serverstate)
+	}
+	if !ps.mirrorLocked(serverstate, ps.snapshot, ps.deltas) {
+		return
+	}
+	if ps.disk != nil {
+		ps.disk.write(ps.disk.state, ps.serverstate, serverstate)
+	}
+	ps.serverstate = clone(serverstate)
+}
+
+// append data to the server state, e.g. a record to a log, writing
+// only data to the disk.
+func (ps *Persister) Append(data []byte) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	switch ps.takeFault() {
+	case diskFailWrite, diskDropSync:
+		return
+	case diskTearWrite:
+		data = data[:len(data)/2]
+	}
+	serverstate := append(ps.serverstate, data...)
+	if !ps.mirrorLocked(serverstate, ps.snapshot, ps.deltas) {
+		return
+	}
+	if ps.disk != nil {
+		ps.disk.append(ps.disk.state, len(ps.serverstate), data)
+	}
+	ps.serverstate = serverstate
+}
+
+// save both the server state and a snapshot, atomically, and
+// drop the deltas, which the snapshot replaces.
+// a torn write leaves both as they were, as if the new
+// files never replaced the old ones.
+func (ps *Persister) SaveStateAndSnapshot(serverstate []byte, snapshot []byte) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.takeFault() != diskOK || !ps.mirrorLocked(serverstate, snapshot, nil) {
+		return
+	}
+	if ps.disk != nil {
+		ps.disk.snapshot = ps.disk.replace(ps.disk.snapshot, snapshot)
+		ps.disk.state = ps.disk.replace(ps.disk.state, serverstate)
+		if len(ps.deltas) > 0 {
+			ps.disk.deltas = ps.disk.replace(ps.disk.deltas, nil)
+		}
+	}
+	ps.serverstate = clone(serverstate)
+	ps.snapshot = clone(snapshot)
+	ps.deltas = nil
+}
+
+// make the next write go wrong as f says. crash is called,
+// with the writer's locks held, if the server must stop.
+func (ps *Persister) injectFault(f diskFault, crash func()) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.fault = f
+	ps.crash = crash
+}
+
+// the fault for this write, which is then forgotten.
+func (ps *Persister) takeFault() diskFault {
+	f := ps.fault
+	ps.fault = diskOK
+	if (f == diskFailWrite || f == diskTearWrite) && ps.crash != nil {
+		ps.crash()
+	}
+	return f
+}
+
+// what's left of a write of new over old if it stops partway:
+// old, and half of whatever new adds to it, as when appending
+// to a log. a write that doesn't grow the state leaves old.
+func tear(old []byte, new []byte) []byte {
+	if len(new) <= len(old) {
+		return old
+	}
+	return new[:len(old)+(len(new)-len(old))/2]
+}
+
+func (ps *Persister) ReadSnapshot() []byte {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return clone(ps.snapshot)
+}
+
+func (ps *Persister) SnapshotSize() int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return len(ps.snapshot)
+}
@@ -0,0 +1,236 @@
+package commit
+
+//
+// rolling a Server's state back to how it was just after an earlier
+// transaction committed, e.g. to undo an application's mistake:
+//
+//   sv := MakeServerWithSnapshots(keys, ps, 1<<20)
+//   sv.RetainCheckpoints(24)
+//   sv.CheckpointEvery(time.Hour)
+//   ...
+//   sv.Kill()
+//   old, _ := OpenPersister(dir, DiskOptions{})
+//   rolled, _ := OpenPersister(otherDir, DiskOptions{Fsync: true})
+//   err := RollBack(old, rolled, keys, RecoveryTarget{Time: lastGood})
+//   sv = MakeServerWithSnapshots(keys, rolled, 1<<20)
+//
+// normally a checkpoint throws away the snapshot and log it
+// replaces. with RetainCheckpoints(n), the last n of them are kept:
+// in memory, and for a Persister from OpenPersister() as files
+// retained/<n>.snapshot, retained/<n>.deltas and retained/<n>.log. each committed record
+// in the log carries the time it committed.
+//
+// RollBack() finds the latest snapshot whose log holds the target,
+// replays the log onto it up to the target's commit, and writes the
+// result to another Persister as a snapshot with an empty log. a
+// transaction that was in doubt at the target is aborted in the
+// result, since its outcome came later. the target is a transaction,
+// or a time, which stands for the last transaction committed by
+// then; a target older than the oldest retained log is refused with
+// ErrNotRetained. the Server on the old Persister should be stopped,
+// and the other servers and Coordinator are not rolled back with it.
+//
+
+import (
+	"3PhaseCommit/labgob"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// returned by RollBack() when no retained log holds the target.
+var ErrNotRetained = errors.New("the target is older than the retained logs")
+
+// where to roll back to.
+type RecoveryTarget struct {
+	Tid  int       // just after this transaction committed, unless Time is set
+	Time time.Time // just after the last transaction that committed by then
+}
+
+// a snapshot a checkpoint replaced, with its deltas (delta.go), and
+// the log written after them.
+type retainedCheckpoint struct {
+	gen      int // counts up with each checkpoint
+	snapshot []byte
+	deltas   []byte
+	log      []byte
+}
+
+// keep the snapshot and log of the last n checkpoints; 0 keeps none.
+// those already kept beyond n go at the next checkpoint.
+func (sv *Server) RetainCheckpoints(n int) {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	sv.retain = n
+}
+
+// keep the snapshot about to be replaced, with log, the whole log
+// written since it, and forget all but the last keep.
+func (ps *Persister) retain(log []byte, keep int) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	gen := 1
+	if n := len(ps.retained); n > 0 {
+		gen = ps.retained[n-1].gen + 1
+	}
+	rc := retainedCheckpoint{gen: gen, snapshot: ps.snapshot, deltas: ps.deltas, log: clone(log)}
+	ps.retained = append(ps.retained, rc)
+	var dropped []retainedCheckpoint
+	if len(ps.retained) > keep {
+		dropped = ps.retained[:len(ps.retained)-keep]
+		ps.retained = append([]retainedCheckpoint(nil), ps.retained[len(ps.retained)-keep:]...)
+	}
+
+	df := ps.disk
+	if df == nil || df.err != nil {
+		return
+	}
+	dir := filepath.Join(df.dir, "retained")
+	if err := df.fs.MkdirAll(dir); err != nil {
+		df.err = err
+		return
+	}
+	// the log first: readRetained() skips a snapshot without one
+	for _, file := range []struct {
+		ext  string
+		data []byte
+	}{{"log", rc.log}, {"deltas", rc.deltas}, {"snapshot", rc.snapshot}} {
+		path := filepath.Join(dir, fmt.Sprintf("%d.%s", gen, file.ext))
+		if err := df.writeTemp(path+tmpSuffix, file.data); err != nil {
+			df.err = err
+			return
+		}
+		if err := df.fs.Rename(path+tmpSuffix, path); err != nil {
+			df.err = fmt.Errorf("rename %s: %w", path+tmpSuffix, err)
+			return
+		}
+	}
+	if df.opts.Fsync {
+		if err := df.fs.SyncDir(dir); err != nil {
+			df.err = err
+		}
+	}
+	for _, old := range dropped {
+		df.fs.Remove(filepath.Join(dir, fmt.Sprintf("%d.snapshot", old.gen)))
+		df.fs.Remove(filepath.Join(dir, fmt.Sprintf("%d.deltas", old.gen)))
+		df.fs.Remove(filepath.Join(dir, fmt.Sprintf("%d.log", old.gen)))
+	}
+}
+
+// the checkpoints a previous Persister kept in dir, oldest first.
+func readRetained(fs diskFS, dir string) ([]retainedCheckpoint, error) {
+	names, err := fs.ReadDir(filepath.Join(dir, "retained"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var retained []retainedCheckpoint
+	for _, file := range names {
+		name, isSnapshot := strings.CutSuffix(file, ".snapshot")
+		gen, err := strconv.Atoi(name)
+		if !isSnapshot || err != nil {
+			continue // a log, or a file a crash left half-written
+		}
+		rc := retainedCheckpoint{gen: gen}
+		if rc.snapshot, err = fs.ReadFile(filepath.Join(dir, "retained", file)); err != nil {
+			return nil, err
+		}
+		if rc.log, err = fs.ReadFile(filepath.Join(dir, "retained", name+".log")); err != nil {
+			return nil, err
+		}
+		// kept before checkpoints wrote deltas, if missing
+		if rc.deltas, err = fs.ReadFile(filepath.Join(dir, "retained", name+".deltas")); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		retained = append(retained, rc)
+	}
+	sort.Slice(retained, func(i, j int) bool { return retained[i].gen < retained[j].gen })
+	return retained, nil
+}
+
+// write to to the state the Server persisted in from had just after
+// target committed. keys are the Server's keys.
+func RollBack(from *Persister, to *Persister, keys []string, target RecoveryTarget) error {
+	from.mu.Lock()
+	checkpoints := append([]retainedCheckpoint(nil), from.retained...)
+	checkpoints = append(checkpoints, retainedCheckpoint{snapshot: from.snapshot, deltas: from.deltas, log: from.serverstate})
+	from.mu.Unlock()
+
+	// the later the snapshot, the less to replay
+	for i := len(checkpoints) - 1; i >= 0; i-- {
+		records, err := decodeLog(checkpoints[i].log)
+		if err != nil {
+			return err
+		}
+		if n := target.in(records); n >= 0 {
+			to.SaveStateAndSnapshot(nil, replayed(keys, checkpoints[i], records[:n+1]))
+			return nil
+		}
+	}
+	return ErrNotRetained
+}
+
+// the index of the record in which target committed, or -1.
+func (target RecoveryTarget) in(records []logRecord) int {
+	for i := len(records) - 1; i >= 0; i-- {
+		record := records[i]
+		if !record.HasState || record.State != stateCommitted {
+			continue
+		}
+		if target.Time.IsZero() && record.Tid == target.Tid {
+			return i
+		}
+		if !target.Time.IsZero() && record.Committed <= target.Time.UnixNano() {
+			return i
+		}
+	}
+	return -1
+}
+
+// the records in a log, without a torn last one.
+func decodeLog(data []byte) ([]logRecord, error) {
+	framed, _, err := readFrames(data)
+	if err != nil {
+		return nil, err
+	}
+	r := bytes.NewBuffer(framed)
+	d := labgob.NewDecoder(r)
+	var records []logRecord
+	for r.Len() > 0 {
+		var record logRecord
+		if err := d.Decode(&record); err != nil {
+			return nil, fmt.Errorf("a log record passed its checksum but can't be decoded: %w", err)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// the snapshot of a Server that started from rc's snapshot and
+// deltas, and records, with the transactions still in doubt aborted.
+func replayed(keys []string, rc retainedCheckpoint, records []logRecord) []byte {
+	fw := newFrameWriter()
+	for _, record := range records {
+		fw.encode(record)
+	}
+	ps := MakePersister()
+	ps.SaveStateAndSnapshot(nil, rc.snapshot)
+	ps.SaveStateAndDeltas(fw.bytes(), rc.deltas)
+	sv := MakeServerWithSnapshots(keys, ps, 1<<30)
+	defer sv.Kill()
+
+	for _, tid := range sv.undecided() {
+		sv.Abort(Metadata{}, &RPCArgs{Tid: tid}, &struct{}{})
+	}
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	return sv.encodeState()
+}
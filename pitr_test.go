@@ -0,0 +1,108 @@
+package commit
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Commits x=tid on a server kept on disk that retains two checkpoints, checkpointing twice
+// along the way, with a transaction setting y in doubt across the second, then rolls back
+// to several transactions and a time, live and from the reopened directory
+// Each rollback should hold the values committed by then, with the in-doubt transaction
+// aborted and no lock held, and one to a checkpoint no longer retained should be refused
+func TestPointInTimeRecovery(t *testing.T) {
+	t.Parallel()
+
+	keys := []string{"x", "y"}
+	dir := t.TempDir()
+	ps, err := OpenPersister(dir, DiskOptions{})
+	if err != nil {
+		t.Fatalf("OpenPersister: %v", err)
+	}
+	sv := MakeServerWithSnapshots(keys, ps, 1<<20)
+	sv.RetainCheckpoints(2)
+	commit := func(tid int) {
+		sv.Set(tid, "x", tid)
+		sv.Prepare(Metadata{}, &RPCArgs{Tid: tid}, &PrepareReply{})
+		sv.PreCommit(Metadata{}, &RPCArgs{Tid: tid}, &PreCommitReply{})
+		sv.Commit(Metadata{}, &RPCArgs{Tid: tid}, &CommitReply{})
+	}
+	checkpoint := func() {
+		if err := sv.Checkpoint(); err != nil {
+			t.Fatalf("Checkpoint: %v", err)
+		}
+	}
+
+	commit(0)
+	commit(1)
+	checkpoint()
+	commit(2)
+	sv.Set(10, "y", 10)
+	sv.Prepare(Metadata{}, &RPCArgs{Tid: 10}, &PrepareReply{})
+	commit(3)
+	checkpoint()
+	commit(4)
+	time.Sleep(5 * time.Millisecond)
+	afterFour := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	sv.PreCommit(Metadata{}, &RPCArgs{Tid: 10}, &PreCommitReply{})
+	sv.Commit(Metadata{}, &RPCArgs{Tid: 10}, &CommitReply{})
+	commit(5)
+
+	expect := func(from *Persister, target RecoveryTarget, x int, y interface{}) {
+		to := MakePersister()
+		if err := RollBack(from, to, keys, target); err != nil {
+			t.Fatalf("RollBack to %+v: %v", target, err)
+		}
+		rolled := MakeServerWithSnapshots(keys, to, 1<<20)
+		defer rolled.Kill()
+		values := rolled.storeValues()
+		if values["x"] != x || values["y"] != y {
+			t.Fatalf("expected x=%v y=%v after rolling back to %+v, got %v", x, y, target, values)
+		}
+		if held := rolled.heldLocks(); len(held) > 0 {
+			t.Fatalf("expected no locks held after rolling back to %+v, got %v", target, held)
+		}
+		if tids := rolled.undecided(); len(tids) > 0 {
+			t.Fatalf("expected no transaction in doubt after rolling back to %+v, got %v", target, tids)
+		}
+	}
+	expect(ps, RecoveryTarget{Tid: 0}, 0, nil)
+	expect(ps, RecoveryTarget{Tid: 3}, 3, nil)
+	to := MakePersister()
+	if err := RollBack(ps, to, keys, RecoveryTarget{Tid: 3}); err != nil {
+		t.Fatalf("RollBack: %v", err)
+	}
+	if rolled, _ := decodeState(to.ReadSnapshot()); rolled.states[10] != stateAborted {
+		t.Fatalf("expected the transaction in doubt at the target aborted, got %v", rolled.states[10])
+	}
+	expect(ps, RecoveryTarget{Time: afterFour}, 4, nil)
+	expect(ps, RecoveryTarget{Tid: 5}, 5, 10)
+	sv.Kill()
+	ps.Close()
+
+	ps, err = OpenPersister(dir, DiskOptions{})
+	if err != nil {
+		t.Fatalf("OpenPersister: %v", err)
+	}
+	defer ps.Close()
+	expect(ps, RecoveryTarget{Tid: 1}, 1, nil)
+	expect(ps, RecoveryTarget{Tid: 3}, 3, nil)
+
+	// a third checkpoint drops the first
+	sv = MakeServerWithSnapshots(keys, ps, 1<<20)
+	defer sv.Kill()
+	sv.RetainCheckpoints(2)
+	commit(6)
+	checkpoint()
+	if err := RollBack(ps, MakePersister(), keys, RecoveryTarget{Tid: 1}); !errors.Is(err, ErrNotRetained) {
+		t.Fatalf("expected ErrNotRetained rolling back past the retained checkpoints, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "retained", "1.snapshot")); !os.IsNotExist(err) {
+		t.Fatalf("expected the dropped checkpoint's snapshot removed, got %v", err)
+	}
+	expect(ps, RecoveryTarget{Tid: 3}, 3, nil)
+}
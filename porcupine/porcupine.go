@@ -0,0 +1,361 @@
+package porcupine
+
+//
+// a small linearizability checker with the same API as
+// github.com/anishathalye/porcupine, kept in-tree like labrpc
+// and labgob so the tester has no outside dependencies.
+//
+// it implements the same search: the just-in-time linearization
+// algorithm of Wing & Gong, with Lowe's memoization of
+// (linearized operations, model state) pairs, run separately on
+// every partition the model produces.
+//
+// history := []porcupine.Operation{...}
+// ok := porcupine.CheckOperations(model, history)
+//
+
+import (
+	"sort"
+	"time"
+)
+
+// one operation in a history: the input it was invoked with at
+// time Call, and the output it returned with at time Return.
+type Operation struct {
+	ClientId int // optional, unless you want a visualization
+	Input    interface{}
+	Call     int64 // invocation time
+	Output   interface{}
+	Return   int64 // response time
+}
+
+// a sequential specification of the system being checked.
+// only Init, Step and Equal are required.
+type Model struct {
+	// split a history into independent histories, e.g. by key.
+	Partition func(history []Operation) [][]Operation
+	// initial state of the system.
+	Init func() interface{}
+	// step function: given a state and an operation, is the output
+	// legal, and if so what is the new state?
+	// must not modify state.
+	Step func(state interface{}, input interface{}, output interface{}) (bool, interface{})
+	// equality on states. defaults to ==.
+	Equal func(state1, state2 interface{}) bool
+	// for debugging output.
+	DescribeOperation func(input interface{}, output interface{}) string
+	DescribeState     func(state interface{}) string
+}
+
+// a Model whose Step may lead to several states, e.g. because an
+// operation's outcome is unknown.
+type NondeterministicModel struct {
+	Init              func() []interface{}
+	Step              func(state interface{}, input interface{}, output interface{}) []interface{}
+	Equal             func(state1, state2 interface{}) bool
+	DescribeOperation func(input interface{}, output interface{}) string
+	DescribeState     func(state interface{}) string
+}
+
+type CheckResult string
+
+const (
+	Unknown CheckResult = "Unknown" // the check timed out
+	Ok      CheckResult = "Ok"
+	Illegal CheckResult = "Illegal"
+)
+
+func (m *Model) equal(state1, state2 interface{}) bool {
+	if m.Equal != nil {
+		return m.Equal(state1, state2)
+	}
+	return state1 == state2
+}
+
+// is the history linearizable with respect to the model?
+func CheckOperations(model Model, history []Operation) bool {
+	return CheckOperationsTimeout(model, history, 0) == Ok
+}
+
+// like CheckOperations, but give up and return Unknown after
+// timeout. a timeout of 0 means no limit.
+func CheckOperationsTimeout(model Model, history []Operation, timeout time.Duration) CheckResult {
+	partitions := [][]Operation{history}
+	if model.Partition != nil {
+		partitions = model.Partition(history)
+	}
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	result := Ok
+	for _, partition := range partitions {
+		switch checkSingle(&model, partition, deadline) {
+		case Illegal:
+			return Illegal
+		case Unknown:
+			result = Unknown
+		}
+	}
+	return result
+}
+
+// ToModel turns a NondeterministicModel into a Model whose states
+// are sets of the nondeterministic model's states.
+func (nm *NondeterministicModel) ToModel() Model {
+	equal := nm.Equal
+	if equal == nil {
+		equal = func(state1, state2 interface{}) bool {
+			return state1 == state2
+		}
+	}
+	contains := func(states []interface{}, state interface{}) bool {
+		for _, s := range states {
+			if equal(s, state) {
+				return true
+			}
+		}
+		return false
+	}
+	dedup := func(states []interface{}) []interface{} {
+		var out []interface{}
+		for _, s := range states {
+			if !contains(out, s) {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+
+	return Model{
+		Init: func() interface{} {
+			return dedup(nm.Init())
+		},
+		Step: func(state interface{}, input interface{}, output interface{}) (bool, interface{}) {
+			var next []interface{}
+			for _, s := range state.([]interface{}) {
+				next = append(next, nm.Step(s, input, output)...)
+			}
+			next = dedup(next)
+			return len(next) > 0, next
+		},
+		Equal: func(state1, state2 interface{}) bool {
+			s1 := state1.([]interface{})
+			s2 := state2.([]interface{})
+			if len(s1) != len(s2) {
+				return false
+			}
+			for _, s := range s1 {
+				if !contains(s2, s) {
+					return false
+				}
+			}
+			return true
+		},
+		DescribeOperation: nm.DescribeOperation,
+		DescribeState: func(state interface{}) string {
+			if nm.DescribeState == nil {
+				return ""
+			}
+			desc := "{"
+			for i, s := range state.([]interface{}) {
+				if i > 0 {
+					desc += ", "
+				}
+				desc += nm.DescribeState(s)
+			}
+			return desc + "}"
+		},
+	}
+}
+
+// ------------------------------------------
+//                  SEARCH
+// ------------------------------------------
+
+type entryKind bool
+
+const (
+	callEntry   entryKind = false
+	returnEntry entryKind = true
+)
+
+type entry struct {
+	kind   entryKind
+	id     int
+	time   int64
+	input  interface{}
+	output interface{}
+}
+
+// a node in the doubly-linked list of calls and returns.
+type node struct {
+	entry
+	match *node // the return for a call; nil for a return
+	prev  *node
+	next  *node
+}
+
+// turn a history into time-ordered entries. at equal times calls
+// sort before returns, so touching operations count as concurrent.
+func makeEntries(history []Operation) []entry {
+	entries := make([]entry, 0, 2*len(history))
+	for id, op := range history {
+		entries = append(entries, entry{callEntry, id, op.Call, op.Input, nil})
+		entries = append(entries, entry{returnEntry, id, op.Return, nil, op.Output})
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].time != entries[j].time {
+			return entries[i].time < entries[j].time
+		}
+		return entries[i].kind == callEntry && entries[j].kind == returnEntry
+	})
+	return entries
+}
+
+func makeList(entries []entry) *node {
+	head := &node{}
+	calls := make(map[int]*node)
+	prev := head
+	for _, e := range entries {
+		n := &node{entry: e, prev: prev}
+		prev.next = n
+		prev = n
+		if e.kind == callEntry {
+			calls[e.id] = n
+		} else {
+			calls[e.id].match = n
+			// the output is only known at the return
+			calls[e.id].output = e.output
+		}
+	}
+	return head
+}
+
+// take a call and its return out of the list.
+func lift(n *node) {
+	n.prev.next = n.next
+	n.next.prev = n.prev
+	m := n.match
+	m.prev.next = m.next
+	if m.next != nil {
+		m.next.prev = m.prev
+	}
+}
+
+// put a lifted call and its return back, in reverse order.
+func unlift(n *node) {
+	m := n.match
+	m.prev.next = m
+	if m.next != nil {
+		m.next.prev = m
+	}
+	n.prev.next = n
+	n.next.prev = n
+}
+
+type bitset []uint64
+
+func newBitset(n int) bitset {
+	return make(bitset, (n+63)/64)
+}
+
+func (b bitset) clone() bitset {
+	c := make(bitset, len(b))
+	copy(c, b)
+	return c
+}
+
+func (b bitset) set(i int) bitset {
+	b[i/64] |= 1 << uint(i%64)
+	return b
+}
+
+func (b bitset) clear(i int) bitset {
+	b[i/64] &^= 1 << uint(i%64)
+	return b
+}
+
+func (b bitset) hash() uint64 {
+	h := uint64(len(b))
+	for _, w := range b {
+		h = h*31 + w
+	}
+	return h
+}
+
+func (b bitset) equals(c bitset) bool {
+	for i := range b {
+		if b[i] != c[i] {
+			return false
+		}
+	}
+	return true
+}
+
+type cacheEntry struct {
+	linearized bitset
+	state      interface{}
+}
+
+type frame struct {
+	n     *node
+	state interface{}
+}
+
+func checkSingle(model *Model, history []Operation, deadline time.Time) CheckResult {
+	head := makeList(makeEntries(history))
+	linearized := newBitset(len(history))
+	cache := make(map[uint64][]cacheEntry)
+	var stack []frame
+
+	state := model.Init()
+	n := head.next
+	steps := 0
+	for head.next != nil {
+		steps++
+		if !deadline.IsZero() && steps%1000 == 0 && time.Now().After(deadline) {
+			return Unknown
+		}
+
+		if n.kind == callEntry {
+			ok, newState := model.Step(state, n.input, n.output)
+			if ok {
+				newLinearized := linearized.clone().set(n.id)
+				h := newLinearized.hash()
+				seen := false
+				for _, c := range cache[h] {
+					if c.linearized.equals(newLinearized) && model.equal(c.state, newState) {
+						seen = true
+						break
+					}
+				}
+				if !seen {
+					cache[h] = append(cache[h], cacheEntry{newLinearized, newState})
+					stack = append(stack, frame{n, state})
+					state = newState
+					linearized.set(n.id)
+					lift(n)
+					n = head.next
+					continue
+				}
+			}
+			n = n.next
+		} else {
+			// some operation returned before any order of the calls
+			// in front of it could explain it; backtrack.
+			if len(stack) == 0 {
+				return Illegal
+			}
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			state = top.state
+			linearized.clear(top.n.id)
+			unlift(top.n)
+			n = top.n.next
+		}
+	}
+	return Ok
+}
@@ -0,0 +1,95 @@
+package porcupine
+
+import "testing"
+
+type registerInput struct {
+	write bool
+	value int
+}
+
+// a single integer register, initially 0.
+var registerModel = Model{
+	Init: func() interface{} {
+		return 0
+	},
+	Step: func(state interface{}, input interface{}, output interface{}) (bool, interface{}) {
+		in := input.(registerInput)
+		if in.write {
+			return true, in.value
+		}
+		return output.(int) == state.(int), state
+	},
+}
+
+func TestRegisterOk(t *testing.T) {
+	history := []Operation{
+		{0, registerInput{true, 100}, 0, 0, 100},
+		{1, registerInput{false, 0}, 25, 100, 75},
+		{2, registerInput{false, 0}, 30, 0, 60},
+	}
+	if !CheckOperations(registerModel, history) {
+		t.Fatalf("history should be linearizable")
+	}
+}
+
+func TestRegisterIllegal(t *testing.T) {
+	history := []Operation{
+		{0, registerInput{true, 200}, 0, 0, 100},
+		{1, registerInput{false, 0}, 10, 200, 30},
+		{2, registerInput{false, 0}, 40, 0, 90},
+	}
+	if CheckOperations(registerModel, history) {
+		t.Fatalf("history should not be linearizable")
+	}
+}
+
+func TestRealTimeOrder(t *testing.T) {
+	// the read starts after the write finished, so it must see it
+	history := []Operation{
+		{0, registerInput{true, 1}, 0, 0, 10},
+		{1, registerInput{false, 0}, 20, 0, 30},
+	}
+	if CheckOperations(registerModel, history) {
+		t.Fatalf("read after a completed write returned the old value")
+	}
+}
+
+func TestNondeterministic(t *testing.T) {
+	// a write whose outcome is unknown may or may not have happened
+	model := NondeterministicModel{
+		Init: func() []interface{} {
+			return []interface{}{0}
+		},
+		Step: func(state interface{}, input interface{}, output interface{}) []interface{} {
+			in := input.(registerInput)
+			if in.write {
+				if output == nil {
+					return []interface{}{state, in.value}
+				}
+				return []interface{}{in.value}
+			}
+			if output.(int) == state.(int) {
+				return []interface{}{state}
+			}
+			return nil
+		},
+	}
+
+	for _, read := range []int{0, 5} {
+		history := []Operation{
+			{0, registerInput{true, 5}, 0, nil, 100},
+			{1, registerInput{false, 0}, 50, read, 60},
+		}
+		if !CheckOperations(model.ToModel(), history) {
+			t.Fatalf("reading %v should be allowed", read)
+		}
+	}
+
+	history := []Operation{
+		{0, registerInput{true, 5}, 0, nil, 100},
+		{1, registerInput{false, 0}, 50, 7, 60},
+	}
+	if CheckOperations(model.ToModel(), history) {
+		t.Fatalf("reading 7 should not be allowed")
+	}
+}
@@ -0,0 +1,127 @@
+package commit
+
+//
+// profiling the commit path, to put a number on what the global
+// sv.mu and co.mu cost and to see whether a change made it better
+// or worse.
+//
+// with profile labels on, the goroutines working on a transaction,
+// and those they start, carry pprof labels 3pc.component
+// (coordinator or server), 3pc.tid and 3pc.phase, so a CPU profile
+// can be cut by transaction or phase:
+//
+//   co.SetProfileLabels(true)
+//   sv.SetProfileLabels(true)
+//   ...
+//   go tool pprof -tagfocus 3pc.phase=Prepare cpu.out
+//
+// a ContentionProfile measures roughly how long goroutines waited
+// for a sync.Mutex or sync.RWMutex between Start and Stop, from the
+// runtime's own estimate, and can write the mutex profile, which
+// says where:
+//
+//   p := StartContentionProfile(1)
+//   ... run transactions ...
+//   wait, err := p.Stop(f)
+//
+// the benchmarks report the wait per transaction as
+// mutex-wait-ns/txn, and write their mutex profiles to the
+// directory named by BENCH_MUTEXPROFILE.
+//
+
+import (
+	"context"
+	"io"
+	"runtime"
+	"runtime/metrics"
+	"runtime/pprof"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// label the goroutines that work on the Coordinator's transactions
+// with their tid and phase, or stop.
+func (co *Coordinator) SetProfileLabels(on bool) {
+	atomic.StoreInt32(&co.profiling, boolToInt32(on))
+}
+
+// label the goroutines running the Server's handlers with their
+// tid and phase, or stop.
+func (sv *Server) SetProfileLabels(on bool) {
+	atomic.StoreInt32(&sv.profiling, boolToInt32(on))
+}
+
+func boolToInt32(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// label the calling goroutine with ctx's transaction and phase, if
+// profile labels are on, until the returned function is called.
+func (co *Coordinator) profile(ctx context.Context) func() {
+	if atomic.LoadInt32(&co.profiling) == 0 {
+		return func() {}
+	}
+	return setProfileLabels(ctx, "coordinator")
+}
+
+func (sv *Server) profile(ctx context.Context) func() {
+	if atomic.LoadInt32(&sv.profiling) == 0 {
+		return func() {}
+	}
+	return setProfileLabels(ctx, "server")
+}
+
+// like pprof.Do, but for the rest of the caller's function.
+func setProfileLabels(ctx context.Context, component string) func() {
+	tid, phase := txnOf(ctx)
+	pprof.SetGoroutineLabels(pprof.WithLabels(ctx, pprof.Labels(
+		"3pc.component", component, "3pc.tid", strconv.Itoa(tid), "3pc.phase", phase)))
+	return func() { pprof.SetGoroutineLabels(ctx) }
+}
+
+// the runtime's running total of time spent waiting for a mutex.
+const mutexWaitMetric = "/sync/mutex/wait/total:seconds"
+
+type ContentionProfile struct {
+	fraction int // the mutex profile fraction to restore
+	waited   time.Duration
+}
+
+// start measuring lock contention, sampling one in fraction
+// contention events for the mutex profile; 0 measures only the
+// total wait.
+func StartContentionProfile(fraction int) *ContentionProfile {
+	p := &ContentionProfile{fraction: runtime.SetMutexProfileFraction(-1)}
+	if fraction > 0 {
+		runtime.SetMutexProfileFraction(fraction)
+	}
+	p.waited = mutexWait()
+	return p
+}
+
+// stop sampling, write the mutex profile to w unless it's nil, and
+// return how long goroutines waited for mutexes since the start.
+// the profile counts every sample since the process started, so a
+// program that profiles twice should compare the two.
+func (p *ContentionProfile) Stop(w io.Writer) (time.Duration, error) {
+	waited := mutexWait() - p.waited
+	var err error
+	if w != nil {
+		err = pprof.Lookup("mutex").WriteTo(w, 0)
+	}
+	runtime.SetMutexProfileFraction(p.fraction)
+	return waited, err
+}
+
+func mutexWait() time.Duration {
+	sample := []metrics.Sample{{Name: mutexWaitMetric}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindFloat64 {
+		return 0
+	}
+	return time.Duration(sample[0].Value.Float64() * float64(time.Second))
+}
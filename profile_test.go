@@ -0,0 +1,93 @@
+package commit
+
+import (
+	"3PhaseCommit/labrpc"
+	"bytes"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Commits a transaction through a server with profile labels on, taking a goroutine profile
+// inside its Prepare handler
+// The handler's goroutine should carry the transaction's tid and phase as pprof labels
+func TestProfileLabels(t *testing.T) {
+	t.Parallel()
+
+	net := labrpc.MakeNetwork()
+	defer net.Cleanup()
+	tr := makeLabrpcTransport(net)
+	sv := MakeServer([]string{"x"}, MakePersister())
+	defer sv.Kill()
+	sv.SetProfileLabels(true)
+	var profile bytes.Buffer
+	sv.setHook(func(point hookPoint, method string, tid int, meta Metadata) {
+		if point == hookBefore && method == "Server.Prepare" {
+			pprof.Lookup("goroutine").WriteTo(&profile, 1)
+		}
+	})
+	tr.Serve("server0", sv)
+	end, _ := tr.Dial("server0")
+	respChan := make(chan ResponseMsg)
+	co := MakeCoordinator([]PeerClient{end}, respChan)
+	defer co.Kill()
+	co.SetProfileLabels(true)
+
+	sv.Set(0, "x", 1)
+	co.FinishTransaction(0)
+	select {
+	case m := <-respChan:
+		if !m.committed {
+			t.Fatalf("expected transaction 0 to commit, got %+v", m)
+		}
+	case <-time.After(waitTimeout):
+		t.Fatalf("Transaction 0 got no response within %v", waitTimeout)
+	}
+
+	want := `labels: {"3pc.component":"server", "3pc.phase":"Prepare", "3pc.tid":"0"}`
+	if !strings.Contains(profile.String(), want) {
+		t.Fatalf("expected a goroutine with %s, got:\n%s", want, profile.String())
+	}
+}
+
+// Holds a mutex for 50ms while 64 goroutines wait for it, under a ContentionProfile
+// The runtime times only some goroutines' waits, but the profile should count well over one
+// goroutine's wait in all, and write a mutex profile
+func TestContentionProfile(t *testing.T) {
+	t.Parallel()
+
+	const hold = 50 * time.Millisecond
+	const waiters = 64
+	p := StartContentionProfile(1)
+	var mu sync.Mutex
+	mu.Lock()
+	var started, done sync.WaitGroup
+	for range waiters {
+		started.Add(1)
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			started.Done()
+			mu.Lock()
+			mu.Unlock()
+		}()
+	}
+	started.Wait()
+	time.Sleep(hold)
+	mu.Unlock()
+	done.Wait()
+
+	var out bytes.Buffer
+	waited, err := p.Stop(&out)
+	if err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	if waited < hold {
+		t.Fatalf("expected at least %v of mutex wait, got %v", hold, waited)
+	}
+	if out.Len() == 0 {
+		t.Fatalf("expected a mutex profile")
+	}
+}
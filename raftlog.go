@@ -0,0 +1,526 @@
+package commit
+
+//
+// a Coordinator whose decision log is replicated by a small Raft
+// group, so that a decision outlives the Coordinator's machine and a
+// standby Coordinator can take over at once:
+//
+//   rl := MakeRaftLog(peers, me, persister)
+//   lt.ServeRaftLog(fmt.Sprintf("raft%d", me), rl)
+//   co := MakeCoordinatorWithDecisionLog(servers, respChan, rl)
+//
+// each coordinator machine runs a RaftLog replica, with a Persister
+// of its own and a PeerClient for each replica (peers[me] is never
+// called), and a Coordinator on top of it. the replicas elect a
+// leader, and only the leader's Coordinator can log decisions: a
+// decision is appended to the leader's log, and Append() returns
+// once a majority of the replicas have persisted it. a Coordinator
+// whose replica isn't the leader, or stops being it, can't log a
+// decision and stops before any server hears it, as one whose disk
+// fails does (durability.go), so clients should send transactions
+// to the Coordinator whose replica IsLeader().
+//
+// a Coordinator's recovery waits until its replica leads and has
+// committed an entry of its own term, when it holds every decision
+// logged under an earlier leader, then finishes transactions the
+// way the log says, as MakeCoordinatorWithPersister()'s does. the
+// servers and the 3PC messages are unchanged; only the Coordinators
+// talk to the replicas. a group of 2f+1 replicas loses no decision,
+// and keeps logging new ones, with f of them down.
+//
+// the first outcome logged for a transaction wins: appending the
+// other one fails. this is Raft without membership changes or
+// snapshots, so the log is never compacted, as a Persister's
+// decision log isn't. any DecisionLog can take its place.
+//
+
+import (
+	"3PhaseCommit/labgob"
+	"3PhaseCommit/labrpc"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// returned by Append() and Decisions() on a replica that isn't the
+// leader, or stopped being it while waiting.
+var ErrNotLeader = errors.New("not the decision log's leader")
+
+// returned by Append() and Decisions() when a majority of the
+// replicas didn't answer in time.
+var ErrNoMajority = errors.New("no majority of the decision log's replicas answered")
+
+const (
+	raftHeartbeat     = 50 * time.Millisecond  // how often a leader sends AppendEntries
+	raftElection      = 300 * time.Millisecond // a follower that hears from no leader for between this and twice this starts an election
+	raftAppendTimeout = 2 * time.Second        // how long Append() and Decisions() wait for a majority
+)
+
+type raftRole int
+
+const (
+	raftFollower raftRole = iota
+	raftCandidate
+	raftLeader
+)
+
+type raftEntry struct {
+	Term    int
+	Tid     int
+	Outcome string // "" for the entry a new leader commits to catch up
+}
+
+// what a replica persists before it answers an RPC.
+type raftState struct {
+	Term     int
+	VotedFor int
+	Entries  []raftEntry
+}
+
+type RequestVoteArgs struct {
+	Term      int
+	Candidate int
+	LastIndex int
+	LastTerm  int
+}
+
+type RequestVoteReply struct {
+	Term    int
+	Granted bool
+}
+
+type AppendEntriesArgs struct {
+	Term      int
+	Leader    int
+	PrevIndex int
+	PrevTerm  int
+	Entries   []raftEntry
+	Commit    int // the leader's commit index
+}
+
+type AppendEntriesReply struct {
+	Term    int
+	Success bool
+	Next    int // where to send from next, if not Success
+}
+
+type RaftLog struct {
+	mu        sync.Mutex
+	changed   *sync.Cond // broadcast when the term, role or commit index changes, and every tick
+	peers     []PeerClient
+	me        int
+	persister *Persister
+	logger    Logger
+	dead      int32
+
+	term     int
+	votedFor int         // -1 if none this term
+	entries  []raftEntry // entries[0] is a placeholder, so the first is at index 1
+	role     raftRole
+	heard    time.Time     // when we last heard from a leader, or voted
+	timeout  time.Duration // until we start an election
+	sent     time.Time     // when we last sent AppendEntries, as leader
+	commit   int           // the highest index known committed
+	start    int           // the index of our term's first entry, as leader
+	next     []int         // as leader, the next index to send each replica
+	match    []int         // as leader, the highest index each replica holds
+	decided  map[int]string
+}
+
+// a replica of a decision log, persisted to persister, one of a group
+// whose members are reached through peers.
+func MakeRaftLog(peers []PeerClient, me int, persister *Persister) *RaftLog {
+	rl := &RaftLog{
+		peers:     peers,
+		me:        me,
+		persister: persister,
+		logger:    stdLogger(fmt.Sprintf("raft %d", me)),
+		votedFor:  -1,
+		entries:   []raftEntry{{Tid: noTid}},
+		heard:     time.Now(),
+		decided:   make(map[int]string),
+	}
+	rl.changed = sync.NewCond(&rl.mu)
+	rl.timeout = raftElectionTimeout()
+	rl.readPersist(persister.ReadServerState())
+	go rl.ticker()
+	return rl
+}
+
+func raftElectionTimeout() time.Duration {
+	return raftElection + time.Duration(rand.Int63n(int64(raftElection)))
+}
+
+// make a RaftLog's handlers reachable at addr.
+func (lt *labrpcTransport) ServeRaftLog(addr string, rl *RaftLog) (io.Closer, error) {
+	srv := labrpc.MakeServer()
+	srv.AddService(labrpc.MakeService(rl))
+	lt.net.AddServer(addr, srv)
+	return labrpcCloser{lt.net, addr}, nil
+}
+
+// like MakeCoordinatorWithPersister, but decisions are logged to
+// dlog, e.g. a RaftLog.
+func MakeCoordinatorWithDecisionLog(servers []PeerClient, respChan chan ResponseMsg, dlog DecisionLog) *Coordinator {
+	return makeLoggingCoordinator(servers, respChan, realClock{}, phaseTimeout, stdLogger("coordinator"), nil, dlog)
+}
+
+func (rl *RaftLog) Kill() {
+	atomic.StoreInt32(&rl.dead, 1)
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.changed.Broadcast()
+}
+
+func (rl *RaftLog) killed() bool {
+	return atomic.LoadInt32(&rl.dead) == 1
+}
+
+// whether this replica leads, so that its Coordinator can log
+// decisions.
+func (rl *RaftLog) IsLeader() bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.role == raftLeader && !rl.killed()
+}
+
+// log tid's outcome, and wait until a majority of the replicas have it.
+func (rl *RaftLog) Append(tid int, outcome string) error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.role != raftLeader || rl.killed() {
+		return ErrNotLeader
+	}
+	if err := rl.checkDecidedLocked(tid, outcome); err != nil {
+		return err
+	}
+	rl.entries = append(rl.entries, raftEntry{Term: rl.term, Tid: tid, Outcome: outcome})
+	index, term := len(rl.entries)-1, rl.term
+	rl.match[rl.me] = index
+	rl.persistLocked()
+	rl.broadcastLocked()
+	rl.advanceLocked()
+
+	if err := rl.awaitLocked(term, index); err != nil {
+		return err
+	}
+	return rl.checkDecidedLocked(tid, outcome)
+}
+
+// every outcome logged so far, once this replica leads and has
+// caught up.
+func (rl *RaftLog) Decisions() (map[int]string, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.role != raftLeader || rl.killed() {
+		return nil, ErrNotLeader
+	}
+	if err := rl.awaitLocked(rl.term, rl.start); err != nil {
+		return nil, err
+	}
+	decided := make(map[int]string, len(rl.decided))
+	for tid, outcome := range rl.decided {
+		decided[tid] = outcome
+	}
+	return decided, nil
+}
+
+// wait until index is committed while we lead in term.
+func (rl *RaftLog) awaitLocked(term int, index int) error {
+	deadline := time.Now().Add(raftAppendTimeout)
+	for rl.commit < index {
+		if rl.role != raftLeader || rl.term != term || rl.killed() {
+			return ErrNotLeader
+		}
+		if time.Now().After(deadline) {
+			return ErrNoMajority
+		}
+		rl.changed.Wait()
+	}
+	return nil
+}
+
+func (rl *RaftLog) checkDecidedLocked(tid int, outcome string) error {
+	if decided, exists := rl.decided[tid]; exists && decided != outcome {
+		return fmt.Errorf("transaction %d was already logged as %s", tid, decided)
+	}
+	return nil
+}
+
+func (rl *RaftLog) ticker() {
+	for !rl.killed() {
+		time.Sleep(raftHeartbeat / 5)
+		rl.mu.Lock()
+		if rl.role == raftLeader {
+			if time.Since(rl.sent) >= raftHeartbeat {
+				rl.broadcastLocked()
+			}
+		} else if time.Since(rl.heard) >= rl.timeout {
+			rl.electLocked()
+		}
+		rl.changed.Broadcast() // for awaitLocked()'s deadline
+		rl.mu.Unlock()
+	}
+}
+
+// take the term from a replica that has a later one.
+func (rl *RaftLog) followLocked(term int) {
+	rl.term = term
+	rl.votedFor = -1
+	rl.role = raftFollower
+	rl.persistLocked()
+	rl.changed.Broadcast()
+}
+
+func (rl *RaftLog) electLocked() {
+	rl.term++
+	rl.votedFor = rl.me
+	rl.role = raftCandidate
+	rl.heard = time.Now()
+	rl.timeout = raftElectionTimeout()
+	rl.persistLocked()
+	rl.changed.Broadcast()
+	rl.logger.Debugf(noTid, "", "starting an election for term %d", rl.term)
+
+	last := len(rl.entries) - 1
+	args := RequestVoteArgs{Term: rl.term, Candidate: rl.me, LastIndex: last, LastTerm: rl.entries[last].Term}
+	votes := 1
+	if votes > len(rl.peers)/2 {
+		rl.leadLocked()
+		return
+	}
+	for i := range rl.peers {
+		if i == rl.me {
+			continue
+		}
+		go func(i int) {
+			reply := &RequestVoteReply{}
+			if !rl.peers[i].Call("RaftLog.RequestVote", &args, reply) {
+				return
+			}
+			rl.mu.Lock()
+			defer rl.mu.Unlock()
+			if reply.Term > rl.term {
+				rl.followLocked(reply.Term)
+				return
+			}
+			if !reply.Granted || rl.role != raftCandidate || rl.term != args.Term {
+				return
+			}
+			votes++
+			if votes > len(rl.peers)/2 {
+				rl.leadLocked()
+			}
+		}(i)
+	}
+}
+
+// become the leader, and commit an entry of our own term, which
+// commits every earlier one.
+func (rl *RaftLog) leadLocked() {
+	rl.role = raftLeader
+	rl.entries = append(rl.entries, raftEntry{Term: rl.term, Tid: noTid})
+	rl.start = len(rl.entries) - 1
+	rl.next = make([]int, len(rl.peers))
+	rl.match = make([]int, len(rl.peers))
+	for i := range rl.peers {
+		rl.next[i] = rl.start
+	}
+	rl.match[rl.me] = rl.start
+	rl.persistLocked()
+	rl.changed.Broadcast()
+	rl.logger.Infof(noTid, "", "leading in term %d", rl.term)
+	rl.broadcastLocked()
+	rl.advanceLocked()
+}
+
+// send each replica the entries it's missing, or a heartbeat.
+func (rl *RaftLog) broadcastLocked() {
+	rl.sent = time.Now()
+	for i := range rl.peers {
+		if i == rl.me {
+			continue
+		}
+		prev := rl.next[i] - 1
+		args := &AppendEntriesArgs{
+			Term:      rl.term,
+			Leader:    rl.me,
+			PrevIndex: prev,
+			PrevTerm:  rl.entries[prev].Term,
+			Entries:   append([]raftEntry(nil), rl.entries[prev+1:]...),
+			Commit:    rl.commit,
+		}
+		go rl.sendEntries(i, args)
+	}
+}
+
+func (rl *RaftLog) sendEntries(i int, args *AppendEntriesArgs) {
+	reply := &AppendEntriesReply{}
+	if !rl.peers[i].Call("RaftLog.AppendEntries", args, reply) {
+		return
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if reply.Term > rl.term {
+		rl.followLocked(reply.Term)
+		return
+	}
+	if rl.role != raftLeader || rl.term != args.Term {
+		return
+	}
+	if reply.Success {
+		if match := args.PrevIndex + len(args.Entries); match > rl.match[i] {
+			rl.match[i] = match
+			rl.next[i] = match + 1
+			rl.advanceLocked()
+		}
+		return
+	}
+	if reply.Next < rl.next[i] {
+		rl.next[i] = max(reply.Next, rl.match[i]+1)
+	}
+}
+
+// commit the latest entry of our term a majority hold.
+func (rl *RaftLog) advanceLocked() {
+	for n := len(rl.entries) - 1; n > rl.commit && rl.entries[n].Term == rl.term; n-- {
+		holding := 0
+		for i := range rl.peers {
+			if rl.match[i] >= n {
+				holding++
+			}
+		}
+		if holding > len(rl.peers)/2 {
+			rl.commitLocked(n)
+			return
+		}
+	}
+}
+
+func (rl *RaftLog) commitLocked(index int) {
+	for _, entry := range rl.entries[rl.commit+1 : index+1] {
+		if _, exists := rl.decided[entry.Tid]; !exists && entry.Outcome != "" {
+			rl.decided[entry.Tid] = entry.Outcome
+		}
+	}
+	rl.commit = index
+	rl.changed.Broadcast()
+}
+
+// RequestVote handler
+func (rl *RaftLog) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.killed() {
+		return
+	}
+	if args.Term > rl.term {
+		rl.followLocked(args.Term)
+	}
+	reply.Term = rl.term
+	last := len(rl.entries) - 1
+	upToDate := args.LastTerm > rl.entries[last].Term ||
+		(args.LastTerm == rl.entries[last].Term && args.LastIndex >= last)
+	if args.Term == rl.term && (rl.votedFor == -1 || rl.votedFor == args.Candidate) && upToDate {
+		rl.votedFor = args.Candidate
+		rl.heard = time.Now()
+		rl.persistLocked()
+		reply.Granted = true
+	}
+}
+
+// AppendEntries handler
+func (rl *RaftLog) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.killed() {
+		return
+	}
+	if args.Term > rl.term {
+		rl.followLocked(args.Term)
+	}
+	reply.Term = rl.term
+	if args.Term < rl.term {
+		return
+	}
+	if rl.role != raftFollower {
+		rl.role = raftFollower
+		rl.changed.Broadcast()
+	}
+	rl.heard = time.Now()
+
+	if args.PrevIndex >= len(rl.entries) {
+		reply.Next = len(rl.entries)
+		return
+	}
+	if conflict := rl.entries[args.PrevIndex].Term; conflict != args.PrevTerm {
+		// skip back past the whole conflicting term
+		next := args.PrevIndex
+		for next > 1 && rl.entries[next-1].Term == conflict {
+			next--
+		}
+		reply.Next = next
+		return
+	}
+
+	// truncate only at a conflict, so that a late, shorter request
+	// doesn't drop entries
+	for i, entry := range args.Entries {
+		index := args.PrevIndex + 1 + i
+		if index < len(rl.entries) && rl.entries[index].Term == entry.Term {
+			continue
+		}
+		rl.entries = append(rl.entries[:index:index], args.Entries[i:]...)
+		rl.persistLocked()
+		break
+	}
+	if commit := min(args.Commit, args.PrevIndex+len(args.Entries)); commit > rl.commit {
+		rl.commitLocked(commit)
+	}
+	reply.Success = true
+}
+
+// save the term, vote and entries, and sync them; a replica that
+// can't stops, since it can't keep its votes and entries.
+func (rl *RaftLog) persistLocked() {
+	fw := newFrameWriter()
+	fw.encode(raftState{Term: rl.term, VotedFor: rl.votedFor, Entries: rl.entries[1:]})
+	rl.persister.Save(fw.bytes())
+	if err := rl.persister.Sync(); err != nil {
+		rl.logger.Warnf(noTid, "", "can't make the decision log durable, stopping: %v", err)
+		atomic.StoreInt32(&rl.dead, 1)
+		rl.changed.Broadcast()
+	}
+}
+
+func (rl *RaftLog) readPersist(data []byte) {
+	if len(data) < 1 {
+		return
+	}
+
+	framed, torn, err := readFrames(data)
+	if err == nil && torn > 0 {
+		err = fmt.Errorf("torn write, %d bytes", torn)
+	}
+	if err != nil {
+		log.Fatalf("RaftLog: %v", err)
+	}
+	var state raftState
+	if err := labgob.NewDecoder(bytes.NewBuffer(framed)).Decode(&state); err != nil {
+		log.Fatalf("RaftLog: state passed its checksum but can't be decoded: %v", err)
+	}
+	rl.term = state.Term
+	rl.votedFor = state.VotedFor
+	rl.entries = append(rl.entries, state.Entries...)
+}
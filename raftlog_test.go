@@ -0,0 +1,112 @@
+package commit
+
+import (
+	"3PhaseCommit/labrpc"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Has a coordinator on the leader of three decision log replicas decide to abort a transaction
+// one server voted Yes for, then crashes, with its replica, before any server hears the abort
+// A coordinator on the next leader should abort it from the replicated log, then commit another
+// transaction with one replica down
+func TestRaftDecisionLog(t *testing.T) {
+	t.Parallel()
+
+	net := labrpc.MakeNetwork()
+	defer net.Cleanup()
+	lt := makeLabrpcTransport(net)
+	servers := []*Server{MakeServer([]string{"x"}, MakePersister()), MakeServer([]string{"y"}, MakePersister())}
+	for i, sv := range servers {
+		defer sv.Kill()
+		serveLabrpc(net, fmt.Sprintf("server%d", i), sv)
+	}
+	ends := func(prefix string, to string, enabled ...bool) []PeerClient {
+		peers := make([]PeerClient, len(enabled))
+		for i, on := range enabled {
+			name := fmt.Sprintf("%s-%d", prefix, i)
+			end := net.MakeEnd(name)
+			net.Connect(name, fmt.Sprintf("%s%d", to, i))
+			net.Enable(name, on)
+			peers[i] = end
+		}
+		return peers
+	}
+
+	replicas := make([]*RaftLog, 3)
+	for i := range replicas {
+		replicas[i] = MakeRaftLog(ends(fmt.Sprintf("raft%d", i), "raft", true, true, true), i, MakePersister())
+		defer replicas[i].Kill()
+		lt.ServeRaftLog(fmt.Sprintf("raft%d", i), replicas[i])
+	}
+	leader := func(except int) int {
+		for start := time.Now(); time.Since(start) < waitTimeout; time.Sleep(10 * time.Millisecond) {
+			for i, rl := range replicas {
+				if i != except && rl.IsLeader() {
+					return i
+				}
+			}
+		}
+		t.Fatalf("no replica became the leader within %v", waitTimeout)
+		return -1
+	}
+
+	var co *Coordinator
+	crashed := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	first := true
+	servers[0].setHook(func(point hookPoint, method string, tid int, meta Metadata) {
+		if point == hookBefore && method == "Server.Abort" && first {
+			first = false
+			co.Kill()
+			close(crashed)
+			<-release
+		}
+	})
+
+	old := leader(-1)
+	co = MakeCoordinatorWithDecisionLog(ends("first", "server", true, false), make(chan ResponseMsg), replicas[old])
+	servers[0].Set(0, "x", 1)
+	servers[1].Set(0, "y", 1)
+	co.FinishTransaction(0)
+	select {
+	case <-crashed:
+	case <-time.After(waitTimeout + phaseTimeout):
+		t.Fatalf("the coordinator never decided to abort")
+	}
+	replicas[old].Kill()
+	if state, _ := servers[0].transactionState(0); state != stateVotedYes {
+		t.Fatalf("expected server 0 to still be in doubt, got %v", state)
+	}
+
+	respChan := make(chan ResponseMsg)
+	co2 := MakeCoordinatorWithDecisionLog(ends("second", "server", true, true), respChan, replicas[leader(old)])
+	defer co2.Kill()
+	select {
+	case m := <-respChan:
+		if m.tid != 0 || m.committed {
+			t.Fatalf("expected the new leader's coordinator to abort transaction 0, got %+v", m)
+		}
+	case <-time.After(waitTimeout):
+		t.Fatalf("the new leader's coordinator reported nothing within %v", waitTimeout)
+	}
+	if v := servers[0].storeValues()["x"]; v != nil {
+		t.Fatalf("expected the aborted Set not to be applied, got x = %v", v)
+	}
+
+	servers[0].Set(1, "x", 2)
+	co2.FinishTransaction(1)
+	select {
+	case m := <-respChan:
+		if m.tid != 1 || !m.committed {
+			t.Fatalf("expected transaction 1 to commit with a replica down, got %+v", m)
+		}
+	case <-time.After(waitTimeout):
+		t.Fatalf("transaction 1 didn't finish within %v", waitTimeout)
+	}
+	if co2.killed() {
+		t.Fatalf("expected the coordinator to log its decision with two of three replicas")
+	}
+}
@@ -0,0 +1,105 @@
+package commit
+
+//
+// keeping the values a transaction reads and writes out of what the
+// package says about it, for running it on data that mustn't end up
+// in test output or a trace backend:
+//
+//   co.SetRedaction(RedactHash)
+//   sv.SetRedaction(RedactHash)
+//
+// with RedactHash, a value in a log line or the debug snapshot is
+// shown as a short hash of its type and value, e.g. "sha256:3c1f9a0e7b2d",
+// so equal values can still be matched up; with RedactOmit it's
+// shown as "<redacted>". keys are always shown. LOG_REDACT=hash or
+// LOG_REDACT=omit sets the default for every Coordinator and Server,
+// and for the tester's own log lines.
+//
+// events, audit records and trace spans carry keys but never
+// values, so they need no redacting. a hash of a value from a small
+// set (a boolean, a small number) is easily reversed by trying them
+// all; use RedactOmit for those. the values themselves are still
+// persisted, sent to servers and returned to the client.
+//
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+type Redaction int32
+
+const (
+	RedactNone Redaction = iota // show values as they are
+	RedactHash                  // show a hash of each value
+	RedactOmit                  // show no values
+)
+
+func (r Redaction) String() string {
+	switch r {
+	case RedactNone:
+		return "none"
+	case RedactHash:
+		return "hash"
+	case RedactOmit:
+		return "omit"
+	}
+	return fmt.Sprintf("Redaction(%d)", int(r))
+}
+
+// the Redaction LOG_REDACT asks for; none by default.
+func redactionFromEnv() Redaction {
+	switch strings.ToLower(os.Getenv("LOG_REDACT")) {
+	case "hash":
+		return RedactHash
+	case "omit":
+		return RedactOmit
+	}
+	return RedactNone
+}
+
+// v as it may be shown.
+func (r Redaction) value(v interface{}) interface{} {
+	switch r {
+	case RedactHash:
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%T:%v", v, v)))
+		return "sha256:" + hex.EncodeToString(sum[:6])
+	case RedactOmit:
+		return "<redacted>"
+	}
+	return v
+}
+
+// values, key by key, as they may be shown.
+func (r Redaction) values(values map[string]interface{}) map[string]interface{} {
+	if r == RedactNone {
+		return values
+	}
+	shown := make(map[string]interface{}, len(values))
+	for key, v := range values {
+		shown[key] = r.value(v)
+	}
+	return shown
+}
+
+// how the Coordinator shows values from now on.
+func (co *Coordinator) SetRedaction(r Redaction) {
+	atomic.StoreInt32(&co.redacting, int32(r))
+}
+
+// how the Server shows values from now on.
+func (sv *Server) SetRedaction(r Redaction) {
+	atomic.StoreInt32(&sv.redacting, int32(r))
+}
+
+func (co *Coordinator) redaction() Redaction {
+	return Redaction(atomic.LoadInt32(&co.redacting))
+}
+
+func (sv *Server) redaction() Redaction {
+	return Redaction(atomic.LoadInt32(&sv.redacting))
+}
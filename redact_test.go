@@ -0,0 +1,68 @@
+package commit
+
+import (
+	"3PhaseCommit/labrpc"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Sets and reads secret values with the coordinator's and server's values hashed, then omitted,
+// keeping a second transaction's Set in the debug snapshot
+// Neither the logs nor the snapshot should contain a secret, though they should still name the
+// keys and show the hash or the placeholder in its place
+func TestRedaction(t *testing.T) {
+	t.Parallel()
+
+	for _, r := range []Redaction{RedactHash, RedactOmit} {
+		net := labrpc.MakeNetwork()
+		defer net.Cleanup()
+		tr := makeLabrpcTransport(net)
+		svLog, coLog := &recordingLogger{}, &recordingLogger{}
+		sv := MakeServerWithLogger([]string{"x", "y"}, MakePersister(), -1, svLog)
+		defer sv.Kill()
+		sv.SetRedaction(r)
+		tr.Serve("server0", sv)
+		end, _ := tr.Dial("server0")
+		respChan := make(chan ResponseMsg)
+		co := MakeCoordinatorWithLogger([]PeerClient{end}, respChan, coLog)
+		defer co.Kill()
+		co.SetRedaction(r)
+
+		sv.Set(0, "x", "secret-x")
+		co.FinishTransaction(0)
+		for tid := 0; tid < 2; tid++ {
+			select {
+			case m := <-respChan:
+				if !m.committed {
+					t.Fatalf("expected transaction %d to commit, got %+v", tid, m)
+				}
+			case <-time.After(waitTimeout):
+				t.Fatalf("Transaction %d got no response within %v", tid, waitTimeout)
+			}
+			if tid == 0 {
+				sv.Get(1, "x")
+				co.FinishTransaction(1)
+			}
+		}
+		sv.Set(2, "y", "secret-y")
+
+		var text strings.Builder
+		for _, line := range append(svLog.lines(), coLog.lines()...) {
+			text.WriteString(line.text + "\n")
+		}
+		snapshot, _ := json.Marshal(sv.debugState())
+		text.Write(snapshot)
+		shown := r.value("secret-x")
+		if strings.Contains(text.String(), "secret") {
+			t.Fatalf("%v: expected no values, got:\n%s", r, text.String())
+		}
+		if !strings.Contains(text.String(), "read values: map[x:"+shown.(string)+"]") {
+			t.Fatalf("%v: expected the read of x to show as %v, got:\n%s", r, shown, text.String())
+		}
+		if ops := sv.debugState().Transactions["2"].Operations; len(ops) != 1 || ops[0].Key != "y" || ops[0].Value != r.value("secret-y") {
+			t.Fatalf("%v: expected the snapshot to show y's Set redacted, got %+v", r, ops)
+		}
+	}
+}
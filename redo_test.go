@@ -0,0 +1,54 @@
+package commit
+
+import (
+	"testing"
+)
+
+// Commits x=1 and x=2 through a server that logs, checkpoints, and restarts it from the
+// snapshot with the first commit's log record left over, as if its truncation was lost
+// The stale record should not roll x back, and a resent Commit should read what it first read
+func TestIdempotentRedo(t *testing.T) {
+	t.Parallel()
+
+	ps := MakePersister()
+	keys := []string{"x", "y"}
+	sv := MakeServerWithSnapshots(keys, ps, 1<<20)
+	defer sv.Kill()
+	commit := func(sv *Server, tid int) *CommitReply {
+		args := &RPCArgs{Tid: tid}
+		sv.Prepare(Metadata{}, args, &PrepareReply{})
+		sv.PreCommit(Metadata{}, args, &PreCommitReply{})
+		reply := &CommitReply{}
+		sv.Commit(Metadata{}, args, reply)
+		return reply
+	}
+
+	sv.Set(0, "y", "first")
+	commit(sv, 0)
+	sv.Set(1, "x", 1)
+	sv.Get(1, "y")
+	commit(sv, 1)
+	stale := ps.ReadServerState()
+	sv.Set(2, "x", 2)
+	sv.Set(2, "y", "second")
+	commit(sv, 2)
+	if err := sv.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint: %v", err)
+	}
+
+	restarted := MakePersister()
+	restarted.SaveStateAndSnapshot(stale, ps.ReadSnapshot())
+	sv = MakeServerWithSnapshots(keys, restarted, 1<<20)
+	defer sv.Kill()
+	if v := sv.storeValues()["x"]; v != 2 {
+		t.Fatalf("expected replaying a stale log record to leave x at 2, got %v", v)
+	}
+
+	reply := commit(sv, 1)
+	if v := reply.ReadValues["y"]; v != "first" || reply.Reads != 1 {
+		t.Fatalf("expected a resent Commit to read y as it first did, got %v", reply.ReadValues)
+	}
+	if values := sv.storeValues(); values["x"] != 2 || values["y"] != "second" {
+		t.Fatalf("expected a resent Commit to leave the store alone, got %v", values)
+	}
+}
@@ -0,0 +1,67 @@
+package commit
+
+import (
+	"testing"
+	"time"
+)
+
+// Restarts a server with a transaction in doubt that wrote x and read y, then prepares
+// three more: one reading y, one writing x and one writing y
+// The reader should vote at once, and each writer only once the transactions holding its
+// key are aborted, as they would have before the restart
+func TestRecoveredLockConflicts(t *testing.T) {
+	t.Parallel()
+
+	ps := MakePersister()
+	sv := MakeServerWithSnapshots([]string{"x", "y"}, ps, 1<<20)
+	sv.Set(1, "x", 1)
+	sv.Get(1, "y")
+	sv.Prepare(Metadata{}, &RPCArgs{Tid: 1}, &PrepareReply{})
+	sv.Kill()
+
+	sv = MakeServerWithSnapshots([]string{"x", "y"}, ps.Copy(), 1<<20)
+	defer sv.Kill()
+	prepare := func(tid int) chan bool {
+		vote := make(chan bool, 1)
+		go func() {
+			reply := &PrepareReply{}
+			sv.Prepare(Metadata{}, &RPCArgs{Tid: tid}, reply)
+			vote <- reply.Vote
+		}()
+		return vote
+	}
+	expectVote := func(tid int, vote chan bool) {
+		select {
+		case yes := <-vote:
+			if !yes {
+				t.Fatalf("expected transaction %d to vote Yes", tid)
+			}
+		case <-time.After(waitTimeout):
+			t.Fatalf("transaction %d didn't vote within %v", tid, waitTimeout)
+		}
+	}
+	expectBlocked := func(tid int, vote chan bool) {
+		select {
+		case <-vote:
+			t.Fatalf("expected transaction %d to wait for the in-doubt transaction's lock", tid)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	abort := func(tid int) {
+		sv.Abort(Metadata{}, &RPCArgs{Tid: tid}, &struct{}{})
+	}
+
+	sv.Get(2, "y")
+	sv.Set(3, "x", 3)
+	sv.Set(4, "y", 4)
+	expectVote(2, prepare(2))
+	x, y := prepare(3), prepare(4)
+	expectBlocked(3, x)
+	expectBlocked(4, y)
+
+	abort(1)
+	expectVote(3, x)
+	expectBlocked(4, y)
+	abort(2)
+	expectVote(4, y)
+}
@@ -0,0 +1,592 @@
+package commit
+
+//
+// a participant kept by a small group of machines, so that losing
+// one doesn't make its keys unavailable in the middle of a
+// transaction:
+//
+//   r := MakeReplica(peers, me, persister, meta, func(ps *Persister) (*Server, io.Closer) {
+//       sv := MakeServerWithSnapshots(keys, ps, 1<<20)
+//       closer, _ := tr.Serve(fmt.Sprintf("member%d", me), sv)
+//       return sv, closer
+//   })
+//   tr.ServeReplica(fmt.Sprintf("replica%d", me), r)   // labrpcTransport
+//
+//   servers[0] = ReplicaGroupPeer(members) // a Dial()ed PeerClient for each member's Server
+//
+// each member runs a Replica, with a PeerClient for each member's
+// Replica (peers[me] is never called), a Persister for the Server's
+// state and one, meta, for its own. the members elect a leader, which
+// runs the one Server, made by start() from its Persister; the
+// others run none. each write the Server makes to its Persister, for
+// an operation or a phase of 3PC, is first sent to the other
+// members, and only made once a majority of the group, the leader
+// included, have it, so the Server replies only to changes a
+// majority holds. a group of 2f+1 members keeps its Server with f of
+// them down.
+//
+// a leader that can't get a write to a majority in time, or hears
+// of a newer leader, stops serving before the write is made, drops
+// the write and kills its Server, so the reply never arrives and the
+// coordinator resends it. this relies on the transport dropping the
+// replies of a Server it stopped serving, as labrpc does. a member
+// that hears nothing from a leader for an election timeout claims
+// the next epoch; once a majority promise it that epoch, it takes
+// the newest state any of them has, sends it to them, and starts a
+// Server from it, which takes back its in-doubt transactions' locks
+// as after a restart. ReplicaGroupPeer() sends the coordinator's
+// calls to whichever member answers. the coordinator and the 3PC
+// messages don't change.
+//
+// each write sends the Server's whole persisted state, snapshot and
+// deltas included, as Persister.Save() takes the whole state.
+// clients' Gets and Sets go to the leader's Server(), which logs
+// them, so they're replicated like the rest. retained checkpoints
+// (pitr.go) stay on the member that made them.
+//
+
+import (
+	"3PhaseCommit/labgob"
+	"3PhaseCommit/labrpc"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// returned, through Persister.Sync(), for a write a member made
+// after it stopped leading, or couldn't get to a majority.
+var ErrNotReplicated = errors.New("the write didn't reach a majority of the replica group")
+
+// sends a write to a replica group; see Persister.setMirror().
+type mirrorFunc func(state []byte, snapshot []byte, deltas []byte) error
+
+// a write's place in the group's history: its leader's epoch, and
+// its number in that epoch.
+type replicaStamp struct {
+	Epoch int
+	Seq   int
+}
+
+func (s replicaStamp) less(t replicaStamp) bool {
+	return s.Epoch < t.Epoch || (s.Epoch == t.Epoch && s.Seq < t.Seq)
+}
+
+// what a member persists in its meta Persister.
+type replicaMeta struct {
+	Epoch   int          // the latest epoch it promised
+	Written replicaStamp // the write its Persister holds
+}
+
+type ReplicateArgs struct {
+	Epoch     int
+	Leader    int
+	Heartbeat bool // no write, just the leader saying it's there
+	Stamp     replicaStamp
+	State     []byte
+	Snapshot  []byte
+	Deltas    []byte
+}
+
+type ReplicateReply struct {
+	Epoch int // the member's epoch, if it refused
+	OK    bool
+}
+
+type ClaimArgs struct {
+	Epoch     int
+	Candidate int
+	Written   replicaStamp // the newest write the candidate has
+}
+
+type ClaimReply struct {
+	Epoch    int // the member's epoch, if it refused
+	OK       bool
+	Written  replicaStamp
+	State    []byte // the member's state, if newer than the candidate's
+	Snapshot []byte
+	Deltas   []byte
+}
+
+// lock order: a Persister's mu, then the Replica's mu, which is never
+// held while taking the Persister's.
+type Replica struct {
+	mu        sync.Mutex
+	install   sync.Mutex // held while writing someone else's state to the Persister
+	peers     []PeerClient
+	me        int
+	persister *Persister // the Server's state
+	meta      *Persister // our epoch and stamp
+	start     func(ps *Persister) (*Server, io.Closer)
+	logger    Logger
+	dead      int32
+
+	epoch   int          // the latest epoch we promised, or lead
+	written replicaStamp // the write our Persister holds
+	leading bool
+	seq     int       // the last write we sent, as leader
+	heard   time.Time // when we last heard from a leader, or promised an epoch
+	timeout time.Duration
+	sent    time.Time // when we last sent heartbeats, as leader
+	sv      *Server   // the Server, while we lead and it runs
+	serving io.Closer
+}
+
+// a member of a participant's replica group, reaching the others
+// through peers. start() makes and serves the Server from persister
+// when this member becomes the leader; closing what it returns must
+// stop the Server's replies.
+func MakeReplica(peers []PeerClient, me int, persister *Persister, meta *Persister, start func(ps *Persister) (*Server, io.Closer)) *Replica {
+	r := &Replica{
+		peers:     peers,
+		me:        me,
+		persister: persister,
+		meta:      meta,
+		start:     start,
+		logger:    stdLogger(fmt.Sprintf("replica %d", me)),
+		heard:     time.Now(),
+		timeout:   raftElectionTimeout(),
+	}
+	r.readMeta(meta.ReadServerState())
+	go r.ticker()
+	return r
+}
+
+// make a Replica's handlers reachable at addr.
+func (lt *labrpcTransport) ServeReplica(addr string, r *Replica) (io.Closer, error) {
+	srv := labrpc.MakeServer()
+	srv.AddService(labrpc.MakeService(r))
+	lt.net.AddServer(addr, srv)
+	return labrpcCloser{lt.net, addr}, nil
+}
+
+func (r *Replica) Kill() {
+	atomic.StoreInt32(&r.dead, 1)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stepDownLocked()
+}
+
+func (r *Replica) killed() bool {
+	return atomic.LoadInt32(&r.dead) == 1
+}
+
+// the Server, if this member leads and has started it; clients'
+// Gets and Sets go to it.
+func (r *Replica) Server() *Server {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sv
+}
+
+func (r *Replica) ticker() {
+	for !r.killed() {
+		time.Sleep(raftHeartbeat / 5)
+		r.mu.Lock()
+		if r.leading {
+			if time.Since(r.sent) >= raftHeartbeat {
+				r.heartbeatLocked()
+			}
+		} else if time.Since(r.heard) >= r.timeout {
+			r.claimLocked()
+		}
+		r.mu.Unlock()
+	}
+}
+
+func (r *Replica) heartbeatLocked() {
+	r.sent = time.Now()
+	args := &ReplicateArgs{Epoch: r.epoch, Leader: r.me, Heartbeat: true}
+	for i := range r.peers {
+		if i == r.me {
+			continue
+		}
+		go func(i int) {
+			reply := &ReplicateReply{}
+			if r.peers[i].Call("Replica.Replicate", args, reply) && !reply.OK {
+				r.deposed(args.Epoch, reply.Epoch)
+			}
+		}(i)
+	}
+}
+
+// step down if a member has promised a later epoch than the one we
+// lead.
+func (r *Replica) deposed(epoch int, newer int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if newer > r.epoch && r.epoch == epoch {
+		r.epoch = newer
+		r.saveMetaLocked()
+		r.stepDownLocked()
+	}
+}
+
+// stop serving, so that the Server's replies are dropped, and kill
+// it, in the background since its handlers may hold its lock.
+func (r *Replica) stepDownLocked() {
+	if !r.leading {
+		return
+	}
+	r.leading = false
+	if r.serving != nil {
+		r.serving.Close()
+	}
+	if sv := r.sv; sv != nil {
+		go sv.Kill()
+	}
+	r.sv, r.serving = nil, nil
+	r.logger.Infof(noTid, "", "no longer leading in epoch %d", r.epoch)
+}
+
+// claim the next epoch, in the background.
+func (r *Replica) claimLocked() {
+	r.epoch++
+	r.heard = time.Now()
+	r.timeout = raftElectionTimeout()
+	r.saveMetaLocked()
+	r.logger.Debugf(noTid, "", "claiming epoch %d", r.epoch)
+	go r.claim(&ClaimArgs{Epoch: r.epoch, Candidate: r.me, Written: r.written})
+}
+
+func (r *Replica) claim(args *ClaimArgs) {
+	replies := make(chan *ClaimReply)
+	for i := range r.peers {
+		if i == r.me {
+			continue
+		}
+		go func(i int) {
+			reply := &ClaimReply{}
+			if !r.peers[i].Call("Replica.Claim", args, reply) {
+				reply = nil
+			}
+			replies <- reply
+		}(i)
+	}
+
+	// the newest state among a majority holds every write a
+	// majority took
+	promised := 1
+	newest := &ClaimReply{Written: args.Written}
+	n := 1
+	for ; n < len(r.peers) && promised <= len(r.peers)/2; n++ {
+		reply := <-replies
+		if reply == nil {
+			continue
+		}
+		if !reply.OK {
+			r.deposed(args.Epoch, reply.Epoch)
+			continue
+		}
+		promised++
+		if newest.Written.less(reply.Written) {
+			newest = reply
+		}
+	}
+	go func() {
+		for ; n < len(r.peers); n++ {
+			<-replies
+		}
+	}()
+	if promised <= len(r.peers)/2 || !r.leadingEpoch(args.Epoch, true) {
+		return
+	}
+
+	if newest.Written != args.Written {
+		r.install.Lock()
+		r.persister.install(newest.State, newest.Snapshot, newest.Deltas)
+		r.install.Unlock()
+		r.mu.Lock()
+		r.written = newest.Written
+		r.saveMetaLocked()
+		r.mu.Unlock()
+	}
+
+	// make the state ours, on a majority, before serving from it
+	state, snapshot, deltas := r.persister.ReadServerState(), r.persister.ReadSnapshot(), r.persister.ReadDeltas()
+	if r.replicate(args.Epoch, state, snapshot, deltas) != nil {
+		return
+	}
+	r.persister.setMirror(func(state []byte, snapshot []byte, deltas []byte) error {
+		return r.replicate(args.Epoch, state, snapshot, deltas)
+	})
+	sv, serving := r.start(r.persister)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.leading || r.epoch != args.Epoch {
+		serving.Close()
+		go sv.Kill()
+		return
+	}
+	r.sv, r.serving = sv, serving
+	r.logger.Infof(noTid, "", "leading in epoch %d", args.Epoch)
+}
+
+// whether we lead in epoch; with claim, become its leader if no one
+// has claimed a later one meanwhile.
+func (r *Replica) leadingEpoch(epoch int, claim bool) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if claim && r.epoch == epoch && !r.killed() {
+		r.leading = true
+		r.seq = 0
+		r.sent = time.Time{}
+	}
+	return r.leading && r.epoch == epoch
+}
+
+// send a write to the other members, and wait for a majority to have
+// it; called by the Persister, with its lock held, before it makes
+// the write.
+func (r *Replica) replicate(epoch int, state []byte, snapshot []byte, deltas []byte) error {
+	r.mu.Lock()
+	if !r.leading || r.epoch != epoch {
+		r.mu.Unlock()
+		return ErrNotReplicated
+	}
+	r.seq++
+	args := &ReplicateArgs{Epoch: epoch, Leader: r.me, Stamp: replicaStamp{epoch, r.seq}, State: state, Snapshot: snapshot, Deltas: deltas}
+	r.mu.Unlock()
+
+	acks := make(chan bool)
+	deadline := time.Now().Add(raftAppendTimeout)
+	for i := range r.peers {
+		if i == r.me {
+			continue
+		}
+		go func(i int) {
+			for time.Now().Before(deadline) && r.leadingEpoch(epoch, false) {
+				reply := &ReplicateReply{}
+				if r.peers[i].Call("Replica.Replicate", args, reply) {
+					if !reply.OK {
+						r.deposed(epoch, reply.Epoch)
+					}
+					acks <- reply.OK
+					return
+				}
+			}
+			acks <- false
+		}(i)
+	}
+	have := 1
+	n := 1
+	for ; n < len(r.peers) && have <= len(r.peers)/2; n++ {
+		if <-acks {
+			have++
+		}
+	}
+	go func() {
+		for ; n < len(r.peers); n++ {
+			<-acks
+		}
+	}()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if have <= len(r.peers)/2 || !r.leading || r.epoch != epoch {
+		r.logger.Warnf(noTid, "", "a write reached %d of %d members, stepping down", have, len(r.peers))
+		r.stepDownLocked()
+		return ErrNotReplicated
+	}
+	r.written = args.Stamp
+	r.saveMetaLocked()
+	return nil
+}
+
+// Replicate handler
+func (r *Replica) Replicate(args *ReplicateArgs, reply *ReplicateReply) {
+	r.mu.Lock()
+	if r.killed() || args.Epoch < r.epoch {
+		reply.Epoch = r.epoch
+		r.mu.Unlock()
+		return
+	}
+	if args.Epoch > r.epoch {
+		r.epoch = args.Epoch
+		r.saveMetaLocked()
+		r.stepDownLocked()
+	}
+	r.heard = time.Now()
+	r.mu.Unlock()
+
+	if !args.Heartbeat {
+		r.install.Lock()
+		defer r.install.Unlock()
+		r.mu.Lock()
+		newer := r.written.less(args.Stamp)
+		r.mu.Unlock()
+		if newer {
+			r.persister.install(args.State, args.Snapshot, args.Deltas)
+			if err := r.persister.Sync(); err != nil {
+				r.logger.Warnf(noTid, "", "can't make a replicated write durable: %v", err)
+				return
+			}
+			r.mu.Lock()
+			r.written = args.Stamp
+			r.saveMetaLocked()
+			r.mu.Unlock()
+		}
+	}
+	reply.OK = true
+}
+
+// Claim handler
+func (r *Replica) Claim(args *ClaimArgs, reply *ClaimReply) {
+	r.mu.Lock()
+	if r.killed() || args.Epoch <= r.epoch {
+		reply.Epoch = r.epoch
+		r.mu.Unlock()
+		return
+	}
+	r.epoch = args.Epoch
+	r.heard = time.Now()
+	r.saveMetaLocked()
+	r.stepDownLocked()
+	written := r.written
+	r.mu.Unlock()
+
+	reply.OK = true
+	reply.Written = written
+	if args.Written.less(written) {
+		reply.State, reply.Snapshot, reply.Deltas = r.persister.ReadServerState(), r.persister.ReadSnapshot(), r.persister.ReadDeltas()
+	}
+}
+
+func (r *Replica) saveMetaLocked() {
+	fw := newFrameWriter()
+	fw.encode(replicaMeta{Epoch: r.epoch, Written: r.written})
+	r.meta.Save(fw.bytes())
+	if err := r.meta.Sync(); err != nil {
+		log.Fatalf("Replica: can't make its epoch durable: %v", err)
+	}
+}
+
+func (r *Replica) readMeta(data []byte) {
+	if len(data) < 1 {
+		return
+	}
+
+	framed, torn, err := readFrames(data)
+	if err == nil && torn > 0 {
+		err = fmt.Errorf("torn write, %d bytes", torn)
+	}
+	if err != nil {
+		log.Fatalf("Replica: %v", err)
+	}
+	var meta replicaMeta
+	if err := labgob.NewDecoder(bytes.NewBuffer(framed)).Decode(&meta); err != nil {
+		log.Fatalf("Replica: state passed its checksum but can't be decoded: %v", err)
+	}
+	r.epoch = meta.Epoch
+	r.written = meta.Written
+}
+
+// send each write to mirror before making it, or nil to stop; a write
+// mirror fails isn't made, nor is any after it until setMirror() is
+// called again.
+func (ps *Persister) setMirror(mirror mirrorFunc) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.mirror = mirror
+	ps.mirrorErr = nil
+}
+
+// send a write to the group; false if it didn't take it, and the
+// write mustn't be made. must be called with ps.mu held.
+func (ps *Persister) mirrorLocked(state []byte, snapshot []byte, deltas []byte) bool {
+	if ps.mirror == nil {
+		return true
+	}
+	if ps.mirrorErr == nil {
+		ps.mirrorErr = ps.mirror(state, snapshot, deltas)
+	}
+	return ps.mirrorErr == nil
+}
+
+// make the Persister hold the leader's state, snapshot and deltas,
+// without sending them on.
+func (ps *Persister) install(state []byte, snapshot []byte, deltas []byte) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if df := ps.disk; df != nil {
+		if !bytes.Equal(snapshot, ps.snapshot) {
+			df.snapshot = df.replace(df.snapshot, snapshot)
+		}
+		if !bytes.Equal(deltas, ps.deltas) {
+			df.deltas = df.replace(df.deltas, deltas)
+		}
+		df.write(df.state, ps.serverstate, state)
+	}
+	ps.serverstate = clone(state)
+	ps.snapshot = clone(snapshot)
+	ps.deltas = clone(deltas)
+}
+
+// a PeerClient for a replica group's Server, which calls whichever
+// member answers, starting with the last one that did.
+type replicaGroupPeer struct {
+	mu      sync.Mutex
+	members []PeerClient // each member's Server
+	leader  int
+}
+
+// a PeerClient for the Server of the replica group whose members'
+// Servers are reached through members.
+func ReplicaGroupPeer(members []PeerClient) PeerClient {
+	return &replicaGroupPeer{members: members}
+}
+
+func (gp *replicaGroupPeer) Call(svcMeth string, args interface{}, reply interface{}) bool {
+	return gp.CallErr(svcMeth, nil, args, reply) == nil
+}
+
+func (gp *replicaGroupPeer) CallMeta(svcMeth string, meta Metadata, args interface{}, reply interface{}) bool {
+	return gp.CallErr(svcMeth, meta, args, reply) == nil
+}
+
+// try each member once, from the last one that answered; a call
+// too large to send, or that the transport doesn't carry, fails the
+// same way at every member, so it isn't tried at the others.
+func (gp *replicaGroupPeer) CallErr(svcMeth string, meta Metadata, args interface{}, reply interface{}) error {
+	gp.mu.Lock()
+	leader := gp.leader
+	gp.mu.Unlock()
+
+	var err error
+	for n := 0; n < len(gp.members); n++ {
+		i := (leader + n) % len(gp.members)
+		err = gp.members[i].CallErr(svcMeth, meta, args, reply)
+		if errors.Is(err, ErrUnsupportedMethod) {
+			return err
+		}
+		if err == nil || errors.Is(err, ErrMessageTooLarge) {
+			gp.mu.Lock()
+			gp.leader = i
+			gp.mu.Unlock()
+			return err
+		}
+	}
+	return err
+}
+
+func (gp *replicaGroupPeer) Send(svcMeth string, args interface{}) {
+	gp.mu.Lock()
+	leader := gp.leader
+	gp.mu.Unlock()
+	gp.members[leader].Send(svcMeth, args)
+}
+
+func (gp *replicaGroupPeer) Close() error {
+	for _, member := range gp.members {
+		if c, ok := member.(io.Closer); ok {
+			c.Close()
+		}
+	}
+	return nil
+}
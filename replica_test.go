@@ -0,0 +1,121 @@
+package commit
+
+import (
+	"3PhaseCommit/labrpc"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+// Runs server 0 as a group of three replicas and crashes its leader as Commit arrives, after
+// the transaction pre-committed there, then commits a second transaction with that member down
+// The coordinator should commit both through the members left, with the first transaction's
+// write applied once on the new leader
+func TestReplicaGroup(t *testing.T) {
+	t.Parallel()
+
+	net := labrpc.MakeNetwork()
+	defer net.Cleanup()
+	lt := makeLabrpcTransport(net)
+	ends := func(prefix string, to string, n int) []PeerClient {
+		peers := make([]PeerClient, n)
+		for i := range peers {
+			name := fmt.Sprintf("%s-%d", prefix, i)
+			end := net.MakeEnd(name)
+			net.Connect(name, fmt.Sprintf("%s%d", to, i))
+			net.Enable(name, true)
+			peers[i] = end
+		}
+		return peers
+	}
+
+	crashed := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	var replicas []*Replica
+	first := true
+	for i := 0; i < 3; i++ {
+		r := MakeReplica(ends(fmt.Sprintf("replica%d", i), "replica", 3), i, MakePersister(), MakePersister(), func(ps *Persister) (*Server, io.Closer) {
+			sv := MakeServer([]string{"x"}, ps)
+			sv.setHook(func(point hookPoint, method string, tid int, meta Metadata) {
+				if point == hookBefore && method == "Server.Commit" && tid == 0 && first {
+					first = false
+					replicas[i].Kill()
+					close(crashed)
+					<-release
+				}
+			})
+			closer, _ := lt.Serve(fmt.Sprintf("member%d", i), sv)
+			return sv, closer
+		})
+		defer r.Kill()
+		replicas = append(replicas, r)
+		lt.ServeReplica(fmt.Sprintf("replica%d", i), r)
+	}
+	leader := func() *Server {
+		for start := time.Now(); time.Since(start) < waitTimeout; time.Sleep(10 * time.Millisecond) {
+			for _, r := range replicas {
+				if sv := r.Server(); sv != nil && !r.killed() {
+					return sv
+				}
+			}
+		}
+		t.Fatalf("no replica started a server within %v", waitTimeout)
+		return nil
+	}
+	other := MakeServer([]string{"y"}, MakePersister())
+	defer other.Kill()
+	serveLabrpc(net, "server1", other)
+
+	respChan := make(chan ResponseMsg)
+	servers := []PeerClient{ReplicaGroupPeer(ends("group", "member", 3)), ends("coordinator", "server", 2)[1]}
+	co := MakeCoordinator(servers, respChan)
+	defer co.Kill()
+	finish := func(tid int) {
+		co.FinishTransaction(tid)
+		select {
+		case m := <-respChan:
+			if m.tid != tid || !m.committed {
+				t.Fatalf("expected transaction %d to commit, got %+v", tid, m)
+			}
+		case <-time.After(waitTimeout):
+			t.Fatalf("transaction %d didn't finish within %v", tid, waitTimeout)
+		}
+	}
+
+	leader().Set(0, "x", 1)
+	other.Set(0, "y", 1)
+	finish(0)
+	select {
+	case <-crashed:
+	default:
+		t.Fatalf("expected the leader to crash as Commit arrived")
+	}
+	sv := leader()
+	if v := sv.storeValues()["x"]; v != 1 {
+		t.Fatalf("expected the new leader to have committed x = 1, got %v", v)
+	}
+
+	sv.Set(1, "x", 2)
+	finish(1)
+	if v := leader().storeValues()["x"]; v != 2 {
+		t.Fatalf("expected x = 2 after the second commit, got %v", v)
+	}
+}
+
+// Calls a replica group whose first member fails with a wrapped ErrMessageTooLarge, then
+// with ErrUnsupportedMethod, and whose second member would succeed
+// Neither error should be tried at the second member, since every member fails it the same way
+func TestReplicaGroupPeerErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, want := range []error{fmt.Errorf("%w: wrapped", ErrMessageTooLarge), ErrUnsupportedMethod} {
+		first, second := &failingPeer{err: want}, &failingPeer{}
+		err := ReplicaGroupPeer([]PeerClient{first, second}).CallErr("Server.Commit", nil, &RPCArgs{Tid: 0}, &CommitReply{})
+		if !errors.Is(err, want) || second.calls.Load() != 0 {
+			t.Fatalf("expected %v from the first member alone, got %v with %d calls to the second", want, err, second.calls.Load())
+		}
+	}
+}
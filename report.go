@@ -0,0 +1,155 @@
+package commit
+
+//
+// a one-line summary logged every so often, so a long soak test can
+// be followed from its log without a metrics stack:
+//
+//   co.ReportEvery(10 * time.Second)
+//   sv.ReportEvery(10 * time.Second)
+//
+//   coordinator  INFO  summary: 3 active (Prepare 1, PreCommit 2); last 10s: 12 committed, 2 aborted, 140 RPCs, 3 failed (2.1%)
+//   server 0     INFO  summary: 2 active (VotedYes 1, PreCommitted 1), 3 keys locked; last 10s: 57 RPCs, 2 replayed (3.5%)
+//
+// the Coordinator counts the transactions it hasn't reported yet by
+// phase, and the RPCs it sent, resends and recovery's Queries
+// included, that failed. a Server counts the transactions it hasn't
+// committed or aborted yet by state, the keys whose lock is held,
+// and the calls to its handlers that were resends or duplicates of
+// one it had answered, the sign of a reply lost on the way back.
+//
+// the reporter runs until Kill(), waking each interval to log;
+// ReportEvery(0) stops the lines but not the goroutine.
+//
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// log a summary every interval; 0 stops the summaries.
+func (co *Coordinator) ReportEvery(interval time.Duration) {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+
+	co.reportEvery = interval
+	if interval > 0 && !co.reporting {
+		co.reporting = true
+		atomic.AddInt32(&co.watchdog, 1)
+		co.spawn(co.summarize)
+	}
+}
+
+// log a summary every interval; 0 stops the summaries.
+func (sv *Server) ReportEvery(interval time.Duration) {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	sv.reportEvery = interval
+	if interval > 0 && !sv.reporting {
+		sv.reporting = true
+		sv.spawn(sv.summarize)
+	}
+}
+
+func (co *Coordinator) summarize() {
+	defer atomic.AddInt32(&co.watchdog, -1)
+
+	ctx := withTxn(context.Background(), noTid, "")
+	var committed, aborted, rpcs, failures int64
+	for !co.killed() {
+		co.mu.Lock()
+		interval := co.reportEvery
+		co.mu.Unlock()
+		if interval <= 0 {
+			time.Sleep(slowCheckInterval)
+			continue
+		}
+		time.Sleep(interval)
+
+		co.mu.Lock()
+		phases := make(map[string]int)
+		for _, tran := range co.tran {
+			if !tran.done {
+				phases[tran.Phase]++
+			}
+		}
+		co.mu.Unlock()
+		c := co.counts
+		nowCommitted, nowAborted, nowRPCs, nowFailures := c.committed.Load(), c.aborted.Load(), c.rpcs.Load(), c.failures()
+		co.logFor(ctx).Infof("summary: %s; last %v: %d committed, %d aborted, %d RPCs, %d failed (%s)",
+			countsByName(phases), interval, nowCommitted-committed, nowAborted-aborted,
+			nowRPCs-rpcs, nowFailures-failures, percent(nowFailures-failures, nowRPCs-rpcs))
+		committed, aborted, rpcs, failures = nowCommitted, nowAborted, nowRPCs, nowFailures
+	}
+}
+
+func (sv *Server) summarize() {
+	ctx := withTxn(context.Background(), noTid, "")
+	var calls, replays int64
+	for !sv.killed() {
+		sv.mu.Lock()
+		interval := sv.reportEvery
+		sv.mu.Unlock()
+		if interval <= 0 {
+			sv.sleep(slowCheckInterval)
+			continue
+		}
+		if !sv.sleep(interval) {
+			return
+		}
+
+		locked := 0
+		for _, locks := range sv.lockTable() {
+			if locks.locked {
+				locked++
+			}
+		}
+		sv.mu.Lock()
+		states := make(map[string]int)
+		for _, state := range sv.states {
+			if state != stateCommitted && state != stateAborted {
+				states[state.String()]++
+			}
+		}
+		for tid := range sv.operations {
+			if _, exists := sv.states[tid]; !exists {
+				states[stateOperations.String()]++
+			}
+		}
+		sv.mu.Unlock()
+		nowCalls, nowReplays := sv.replies.calls.Load(), sv.replies.replays.Load()
+		sv.logFor(ctx).Infof("summary: %s, %d keys locked; last %v: %d RPCs, %d replayed (%s)",
+			countsByName(states), locked, interval, nowCalls-calls, nowReplays-replays, percent(nowReplays-replays, nowCalls-calls))
+		calls, replays = nowCalls, nowReplays
+	}
+}
+
+// e.g. "3 active (Prepare 1, PreCommit 2)".
+func countsByName(counts map[string]int) string {
+	names := make([]string, 0, len(counts))
+	total := 0
+	for name, n := range counts {
+		names = append(names, name)
+		total += n
+	}
+	if total == 0 {
+		return "0 active"
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%s %d", name, counts[name])
+	}
+	return fmt.Sprintf("%d active (%s)", total, strings.Join(parts, ", "))
+}
+
+func percent(n int64, of int64) string {
+	if of == 0 {
+		return "0.0%"
+	}
+	return fmt.Sprintf("%.1f%%", 100*float64(n)/float64(of))
+}
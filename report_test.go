@@ -0,0 +1,84 @@
+package commit
+
+import (
+	"3PhaseCommit/labrpc"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Commits one transaction and leaves another with its operations logged, with the coordinator
+// and server each logging a summary every 20ms
+// The coordinator's summaries should count the commit and its RPCs once between them, and the
+// server's should count the open transaction by state
+func TestReportEvery(t *testing.T) {
+	t.Parallel()
+
+	net := labrpc.MakeNetwork()
+	defer net.Cleanup()
+	tr := makeLabrpcTransport(net)
+	svLog, coLog := &recordingLogger{}, &recordingLogger{}
+	sv := MakeServerWithLogger([]string{"x", "y"}, MakePersister(), -1, svLog)
+	defer sv.Kill()
+	sv.ReportEvery(20 * time.Millisecond)
+	tr.Serve("server0", sv)
+	end, _ := tr.Dial("server0")
+	respChan := make(chan ResponseMsg)
+	co := MakeCoordinatorWithLogger([]PeerClient{end}, respChan, coLog)
+	defer co.Kill()
+	co.ReportEvery(20 * time.Millisecond)
+
+	sv.Set(0, "x", 1)
+	co.FinishTransaction(0)
+	select {
+	case m := <-respChan:
+		if !m.committed {
+			t.Fatalf("expected transaction 0 to commit, got %+v", m)
+		}
+	case <-time.After(waitTimeout):
+		t.Fatalf("Transaction 0 got no response within %v", waitTimeout)
+	}
+	sv.Set(1, "y", 1)
+
+	summaries := func(l *recordingLogger) []string {
+		var lines []string
+		for _, line := range l.lines() {
+			if strings.HasPrefix(line.text, "summary: ") {
+				lines = append(lines, line.text)
+			}
+		}
+		return lines
+	}
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		committed := 0
+		for _, line := range summaries(coLog) {
+			if strings.Contains(line, " 1 committed, 0 aborted") {
+				committed++
+			}
+		}
+		open := false
+		for _, line := range summaries(svLog) {
+			open = open || strings.HasPrefix(line, "summary: 1 active (Operations 1), 0 keys locked; last 20ms: ")
+		}
+		if committed > 1 {
+			t.Fatalf("expected the commit to be counted once, got %v", summaries(coLog))
+		}
+		if committed == 1 && open {
+			break
+		}
+		if time.Since(start) > waitTimeout {
+			t.Fatalf("expected summaries counting the commit and the open transaction, got %v and %v", summaries(coLog), summaries(svLog))
+		}
+	}
+	for _, line := range summaries(coLog) {
+		if !strings.HasSuffix(line, "0 failed (0.0%)") {
+			t.Fatalf("expected no failed RPCs, got %q", line)
+		}
+	}
+	sv.Kill()
+	for start := time.Now(); sv.goroutines() > 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > waitTimeout {
+			t.Fatalf("expected the server's reporter to return once the server was killed")
+		}
+	}
+}
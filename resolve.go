@@ -0,0 +1,121 @@
+package commit
+
+//
+// a restarted Server asking the Coordinator how the transactions it
+// found in doubt ended, rather than waiting for the Coordinator to
+// resend Commit or Abort, or for the next one to Query it:
+//
+//   sv := MakeServer(keys, persister.Copy())
+//   tr.Serve("server0", sv)
+//   end, _ := tr.Dial("coordinator")
+//   sv.ResolveInDoubt(end)
+//
+// a transaction is in doubt if the Server voted Yes, or
+// pre-committed, and hasn't heard the outcome; readPersist() has
+// re-acquired its locks. ResolveInDoubt() asks the Coordinator's
+// ResolveTransaction handler about each one, in the background, and
+// finishes it the way the Coordinator's own messages would: a
+// committed transaction is pre-committed if need be and committed,
+// applying its Sets, and an aborted one releases its locks. one the
+// Coordinator hasn't decided yet, or doesn't know, e.g. because it's
+// still recovering, is asked about again every resolveRetryInterval,
+// until it's decided or the Coordinator's messages finish it first.
+//
+// the Coordinator is served like a Server; labrpcTransport's
+// ServeCoordinator() does it on a labrpc.Network. the other
+// transports only serve Servers so far.
+//
+
+import (
+	"3PhaseCommit/labrpc"
+	"context"
+	"io"
+	"strconv"
+	"time"
+)
+
+const resolveRetryInterval = 100 * time.Millisecond
+
+// ResolveTransaction handler
+// Tells a restarted server whether a transaction committed or aborted,
+// or nothing if that isn't decided yet
+
+func (co *Coordinator) ResolveTransaction(meta Metadata, args *RPCArgs, reply *ResolveReply) {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+
+	tran, exists := co.tran[args.Tid]
+	if exists && (tran.Phase == PhaseCommitted || tran.Phase == PhaseAborted) {
+		reply.Outcome = tran.Phase
+	} else if !exists {
+		reply.Outcome = co.decided[args.Tid] // logged by a previous Coordinator, if at all
+	}
+	co.logFor(withTxn(context.Background(), args.Tid, phaseRecovery)).Debugf("a server asked for the outcome: %q", reply.Outcome)
+
+}
+
+// ask coordinator how each transaction this Server holds in doubt
+// ended, and finish them, in the background; call it after a restart.
+func (sv *Server) ResolveInDoubt(coordinator PeerClient) {
+	tids := sv.undecided()
+	if len(tids) == 0 {
+		return
+	}
+	sv.spawn(func() { sv.resolve(coordinator, tids) })
+}
+
+func (sv *Server) resolve(coordinator PeerClient, tids []int) {
+	for len(tids) > 0 && !sv.killed() {
+		left := tids[:0]
+		for _, tid := range tids {
+			if !sv.resolveOne(coordinator, tid) {
+				left = append(left, tid)
+			}
+		}
+		tids = left
+		if len(tids) > 0 && !sv.sleep(resolveRetryInterval) {
+			return
+		}
+	}
+}
+
+// ask about tid, and finish it if the Coordinator knows how; false
+// if it's still in doubt.
+func (sv *Server) resolveOne(coordinator PeerClient, tid int) bool {
+	sv.mu.Lock()
+	state := sv.states[tid]
+	sv.mu.Unlock()
+	if state != stateVotedYes && state != statePreCommitted {
+		return true // the Coordinator's messages got here first
+	}
+
+	ctx := withTxn(context.Background(), tid, phaseRecovery)
+	meta := Metadata{MetaTid: strconv.Itoa(tid)}
+	args := &RPCArgs{Tid: tid}
+	reply := &ResolveReply{}
+	if err := coordinator.CallErr("Coordinator.ResolveTransaction", meta, args, reply); err != nil {
+		sv.logFor(ctx).Debugf("asking the coordinator for the outcome: %v", err)
+		return false
+	}
+
+	switch reply.Outcome {
+	case PhaseCommitted:
+		sv.logFor(ctx).Infof("the coordinator committed the in-doubt transaction, rolling forward")
+		sv.PreCommit(meta, args, &PreCommitReply{})
+		sv.Commit(meta, args, &CommitReply{})
+	case PhaseAborted:
+		sv.logFor(ctx).Infof("the coordinator aborted the in-doubt transaction")
+		sv.Abort(meta, args, &struct{}{})
+	default:
+		return false
+	}
+	return true
+}
+
+// make co's ResolveTransaction handler reachable at addr.
+func (lt *labrpcTransport) ServeCoordinator(addr string, co *Coordinator) (io.Closer, error) {
+	srv := labrpc.MakeServer()
+	srv.AddService(labrpc.MakeService(co))
+	lt.net.AddServer(addr, srv)
+	return labrpcCloser{lt.net, addr}, nil
+}
@@ -0,0 +1,112 @@
+package commit
+
+import (
+	"3PhaseCommit/labrpc"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Crashes one server as Commit arrives and another as Abort arrives, then restarts both
+// off the network, so only asking the Coordinator can settle what they hold in doubt
+// The first should roll its Set forward and the second release its lock without applying it
+func TestResolveInDoubt(t *testing.T) {
+	t.Parallel()
+
+	net := labrpc.MakeNetwork()
+	defer net.Cleanup()
+	tr := makeLabrpcTransport(net)
+	keys := [][]string{{"x"}, {"y"}, {"w"}}
+	crashOn := []string{"Server.Commit", "Server.Abort", ""}
+	persisters := make([]*Persister, len(keys))
+	ends := make([]PeerClient, len(keys))
+	for i := range keys {
+		persisters[i] = MakePersister()
+		sv := MakeServer(keys[i], persisters[i])
+		defer sv.Kill()
+		crash := crashOn[i]
+		sv.setHook(func(point hookPoint, method string, tid int, meta Metadata) {
+			if point == hookBefore && method == crash {
+				sv.Kill()
+			}
+		})
+		name := fmt.Sprintf("server%d", i)
+		tr.Serve(name, sv)
+		ends[i], _ = tr.Dial(name)
+		if i == 0 {
+			sv.Set(1, "x", 1)
+		} else if i == 1 {
+			sv.Set(2, "y", 2)
+		} else {
+			sv.Set(2, "z", 2) // no such key, so server 2 votes No
+		}
+	}
+	respChan := make(chan ResponseMsg, 2)
+	co := MakeCoordinator(ends, respChan)
+	defer co.Kill()
+	for tid := 1; tid <= 2; tid++ {
+		co.FinishTransaction(tid)
+		select {
+		case <-respChan:
+		case <-time.After(waitTimeout):
+			t.Fatalf("Transaction %d got no response within %v", tid, waitTimeout)
+		}
+	}
+
+	restarted := make([]*Server, 2)
+	for i := range restarted {
+		restarted[i] = MakeServer(keys[i], persisters[i].Copy())
+		defer restarted[i].Kill()
+		if n := len(restarted[i].undecided()); n != 1 {
+			t.Fatalf("expected server %d to restart with 1 transaction in doubt, got %d", i, n)
+		}
+	}
+	tr.ServeCoordinator("coordinator", co)
+	end, _ := tr.Dial("coordinator")
+	for _, sv := range restarted {
+		sv.ResolveInDoubt(end)
+	}
+	for start := time.Now(); len(restarted[0].undecided())+len(restarted[1].undecided()) > 0; time.Sleep(5 * time.Millisecond) {
+		if time.Since(start) > waitTimeout {
+			t.Fatalf("expected the restarted servers to resolve their transactions within %v", waitTimeout)
+		}
+	}
+
+	if v := restarted[0].storeValues()["x"]; v != 1 {
+		t.Fatalf("expected the committed Set to be rolled forward, got x = %v", v)
+	}
+	if locks := restarted[0].heldLocks(); len(locks) != 0 {
+		t.Fatalf("expected server 0 to hold no locks, got %v", locks)
+	}
+	if v := restarted[1].storeValues()["y"]; v == 2 {
+		t.Fatalf("expected the aborted Set not to be applied")
+	}
+	if locks := restarted[1].heldLocks(); len(locks) != 0 {
+		t.Fatalf("expected server 1 to release its lock, got %v", locks)
+	}
+}
+
+// Has a server in doubt ask a coordinator it can't reach, then kills it
+// The goroutine asking should return as soon as the server is killed, rather than
+// after its next retry
+func TestResolveKilled(t *testing.T) {
+	t.Parallel()
+
+	sv := MakeServer([]string{"x"}, MakePersister())
+	sv.Set(0, "x", 1)
+	sv.Prepare(Metadata{}, &RPCArgs{Tid: 0}, &PrepareReply{})
+	unreachable := &refusingPeer{method: "Coordinator.ResolveTransaction"}
+	unreachable.refusing.Store(true)
+	sv.ResolveInDoubt(unreachable)
+	if n := sv.goroutines(); n != 1 {
+		t.Fatalf("expected 1 goroutine asking the coordinator, got %d", n)
+	}
+
+	time.Sleep(resolveRetryInterval / 2)
+	sv.Kill()
+	for start := time.Now(); sv.goroutines() > 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > resolveRetryInterval/4 {
+			t.Fatalf("expected the goroutine asking the coordinator to return once killed")
+		}
+	}
+}
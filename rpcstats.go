@@ -0,0 +1,114 @@
+package commit
+
+//
+// what the Coordinator's RPCs met with, by kind of failure, so a
+// test can check that the Coordinator saw the fault it injected and
+// not another:
+//
+//   before := co.Stats()
+//   net.Enable(endname, false)
+//   ...
+//   if co.Stats().Disconnected == before.Disconnected {
+//       t.Fatalf("expected calls to the disabled end to fail")
+//   }
+//
+// a failed call is a timeout if the network lost the request or
+// reply (labrpc.ErrLost) or the transport gave up waiting for it,
+// disconnected if the end is disabled or unconnected, the server is
+// down, or the connection closed or couldn't be made, and too large
+// if it didn't fit in a message. rejected votes are Prepares that a
+// server with operations answered No. a duplicate reply is one to a
+// message the server had already answered for the same transaction,
+// e.g. the Commits sent again when a client asks about a transaction
+// that already committed.
+//
+// the counts start from zero when the Coordinator is made.
+//
+
+import (
+	"3PhaseCommit/labrpc"
+	"context"
+	"errors"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type RPCStats struct {
+	Sent             int64 // every call, resends and recovery's Queries included
+	Timeouts         int64
+	Disconnected     int64
+	TooLarge         int64
+	RejectedVotes    int64
+	DuplicateReplies int64
+}
+
+// the calls that failed, of any kind.
+func (s RPCStats) Failed() int64 {
+	return s.Timeouts + s.Disconnected + s.TooLarge
+}
+
+func (co *Coordinator) Stats() RPCStats {
+	c := co.counts
+	return RPCStats{
+		Sent:             c.rpcs.Load(),
+		Timeouts:         c.timeouts.Load(),
+		Disconnected:     c.disconnected.Load(),
+		TooLarge:         c.tooLarge.Load(),
+		RejectedVotes:    c.rejectedVotes.Load(),
+		DuplicateReplies: c.duplicateReplies.Load(),
+	}
+}
+
+// count a call that failed with err.
+func (c *coordinatorCounts) failed(err error) {
+	var timeout interface{ Timeout() bool } // e.g. a net.Error
+	switch {
+	case errors.Is(err, ErrMessageTooLarge):
+		c.tooLarge.Add(1)
+	case errors.Is(err, labrpc.ErrLost),
+		errors.Is(err, errTCPTimeout),
+		errors.Is(err, errUDPTimeout),
+		errors.Is(err, context.DeadlineExceeded),
+		status.Code(err) == codes.DeadlineExceeded,
+		errors.As(err, &timeout) && timeout.Timeout():
+		c.timeouts.Add(1)
+	default:
+		c.disconnected.Add(1)
+	}
+}
+
+func (c *coordinatorCounts) failures() int64 {
+	return c.timeouts.Load() + c.disconnected.Load() + c.tooLarge.Load()
+}
+
+// note that server answered tran's method, counting a duplicate
+// reply if it had before; co.mu must be held.
+func (co *Coordinator) answeredLocked(tran *Transaction, server int, method string) {
+	if tran.answered == nil {
+		tran.answered = make(map[int]map[string]bool)
+	}
+	if tran.answered[server] == nil {
+		tran.answered[server] = make(map[string]bool)
+	}
+	if tran.answered[server][method] {
+		co.counts.duplicateReplies.Add(1)
+	}
+	tran.answered[server][method] = true
+}
+
+// the messages a server in state has answered, so that a recovered
+// transaction counts the previous Coordinator's.
+func answeredIn(state TransactionState) []string {
+	switch state {
+	case stateVotedYes, stateVotedNo:
+		return []string{"Prepare"}
+	case statePreCommitted:
+		return []string{"Prepare", "PreCommit"}
+	case stateCommitted:
+		return []string{"Prepare", "PreCommit", "Commit"}
+	case stateAborted:
+		return []string{"Abort"}
+	}
+	return nil
+}
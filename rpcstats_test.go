@@ -0,0 +1,101 @@
+package commit
+
+import (
+	"3PhaseCommit/labrpc"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Runs transactions against two servers while injecting one fault at a time: a Prepare for a
+// missing key, a lost Prepare, a disabled end, and a restarted coordinator asked again about a
+// committed transaction
+// Each fault should show up in its own count in Stats() and leave the others alone
+func TestRPCStats(t *testing.T) {
+	t.Parallel()
+
+	net := labrpc.MakeNetwork()
+	defer net.Cleanup()
+	servers := []*Server{
+		MakeServer([]string{"x"}, MakePersister()),
+		MakeServer([]string{"y"}, MakePersister()),
+	}
+	ends := make([]PeerClient, len(servers))
+	for i, sv := range servers {
+		defer sv.Kill()
+		serveLabrpc(net, i, sv)
+		ends[i] = net.MakeEnd(i)
+		net.Connect(i, i)
+		net.Enable(i, true)
+	}
+	var mu sync.Mutex
+	dropPrepare := false
+	net.RegisterInterceptor(func(svcMeth string, endname interface{}) *labrpc.Fault {
+		mu.Lock()
+		defer mu.Unlock()
+		if dropPrepare && svcMeth == "Server.Prepare" {
+			dropPrepare = false
+			return &labrpc.Fault{DropRequest: true}
+		}
+		return nil
+	})
+	respChan := make(chan ResponseMsg)
+	co := makeCoordinator(ends, respChan, realClock{}, 500*time.Millisecond, stdLogger("coordinator"))
+	wait := func(tid int, committed bool) {
+		select {
+		case m := <-respChan:
+			if m.tid != tid || m.committed != committed {
+				t.Fatalf("expected transaction %d to end committed=%v, got %+v", tid, committed, m)
+			}
+		case <-time.After(waitTimeout):
+			t.Fatalf("Transaction %d got no response within %v", tid, waitTimeout)
+		}
+	}
+	expect := func(what string, want RPCStats) {
+		got := co.Stats()
+		want.Sent = got.Sent
+		if got != want {
+			t.Fatalf("after %s, expected %+v, got %+v", what, want, got)
+		}
+	}
+
+	servers[0].Set(0, "x", 1)
+	servers[1].Set(0, "y", 1)
+	co.FinishTransaction(0)
+	wait(0, true)
+	expect("a commit", RPCStats{})
+
+	servers[1].Get(1, "z")
+	co.FinishTransaction(1)
+	wait(1, false)
+	expect("a missing key", RPCStats{RejectedVotes: 1})
+
+	mu.Lock()
+	dropPrepare = true
+	mu.Unlock()
+	servers[0].Set(2, "x", 2)
+	co.FinishTransaction(2)
+	wait(2, true)
+	expect("a lost Prepare", RPCStats{RejectedVotes: 1, Timeouts: 1})
+
+	net.Enable(1, false)
+	servers[1].Set(3, "y", 3)
+	co.FinishTransaction(3)
+	wait(3, false)
+	if st := co.Stats(); st.Disconnected == 0 || st.Timeouts != 1 || st.RejectedVotes != 1 {
+		t.Fatalf("after a disabled end, expected only disconnected calls, got %+v", st)
+	}
+	co.Kill()
+	net.Enable(1, true)
+
+	co = makeCoordinator(ends, respChan, realClock{}, 500*time.Millisecond, stdLogger("coordinator"))
+	defer co.Kill()
+	for start := time.Now(); co.working() > 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > waitTimeout {
+			t.Fatalf("recovery didn't finish within %v", waitTimeout)
+		}
+	}
+	co.FinishTransaction(0)
+	wait(0, true)
+	expect("reporting a recovered commit again", RPCStats{DuplicateReplies: 2})
+}
@@ -0,0 +1,279 @@
+package commit
+
+//
+// a small language for failure scenarios in the 3PC tester.
+//
+// a scenario is a list of steps run in order by cfg.run():
+//
+//   cfg.run(
+//     doSet(0, "x", 1),
+//     atNextCommit(doCrashServer(0)),
+//     doFinish(0),
+//     awaitCommit(),
+//     expectBlocked(0, 50*time.Millisecond),
+//     doRestartServer(0),
+//     expectCommit(0, nil),
+//   )
+//
+// faults (crashes, partitions, restarts) can run either as
+// top-level steps or inside atNextPreCommit()/atNextCommit(),
+// which fire them as the next message of that phase is sent,
+// atNthPreCommit()/atNthCommit(), which fire them at the nth,
+// or inside atNextQuery(), which fires them during recovery.
+//
+
+import (
+	"fmt"
+	"time"
+)
+
+type step struct {
+	name   string
+	locked bool // must run with cfg.mu held; true for faults
+	do     func(cfg *config)
+}
+
+// run the steps of a scenario in order.
+func (cfg *config) run(steps ...step) {
+	for _, s := range steps {
+		if s.locked {
+			cfg.mu.Lock()
+			s.do(cfg)
+			cfg.mu.Unlock()
+		} else {
+			s.do(cfg)
+		}
+	}
+}
+
+func fault(name string, do func(cfg *config)) step {
+	return step{name: name, locked: true, do: do}
+}
+
+// ------------------------------------------
+//                 OPERATIONS
+// ------------------------------------------
+
+func doSet(tid int, key string, value interface{}) step {
+	return step{name: fmt.Sprintf("set(%d, %s, %v)", tid, key, redactionFromEnv().value(value)), do: func(cfg *config) {
+		cfg.sendSet(tid, key, value)
+	}}
+}
+
+func doGet(tid int, key string) step {
+	return step{name: fmt.Sprintf("get(%d, %s)", tid, key), do: func(cfg *config) {
+		cfg.sendGet(tid, key)
+	}}
+}
+
+func doFinish(tid int) step {
+	return step{name: fmt.Sprintf("finish(%d)", tid), do: func(cfg *config) {
+		cfg.finishTransaction(tid)
+	}}
+}
+
+// finish the transaction on coordinator c (see startExtraCoordinator()).
+func doFinishOn(c int, tid int) step {
+	return step{name: fmt.Sprintf("finishOn(%d, %d)", c, tid), do: func(cfg *config) {
+		cfg.finishTransactionOn(c, tid)
+	}}
+}
+
+func doSleep(d time.Duration) step {
+	return step{name: fmt.Sprintf("sleep(%v)", d), do: func(cfg *config) {
+		time.Sleep(d)
+	}}
+}
+
+// ------------------------------------------
+//                   FAULTS
+// ------------------------------------------
+
+func doCrashServer(i int) step {
+	return fault(fmt.Sprintf("crash(%d)", i), func(cfg *config) {
+		cfg.crashServerLocked(i)
+	})
+}
+
+func doRestartServer(i int) step {
+	return fault(fmt.Sprintf("restart(%d)", i), func(cfg *config) {
+		cfg.restartServerLocked(i)
+	})
+}
+
+func doDisconnect(i int) step {
+	return fault(fmt.Sprintf("disconnect(%d)", i), func(cfg *config) {
+		cfg.disconnect(i)
+	})
+}
+
+func doConnect(i int) step {
+	return fault(fmt.Sprintf("connect(%d)", i), func(cfg *config) {
+		cfg.connect(i)
+	})
+}
+
+func doPause(i int) step {
+	return fault(fmt.Sprintf("pause(%d)", i), func(cfg *config) {
+		cfg.pauseLocked(i)
+	})
+}
+
+func doResume(i int) step {
+	return fault(fmt.Sprintf("resume(%d)", i), func(cfg *config) {
+		cfg.resumeLocked(i)
+	})
+}
+
+func doPartition(groups ...[]int) step {
+	return fault(fmt.Sprintf("partition(%v)", groups), func(cfg *config) {
+		cfg.partitionLocked(groups)
+	})
+}
+
+func doHeal() step {
+	return fault("heal()", func(cfg *config) {
+		cfg.healLocked()
+	})
+}
+
+func doRestartCoordinator() step {
+	return fault("restartCoordinator()", func(cfg *config) {
+		cfg.restartCoordinatorLocked()
+	})
+}
+
+// start coordinator 1, 2, ... next to the current one.
+func doStartExtraCoordinator() step {
+	return fault("startExtraCoordinator()", func(cfg *config) {
+		cfg.startExtraCoordinatorLocked()
+	})
+}
+
+func doIsolateCoordinator(c int) step {
+	return fault(fmt.Sprintf("isolateCoordinator(%d)", c), func(cfg *config) {
+		cfg.isolateCoordinatorLocked(c, true)
+	})
+}
+
+func doReconnectCoordinator(c int) step {
+	return fault(fmt.Sprintf("reconnectCoordinator(%d)", c), func(cfg *config) {
+		cfg.isolateCoordinatorLocked(c, false)
+	})
+}
+
+// ------------------------------------------
+//                PHASE HOOKS
+// ------------------------------------------
+
+// run faults as the next PreCommit is sent.
+func atNextPreCommit(faults ...step) step {
+	return atNthPreCommit(1, faults...)
+}
+
+// run faults as the nth upcoming PreCommit is sent, counting from 1.
+func atNthPreCommit(n int, faults ...step) step {
+	return step{name: fmt.Sprintf("atNthPreCommit(%d)", n), do: func(cfg *config) {
+		checkFaults(cfg, faults)
+		cfg.doOnPreCommit(n, func() { runLocked(cfg, faults) })
+	}}
+}
+
+// run faults as the next Commit is sent.
+func atNextCommit(faults ...step) step {
+	return atNthCommit(1, faults...)
+}
+
+// run faults as the nth upcoming Commit is sent, counting from 1.
+func atNthCommit(n int, faults ...step) step {
+	return step{name: fmt.Sprintf("atNthCommit(%d)", n), do: func(cfg *config) {
+		checkFaults(cfg, faults)
+		cfg.doOnCommit(n, func() { runLocked(cfg, faults) })
+	}}
+}
+
+// run faults as the next recovery Query is sent.
+func atNextQuery(faults ...step) step {
+	return step{name: "atNextQuery", do: func(cfg *config) {
+		checkFaults(cfg, faults)
+		cfg.doNextQuery(func() bool {
+			runLocked(cfg, faults)
+			return true
+		})
+	}}
+}
+
+func checkFaults(cfg *config, faults []step) {
+	for _, f := range faults {
+		if !f.locked {
+			cfg.t.Fatalf("scenario: %s can't run inside a phase hook", f.name)
+		}
+	}
+}
+
+func runLocked(cfg *config, faults []step) {
+	for _, f := range faults {
+		f.do(cfg)
+	}
+}
+
+// wait until the hook registered by atNextPreCommit() or
+// atNthPreCommit() has fired.
+func awaitPreCommit() step {
+	return step{name: "awaitPreCommit", do: func(cfg *config) {
+		cfg.awaitHook(func() bool { return cfg.onPreCommit == nil })
+	}}
+}
+
+// wait until the hook registered by atNextCommit() or
+// atNthCommit() has fired.
+func awaitCommit() step {
+	return step{name: "awaitCommit", do: func(cfg *config) {
+		cfg.awaitHook(func() bool { return cfg.onCommit == nil })
+	}}
+}
+
+// wait until the hook registered by atNextQuery() has fired.
+func awaitQuery() step {
+	return step{name: "awaitQuery", do: func(cfg *config) {
+		cfg.awaitHook(func() bool { return cfg.onQuery == nil })
+	}}
+}
+
+func (cfg *config) awaitHook(fired func() bool) {
+	for {
+		cfg.mu.Lock()
+		done := fired()
+		cfg.mu.Unlock()
+		if done {
+			return
+		}
+		cfg.stopIfFailed()
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// ------------------------------------------
+//                EXPECTATIONS
+// ------------------------------------------
+
+// the transaction commits, returning readValues (unless nil).
+func expectCommit(tid int, readValues map[string]interface{}) step {
+	return step{name: fmt.Sprintf("expectCommit(%d)", tid), do: func(cfg *config) {
+		cfg.assertTransaction(tid, true, readValues)
+	}}
+}
+
+func expectAbort(tid int) step {
+	return step{name: fmt.Sprintf("expectAbort(%d)", tid), do: func(cfg *config) {
+		cfg.assertTransaction(tid, false, nil)
+	}}
+}
+
+// the transaction is still undecided after d.
+func expectBlocked(tid int, d time.Duration) step {
+	return step{name: fmt.Sprintf("expectBlocked(%d)", tid), do: func(cfg *config) {
+		time.Sleep(d)
+		cfg.assertNoTransaction(tid)
+	}}
+}
@@ -0,0 +1,107 @@
+package commit
+
+import (
+	"3PhaseCommit/labgob"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// Restarts a server with a snapshot, commits in its log and a transaction in doubt, first as
+// persisted, then with a snapshot value and a logged commit each changed in a way that still decodes
+// The intact store should pass, and each damaged one start degraded, voting No on a new transaction
+// while it still commits the one in doubt
+func TestSelfCheck(t *testing.T) {
+	t.Parallel()
+
+	keys := []string{"x", "y", "z"}
+	ps := MakePersister()
+	sv := MakeServerWithSnapshots(keys, ps, 1<<20)
+	commit := func(sv *Server, tid int) {
+		sv.Prepare(Metadata{}, &RPCArgs{Tid: tid}, &PrepareReply{})
+		sv.PreCommit(Metadata{}, &RPCArgs{Tid: tid}, &PreCommitReply{})
+		sv.Commit(Metadata{}, &RPCArgs{Tid: tid}, &CommitReply{})
+	}
+	sv.Set(0, "x", 1)
+	sv.Set(0, "y", "one")
+	commit(sv, 0)
+	if err := sv.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint: %v", err)
+	}
+	sv.Set(1, "y", "two")
+	commit(sv, 1)
+	sv.Set(2, "z", 3)
+	sv.Prepare(Metadata{}, &RPCArgs{Tid: 2}, &PrepareReply{})
+	sv.Kill()
+
+	restart := func(ps *Persister) *Server {
+		sv := MakeServerWithSnapshots(keys, ps, 1<<20)
+		t.Cleanup(sv.Kill)
+		return sv
+	}
+	if err := restart(ps.Copy()).SelfCheck(); err != nil {
+		t.Fatalf("expected the persisted store to pass its self-check, got %v", err)
+	}
+
+	// a snapshot value changed, its checksum not
+	saved, err := decodeState(ps.ReadSnapshot())
+	if err != nil {
+		t.Fatalf("decodeState: %v", err)
+	}
+	saved.values["x"] = 100
+	badSnapshot := ps.Copy()
+	badSnapshot.snapshot = saved.encode()
+
+	// a logged commit's value changed, its frame rechecksummed
+	var records []logRecord
+	d := labgob.NewDecoder(bytes.NewBuffer(mustReadFrames(t, ps.ReadServerState())))
+	for {
+		var record logRecord
+		if d.Decode(&record) != nil {
+			break
+		}
+		if record.Tid == 1 && record.State == stateCommitted {
+			record.Values["y"] = "three"
+		}
+		records = append(records, record)
+	}
+	fw := newFrameWriter()
+	for _, record := range records {
+		fw.encode(record)
+	}
+	badLog := ps.Copy()
+	badLog.serverstate = fw.bytes()
+
+	for _, c := range []struct {
+		name string
+		ps   *Persister
+		want string
+	}{
+		{"snapshot", badSnapshot, "checksum"},
+		{"log", badLog, "commit marker"},
+	} {
+		sv := restart(c.ps)
+		if err := sv.SelfCheck(); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Fatalf("%s: expected the self-check to fail on the %s, got %v", c.name, c.want, err)
+		}
+		sv.Set(3, "x", 4)
+		reply := &PrepareReply{}
+		sv.Prepare(Metadata{}, &RPCArgs{Tid: 3}, reply)
+		if reply.Vote {
+			t.Fatalf("%s: expected a degraded server to vote No", c.name)
+		}
+		sv.PreCommit(Metadata{}, &RPCArgs{Tid: 2}, &PreCommitReply{})
+		sv.Commit(Metadata{}, &RPCArgs{Tid: 2}, &CommitReply{})
+		if v := sv.storeValues()["z"]; v != 3 {
+			t.Fatalf("%s: expected the in-doubt transaction to commit, got z = %v", c.name, v)
+		}
+	}
+}
+
+func mustReadFrames(t *testing.T, data []byte) []byte {
+	framed, _, err := readFrames(data)
+	if err != nil {
+		t.Fatalf("readFrames: %v", err)
+	}
+	return framed
+}
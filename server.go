@@ -1,8 +1,17 @@
 package commit
 
 import (
+	"3PhaseCommit/labgob"
+	"bytes"
+	"context"
+	"errors"
 	"log"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
 type StoreItem struct {
@@ -10,16 +19,89 @@ type StoreItem struct {
 	lock  sync.RWMutex
 
 	// Any extra fields here
+	version int // how many committed transactions have set it, so a replayed log can't roll it back
 
 }
 
 type Server struct {
-	mu    sync.Mutex
-	store map[string]*StoreItem
+	mu        sync.Mutex
+	store     map[string]*StoreItem
+	persister *Persister    // holds this server's persisted state
+	dead      int32         // set by Kill()
+	done      chan struct{} // closed by Kill()
+	prepares  int32         // Prepare handlers that haven't returned
+	running   int32         // goroutines started by spawn() that haven't returned
+	profiling int32         // 1 to label handlers with their transaction; see profile.go
+	redacting int32         // how logs show values, a Redaction; see redact.go
+	durable   int32         // how durable a Yes vote is before it's sent, a DurabilityLevel; see durability.go
 
 	// Your fields here
-	operations map[int][]Operation
-	states     map[int]TransactionState
+	operations      map[int][]Operation
+	states          map[int]TransactionState
+	readValues      map[int]map[string]interface{} // values read by committed transactions
+	preparing       map[int]chan struct{}          // closed when the Prepare acquiring a transaction's locks returns
+	maxstate        int                            // snapshot once the log grows past this many bytes (-1 to never log)
+	log             []logRecord                    // changes since the last snapshot
+	logger          Logger
+	hook            handlerHook                // run by handlers for the tester; nil if none
+	fits            func(msg interface{}) bool // whether the transport can carry msg; nil if it has no limit
+	replies         *replyCache                // replies to recent requests, so that resends don't run twice
+	tracer          trace.Tracer               // starts the handlers' spans; see tracing.go
+	events          eventBus                   // see events.go
+	metrics         func()                     // ends SetMetrics()'s subscription
+	audit           func()                     // ends SetAuditSink()'s subscription
+	archive         func()                     // ends SetArchiveSink()'s subscription
+	contention      map[string]*KeyContention  // how long Prepares waited for each key; see hotkeys.go
+	blocked         map[int]Operation          // the op each blocked Prepare waits for the lock of; see blocked.go
+	reportEvery     time.Duration              // log a summary this often; see report.go
+	reporting       bool                       // the reporter has started
+	checkpointEvery time.Duration              // fold the log into a snapshot this often; see checkpoint.go
+	checkpointing   bool                       // the checkpointer has started
+	retain          int                        // checkpoints to keep the snapshot and log of; see pitr.go
+	deltaEvery      int                        // deltas to write between full snapshots; see delta.go
+	deltas          []byte                     // the deltas written since the last full snapshot
+	deltaCount      int                        // how many deltas that is
+	snapshotSum     uint32                     // the last full snapshot's checksum, which the deltas name
+	degraded        error                      // why the store failed its self-check at startup, if it did; see selfcheck.go
+	moved           map[string]bool            // keys exported to another server, whose operations are refused; see migrate.go
+}
+
+// where in a handler the tester's hook runs
+
+type hookPoint int
+
+const (
+	hookBefore hookPoint = iota // as the handler starts, before it looks at any state
+	hookAfter                   // once it has changed and persisted its state, just before it replies
+)
+
+func (p hookPoint) String() string {
+	if p == hookBefore {
+		return "before"
+	}
+	return "after"
+}
+
+// code the tester runs inside handlers, with no lock held, e.g. to
+// delay or crash the server at a point it can't reach by faulting
+// messages, which happens as they're sent. meta is the call's
+// metadata
+
+type handlerHook func(point hookPoint, method string, tid int, meta Metadata)
+
+// one logged change: a transaction's operations, state and read
+// values, and the values it wrote if it just committed
+
+type logRecord struct {
+	Tid        int
+	Operations []Operation
+	State      TransactionState
+	HasState   bool
+	ReadValues map[string]interface{}
+	Values     map[string]interface{}
+	Versions   map[string]int // each of Values' keys' version once it was set
+	Committed  int64          // when it committed, in Unix nanoseconds, if it just did; see pitr.go
+	Sum        uint32         // checksum of Values and Versions, its commit marker; see selfcheck.go
 }
 
 // Prepare handler
@@ -34,12 +116,24 @@ type Server struct {
 
 // 3. If this fails, release any obtained locks and vote No
 
-func (sv *Server) Prepare(args *RPCArgs, reply *PrepareReply) {
+func (sv *Server) Prepare(meta Metadata, args *RPCArgs, reply *PrepareReply) {
 
-	log.Printf("Prepare")
-	// log.Printf("Aquiring prepare lock")
+	finish, replayed := sv.replies.start("Server.Prepare", meta, reply)
+	if replayed {
+		return
+	}
+	defer finish()
+	ctx, span := sv.startSpan(meta, "Server.Prepare", args.Tid, PhasePrepare)
+	defer sv.profile(ctx)()
+	defer span.End()
+	atomic.AddInt32(&sv.prepares, 1)
+	defer atomic.AddInt32(&sv.prepares, -1)
+
+	sv.runHook(hookBefore, "Server.Prepare", args.Tid, meta)
+	defer sv.runHook(hookAfter, "Server.Prepare", args.Tid, meta)
+
+	sv.logFor(ctx).Debugf("handling Prepare, metadata %v", meta)
 	// sv.mu.Lock()
-	// log.Printf("Aquired prepare lock")
 	// defer sv.mu.Unlock()
 
 	// if the transaction ID is already committed, set the reply to false
@@ -55,124 +149,302 @@ func (sv *Server) Prepare(args *RPCArgs, reply *PrepareReply) {
 		return
 	}
 
-	sv.mu.Unlock()
+	// a resent Prepare waits for the one still acquiring locks, then answers with its vote
+	for {
+		done, preparing := sv.preparing[tId]
+		if !preparing {
+			break
+		}
+		sv.mu.Unlock()
+		<-done
+		sv.mu.Lock()
+	}
 
 	reply.Relevant = true
 	reply.Vote = true
 
-	sv.mu.Lock()
 	// check if the transaction ID exists in the states map
 	if sv.states[args.Tid] != stateOperations {
-		log.Printf("Prepare: transaction ID %d already exists", args.Tid)
+		sv.logFor(ctx).Debugf("already voted")
 		if sv.states[args.Tid] == stateVotedYes || sv.states[args.Tid] == statePreCommitted || sv.states[args.Tid] == stateCommitted {
 			reply.Vote = true
 		} else {
 			reply.Vote = false
 		}
 		sv.mu.Unlock()
-		log.Printf("Prepare: transaction ID %d already exists", args.Tid)
+		sv.logFor(ctx).Debugf("voted %v again", reply.Vote)
+		return
+	}
+
+	// a store that failed its self-check takes no new transactions
+	if sv.degraded != nil {
+		sv.logFor(ctx).Infof("the store failed its self-check, voting No")
+		reply.Vote = false
+		sv.states[tId] = stateVotedNo
+		sv.persist(tId)
+		sv.mu.Unlock()
 		return
 	}
+
+	done := make(chan struct{})
+	sv.preparing[tId] = done
 	sv.mu.Unlock()
 
-	locks := make([]*StoreItem, 0)
+	defer func() {
+		sv.mu.Lock()
+		delete(sv.preparing, tId)
+		close(done)
+		sv.mu.Unlock()
+	}()
+
+	locked := make([]Operation, 0)
+	var waitedFor []string // the keys whose lock was held when we got to them
 
 	// try to obtain locks for all the operations
-	log.Printf("Prepare: try to obtain locks for all the operations")
-	for _, op := range ops {
+	sv.logFor(ctx).Debugf("trying to obtain locks for all the operations")
+	for _, op := range lockOrder(ops) {
 		sv.mu.Lock()
 		item, exist := sv.store[op.Key]
 		sv.mu.Unlock()
-		log.Printf("Prepare: lock obtained for key %s", op.Key)
+		sv.logFor(ctx).Debugf("locking key %s", op.Key)
 
 		// if the item does not exist, set the reply to false
 		if !exist {
-			log.Printf("Prepare: item does not exist")
+			sv.logFor(ctx).Infof("key %s does not exist, voting No", op.Key)
 			reply.Vote = false
+			reply.NoKey = op.Key
 			sv.mu.Lock()
 			sv.states[tId] = stateVotedNo
+			sv.persist(tId)
 			sv.mu.Unlock()
 
 			// unlock all the locks obtained so far
-			for _, lock := range locks {
-				if lock != nil {
-					lock.lock.Unlock()
-				}
-			}
+			sv.unlockOps(ctx, locked)
 
 			return
 		}
 
-		log.Printf("Prepare: item exists for key %s", op.Key)
+		sv.logFor(ctx).Debugf("key %s exists", op.Key)
 
-		// try to obtain the lock for the item
+		// try to obtain the lock for the item, timing the wait if it's held
+		start := time.Now()
+		waited := false
 		if op.IsGet {
-			log.Printf("Prepare: read lock obtained for key %s", op.Key)
-			item.lock.RLock() // use read lock for get operation
-			log.Printf("Prepare: finished read lock obtained for key %s", op.Key)
+			sv.logFor(ctx).Debugf("waiting for read lock on key %s", op.Key)
+			if !item.lock.TryRLock() {
+				waited = true
+				sv.setBlocked(tId, op)
+				item.lock.RLock() // use read lock for get operation
+			}
+			sv.logFor(ctx).Debugf("read lock obtained for key %s", op.Key)
 
 		} else {
-			log.Printf("Prepare: write lock obtained for key %s", op.Key)
-			item.lock.Lock() // use write lock for set operation
-			log.Printf("Prepare: finished write lock obtained for key %s", op.Key)
+			sv.logFor(ctx).Debugf("waiting for write lock on key %s", op.Key)
+			if !item.lock.TryLock() {
+				waited = true
+				sv.setBlocked(tId, op)
+				item.lock.Lock() // use write lock for set operation
+			}
+			sv.logFor(ctx).Debugf("write lock obtained for key %s", op.Key)
 
 		}
-		log.Printf("Prepare: lock obtained for key %s after trying to obtain the lock", op.Key)
+		var wait time.Duration
+		if waited {
+			wait = time.Since(start)
+			sv.mu.Lock()
+			sv.noteWaitLocked(op.Key, wait)
+			delete(sv.blocked, tId)
+			sv.mu.Unlock()
+			waitedFor = append(waitedFor, op.Key)
+		}
+		sv.publish(LockAcquired{EventHeader: serverEventHeader(ctx), Key: op.Key, Write: !op.IsGet, Waited: wait})
+		sv.logFor(ctx).Debugf("lock obtained for key %s", op.Key)
 
-		locks = append(locks, item) // add the lock to the list of locks obtained
+		locked = append(locked, op) // add the lock to the list of locks obtained
 
 	}
 
-	log.Printf("Prepare: locks obtained for all operations")
+	sv.logFor(ctx).Debugf("locks obtained for all operations")
 
 	sv.mu.Lock()
+
+	// the coordinator gave up on us and aborted while we waited for the locks,
+	// or we were killed and must let the other waiting Prepares finish
+	if sv.states[tId] == stateAborted || sv.killed() {
+		sv.logFor(ctx).Infof("aborted while acquiring locks, voting No")
+		sv.noteAbortLocked(waitedFor)
+		sv.unlockOps(ctx, locked)
+		reply.Vote = false
+		sv.mu.Unlock()
+		return
+	}
+
+	// the Commit reply must get back to the coordinator, which can't
+	// abort once it has decided to commit
+	if !sv.commitReplyFits(ops) {
+		sv.logFor(ctx).Infof("Commit reply would be too large, voting No")
+		sv.unlockOps(ctx, locked)
+		reply.Vote = false
+		reply.TooLarge = true
+		sv.states[tId] = stateVotedNo
+		sv.persist(tId)
+		sv.mu.Unlock()
+		return
+	}
+
 	sv.states[tId] = stateVotedYes
+	sv.persist(tId)
 	sv.mu.Unlock()
+
+	// the operations and the vote must be on disk before we promise;
+	// a server that can't write can't keep its promises, so it stops
+	if !sv.syncVote(ctx) {
+		reply.Vote = false
+		return
+	}
+
+	keys := make([]string, len(locked))
+	for i, op := range locked {
+		keys[i] = op.Key
+	}
+	sv.publish(TxnPrepared{EventHeader: serverEventHeader(ctx), Keys: keys})
+}
+
+// would the reply to Commit for ops fit in a message? ops' locks
+// are held, so the values they read can't change before Commit
+// must be called with sv.mu held
+
+func (sv *Server) commitReplyFits(ops []Operation) bool {
+
+	if sv.fits == nil {
+		return true
+	}
+
+	// as Commit applies them, so a Get sees an earlier Set
+	values := make(map[string]interface{})
+	reply := &CommitReply{ReadValues: make(map[string]interface{})}
+	for _, op := range ops {
+		value, written := values[op.Key]
+		if !written {
+			value = sv.store[op.Key].value
+		}
+		if op.IsGet {
+			reply.ReadValues[op.Key] = value
+		} else {
+			values[op.Key] = op.Value
+		}
+	}
+	reply.Reads = len(reply.ReadValues)
+	return sv.fits(reply)
+
 }
 
 // Abort handler
 // This function should abort the given transaction
 // Make sure to release any held locks
 
-func (sv *Server) Abort(args *RPCArgs, reply *struct{}) {
-
-	log.Printf("Abort")
+func (sv *Server) Abort(meta Metadata, args *RPCArgs, reply *struct{}) {
 
-	// log.Printf("Aquiring abort lock")
+	finish, replayed := sv.replies.start("Server.Abort", meta, reply)
+	if replayed {
+		return
+	}
+	defer finish()
+	ctx, span := sv.startSpan(meta, "Server.Abort", args.Tid, PhaseAborted)
+	defer sv.profile(ctx)()
+	defer span.End()
+	sv.runHook(hookBefore, "Server.Abort", args.Tid, meta)
+	defer sv.runHook(hookAfter, "Server.Abort", args.Tid, meta)
+
+	sv.logFor(ctx).Debugf("handling Abort, metadata %v", meta)
+
+	var decided *Decision // published once the lock is released
+	defer func() {
+		if decided != nil {
+			sv.publish(*decided)
+		}
+	}()
 	sv.mu.Lock()
-	// log.Printf("Aquired abort lock")
 
 	defer sv.mu.Unlock()
 
 	tId := args.Tid // get the transaction ID from the args
-	// check if the transaction ID exists in the states map
 
-	if _, exists := sv.states[tId]; !exists || sv.states[tId] == stateAborted {
+	// Kill() already released the locks
+	if sv.killed() {
+		return
+	}
+
+	// never undo a commit
+	// a transaction we have no operations for is still marked aborted, so a
+	// recovering Coordinator can see that the abort was decided
+	state, exists := sv.states[tId]
+	if exists && (state == stateAborted || state == stateCommitted) {
 		return
 
 	}
 
 	// release all locks obtained for the transaction
+	// a No vote already released them, and a Prepare still waiting for
+	// locks releases its own when it sees the abort
+
+	if state == stateVotedYes || state == statePreCommitted {
+		sv.logFor(ctx).Debugf("releasing locks")
+		sv.unlockOps(ctx, sv.operations[tId])
+	}
 
-	log.Printf("Releasing abort locks")
+	sv.states[tId] = stateAborted // set the state to aborted
+	sv.persist(tId)
+	// delete(sv.operations, tId)    // delete the operations for the transaction ID
+	sv.logFor(ctx).Infof("aborted")
+	decided = sv.decisionLocked(ctx, PhaseAborted)
+
+}
+
+// the locks Prepare takes for ops: one per key, a write lock if any
+// operation sets the key, sorted by key so that two Prepares always
+// lock shared keys in the same order and can't deadlock
+
+func lockOrder(ops []Operation) []Operation {
+
+	write := make(map[string]bool)
+	keys := make([]string, 0)
+	for _, op := range ops {
+		if _, seen := write[op.Key]; !seen {
+			keys = append(keys, op.Key)
+		}
+		write[op.Key] = write[op.Key] || !op.IsGet
+	}
+	sort.Strings(keys)
+
+	locks := make([]Operation, 0, len(keys))
+	for _, key := range keys {
+		locks = append(locks, Operation{IsGet: !write[key], Key: key})
+	}
+	return locks
 
-	for _, op := range sv.operations[tId] {
+}
+
+// release the locks taken in Prepare for the ops of ctx's transaction,
+// publishing each
+// the caller must hold them all
+
+func (sv *Server) unlockOps(ctx context.Context, ops []Operation) {
+
+	for _, op := range lockOrder(ops) {
 		item, exist := sv.store[op.Key]
 		if exist {
 			if op.IsGet {
-				log.Printf("Releasing read lock")
+				sv.logFor(ctx).Debugf("releasing read lock on key %s", op.Key)
 				item.lock.RUnlock() // use read unlock for get operation
 			} else {
-				log.Printf("Releasing write lock")
+				sv.logFor(ctx).Debugf("releasing write lock on key %s", op.Key)
 				item.lock.Unlock() // use write unlock for set operation
 			}
+			sv.publish(LockReleased{EventHeader: serverEventHeader(ctx), Key: op.Key, Write: !op.IsGet})
 		}
 	}
 
-	sv.states[tId] = stateAborted // set the state to aborted
-	// delete(sv.operations, tId)    // delete the operations for the transaction ID
-	log.Printf("Transaction %d: server finished aborting", tId) // log the operation
-
 }
 
 // Query handler
@@ -181,12 +453,17 @@ func (sv *Server) Abort(args *RPCArgs, reply *struct{}) {
 
 // This function should reply with information about all known transactions
 
-func (sv *Server) Query(args struct{}, reply *QueryReply) {
+func (sv *Server) Query(meta Metadata, args struct{}, reply *QueryReply) {
 
-	log.Printf("Query")
-	// log.Printf("Aquiring query lock")
+	finish, replayed := sv.replies.start("Server.Query", meta, reply)
+	if replayed {
+		return
+	}
+	defer finish()
+	ctx := withTxn(context.Background(), noTid, phaseQuery)
+	defer sv.profile(ctx)()
+	sv.logFor(ctx).Debugf("handling Query, metadata %v", meta)
 	sv.mu.Lock()
-	// log.Printf("Aquired query lock")
 	defer sv.mu.Unlock()
 
 	reply.Transactions = make(map[int]ServerTransaction)
@@ -210,21 +487,35 @@ func (sv *Server) Query(args struct{}, reply *QueryReply) {
 
 // so there isn't too much to do here
 
-func (sv *Server) PreCommit(args *RPCArgs, reply *struct{}) {
+func (sv *Server) PreCommit(meta Metadata, args *RPCArgs, reply *PreCommitReply) {
 
-	log.Printf("Server: Handling PreCommit for transaction %d", args.Tid)
-	// log.Printf("Aquiring preCommit lock")
+	finish, replayed := sv.replies.start("Server.PreCommit", meta, reply)
+	if replayed {
+		return
+	}
+	defer finish()
+	ctx, span := sv.startSpan(meta, "Server.PreCommit", args.Tid, PhasePreCommit)
+	defer sv.profile(ctx)()
+	defer span.End()
+	sv.runHook(hookBefore, "Server.PreCommit", args.Tid, meta)
+	defer sv.runHook(hookAfter, "Server.PreCommit", args.Tid, meta)
+
+	sv.logFor(ctx).Debugf("handling PreCommit, metadata %v", meta)
 	sv.mu.Lock()
-	// log.Printf("Aquired preCommit lock")
 	defer sv.mu.Unlock()
 
 	tid := args.Tid // get the transaction ID from the args
 	// check if the transaction ID exists in the states map
 	if _, exists := sv.operations[tid]; exists && sv.states[tid] == stateVotedYes {
 		sv.states[tid] = statePreCommitted
+		sv.persist(tid)
 	}
 
-	log.Printf("Server: Finished PreCommit for transaction %d", args.Tid)
+	// only acknowledge a transaction we voted Yes for
+
+	reply.Ack = sv.states[tid] == statePreCommitted || sv.states[tid] == stateCommitted
+
+	sv.logFor(ctx).Debugf("acknowledged %v", reply.Ack)
 
 }
 
@@ -236,17 +527,52 @@ func (sv *Server) PreCommit(args *RPCArgs, reply *struct{}) {
 
 // Make sure to release any held locks
 
-func (sv *Server) Commit(args *RPCArgs, reply *CommitReply) {
+// Applying is idempotent: the committed state is persisted in the same write as
+// the values it set, so a Server that crashed after applying them answers the
+// resent Commit from readValues, and each value carries its key's version, so
+// replaying its log record over a snapshot that already holds it can't roll the key back
+
+func (sv *Server) Commit(meta Metadata, args *RPCArgs, reply *CommitReply) {
 
-	log.Printf("Commit")
-	// log.Printf("Aquiring commit lock")
+	finish, replayed := sv.replies.start("Server.Commit", meta, reply)
+	if replayed {
+		return
+	}
+	defer finish()
+	ctx, span := sv.startSpan(meta, "Server.Commit", args.Tid, PhaseCommitted)
+	defer sv.profile(ctx)()
+	defer span.End()
+	sv.runHook(hookBefore, "Server.Commit", args.Tid, meta)
+	defer sv.runHook(hookAfter, "Server.Commit", args.Tid, meta)
+
+	sv.logFor(ctx).Debugf("handling Commit, metadata %v", meta)
+	var decided *Decision // published once the lock is released
+	defer func() {
+		if decided != nil {
+			sv.publish(*decided)
+		}
+	}()
 	sv.mu.Lock()
-	// log.Printf("Aquired commit lock")
 	defer sv.mu.Unlock()
 
 	tid := args.Tid // get the transaction ID from the args
 	ops, exists := sv.operations[tid]
 	reply.ReadValues = make(map[string]interface{})
+
+	// Kill() already released the locks
+	if sv.killed() {
+		return
+	}
+
+	// a retransmitted Commit gets the same reply as the original
+	if sv.states[tid] == stateCommitted {
+		for k, v := range sv.readValues[tid] {
+			reply.ReadValues[k] = v
+		}
+		reply.Reads = len(reply.ReadValues)
+		return
+	}
+
 	if !exists || sv.states[tid] != statePreCommitted {
 		return
 	}
@@ -258,22 +584,27 @@ func (sv *Server) Commit(args *RPCArgs, reply *CommitReply) {
 
 		if exist {
 			if op.IsGet {
-				reply.ReadValues[op.Key] = item.value                         // get the value for the key
-				log.Printf("Transaction %d: server finished committing", tid) // log the operation
-				item.lock.RUnlock()                                           // use read unlock for get operation
+				reply.ReadValues[op.Key] = item.value // get the value for the key
 
 			} else {
-				item.value = op.Value                                         // set the value for the key
-				log.Printf("Transaction %d: server finished committing", tid) // log the operation
-				item.lock.Unlock()                                            // use write unlock for set operation
+				item.value = op.Value // set the value for the key
+				item.version++
 
 			}
 
 		}
 
 	}
+	sv.unlockOps(ctx, ops)
+	sv.logFor(ctx).Infof("committed")
+	decided = sv.decisionLocked(ctx, PhaseCommitted)
 
 	sv.states[tid] = stateCommitted // set the state to committed
+	sv.readValues[tid] = reply.ReadValues
+	reply.Reads = len(reply.ReadValues)
+	sv.persist(tid)
+	decided.Values, decided.Versions = sv.writeSet(tid)
+	decided.ReadValues = reply.ReadValues
 
 	// delete(sv.operations, tid) // delete the operations for the transaction ID
 
@@ -284,26 +615,33 @@ func (sv *Server) Commit(args *RPCArgs, reply *CommitReply) {
 //
 
 // This function should log a Get operation
+// It returns a *TxnError if the transaction is already past its operations
 
-func (sv *Server) Get(tid int, key string) {
+func (sv *Server) Get(tid int, key string) error {
 
-	log.Printf("Get")
-	// log.Printf("Aquiring get lock")
+	ctx := withTxn(context.Background(), tid, phaseOperations)
+	defer sv.profile(ctx)()
+	sv.logFor(ctx).Debugf("Get %s", key)
 	sv.mu.Lock()
-	// log.Printf("Aquired get lock")
-	log.Printf("Get complete")
 	defer sv.mu.Unlock()
 
+	if err := sv.accepting(ctx, key); err != nil {
+		return err
+	}
+
 	// append the log to the operations
 	sv.operations[tid] = append(sv.operations[tid], Operation{
 		IsGet: true,
 		Key:   key})
+	sv.persist(tid)
 
 	// // if the key doesn't exist yet, create a new state for the key to be set
 	// if _, exists := sv.states[tid]; !exists {
 	// 	sv.states[tid] = stateOperations
 	// }
 
+	return nil
+
 }
 
 // Set
@@ -311,21 +649,27 @@ func (sv *Server) Get(tid int, key string) {
 //
 
 // This function should log a Set operation
+// It returns a *TxnError if the transaction is already past its operations
 
-func (sv *Server) Set(tid int, key string, value interface{}) {
+func (sv *Server) Set(tid int, key string, value interface{}) error {
 
-	log.Printf("Set")
-	// log.Printf("Aquiring set lock")
+	ctx := withTxn(context.Background(), tid, phaseOperations)
+	defer sv.profile(ctx)()
+	sv.logFor(ctx).Debugf("Set %s", key)
 	sv.mu.Lock()
-	// log.Printf("Aquired set lock")
 	defer sv.mu.Unlock()
 
+	if err := sv.accepting(ctx, key); err != nil {
+		return err
+	}
+
 	// append the log to the operations along with the set value
 
 	sv.operations[tid] = append(sv.operations[tid], Operation{
 		IsGet: false,
 		Key:   key,
 		Value: value})
+	sv.persist(tid)
 
 	// if the key doesn't exist yet, create a new state for the key to be set
 	// if _, exists := sv.states[tid]; !exists {
@@ -333,6 +677,340 @@ func (sv *Server) Set(tid int, key string, value interface{}) {
 
 	// }
 
+	return nil
+
+}
+
+// can operations still be added to ctx's transaction? a *TxnError about
+// key if not
+// once Prepare starts locking, the set of operations is fixed:
+// a late operation would be applied or unlocked without its lock
+// nor can operations on a key that moved to another server
+// must be called with sv.mu held
+
+func (sv *Server) accepting(ctx context.Context, key string) error {
+
+	tid, phase := txnOf(ctx)
+	if sv.moved[key] {
+		sv.logFor(ctx).Warnf("ignoring operation, key %s moved", key)
+		return &TxnError{Tid: tid, Phase: phase, Participant: -1, Key: key, Err: ErrKeyMoved}
+	}
+	if _, preparing := sv.preparing[tid]; preparing {
+		sv.logFor(ctx).Warnf("ignoring operation, already preparing")
+		return &TxnError{Tid: tid, Phase: phase, Participant: -1, Key: key, Err: ErrTooLate}
+	}
+	if state, exists := sv.states[tid]; exists && state != stateOperations {
+		sv.logFor(ctx).Warnf("ignoring operation, already past Prepare")
+		return &TxnError{Tid: tid, Phase: phase, Participant: -1, Key: key, Err: ErrTooLate}
+	}
+	return nil
+
+}
+
+// save the store, the logged operations and the transaction states to
+// stable storage, where they can later be retrieved after a crash and restart.
+// tid is the transaction that just changed
+// must be called with sv.mu held
+
+func (sv *Server) persist(tid int) {
+
+	if sv.maxstate < 0 {
+		sv.persister.Save(sv.encodeState())
+		return
+	}
+
+	// log just this transaction, and fold the log into a new
+	// snapshot once it grows past maxstate
+
+	record := logRecord{
+		Tid:        tid,
+		Operations: sv.operations[tid],
+		ReadValues: sv.readValues[tid],
+	}
+	record.State, record.HasState = sv.states[tid]
+	if record.State == stateCommitted {
+		record.Committed = time.Now().UnixNano()
+		record.Values, record.Versions = sv.writeSet(tid)
+		record.Sum = valuesSum(record.Values, record.Versions)
+	}
+	sv.log = append(sv.log, record)
+
+	state := sv.encodeLog()
+	if len(state) > sv.maxstate {
+		sv.checkpointLocked()
+		return
+	}
+	sv.persister.Save(state)
+
+}
+
+// the values a committed transaction set, and the keys' versions
+// must be called with sv.mu held
+
+func (sv *Server) writeSet(tid int) (map[string]interface{}, map[string]int) {
+
+	values := make(map[string]interface{})
+	versions := make(map[string]int)
+	for _, op := range sv.operations[tid] {
+		if item, exists := sv.store[op.Key]; exists && !op.IsGet {
+			values[op.Key] = item.value
+			versions[op.Key] = item.version
+		}
+	}
+	return values, versions
+
+}
+
+// everything a Server knows: the whole persisted state without
+// snapshots, or the snapshot with them
+
+func (sv *Server) encodeState() []byte {
+
+	saved := &savedState{
+		values:     make(map[string]interface{}),
+		operations: sv.operations,
+		states:     sv.states,
+		readValues: sv.readValues,
+		versions:   make(map[string]int),
+	}
+	for key, item := range sv.store {
+		saved.values[key] = item.value
+		saved.versions[key] = item.version
+	}
+	saved.sum, saved.hasSum = valuesSum(saved.values, saved.versions), true
+	return saved.encode()
+
+}
+
+// one checksummed record after another, so a longer log starts with
+// the bytes of a shorter one, and a write torn while appending a
+// record leaves the records before it readable; see wal.go
+
+func (sv *Server) encodeLog() []byte {
+
+	fw := newFrameWriter()
+	for _, record := range sv.log {
+		fw.encode(record)
+	}
+	return fw.bytes()
+
+}
+
+// restore previously persisted state
+
+//
+
+// Transactions that voted Yes before the crash still hold their locks, so
+
+// the locks are re-acquired here before the server starts handling RPCs
+
+func (sv *Server) readPersist(state []byte, snapshot []byte, deltas []byte) {
+
+	if sv.maxstate < 0 {
+		sv.readState(state)
+	} else {
+		// the snapshot, then the deltas written since, then the
+		// changes logged since those
+		sv.readState(snapshot)
+		sv.readDeltas(snapshot, deltas)
+		sv.readLog(state)
+	}
+
+	sv.relockInDoubt()
+
+}
+
+// rebuild the lock table from the persisted transaction states: each
+// in-doubt transaction takes the read or write locks it held before,
+// so a Prepare that arrives after the restart still waits for it.
+// in-doubt transactions never conflict, since each got its locks while
+// the others held theirs; if the persisted state says they do, it's
+// damaged, and waiting here would hang the restart, so we stop
+
+func (sv *Server) relockInDoubt() {
+
+	holders := make(map[string]int) // key : an in-doubt transaction holding its lock
+	for tid, state := range sv.states {
+		if state != stateVotedYes && state != statePreCommitted {
+			continue
+		}
+
+		for _, op := range lockOrder(sv.operations[tid]) {
+			item, exist := sv.store[op.Key]
+			if !exist {
+				continue
+			}
+
+			locked := false
+			if op.IsGet {
+				locked = item.lock.TryRLock()
+			} else {
+				locked = item.lock.TryLock()
+			}
+			if !locked {
+				log.Fatalf("Server: persisted state has in-doubt transactions %d and %d both locking key %s", holders[op.Key], tid, op.Key)
+			}
+			holders[op.Key] = tid
+		}
+
+		sv.logFor(withTxn(context.Background(), tid, phaseRecovery)).Infof("re-acquired locks for in-doubt transaction")
+	}
+
+}
+
+func (sv *Server) readState(data []byte) {
+
+	if len(data) < 1 { // bootstrap without any state
+		return
+	}
+
+	saved, err := decodeState(data)
+	if err != nil {
+		log.Fatalf("Server: %v", err)
+	}
+	if saved.hasSum && valuesSum(saved.values, saved.versions) != saved.sum {
+		sv.degrade(errors.New("the snapshot's values don't match its checksum"))
+	}
+
+	for key, value := range saved.values {
+		if item, exists := sv.store[key]; exists {
+			item.value = value
+			item.version = saved.versions[key]
+		}
+	}
+	for tid, ops := range saved.operations {
+		sv.operations[tid] = ops
+	}
+	for tid, state := range saved.states {
+		sv.states[tid] = state
+	}
+	for tid, values := range saved.readValues {
+		sv.readValues[tid] = values
+	}
+
+}
+
+// what encodeState() saves
+
+type savedState struct {
+	values     map[string]interface{}
+	operations map[int][]Operation
+	states     map[int]TransactionState
+	readValues map[int]map[string]interface{}
+	versions   map[string]int
+	sum        uint32 // valuesSum() of values and versions, if hasSum; see selfcheck.go
+	hasSum     bool
+}
+
+func (saved *savedState) encode() []byte {
+
+	w := new(bytes.Buffer)
+	e := labgob.NewEncoder(w)
+	e.Encode(saved.values)
+	e.Encode(saved.operations)
+	e.Encode(saved.states)
+	e.Encode(saved.readValues)
+	e.Encode(saved.versions)
+	if saved.hasSum {
+		e.Encode(saved.sum)
+	}
+	return w.Bytes()
+
+}
+
+func decodeState(data []byte) (*savedState, error) {
+
+	r := bytes.NewBuffer(data)
+	d := labgob.NewDecoder(r)
+	saved := &savedState{}
+	if d.Decode(&saved.values) != nil ||
+		d.Decode(&saved.operations) != nil ||
+		d.Decode(&saved.states) != nil ||
+		d.Decode(&saved.readValues) != nil {
+		return nil, errors.New("failed to decode persisted state")
+	}
+	// state saved before keys had versions has none
+	if r.Len() > 0 && d.Decode(&saved.versions) != nil {
+		return nil, errors.New("failed to decode persisted versions")
+	}
+	// nor a checksum before those, nor does a delta have one
+	if r.Len() > 0 {
+		if d.Decode(&saved.sum) != nil {
+			return nil, errors.New("failed to decode the persisted checksum")
+		}
+		saved.hasSum = true
+	}
+	return saved, nil
+
+}
+
+// replay the changes logged since the last snapshot, in order
+
+//
+
+// a record cut short by a torn write, or failing its checksum, is
+
+// dropped; the server never replied to the request that wrote it, so
+
+// it's as if it never arrived. a log damaged before its last record
+
+// has lost records the server acted on, so the server refuses to start
+
+func (sv *Server) readLog(data []byte) {
+
+	if len(data) < 1 {
+		return
+	}
+
+	ctx := withTxn(context.Background(), noTid, phaseRecovery)
+	framed, torn, err := readFrames(data)
+	if err != nil {
+		log.Fatalf("Server: %v", err)
+	}
+	if torn > 0 {
+		sv.logFor(ctx).Warnf("dropping a torn log record, %d bytes", torn)
+	}
+
+	r := bytes.NewBuffer(framed)
+	d := labgob.NewDecoder(r)
+	var records []logRecord
+	for r.Len() > 0 {
+		var record logRecord
+		if err := d.Decode(&record); err != nil {
+			log.Fatalf("Server: a log record passed its checksum but can't be decoded: %v", err)
+		}
+		records = append(records, record)
+	}
+
+	for _, record := range records {
+		if len(record.Operations) > 0 {
+			sv.operations[record.Tid] = record.Operations
+		}
+		if record.HasState {
+			sv.states[record.Tid] = record.State
+		}
+		if record.ReadValues != nil {
+			sv.readValues[record.Tid] = record.ReadValues
+		}
+		for key, value := range record.Values {
+			item, exists := sv.store[key]
+			if !exists {
+				continue
+			}
+			// the snapshot already holds this value, or a later one
+			version, versioned := record.Versions[key]
+			if versioned && version <= item.version {
+				continue
+			}
+			item.value = value
+			if versioned {
+				item.version = version
+			}
+		}
+	}
+	sv.log = records
+	sv.checkLog(records)
+
 }
 
 // Initialize new Server
@@ -341,14 +1019,59 @@ func (sv *Server) Set(tid int, key string, value interface{}) {
 
 // keys is a slice of the keys that this server is responsible for storing
 
-func MakeServer(keys []string) *Server {
+// persister holds the state saved by a previous instance of this server, if any
+
+func MakeServer(keys []string, persister *Persister) *Server {
+	return MakeServerWithSnapshots(keys, persister, -1)
+
+}
+
+// Like MakeServer, but persist each change by appending it to a log, and
+
+// replace the log with a snapshot of the whole state once it grows past
+
+// maxstate bytes
+
+func MakeServerWithSnapshots(keys []string, persister *Persister, maxstate int) *Server {
+	return makeServer(keys, persister, maxstate, stdLogger("server"))
+
+}
+
+// Like MakeServerWithSnapshots, but lines are logged to logger, e.g. one
+// made by NewLogger() or an adapter to another logging library; nil means
+// MakeServer's logger, which only shows warnings
+
+func MakeServerWithLogger(keys []string, persister *Persister, maxstate int, logger Logger) *Server {
+	if logger == nil {
+		logger = stdLogger("server")
+	}
+	return makeServer(keys, persister, maxstate, logger)
+
+}
+
+// Like MakeServerWithLogger, for the tester
+
+func makeServer(keys []string, persister *Persister, maxstate int, logger Logger) *Server {
 
 	sv := &Server{
 		// Initialize fields here
 		store:      make(map[string]*StoreItem),
+		persister:  persister,
 		operations: make(map[int][]Operation),
 		states:     make(map[int]TransactionState),
+		readValues: make(map[int]map[string]interface{}),
+		preparing:  make(map[int]chan struct{}),
+		maxstate:   maxstate,
+		logger:     logger,
+		replies:    makeReplyCache(),
+		contention: make(map[string]*KeyContention),
+		blocked:    make(map[int]Operation),
+		tracer:     defaultTracer(),
+		moved:      make(map[string]bool),
+		done:       make(chan struct{}),
 	}
+	sv.SetRedaction(redactionFromEnv())
+	sv.SetDurability(DurabilitySync)
 
 	// Initialize the store with the keys
 	for _, key := range keys {
@@ -358,6 +1081,270 @@ func MakeServer(keys []string) *Server {
 
 	}
 
+	// initialize from state persisted before a crash
+	sv.readPersist(persister.ReadServerState(), persister.ReadSnapshot(), persister.ReadDeltas())
+
 	return sv
 
 }
+
+// The tester calls Kill() when it crashes a Server, just like the Coordinator
+
+// A killed Server is usually already detached from the network, but a
+
+// Prepare may still be waiting for a lock that an undecided transaction of
+
+// this instance holds. Kill() releases those locks so every such Prepare can
+
+// return; handlers that run afterwards give their locks back and ignore
+
+// Commit and Abort
+
+func (sv *Server) Kill() {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	// a second Kill() mustn't release the locks again
+	if sv.killed() {
+		return
+	}
+	atomic.StoreInt32(&sv.dead, 1)
+	close(sv.done)
+	for tid, state := range sv.states {
+		if state == stateVotedYes || state == statePreCommitted {
+			sv.unlockOps(withTxn(context.Background(), tid, ""), sv.operations[tid])
+		}
+	}
+
+}
+
+// Prepare handlers still running, for the tester to check that none
+
+// outlive Kill()
+
+func (sv *Server) runningPrepares() int {
+	return int(atomic.LoadInt32(&sv.prepares))
+
+}
+
+// run f on a goroutine the tester can check doesn't outlive Kill()
+
+func (sv *Server) spawn(f func()) {
+	atomic.AddInt32(&sv.running, 1)
+	go func() {
+		defer atomic.AddInt32(&sv.running, -1)
+		f()
+	}()
+
+}
+
+func (sv *Server) goroutines() int {
+	return int(atomic.LoadInt32(&sv.running))
+
+}
+
+// wait for d, or until Kill(); false if the Server was killed
+
+func (sv *Server) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return !sv.killed()
+	case <-sv.done:
+		return false
+	}
+
+}
+
+func (sv *Server) killed() bool {
+	z := atomic.LoadInt32(&sv.dead)
+	return z == 1
+
+}
+
+// a copy of the store's current values, so the tester can check
+// them without going through a transaction
+
+func (sv *Server) storeValues() map[string]interface{} {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	values := make(map[string]interface{}, len(sv.store))
+	for key, item := range sv.store {
+		values[key] = item.value
+	}
+	return values
+}
+
+// the keys this server stores, sorted, so that a client can tell
+// which server to send a key's operations to
+
+func (sv *Server) keys() []string {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	keys := make([]string, 0, len(sv.store))
+	for key := range sv.store {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// the keys whose lock some transaction holds, for the tester; only
+// meaningful while no Prepare or Commit is running
+
+func (sv *Server) heldLocks() []string {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	held := make([]string, 0)
+	for key, item := range sv.store {
+		if !item.lock.TryLock() {
+			held = append(held, key)
+			continue
+		}
+		item.lock.Unlock()
+	}
+	sort.Strings(held)
+	return held
+}
+
+// whether the server has operations or a state for tid, so that a
+// client handing out tids can skip it
+
+func (sv *Server) hasTid(tid int) bool {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	_, hasState := sv.states[tid]
+	_, hasOperations := sv.operations[tid]
+	return hasState || hasOperations
+}
+
+// the transactions that voted Yes and haven't been decided, for the
+// tester
+
+func (sv *Server) undecided() []int {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	tids := make([]int, 0)
+	for tid, state := range sv.states {
+		if state == stateVotedYes || state == statePreCommitted {
+			tids = append(tids, tid)
+		}
+	}
+	sort.Ints(tids)
+	return tids
+}
+
+// who holds one key's lock, as seen by lockTable()
+
+type keyLocks struct {
+	locked    bool  // someone holds the lock
+	readers   []int // undecided transactions that voted Yes and read the key
+	writers   []int // undecided transactions that voted Yes and set the key
+	preparing bool  // a running Prepare may hold or be waiting for the lock
+}
+
+// a snapshot of every key's lock and the transactions that should
+// hold it, for the tester's invariant checker; empty once killed, since
+// Kill() releases the locks but keeps the votes
+
+func (sv *Server) lockTable() map[string]*keyLocks {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	if sv.killed() {
+		return nil
+	}
+
+	table := make(map[string]*keyLocks, len(sv.store))
+	for key, item := range sv.store {
+		locks := &keyLocks{locked: !item.lock.TryLock()}
+		if !locks.locked {
+			item.lock.Unlock()
+		}
+		table[key] = locks
+	}
+
+	for tid, state := range sv.states {
+		if state != stateVotedYes && state != statePreCommitted {
+			continue
+		}
+		for _, op := range lockOrder(sv.operations[tid]) {
+			if locks, exists := table[op.Key]; exists {
+				if op.IsGet {
+					locks.readers = append(locks.readers, tid)
+				} else {
+					locks.writers = append(locks.writers, tid)
+				}
+			}
+		}
+	}
+
+	for tid := range sv.preparing {
+		for _, op := range sv.operations[tid] {
+			if locks, exists := table[op.Key]; exists {
+				locks.preparing = true
+			}
+		}
+	}
+	return table
+}
+
+// the state of a transaction, for the tester to report when the transaction
+// never finishes
+
+func (sv *Server) transactionState(tid int) (TransactionState, bool) {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	state, exists := sv.states[tid]
+	return state, exists
+
+}
+
+// run the tester's hook, if it set one, at point in a handler
+
+func (sv *Server) runHook(point hookPoint, method string, tid int, meta Metadata) {
+	sv.mu.Lock()
+	hook := sv.hook
+	sv.mu.Unlock()
+
+	if hook != nil {
+		hook(point, method, tid, meta)
+	}
+
+}
+
+func (sv *Server) setHook(hook handlerHook) {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	sv.hook = hook
+
+}
+
+// tell the server how to check that a reply fits within the
+// message size limit of the transport serving it
+
+func (sv *Server) setMessageFits(fits func(msg interface{}) bool) {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	sv.fits = fits
+
+}
+
+// how many per-transaction entries the server keeps, for the tester
+// to watch them grow
+
+func (sv *Server) transactionRecords() int {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	return len(sv.operations) + len(sv.states) + len(sv.readValues)
+}
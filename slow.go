@@ -0,0 +1,152 @@
+package commit
+
+//
+// warnings about transactions stuck in a phase, so a wedged commit
+// is noticed while it's still wedged rather than when a test times
+// out:
+//
+//   co.WarnSlow(5 * time.Second)
+//   co.OnSlow(func(s SlowTransaction) {
+//       alert("transaction %d in %s for %v, waiting for %v", s.Tid, s.Phase, s.InPhase, s.Waiting)
+//   })
+//
+// once a transaction has been in one phase for the threshold, the
+// Coordinator logs a warning and publishes a SlowTransaction event
+// (events.go), which OnSlow functions get, and does so again each
+// time another threshold passes in that phase.
+// the warning names the servers the phase is waiting on: those
+// sent the phase's message without an answer yet, or whose last
+// try failed. a transaction's phase is timed on the Coordinator's
+// clock, which is checked every threshold/4, or 100ms if that's
+// sooner.
+//
+// a transaction stops being watched when its outcome is reported,
+// although an Abort may still be retrying to an unreachable server.
+//
+
+import (
+	"context"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+type SlowTransaction struct {
+	EventHeader
+	Trace   string
+	InPhase time.Duration // on the Coordinator's clock
+	Waiting []int         // servers that haven't answered the phase's message
+	Methods []string      // the message each of Waiting hasn't answered
+}
+
+// the longest the watchdog sleeps between checks
+const slowCheckInterval = 100 * time.Millisecond
+
+// warn about transactions that stay in one phase for threshold or
+// longer; 0 stops the warnings.
+func (co *Coordinator) WarnSlow(threshold time.Duration) {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+
+	co.slowThreshold = threshold
+	if threshold > 0 && !co.slowWatching {
+		co.slowWatching = true
+		atomic.AddInt32(&co.watchdog, 1)
+		co.spawn(co.watchSlow)
+	}
+}
+
+// call f with each warning about a slow transaction. f runs on the
+// watchdog's goroutine, without the Coordinator's lock held, so it
+// shouldn't block for long.
+func (co *Coordinator) OnSlow(f func(SlowTransaction)) {
+	co.Subscribe(func(e Event) {
+		if s, ok := e.(SlowTransaction); ok {
+			f(s)
+		}
+	})
+}
+
+func (co *Coordinator) watchSlow() {
+	defer atomic.AddInt32(&co.watchdog, -1)
+
+	for !co.killed() {
+		co.mu.Lock()
+		interval := min(co.slowThreshold/4, slowCheckInterval)
+		co.mu.Unlock()
+		time.Sleep(max(interval, time.Millisecond))
+
+		for _, s := range co.slowTransactions() {
+			co.logFor(withTxn(context.Background(), s.Tid, s.Phase)).Warnf("in %s for %v, waiting for servers %v", s.Phase, s.InPhase, s.Waiting)
+			co.publish(s)
+		}
+	}
+}
+
+// the transactions that have passed another threshold in their
+// phase since the last check.
+func (co *Coordinator) slowTransactions() []SlowTransaction {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+
+	if co.slowThreshold <= 0 {
+		return nil
+	}
+	var slow []SlowTransaction
+	now := co.clock.Now()
+	for tid, tran := range co.tran {
+		in := now.Sub(tran.phaseStart)
+		if tran.done || in < co.slowThreshold*time.Duration(tran.warnings+1) {
+			continue
+		}
+		tran.warnings = int(in / co.slowThreshold)
+		s := SlowTransaction{EventHeader: EventHeader{Tid: tid, Phase: tran.Phase, Time: now}, Trace: tran.Trace, InPhase: in}
+		for server := range tran.waiting {
+			s.Waiting = append(s.Waiting, server)
+		}
+		sort.Ints(s.Waiting)
+		for _, server := range s.Waiting {
+			s.Methods = append(s.Methods, tran.waiting[server])
+		}
+		slow = append(slow, s)
+	}
+	sort.Slice(slow, func(i, j int) bool { return slow[i].Tid < slow[j].Tid })
+	return slow
+}
+
+// the Coordinator's goroutines other than the watchdog and the
+// reporter, which run until Kill(), e.g. to tell when recovery has
+// finished.
+func (co *Coordinator) working() int {
+	return co.goroutines() - int(atomic.LoadInt32(&co.watchdog))
+}
+
+// call method on server about tid, noting that server owes tid an
+// answer until a call succeeds. it waits while a migration holds
+// method to server; see migrate.go.
+func (co *Coordinator) call(server int, method string, meta Metadata, tid int, args interface{}, reply interface{}) error {
+	co.mu.Lock()
+	co.waitMigrationLocked(server, method)
+	if tran, exists := co.tran[tid]; exists {
+		if tran.waiting == nil {
+			tran.waiting = make(map[int]string)
+		}
+		tran.waiting[server] = method
+	}
+	co.inflight[server]++
+	co.mu.Unlock()
+
+	co.counts.rpcs.Add(1)
+	err := co.server(server).CallErr("Server."+method, meta, args, reply)
+	co.mu.Lock()
+	co.inflight[server]--
+	co.migrated.Broadcast()
+	if err != nil {
+		co.counts.failed(err)
+	} else if tran, exists := co.tran[tid]; exists {
+		delete(tran.waiting, server)
+		co.answeredLocked(tran, server, method)
+	}
+	co.mu.Unlock()
+	return err
+}
@@ -0,0 +1,98 @@
+package commit
+
+import (
+	"3PhaseCommit/labrpc"
+	"testing"
+	"time"
+)
+
+// a PeerClient whose calls to method wait until release is closed.
+type stallingPeer struct {
+	PeerClient
+	method  string
+	release chan struct{}
+}
+
+func (p *stallingPeer) CallErr(svcMeth string, meta Metadata, args interface{}, reply interface{}) error {
+	if svcMeth == p.method {
+		<-p.release
+	}
+	return p.PeerClient.CallErr(svcMeth, meta, args, reply)
+}
+
+// Stalls a transaction's PreCommit to server 1 while moving a simulated clock past the slow threshold
+// Each threshold passed should bring one warning naming PreCommit and server 1, and none
+// should come once the transaction has committed
+func TestSlowTransactions(t *testing.T) {
+	t.Parallel()
+
+	net := labrpc.MakeNetwork()
+	defer net.Cleanup()
+	tr := makeLabrpcTransport(net)
+	release := make(chan struct{})
+	var peers []PeerClient
+	for i, key := range []string{"x", "y"} {
+		sv := MakeServer([]string{key}, MakePersister())
+		defer sv.Kill()
+		name := []string{"server0", "server1"}[i]
+		tr.Serve(name, sv)
+		end, _ := tr.Dial(name)
+		if i == 1 {
+			end = &stallingPeer{PeerClient: end, method: "Server.PreCommit", release: release}
+		}
+		peers = append(peers, end)
+		sv.Set(0, key, i)
+	}
+	clock := MakeSimClock()
+	respChan := make(chan ResponseMsg)
+	co := makeCoordinator(peers, respChan, clock, phaseTimeout, stdLogger("coordinator"))
+	defer co.Kill()
+	warnings := make(chan SlowTransaction, 10)
+	co.OnSlow(func(s SlowTransaction) { warnings <- s })
+	co.WarnSlow(time.Second)
+
+	co.FinishTransaction(0)
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		co.mu.Lock()
+		waiting := co.tran[0].waiting[1]
+		co.mu.Unlock()
+		if waiting == "PreCommit" {
+			break
+		}
+		if time.Since(start) > waitTimeout {
+			t.Fatalf("PreCommit never reached server 1")
+		}
+	}
+
+	for n := 1; n <= 2; n++ {
+		clock.Advance(time.Second)
+		select {
+		case s := <-warnings:
+			if s.Tid != 0 || s.Phase != PhasePreCommit || s.InPhase != time.Duration(n)*time.Second {
+				t.Fatalf("expected warning %d about transaction 0 in PreCommit for %ds, got %+v", n, n, s)
+			}
+			if len(s.Waiting) != 1 || s.Waiting[0] != 1 || s.Methods[0] != "PreCommit" {
+				t.Fatalf("expected transaction 0 to wait only for server 1's PreCommit, got %+v", s)
+			}
+		case <-time.After(waitTimeout):
+			t.Fatalf("no warning %d within %v", n, waitTimeout)
+		}
+	}
+
+	close(release)
+	select {
+	case m := <-respChan:
+		if !m.committed {
+			t.Fatalf("expected transaction 0 to commit, got %+v", m)
+		}
+	case <-time.After(waitTimeout):
+		t.Fatalf("Transaction 0 got no response within %v", waitTimeout)
+	}
+	clock.Advance(time.Minute)
+	time.Sleep(4 * slowCheckInterval)
+	select {
+	case s := <-warnings:
+		t.Fatalf("expected no warning after the commit, got %+v", s)
+	default:
+	}
+}
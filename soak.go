@@ -0,0 +1,193 @@
+package commit
+
+//
+// a long-running soak test for the 3PC tester, to surface slow
+// leaks that short tests miss.
+//
+// go test -run TestSoak -long -soaktime 2h -timeout 3h
+//
+// clients run a random workload (see workload.go) until the time
+// is up. every sampling period the soak lets the transactions in
+// flight finish, holds back new ones, and checks that:
+//
+//   - no server still holds a lock,
+//   - every server's store, read directly, matches what a read
+//     transaction returns, and every group adds up,
+//   - the heap grows by at most soakHeapPerTxn per transaction.
+//
+// each sample prints a line with the transaction rate, heap,
+// servers' per-transaction records and goroutines, so a slow
+// leak shows up as a number that keeps climbing. the coordinator
+// and servers log a summary each period too (report.go).
+//
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// servers keep a record of every transaction for recovery, and
+// the tester keeps its history, so the heap does grow; a leak
+// grows it faster than this.
+const soakHeapPerTxn = 64 * 1024
+
+type soakSample struct {
+	at         time.Time
+	txns       int64
+	heap       uint64
+	records    int
+	goroutines int
+}
+
+// run a random workload for d, sampling invariants every period.
+func (cfg *config) soak(d time.Duration, period time.Duration) {
+	w := cfg.makeWorkload()
+	fmt.Printf("  ... soak: %v\n", w)
+
+	cfg.mu.Lock()
+	cfg.duplicates = true // lost responses are resent
+	// summaries in the log (LOG=1) between samples
+	cfg.coordinator.ReportEvery(period)
+	for _, sv := range cfg.servers {
+		if sv != nil {
+			sv.ReportEvery(period)
+		}
+	}
+	cfg.mu.Unlock()
+
+	for _, group := range w.groups {
+		cfg.workloadTxn(w, group, false, true)
+	}
+
+	// clients hold gate for reading while running a transaction,
+	// so the sampler can wait for a quiet moment.
+	var gate sync.RWMutex
+	var txns atomic.Int64
+	deadline := time.Now().Add(d)
+
+	var wg sync.WaitGroup
+	for range w.clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				cfg.mu.Lock()
+				group := w.groups[cfg.randIntLocked()%len(w.groups)]
+				kind := cfg.randIntLocked() % 100
+				cfg.mu.Unlock()
+
+				gate.RLock()
+				cfg.workloadTxn(w, group, kind < w.readPct+w.mixedPct, kind >= w.readPct)
+				gate.RUnlock()
+				txns.Add(1)
+			}
+		}()
+	}
+
+	first := cfg.soakSample(w, &gate, &txns)
+	for time.Now().Before(deadline) {
+		time.Sleep(min(period, time.Until(deadline)))
+		cfg.soakSample(w, &gate, &txns).check(cfg, first)
+	}
+	wg.Wait()
+	cfg.soakSample(w, &gate, &txns).check(cfg, first)
+}
+
+// pause the clients, check the invariants, and measure.
+func (cfg *config) soakSample(w workload, gate *sync.RWMutex, txns *atomic.Int64) soakSample {
+	gate.Lock()
+	defer gate.Unlock()
+
+	cfg.checkNoLocks(time.Second)
+	cfg.checkStoresMatchReads(w)
+
+	runtime.GC()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	s := soakSample{
+		at:         time.Now(),
+		txns:       txns.Load(),
+		heap:       mem.HeapAlloc,
+		goroutines: runtime.NumGoroutine(),
+	}
+	cfg.mu.Lock()
+	for _, sv := range cfg.servers {
+		if sv != nil {
+			s.records += sv.transactionRecords()
+		}
+	}
+	cfg.mu.Unlock()
+	return s
+}
+
+// print the sample, and fail if the heap grew too fast since first.
+func (s soakSample) check(cfg *config, first soakSample) {
+	ntxns := max(s.txns-first.txns, 1)
+	perTxn := (int64(s.heap) - int64(first.heap)) / ntxns
+	fmt.Printf("  ... soak %v: %d txns (%.0f/s), heap %d KB (%+d B/txn), %d records (%.1f/txn), %d goroutines\n",
+		s.at.Sub(first.at).Round(time.Second), s.txns, float64(s.txns-first.txns)/s.at.Sub(first.at).Seconds(),
+		s.heap/1024, perTxn, s.records, float64(s.records-first.records)/float64(ntxns), s.goroutines)
+
+	if ntxns >= 1000 && perTxn > soakHeapPerTxn {
+		cfg.t.Fatalf("soak: heap grew by %d bytes per transaction over %d transactions; expected at most %d",
+			perTxn, ntxns, soakHeapPerTxn)
+	}
+}
+
+// no transaction is running, so once the last Commits and Aborts
+// arrive no server should hold a lock.
+func (cfg *config) checkNoLocks(wait time.Duration) {
+	deadline := time.Now().Add(wait)
+	for {
+		held := make(map[int][]string)
+		cfg.mu.Lock()
+		for i, sv := range cfg.servers {
+			if sv == nil {
+				continue
+			}
+			if keys := sv.heldLocks(); len(keys) > 0 {
+				held[i] = keys
+			}
+		}
+		cfg.mu.Unlock()
+
+		if len(held) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			cfg.t.Fatalf("locks still held with no transaction running: %v", held)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// read every group through a transaction, and compare with the
+// servers' stores read directly.
+func (cfg *config) checkStoresMatchReads(w workload) {
+	read := make(map[string]interface{})
+	for _, group := range w.groups {
+		for key, v := range cfg.workloadTxn(w, group, true, false) {
+			read[key] = v
+		}
+	}
+
+	cfg.mu.Lock()
+	servers := append([]*Server(nil), cfg.servers...)
+	cfg.mu.Unlock()
+
+	for i, sv := range servers {
+		if sv == nil {
+			continue
+		}
+		for key, v := range sv.storeValues() {
+			if !reflect.DeepEqual(read[key], v) {
+				cfg.t.Fatalf("server %d stores %v for key %s, but a transaction read %v", i, v, key, read[key])
+			}
+		}
+	}
+}
@@ -0,0 +1,435 @@
+package commit
+
+//
+// a Transport over TCP with net/rpc, for servers and coordinators
+// on separate machines:
+//
+//   t := MakeTCPTransport()
+//   l, err := t.Listen(":7000", sv)                // on each server
+//   co, err := DialCoordinator(t, addrs, respChan) // on the coordinator
+//
+// each PeerClient keeps a pool of connections, which it takes in
+// turn; each is dialled on its first use and again after it breaks
+// or fails a health check, e.g. because the server restarted, with
+// backoff after failed dials (see PoolConfig). SetPool() changes
+// the pool of the PeerClients dialled later. a call gives up and
+// returns false after
+// tcpCallTimeout, like a request lost by labrpc, and the
+// Coordinator retries it as usual. a call's Metadata travels in
+// the request alongside its args. MakeTCPTransportTLS() encrypts
+// the connections; see tls.go. SetCodec() encodes the messages
+// with a codec.Codec in place of net/rpc's gob; see codec.go.
+// SetMaxMessageSize() refuses requests and replies over a limit,
+// framing messages as SetCodec() does, with gob if no codec is set,
+// so servers and coordinators must agree on it.
+//
+
+import (
+	"3PhaseCommit/codec"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+const (
+	tcpDialTimeout = time.Second
+	tcpCallTimeout = 5 * time.Second
+)
+
+type TCPTransport struct {
+	network    string // "tcp", or "unix" for a UnixTransport
+	tls        TransportTLS
+	pool       PoolConfig
+	codec      codec.Codec // nil for net/rpc's gob
+	maxMessage int         // the most bytes in a request or reply; 0 for no limit
+}
+
+func MakeTCPTransport() *TCPTransport {
+	return &TCPTransport{network: "tcp", pool: DefaultPoolConfig()}
+}
+
+// like MakeTCPTransport, but with TLS on every connection.
+func MakeTCPTransportTLS(tlsCfg TransportTLS) *TCPTransport {
+	return &TCPTransport{network: "tcp", tls: tlsCfg, pool: DefaultPoolConfig()}
+}
+
+func (tt *TCPTransport) SetPool(pc PoolConfig) {
+	tt.pool = pc
+}
+
+// encode the messages of later Listens and Dials with c.
+func (tt *TCPTransport) SetCodec(c codec.Codec) {
+	tt.codec = c
+}
+
+// refuse the requests and replies of later Listens and Dials that
+// take more than n bytes once encoded; 0 lifts the limit.
+func (tt *TCPTransport) SetMaxMessageSize(n int) {
+	tt.maxMessage = n
+}
+
+// what messages are encoded with; nil for net/rpc's own gob stream.
+func (tt *TCPTransport) wireCodec() codec.Codec {
+	if tt.codec == nil && tt.maxMessage > 0 {
+		// net/rpc's gob stream can't be limited message by message
+		return codec.Gob
+	}
+	return tt.codec
+}
+
+// a Server's handlers, listening on a TCP address.
+type TCPListener struct {
+	ln         net.Listener
+	codec      codec.Codec
+	maxMessage int
+
+	mu     sync.Mutex
+	conns  map[net.Conn]bool // open connections, closed by Close()
+	closed bool
+}
+
+// listen on addr, e.g. ":7000", or "127.0.0.1:0" for any free port,
+// and serve sv's handlers to each connection.
+func (tt *TCPTransport) Listen(addr string, sv *Server) (*TCPListener, error) {
+	rs := rpc.NewServer()
+	if err := rs.RegisterName("Server", &tcpHandlers{sv}); err != nil {
+		return nil, err
+	}
+
+	ln, err := net.Listen(tt.network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if tt.tls.Server != nil {
+		ln = tls.NewListener(ln, tt.tls.Server)
+	}
+
+	if c, max := tt.wireCodec(), tt.maxMessage; max > 0 {
+		sv.setMessageFits(func(msg interface{}) bool {
+			b, err := c.Marshal(msg)
+			return err == nil && len(b) <= max
+		})
+	}
+
+	l := &TCPListener{ln: ln, codec: tt.wireCodec(), maxMessage: tt.maxMessage, conns: make(map[net.Conn]bool)}
+	go l.accept(rs)
+	return l, nil
+}
+
+func (tt *TCPTransport) Serve(addr string, sv *Server) (io.Closer, error) {
+	return tt.Listen(addr, sv)
+}
+
+func (tt *TCPTransport) Dial(addr string) (PeerClient, error) {
+	p := &tcpPeer{
+		network:    tt.network,
+		addr:       addr,
+		tls:        tt.tls.Client,
+		pool:       tt.pool,
+		codec:      tt.wireCodec(),
+		maxMessage: tt.maxMessage,
+		conns:      make([]*rpc.Client, max(tt.pool.Size, 1)),
+		done:       make(chan struct{}),
+	}
+	if tt.pool.HealthInterval > 0 {
+		go p.checkHealth()
+	}
+	return p, nil
+}
+
+// the address l listens on, with the port filled in.
+func (l *TCPListener) Addr() string {
+	return l.ln.Addr().String()
+}
+
+// the number of connections l has open.
+func (l *TCPListener) openConns() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.conns)
+}
+
+// stop listening, and close every connection, so that their
+// clients dial again.
+func (l *TCPListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.closed = true
+	for conn := range l.conns {
+		conn.Close()
+	}
+	return l.ln.Close()
+}
+
+func (l *TCPListener) accept(rs *rpc.Server) {
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		l.mu.Lock()
+		if l.closed {
+			l.mu.Unlock()
+			conn.Close()
+			return
+		}
+		l.conns[conn] = true
+		l.mu.Unlock()
+
+		go func() {
+			if l.codec != nil {
+				rs.ServeCodec(newRPCCodec(l.codec, l.maxMessage, conn))
+			} else {
+				rs.ServeConn(conn)
+			}
+
+			l.mu.Lock()
+			delete(l.conns, conn)
+			l.mu.Unlock()
+		}()
+	}
+}
+
+// a Server's handlers in the form net/rpc expects.
+type tcpHandlers struct {
+	sv *Server
+}
+
+// what a tcpPeer sends: a call's metadata and its args, which are
+// nil for Query. exported only because net/rpc requires it.
+type TCPArgs struct {
+	Meta Metadata
+	Args *RPCArgs
+}
+
+// the call's metadata; gob turns an empty map into nil.
+func (a *TCPArgs) metadata() Metadata {
+	if a.Meta == nil {
+		return Metadata{}
+	}
+	return a.Meta
+}
+
+// answers a tcpPeer's health checks.
+func (h *tcpHandlers) Ping(args struct{}, reply *struct{}) error {
+	return nil
+}
+
+func (h *tcpHandlers) Prepare(args *TCPArgs, reply *PrepareReply) error {
+	h.sv.Prepare(args.metadata(), args.Args, reply)
+	return nil
+}
+
+func (h *tcpHandlers) Abort(args *TCPArgs, reply *struct{}) error {
+	h.sv.Abort(args.metadata(), args.Args, reply)
+	return nil
+}
+
+func (h *tcpHandlers) Query(args *TCPArgs, reply *QueryReply) error {
+	h.sv.Query(args.metadata(), struct{}{}, reply)
+	return nil
+}
+
+func (h *tcpHandlers) PreCommit(args *TCPArgs, reply *PreCommitReply) error {
+	h.sv.PreCommit(args.metadata(), args.Args, reply)
+	return nil
+}
+
+func (h *tcpHandlers) Commit(args *TCPArgs, reply *CommitReply) error {
+	h.sv.Commit(args.metadata(), args.Args, reply)
+	return nil
+}
+
+// a PeerClient for the server at addr.
+type tcpPeer struct {
+	network    string
+	addr       string
+	tls        *tls.Config // nil for plain TCP
+	pool       PoolConfig
+	codec      codec.Codec   // nil for net/rpc's gob
+	maxMessage int           // 0 for no limit
+	done       chan struct{} // closed by Close(), to stop the health checks
+
+	mu      sync.Mutex
+	conns   []*rpc.Client // the pool; nil until dialled, and after a connection breaks
+	next    int           // the connection the next call takes
+	backoff time.Duration // after the last failed dial; 0 once a dial succeeds
+	retryAt time.Time     // when dialling may start again
+	closed  bool
+}
+
+var (
+	errPeerClosed = errors.New("peer closed")
+	errTCPTimeout = errors.New("no reply within tcpCallTimeout")
+)
+
+func (p *tcpPeer) Call(svcMeth string, args interface{}, reply interface{}) bool {
+	return p.CallMeta(svcMeth, nil, args, reply)
+}
+
+func (p *tcpPeer) CallMeta(svcMeth string, meta Metadata, args interface{}, reply interface{}) bool {
+	return p.CallErr(svcMeth, meta, args, reply) == nil
+}
+
+func (p *tcpPeer) CallErr(svcMeth string, meta Metadata, args interface{}, reply interface{}) error {
+	if !transactionMethod(svcMeth) {
+		return ErrUnsupportedMethod
+	}
+	client, err := p.connect()
+	if err != nil {
+		return err
+	}
+
+	rpcArgs, _ := args.(*RPCArgs) // Query's are struct{}{}
+	call := client.Go(svcMeth, &TCPArgs{Meta: meta, Args: rpcArgs}, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+	case <-time.After(tcpCallTimeout):
+		// the connection may be fine and the handler slow, so keep it
+		return errTCPTimeout
+	}
+	if call.Error == ErrMessageTooLarge || call.Error == rpc.ServerError(ErrMessageTooLarge.Error()) {
+		// refused by one side or the other; the connection is fine
+		return ErrMessageTooLarge
+	}
+	if call.Error != nil {
+		// handlers never return errors, so the connection broke
+		p.drop(client)
+		return call.Error
+	}
+	return nil
+}
+
+// send without waiting for the reply. a broken connection is
+// noticed by the next Call.
+func (p *tcpPeer) Send(svcMeth string, args interface{}) {
+	client, err := p.connect()
+	if err != nil {
+		return
+	}
+	rpcArgs, _ := args.(*RPCArgs)
+	client.Go(svcMeth, &TCPArgs{Args: rpcArgs}, replyFor(svcMeth), make(chan *rpc.Call, 1))
+}
+
+// the pool's next connection, dialling it if it has none. if the
+// last dial failed, first wait out the backoff.
+func (p *tcpPeer) connect() (*rpc.Client, error) {
+	p.mu.Lock()
+	wait := time.Until(p.retryAt)
+	p.mu.Unlock()
+	if wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-p.done:
+			return nil, errPeerClosed
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil, errPeerClosed
+	}
+	i := p.next
+	p.next = (p.next + 1) % len(p.conns)
+	if p.conns[i] == nil {
+		var conn net.Conn
+		var err error
+		if p.tls != nil {
+			conn, err = tls.DialWithDialer(&net.Dialer{Timeout: tcpDialTimeout}, p.network, p.addr, p.tls)
+		} else {
+			conn, err = net.DialTimeout(p.network, p.addr, tcpDialTimeout)
+		}
+		if err != nil {
+			p.backoff = p.pool.nextBackoff(p.backoff)
+			p.retryAt = time.Now().Add(p.backoff)
+			return nil, err
+		}
+		p.backoff = 0
+		if p.codec != nil {
+			p.conns[i] = rpc.NewClientWithCodec(newRPCCodec(p.codec, p.maxMessage, conn))
+		} else {
+			p.conns[i] = rpc.NewClient(conn)
+		}
+	}
+	return p.conns[i], nil
+}
+
+// forget a broken connection, unless another call already has.
+func (p *tcpPeer) drop(client *rpc.Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, c := range p.conns {
+		if c == client {
+			c.Close()
+			p.conns[i] = nil
+		}
+	}
+}
+
+// every HealthInterval, ping each open connection, and drop any
+// that doesn't answer within tcpDialTimeout, so that the next
+// call dials a fresh one rather than finding out the hard way.
+func (p *tcpPeer) checkHealth() {
+	ticker := time.NewTicker(p.pool.HealthInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.done:
+			return
+		}
+
+		p.mu.Lock()
+		var open []*rpc.Client
+		for _, c := range p.conns {
+			if c != nil {
+				open = append(open, c)
+			}
+		}
+		p.mu.Unlock()
+
+		for _, c := range open {
+			call := c.Go("Server.Ping", struct{}{}, &struct{}{}, make(chan *rpc.Call, 1))
+			select {
+			case <-call.Done:
+				if call.Error != nil {
+					p.drop(c)
+				}
+			case <-time.After(tcpDialTimeout):
+				p.drop(c)
+			case <-p.done:
+				return
+			}
+		}
+	}
+}
+
+// close every connection; later calls fail.
+func (p *tcpPeer) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	close(p.done)
+	for i, c := range p.conns {
+		if c != nil {
+			c.Close()
+			p.conns[i] = nil
+		}
+	}
+	return nil
+}
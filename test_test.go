@@ -1,8 +1,17 @@
 package commit
 
 import (
-	"log"
-	"math/rand/v2"
+	"3PhaseCommit/codec"
+	"3PhaseCommit/labrpc"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -10,6 +19,8 @@ import (
 // Sends two transactions without failures.
 // They should both commit and change the store
 func TestBasicCommit(t *testing.T) {
+	t.Parallel()
+
 	keys := [][]string{
 		{"x"},
 		{"y"},
@@ -28,20 +39,20 @@ func TestBasicCommit(t *testing.T) {
 
 	cfg.sendSet(0, "z", 3)
 
-	log.Printf("Transaction 0: Finishing")
+	cfg.logf("Transaction 0: Finishing")
 	cfg.finishTransaction(0)
-	log.Printf("Transaction 0: Finished Transaction 0")
+	cfg.logf("Transaction 0: Finished Transaction 0")
 	cfg.assertTransaction(0, true, nil)
 
-	log.Printf("Transaction 0: Committed successfully")
+	cfg.logf("Transaction 0: Committed successfully")
 
-	log.Printf("Transaction 1: Getting x, y, z")
+	cfg.logf("Transaction 1: Getting x, y, z")
 	// Transaction 1
 	cfg.sendGet(1, "x")
 	cfg.sendGet(1, "y")
 	cfg.sendGet(1, "z")
 
-	log.Printf("Transaction 1: Finishing")
+	cfg.logf("Transaction 1: Finishing")
 
 	cfg.finishTransaction(1)
 	cfg.assertTransaction(1, true, map[string]interface{}{
@@ -50,16 +61,18 @@ func TestBasicCommit(t *testing.T) {
 		"z": 3,
 	})
 
-	log.Printf("Transaction 1: Read values successfully and committed")
+	cfg.logf("Transaction 1: Read values successfully and committed")
 
 	cfg.end()
 
-	log.Printf("Finished TestBasicCommit")
+	cfg.logf("Finished TestBasicCommit")
 }
 
 // Disconnects one server before FinishTransaction
 // This should cause an Abort, and the store should be unchanged
 func TestBasicAbort(t *testing.T) {
+	t.Parallel()
+
 	keys := [][]string{
 		{"x"},
 		{"y"},
@@ -72,34 +85,39 @@ func TestBasicAbort(t *testing.T) {
 	cfg.begin("TestBasicAbort: Abort when a server is disconnected")
 
 	// Successful transaction initializes values
-	log.Printf("Transaction 0: Sending set x, y, z")
+	cfg.logf("Transaction 0: Sending set x, y, z")
 	cfg.sendSet(0, "x", 1)
 	cfg.sendSet(0, "y", 1)
 	cfg.sendSet(0, "z", 1)
 	cfg.finishTransaction(0)
-	log.Printf("Transaction 0: Finished Transaction 0")
+	cfg.logf("Transaction 0: Finished Transaction 0")
 	cfg.assertTransaction(0, true, map[string]interface{}{})
 
 	// Disconnected server causes failed transaction
-	log.Printf("Transaction 1: Disconnecting server 0")
+	cfg.logf("Transaction 1: Disconnecting server 0")
 	cfg.disconnect(0)
 
-	log.Printf("Transaction 1: Sending set x, y, z")
+	cfg.logf("Transaction 1: Sending set x, y, z")
 	cfg.sendSet(1, "x", 2)
 	cfg.sendSet(1, "y", 2)
 	cfg.sendSet(1, "z", 2)
 	cfg.finishTransaction(1)
-	log.Printf("Transaction 1: Finished transaction 1. Expecting ABORT due to server disconnection")
+	cfg.logf("Transaction 1: Finished transaction 1. Expecting ABORT due to server disconnection")
 	cfg.assertTransaction(1, false, nil)
 
 	time.Sleep(50 * time.Millisecond) // give the servers time to finish aborting
-	log.Printf("[Pause] Sleeping briefly to let abort propagate")
+	cfg.logf("[Pause] Sleeping briefly to let abort propagate")
 
 	// Reconnect and read old values
-	log.Printf("[Recovery] Reconnecting server 0")
+	cfg.logf("[Recovery] Reconnecting server 0")
 	cfg.connect(0)
 
-	log.Printf("[Verify] Reading values x, y, z to confirm they are still 1")
+	cfg.logf("[Verify] Checking each server's store still holds 1")
+	cfg.assertStoreEquals(0, map[string]interface{}{"x": 1})
+	cfg.assertStoreEquals(1, map[string]interface{}{"y": 1})
+	cfg.assertStoreEquals(2, map[string]interface{}{"z": 1})
+
+	cfg.logf("[Verify] Reading values x, y, z to confirm they are still 1")
 	cfg.sendGet(2, "x")
 	cfg.sendGet(2, "y")
 	cfg.sendGet(2, "z")
@@ -109,13 +127,15 @@ func TestBasicAbort(t *testing.T) {
 		"y": 1,
 		"z": 1,
 	})
-	log.Printf("=== Finished Test: BasicAbort ===")
+	cfg.logf("=== Finished Test: BasicAbort ===")
 	cfg.end()
 }
 
 // Restarts the coordinator between transactions
 // The coordinator should recover and sucessfully commit the second transaction
 func TestEasyRecovery(t *testing.T) {
+	t.Parallel()
+
 	keys := [][]string{
 		{"x"},
 		{"y"},
@@ -156,6 +176,8 @@ func TestEasyRecovery(t *testing.T) {
 // Disconnects a server that isn't relevant to the transaction after the Prepare phase is completed
 // The transaction should still be able to commit
 func TestRelevance(t *testing.T) {
+	t.Parallel()
+
 	keys := [][]string{
 		{"x"},
 		{"y"},
@@ -181,6 +203,8 @@ func TestRelevance(t *testing.T) {
 // Sends many batches of concurrent transactions that write to separate keys
 // The transactions should all be able to succeed
 func TestConcurrentDifferentKeys(t *testing.T) {
+	t.Parallel()
+
 	keys := [][]string{
 		{"x"},
 		{"y"},
@@ -191,8 +215,14 @@ func TestConcurrentDifferentKeys(t *testing.T) {
 
 	cfg.begin("TestConcurrentDifferentKeys: Transactions that don't touch the same keys can always succeed concurrently")
 
-	n := 10
+	concurrentDifferentKeys(cfg, 10, false)
+
+	cfg.end()
+}
 
+// the body of TestConcurrentDifferentKeys, with n batches; see
+// TestConcurrencyVariants for mayAbort
+func concurrentDifferentKeys(cfg *config, n int, mayAbort bool) {
 	for i := range n {
 		tid1 := i * 3
 		tid2 := tid1 + 1
@@ -203,17 +233,17 @@ func TestConcurrentDifferentKeys(t *testing.T) {
 		cfg.finishTransaction(tid3)
 		cfg.finishTransaction(tid2)
 		cfg.finishTransaction(tid1)
-		cfg.assertTransaction(tid3, true, nil)
-		cfg.assertTransaction(tid2, true, nil)
-		cfg.assertTransaction(tid1, true, nil)
+		assertCommitted(cfg, tid3, mayAbort)
+		assertCommitted(cfg, tid2, mayAbort)
+		assertCommitted(cfg, tid1, mayAbort)
 	}
-
-	cfg.end()
 }
 
 // Sends many batches of concurrent transactions that read from the same key
 // The transactions should all be able to succeed
 func TestConcurrentReadSameKeys(t *testing.T) {
+	t.Parallel()
+
 	keys := [][]string{
 		{"x"},
 		{"y"},
@@ -224,30 +254,37 @@ func TestConcurrentReadSameKeys(t *testing.T) {
 
 	cfg.begin("TestConcurrentReadSameKeys: Transactions that only read the same keys can always succeed concurrently")
 
-	n := 10
+	concurrentReadSameKeys(cfg, 10, false)
+
+	cfg.end()
+}
+
+// the body of TestConcurrentReadSameKeys, with n batches
+func concurrentReadSameKeys(cfg *config, n int, mayAbort bool) {
+	keys := []string{"x", "y", "z"}
 
 	for i := range n {
 		tid1 := i * 3
 		tid2 := tid1 + 1
 		tid3 := tid1 + 2
-		key := keys[i%3][0]
+		key := keys[i%3]
 		cfg.sendGet(tid1, key)
 		cfg.sendGet(tid2, key)
 		cfg.sendGet(tid3, key)
 		cfg.finishTransaction(tid3)
 		cfg.finishTransaction(tid2)
 		cfg.finishTransaction(tid1)
-		cfg.assertTransaction(tid3, true, nil)
-		cfg.assertTransaction(tid2, true, nil)
-		cfg.assertTransaction(tid1, true, nil)
+		assertCommitted(cfg, tid3, mayAbort)
+		assertCommitted(cfg, tid2, mayAbort)
+		assertCommitted(cfg, tid1, mayAbort)
 	}
-
-	cfg.end()
 }
 
 // Sends many batches of concurrent transactions that write to the same key
 // At least one transaction from each batch should succeed
 func TestConcurrentWriteSameKeys(t *testing.T) {
+	t.Parallel()
+
 	keys := [][]string{
 		{"x"},
 		{"y"},
@@ -258,73 +295,80 @@ func TestConcurrentWriteSameKeys(t *testing.T) {
 
 	cfg.begin("TestConcurrentWriteSameKeys: Concurrent transactions that write to the same keys should have at least one commit")
 
-	n := 10
+	concurrentWriteSameKeys(cfg, 10, false)
+
+	cfg.end()
+}
+
+// the body of TestConcurrentWriteSameKeys, with n batches
+func concurrentWriteSameKeys(cfg *config, n int, mayAbort bool) {
+	keys := []string{"x", "y", "z"}
 
 	for i := range n {
 		tid1 := i * 3
 		tid2 := tid1 + 1
 		tid3 := tid1 + 2
-		key := keys[i%3][0]
+		key := keys[i%3]
 
-		log.Printf("\n[Batch %d] Writing to key '%s' with transaction IDs %d, %d, %d", i, key, tid1, tid2, tid3)
+		cfg.logf("[Batch %d] Writing to key '%s' with transaction IDs %d, %d, %d", i, key, tid1, tid2, tid3)
 
 		cfg.sendSet(tid1, key, i)
 		cfg.sendSet(tid2, key, i)
 		cfg.sendSet(tid3, key, i)
 
-		log.Printf("[Batch %d] Finishing transactions in reverse order", i)
+		cfg.logf("[Batch %d] Finishing transactions in reverse order", i)
 
 		cfg.finishTransaction(tid3)
 		cfg.finishTransaction(tid2)
 		cfg.finishTransaction(tid1)
 
-		log.Printf("[Batch %d] Waiting for transaction results", i)
+		cfg.logf("[Batch %d] Waiting for transaction results", i)
 
 		res1 := cfg.waitTransaction(tid3)
-		log.Printf("[Batch %v] res1: %v", i, res1)
+		cfg.logf("[Batch %v] res1: %v", i, res1)
 		res2 := cfg.waitTransaction(tid2)
-		log.Printf("[Batch %v] res2: %v", i, res2)
+		cfg.logf("[Batch %v] res2: %v", i, res2)
 		res3 := cfg.waitTransaction(tid1)
-		log.Printf("[Batch %v] res3: %v", i, res3)
+		cfg.logf("[Batch %v] res3: %v", i, res3)
 
 		succCount := 0
 		if res1.committed {
-			log.Printf("  ✓ Transaction %d committed", tid3)
+			cfg.logf("  ✓ Transaction %d committed", tid3)
 			succCount += 1
 		} else {
-			log.Printf("  ✗ Transaction %d aborted", tid3)
+			cfg.logf("  ✗ Transaction %d aborted", tid3)
 		}
 
 		if res2.committed {
-			log.Printf("  ✓ Transaction %d committed", tid2)
+			cfg.logf("  ✓ Transaction %d committed", tid2)
 			succCount += 1
 		} else {
-			log.Printf("  ✗ Transaction %d aborted", tid2)
+			cfg.logf("  ✗ Transaction %d aborted", tid2)
 		}
 
 		if res3.committed {
-			log.Printf("  ✓ Transaction %d committed", tid1)
+			cfg.logf("  ✓ Transaction %d committed", tid1)
 			succCount += 1
 		} else {
-			log.Printf("  ✗ Transaction %d aborted", tid1)
+			cfg.logf("  ✗ Transaction %d aborted", tid1)
 		}
 
-		if succCount < 1 {
-			t.Fatal("Not enough successes")
-		} else {
-			log.Printf("[Batch %d] ✅ At least one transaction committed", i)
+		if succCount < 1 && !mayAbort {
+			cfg.t.Fatal("Not enough successes")
+		} else if succCount >= 1 {
+			cfg.logf("[Batch %d] ✅ At least one transaction committed", i)
 		}
 
-		log.Printf("--------------------------------------")
+		cfg.logf("--------------------------------------")
 
 	}
-
-	cfg.end()
 }
 
 // Sends many batches of concurrent transactions that write the same value to each key
 // After each batch, the final value the keys should all be the same
 func TestSerializability(t *testing.T) {
+	t.Parallel()
+
 	keys := [][]string{
 		{"x"},
 		{"y"},
@@ -335,14 +379,22 @@ func TestSerializability(t *testing.T) {
 
 	cfg.begin("TestSerializability: Concurrent transactions are executed serially")
 
+	serializability(cfg, 10, false)
+
+	cfg.end()
+}
+
+// the body of TestSerializability, with n batches
+func serializability(cfg *config, n int, mayAbort bool) {
 	cfg.sendSet(0, "x", 0)
 	cfg.sendSet(0, "y", 0)
 	cfg.sendSet(0, "z", 0)
 	cfg.finishTransaction(0)
 	cfg.waitTransaction(0)
 
-	n := 10
-
+	// whether oldVal is still the keys' value as of the last batch;
+	// not once a read aborts
+	known := true
 	oldVal := 0
 	for i := range n {
 		m := 3
@@ -369,25 +421,91 @@ func TestSerializability(t *testing.T) {
 		cfg.sendGet(tid, "y")
 		cfg.sendGet(tid, "z")
 		cfg.finishTransaction(tid)
-		resp := cfg.assertTransaction(tid, true, nil)
-		x := resp.readValues["x"].(int)
-		y := resp.readValues["y"].(int)
-		z := resp.readValues["z"].(int)
+		resp := assertCommitted(cfg, tid, mayAbort)
+		if !resp.committed {
+			known = false
+			continue
+		}
+		// a key that was never set reads as nil, which is as good as
+		// 0 here: only if transaction 0 aborted
+		x, _ := resp.readValues["x"].(int)
+		y, _ := resp.readValues["y"].(int)
+		z, _ := resp.readValues["z"].(int)
 		if x != y || x != z {
-			t.Fatal("read values don't match")
+			cfg.t.Fatal("read values don't match")
 		}
-		if x != oldVal && x < tidBase || x > tidBase+m {
-			t.Fatal("read values outside of possible range")
+		if known && x != oldVal && x < tidBase || x > tidBase+m {
+			cfg.t.Fatal("read values outside of possible range")
 		}
+		known = true
 		oldVal = x
 	}
+}
 
-	cfg.end()
+// tid's response, which must be a commit unless mayAbort.
+func assertCommitted(cfg *config, tid int, mayAbort bool) ResponseMsg {
+	if mayAbort {
+		return cfg.waitTransaction(tid)
+	}
+	return cfg.assertTransaction(tid, true, nil)
+}
+
+// Re-runs the concurrency tests above under every combination of an unreliable
+// network, long reordering and coordinator restarts, with fewer batches each
+// A restarted coordinator may abort a transaction, so under restarts any transaction may abort
+// The long-reordering variants take up to a minute each, so only run with -long
+func TestConcurrencyVariants(t *testing.T) {
+	t.Parallel()
+
+	bodies := []struct {
+		name string
+		run  func(cfg *config, n int, mayAbort bool)
+	}{
+		{"DifferentKeys", concurrentDifferentKeys},
+		{"ReadSameKeys", concurrentReadSameKeys},
+		{"WriteSameKeys", concurrentWriteSameKeys},
+		{"Serializability", serializability},
+	}
+
+	for _, body := range bodies {
+		for _, v := range allVariants() {
+			t.Run(body.name+"/"+v.String(), func(t *testing.T) {
+				t.Parallel()
+
+				if v.longReordering && !*long {
+					t.Skip("long-reordering variant; run with -long")
+				}
+
+				keys := [][]string{
+					{"x"},
+					{"y"},
+					{"z"},
+				}
+				cfg := make_config(t, keys, false, false)
+				defer cfg.cleanup()
+
+				cfg.begin("TestConcurrencyVariants: " + body.name + " under " + v.String())
+
+				n := 10
+				if v.longReordering {
+					n = 3
+				}
+
+				stop := cfg.startVariant(v)
+				body.run(cfg, n, v.restarts)
+				stop()
+
+				cfg.end()
+			})
+		}
+	}
 }
 
 // Disconnects a server after the Prepare phase but before the first PreCommit goes through
 // The transaction should abort
 func TestDisconnectPreCommit(t *testing.T) {
+	t.Parallel()
+
 	keys := [][]string{
 		{"x"},
 		{"y"},
@@ -402,14 +520,19 @@ func TestDisconnectPreCommit(t *testing.T) {
 	cfg.sendSet(0, "y", 1)
 	cfg.sendSet(0, "z", 1)
 	cfg.doNextPreCommit(func() bool {
-		log.Printf("Disconnecting server 0")
+		cfg.logf("Disconnecting server 0")
 		cfg.disconnect(0)
 		return true
 	})
-	log.Printf("Finishing transaction 0")
+	cfg.logf("Finishing transaction 0")
 	cfg.finishTransaction(0)
 	cfg.assertTransaction(0, false, nil)
 
+	// none of the writes may have been applied
+	for i := range keys {
+		cfg.assertStoreEquals(i, map[string]interface{}{})
+	}
+
 	cfg.end()
 }
 
@@ -417,6 +540,8 @@ func TestDisconnectPreCommit(t *testing.T) {
 // The transaction should block until the server is reconnected
 // Then the transaction should be committed
 func TestDisconnectCommit(t *testing.T) {
+	t.Parallel()
+
 	keys := [][]string{
 		{"x"},
 		{"y"},
@@ -447,9 +572,119 @@ func TestDisconnectCommit(t *testing.T) {
 	cfg.end()
 }
 
+// Loses a server's replies, but not the coordinator's requests, from PreCommit on
+// The server hears PreCommit but the coordinator times out and aborts, and the server must hear that Abort too
+// Then loses the coordinator's Commit to a server and restarts the coordinator, whose recovery must finish the commit
+func TestOneWayLinks(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+		{"z"},
+	}
+	cfg := make_config(t, keys, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("TestOneWayLinks: Requests that arrive without their replies leave no server in doubt")
+
+	cfg.sendSet(0, "x", 1)
+	cfg.sendSet(0, "y", 1)
+	cfg.sendSet(0, "z", 1)
+	cfg.doNextPreCommit(func() bool {
+		cfg.logf("Losing server 0's replies")
+		cfg.connectOneWay(0, true, false)
+		return true
+	})
+	cfg.finishTransaction(0)
+	cfg.assertTransaction(0, false, nil)
+
+	// the Abort reaches server 0 even though its ack can't
+	cfg.awaitHook(func() bool {
+		state, _ := cfg.servers[0].transactionState(0)
+		return state == stateAborted
+	})
+	if n := cfg.rpcStats(0, "Server.PreCommit").Count; n == 0 {
+		t.Fatalf("server 0 never got PreCommit")
+	}
+	cfg.connect(0)
+	for i := range keys {
+		cfg.assertStoreEquals(i, map[string]interface{}{})
+	}
+
+	cfg.sendSet(1, "x", 2)
+	cfg.sendSet(1, "y", 2)
+	cfg.sendSet(1, "z", 2)
+	cfg.doNextCommit(func() bool {
+		cfg.logf("Losing the coordinator's requests to server 0")
+		cfg.connectOneWay(0, false, true)
+		return true
+	})
+	cfg.finishTransaction(1)
+
+	cfg.awaitHook(func() bool { return cfg.onCommit == nil })
+	time.Sleep(50 * time.Millisecond)
+	cfg.assertNoTransaction(1)
+	if state, _ := cfg.servers[0].transactionState(1); state != statePreCommitted {
+		t.Fatalf("server 0 is %v; expected it to be waiting for Commit", state)
+	}
+
+	// the new coordinator's links are whole again
+	cfg.mu.Lock()
+	cfg.restartCoordinatorLocked()
+	cfg.mu.Unlock()
+	cfg.assertTransaction(1, true, nil)
+	for i, key := range []string{"x", "y", "z"} {
+		cfg.assertStoreEquals(i, map[string]interface{}{key: 2})
+	}
+
+	cfg.end()
+}
+
+// Pauses a server before Prepare, for longer than the phase timeout
+// Unlike a disconnected server, it doesn't lose the Prepare, so the transaction
+// should wait for it and commit once it resumes
+func TestPauseServer(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+		{"z"},
+	}
+	cfg := make_config(t, keys, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("TestPauseServer: A paused server delays the transaction, but it commits")
+
+	cfg.setPhaseTimeout(100 * time.Millisecond)
+
+	cfg.sendSet(0, "x", 1)
+	cfg.sendSet(0, "y", 1)
+	cfg.sendSet(0, "z", 1)
+	cfg.logf("Pausing server 2")
+	cfg.pause(2)
+	cfg.finishTransaction(0)
+
+	if _, ok := cfg.waitTransactionFor(0, 300*time.Millisecond); ok {
+		cfg.t.Fatalf("transaction 0 was decided while server 2 was paused")
+	}
+
+	cfg.logf("Resuming server 2")
+	cfg.resume(2)
+	cfg.assertTransaction(0, true, nil)
+	for i, key := range []string{"x", "y", "z"} {
+		cfg.assertStoreEquals(i, map[string]interface{}{key: 1})
+	}
+
+	cfg.end()
+}
+
 // Restarts the coordinator after the Prepare phase but before the first PreCommit goes through
 // The coordinator should recover and commit the transaction
 func TestRestartPreCommit(t *testing.T) {
+	t.Parallel()
+
 	keys := [][]string{
 		{"x"},
 		{"y"},
@@ -463,17 +698,17 @@ func TestRestartPreCommit(t *testing.T) {
 	cfg.sendSet(0, "x", 1)
 	cfg.sendSet(0, "y", 1)
 	cfg.sendSet(0, "z", 1)
-	log.Printf("Finishing sending set 0")
+	cfg.logf("Finishing sending set 0")
 
 	cfg.doNextPreCommit(func() bool {
-		log.Printf("Restarting coordinator")
+		cfg.logf("Restarting coordinator")
 		cfg.restartCoordinatorLocked()
 		return true
 	})
 
-	log.Printf("Finishing transaction 0")
+	cfg.logf("Finishing transaction 0")
 	cfg.finishTransaction(0)
-	log.Printf("Finished transaction 0")
+	cfg.logf("Finished transaction 0")
 	cfg.assertTransaction(0, true, nil)
 
 	cfg.end()
@@ -482,6 +717,8 @@ func TestRestartPreCommit(t *testing.T) {
 // Restarts the coordinator after the PreCommit phase but before the first Commmit goes through
 // The coordinator should recover and commit the transaction
 func TestRestartCommit(t *testing.T) {
+	t.Parallel()
+
 	keys := [][]string{
 		{"x"},
 		{"y"},
@@ -513,6 +750,8 @@ func TestRestartCommit(t *testing.T) {
 // The coordinator should recover and commit the transaction
 // Does many trials to test different possibilities
 func TestRestartMidPreCommit(t *testing.T) {
+	t.Parallel()
+
 	keys := [][]string{
 		{"x"},
 		{"y"},
@@ -530,7 +769,7 @@ func TestRestartMidPreCommit(t *testing.T) {
 		cfg.sendSet(i, "y", 1)
 		cfg.sendSet(i, "z", 1)
 		cfg.doNextPreCommit(func() bool {
-			if rand.Int()%2 == 0 {
+			if cfg.randIntLocked()%2 == 0 {
 				cfg.restartCoordinatorLocked()
 				return true
 			}
@@ -543,10 +782,43 @@ func TestRestartMidPreCommit(t *testing.T) {
 	cfg.end()
 }
 
+// Restarts the coordinator as each PreCommit and each Commit of a transaction is sent
+// Every transaction should recover and commit
+func TestRestartNthPhaseMessage(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+		{"z"},
+	}
+	cfg := make_config(t, keys, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("TestRestartNthPhaseMessage: If the coordinator restarts at any PreCommit or Commit, we commit")
+
+	tid := 0
+	for _, hook := range []func(n int, f func()){cfg.doOnPreCommit, cfg.doOnCommit} {
+		for n := 1; n <= len(keys); n++ {
+			cfg.sendSet(tid, "x", tid)
+			cfg.sendSet(tid, "y", tid)
+			cfg.sendSet(tid, "z", tid)
+			hook(n, cfg.restartCoordinatorLocked)
+			cfg.finishTransaction(tid)
+			cfg.assertTransaction(tid, true, nil)
+			tid++
+		}
+	}
+
+	cfg.end()
+}
+
 // Restarts the coordinator at a random time during the Commit phase
 // The coordinator should recover and commit the transaction
 // Does many trials to test different possibilities
 func TestRestartMidCommit(t *testing.T) {
+	t.Parallel()
+
 	keys := [][]string{
 		{"x"},
 		{"y"},
@@ -564,7 +836,7 @@ func TestRestartMidCommit(t *testing.T) {
 		cfg.sendSet(i, "y", 1)
 		cfg.sendSet(i, "z", 1)
 		cfg.doNextCommit(func() bool {
-			if rand.Int()%2 == 0 {
+			if cfg.randIntLocked()%2 == 0 {
 				cfg.restartCoordinatorLocked()
 				return true
 			}
@@ -576,3 +848,3134 @@ func TestRestartMidCommit(t *testing.T) {
 
 	cfg.end()
 }
+
+// Like TestRestartPreCommit, with servers that persist to snapshots and logs and a coordinator that
+// logs its decisions; the new coordinator gets only a copy of the log. Nothing is logged before
+// PreCommit, so it should learn from Query that the servers voted Yes, commit and log the commit
+func TestPersistentRestartPreCommit(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+		{"z"},
+	}
+	cfg := make_config(t, keys, false, true)
+	defer cfg.cleanup()
+	cfg.persistCoordinator()
+
+	cfg.begin("TestPersistentRestartPreCommit: A coordinator restarted from its log before PreCommit commits from Query")
+
+	cfg.sendSet(0, "x", 1)
+	cfg.sendSet(0, "y", 1)
+	cfg.sendSet(0, "z", 1)
+
+	logged := "unset"
+	queries := 0
+	cfg.doNextPreCommit(func() bool {
+		cfg.logf("Restarting coordinator from its log")
+		cfg.restartCoordinatorLocked()
+		logged = cfg.loggedDecisionLocked(0)
+		queries = cfg.queries
+		return true
+	})
+
+	cfg.finishTransaction(0)
+	cfg.assertTransaction(0, true, nil)
+	if logged != "" {
+		t.Fatalf("expected nothing logged for transaction 0 before PreCommit, got %q", logged)
+	}
+	cfg.mu.Lock()
+	queried := cfg.queries > queries
+	cfg.mu.Unlock()
+	if !queried {
+		t.Fatalf("expected the restarted coordinator to Query the servers")
+	}
+	if outcome := cfg.loggedDecision(0); outcome != PhaseCommitted {
+		t.Fatalf("expected the restarted coordinator to log the commit, got %q", outcome)
+	}
+
+	cfg.end()
+}
+
+// Like TestRestartCommit, with servers that persist to snapshots and logs and a coordinator that
+// logs its decisions; each new coordinator gets only a copy of the log. The commit is logged before
+// the first Commit is sent, so each new coordinator should find it there and commit
+func TestPersistentRestartCommit(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+		{"z"},
+	}
+	cfg := make_config(t, keys, false, true)
+	defer cfg.cleanup()
+	cfg.persistCoordinator()
+
+	cfg.begin("TestPersistentRestartCommit: A coordinator restarted from its log before Commit commits as logged")
+
+	n := 10
+
+	for i := range n {
+		cfg.sendSet(i, "x", i)
+		cfg.sendSet(i, "y", i)
+		cfg.sendSet(i, "z", i)
+		logged := "unset"
+		cfg.doNextCommit(func() bool {
+			cfg.restartCoordinatorLocked()
+			logged = cfg.loggedDecisionLocked(i)
+			return true
+		})
+		cfg.finishTransaction(i)
+		cfg.assertTransaction(i, true, nil)
+		if logged != PhaseCommitted {
+			t.Fatalf("expected transaction %d's commit to be logged before Commit, got %q", i, logged)
+		}
+	}
+	for i, key := range []string{"x", "y", "z"} {
+		cfg.assertStoreEquals(i, map[string]interface{}{key: n - 1})
+	}
+
+	cfg.end()
+}
+
+// Like TestRestartNthPhaseMessage, with servers that persist to snapshots and logs and a coordinator
+// that logs its decisions; each new coordinator gets only a copy of the log
+// Every transaction should commit, with the commit logged by the time any Commit was sent
+func TestPersistentRestartNthPhaseMessage(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+		{"z"},
+	}
+	cfg := make_config(t, keys, false, true)
+	defer cfg.cleanup()
+	cfg.persistCoordinator()
+
+	cfg.begin("TestPersistentRestartNthPhaseMessage: A coordinator restarted from its log at any PreCommit or Commit commits")
+
+	tid := 0
+	for _, c := range []struct {
+		hook func(n int, f func())
+		want string
+	}{
+		{cfg.doOnPreCommit, ""},
+		{cfg.doOnCommit, PhaseCommitted},
+	} {
+		for n := 1; n <= len(keys); n++ {
+			cfg.sendSet(tid, "x", tid)
+			cfg.sendSet(tid, "y", tid)
+			cfg.sendSet(tid, "z", tid)
+			logged := "unset"
+			c.hook(n, func() {
+				cfg.restartCoordinatorLocked()
+				logged = cfg.loggedDecisionLocked(tid)
+			})
+			cfg.finishTransaction(tid)
+			cfg.assertTransaction(tid, true, nil)
+			if logged != c.want {
+				t.Fatalf("expected %q logged for transaction %d when the coordinator restarted, got %q", c.want, tid, logged)
+			}
+			tid++
+		}
+	}
+
+	cfg.end()
+}
+
+// Crashes the coordinator, which logs its decisions, as the first Commit is sent, then crashes every
+// server, all of which persist to snapshots and logs, and restarts them with no coordinator running
+// The servers still in doubt should take their locks back, and a coordinator started later from a
+// copy of the log should commit the transaction, with every server then holding its value
+func TestPersistentRestartEverything(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+		{"z"},
+	}
+	cfg := make_config(t, keys, false, true)
+	defer cfg.cleanup()
+	cfg.persistCoordinator()
+
+	cfg.begin("TestPersistentRestartEverything: Everything restarted from persisted state finishes a transaction in doubt")
+
+	cfg.sendSet(0, "x", 1)
+	cfg.sendSet(0, "y", 2)
+	cfg.sendSet(0, "z", 3)
+	cfg.doNextCommit(func() bool {
+		cfg.logf("Crashing coordinator")
+		cfg.crashCoordinatorLocked()
+		return true
+	})
+	cfg.finishTransaction(0)
+
+	cfg.awaitHook(func() bool { return cfg.onCommit == nil })
+	time.Sleep(50 * time.Millisecond)
+	cfg.assertNoTransaction(0)
+
+	for i := range keys {
+		cfg.restartServer(i)
+	}
+	inDoubt := 0
+	for i := range keys {
+		if len(cfg.servers[i].undecided()) > 0 {
+			if held := cfg.servers[i].heldLocks(); len(held) != 1 {
+				t.Fatalf("expected restarted server %d to hold transaction 0's lock, got %v", i, held)
+			}
+			inDoubt++
+		}
+	}
+	if inDoubt == 0 {
+		t.Fatalf("expected a restarted server to still be in doubt about transaction 0")
+	}
+
+	cfg.logf("Starting a coordinator from the log")
+	cfg.mu.Lock()
+	cfg.restartCoordinatorLocked()
+	cfg.mu.Unlock()
+	cfg.assertTransaction(0, true, nil)
+	cfg.assertStoreEquals(0, map[string]interface{}{"x": 1})
+	cfg.assertStoreEquals(1, map[string]interface{}{"y": 2})
+	cfg.assertStoreEquals(2, map[string]interface{}{"z": 3})
+
+	cfg.end()
+}
+
+// Crashes and restarts a server between transactions
+// The restarted server should recover its store from its persisted state
+func TestServerRestart(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+		{"z"},
+	}
+	cfg := make_config(t, keys, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("TestServerRestart: A restarted server keeps its committed values")
+
+	cfg.sendSet(0, "x", 1)
+	cfg.sendSet(0, "y", 2)
+	cfg.sendSet(0, "z", 3)
+	cfg.finishTransaction(0)
+	cfg.assertTransaction(0, true, nil)
+
+	cfg.restartServer(0)
+
+	cfg.sendGet(1, "x")
+	cfg.sendGet(1, "y")
+	cfg.sendGet(1, "z")
+	cfg.finishTransaction(1)
+	cfg.assertTransaction(1, true, map[string]interface{}{
+		"x": 1,
+		"y": 2,
+		"z": 3,
+	})
+
+	cfg.end()
+}
+
+// Crashes a server after the PreCommit phase but before the first Commit goes through
+// The transaction should block until the server restarts
+// The restarted server still holds its locks and should then commit
+func TestServerCrashCommit(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+		{"z"},
+	}
+	cfg := make_config(t, keys, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("TestServerCrashCommit: If a server crashes before Commit, we commit once it restarts")
+
+	cfg.sendSet(0, "x", 1)
+	cfg.sendSet(0, "y", 1)
+	cfg.sendSet(0, "z", 1)
+	cfg.doNextCommit(func() bool {
+		cfg.crashServerLocked(0)
+		return true
+	})
+	cfg.finishTransaction(0)
+
+	// We should be waiting for the server to return during this time
+	time.Sleep(50 * time.Millisecond)
+	cfg.assertNoTransaction(0)
+
+	cfg.restartServer(0)
+	cfg.assertTransaction(0, true, nil)
+
+	cfg.sendGet(1, "x")
+	cfg.sendGet(1, "y")
+	cfg.sendGet(1, "z")
+	cfg.finishTransaction(1)
+	cfg.assertTransaction(1, true, map[string]interface{}{
+		"x": 1,
+		"y": 1,
+		"z": 1,
+	})
+
+	cfg.end()
+}
+
+// Partitions the coordinator away from one server before the transaction starts
+// The transaction should abort, and the store should be unchanged once the partition heals
+func TestPartitionPrepare(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+		{"z"},
+	}
+	cfg := make_config(t, keys, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("TestPartitionPrepare: Abort when a server is partitioned away from the coordinator")
+
+	cfg.sendSet(0, "x", 1)
+	cfg.sendSet(0, "y", 1)
+	cfg.sendSet(0, "z", 1)
+	cfg.finishTransaction(0)
+	cfg.assertTransaction(0, true, nil)
+
+	cfg.partition([][]int{{coordinatorId, 0, 1}, {2}})
+
+	cfg.sendSet(1, "x", 2)
+	cfg.sendSet(1, "y", 2)
+	cfg.sendSet(1, "z", 2)
+	cfg.finishTransaction(1)
+	cfg.assertTransaction(1, false, nil)
+
+	time.Sleep(50 * time.Millisecond) // give the servers time to finish aborting
+	cfg.heal()
+
+	cfg.assertStoreEquals(0, map[string]interface{}{"x": 1})
+	cfg.assertStoreEquals(1, map[string]interface{}{"y": 1})
+	cfg.assertStoreEquals(2, map[string]interface{}{"z": 1})
+
+	cfg.sendGet(2, "x")
+	cfg.sendGet(2, "y")
+	cfg.sendGet(2, "z")
+	cfg.finishTransaction(2)
+	cfg.assertTransaction(2, true, map[string]interface{}{
+		"x": 1,
+		"y": 1,
+		"z": 1,
+	})
+
+	cfg.end()
+}
+
+// Partitions the coordinator into a minority after the PreCommit phase but before the first Commit goes through
+// The transaction should block until the partition heals, and then commit
+func TestPartitionCommit(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+		{"z"},
+	}
+	cfg := make_config(t, keys, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("TestPartitionCommit: If the coordinator is partitioned before Commit, we block until it heals")
+
+	cfg.sendSet(0, "x", 1)
+	cfg.sendSet(0, "y", 1)
+	cfg.sendSet(0, "z", 1)
+	cfg.doNextCommit(func() bool {
+		cfg.partitionLocked([][]int{{coordinatorId}, {0, 1, 2}})
+		return true
+	})
+	cfg.finishTransaction(0)
+
+	// We should be waiting for the partition to heal during this time
+	time.Sleep(50 * time.Millisecond)
+	cfg.assertNoTransaction(0)
+
+	cfg.heal()
+	cfg.assertTransaction(0, true, nil)
+
+	cfg.end()
+}
+
+// Sends two transactions over an unreliable network
+// Dropped and delayed messages should be retried, so they should both commit and change the store
+func TestUnreliableBasicCommit(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+		{"z"},
+	}
+	cfg := make_config(t, keys, true, false)
+	defer cfg.cleanup()
+
+	cfg.begin("TestUnreliableBasicCommit: Commit over an unreliable network")
+
+	n := 10
+
+	for i := range n {
+		cfg.sendSet(2*i, "x", i)
+		cfg.sendSet(2*i, "y", i)
+		cfg.sendSet(2*i, "z", i)
+		cfg.finishTransaction(2 * i)
+		cfg.assertTransaction(2*i, true, nil)
+
+		cfg.sendGet(2*i+1, "x")
+		cfg.sendGet(2*i+1, "y")
+		cfg.sendGet(2*i+1, "z")
+		cfg.finishTransaction(2*i + 1)
+		cfg.assertTransaction(2*i+1, true, map[string]interface{}{
+			"x": i,
+			"y": i,
+			"z": i,
+		})
+	}
+
+	cfg.end()
+}
+
+// Disconnects one server before FinishTransaction over an unreliable network
+// This should cause an Abort, and the store should be unchanged
+func TestUnreliableBasicAbort(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+		{"z"},
+	}
+	cfg := make_config(t, keys, true, false)
+	defer cfg.cleanup()
+
+	cfg.begin("TestUnreliableBasicAbort: Abort over an unreliable network when a server is disconnected")
+
+	cfg.sendSet(0, "x", 1)
+	cfg.sendSet(0, "y", 1)
+	cfg.sendSet(0, "z", 1)
+	cfg.finishTransaction(0)
+	cfg.assertTransaction(0, true, nil)
+
+	cfg.disconnect(2)
+
+	cfg.sendSet(1, "x", 2)
+	cfg.sendSet(1, "y", 2)
+	cfg.sendSet(1, "z", 2)
+	cfg.finishTransaction(1)
+	cfg.assertTransaction(1, false, nil)
+
+	cfg.connect(2)
+
+	cfg.sendGet(2, "x")
+	cfg.sendGet(2, "y")
+	cfg.sendGet(2, "z")
+	cfg.finishTransaction(2)
+	cfg.assertTransaction(2, true, map[string]interface{}{
+		"x": 1,
+		"y": 1,
+		"z": 1,
+	})
+
+	cfg.end()
+}
+
+// Sends many batches of concurrent transactions that write to separate keys over an unreliable network
+// The transactions should all be able to succeed
+func TestUnreliableConcurrentDifferentKeys(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+		{"z"},
+	}
+	cfg := make_config(t, keys, true, false)
+	defer cfg.cleanup()
+
+	cfg.begin("TestUnreliableConcurrentDifferentKeys: Transactions that don't touch the same keys succeed over an unreliable network")
+
+	n := 10
+
+	for i := range n {
+		tid1 := i * 3
+		tid2 := tid1 + 1
+		tid3 := tid1 + 2
+		cfg.sendSet(tid1, "x", i)
+		cfg.sendSet(tid2, "y", i)
+		cfg.sendSet(tid3, "z", i)
+		cfg.finishTransaction(tid3)
+		cfg.finishTransaction(tid2)
+		cfg.finishTransaction(tid1)
+		cfg.assertTransaction(tid3, true, nil)
+		cfg.assertTransaction(tid2, true, nil)
+		cfg.assertTransaction(tid1, true, nil)
+	}
+
+	cfg.end()
+}
+
+// Sends many batches of concurrent transactions that read from the same key over an unreliable network
+// The transactions should all be able to succeed
+func TestUnreliableConcurrentReadSameKeys(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+		{"z"},
+	}
+	cfg := make_config(t, keys, true, false)
+	defer cfg.cleanup()
+
+	cfg.begin("TestUnreliableConcurrentReadSameKeys: Transactions that only read the same keys succeed over an unreliable network")
+
+	n := 10
+
+	for i := range n {
+		tid1 := i * 3
+		tid2 := tid1 + 1
+		tid3 := tid1 + 2
+		key := keys[i%3][0]
+		cfg.sendGet(tid1, key)
+		cfg.sendGet(tid2, key)
+		cfg.sendGet(tid3, key)
+		cfg.finishTransaction(tid3)
+		cfg.finishTransaction(tid2)
+		cfg.finishTransaction(tid1)
+		cfg.assertTransaction(tid3, true, nil)
+		cfg.assertTransaction(tid2, true, nil)
+		cfg.assertTransaction(tid1, true, nil)
+	}
+
+	cfg.end()
+}
+
+// Sends many batches of concurrent transactions that write to the same key over an unreliable network
+// At least one transaction from each batch should succeed
+func TestUnreliableConcurrentWriteSameKeys(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+		{"z"},
+	}
+	cfg := make_config(t, keys, true, false)
+	defer cfg.cleanup()
+
+	cfg.begin("TestUnreliableConcurrentWriteSameKeys: Concurrent writes to the same keys have at least one commit over an unreliable network")
+
+	n := 10
+
+	for i := range n {
+		tid1 := i * 3
+		tid2 := tid1 + 1
+		tid3 := tid1 + 2
+		key := keys[i%3][0]
+		cfg.sendSet(tid1, key, i)
+		cfg.sendSet(tid2, key, i)
+		cfg.sendSet(tid3, key, i)
+		cfg.finishTransaction(tid3)
+		cfg.finishTransaction(tid2)
+		cfg.finishTransaction(tid1)
+
+		succCount := 0
+		for _, tid := range []int{tid3, tid2, tid1} {
+			if cfg.waitTransaction(tid).committed {
+				succCount += 1
+			}
+		}
+		if succCount < 1 {
+			t.Fatal("Not enough successes")
+		}
+	}
+
+	cfg.end()
+}
+
+// Reads a 128KB value from a server whose link carries 128KB/s
+// The Commit reply takes longer than the phase timeout to arrive, but Commit isn't timed,
+// so the transaction should commit, while small RPCs to the other server stay fast
+func TestBandwidthLimit(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+	}
+	cfg := make_config(t, keys, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("TestBandwidthLimit: Commit a large read over a slow link")
+
+	value := strings.Repeat("v", 128*1024)
+	cfg.sendSet(0, "x", value)
+	cfg.sendSet(0, "y", 1)
+	cfg.finishTransaction(0)
+	cfg.assertTransaction(0, true, nil)
+
+	cfg.setBandwidth(0, 128*1024)
+
+	t0 := time.Now()
+	cfg.sendGet(1, "y")
+	cfg.finishTransaction(1)
+	cfg.assertTransaction(1, true, map[string]interface{}{"y": 1})
+	if d := time.Since(t0); d > phaseTimeout {
+		t.Fatalf("a transaction on the unlimited server took %v", d)
+	}
+
+	t0 = time.Now()
+	cfg.sendGet(2, "x")
+	cfg.finishTransaction(2)
+	cfg.assertTransaction(2, true, map[string]interface{}{"x": value})
+	if d := time.Since(t0); d < 900*time.Millisecond {
+		t.Fatalf("reading 128KB at 128KB/s took only %v", d)
+	}
+
+	cfg.end()
+}
+
+// Reads a 128KB value over a 128KB/s link, then writes another key on the same server
+// With Prepare, PreCommit and Abort in the high-priority lane, the write should reach
+// PreCommit while the slow Commit reply is still crossing, rather than queue behind it
+func TestPriorityLanes(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x", "w"},
+	}
+	cfg := make_config(t, keys, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("TestPriorityLanes: Small RPCs overtake a large Commit reply")
+
+	value := strings.Repeat("v", 128*1024)
+	cfg.sendSet(0, "x", value)
+	cfg.finishTransaction(0)
+	cfg.assertTransaction(0, true, nil)
+
+	for _, method := range []string{"Server.Prepare", "Server.PreCommit", "Server.Abort"} {
+		cfg.setPriority(method, labrpc.High)
+	}
+	cfg.setBandwidth(0, 128*1024)
+
+	cfg.sendGet(1, "x")
+	cfg.finishTransaction(1)
+	time.Sleep(100 * time.Millisecond)
+
+	t0 := time.Now()
+	cfg.sendSet(2, "w", 2)
+	cfg.finishTransaction(2)
+	for {
+		if state, _ := cfg.servers[0].transactionState(2); state == statePreCommitted || state == stateCommitted {
+			break
+		}
+		if d := time.Since(t0); d > 300*time.Millisecond {
+			t.Fatalf("transaction 2 wasn't precommitted after %v behind a 128KB Commit reply", d)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	// its Commit still queues behind the reply
+	cfg.assertTransaction(2, true, nil)
+	cfg.assertTransaction(1, true, map[string]interface{}{"x": value})
+
+	cfg.end()
+}
+
+// Makes one server's link 10x slower than the others
+// Transactions should still commit, and concurrent writers should still be serialized
+func TestSlowServer(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+		{"z"},
+	}
+	cfg := make_config(t, keys, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("TestSlowServer: Commit and serialize when one server is 10x slower")
+
+	cfg.setLatency(0, 2*time.Millisecond)
+	cfg.setLatency(1, 2*time.Millisecond)
+	cfg.setLatency(2, 20*time.Millisecond)
+
+	cfg.sendSet(0, "x", 0)
+	cfg.sendSet(0, "y", 0)
+	cfg.sendSet(0, "z", 0)
+	cfg.finishTransaction(0)
+	cfg.assertTransaction(0, true, nil)
+
+	n := 5
+
+	for i := range n {
+		m := 3
+		tidBase := i*(m+1) + 1
+		for j := range m {
+			tid := tidBase + j
+			cfg.sendSet(tid, "x", tid)
+			cfg.sendSet(tid, "y", tid)
+			cfg.sendSet(tid, "z", tid)
+		}
+
+		for j := range m {
+			cfg.finishTransaction(tidBase + j)
+		}
+
+		for j := range m {
+			cfg.waitTransaction(tidBase + j)
+		}
+
+		tid := tidBase + m
+		cfg.sendGet(tid, "x")
+		cfg.sendGet(tid, "y")
+		cfg.sendGet(tid, "z")
+		cfg.finishTransaction(tid)
+		resp := cfg.assertTransaction(tid, true, nil)
+		x := resp.readValues["x"].(int)
+		y := resp.readValues["y"].(int)
+		z := resp.readValues["z"].(int)
+		if x != y || x != z {
+			t.Fatal("read values don't match")
+		}
+	}
+
+	cfg.end()
+}
+
+// Loses a Commit request and a Commit reply
+// The coordinator should resend Commit, and the read values should survive the lost reply
+func TestDropCommit(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+		{"z"},
+	}
+	cfg := make_config(t, keys, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("TestDropCommit: Lost Commit messages are resent")
+
+	cfg.sendSet(0, "x", 1)
+	cfg.sendSet(0, "y", 2)
+	cfg.sendSet(0, "z", 3)
+	cfg.dropNext("Server.Commit", 0)
+	cfg.finishTransaction(0)
+	cfg.assertTransaction(0, true, nil)
+
+	cfg.sendGet(1, "x")
+	cfg.sendGet(1, "y")
+	cfg.sendGet(1, "z")
+	cfg.dropReplyNext("Server.Commit", 1)
+	cfg.finishTransaction(1)
+	cfg.assertTransaction(1, true, map[string]interface{}{
+		"x": 1,
+		"y": 2,
+		"z": 3,
+	})
+
+	cfg.end()
+}
+
+// Loses the third PreCommit to server 2, and only that one
+// Every transaction commits, and only the third costs an extra RPC
+func TestInterceptNth(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+		{"z"},
+	}
+	cfg := make_config(t, keys, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("TestInterceptNth: Only the chosen message is lost")
+
+	cfg.interceptNth("Server.PreCommit", 2, 3, labrpc.Fault{DropRequest: true})
+
+	// don't count the coordinator's startup Queries
+	cfg.awaitQueries(len(keys))
+
+	rpcs := make([]int, 4)
+	for tid := range rpcs {
+		before := cfg.rpcTotal()
+		cfg.sendSet(tid, "x", tid)
+		cfg.sendSet(tid, "z", tid)
+		cfg.finishTransaction(tid)
+		cfg.assertTransaction(tid, true, nil)
+		rpcs[tid] = cfg.rpcTotal() - before
+	}
+
+	if rpcs[1] != rpcs[0] || rpcs[2] != rpcs[0]+1 || rpcs[3] != rpcs[0] {
+		t.Fatalf("transactions took %v RPCs; expected one extra for the third", rpcs)
+	}
+
+	cfg.end()
+}
+
+// Counts the RPCs each server gets for one transaction on two of three servers
+// The third server only hears Prepare, and says it isn't involved
+func TestRPCAccounting(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+		{"z"},
+	}
+	cfg := make_config(t, keys, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("TestRPCAccounting: Each server gets the expected RPCs")
+
+	// don't count the coordinator's startup Queries
+	cfg.awaitQueries(len(keys))
+
+	before := make(map[int]map[string]labrpc.Stats)
+	for i := range keys {
+		before[i] = make(map[string]labrpc.Stats)
+		for _, method := range serverMethods {
+			before[i][method] = cfg.rpcStats(i, method)
+		}
+	}
+
+	cfg.sendSet(0, "x", 1)
+	cfg.sendGet(0, "y")
+	cfg.finishTransaction(0)
+	cfg.assertTransaction(0, true, map[string]interface{}{"y": nil})
+
+	want := map[int]map[string]int{
+		0: {"Server.Prepare": 1, "Server.PreCommit": 1, "Server.Commit": 1},
+		1: {"Server.Prepare": 1, "Server.PreCommit": 1, "Server.Commit": 1},
+		2: {"Server.Prepare": 1},
+	}
+	for i := range keys {
+		for _, method := range serverMethods {
+			st := cfg.rpcStats(i, method)
+			if n := st.Count - before[i][method].Count; n != want[i][method] {
+				t.Fatalf("server %d got %d %s RPCs; expected %d", i, n, method, want[i][method])
+			}
+			if st.Count > before[i][method].Count && st.Bytes <= before[i][method].Bytes {
+				t.Fatalf("server %d's %s RPCs weren't counted in bytes", i, method)
+			}
+		}
+	}
+
+	cfg.end()
+}
+
+// Aborts a transaction because a server is disconnected, and checks the per-method statistics
+// The failed Prepares should be counted with their latency, and no PreCommit or Commit sent
+func TestMethodStats(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+	}
+	cfg := make_config(t, keys, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("TestMethodStats: An aborted transaction sends no PreCommit or Commit")
+
+	cfg.awaitQueries(len(keys))
+	before := make(map[string]labrpc.MethodStats)
+	for _, method := range serverMethods {
+		before[method] = cfg.methodStats(method)
+	}
+
+	cfg.disconnect(1)
+	cfg.sendSet(0, "x", 1)
+	cfg.sendSet(0, "y", 1)
+	cfg.finishTransaction(0)
+	cfg.assertTransaction(0, false, nil)
+	cfg.connect(1)
+
+	for _, method := range []string{"Server.PreCommit", "Server.Commit"} {
+		if n := cfg.methodStats(method).Count - before[method].Count; n != 0 {
+			t.Fatalf("an aborted transaction sent %d %s RPCs", n, method)
+		}
+	}
+
+	prepare := cfg.methodStats("Server.Prepare")
+	if prepare.Failures == before["Server.Prepare"].Failures {
+		t.Fatalf("no failed Prepares counted for a disconnected server")
+	}
+	if prepare.Returned > prepare.Count || prepare.Failures > prepare.Returned {
+		t.Fatalf("inconsistent Prepare statistics %+v", prepare)
+	}
+	if prepare.MeanLatency() <= 0 || prepare.MaxLatency < prepare.MeanLatency() {
+		t.Fatalf("wrong Prepare latencies %+v", prepare)
+	}
+
+	cfg.end()
+}
+
+// Watches the protocol's messages on the network, and makes the PreCommit acks for one transaction lie
+// The coordinator should abort that transaction without ever sending its Commit, leaving the stores as they were
+func TestTamperedReplies(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+	}
+	cfg := make_config(t, keys, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("TestTamperedReplies: Abort when PreCommit acks are tampered with")
+
+	var mu sync.Mutex
+	commits := make(map[int]int) // tid : Commits delivered
+	cfg.onMessage(func(m *labrpc.Message) {
+		args, ok := m.Args.(*RPCArgs)
+		if !ok {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if m.Point == labrpc.AtDeliver && m.SvcMeth == "Server.Commit" {
+			commits[args.Tid]++
+		}
+		if m.Point == labrpc.AtReply && m.SvcMeth == "Server.PreCommit" && args.Tid == 1 {
+			m.Reply.(*PreCommitReply).Ack = false
+		}
+	})
+
+	cfg.sendSet(0, "x", 1)
+	cfg.sendSet(0, "y", 1)
+	cfg.finishTransaction(0)
+	cfg.assertTransaction(0, true, nil)
+
+	cfg.sendSet(1, "x", 2)
+	cfg.sendSet(1, "y", 2)
+	cfg.finishTransaction(1)
+	cfg.assertTransaction(1, false, nil)
+
+	cfg.sendGet(2, "x")
+	cfg.sendGet(2, "y")
+	cfg.finishTransaction(2)
+	cfg.assertTransaction(2, true, map[string]interface{}{"x": 1, "y": 1})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if commits[0] != 2 || commits[1] != 0 || commits[2] != 2 {
+		t.Fatalf("Commits delivered per transaction %v; expected 2 for 0 and 2, and none for 1", commits)
+	}
+
+	cfg.end()
+}
+
+// Delivers every kind of protocol message twice
+// Duplicates must not take or release locks a second time, so later transactions still succeed
+func TestDuplicateMessages(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+		{"z"},
+	}
+	cfg := make_config(t, keys, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("TestDuplicateMessages: Duplicated messages are harmless")
+
+	cfg.sendSet(0, "x", 1)
+	cfg.sendSet(0, "y", 1)
+	cfg.sendSet(0, "z", 1)
+	cfg.duplicateNext("Server.Prepare", anyServer)
+	cfg.duplicateNext("Server.PreCommit", anyServer)
+	cfg.duplicateNext("Server.Commit", anyServer)
+	cfg.finishTransaction(0)
+	cfg.assertTransaction(0, true, nil)
+
+	cfg.sendSet(1, "x", 2)
+	cfg.duplicateNext("Server.Abort", 0)
+	cfg.disconnect(1)
+	cfg.sendSet(1, "y", 2)
+	cfg.finishTransaction(1)
+	cfg.assertTransaction(1, false, nil)
+	cfg.connect(1)
+
+	time.Sleep(50 * time.Millisecond) // give the servers time to finish aborting
+
+	cfg.sendGet(2, "x")
+	cfg.sendGet(2, "y")
+	cfg.sendGet(2, "z")
+	cfg.finishTransaction(2)
+	cfg.assertTransaction(2, true, map[string]interface{}{
+		"x": 1,
+		"y": 1,
+		"z": 1,
+	})
+
+	cfg.end()
+}
+
+// Damages replies in flight: a flipped vote, a claim that a server
+// holds no operations, and lost read values
+// The coordinator must never commit on a damaged reply
+func TestCorruptReplies(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+		{"z"},
+	}
+	cfg := make_config(t, keys, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("TestCorruptReplies: Damaged replies don't commit bad data")
+
+	cfg.sendSet(0, "x", 1)
+	cfg.sendSet(0, "y", 1)
+	cfg.sendSet(0, "z", 1)
+	cfg.finishTransaction(0)
+	cfg.assertTransaction(0, true, nil)
+
+	// a Yes flipped to No aborts
+	cfg.sendSet(1, "x", 2)
+	cfg.sendSet(1, "y", 2)
+	cfg.modifyPrepareReplyNext(1, func(reply *PrepareReply) { reply.Vote = false })
+	cfg.finishTransaction(1)
+	cfg.assertTransaction(1, false, nil)
+
+	// a No flipped to Yes (w isn't a key, so server 0 votes No)
+	// aborts when the server doesn't acknowledge PreCommit
+	cfg.sendSet(2, "w", 3)
+	cfg.sendSet(2, "y", 3)
+	cfg.modifyPrepareReplyNext(0, func(reply *PrepareReply) { reply.Vote = true })
+	cfg.finishTransaction(2)
+	cfg.assertTransaction(2, false, nil)
+
+	// a server that votes Yes but claims it isn't relevant is heard
+	// again, rather than left out of the commit
+	cfg.sendSet(3, "x", 4)
+	cfg.sendSet(3, "z", 4)
+	cfg.modifyPrepareReplyNext(2, func(reply *PrepareReply) { reply.Relevant = false })
+	cfg.finishTransaction(3)
+	cfg.assertTransaction(3, true, nil)
+
+	// lost read values are fetched again
+	cfg.sendGet(4, "x")
+	cfg.sendGet(4, "y")
+	cfg.modifyCommitReplyNext(1, func(reply *CommitReply) { reply.ReadValues = nil })
+	cfg.finishTransaction(4)
+	cfg.assertTransaction(4, true, map[string]interface{}{
+		"x": 4,
+		"y": 1,
+	})
+
+	time.Sleep(50 * time.Millisecond) // give the servers time to finish aborting
+
+	cfg.assertStoreEquals(0, map[string]interface{}{"x": 4})
+	cfg.assertStoreEquals(1, map[string]interface{}{"y": 1})
+	cfg.assertStoreEquals(2, map[string]interface{}{"z": 4})
+
+	cfg.end()
+}
+
+// Holds back a PreCommit so that it arrives after the other phase messages
+// The transaction should still commit
+func TestDelayPreCommit(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+		{"z"},
+	}
+	cfg := make_config(t, keys, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("TestDelayPreCommit: A reordered PreCommit doesn't prevent the commit")
+
+	cfg.sendSet(0, "x", 1)
+	cfg.sendSet(0, "y", 1)
+	cfg.sendSet(0, "z", 1)
+	cfg.delayNext("Server.PreCommit", 2, 50*time.Millisecond)
+	cfg.finishTransaction(0)
+	cfg.assertTransaction(0, true, nil)
+
+	cfg.end()
+}
+
+// Crashes a server and restarts the coordinator at the same time, just before the first Commit
+// The new coordinator should wait for the server to come back and then commit
+func TestScenarioCrashDuringRecovery(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+		{"z"},
+	}
+	cfg := make_config(t, keys, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("TestScenarioCrashDuringRecovery: Recovery waits for a crashed server before committing")
+
+	cfg.run(
+		doSet(0, "x", 1),
+		doSet(0, "y", 1),
+		doSet(0, "z", 1),
+		atNextCommit(doCrashServer(0), doRestartCoordinator()),
+		doFinish(0),
+		awaitCommit(),
+		expectBlocked(0, 50*time.Millisecond),
+		doRestartServer(0),
+		expectCommit(0, nil),
+
+		doGet(1, "x"),
+		doGet(1, "y"),
+		doGet(1, "z"),
+		doFinish(1),
+		expectCommit(1, map[string]interface{}{"x": 1, "y": 1, "z": 1}),
+	)
+
+	cfg.end()
+}
+
+// Partitions the coordinator away from a server just before PreCommit, then heals it
+// The transaction should abort, and a later transaction should still see the old values
+func TestScenarioPartitionPreCommit(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+		{"z"},
+	}
+	cfg := make_config(t, keys, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("TestScenarioPartitionPreCommit: A partition before PreCommit aborts")
+
+	cfg.run(
+		doSet(0, "x", 1),
+		doSet(0, "y", 1),
+		doFinish(0),
+		expectCommit(0, nil),
+
+		doSet(1, "x", 2),
+		doSet(1, "y", 2),
+		atNextPreCommit(doPartition([]int{coordinatorId, 0, 2}, []int{1})),
+		doFinish(1),
+		expectAbort(1),
+		doHeal(),
+		doSleep(50*time.Millisecond),
+
+		doGet(2, "x"),
+		doGet(2, "y"),
+		doFinish(2),
+		expectCommit(2, map[string]interface{}{"x": 1, "y": 1}),
+	)
+
+	cfg.end()
+}
+
+// Partitions the coordinator away from a server after one server has heard Commit, then heals it
+// The transaction should still commit everywhere once the partition heals
+func TestScenarioPartitionNthCommit(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+		{"z"},
+	}
+	cfg := make_config(t, keys, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("TestScenarioPartitionNthCommit: A partition in the middle of Commit still commits")
+
+	cfg.run(
+		doSet(0, "x", 1),
+		doSet(0, "y", 1),
+		doSet(0, "z", 1),
+		atNthCommit(2, doPartition([]int{coordinatorId, 0, 1}, []int{2})),
+		doFinish(0),
+		awaitCommit(),
+		doSleep(50*time.Millisecond),
+		doHeal(),
+		expectCommit(0, nil),
+
+		doGet(1, "x"),
+		doGet(1, "y"),
+		doGet(1, "z"),
+		doFinish(1),
+		expectCommit(1, map[string]interface{}{"x": 1, "y": 1, "z": 1}),
+	)
+
+	cfg.end()
+}
+
+// Pauses a server as PreCommit starts, then resumes it
+// The coordinator should wait out the pause rather than abort, and commit
+func TestScenarioPausePreCommit(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+		{"z"},
+	}
+	cfg := make_config(t, keys, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("TestScenarioPausePreCommit: A server paused during PreCommit still commits")
+
+	cfg.setPhaseTimeout(100 * time.Millisecond)
+
+	cfg.run(
+		doSet(0, "x", 1),
+		doSet(0, "y", 1),
+		doSet(0, "z", 1),
+		atNextPreCommit(doPause(1)),
+		doFinish(0),
+		awaitPreCommit(),
+		expectBlocked(0, 300*time.Millisecond),
+		doResume(1),
+		expectCommit(0, nil),
+
+		doGet(1, "x"),
+		doGet(1, "y"),
+		doGet(1, "z"),
+		doFinish(1),
+		expectCommit(1, map[string]interface{}{"x": 1, "y": 1, "z": 1}),
+	)
+
+	cfg.end()
+}
+
+// Restarts the coordinator between transactions
+// The new coordinator queries every server exactly once
+func TestRecoveryQueries(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+		{"z"},
+	}
+	cfg := make_config(t, keys, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("TestRecoveryQueries: A restarted coordinator queries every server once")
+
+	cfg.awaitQueries(len(keys))
+
+	cfg.sendSet(0, "x", 1)
+	cfg.sendSet(0, "y", 1)
+	cfg.sendSet(0, "z", 1)
+	cfg.finishTransaction(0)
+	cfg.assertTransaction(0, true, nil)
+
+	if n := cfg.queryCount(); n != len(keys) {
+		t.Fatalf("the first coordinator sent %d Queries; expected %d", n, len(keys))
+	}
+
+	cfg.mu.Lock()
+	cfg.restartCoordinatorLocked()
+	cfg.mu.Unlock()
+
+	cfg.awaitQueries(2 * len(keys))
+	time.Sleep(50 * time.Millisecond)
+	if n := cfg.queryCount(); n != 2*len(keys) {
+		t.Fatalf("the restarted coordinator sent %d Queries; expected %d", n-len(keys), len(keys))
+	}
+
+	cfg.end()
+}
+
+// Restarts the coordinator before Commit, then restarts the recovering
+// coordinator again while it is still querying servers
+// The third coordinator recovers and commits
+func TestScenarioCrashDuringQuery(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+		{"z"},
+	}
+	cfg := make_config(t, keys, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("TestScenarioCrashDuringQuery: A coordinator that crashes while recovering is recovered in turn")
+
+	cfg.awaitQueries(len(keys))
+
+	cfg.run(
+		doSet(0, "x", 1),
+		doSet(0, "y", 1),
+		doSet(0, "z", 1),
+		atNextCommit(doRestartCoordinator()),
+		atNextQuery(doRestartCoordinator()),
+		doFinish(0),
+		awaitCommit(),
+		awaitQuery(),
+		expectCommit(0, nil),
+
+		doGet(1, "x"),
+		doGet(1, "y"),
+		doGet(1, "z"),
+		doFinish(1),
+		expectCommit(1, map[string]interface{}{"x": 1, "y": 1, "z": 1}),
+	)
+
+	// the interrupted recovery sent at least one Query, and the
+	// one after it queried every server
+	if n := cfg.queryCount(); n < 2*len(keys)+1 {
+		t.Fatalf("coordinators sent %d Queries; expected at least %d", n, 2*len(keys)+1)
+	}
+
+	cfg.end()
+}
+
+// Runs two coordinators side by side, each finishing its own transactions
+// on the same keys
+func TestTwoCoordinators(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+		{"z"},
+	}
+	cfg := make_config(t, keys, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("TestTwoCoordinators: Two coordinators commit concurrent transactions")
+
+	// both coordinators recover at startup; wait until neither will
+	// pick up a transaction the other is running
+	cfg.awaitQueries(len(keys))
+	c := cfg.startExtraCoordinator()
+	cfg.awaitQueries(2 * len(keys))
+
+	for tid := range 10 {
+		cfg.sendSet(tid, "x", tid)
+		cfg.sendSet(tid, "y", tid)
+		cfg.sendSet(tid, "z", tid)
+		cfg.finishTransactionOn(tid%2*c, tid)
+	}
+	for tid := range 10 {
+		cfg.assertTransaction(tid, true, nil)
+	}
+
+	cfg.sendGet(10, "x")
+	cfg.sendGet(10, "y")
+	cfg.sendGet(10, "z")
+	cfg.finishTransactionOn(c, 10)
+	resp := cfg.assertTransaction(10, true, nil)
+	if resp.readValues["x"] != resp.readValues["y"] || resp.readValues["y"] != resp.readValues["z"] {
+		t.Fatalf("read %v; expected all keys written by the same transaction", resp.readValues)
+	}
+
+	cfg.end()
+}
+
+// Finishes the same transaction on two coordinators at once
+// Both must reach, and report, the same decision
+func TestDuplicateDecision(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+		{"z"},
+	}
+	cfg := make_config(t, keys, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("TestDuplicateDecision: Two coordinators finishing one transaction agree")
+
+	cfg.mu.Lock()
+	cfg.duplicates = true // both coordinators report the transaction
+	cfg.mu.Unlock()
+
+	// both coordinators recover at startup; wait until neither will
+	// pick up a transaction the other is running
+	cfg.awaitQueries(len(keys))
+	c := cfg.startExtraCoordinator()
+	cfg.awaitQueries(2 * len(keys))
+
+	cfg.sendSet(0, "x", 1)
+	cfg.finishTransaction(0)
+	cfg.assertTransaction(0, true, nil)
+
+	cfg.sendGet(1, "x")
+	cfg.sendSet(1, "y", 2)
+	cfg.sendSet(1, "z", 3)
+	cfg.finishTransactionOn(0, 1)
+	cfg.finishTransactionOn(c, 1)
+	cfg.assertTransaction(1, true, map[string]interface{}{"x": 1})
+
+	// give the slower coordinator time to report; a different
+	// decision or different values fail the test in apply()
+	time.Sleep(100 * time.Millisecond)
+
+	cfg.sendGet(2, "x")
+	cfg.sendGet(2, "y")
+	cfg.sendGet(2, "z")
+	cfg.finishTransactionOn(c, 2)
+	cfg.assertTransaction(2, true, map[string]interface{}{
+		"x": 1,
+		"y": 2,
+		"z": 3,
+	})
+
+	cfg.end()
+}
+
+// Cuts the coordinator off before Commit and starts a replacement, which
+// recovers and commits; then the old coordinator comes back and finishes
+// the same transaction
+func TestScenarioSplitBrain(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+		{"z"},
+	}
+	cfg := make_config(t, keys, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("TestScenarioSplitBrain: A coordinator that wasn't really dead agrees with its replacement")
+
+	cfg.mu.Lock()
+	cfg.duplicates = true // both coordinators report the transaction
+	cfg.mu.Unlock()
+
+	cfg.run(
+		doSet(0, "x", 1),
+		doSet(0, "y", 1),
+		doSet(0, "z", 1),
+		atNextCommit(doIsolateCoordinator(0), doStartExtraCoordinator()),
+		doFinish(0),
+		awaitCommit(),
+		expectCommit(0, nil),
+
+		doReconnectCoordinator(0),
+		doSleep(100*time.Millisecond),
+
+		doGet(1, "x"),
+		doGet(1, "y"),
+		doGet(1, "z"),
+		doFinishOn(1, 1),
+		expectCommit(1, map[string]interface{}{"x": 1, "y": 1, "z": 1}),
+	)
+
+	cfg.end()
+}
+
+// Runs concurrent clients while randomly disconnecting servers,
+// restarting the coordinator and dropping messages
+// Clients resend lost transactions, and the history must stay serializable
+func TestChaos(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"a", "b"},
+		{"c", "d"},
+		{"e", "f"},
+	}
+	cfg := make_config(t, keys, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("TestChaos: Transactions stay serializable under random faults")
+
+	all := []string{"a", "b", "c", "d", "e", "f"}
+	const chaosDuration = 3 * time.Second
+	const nclients = 3
+
+	cfg.mu.Lock()
+	cfg.duplicates = true // a restarted coordinator may report a transaction again
+	cfg.mu.Unlock()
+
+	var stop atomic.Bool
+	var nextTid atomic.Int64
+	var wg sync.WaitGroup
+
+	for range nclients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stop.Load() {
+				tid := int(nextTid.Add(1))
+
+				n := 1 + cfg.randInt()%3
+				for range n {
+					key := all[cfg.randInt()%len(all)]
+					if cfg.randInt()%2 == 0 {
+						cfg.sendGet(tid, key)
+					} else {
+						cfg.sendSet(tid, key, tid)
+					}
+				}
+
+				cfg.finishTransaction(tid)
+				cfg.waitTransactionRetrying(tid, 500*time.Millisecond, time.Now().Add(10*time.Second))
+			}
+		}()
+	}
+
+	for start := time.Now(); time.Since(start) < chaosDuration; {
+		cfg.mu.Lock()
+		switch cfg.randIntLocked() % 5 {
+		case 0:
+			cfg.disconnect(cfg.randIntLocked() % cfg.n)
+		case 1:
+			cfg.connect(cfg.randIntLocked() % cfg.n)
+		case 2:
+			cfg.restartCoordinatorLocked()
+		case 3:
+			cfg.setunreliable(cfg.randIntLocked()%2 == 0)
+		case 4:
+			cfg.connectAll()
+		}
+		pause := time.Duration(cfg.randIntLocked()%200) * time.Millisecond
+		cfg.mu.Unlock()
+		time.Sleep(pause)
+	}
+
+	cfg.mu.Lock()
+	cfg.setunreliable(false)
+	cfg.connectAll()
+	cfg.mu.Unlock()
+
+	stop.Store(true)
+	wg.Wait()
+
+	cfg.end()
+}
+
+// Runs the same transactions twice with the same seed on an unreliable network
+// with a second of latency to each server, all on a virtual clock
+// Both runs should send the same RPCs and finish at the same virtual time,
+// taking far less real time than virtual time
+func TestVirtualTime(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+	}
+	seed := makeSeed(t)
+
+	run := func(name string) (int, time.Duration) {
+		cfg := makeSeededConfig(t, keys, true, false, seed)
+		defer cfg.cleanup()
+
+		cfg.begin("TestVirtualTime: " + name)
+		clock := cfg.useVirtualTime()
+		start := clock.Now()
+		cfg.setPhaseTimeout(time.Minute) // room for lost RPCs at a second each
+		for i := range keys {
+			cfg.setLatency(i, time.Second)
+		}
+
+		rpcs := cfg.rpcTotal()
+		for tid := 0; tid < 5; tid++ {
+			cfg.sendSet(tid, "x", tid)
+			cfg.sendGet(tid, "y")
+			cfg.finishTransaction(tid)
+			cfg.assertTransaction(tid, true, map[string]interface{}{"y": nil})
+		}
+		rpcs = cfg.rpcTotal() - rpcs
+		elapsed := clock.Now().Sub(start)
+
+		cfg.end()
+		return rpcs, elapsed
+	}
+
+	t0 := time.Now()
+	rpcs1, elapsed1 := run("A seeded run on a virtual clock")
+	rpcs2, elapsed2 := run("The same run again")
+	if real := time.Since(t0); real > elapsed1/2 {
+		t.Fatalf("%v of virtual time took %v of real time", elapsed1, real)
+	}
+	if rpcs1 != rpcs2 || elapsed1 != elapsed2 {
+		t.Fatalf("runs with seed %d differ: %d RPCs in %v, then %d RPCs in %v", seed, rpcs1, elapsed1, rpcs2, elapsed2)
+	}
+	if elapsed1 < 5*6*time.Second {
+		t.Fatalf("5 transactions with a second of latency per RPC took only %v of virtual time", elapsed1)
+	}
+}
+
+// Disconnects a server with the coordinator on a simulated clock
+// The coordinator keeps retrying Prepare until the test moves time past the timeout
+func TestSimClockPrepareTimeout(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+		{"z"},
+	}
+	cfg := make_config(t, keys, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("TestSimClockPrepareTimeout: Prepare times out only when the clock passes the timeout")
+
+	clock := cfg.useSimClock()
+
+	cfg.run(
+		doSet(0, "x", 1),
+		doSet(0, "y", 1),
+		doFinish(0),
+		expectCommit(0, nil),
+
+		doDisconnect(2),
+		doSet(1, "x", 2),
+		doSet(1, "z", 2),
+		doFinish(1),
+		expectBlocked(1, 500*time.Millisecond),
+	)
+
+	clock.Advance(phaseTimeout / 2)
+	cfg.run(expectBlocked(1, 200*time.Millisecond))
+
+	clock.Advance(phaseTimeout / 2)
+	cfg.run(
+		expectAbort(1),
+		doConnect(2),
+		doSleep(50*time.Millisecond),
+
+		doGet(2, "x"),
+		doFinish(2),
+		expectCommit(2, map[string]interface{}{"x": 1}),
+	)
+
+	cfg.end()
+}
+
+// Shortens the phase timeout with the coordinator on a simulated clock
+// Prepare gives up after the shorter timeout, also after a coordinator restart
+func TestSimClockShortTimeout(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+		{"z"},
+	}
+	cfg := make_config(t, keys, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("TestSimClockShortTimeout: Prepare times out after a shortened timeout")
+
+	const timeout = phaseTimeout / 10
+	clock := cfg.useSimClock()
+	cfg.setPhaseTimeout(timeout)
+
+	cfg.run(
+		doDisconnect(2),
+		doSet(0, "x", 1),
+		doSet(0, "z", 1),
+		doFinish(0),
+		expectBlocked(0, 200*time.Millisecond),
+	)
+
+	clock.Advance(timeout)
+	cfg.run(
+		expectAbort(0),
+		doConnect(2),
+		doSleep(50*time.Millisecond), // let the Abort reach server 2
+		doRestartCoordinator(),
+		doSleep(50*time.Millisecond),
+
+		doDisconnect(2),
+		doSet(1, "x", 2),
+		doSet(1, "z", 2),
+		doFinish(1),
+		expectBlocked(1, 200*time.Millisecond),
+	)
+
+	clock.Advance(timeout)
+	cfg.run(
+		expectAbort(1),
+		doConnect(2),
+		doSleep(50*time.Millisecond),
+
+		doGet(2, "x"),
+		doGet(2, "z"),
+		doFinish(2),
+		expectCommit(2, map[string]interface{}{"x": nil, "z": nil}),
+	)
+
+	cfg.end()
+}
+
+// Disconnects a server before PreCommit with the coordinator on a simulated clock
+// Reconnecting it before the timeout lets the transaction commit
+func TestSimClockPreCommitReconnect(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+		{"z"},
+	}
+	cfg := make_config(t, keys, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("TestSimClockPreCommitReconnect: A server back before the PreCommit timeout commits")
+
+	clock := cfg.useSimClock()
+
+	cfg.run(
+		doSet(0, "x", 1),
+		doSet(0, "y", 1),
+		atNextPreCommit(doDisconnect(1)),
+		doFinish(0),
+		awaitPreCommit(),
+		expectBlocked(0, 500*time.Millisecond),
+	)
+
+	clock.Advance(phaseTimeout - time.Millisecond)
+	cfg.run(
+		doConnect(1),
+		expectCommit(0, nil),
+	)
+
+	cfg.end()
+}
+
+// Runs randomly generated mixes of reads, writes and read-writes over groups of keys
+// Every group's values must keep the same total in every read and at the end
+func TestWorkloadConservation(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"a", "b", "c"},
+		{"d", "e", "f"},
+		{"g", "h", "i"},
+	}
+	cfg := make_config(t, keys, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("TestWorkloadConservation: Random transaction mixes keep every group's total")
+
+	for range 3 {
+		w := cfg.makeWorkload()
+		cfg.logf("workload: %v", w)
+		cfg.runWorkload(w)
+	}
+
+	cfg.end()
+}
+
+// Like TestWorkloadConservation, over an unreliable network
+func TestUnreliableWorkloadConservation(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"a", "b", "c"},
+		{"d", "e", "f"},
+		{"g", "h", "i"},
+	}
+	cfg := make_config(t, keys, true, false)
+	defer cfg.cleanup()
+
+	cfg.begin("TestUnreliableWorkloadConservation: Random transaction mixes keep every group's total over an unreliable network")
+
+	for range 3 {
+		w := cfg.makeWorkload()
+		cfg.logf("workload: %v", w)
+		cfg.runWorkload(w)
+	}
+
+	cfg.end()
+}
+
+// Sweeps the share of transactions that touch one hot key from none to all
+// Conflicting transactions should wait for each other, so every kind of
+// transaction keeps committing and few abort
+func TestContentionSweep(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"hot"},
+		{"a", "b"},
+		{"c", "d"},
+	}
+	cfg := make_config(t, keys, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("TestContentionSweep: Transactions commit at every level of contention")
+
+	const maxAbortPct = 20
+	for _, pct := range []int{0, 25, 50, 75, 100} {
+		c := contention{hot: "hot", cold: []string{"a", "b", "c", "d"}, hotPct: pct, txns: 10}
+		r := cfg.runContention(c)
+		fmt.Printf("  ... contention %d%%: %v\n", pct, r)
+
+		if r.hotTxns > 0 && r.hotCommits == 0 {
+			t.Fatalf("contention %d%%: none of %d transactions on the hot key committed", pct, r.hotTxns)
+		}
+		for client := range c.cold {
+			if r.coldTxns[client] > 0 && r.coldCommits[client] == 0 {
+				t.Fatalf("contention %d%%: none of client %d's %d transactions committed", pct, client, r.coldTxns[client])
+			}
+		}
+		if aborts := r.txns() - r.commits(); aborts*100 > r.txns()*maxAbortPct {
+			t.Fatalf("contention %d%%: %d of %d transactions aborted; expected at most %d%%", pct, aborts, r.txns(), maxAbortPct)
+		}
+	}
+
+	cfg.end()
+}
+
+// Commits enough transactions for every server to snapshot, crashes a
+// server holding locks for an in-doubt transaction, then restarts every
+// server from its snapshot and log
+func TestSnapshotServerRestart(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+		{"z"},
+	}
+	cfg := make_config(t, keys, false, true)
+	defer cfg.cleanup()
+
+	cfg.begin("TestSnapshotServerRestart: Servers restore committed values and held locks from snapshots")
+
+	for tid := range 20 {
+		cfg.sendSet(tid, "x", tid)
+		cfg.sendSet(tid, "y", tid)
+		cfg.sendSet(tid, "z", tid)
+		cfg.finishTransaction(tid)
+		cfg.assertTransaction(tid, true, nil)
+	}
+
+	cfg.sendSet(20, "x", 20)
+	cfg.sendSet(20, "y", 20)
+	cfg.sendSet(20, "z", 20)
+	cfg.doNextCommit(func() bool {
+		cfg.crashServerLocked(0)
+		return true
+	})
+	cfg.finishTransaction(20)
+
+	time.Sleep(50 * time.Millisecond)
+	cfg.assertNoTransaction(20)
+
+	cfg.restartServer(0)
+	cfg.assertTransaction(20, true, nil)
+
+	for i := range keys {
+		cfg.restartServer(i)
+	}
+	cfg.assertStoreEquals(0, map[string]interface{}{"x": 20})
+	cfg.assertStoreEquals(1, map[string]interface{}{"y": 20})
+	cfg.assertStoreEquals(2, map[string]interface{}{"z": 20})
+
+	cfg.sendGet(21, "x")
+	cfg.sendGet(21, "y")
+	cfg.sendGet(21, "z")
+	cfg.finishTransaction(21)
+	cfg.assertTransaction(21, true, map[string]interface{}{
+		"x": 20,
+		"y": 20,
+		"z": 20,
+	})
+
+	cfg.checkSnapshots()
+	cfg.end()
+}
+
+// Runs random workloads while servers keep crashing and restarting
+// from their snapshots
+func TestSnapshotWorkloadRestarts(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"a", "b", "c"},
+		{"d", "e", "f"},
+		{"g", "h", "i"},
+	}
+	cfg := make_config(t, keys, false, true)
+	defer cfg.cleanup()
+
+	cfg.begin("TestSnapshotWorkloadRestarts: Random transaction mixes keep every group's total across restarts from snapshots")
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Duration(20+cfg.randInt()%50) * time.Millisecond):
+			}
+			i := cfg.randInt() % len(keys)
+			cfg.logf("restarting server %d", i)
+			cfg.restartServer(i)
+		}
+	}()
+
+	for range 3 {
+		w := cfg.makeWorkload()
+		cfg.logf("workload: %v", w)
+		cfg.runWorkload(w)
+	}
+	close(stop)
+	wg.Wait()
+
+	cfg.checkSnapshots()
+	cfg.end()
+}
+
+// Fails, drops and tears the write of a server's Yes vote; the first two
+// stop the server mid-Prepare, and a dropped sync is lost when it restarts
+// Each transaction should abort, and leave every server able to commit the next
+func TestDiskFaults(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+		{"z"},
+	}
+	cfg := make_config(t, keys, false, true)
+	defer cfg.cleanup()
+
+	cfg.begin("TestDiskFaults: A vote that never reaches the disk aborts the transaction")
+
+	cfg.setPhaseTimeout(100 * time.Millisecond)
+
+	tid := 0
+	for _, f := range []diskFault{diskFailWrite, diskTearWrite, diskDropSync} {
+		cfg.logf("disk fault: %v", f)
+		cfg.sendSet(tid, "x", tid+1)
+		cfg.sendSet(tid, "y", tid+1)
+		cfg.sendSet(tid, "z", tid+1)
+
+		// the next write is server 0's vote
+		cfg.diskFaultNext(0, f)
+		if f == diskDropSync {
+			cfg.doNextPreCommit(func() bool {
+				cfg.restartServerLocked(0)
+				return true
+			})
+		}
+		cfg.finishTransaction(tid)
+		cfg.assertTransaction(tid, false, nil)
+		cfg.restartServer(0)
+
+		// server 0 hears the Abort once it's back; wait for it, so
+		// that writing it can't take the next fault
+		cfg.awaitHook(func() bool {
+			state, _ := cfg.servers[0].transactionState(tid)
+			return state == stateAborted
+		})
+		tid++
+
+		cfg.sendGet(tid, "x")
+		cfg.sendGet(tid, "y")
+		cfg.sendGet(tid, "z")
+		cfg.finishTransaction(tid)
+		cfg.assertTransaction(tid, true, map[string]interface{}{"x": nil, "y": nil, "z": nil})
+		tid++
+	}
+
+	cfg.end()
+}
+
+// Runs servers on simulated disks, and cuts a server's vote short, tears it, and writes
+// some of its sectors as the power goes out, then cuts the power after a vote is fsynced
+// A vote the server couldn't finish should abort its transaction and leave the server able to
+// commit the next, and one that was fsynced should survive the power loss and commit
+func TestStorageFaults(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+		{"z"},
+	}
+	cfg := make_config(t, keys, false, true)
+	defer cfg.cleanup()
+	cfg.useFaultDisks()
+
+	cfg.begin("TestStorageFaults: Servers recover from short, torn and reordered writes and power loss")
+
+	cfg.setPhaseTimeout(100 * time.Millisecond)
+
+	tid := 0
+	for _, f := range []writeFault{writeShort, writeTorn, writeReordered} {
+		cfg.logf("write fault: %v", f)
+		cfg.sendSet(tid, "x", tid+1)
+		cfg.sendSet(tid, "y", tid+1)
+		cfg.sendSet(tid, "z", tid+1)
+
+		// the next write is server 0's vote
+		cfg.writeFaultNext(0, f)
+		cfg.finishTransaction(tid)
+		cfg.assertTransaction(tid, false, nil)
+		cfg.restartServer(0)
+
+		// server 0 hears the Abort once it's back; wait for it, so
+		// that writing it can't take the next fault
+		cfg.awaitHook(func() bool {
+			state, _ := cfg.servers[0].transactionState(tid)
+			return state == stateAborted
+		})
+		tid++
+
+		cfg.sendGet(tid, "x")
+		cfg.sendGet(tid, "y")
+		cfg.sendGet(tid, "z")
+		cfg.finishTransaction(tid)
+		cfg.assertTransaction(tid, true, map[string]interface{}{"x": nil, "y": nil, "z": nil})
+		tid++
+	}
+
+	// the vote was fsynced before it was sent, so it survives
+	cfg.sendSet(tid, "x", tid+1)
+	cfg.sendSet(tid, "y", tid+1)
+	cfg.doNextPreCommit(func() bool {
+		cfg.powerLossLocked(0)
+		cfg.restartServerLocked(0)
+		return true
+	})
+	cfg.finishTransaction(tid)
+	cfg.assertTransaction(tid, true, nil)
+	tid++
+
+	cfg.sendGet(tid, "x")
+	cfg.sendGet(tid, "y")
+	cfg.finishTransaction(tid)
+	cfg.assertTransaction(tid, true, map[string]interface{}{"x": tid, "y": tid})
+
+	cfg.end()
+}
+
+// Crashes a server inside each handler, before it does anything and after it
+// has persisted its new state but before it replies, then restarts it
+// Crashing before a Commit is decided aborts; after, the transaction commits
+// with the values it read
+func TestHandlerCrashes(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+		{"z"},
+	}
+	cfg := make_config(t, keys, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("TestHandlerCrashes: A server crashing inside a handler aborts or commits cleanly")
+
+	cfg.setPhaseTimeout(100 * time.Millisecond)
+
+	cases := []struct {
+		method string
+		point  hookPoint
+		commit bool
+	}{
+		{"Server.Prepare", hookBefore, false},
+		{"Server.Prepare", hookAfter, false},
+		{"Server.PreCommit", hookBefore, false},
+		{"Server.PreCommit", hookAfter, false},
+		{"Server.Commit", hookBefore, true},
+		{"Server.Commit", hookAfter, true},
+	}
+
+	x := 0 // the value of x committed so far
+	for tid, c := range cases {
+		cfg.logf("crashing server 0 %v %s", c.point, c.method)
+		cfg.sendGet(tid, "x")
+		cfg.sendSet(tid, "x", tid+1)
+		cfg.sendSet(tid, "y", tid+1)
+		cfg.sendSet(tid, "z", tid+1)
+		cfg.doInHandler(0, c.method, c.point, func() {
+			cfg.crashServer(0)
+		})
+		cfg.finishTransaction(tid)
+
+		// long enough for the Prepare and PreCommit timeouts
+		time.Sleep(200 * time.Millisecond)
+		cfg.restartServer(0)
+
+		var read interface{}
+		if x > 0 {
+			read = x
+		}
+		if c.commit {
+			cfg.assertTransaction(tid, true, map[string]interface{}{"x": read})
+			x = tid + 1
+		} else {
+			cfg.assertTransaction(tid, false, nil)
+		}
+	}
+
+	for i, key := range []string{"x", "y", "z"} {
+		cfg.assertStoreEquals(i, map[string]interface{}{key: x})
+	}
+
+	cfg.end()
+}
+
+// Slows a server's Prepare handler down past the phase timeout
+// The coordinator waits for the reply, so the transaction still commits
+func TestSlowHandler(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+		{"z"},
+	}
+	cfg := make_config(t, keys, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("TestSlowHandler: A slow Prepare handler delays the transaction, but it commits")
+
+	cfg.setPhaseTimeout(100 * time.Millisecond)
+
+	cfg.sendSet(0, "x", 1)
+	cfg.sendSet(0, "y", 1)
+	cfg.doInHandler(1, "Server.Prepare", hookAfter, func() {
+		time.Sleep(300 * time.Millisecond)
+	})
+	cfg.finishTransaction(0)
+
+	if _, ok := cfg.waitTransactionFor(0, 200*time.Millisecond); ok {
+		cfg.t.Fatalf("transaction 0 was decided while server 1 was still handling Prepare")
+	}
+	cfg.assertTransaction(0, true, nil)
+
+	cfg.end()
+}
+
+// Adds servers while the test runs, with two coordinators running, then restarts one
+// Transactions on the new servers' keys should commit through either coordinator
+func TestAddServer(t *testing.T) {
+	t.Parallel()
+
+	keys := [][]string{
+		{"x"},
+		{"y"},
+	}
+	cfg := make_config(t, keys, false, false)
+	defer cfg.cleanup()
+
+	cfg.begin("TestAddServer: Servers added mid-test take part in transactions")
+
+	// both coordinators recover at startup; wait until neither will
+	// pick up a transaction the other is running
+	cfg.awaitQueries(len(keys))
+	c := cfg.startExtraCoordinator()
+	cfg.awaitQueries(2 * len(keys))
+
+	cfg.sendSet(0, "x", 1)
+	cfg.sendSet(0, "y", 1)
+	cfg.finishTransaction(0)
+	cfg.assertTransaction(0, true, nil)
+
+	if i := cfg.addServer([]string{"z"}); i != 2 {
+		cfg.t.Fatalf("addServer returned %d, expected 2", i)
+	}
+	cfg.sendGet(1, "x")
+	cfg.sendSet(1, "z", 2)
+	cfg.finishTransaction(1)
+	cfg.assertTransaction(1, true, map[string]interface{}{"x": 1})
+	cfg.assertStoreEquals(2, map[string]interface{}{"z": 2})
+
+	cfg.addServer([]string{"w"})
+	cfg.sendSet(2, "z", 3)
+	cfg.sendSet(2, "w", 3)
+	cfg.finishTransactionOn(c, 2)
+	cfg.assertTransaction(2, true, nil)
+
+	cfg.startCoordinator()
+	cfg.connectAll()
+	cfg.sendGet(3, "x")
+	cfg.sendGet(3, "y")
+	cfg.sendGet(3, "z")
+	cfg.sendGet(3, "w")
+	cfg.finishTransaction(3)
+	cfg.assertTransaction(3, true, map[string]interface{}{
+		"x": 1,
+		"y": 1,
+		"z": 3,
+		"w": 3,
+	})
+	cfg.assertStoreEquals(2, map[string]interface{}{"z": 3})
+	cfg.assertStoreEquals(3, map[string]interface{}{"w": 3})
+
+	cfg.end()
+}
+
+// Serves two servers and dials a coordinator through labrpcTransport, outside the tester
+// A transaction should commit, and a later one read back what it wrote
+func TestLabrpcTransport(t *testing.T) {
+	t.Parallel()
+
+	net := labrpc.MakeNetwork()
+	defer net.Cleanup()
+	tr := makeLabrpcTransport(net)
+
+	addrs := []string{"server0", "server1"}
+	servers := []*Server{
+		MakeServer([]string{"x"}, MakePersister()),
+		MakeServer([]string{"y"}, MakePersister()),
+	}
+	for i, sv := range servers {
+		closer, err := tr.Serve(addrs[i], sv)
+		if err != nil {
+			t.Fatalf("Serve(%q): %v", addrs[i], err)
+		}
+		defer sv.Kill()
+		defer closer.Close()
+	}
+
+	respChan := make(chan ResponseMsg)
+	co, err := DialCoordinator(tr, addrs, respChan)
+	if err != nil {
+		t.Fatalf("DialCoordinator: %v", err)
+	}
+	defer co.Kill()
+
+	await := func(tid int) ResponseMsg {
+		select {
+		case m := <-respChan:
+			if m.tid != tid || !m.committed {
+				t.Fatalf("expected transaction %d to commit, got %+v", tid, m)
+			}
+			return m
+		case <-time.After(waitTimeout):
+			t.Fatalf("Transaction %d got no response within %v", tid, waitTimeout)
+		}
+		return ResponseMsg{}
+	}
+
+	servers[0].Set(0, "x", 1)
+	servers[1].Set(0, "y", 2)
+	co.FinishTransaction(0)
+	await(0)
+
+	servers[0].Get(1, "x")
+	servers[1].Get(1, "y")
+	co.FinishTransaction(1)
+	m := await(1)
+	if m.readValues["x"] != 1 || m.readValues["y"] != 2 {
+		t.Fatalf("expected x=1 and y=2, read %v", m.readValues)
+	}
+}
+
+// Commits and reads back an int, string, bool and float64, with each codec on the wire
+// Every codec should carry the protocol's messages, and the values should come back with their types
+func TestCodecs(t *testing.T) {
+	t.Parallel()
+
+	for _, c := range []codec.Codec{codec.Gob, codec.JSON, codec.Msgpack, ProtoCodec} {
+		t.Run(c.Name(), func(t *testing.T) {
+			t.Parallel()
+
+			keys := [][]string{
+				{"int", "string"},
+				{"bool", "float"},
+			}
+			cfg := make_config(t, keys, false, false)
+			defer cfg.cleanup()
+
+			cfg.begin("TestCodecs: The protocol over " + c.Name())
+			cfg.setCodec(c)
+
+			values := map[string]interface{}{"int": 1, "string": "two", "bool": true, "float": 3.5}
+			for key, value := range values {
+				cfg.sendSet(0, key, value)
+			}
+			cfg.finishTransaction(0)
+			cfg.assertTransaction(0, true, nil)
+
+			for key := range values {
+				cfg.sendGet(1, key)
+			}
+			cfg.finishTransaction(1)
+			cfg.assertTransaction(1, true, values)
+
+			cfg.end()
+		})
+	}
+}
+
+// Serves two servers on local TCP ports and dials a coordinator through TCPTransport
+// A transaction should commit, and after one server restarts on the same port,
+// the coordinator should dial it again and read back what was written
+func TestTCPTransport(t *testing.T) {
+	t.Parallel()
+
+	checkTransportRestart(t, MakeTCPTransport())
+}
+
+// Like TestTCPTransport, but over gRPC, so every message and value also
+// goes through its protobuf form
+func TestGRPCTransport(t *testing.T) {
+	t.Parallel()
+
+	checkTransportRestart(t, MakeGRPCTransport())
+}
+
+// Calls a server through a TCP connection pool while it runs, is down, and restarts on the same port
+// The pool should never hold more connections than its size, back off rather than redial a server that is down,
+// drop the dead connections with health checks, and leave no connection open once closed
+func TestTCPPool(t *testing.T) {
+	t.Parallel()
+
+	pool := PoolConfig{
+		Size:           2,
+		HealthInterval: 20 * time.Millisecond,
+		MinBackoff:     50 * time.Millisecond,
+		MaxBackoff:     200 * time.Millisecond,
+	}
+	tr := MakeTCPTransport()
+	tr.SetPool(pool)
+
+	sv := MakeServer([]string{"x"}, MakePersister())
+	defer sv.Kill()
+	l, err := tr.Listen("127.0.0.1:0", sv)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	addr := l.Addr()
+
+	peer, err := tr.Dial(addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		if !peer.Call("Server.Query", struct{}{}, &QueryReply{}) {
+			t.Fatalf("Query %d failed", i)
+		}
+	}
+	if n := l.openConns(); n != pool.Size {
+		t.Fatalf("server has %d connections; expected the pool's %d", n, pool.Size)
+	}
+
+	// the health checks notice the server is gone before any call does
+	l.Close()
+	open := func() int {
+		p := peer.(*tcpPeer)
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		n := 0
+		for _, c := range p.conns {
+			if c != nil {
+				n++
+			}
+		}
+		return n
+	}
+	for start := time.Now(); open() > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("pool still has %d connections 1s after the server went away", open())
+		}
+	}
+
+	// with the server down, calls wait out the backoff between dials
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if peer.Call("Server.Query", struct{}{}, &QueryReply{}) {
+			t.Fatalf("Query succeeded with the server down")
+		}
+	}
+	if d := time.Since(start); d < pool.MinBackoff || d > 5*pool.MaxBackoff+tcpDialTimeout {
+		t.Fatalf("5 calls to a server that's down took %v; expected them to back off, but not hang", d)
+	}
+
+	l, err = tr.Listen(addr, sv)
+	if err != nil {
+		t.Fatalf("Listen again: %v", err)
+	}
+	defer l.Close()
+
+	// calls dial again once the backoff is over
+	start = time.Now()
+	for !peer.Call("Server.Query", struct{}{}, &QueryReply{}) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("no call got through within 1s of the server restarting")
+		}
+	}
+	for i := 0; i < 20; i++ {
+		if !peer.Call("Server.Query", struct{}{}, &QueryReply{}) {
+			t.Fatalf("Query %d failed after the restart", i)
+		}
+	}
+	if n := l.openConns(); n > pool.Size {
+		t.Fatalf("server has %d connections after the restart; expected at most %d", n, pool.Size)
+	}
+
+	peer.(io.Closer).Close()
+	for start := time.Now(); l.openConns() > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("server still has %d connections after the pool closed", l.openConns())
+		}
+	}
+}
+
+// Like TestTCPTransport, with each codec in place of net/rpc's gob
+func TestTCPCodecs(t *testing.T) {
+	t.Parallel()
+
+	for _, c := range []codec.Codec{codec.Gob, codec.JSON, codec.Msgpack, ProtoCodec} {
+		t.Run(c.Name(), func(t *testing.T) {
+			t.Parallel()
+
+			tr := MakeTCPTransport()
+			tr.SetCodec(c)
+			checkTransportRestart(t, tr)
+		})
+	}
+}
+
+// Limits each transport's messages to 1000 bytes, and reads a 2000-byte value
+// The transaction should abort, since its Commit reply couldn't be sent, and a
+// Query whose reply is too large should fail with ErrMessageTooLarge
+func TestMessageTooLarge(t *testing.T) {
+	t.Parallel()
+
+	for _, tr := range transportCases() {
+		t.Run(tr.name, func(t *testing.T) {
+			t.Parallel()
+
+			transport := tr.make(t)
+			transport.(interface{ SetMaxMessageSize(int) }).SetMaxMessageSize(1000)
+
+			sv := MakeServer([]string{"x"}, MakePersister())
+			defer sv.Kill()
+			peer := serveAndDial(t, transport, tr.addrs[0], sv)
+
+			respChan := make(chan ResponseMsg)
+			co := MakeCoordinator([]PeerClient{peer}, respChan)
+			defer co.Kill()
+
+			await := func(tid int, committed bool) ResponseMsg {
+				select {
+				case m := <-respChan:
+					if m.tid != tid || m.committed != committed {
+						t.Fatalf("expected transaction %d to commit %v, got %+v", tid, committed, m)
+					}
+					return m
+				case <-time.After(waitTimeout):
+					t.Fatalf("Transaction %d got no response within %v", tid, waitTimeout)
+				}
+				return ResponseMsg{}
+			}
+
+			// the value never crosses the wire on its way in
+			big := strings.Repeat("v", 2000)
+			sv.Set(0, "x", big)
+			co.FinishTransaction(0)
+			await(0, true)
+
+			sv.Get(1, "x")
+			co.FinishTransaction(1)
+			await(1, false)
+			if locks := sv.heldLocks(); len(locks) != 0 {
+				t.Fatalf("locks %v still held after the abort", locks)
+			}
+
+			// nothing is wedged: the value can be replaced and read
+			sv.Set(2, "x", "small")
+			co.FinishTransaction(2)
+			await(2, true)
+			sv.Get(3, "x")
+			co.FinishTransaction(3)
+			if m := await(3, true); m.readValues["x"] != "small" {
+				t.Fatalf("expected x=small, read %v", m.readValues)
+			}
+
+			// transaction 0's operations make the reply too large
+			if err := peer.CallErr("Server.Query", nil, struct{}{}, &QueryReply{}); err != ErrMessageTooLarge {
+				t.Fatalf("Query: %v; expected ErrMessageTooLarge", err)
+			}
+		})
+	}
+}
+
+// commit a transaction over tr, which must serve on local ports,
+// restart one server on the same port, and read the values back.
+func checkTransportRestart(t *testing.T, tr Transport) {
+	checkTransportRestartAt(t, tr, []string{"127.0.0.1:0", "127.0.0.1:0"})
+}
+
+// like checkTransportRestart, but serving the two servers at addrs.
+func checkTransportRestartAt(t *testing.T, tr Transport, addrs []string) {
+	keys := [][]string{{"x"}, {"y"}}
+	persisters := []*Persister{MakePersister(), MakePersister()}
+	servers := make([]*Server, 2)
+	closers := make([]io.Closer, 2)
+	addrs = append([]string(nil), addrs...)
+	for i := range servers {
+		servers[i] = MakeServer(keys[i], persisters[i])
+		closer, err := tr.Serve(addrs[i], servers[i])
+		if err != nil {
+			t.Fatalf("Serve: %v", err)
+		}
+		closers[i] = closer
+		addrs[i] = closer.(interface{ Addr() string }).Addr()
+	}
+	defer func() {
+		for i := range servers {
+			closers[i].Close()
+			servers[i].Kill()
+		}
+	}()
+
+	respChan := make(chan ResponseMsg)
+	co, err := DialCoordinator(tr, addrs, respChan)
+	if err != nil {
+		t.Fatalf("DialCoordinator: %v", err)
+	}
+	defer co.Kill()
+
+	await := func(tid int) ResponseMsg {
+		select {
+		case m := <-respChan:
+			if m.tid != tid || !m.committed {
+				t.Fatalf("expected transaction %d to commit, got %+v", tid, m)
+			}
+			return m
+		case <-time.After(waitTimeout):
+			t.Fatalf("Transaction %d got no response within %v", tid, waitTimeout)
+		}
+		return ResponseMsg{}
+	}
+
+	servers[0].Set(0, "x", 1)
+	servers[1].Set(0, "y", "two")
+	co.FinishTransaction(0)
+	await(0)
+
+	// restart server 1 from its persisted state, on the same port
+	closers[1].Close()
+	servers[1].Kill()
+	servers[1] = MakeServer(keys[1], persisters[1])
+	closers[1], err = tr.Serve(addrs[1], servers[1])
+	if err != nil {
+		t.Fatalf("Serve again: %v", err)
+	}
+
+	servers[0].Get(1, "x")
+	servers[1].Get(1, "y")
+	co.FinishTransaction(1)
+	m := await(1)
+	if m.readValues["x"] != 1 || m.readValues["y"] != "two" {
+		t.Fatalf("expected x=1 and y=two, read %v", m.readValues)
+	}
+}
+
+// Commits a transaction over each transport, with a hook on every server
+// Each handler should see the transaction's ID and the coordinator's trace in its metadata,
+// and the trace should appear in the coordinator's log and in every server's
+func TestTraceMetadata(t *testing.T) {
+	t.Parallel()
+
+	for _, tr := range transportCases() {
+		t.Run(tr.name, func(t *testing.T) {
+			t.Parallel()
+
+			transport := tr.make(t)
+			tl := makeTestLog(t.Name(), time.Now())
+
+			var mu sync.Mutex
+			var seen []Metadata // of every handler call, as it starts
+			servers := make([]*Server, 2)
+			peers := make([]PeerClient, 2)
+			for i, key := range []string{"x", "y"} {
+				servers[i] = makeServer([]string{key}, MakePersister(), -1, tl.logger(fmt.Sprintf("server %d", i)))
+				defer servers[i].Kill()
+				servers[i].setHook(func(point hookPoint, method string, tid int, meta Metadata) {
+					if point == hookBefore {
+						mu.Lock()
+						seen = append(seen, meta)
+						mu.Unlock()
+					}
+				})
+
+				peers[i] = serveAndDial(t, transport, tr.addrs[i], servers[i])
+			}
+
+			respChan := make(chan ResponseMsg)
+			co := makeCoordinator(peers, respChan, realClock{}, phaseTimeout, tl.logger("coordinator"))
+			defer co.Kill()
+
+			servers[0].Set(0, "x", 1)
+			servers[1].Set(0, "y", 2)
+			co.FinishTransaction(0)
+			select {
+			case m := <-respChan:
+				if !m.committed {
+					t.Fatalf("expected transaction 0 to commit, got %+v", m)
+				}
+			case <-time.After(waitTimeout):
+				t.Fatalf("Transaction 0 got no response within %v", waitTimeout)
+			}
+
+			co.mu.Lock()
+			trace := co.tran[0].Trace
+			co.mu.Unlock()
+			if trace == "" {
+				t.Fatalf("transaction 0 has no trace")
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			// Prepare, PreCommit and Commit on each server, at least
+			if len(seen) < 6 {
+				t.Fatalf("hooks ran for %d calls, expected at least 6", len(seen))
+			}
+			for _, meta := range seen {
+				if meta[MetaTid] != "0" || meta[MetaTrace] != trace {
+					t.Fatalf("a handler got metadata %v, expected tid 0 and trace %s", meta, trace)
+				}
+			}
+
+			var out strings.Builder
+			tl.dump(&out, levelDebug)
+			for _, component := range []string{"coordinator", "server 0", "server 1"} {
+				found := false
+				for _, line := range strings.Split(out.String(), "\n") {
+					if strings.Contains(line, component) && strings.Contains(line, trace) {
+						found = true
+					}
+				}
+				if !found {
+					t.Fatalf("trace %s isn't in the %s's log:\n%s", trace, component, out.String())
+				}
+			}
+		})
+	}
+}
+
+// Commits a transaction through a server and coordinator made with loggers over
+// slog JSON handlers, one at the info level and one at debug
+// The info handler should see the decisions, tagged with component, tid and phase,
+// but none of the per-lock detail, which the debug handler should see
+func TestSlogLogger(t *testing.T) {
+	t.Parallel()
+
+	for _, level := range []slog.Level{slog.LevelInfo, slog.LevelDebug} {
+		var buf syncBuffer
+		sl := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: level}))
+
+		net := labrpc.MakeNetwork()
+		defer net.Cleanup()
+		tr := makeLabrpcTransport(net)
+		sv := MakeServerWithLogger([]string{"x"}, MakePersister(), -1, NewLogger(sl, "server 0"))
+		defer sv.Kill()
+		tr.Serve("server0", sv)
+		end, _ := tr.Dial("server0")
+		respChan := make(chan ResponseMsg)
+		co := MakeCoordinatorWithLogger([]PeerClient{end}, respChan, NewLogger(sl, "coordinator"))
+		defer co.Kill()
+
+		sv.Set(0, "x", 1)
+		co.FinishTransaction(0)
+		select {
+		case m := <-respChan:
+			if !m.committed {
+				t.Fatalf("expected transaction 0 to commit, got %+v", m)
+			}
+		case <-time.After(waitTimeout):
+			t.Fatalf("Transaction 0 got no response within %v", waitTimeout)
+		}
+
+		var committed, debug bool
+		dec := json.NewDecoder(strings.NewReader(buf.String()))
+		for dec.More() {
+			var line struct {
+				Level     string
+				Msg       string
+				Component string
+				Tid       *int
+				Phase     string
+			}
+			if err := dec.Decode(&line); err != nil {
+				t.Fatalf("bad log line: %v", err)
+			}
+			if line.Level == "DEBUG" {
+				debug = true
+			}
+			if line.Component == "server 0" && line.Msg == "committed" {
+				if line.Tid == nil || *line.Tid != 0 || line.Phase != PhaseCommitted {
+					t.Fatalf("expected the commit tagged with tid 0 and phase %s, got %+v", PhaseCommitted, line)
+				}
+				committed = true
+			}
+		}
+		if !committed {
+			t.Fatalf("at level %v the server's commit wasn't logged:\n%s", level, buf.String())
+		}
+		if debug != (level == slog.LevelDebug) {
+			t.Fatalf("at level %v, debug lines logged: %v", level, debug)
+		}
+	}
+}
+
+// Commits a transaction through a server and coordinator given a Logger of the
+// test's own, as an embedder routing lines to another library would
+// Every line should reach it, with the commit tagged with its tid and phase
+func TestCustomLogger(t *testing.T) {
+	t.Parallel()
+
+	net := labrpc.MakeNetwork()
+	defer net.Cleanup()
+	tr := makeLabrpcTransport(net)
+	logger := &recordingLogger{}
+	sv := MakeServerWithLogger([]string{"x"}, MakePersister(), -1, logger)
+	defer sv.Kill()
+	tr.Serve("server0", sv)
+	end, _ := tr.Dial("server0")
+	respChan := make(chan ResponseMsg)
+	co := MakeCoordinatorWithLogger([]PeerClient{end}, respChan, logger)
+	defer co.Kill()
+
+	sv.Set(0, "x", 1)
+	co.FinishTransaction(0)
+	select {
+	case m := <-respChan:
+		if !m.committed {
+			t.Fatalf("expected transaction 0 to commit, got %+v", m)
+		}
+	case <-time.After(waitTimeout):
+		t.Fatalf("Transaction 0 got no response within %v", waitTimeout)
+	}
+
+	levels := make(map[string]int)
+	committed := false
+	for _, line := range logger.lines() {
+		levels[line.level]++
+		if line.tid == 0 && line.phase == PhaseCommitted && line.text == "committed" {
+			committed = true
+		}
+	}
+	if !committed || levels["debug"] == 0 || levels["info"] == 0 {
+		t.Fatalf("expected debug and info lines, and the server's commit, got %v", logger.lines())
+	}
+}
+
+// Commits a transaction with a read and a write, recording the server's and coordinator's lines and events
+// Every line, including the lock releases, and every event should carry the transaction's id,
+// and each of the server's lines and all the events the phase they came from
+func TestLogTags(t *testing.T) {
+	t.Parallel()
+
+	net := labrpc.MakeNetwork()
+	defer net.Cleanup()
+	tr := makeLabrpcTransport(net)
+	svLog, coLog := &recordingLogger{}, &recordingLogger{}
+	sv := MakeServerWithLogger([]string{"x", "y"}, MakePersister(), -1, svLog)
+	defer sv.Kill()
+	tr.Serve("server0", sv)
+	end, _ := tr.Dial("server0")
+	respChan := make(chan ResponseMsg)
+	co := MakeCoordinatorWithLogger([]PeerClient{end}, respChan, coLog)
+	defer co.Kill()
+	var mu sync.Mutex
+	var events []Event
+	record := func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e)
+	}
+	sv.Subscribe(record)
+	co.Subscribe(record)
+
+	sv.Get(0, "x")
+	sv.Set(0, "y", 1)
+	co.FinishTransaction(0)
+	select {
+	case m := <-respChan:
+		if !m.committed {
+			t.Fatalf("expected transaction 0 to commit, got %+v", m)
+		}
+	case <-time.After(waitTimeout):
+		t.Fatalf("Transaction 0 got no response within %v", waitTimeout)
+	}
+
+	// the coordinator's startup recovery isn't about any transaction
+	phases := make(map[string]bool)
+	for _, line := range svLog.lines() {
+		if line.phase == phaseQuery {
+			continue
+		}
+		if line.tid != 0 || line.phase == "" {
+			t.Fatalf("expected each of the server's lines to be tagged with transaction 0 and a phase, got %+v", line)
+		}
+		if strings.HasPrefix(line.text, "releasing") && line.phase != PhaseCommitted {
+			t.Fatalf("expected the locks to be released in %s, got %+v", PhaseCommitted, line)
+		}
+		phases[line.phase] = true
+	}
+	for _, phase := range []string{phaseOperations, PhasePrepare, PhasePreCommit, PhaseCommitted} {
+		if !phases[phase] {
+			t.Fatalf("expected the server to log in %s, got %v", phase, svLog.lines())
+		}
+	}
+	for _, line := range coLog.lines() {
+		if line.tid != 0 && line.phase != phaseRecovery {
+			t.Fatalf("expected each of the coordinator's lines to be tagged with transaction 0, got %+v", line)
+		}
+	}
+
+	// the server's Commit publishes its decision after replying
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		mu.Lock()
+		n := 0
+		for _, e := range events {
+			if d, ok := e.(Decision); ok && d.Trace == "" {
+				n++
+			}
+		}
+		mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Since(start) > waitTimeout {
+			t.Fatalf("the server's decision was never published")
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, e := range events {
+		if h := e.header(); h.Tid != 0 || h.Phase == "" {
+			t.Fatalf("expected each event to be tagged with transaction 0 and a phase, got %T %+v", e, e)
+		}
+	}
+}
+
+// Commits a transaction whose PreCommit is slow on one server, and aborts another
+// Each result should say how long the transaction spent in each phase it went through,
+// with the slow phase dominating, and phases that add up to the total
+func TestPhaseDurations(t *testing.T) {
+	t.Parallel()
+
+	const slow = 50 * time.Millisecond
+	net := labrpc.MakeNetwork()
+	defer net.Cleanup()
+	tr := makeLabrpcTransport(net)
+	var servers []*Server
+	var peers []PeerClient
+	for i, key := range []string{"x", "y"} {
+		sv := MakeServer([]string{key}, MakePersister())
+		defer sv.Kill()
+		name := fmt.Sprintf("server%d", i)
+		tr.Serve(name, sv)
+		end, _ := tr.Dial(name)
+		servers = append(servers, sv)
+		peers = append(peers, end)
+	}
+	servers[1].setHook(func(point hookPoint, method string, tid int, meta Metadata) {
+		if point == hookBefore && method == "Server.PreCommit" {
+			time.Sleep(slow)
+		}
+	})
+	respChan := make(chan ResponseMsg)
+	co := MakeCoordinator(peers, respChan)
+	defer co.Kill()
+
+	servers[0].Set(0, "x", 1)
+	servers[1].Get(0, "y")
+	servers[0].Set(1, "w", 2) // w isn't a key, so transaction 1 aborts
+	expected := [][]string{{"prepare", "precommit", "commit"}, {"prepare", "abort"}}
+	for tid, phases := range expected {
+		co.FinishTransaction(tid)
+		var m ResponseMsg
+		select {
+		case m = <-respChan:
+		case <-time.After(waitTimeout):
+			t.Fatalf("Transaction %d got no response within %v", tid, waitTimeout)
+		}
+		if m.committed != (tid == 0) || len(m.durations) != len(phases)+1 {
+			t.Fatalf("expected transaction %d to go through %v, got %+v", tid, phases, m)
+		}
+		var sum time.Duration
+		for _, phase := range phases {
+			d, ok := m.durations[phase]
+			if !ok {
+				t.Fatalf("transaction %d has no time for %s: %v", tid, phase, m.durations)
+			}
+			sum += d
+		}
+		if sum != m.durations["total"] {
+			t.Fatalf("transaction %d's phases add up to %v, not its total: %v", tid, sum, m.durations)
+		}
+		if tid == 0 {
+			d := m.durations
+			if d["precommit"] < slow || d["precommit"] < d["prepare"] || d["precommit"] < d["commit"] {
+				t.Fatalf("expected the slow PreCommit to dominate, got %v", d)
+			}
+		}
+	}
+}
+
+// a Logger that keeps every line.
+type recordingLogger struct {
+	mu      sync.Mutex
+	entries []recordedLine
+}
+
+type recordedLine struct {
+	level string
+	tid   int
+	phase string
+	text  string
+}
+
+func (l *recordingLogger) Debugf(tid int, phase string, format string, a ...interface{}) {
+	l.add("debug", tid, phase, fmt.Sprintf(format, a...))
+}
+
+func (l *recordingLogger) Infof(tid int, phase string, format string, a ...interface{}) {
+	l.add("info", tid, phase, fmt.Sprintf(format, a...))
+}
+
+func (l *recordingLogger) Warnf(tid int, phase string, format string, a ...interface{}) {
+	l.add("warn", tid, phase, fmt.Sprintf(format, a...))
+}
+
+func (l *recordingLogger) add(level string, tid int, phase string, text string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, recordedLine{level, tid, phase, text})
+}
+
+func (l *recordingLogger) lines() []recordedLine {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]recordedLine(nil), l.entries...)
+}
+
+// a bytes.Buffer that several goroutines can write to.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// Sends Abort one-way over each transport, to a server holding a transaction
+// Send should return at once, and the server should abort the transaction soon after
+func TestTransportSend(t *testing.T) {
+	t.Parallel()
+
+	for _, tr := range transportCases() {
+		t.Run(tr.name, func(t *testing.T) {
+			t.Parallel()
+
+			sv := MakeServer([]string{"x"}, MakePersister())
+			defer sv.Kill()
+			peer := serveAndDial(t, tr.make(t), tr.addrs[0], sv)
+
+			sv.Set(0, "x", 1)
+			peer.Send("Server.Abort", &RPCArgs{Tid: 0})
+			for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+				if state, _ := sv.transactionState(0); state == stateAborted {
+					break
+				}
+				if time.Since(start) > waitTimeout {
+					t.Fatalf("server didn't abort transaction 0 after a one-way Abort")
+				}
+			}
+		})
+	}
+}
+
+// a Transport to test, with addresses to serve two servers on.
+type transportCase struct {
+	name  string
+	make  func(t *testing.T) Transport
+	addrs []string
+}
+
+func transportCases() []transportCase {
+	return []transportCase{
+		{"labrpc", func(t *testing.T) Transport {
+			net := labrpc.MakeNetwork()
+			t.Cleanup(net.Cleanup)
+			return makeLabrpcTransport(net)
+		}, []string{"server0", "server1"}},
+		{"TCP", func(t *testing.T) Transport { return MakeTCPTransport() }, []string{"127.0.0.1:0", "127.0.0.1:0"}},
+		{"GRPC", func(t *testing.T) Transport { return MakeGRPCTransport() }, []string{"127.0.0.1:0", "127.0.0.1:0"}},
+		{"UDP", func(t *testing.T) Transport { return MakeUDPTransport() }, []string{"127.0.0.1:0", "127.0.0.1:0"}},
+		{"UDS", func(t *testing.T) Transport {
+			ut := MakeUnixTransport()
+			ut.SetDir(t.TempDir())
+			return ut
+		}, []string{"server0.sock", "server1.sock"}},
+	}
+}
+
+// serve sv through tr at addr until the test ends, and dial it.
+func serveAndDial(t *testing.T, tr Transport, addr string, sv *Server) PeerClient {
+	closer, err := tr.Serve(addr, sv)
+	if err != nil {
+		t.Fatalf("Serve: %v", err)
+	}
+	t.Cleanup(func() { closer.Close() })
+	if l, ok := closer.(interface{ Addr() string }); ok {
+		addr = l.Addr()
+	}
+	peer, err := tr.Dial(addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	if c, ok := peer.(io.Closer); ok {
+		t.Cleanup(func() { c.Close() })
+	}
+	return peer
+}
+
+// Sweeps cluster sizes, from a single server to eight, with keys assigned to random servers
+// Commits, aborts, coordinator restarts and random workloads should work on every layout
+func TestTopologies(t *testing.T) {
+	t.Parallel()
+
+	sizes := []struct{ servers, keys int }{
+		{1, 1},
+		{1, 4},
+		{2, 3},
+		{5, 8},
+		{8, 16},
+	}
+
+	for _, size := range sizes {
+		t.Run(fmt.Sprintf("%dservers-%dkeys", size.servers, size.keys), func(t *testing.T) {
+			t.Parallel()
+
+			cfg := make_random_config(t, size.servers, size.keys, false)
+			defer cfg.cleanup()
+
+			cfg.begin(fmt.Sprintf("TestTopologies: %d servers storing %v", size.servers, cfg.keys))
+
+			var all []string
+			holder := -1 // a server with at least one key
+			for i, keys := range cfg.keys {
+				all = append(all, keys...)
+				if len(keys) > 0 {
+					holder = i
+				}
+			}
+
+			// write every key, then read them all back
+			written := make(map[string]interface{})
+			for i, key := range all {
+				cfg.sendSet(0, key, i)
+				written[key] = i
+			}
+			cfg.finishTransaction(0)
+			cfg.assertTransaction(0, true, nil)
+
+			for _, key := range all {
+				cfg.sendGet(1, key)
+			}
+			cfg.finishTransaction(1)
+			cfg.assertTransaction(1, true, written)
+
+			// a server holding keys is unreachable, so a transaction on every key aborts
+			// it may be the only server, so it is reconnected before the abort can be reported
+			cfg.disconnect(holder)
+			for _, key := range all {
+				cfg.sendSet(2, key, -1)
+			}
+			cfg.finishTransaction(2)
+			time.Sleep(2 * phaseTimeout)
+			cfg.connect(holder)
+			cfg.assertTransaction(2, false, nil)
+			time.Sleep(50 * time.Millisecond) // give the servers time to finish aborting
+
+			// the coordinator restarts while committing
+			for _, key := range all {
+				cfg.sendSet(3, key, 3)
+				written[key] = 3
+			}
+			cfg.doNextCommit(func() bool {
+				cfg.restartCoordinatorLocked()
+				return true
+			})
+			cfg.finishTransaction(3)
+			cfg.assertTransaction(3, true, nil)
+
+			for _, key := range all {
+				cfg.sendGet(4, key)
+			}
+			cfg.finishTransaction(4)
+			cfg.assertTransaction(4, true, written)
+
+			cfg.nextTid.Store(4)
+			cfg.runWorkload(cfg.makeWorkload())
+
+			cfg.end()
+		})
+	}
+}
+
+var long = flag.Bool("long", false, "run the soak test and the long-reordering variants")
+
+var soakTime = flag.Duration("soaktime", time.Hour, "how long the soak test runs")
+
+// Runs a random workload for -soaktime, checking for leaked locks, stores
+// that disagree with reads, and a heap that grows too fast along the way
+// Only runs with -long
+func TestSoak(t *testing.T) {
+	t.Parallel()
+
+	if !*long {
+		t.Skip("soak test; run with -long")
+	}
+
+	keys := [][]string{
+		{"a", "b", "c", "d"},
+		{"e", "f", "g", "h"},
+		{"i", "j", "k", "l"},
+	}
+	cfg := make_config(t, keys, false, true)
+	defer cfg.cleanup()
+
+	cfg.begin(fmt.Sprintf("TestSoak: Random transactions for %v without leaks", *soakTime))
+
+	cfg.soak(*soakTime, max(*soakTime/60, time.Second))
+
+	cfg.end()
+}
@@ -0,0 +1,212 @@
+package commit
+
+//
+// a timeline of a test run, for debugging interleavings.
+//
+// the tester records every RPC the coordinator sends (from the
+// time the network takes it to the time Call() returns), every
+// transaction finished and reported, and every fault it injects,
+// with one lane for the coordinator and one per server.
+//
+// when a test fails, cleanup() writes the timeline as a
+// self-contained HTML page with an SVG chart. set TIMELINE=1 to
+// write it for passing tests too, and TIMELINE_DIR to choose
+// where it goes (the default is the system's temp directory).
+//
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+type timelineEvent struct {
+	lane  int // server, or coordinatorId
+	from  time.Duration
+	to    time.Duration // equal to from for a mark
+	label string
+	ok    bool // for an RPC: did the caller get a reply?
+}
+
+type timeline struct {
+	mu     sync.Mutex
+	start  time.Time
+	lanes  map[interface{}]int // endname -> server
+	events []timelineEvent
+}
+
+func makeTimeline(start time.Time) *timeline {
+	return &timeline{start: start, lanes: make(map[interface{}]int)}
+}
+
+// requests on endname go to server.
+func (tl *timeline) addEnd(endname interface{}, server int) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	tl.lanes[endname] = server
+}
+
+// record an RPC on endname that started at start and ends now.
+func (tl *timeline) rpc(svcMeth string, endname interface{}, start time.Time, ok bool) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	lane, known := tl.lanes[endname]
+	if !known {
+		return
+	}
+	tl.events = append(tl.events, timelineEvent{
+		lane:  lane,
+		from:  start.Sub(tl.start),
+		to:    time.Since(tl.start),
+		label: strings.TrimPrefix(svcMeth, "Server."),
+		ok:    ok,
+	})
+}
+
+// record something that happened to lane just now.
+func (tl *timeline) mark(lane int, format string, a ...interface{}) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	now := time.Since(tl.start)
+	tl.events = append(tl.events, timelineEvent{
+		lane:  lane,
+		from:  now,
+		to:    now,
+		label: fmt.Sprintf(format, a...),
+		ok:    true,
+	})
+}
+
+var rpcColors = map[string]string{
+	"Prepare":   "#4e79a7",
+	"PreCommit": "#f28e2b",
+	"Commit":    "#59a14f",
+	"Abort":     "#e15759",
+	"Query":     "#9c9c9c",
+}
+
+const (
+	laneHeight  = 48
+	laneLabelsW = 110
+	axisHeight  = 24
+)
+
+// write the timeline as an HTML page, with lanes for the
+// coordinator and servers 0..nservers-1.
+func (tl *timeline) writeHTML(w io.Writer, title string, nservers int) {
+	tl.mu.Lock()
+	events := make([]timelineEvent, len(tl.events))
+	copy(events, tl.events)
+	tl.mu.Unlock()
+
+	end := time.Millisecond
+	for _, e := range events {
+		end = max(end, e.to)
+	}
+	ms := float64(end) / float64(time.Millisecond)
+	pxPerMs := math.Max(1, 1200/ms)
+	width := laneLabelsW + int(ms*pxPerMs) + 20
+	height := axisHeight + (nservers+1)*laneHeight
+
+	x := func(d time.Duration) float64 {
+		return laneLabelsW + float64(d)/float64(time.Millisecond)*pxPerMs
+	}
+	y := func(lane int) int {
+		if lane == coordinatorId {
+			return axisHeight
+		}
+		return axisHeight + (lane+1)*laneHeight
+	}
+
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>%s</title>\n", html.EscapeString(title))
+	fmt.Fprintf(w, "<style>body{font-family:sans-serif;font-size:12px} svg text{font-size:11px} "+
+		"rect.rpc:hover,path.mark:hover{stroke:#000;stroke-width:2}</style></head><body>\n")
+	fmt.Fprintf(w, "<h3>%s</h3>\n", html.EscapeString(title))
+	fmt.Fprintf(w, "<p>zoom <input type=\"range\" min=\"1\" max=\"20\" value=\"1\" "+
+		"oninput=\"var s=document.getElementById('tl');s.setAttribute('width',%d*this.value)\"> "+
+		"hover over an RPC or mark for details; faded RPCs got no reply.</p>\n", width)
+	fmt.Fprintf(w, "<div style=\"overflow-x:auto\"><svg id=\"tl\" width=\"%d\" height=\"%d\" viewBox=\"0 0 %d %d\" "+
+		"preserveAspectRatio=\"none\" xmlns=\"http://www.w3.org/2000/svg\">\n", width, height, width, height)
+
+	// lanes
+	for lane := coordinatorId; lane < nservers; lane++ {
+		name := fmt.Sprintf("server %d", lane)
+		if lane == coordinatorId {
+			name = "coordinator"
+		}
+		fill := "#ffffff"
+		if lane%2 == 0 {
+			fill = "#f4f4f4"
+		}
+		fmt.Fprintf(w, "<rect x=\"0\" y=\"%d\" width=\"%d\" height=\"%d\" fill=\"%s\"/>\n", y(lane), width, laneHeight, fill)
+		fmt.Fprintf(w, "<text x=\"4\" y=\"%d\">%s</text>\n", y(lane)+laneHeight/2+4, name)
+	}
+
+	// time axis, with about ten ticks
+	tick := math.Pow(10, math.Floor(math.Log10(ms/10)))
+	for t := 0.0; t <= ms; t += tick {
+		px := laneLabelsW + t*pxPerMs
+		fmt.Fprintf(w, "<line x1=\"%.1f\" y1=\"%d\" x2=\"%.1f\" y2=\"%d\" stroke=\"#ddd\"/>\n", px, axisHeight, px, height)
+		fmt.Fprintf(w, "<text x=\"%.1f\" y=\"14\">%gms</text>\n", px, t)
+	}
+
+	for _, e := range events {
+		if e.to == e.from {
+			px := x(e.from)
+			top := y(e.lane)
+			fmt.Fprintf(w, "<path class=\"mark\" d=\"M%.1f %d l-4 -8 h8 z\" fill=\"#222\"><title>%s at %v</title></path>\n",
+				px, top+12, html.EscapeString(e.label), e.from)
+			fmt.Fprintf(w, "<line x1=\"%.1f\" y1=\"%d\" x2=\"%.1f\" y2=\"%d\" stroke=\"#222\" stroke-dasharray=\"2,2\"/>\n",
+				px, top+12, px, top+laneHeight)
+			fmt.Fprintf(w, "<text x=\"%.1f\" y=\"%d\">%s</text>\n", px+5, top+11, html.EscapeString(e.label))
+			continue
+		}
+
+		color, known := rpcColors[e.label]
+		if !known {
+			color = "#b07aa1"
+		}
+		opacity := "0.8"
+		reply := "reply"
+		if !e.ok {
+			opacity = "0.3"
+			reply = "no reply"
+		}
+		fmt.Fprintf(w, "<rect class=\"rpc\" x=\"%.1f\" y=\"%d\" width=\"%.1f\" height=\"%d\" fill=\"%s\" fill-opacity=\"%s\">"+
+			"<title>%s %v to %v (%v, %s)</title></rect>\n",
+			x(e.from), y(e.lane)+16, math.Max(1, x(e.to)-x(e.from)), laneHeight-22, color, opacity,
+			html.EscapeString(e.label), e.from, e.to, e.to-e.from, reply)
+	}
+
+	fmt.Fprintf(w, "</svg></div>\n<p>")
+	for _, name := range []string{"Prepare", "PreCommit", "Commit", "Abort", "Query"} {
+		fmt.Fprintf(w, "<span style=\"background:%s;color:#fff;padding:2px 6px;margin-right:4px\">%s</span>", rpcColors[name], name)
+	}
+	fmt.Fprintf(w, "</p></body></html>\n")
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// write the timeline for a test to TIMELINE_DIR, and return
+// the file's name.
+func (tl *timeline) save(testName string, nservers int) (string, error) {
+	dir := os.Getenv("TIMELINE_DIR")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	name := filepath.Join(dir, "timeline-"+unsafeFileChars.ReplaceAllString(testName, "_")+".html")
+
+	f, err := os.Create(name)
+	if err != nil {
+		return "", err
+	}
+	tl.writeHTML(f, testName, nservers)
+	return name, f.Close()
+}
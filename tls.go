@@ -0,0 +1,67 @@
+package commit
+
+//
+// TLS for the network transports, so that coordinator and server
+// traffic is encrypted and servers only answer coordinators that
+// present a certificate they trust:
+//
+//   tlsCfg, err := LoadMutualTLS("node.crt", "node.key", "ca.crt")
+//   t := MakeTCPTransportTLS(tlsCfg) // or MakeGRPCTransportTLS(tlsCfg)
+//
+// with mutual TLS, a server rejects any connection whose client
+// certificate the CA didn't sign, and a coordinator rejects any
+// server whose certificate the CA didn't sign for the host it
+// dialled, so a server's certificate must name its address.
+//
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// how a transport secures its connections. Server is used by
+// Listen and Client by Dial; nil means plain TCP.
+type TransportTLS struct {
+	Server *tls.Config
+	Client *tls.Config
+}
+
+// mutual TLS in which each side presents the certificate in
+// certFile, with its key in keyFile, and only accepts peers whose
+// certificates the CA in caFile signed. every node can use the
+// same files, or its own certificate from the same CA.
+func LoadMutualTLS(certFile, keyFile, caFile string) (TransportTLS, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return TransportTLS{}, err
+	}
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return TransportTLS{}, err
+	}
+	return MutualTLS(cert, caPEM)
+}
+
+// like LoadMutualTLS, but with a certificate and CA already in
+// memory; caPEM holds one or more PEM-encoded CA certificates.
+func MutualTLS(cert tls.Certificate, caPEM []byte) (TransportTLS, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return TransportTLS{}, fmt.Errorf("no CA certificates in PEM data")
+	}
+	return TransportTLS{
+		Server: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientCAs:    pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			MinVersion:   tls.VersionTLS12,
+		},
+		Client: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      pool,
+			MinVersion:   tls.VersionTLS12,
+		},
+	}, nil
+}
@@ -0,0 +1,138 @@
+package commit
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Runs the TCP and gRPC transport checks over mutual TLS
+// A server should then refuse coordinators with no TLS, no certificate,
+// or a certificate from another CA
+func TestTLSTransport(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	certFile, keyFile, caFile := makeTestCerts(t, dir, "node")
+	rogueCert, rogueKey, _ := makeTestCerts(t, dir, "rogue")
+
+	good, err := LoadMutualTLS(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatalf("LoadMutualTLS: %v", err)
+	}
+	// trusts the servers, but its own certificate is from another CA
+	rogue, err := LoadMutualTLS(rogueCert, rogueKey, caFile)
+	if err != nil {
+		t.Fatalf("LoadMutualTLS: %v", err)
+	}
+	noCert := TransportTLS{Client: &tls.Config{RootCAs: good.Client.RootCAs}}
+
+	transports := []struct {
+		name string
+		make func(tlsCfg TransportTLS) Transport
+	}{
+		{"TCP", func(tlsCfg TransportTLS) Transport { return MakeTCPTransportTLS(tlsCfg) }},
+		{"GRPC", func(tlsCfg TransportTLS) Transport { return MakeGRPCTransportTLS(tlsCfg) }},
+	}
+
+	for _, tr := range transports {
+		t.Run(tr.name, func(t *testing.T) {
+			t.Parallel()
+
+			checkTransportRestart(t, tr.make(good))
+
+			sv := MakeServer([]string{"x"}, MakePersister())
+			defer sv.Kill()
+			closer, err := tr.make(good).Serve("127.0.0.1:0", sv)
+			if err != nil {
+				t.Fatalf("Serve: %v", err)
+			}
+			defer closer.Close()
+			addr := closer.(interface{ Addr() string }).Addr()
+
+			clients := map[string]TransportTLS{
+				"no TLS":                   {},
+				"no certificate":           noCert,
+				"another CA's certificate": rogue,
+			}
+			for name, tlsCfg := range clients {
+				peer, err := tr.make(tlsCfg).Dial(addr)
+				if err != nil {
+					t.Fatalf("Dial: %v", err)
+				}
+				if peer.Call("Server.Query", struct{}{}, &QueryReply{}) {
+					t.Fatalf("server answered a coordinator with %s", name)
+				}
+				peer.(io.Closer).Close()
+			}
+		})
+	}
+}
+
+// a fresh CA, and a certificate it signed for 127.0.0.1, for both
+// servers and clients. returns the files LoadMutualTLS() takes.
+func makeTestCerts(t *testing.T, dir string, name string) (certFile, keyFile, caFile string) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name + " CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(file string, blockType string, der []byte) string {
+		path := filepath.Join(dir, file)
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	return write(name+".crt", "CERTIFICATE", der), write(name+".key", "EC PRIVATE KEY", keyDER), write(name+"-ca.crt", "CERTIFICATE", caDER)
+}
@@ -0,0 +1,152 @@
+package commit
+
+//
+// OpenTelemetry spans, so that commit latency can be broken down
+// in any OTLP-compatible backend:
+//
+//   3PC transaction            tid, trace, outcome
+//     Prepare                  one span per phase
+//       Server.Prepare         one per participant, server; its
+//         Server.Prepare         retries are events. the server's
+//                                own span, with tid and keys
+//     PreCommit
+//       Server.PreCommit
+//     Committed (or Aborted)
+//       Server.Commit
+//
+// the span context travels in each RPC's Metadata as a W3C
+// traceparent, so a server's spans join the coordinator's trace
+// over any Transport. spans go to the global TracerProvider, which
+// does nothing until otel.SetTracerProvider() is called, or to
+// one given to SetTracerProvider().
+//
+
+import (
+	"context"
+	"sort"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// the instrumentation scope of every span.
+const tracerName = "3PhaseCommit"
+
+const (
+	attrTid     = attribute.Key("3pc.tid")
+	attrKeys    = attribute.Key("3pc.keys")
+	attrServer  = attribute.Key("3pc.server")
+	attrTrace   = attribute.Key("3pc.trace") // the ID in the logs, see MetaTrace
+	attrOutcome = attribute.Key("3pc.outcome")
+)
+
+// how span contexts are carried in Metadata.
+var tracePropagator = propagation.TraceContext{}
+
+func defaultTracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// send spans for the transactions the Coordinator starts from now
+// on to tp instead of the global TracerProvider.
+func (co *Coordinator) SetTracerProvider(tp trace.TracerProvider) {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+
+	co.tracer = tp.Tracer(tracerName)
+}
+
+// send the spans of the Server's handlers to tp instead of the
+// global TracerProvider.
+func (sv *Server) SetTracerProvider(tp trace.TracerProvider) {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	sv.tracer = tp.Tracer(tracerName)
+}
+
+// the context of tran's span, starting the span if it hasn't been,
+// tagged with tid.
+func (co *Coordinator) traceTransaction(tid int, tran *Transaction) context.Context {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+
+	if tran.span == nil {
+		_, tran.span = co.tracer.Start(context.Background(), "3PC transaction",
+			trace.WithAttributes(attrTid.Int(tid), attrTrace.String(tran.Trace)))
+	}
+	return trace.ContextWithSpan(withTxn(context.Background(), tid, ""), tran.span)
+}
+
+// end tran's span once its outcome has been reported.
+func (co *Coordinator) endTrace(tran *Transaction, outcome string) {
+	co.mu.Lock()
+	span := tran.span
+	tran.span = nil
+	co.mu.Unlock()
+
+	if span != nil {
+		span.SetAttributes(attrOutcome.String(outcome))
+		span.End()
+	}
+}
+
+func (co *Coordinator) startPhase(ctx context.Context, tid int, phase string) (context.Context, trace.Span) {
+	co.mu.Lock()
+	tracer := co.tracer
+	co.mu.Unlock()
+
+	return tracer.Start(withPhase(ctx, phase), phase, trace.WithAttributes(attrTid.Int(tid)))
+}
+
+// a span for the calls of one phase to one server, resends included.
+func (co *Coordinator) startRPC(ctx context.Context, method string, server int) (context.Context, trace.Span) {
+	co.mu.Lock()
+	tracer := co.tracer
+	co.mu.Unlock()
+
+	return tracer.Start(ctx, method, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrServer.Int(server)))
+}
+
+// end span, marking it failed if err isn't nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// add ctx's span context to meta.
+func injectSpan(ctx context.Context, meta Metadata) {
+	tracePropagator.Inject(ctx, propagation.MapCarrier(meta))
+}
+
+// a span for a handler, a child of the caller's if meta carries one,
+// and its context, tagged with tid and phase.
+func (sv *Server) startSpan(meta Metadata, method string, tid int, phase string) (context.Context, trace.Span) {
+	ctx := tracePropagator.Extract(withTxn(context.Background(), tid, phase), propagation.MapCarrier(meta))
+
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	ctx, span := sv.tracer.Start(ctx, method, trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attrTid.Int(tid)))
+	if span.IsRecording() {
+		keys := make([]string, 0, len(sv.operations[tid]))
+		seen := make(map[string]bool)
+		for _, op := range sv.operations[tid] {
+			if !seen[op.Key] {
+				seen[op.Key] = true
+				keys = append(keys, op.Key)
+			}
+		}
+		sort.Strings(keys)
+		span.SetAttributes(attrKeys.StringSlice(keys))
+	}
+	return ctx, span
+}
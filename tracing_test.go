@@ -0,0 +1,155 @@
+package commit
+
+import (
+	"3PhaseCommit/labrpc"
+	"sort"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Commits one transaction and aborts another, with every span recorded
+// Each should have a transaction span with a child per phase and, under those, one per
+// participant RPC, whose server-side span carries the tid and keys in the same trace
+func TestTracing(t *testing.T) {
+	t.Parallel()
+
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	defer tp.Shutdown(t.Context())
+
+	net := labrpc.MakeNetwork()
+	defer net.Cleanup()
+	tr := makeLabrpcTransport(net)
+	var peers []PeerClient
+	for i, keys := range [][]string{{"x", "y"}, {"z"}} {
+		sv := MakeServer(keys, MakePersister())
+		defer sv.Kill()
+		sv.SetTracerProvider(tp)
+		name := []string{"server0", "server1"}[i]
+		tr.Serve(name, sv)
+		end, _ := tr.Dial(name)
+		peers = append(peers, end)
+		if i == 0 {
+			sv.Set(0, "y", 1)
+			sv.Set(0, "x", 2)
+			sv.Set(1, "w", 3) // w isn't a key, so transaction 1 aborts
+		} else {
+			sv.Get(0, "z")
+		}
+	}
+	respChan := make(chan ResponseMsg)
+	co := MakeCoordinator(peers, respChan)
+	defer co.Kill()
+	co.SetTracerProvider(tp)
+
+	for tid, committed := range []bool{true, false} {
+		co.FinishTransaction(tid)
+		select {
+		case m := <-respChan:
+			if m.committed != committed {
+				t.Fatalf("expected transaction %d to commit: %v, got %+v", tid, committed, m)
+			}
+		case <-time.After(waitTimeout):
+			t.Fatalf("Transaction %d got no response within %v", tid, waitTimeout)
+		}
+	}
+
+	// transaction 1's Aborted span ends after it's reported: 16 spans
+	// for transaction 0, and 9 for transaction 1, whose Abort goes
+	// only to server 0
+	var spans []sdktrace.ReadOnlySpan
+	for start := time.Now(); time.Since(start) < waitTimeout; time.Sleep(10 * time.Millisecond) {
+		if spans = rec.Ended(); len(spans) >= 25 {
+			break
+		}
+	}
+	if len(spans) != 25 {
+		t.Fatalf("expected 25 spans, got %d", len(spans))
+	}
+
+	attr := func(s sdktrace.ReadOnlySpan, key attribute.Key) attribute.Value {
+		for _, kv := range s.Attributes() {
+			if kv.Key == key {
+				return kv.Value
+			}
+		}
+		return attribute.Value{}
+	}
+	byID := make(map[[8]byte]sdktrace.ReadOnlySpan)
+	for _, s := range spans {
+		byID[s.SpanContext().SpanID()] = s
+	}
+	parent := func(s sdktrace.ReadOnlySpan) string {
+		if p, ok := byID[s.Parent().SpanID()]; ok {
+			return p.Name()
+		}
+		return ""
+	}
+
+	expected := []map[string]string{
+		{ // transaction 0's spans and their parents
+			"3PC transaction":  "",
+			PhasePrepare:       "3PC transaction",
+			PhasePreCommit:     "3PC transaction",
+			PhaseCommitted:     "3PC transaction",
+			"Server.Prepare":   PhasePrepare,
+			"Server.PreCommit": PhasePreCommit,
+			"Server.Commit":    PhaseCommitted,
+		},
+		{
+			"3PC transaction": "",
+			PhasePrepare:      "3PC transaction",
+			PhaseAborted:      "3PC transaction",
+			"Server.Prepare":  PhasePrepare,
+			"Server.Abort":    PhaseAborted,
+		},
+	}
+	for tid, parents := range expected {
+		var root sdktrace.ReadOnlySpan
+		for _, s := range spans {
+			if s.Name() == "3PC transaction" && attr(s, attrTid).AsInt64() == int64(tid) {
+				root = s
+			}
+		}
+		if root == nil {
+			t.Fatalf("no span for transaction %d", tid)
+		}
+		outcome := map[bool]string{true: PhaseCommitted, false: PhaseAborted}[tid == 0]
+		if got := attr(root, attrOutcome).AsString(); got != outcome {
+			t.Fatalf("transaction %d's span has outcome %q; expected %q", tid, got, outcome)
+		}
+
+		for _, s := range spans {
+			if s.SpanContext().TraceID() != root.SpanContext().TraceID() {
+				continue
+			}
+			want, ok := parents[s.Name()]
+			if !ok {
+				t.Fatalf("unexpected span %s in transaction %d", s.Name(), tid)
+			}
+			// a handler's span is a child of the coordinator's span for the same RPC
+			if s.SpanKind() == trace.SpanKindServer {
+				want = s.Name()
+			}
+			if got := parent(s); got != want {
+				t.Fatalf("in transaction %d, %s is a child of %q; expected %q", tid, s.Name(), got, want)
+			}
+		}
+	}
+
+	var keys []string // carried by transaction 0's Prepare handlers' spans
+	for _, s := range spans {
+		if s.Name() == "Server.Prepare" && s.SpanKind() == trace.SpanKindServer && attr(s, attrTid).AsInt64() == 0 {
+			keys = append(keys, attr(s, attrKeys).AsStringSlice()...)
+		}
+	}
+	sort.Strings(keys)
+	if len(keys) != 3 || keys[0] != "x" || keys[1] != "y" || keys[2] != "z" {
+		t.Fatalf("expected transaction 0's Prepare spans to carry keys x, y and z, got %v", keys)
+	}
+}
@@ -0,0 +1,193 @@
+package commit
+
+//
+// how Coordinators reach Servers, so that the protocol doesn't
+// depend on labrpc.
+//
+// a Transport makes a Server's handlers reachable at an address,
+// and dials addresses for a Coordinator:
+//
+//   closer, err := t.Serve("server0", sv)
+//   co, err := DialCoordinator(t, []string{"server0", "server1"}, respChan)
+//
+// the Coordinator calls handlers by name, e.g. "Server.Prepare",
+// through a PeerClient per server; *labrpc.ClientEnd is one. each
+// call carries Metadata naming the transaction and its trace, which
+// handlers log and pass to the tester's hooks, so that one
+// transaction's lines can be found in every node's log.
+// labrpcTransport serves and dials on a labrpc.Network. the tester
+// makes its own ClientEnds, so that it can fault each of them, but
+// serves Servers the same way labrpcTransport does.
+//
+// a transport may cap the size of its messages, e.g. with
+// SetMaxMessageSize(). a Server then votes No on a transaction whose
+// Commit reply wouldn't fit, and the Coordinator aborts a transaction
+// whose Prepare or PreCommit fails with ErrMessageTooLarge, rather
+// than resending a message that can never get through.
+//
+// clients still call a Server's Get and Set directly. the
+// transports other than labrpc carry only the 3PC messages, and
+// refuse any other method, e.g. a migration's (migrate.go), with
+// ErrUnsupportedMethod, without sending it.
+//
+
+import (
+	"3PhaseCommit/labrpc"
+	"errors"
+	"io"
+	"time"
+)
+
+var ErrUnsupportedMethod = errors.New("the transport doesn't carry this method")
+
+// opaque per-call metadata, handed to handlers as their first
+// argument; empty if the caller sent none.
+type Metadata = map[string]string
+
+// the keys the Coordinator sets.
+const (
+	MetaTid   = "tid"   // the transaction the call is about
+	MetaTrace = "trace" // the transaction's trace ID, or the recovery's for a Query
+)
+
+// sends RPCs to one server. Call returns false if the request or
+// its reply was lost, like labrpc's. CallMeta also carries meta to
+// the handler; Call sends none. CallErr is like CallMeta, but
+// returns nil for success and otherwise says why the call failed,
+// e.g. ErrMessageTooLarge. Send is for notifications that need
+// no reply: it returns without waiting for the handler, and any
+// reply is thrown away.
+type PeerClient interface {
+	Call(svcMeth string, args interface{}, reply interface{}) bool
+	CallMeta(svcMeth string, meta Metadata, args interface{}, reply interface{}) bool
+	CallErr(svcMeth string, meta Metadata, args interface{}, reply interface{}) error
+	Send(svcMeth string, args interface{})
+}
+
+// returned by CallErr when the request or the reply was bigger than
+// the transport's message size limit, so resending it can't help.
+var ErrMessageTooLarge = labrpc.ErrMessageTooLarge
+
+type Transport interface {
+	// make sv's handlers reachable at addr, until the returned
+	// Closer is closed.
+	Serve(addr string, sv *Server) (io.Closer, error)
+
+	// a client for the server reachable at addr.
+	Dial(addr string) (PeerClient, error)
+}
+
+// how a network transport keeps its connections to each server.
+// a connection that breaks, or fails a health check, is dialled
+// again on the next call; after a failed dial, calls wait out a
+// backoff that doubles from MinBackoff to MaxBackoff before
+// dialling again, rather than hammering a server that is down.
+type PoolConfig struct {
+	Size           int           // connections per server
+	HealthInterval time.Duration // how often open connections are checked; 0 never
+	MinBackoff     time.Duration
+	MaxBackoff     time.Duration
+}
+
+func DefaultPoolConfig() PoolConfig {
+	return PoolConfig{
+		Size:           2,
+		HealthInterval: 10 * time.Second,
+		MinBackoff:     50 * time.Millisecond,
+		MaxBackoff:     2 * time.Second,
+	}
+}
+
+// the backoff after a dial failed, when the one before it was d.
+func (pc PoolConfig) nextBackoff(d time.Duration) time.Duration {
+	if d == 0 {
+		return pc.MinBackoff
+	}
+	return min(2*d, pc.MaxBackoff)
+}
+
+// whether svcMeth is one of the 3PC messages every transport
+// carries.
+func transactionMethod(svcMeth string) bool {
+	switch svcMeth {
+	case "Server.Prepare", "Server.Abort", "Server.Query", "Server.PreCommit", "Server.Commit":
+		return true
+	}
+	return false
+}
+
+// somewhere to decode svcMeth's reply, for a Send() that throws
+// it away.
+func replyFor(svcMeth string) interface{} {
+	switch svcMeth {
+	case "Server.Prepare":
+		return &PrepareReply{}
+	case "Server.Query":
+		return &QueryReply{}
+	case "Server.PreCommit":
+		return &PreCommitReply{}
+	case "Server.Commit":
+		return &CommitReply{}
+	}
+	return &struct{}{}
+}
+
+// start a Coordinator that reaches the servers at addrs through t.
+func DialCoordinator(t Transport, addrs []string, respChan chan ResponseMsg) (*Coordinator, error) {
+	peers := make([]PeerClient, len(addrs))
+	for i, addr := range addrs {
+		peer, err := t.Dial(addr)
+		if err != nil {
+			return nil, err
+		}
+		peers[i] = peer
+	}
+	return MakeCoordinator(peers, respChan), nil
+}
+
+// a Transport on a labrpc.Network, where addr is the server's name.
+type labrpcTransport struct {
+	net *labrpc.Network
+}
+
+func makeLabrpcTransport(net *labrpc.Network) *labrpcTransport {
+	return &labrpcTransport{net: net}
+}
+
+func (lt *labrpcTransport) Serve(addr string, sv *Server) (io.Closer, error) {
+	serveLabrpc(lt.net, addr, sv)
+	return labrpcCloser{lt.net, addr}, nil
+}
+
+func (lt *labrpcTransport) Dial(addr string) (PeerClient, error) {
+	endname := randstring(20)
+	end := lt.net.MakeEnd(endname)
+	lt.net.Connect(endname, addr)
+	lt.net.Enable(endname, true)
+	return end, nil
+}
+
+// refuse messages of more than n bytes on the whole network.
+func (lt *labrpcTransport) SetMaxMessageSize(n int) {
+	lt.net.SetMaxMessageSize(n)
+}
+
+// register sv's handlers on net as servername.
+func serveLabrpc(net *labrpc.Network, servername interface{}, sv *Server) *labrpc.Server {
+	srv := labrpc.MakeServer()
+	srv.AddService(labrpc.MakeService(sv))
+	sv.setMessageFits(net.FitsMessage)
+	net.AddServer(servername, srv)
+	return srv
+}
+
+// takes a server off a labrpc.Network.
+type labrpcCloser struct {
+	net        *labrpc.Network
+	servername interface{}
+}
+
+func (lc labrpcCloser) Close() error {
+	lc.net.DeleteServer(lc.servername)
+	return nil
+}
@@ -0,0 +1,467 @@
+package commit
+
+//
+// an experimental Transport over UDP, for trying the protocol's
+// commit latency over lossy links without TCP's retransmission and
+// head-of-line blocking getting in the way:
+//
+//   t := MakeUDPTransport()
+//   l, err := t.Listen(":7000", sv)                // on each server
+//   co, err := DialCoordinator(t, addrs, respChan) // on the coordinator
+//
+// each call is one datagram, and its reply another. UDP delivers
+// neither reliably, so the transport has its own retry and ack
+// layer: a peer resends a request every udpResendInterval until
+// the reply arrives, and acks the reply; a listener runs each
+// request once, answers resends of it with the same reply, and
+// forgets the reply once it's acked, or after udpReplyTTL if the
+// ack is lost too. a call with no reply within udpCallTimeout
+// returns false, like a request lost by labrpc.
+//
+// a message must fit in one datagram, so SetMaxMessageSize() can
+// only lower the limit below udpMaxDatagram; larger requests and
+// replies fail with ErrMessageTooLarge. SetDropRate() throws away
+// some of the datagrams a transport's listeners and peers send, to
+// simulate a lossy link. there is no encryption and no congestion
+// control: this is for experiments, not for production.
+//
+
+import (
+	"3PhaseCommit/codec"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	udpMaxDatagram    = 65507 // the most a UDP datagram can carry over IPv4
+	udpResendInterval = 50 * time.Millisecond
+	udpCallTimeout    = tcpCallTimeout
+	udpReplyTTL       = 2 * udpCallTimeout
+)
+
+type UDPTransport struct {
+	maxMessage int     // the most bytes in a datagram; 0 for udpMaxDatagram
+	dropRate   float64 // the fraction of datagrams thrown away as they're sent
+}
+
+func MakeUDPTransport() *UDPTransport {
+	return &UDPTransport{}
+}
+
+// refuse the requests and replies of later Listens and Dials that
+// take more than n bytes once encoded; 0 for udpMaxDatagram, which
+// is also the most n can be.
+func (ut *UDPTransport) SetMaxMessageSize(n int) {
+	ut.maxMessage = n
+}
+
+// throw away each datagram that later Listens and Dials send with
+// probability p, as a lossy link would.
+func (ut *UDPTransport) SetDropRate(p float64) {
+	ut.dropRate = p
+}
+
+func (ut *UDPTransport) limit() int {
+	if ut.maxMessage > 0 && ut.maxMessage < udpMaxDatagram {
+		return ut.maxMessage
+	}
+	return udpMaxDatagram
+}
+
+type udpKind int
+
+const (
+	udpRequest udpKind = iota
+	udpReply
+	udpAck // the peer has the reply, so the listener can forget it
+)
+
+// what each datagram holds, gob-encoded. exported fields only
+// because gob requires them.
+type udpPacket struct {
+	Kind   udpKind
+	ID     uint64 // the call, numbered by the peer that made it
+	Method string // requests only
+	Meta   Metadata
+	Args   *RPCArgs // requests; nil for Query
+	Reply  []byte   // replies: the encoded reply, if any
+	Err    string   // replies: why the listener couldn't answer
+}
+
+func encodePacket(p *udpPacket) ([]byte, error) {
+	return codec.Gob.Marshal(p)
+}
+
+// send b on conn, to addr if conn isn't connected, unless a lossy
+// link would lose it.
+func sendDatagram(conn *net.UDPConn, addr *net.UDPAddr, b []byte, dropRate float64) {
+	if dropRate > 0 && rand.Float64() < dropRate {
+		return
+	}
+	if addr != nil {
+		conn.WriteToUDP(b, addr)
+	} else {
+		conn.Write(b)
+	}
+}
+
+// a Server's handlers, listening on a UDP address.
+type UDPListener struct {
+	conn     *net.UDPConn
+	sv       *Server
+	max      int
+	dropRate float64
+	done     chan struct{} // closed by Close()
+
+	mu      sync.Mutex
+	replies map[udpCallKey]*udpCall
+}
+
+// a call, by the address of the peer that made it and its ID.
+type udpCallKey struct {
+	addr string
+	id   uint64
+}
+
+type udpCall struct {
+	packet []byte    // the encoded reply; nil while the handler runs
+	at     time.Time // when the request first arrived
+}
+
+// listen on addr, e.g. ":7000", or "127.0.0.1:0" for any free port,
+// and serve sv's handlers to each peer.
+func (ut *UDPTransport) Listen(addr string, sv *Server) (*UDPListener, error) {
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &UDPListener{
+		conn:     conn,
+		sv:       sv,
+		max:      ut.limit(),
+		dropRate: ut.dropRate,
+		done:     make(chan struct{}),
+		replies:  make(map[udpCallKey]*udpCall),
+	}
+	sv.setMessageFits(func(msg interface{}) bool {
+		b, err := codec.Gob.Marshal(msg)
+		if err != nil {
+			return false
+		}
+		p, err := encodePacket(&udpPacket{Kind: udpReply, ID: ^uint64(0), Reply: b})
+		return err == nil && len(p) <= l.max
+	})
+	go l.receive()
+	go l.expire()
+	return l, nil
+}
+
+func (ut *UDPTransport) Serve(addr string, sv *Server) (io.Closer, error) {
+	return ut.Listen(addr, sv)
+}
+
+// the address l listens on, with the port filled in.
+func (l *UDPListener) Addr() string {
+	return l.conn.LocalAddr().String()
+}
+
+// stop listening; replies to calls still running are lost.
+func (l *UDPListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	select {
+	case <-l.done:
+		return nil
+	default:
+	}
+	close(l.done)
+	return l.conn.Close()
+}
+
+func (l *UDPListener) receive() {
+	buf := make([]byte, udpMaxDatagram)
+	for {
+		n, from, err := l.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-l.done:
+				return
+			default:
+				continue
+			}
+		}
+		var p udpPacket
+		if err := codec.Gob.Unmarshal(buf[:n], &p); err != nil {
+			continue
+		}
+		key := udpCallKey{from.String(), p.ID}
+
+		l.mu.Lock()
+		switch p.Kind {
+		case udpAck:
+			delete(l.replies, key)
+		case udpRequest:
+			if call, ok := l.replies[key]; ok {
+				// a resend: answer it if the handler has returned
+				if call.packet != nil {
+					sendDatagram(l.conn, from, call.packet, l.dropRate)
+				}
+			} else {
+				l.replies[key] = &udpCall{at: time.Now()}
+				go l.handle(key, from, p)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// run p's handler, and send its reply, keeping it for resends.
+func (l *UDPListener) handle(key udpCallKey, from *net.UDPAddr, p udpPacket) {
+	out := udpPacket{Kind: udpReply, ID: p.ID}
+	reply, err := l.dispatch(p)
+	if err == nil && reply != nil {
+		out.Reply, err = codec.Gob.Marshal(reply)
+	}
+	if err != nil {
+		out.Err = err.Error()
+	}
+	b, err := encodePacket(&out)
+	if err == nil && len(b) > l.max {
+		b, err = encodePacket(&udpPacket{Kind: udpReply, ID: p.ID, Err: ErrMessageTooLarge.Error()})
+	}
+	if err != nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if call, ok := l.replies[key]; ok {
+		call.packet = b
+	}
+	sendDatagram(l.conn, from, b, l.dropRate)
+}
+
+// call p's handler; the reply is nil for Abort, which has none.
+func (l *UDPListener) dispatch(p udpPacket) (interface{}, error) {
+	meta := p.Meta
+	if meta == nil {
+		meta = Metadata{}
+	}
+	if p.Method != "Server.Query" && p.Args == nil {
+		return nil, fmt.Errorf("%s without args", p.Method)
+	}
+
+	switch p.Method {
+	case "Server.Prepare":
+		reply := &PrepareReply{}
+		l.sv.Prepare(meta, p.Args, reply)
+		return reply, nil
+	case "Server.Abort":
+		l.sv.Abort(meta, p.Args, &struct{}{})
+		return nil, nil
+	case "Server.Query":
+		reply := &QueryReply{}
+		l.sv.Query(meta, struct{}{}, reply)
+		return reply, nil
+	case "Server.PreCommit":
+		reply := &PreCommitReply{}
+		l.sv.PreCommit(meta, p.Args, reply)
+		return reply, nil
+	case "Server.Commit":
+		reply := &CommitReply{}
+		l.sv.Commit(meta, p.Args, reply)
+		return reply, nil
+	}
+	return nil, fmt.Errorf("unknown method %s", p.Method)
+}
+
+// forget the replies whose acks were lost, once their peers must
+// have given up on them.
+func (l *UDPListener) expire() {
+	ticker := time.NewTicker(udpReplyTTL / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-l.done:
+			return
+		}
+
+		l.mu.Lock()
+		for key, call := range l.replies {
+			if call.packet != nil && time.Since(call.at) > udpReplyTTL {
+				delete(l.replies, key)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+func (ut *UDPTransport) Dial(addr string) (PeerClient, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	p := &udpPeer{
+		conn:     conn,
+		max:      ut.limit(),
+		dropRate: ut.dropRate,
+		done:     make(chan struct{}),
+		pending:  make(map[uint64]chan udpPacket),
+	}
+	go p.receive()
+	return p, nil
+}
+
+// a PeerClient for the server at one UDP address.
+type udpPeer struct {
+	conn     *net.UDPConn
+	max      int
+	dropRate float64
+	nextID   uint64        // atomic; the last call's ID
+	done     chan struct{} // closed by Close()
+
+	mu      sync.Mutex
+	pending map[uint64]chan udpPacket // call ID : where its reply goes
+	closed  bool
+}
+
+var errUDPTimeout = errors.New("no reply within udpCallTimeout")
+
+func (p *udpPeer) Call(svcMeth string, args interface{}, reply interface{}) bool {
+	return p.CallMeta(svcMeth, nil, args, reply)
+}
+
+func (p *udpPeer) CallMeta(svcMeth string, meta Metadata, args interface{}, reply interface{}) bool {
+	return p.CallErr(svcMeth, meta, args, reply) == nil
+}
+
+func (p *udpPeer) CallErr(svcMeth string, meta Metadata, args interface{}, reply interface{}) error {
+	if !transactionMethod(svcMeth) {
+		return ErrUnsupportedMethod
+	}
+	id := atomic.AddUint64(&p.nextID, 1)
+	rpcArgs, _ := args.(*RPCArgs) // Query's are struct{}{}
+	b, err := encodePacket(&udpPacket{Kind: udpRequest, ID: id, Method: svcMeth, Meta: meta, Args: rpcArgs})
+	if err != nil {
+		return err
+	}
+	if len(b) > p.max {
+		return ErrMessageTooLarge
+	}
+
+	ch := make(chan udpPacket, 1)
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return errPeerClosed
+	}
+	p.pending[id] = ch
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.pending, id)
+		p.mu.Unlock()
+	}()
+
+	resend := time.NewTicker(udpResendInterval)
+	defer resend.Stop()
+	timeout := time.After(udpCallTimeout)
+	for {
+		sendDatagram(p.conn, nil, b, p.dropRate)
+		select {
+		case r := <-ch:
+			if r.Err == ErrMessageTooLarge.Error() {
+				return ErrMessageTooLarge
+			}
+			if r.Err != "" {
+				return errors.New(r.Err)
+			}
+			if r.Reply != nil {
+				return codec.Gob.Unmarshal(r.Reply, reply)
+			}
+			return nil
+		case <-resend.C:
+		case <-timeout:
+			return errUDPTimeout
+		case <-p.done:
+			return errPeerClosed
+		}
+	}
+}
+
+// send the request once, without waiting for the reply.
+func (p *udpPeer) Send(svcMeth string, args interface{}) {
+	rpcArgs, _ := args.(*RPCArgs)
+	id := atomic.AddUint64(&p.nextID, 1)
+	b, err := encodePacket(&udpPacket{Kind: udpRequest, ID: id, Method: svcMeth, Args: rpcArgs})
+	if err != nil || len(b) > p.max {
+		return
+	}
+	sendDatagram(p.conn, nil, b, p.dropRate)
+}
+
+// hand each reply to its call, and ack it, even if the call has
+// given up, so that the listener can forget it.
+func (p *udpPeer) receive() {
+	buf := make([]byte, udpMaxDatagram)
+	for {
+		n, err := p.conn.Read(buf)
+		if err != nil {
+			select {
+			case <-p.done:
+				return
+			default:
+				// e.g. the server isn't listening yet
+				continue
+			}
+		}
+		var r udpPacket
+		if err := codec.Gob.Unmarshal(buf[:n], &r); err != nil || r.Kind != udpReply {
+			continue
+		}
+		if ack, err := encodePacket(&udpPacket{Kind: udpAck, ID: r.ID}); err == nil {
+			sendDatagram(p.conn, nil, ack, p.dropRate)
+		}
+
+		p.mu.Lock()
+		if ch, ok := p.pending[r.ID]; ok {
+			select {
+			case ch <- r:
+			default: // a duplicate of a reply already delivered
+			}
+		}
+		p.mu.Unlock()
+	}
+}
+
+// close the socket; later calls fail.
+func (p *udpPeer) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	close(p.done)
+	return p.conn.Close()
+}
@@ -0,0 +1,89 @@
+package commit
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// Like TestTCPTransport, but over UDP, with the transport's own resends and acks
+// standing in for TCP's
+func TestUDPTransport(t *testing.T) {
+	t.Parallel()
+
+	checkTransportRestart(t, MakeUDPTransport())
+}
+
+// Runs transactions over UDP with a third of all datagrams lost, in both directions
+// Every transaction should commit, each Prepare handler should run once however
+// often its request is resent, and the listener should forget acked replies
+func TestUDPLossyLink(t *testing.T) {
+	t.Parallel()
+
+	tr := MakeUDPTransport()
+	tr.SetDropRate(0.3)
+
+	var mu sync.Mutex
+	prepares := 0
+	keys := []string{"x", "y"}
+	servers := make([]*Server, len(keys))
+	listeners := make([]*UDPListener, len(keys))
+	addrs := make([]string, len(keys))
+	for i, key := range keys {
+		servers[i] = MakeServer([]string{key}, MakePersister())
+		defer servers[i].Kill()
+		servers[i].setHook(func(point hookPoint, method string, tid int, meta Metadata) {
+			if point == hookBefore && method == "Server.Prepare" {
+				mu.Lock()
+				prepares++
+				mu.Unlock()
+			}
+		})
+		l, err := tr.Listen("127.0.0.1:0", servers[i])
+		if err != nil {
+			t.Fatalf("Listen: %v", err)
+		}
+		defer l.Close()
+		listeners[i] = l
+		addrs[i] = l.Addr()
+	}
+
+	respChan := make(chan ResponseMsg)
+	co, err := DialCoordinator(tr, addrs, respChan)
+	if err != nil {
+		t.Fatalf("DialCoordinator: %v", err)
+	}
+	defer co.Kill()
+
+	const n = 10
+	for tid := 0; tid < n; tid++ {
+		servers[0].Set(tid, "x", tid)
+		servers[1].Set(tid, "y", tid)
+		co.FinishTransaction(tid)
+		select {
+		case m := <-respChan:
+			if m.tid != tid || !m.committed {
+				t.Fatalf("expected transaction %d to commit, got %+v", tid, m)
+			}
+		case <-time.After(waitTimeout):
+			t.Fatalf("Transaction %d got no response within %v", tid, waitTimeout)
+		}
+	}
+
+	mu.Lock()
+	// a Prepare that timed out is a new call, and may run again
+	if prepares < 2*n || prepares > 3*n {
+		t.Fatalf("Prepare handlers ran %d times for %d transactions on 2 servers", prepares, n)
+	}
+	mu.Unlock()
+
+	// with no more calls, only replies whose acks were lost remain
+	for _, l := range listeners {
+		l.mu.Lock()
+		kept := len(l.replies)
+		l.mu.Unlock()
+		if kept > 4*n {
+			t.Fatalf("listener kept %d replies after %d transactions", kept, n)
+		}
+	}
+}
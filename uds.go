@@ -0,0 +1,84 @@
+package commit
+
+//
+// a Transport over Unix domain sockets, for a coordinator and
+// servers on the same machine, and for tests that want messages
+// really encoded and sent, without picking free TCP ports:
+//
+//   t := MakeUnixTransport()
+//   l, err := t.Listen("/run/3pc/server0.sock", sv)
+//   co, err := DialCoordinator(t, paths, respChan)
+//
+// it is the TCP transport with socket paths for addresses, so it
+// has the same pools, codecs and message size limits. SetDir()
+// resolves relative paths under a directory. Listen() replaces a
+// socket file left behind by a server that crashed, but not one
+// that a live server is listening on; Close() removes the file.
+//
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+type UnixTransport struct {
+	*TCPTransport
+	dir string // where relative paths are; "" for the working directory
+}
+
+func MakeUnixTransport() *UnixTransport {
+	return &UnixTransport{TCPTransport: &TCPTransport{network: "unix", pool: DefaultPoolConfig()}}
+}
+
+// resolve the relative paths of later Listens and Dials under dir.
+func (ut *UnixTransport) SetDir(dir string) {
+	ut.dir = dir
+}
+
+func (ut *UnixTransport) path(addr string) string {
+	if ut.dir == "" || filepath.IsAbs(addr) {
+		return addr
+	}
+	return filepath.Join(ut.dir, addr)
+}
+
+// listen on the socket at path, and serve sv's handlers to each
+// connection.
+func (ut *UnixTransport) Listen(path string, sv *Server) (*TCPListener, error) {
+	path = ut.path(path)
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	return ut.TCPTransport.Listen(path, sv)
+}
+
+func (ut *UnixTransport) Serve(path string, sv *Server) (io.Closer, error) {
+	return ut.Listen(path, sv)
+}
+
+func (ut *UnixTransport) Dial(path string) (PeerClient, error) {
+	return ut.TCPTransport.Dial(ut.path(path))
+}
+
+// remove the socket at path if nothing is listening on it.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.Mode()&fs.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and isn't a socket", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, tcpDialTimeout); err == nil {
+		conn.Close()
+		return fmt.Errorf("a server is already listening on %s", path)
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,52 @@
+package commit
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+// Like TestTCPTransport, but over Unix domain sockets in a temporary directory,
+// with the restarted server listening on the same path
+func TestUDSTransport(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	checkTransportRestartAt(t, MakeUnixTransport(), []string{filepath.Join(dir, "s0.sock"), filepath.Join(dir, "s1.sock")})
+}
+
+// Leaves a socket file behind, as a crashed server would
+// Listen should replace it, but refuse a path a live server is listening on
+func TestUDSStaleSocket(t *testing.T) {
+	t.Parallel()
+
+	tr := MakeUnixTransport()
+	tr.SetDir(t.TempDir())
+	path := filepath.Join(tr.dir, "server.sock")
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+
+	sv := MakeServer([]string{"x"}, MakePersister())
+	defer sv.Kill()
+	l, err := tr.Listen("server.sock", sv)
+	if err != nil {
+		t.Fatalf("Listen over a stale socket: %v", err)
+	}
+	defer l.Close()
+
+	if _, err := tr.Listen("server.sock", sv); err == nil {
+		t.Fatalf("Listen took over a live server's socket")
+	}
+
+	peer, _ := tr.Dial("server.sock")
+	defer peer.(interface{ Close() error }).Close()
+	reply := &QueryReply{}
+	if err := peer.CallErr("Server.Query", nil, struct{}{}, reply); err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+package commit
+
+//
+// run a test written for a reliable network under harsher ones.
+//
+// a variant says which faults run in the background while the
+// test does its usual work:
+//
+//   stop := cfg.startVariant(variant{unreliable: true, restarts: true})
+//   ... the test's transactions ...
+//   stop()
+//
+// under restarts, the tester finishes every transaction that has
+// no response yet again every variantResendPeriod, as clients
+// would, since a coordinator that restarts before its recovery
+// hears of a transaction leaves it to the client; and it tolerates
+// a transaction reported twice. it resends all of them, not just
+// the one the test is waiting for, since an orphaned transaction
+// may hold locks the awaited one needs. the
+// coordinator only restarts once it has decided a transaction
+// since its last restart, rather than on a timer, or under long
+// reordering it might never hear back from a server in time to
+// decide anything.
+//
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type variant struct {
+	unreliable     bool // drop and briefly delay messages
+	longReordering bool // hold back some replies for up to a few seconds
+	restarts       bool // restart the coordinator soon after each decision
+}
+
+// under restarts, the coordinator restarts up to this long after
+// it decides a transaction.
+const variantRestartDelay = 2 * time.Millisecond
+
+const variantResendPeriod = 500 * time.Millisecond
+
+func (v variant) String() string {
+	var parts []string
+	if v.unreliable {
+		parts = append(parts, "unreliable")
+	}
+	if v.longReordering {
+		parts = append(parts, "reordering")
+	}
+	if v.restarts {
+		parts = append(parts, "restarts")
+	}
+	if len(parts) == 0 {
+		return "reliable"
+	}
+	return strings.Join(parts, "+")
+}
+
+// every combination of faults but none.
+func allVariants() []variant {
+	var vs []variant
+	for bits := 1; bits < 8; bits++ {
+		vs = append(vs, variant{
+			unreliable:     bits&1 != 0,
+			longReordering: bits&2 != 0,
+			restarts:       bits&4 != 0,
+		})
+	}
+	return vs
+}
+
+// start v's faults. the returned function stops them and makes
+// the network reliable again, so that end() can check the result.
+func (cfg *config) startVariant(v variant) func() {
+	cfg.mu.Lock()
+	cfg.setunreliable(v.unreliable)
+	cfg.setlongreordering(v.longReordering)
+	if v.restarts {
+		cfg.duplicates = true
+	}
+	cfg.mu.Unlock()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	if v.restarts {
+		wg.Add(2)
+		cfg.goBackground(func() {
+			defer wg.Done()
+			cfg.resendUnanswered(stop)
+		})
+		cfg.goBackground(func() {
+			defer wg.Done()
+			cfg.restartAfterDecisions(stop)
+		})
+	}
+
+	return func() {
+		close(stop)
+		wg.Wait()
+
+		cfg.mu.Lock()
+		defer cfg.mu.Unlock()
+
+		cfg.setunreliable(false)
+		cfg.setlongreordering(false)
+	}
+}
+
+// restart the coordinator up to variantRestartDelay after each
+// decision, until stop is closed. decisions that come in before
+// the restart share it.
+func (cfg *config) restartAfterDecisions(stop chan struct{}) {
+	cfg.mu.Lock()
+	decided := len(cfg.transactions)
+	cfg.mu.Unlock()
+
+	for {
+		cfg.mu.Lock()
+		pause := time.Duration(cfg.randIntLocked()) % variantRestartDelay
+		cfg.mu.Unlock()
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(pause):
+		}
+
+		cfg.mu.Lock()
+		if len(cfg.transactions) > decided {
+			decided = len(cfg.transactions)
+			cfg.logf("restarting the coordinator")
+			cfg.restartCoordinatorLocked()
+		}
+		cfg.mu.Unlock()
+	}
+}
+
+// finish every transaction that has no response yet again, every
+// variantResendPeriod until stop is closed.
+func (cfg *config) resendUnanswered(stop chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(variantResendPeriod):
+		}
+
+		var tids []int
+		cfg.mu.Lock()
+		for tid := range cfg.calls {
+			if _, ok := cfg.returns[tid]; !ok {
+				tids = append(tids, tid)
+			}
+		}
+		cfg.mu.Unlock()
+
+		slices.Sort(tids)
+		for _, tid := range tids {
+			cfg.logf("resending transaction %d", tid)
+			cfg.finishTransaction(tid)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package commit
+
+//
+// the framing of the logs a Server and a Coordinator write: a
+// Server's write-ahead log (MakeServerWithSnapshots()) and a
+// Coordinator's decision log (MakeCoordinatorWithPersister()).
+//
+// each record is a frame: its length and a CRC-32C of its bytes,
+// 4 bytes each, big-endian, then the labgob-encoded record. records
+// are encoded one after another by one encoder, so a longer log
+// still starts with the bytes of a shorter one, and a frame holds
+// whatever that encoder wrote for its record.
+//
+// reading a log stops at the first frame that is cut short or fails
+// its checksum. if no good frame follows it, it's the last record,
+// torn by a crash while it was written; the Server or Coordinator
+// never answered the request that wrote it, so it's dropped, as if
+// the request never arrived. if a good frame does follow it, the log
+// was damaged in the middle, and records a Server or Coordinator
+// acted on are missing: it may have voted Yes or decided an outcome
+// that it no longer knows about, so it refuses to start rather than
+// break those promises.
+//
+
+import (
+	"3PhaseCommit/labgob"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+const frameHeader = 8 // length and checksum
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// returned by readFrames() when a log is damaged before its last record.
+var errLogDamaged = errors.New("log damaged before its last record")
+
+// writes records as frames.
+type frameWriter struct {
+	out bytes.Buffer
+	rec bytes.Buffer
+	enc *labgob.LabEncoder
+}
+
+func newFrameWriter() *frameWriter {
+	fw := &frameWriter{}
+	fw.enc = labgob.NewEncoder(&fw.rec)
+	return fw
+}
+
+func (fw *frameWriter) encode(record interface{}) {
+	fw.rec.Reset()
+	fw.enc.Encode(record)
+	var header [frameHeader]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(fw.rec.Len()))
+	binary.BigEndian.PutUint32(header[4:8], crc32.Checksum(fw.rec.Bytes(), crcTable))
+	fw.out.Write(header[:])
+	fw.out.Write(fw.rec.Bytes())
+}
+
+func (fw *frameWriter) bytes() []byte {
+	return fw.out.Bytes()
+}
+
+// the frames encoded since the last take(), to be copied before the
+// next encode() overwrites them.
+func (fw *frameWriter) take() []byte {
+	b := fw.out.Bytes()
+	fw.out.Reset()
+	return b
+}
+
+// the records in data, ready for one labgob decoder, up to the first
+// bad frame, and how many bytes from there on were dropped as a torn
+// last record. errLogDamaged if a good frame follows a bad one.
+func readFrames(data []byte) ([]byte, int, error) {
+	frames, torn, err := splitFrames(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	var records bytes.Buffer
+	for _, record := range frames {
+		records.Write(record)
+	}
+	return records.Bytes(), torn, nil
+}
+
+// like readFrames(), but each record on its own, for records encoded
+// by encoders of their own.
+func splitFrames(data []byte) ([][]byte, int, error) {
+	var records [][]byte
+	off := 0
+	for off < len(data) {
+		record, ok := frameAt(data, off)
+		if !ok {
+			if damaged := firstFrameAfter(data, off+1); damaged >= 0 {
+				return nil, 0, fmt.Errorf("%w: bad record at byte %d, good one at byte %d", errLogDamaged, off, damaged)
+			}
+			return records, len(data) - off, nil
+		}
+		records = append(records, record)
+		off += frameHeader + len(record)
+	}
+	return records, 0, nil
+}
+
+// the record framed at data[off:], if the frame is whole and passes
+// its checksum.
+func frameAt(data []byte, off int) ([]byte, bool) {
+	if len(data)-off < frameHeader {
+		return nil, false
+	}
+	n := int(binary.BigEndian.Uint32(data[off : off+4]))
+	if n == 0 || n > len(data)-off-frameHeader {
+		return nil, false
+	}
+	record := data[off+frameHeader : off+frameHeader+n]
+	if crc32.Checksum(record, crcTable) != binary.BigEndian.Uint32(data[off+4:off+8]) {
+		return nil, false
+	}
+	return record, true
+}
+
+// the offset of the first good frame at or after from, or -1. a bad
+// frame's length may be damaged too, so every offset is tried.
+func firstFrameAfter(data []byte, from int) int {
+	for off := from; off+frameHeader < len(data); off++ {
+		if _, ok := frameAt(data, off); ok {
+			return off
+		}
+	}
+	return -1
+}
@@ -0,0 +1,115 @@
+package commit
+
+import (
+	"3PhaseCommit/labgob"
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Flips each byte of a three-record decision log in turn, and reads it back
+// A flip in the last record should drop just that record, as a torn write, and a flip
+// anywhere before it should be reported as damage, never read as a wrong decision
+func TestWALChecksums(t *testing.T) {
+	t.Parallel()
+
+	records := []decisionRecord{{1, PhaseCommitted}, {2, PhaseAborted}, {3, PhaseCommitted}}
+	fw := newFrameWriter()
+	lastStart := 0
+	for _, record := range records {
+		lastStart = len(fw.bytes())
+		fw.encode(record)
+	}
+	log := append([]byte(nil), fw.bytes()...)
+
+	for i := range log {
+		damaged := append([]byte(nil), log...)
+		damaged[i] ^= 0x40
+		framed, torn, err := readFrames(damaged)
+		if i < lastStart {
+			if !errors.Is(err, errLogDamaged) {
+				t.Fatalf("byte %d flipped: expected errLogDamaged, got %v", i, err)
+			}
+			continue
+		}
+		if err != nil || torn != len(log)-lastStart {
+			t.Fatalf("byte %d flipped: expected the last record's %d bytes dropped, got %d (err %v)", i, len(log)-lastStart, torn, err)
+		}
+		var read []decisionRecord
+		r := bytes.NewBuffer(framed)
+		d := labgob.NewDecoder(r)
+		for r.Len() > 0 {
+			var record decisionRecord
+			if err := d.Decode(&record); err != nil {
+				t.Fatalf("byte %d flipped: decoding what's left: %v", i, err)
+			}
+			read = append(read, record)
+		}
+		if !reflect.DeepEqual(read, records[:2]) {
+			t.Fatalf("byte %d flipped: expected the first two records, got %v", i, read)
+		}
+	}
+}
+
+// Restarts a server whose Yes vote is the last record in its log, once with a byte of that
+// record flipped and once with a byte of an earlier commit flipped
+// The first should start as if the Prepare never arrived, keeping the commit; the second
+// should refuse to start, since it has lost a record it acted on
+func TestWALDamagedRestart(t *testing.T) {
+	if os.Getenv("WAL_DAMAGED_RESTART") != "" {
+		ps := MakePersister()
+		ps.Save(walDamagedLog(false))
+		MakeServerWithSnapshots([]string{"x", "y"}, ps, 1<<20)
+		os.Exit(0)
+	}
+	t.Parallel()
+
+	ps := MakePersister()
+	ps.Save(walDamagedLog(true))
+	sv := MakeServerWithSnapshots([]string{"x", "y"}, ps, 1<<20)
+	defer sv.Kill()
+	if v := sv.storeValues()["x"]; v != 1 {
+		t.Fatalf("expected the commit before the damage to survive, got x = %v", v)
+	}
+	if undecided := sv.undecided(); len(undecided) != 0 {
+		t.Fatalf("expected the damaged vote to be dropped, got %v in doubt", undecided)
+	}
+	if locks := sv.heldLocks(); len(locks) != 0 {
+		t.Fatalf("expected no locks held, got %v", locks)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestWALDamagedRestart$")
+	cmd.Env = append(os.Environ(), "WAL_DAMAGED_RESTART=1")
+	out, err := cmd.CombinedOutput()
+	if err == nil || !strings.Contains(string(out), errLogDamaged.Error()) {
+		t.Fatalf("expected a server with a log damaged in the middle to refuse to start, got %v:\n%s", err, out)
+	}
+}
+
+// a server's log with a commit of x and then a Yes vote on y, with a
+// byte flipped in the vote's record if last, or else in the commit's.
+func walDamagedLog(last bool) []byte {
+	ps := MakePersister()
+	sv := MakeServerWithSnapshots([]string{"x", "y"}, ps, 1<<20)
+	defer sv.Kill()
+	args := &RPCArgs{Tid: 0}
+	sv.Set(0, "x", 1)
+	sv.Prepare(Metadata{}, args, &PrepareReply{})
+	sv.PreCommit(Metadata{}, args, &PreCommitReply{})
+	sv.Commit(Metadata{}, args, &CommitReply{})
+	sv.Set(1, "y", 2)
+	before := ps.ServerStateSize()
+	sv.Prepare(Metadata{}, &RPCArgs{Tid: 1}, &PrepareReply{})
+
+	log := ps.ReadServerState()
+	if last {
+		log[len(log)-1] ^= 0x40
+	} else {
+		log[before/2] ^= 0x40
+	}
+	return log
+}
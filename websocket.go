@@ -0,0 +1,199 @@
+package commit
+
+//
+// the gateway's operations over a WebSocket, with JSON messages,
+// for a browser-based demo that runs transactions and shows them
+// moving through the phases as it happens:
+//
+//   ws := new WebSocket("ws://localhost:8080/ws")
+//
+// each request names its op and carries an ID, which the reply or
+// error repeats:
+//
+//   {"id": 1, "op": "begin"}                          -> {"type": "reply", "id": 1, "tid": 0, "status": "open"}
+//   {"id": 2, "op": "set", "tid": 0, "key": "x", "value": 1}
+//   {"id": 3, "op": "get", "tid": 0, "key": "y"}
+//   {"id": 4, "op": "finish", "tid": 0}
+//   {"id": 5, "op": "abort", "tid": 0}
+//   {"id": 6, "op": "status", "tid": 0}
+//   a failed request                                  -> {"type": "error", "id": 2, "error": "..."}
+//
+// every connection also hears of every transaction the Coordinator
+// runs, including those begun elsewhere or picked up by recovery:
+//
+//   {"type": "phase", "tid": 0, "phase": "PreCommit"}   as it changes phase
+//   {"type": "decided", "tid": 0, "status": "committed", "readValues": {"y": 2}}
+//
+// events may arrive before the reply to the request that caused
+// them. a connection that can't keep up with its events is closed.
+//
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+// how many messages a connection may have waiting to be sent.
+const wsBacklog = 256
+
+// a request from a WebSocket client.
+type wsRequest struct {
+	ID    int         `json:"id"`
+	Op    string      `json:"op"`
+	Tid   int         `json:"tid"`
+	Key   string      `json:"key"`
+	Value interface{} `json:"value"`
+}
+
+// what the gateway sends a WebSocket client.
+type wsMessage struct {
+	Type       string                 `json:"type"` // reply, error, phase or decided
+	ID         int                    `json:"id,omitempty"`
+	Tid        int                    `json:"tid"`
+	Status     string                 `json:"status,omitempty"`
+	Phase      string                 `json:"phase,omitempty"`
+	ReadValues map[string]interface{} `json:"readValues,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+	Reason     *TxnError              `json:"reason,omitempty"` // why a decided transaction aborted
+}
+
+// one WebSocket connection.
+type wsClient struct {
+	conn *websocket.Conn
+	out  chan wsMessage // to be sent, by write()
+	once sync.Once
+	gone chan struct{} // closed once the connection is dropped
+}
+
+// a set of WebSocket clients, each told of every event.
+type wsHub struct {
+	mu      sync.Mutex
+	clients map[*wsClient]bool
+}
+
+func (h *wsHub) add(c *wsClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.clients == nil {
+		h.clients = make(map[*wsClient]bool)
+	}
+	h.clients[c] = true
+}
+
+func (h *wsHub) remove(c *wsClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.clients, c)
+}
+
+// send m to every client, without blocking: it may be called with
+// the Coordinator's lock held.
+func (h *wsHub) broadcast(m wsMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for c := range h.clients {
+		c.send(m)
+	}
+}
+
+func (h *wsHub) closeAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for c := range h.clients {
+		c.drop()
+	}
+}
+
+// queue m, dropping the connection if it's too far behind.
+func (c *wsClient) send(m wsMessage) {
+	select {
+	case c.out <- m:
+	case <-c.gone:
+	default:
+		c.drop()
+	}
+}
+
+func (c *wsClient) drop() {
+	c.once.Do(func() {
+		close(c.gone)
+		c.conn.Close()
+	})
+}
+
+func (c *wsClient) write() {
+	for {
+		select {
+		case m := <-c.out:
+			if err := websocket.JSON.Send(c.conn, m); err != nil {
+				c.drop()
+				return
+			}
+		case <-c.gone:
+			return
+		}
+	}
+}
+
+// serve one WebSocket connection until the client goes away.
+func (gw *Gateway) serveWebSocket(conn *websocket.Conn) {
+	c := &wsClient{conn: conn, out: make(chan wsMessage, wsBacklog), gone: make(chan struct{})}
+	gw.hub.add(c)
+	defer gw.hub.remove(c)
+	defer c.drop()
+	go c.write()
+
+	for {
+		var data []byte
+		if err := websocket.Message.Receive(conn, &data); err != nil {
+			return
+		}
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		var req wsRequest
+		if err := dec.Decode(&req); err != nil {
+			c.send(wsMessage{Type: "error", Error: "bad request: " + err.Error()})
+			continue
+		}
+		c.send(gw.handleWebSocket(req))
+	}
+}
+
+// run a request, and return its reply or error.
+func (gw *Gateway) handleWebSocket(req wsRequest) wsMessage {
+	reply := wsMessage{Type: "reply", ID: req.ID, Tid: req.Tid}
+	var err error
+	switch req.Op {
+	case "begin":
+		reply.Tid = gw.beginTransaction()
+		reply.Status = gatewayOpen
+	case "get", "set":
+		err = gw.queue(req.Tid, req.Op == "get", gatewayOperation{Key: req.Key, Value: req.Value})
+		reply.Status = gatewayOpen
+	case "finish":
+		err = gw.finishTransaction(req.Tid)
+		reply.Status = gatewayFinishing
+	case "abort":
+		err = gw.abortTransaction(req.Tid)
+		reply.Status = gatewayAborted
+	case "status":
+		if err = gw.check(req.Tid, ""); err == nil {
+			st := gw.statusOf(req.Tid)
+			reply.Status, reply.Phase, reply.ReadValues, reply.Reason = st.Status, st.Phase, st.ReadValues, st.Reason
+		}
+	default:
+		err = gatewayErrorf(http.StatusBadRequest, "unknown op %q", req.Op)
+	}
+	if err != nil {
+		return wsMessage{Type: "error", ID: req.ID, Tid: req.Tid, Error: err.Error()}
+	}
+	return reply
+}
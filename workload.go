@@ -0,0 +1,166 @@
+package commit
+
+//
+// randomly generated transaction mixes for the 3PC tester.
+//
+// the keys are split into groups, and the values in every group
+// always add up to the same total: a write transaction rewrites
+// a whole group with a new split of the total, and a read sees
+// a whole group at once. a read that doesn't add up, or a final
+// state that doesn't, means some transaction saw or left part
+// of another's writes.
+//
+// w := cfg.makeWorkload()
+// cfg.runWorkload(w)
+//
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type workload struct {
+	groups   [][]string // disjoint groups of keys
+	total    int        // what every group's values add up to
+	readPct  int        // percent of transactions that only read
+	mixedPct int        // percent that read a group, then rewrite it
+	clients  int        // concurrent clients
+	txns     int        // transactions per client
+}
+
+func (w workload) String() string {
+	return fmt.Sprintf("groups %v, %d%% reads, %d%% read-writes, %d clients x %d transactions",
+		w.groups, w.readPct, w.mixedPct, w.clients, w.txns)
+}
+
+// a random workload over all of the tester's keys.
+func (cfg *config) makeWorkload() workload {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+
+	keys := make([]string, 0, len(cfg.keyMap))
+	for _, serverKeys := range cfg.keys {
+		keys = append(keys, serverKeys...)
+	}
+	for i := len(keys) - 1; i > 0; i-- {
+		j := cfg.randIntLocked() % (i + 1)
+		keys[i], keys[j] = keys[j], keys[i]
+	}
+
+	w := workload{total: 100}
+	for len(keys) > 0 {
+		size := 1 + cfg.randIntLocked()%min(len(keys), 4)
+		w.groups = append(w.groups, keys[:size])
+		keys = keys[size:]
+	}
+	w.readPct = cfg.randIntLocked() % 60
+	w.mixedPct = cfg.randIntLocked() % (100 - w.readPct)
+	w.clients = 1 + cfg.randIntLocked()%4
+	w.txns = 5 + cfg.randIntLocked()%10
+	return w
+}
+
+// split the total into random values, one per key of group.
+func (cfg *config) splitTotal(w workload, group []string) map[string]int {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+
+	values := make(map[string]int)
+	left := w.total
+	for i, key := range group {
+		if i == len(group)-1 {
+			values[key] = left
+		} else {
+			values[key] = cfg.randIntLocked() % (left + 1)
+			left -= values[key]
+		}
+	}
+	return values
+}
+
+// the values read from a group must add up to the total.
+func (cfg *config) checkTotal(w workload, group []string, tid int, readValues map[string]interface{}) {
+	sum := 0
+	for _, key := range group {
+		v, ok := readValues[key].(int)
+		if !ok {
+			cfg.t.Fatalf("workload: transaction %d read %v for %s, not a number", tid, readValues[key], key)
+		}
+		sum += v
+	}
+	if sum != w.total {
+		cfg.t.Fatalf("workload: transaction %d read %v from %v, which adds up to %d, not %d",
+			tid, readValues, group, sum, w.total)
+	}
+}
+
+// run one transaction on group until it commits, resending it
+// in case its response is lost. returns the values it read.
+func (cfg *config) workloadTxn(w workload, group []string, read bool, write bool) map[string]interface{} {
+	for {
+		tid := int(cfg.nextTid.Add(1))
+		if read {
+			for _, key := range group {
+				cfg.sendGet(tid, key)
+			}
+		}
+		if write {
+			for key, v := range cfg.splitTotal(w, group) {
+				cfg.sendSet(tid, key, v)
+			}
+		}
+		cfg.finishTransaction(tid)
+
+		resp, ok := cfg.waitTransactionRetrying(tid, time.Second, time.Now().Add(30*time.Second))
+		if !ok {
+			cfg.t.Fatalf("workload: no response for transaction %d", tid)
+		}
+		if resp.committed {
+			if read {
+				cfg.checkTotal(w, group, tid, resp.readValues)
+			}
+			return resp.readValues
+		}
+	}
+}
+
+// initialize every group, run the clients, then check that
+// every group still adds up.
+func (cfg *config) runWorkload(w workload) {
+	cfg.mu.Lock()
+	cfg.duplicates = true // lost responses are resent
+	cfg.mu.Unlock()
+
+	for _, group := range w.groups {
+		cfg.workloadTxn(w, group, false, true)
+	}
+
+	var wg sync.WaitGroup
+	for range w.clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range w.txns {
+				cfg.mu.Lock()
+				group := w.groups[cfg.randIntLocked()%len(w.groups)]
+				kind := cfg.randIntLocked() % 100
+				cfg.mu.Unlock()
+
+				switch {
+				case kind < w.readPct:
+					cfg.workloadTxn(w, group, true, false)
+				case kind < w.readPct+w.mixedPct:
+					cfg.workloadTxn(w, group, true, true)
+				default:
+					cfg.workloadTxn(w, group, false, true)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, group := range w.groups {
+		cfg.workloadTxn(w, group, true, false)
+	}
+}